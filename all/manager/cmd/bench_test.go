@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// benchRecords はベンチマークに使うCSVの行数です（go test -bench . ./cmd -args -records=5000）
+var benchRecords = flag.Int("records", 1000, "ベンチマークに使うCSVの行数")
+
+// benchFixture はベンチマークで共有するCSVと、そのビーコン・アクセスポイントを登録したストアです
+type benchFixture struct {
+	devices     *memoryStore
+	cached      *deviceCache
+	blePath     string
+	wifiPath    string
+	bleSignals  []BeaconSignal
+	wifiSignals []WiFiSignal
+}
+
+// writeBenchCSVs はベンチマークで使うBLE・WiFi CSVを records 行ずつ dir に書き出します。
+// 登録済みのビーコン・アクセスポイントは全体の1割で、実際のアップロードと同様に未登録の端末が大半を占めます
+func writeBenchCSVs(dir string, records int, devices *memoryStore) (string, string, error) {
+	rng := rand.New(rand.NewSource(1))
+	roomID := devices.AddRoom("bench")
+	var ble, wifi bytes.Buffer
+	for i := 0; i < records; i++ {
+		timestamp := 1731585178467 + int64(i)*100
+		serviceUUID := fmt.Sprintf("%08X-0000-0000-0000-%012X", i%200, i%200)
+		bssid := fmt.Sprintf("02:00:00:00:%02x:%02x", (i%200)/256, (i%200)%256)
+		if i%200 < 20 {
+			devices.AddBeacon(serviceUUID, roomID)
+			devices.AddWifi(bssid, roomID)
+		}
+		fmt.Fprintf(&ble, "%d , %s , %d\n", timestamp, serviceUUID, -40-rng.Intn(60))
+		fmt.Fprintf(&wifi, "%d , %s , %d\n", timestamp, bssid, -40-rng.Intn(60))
+	}
+	blePath := filepath.Join(dir, "ble_data.csv")
+	wifiPath := filepath.Join(dir, "wifi_data.csv")
+	if err := os.WriteFile(blePath, ble.Bytes(), 0o644); err != nil {
+		return "", "", fmt.Errorf("ベンチマーク用のCSVの作成に失敗しました: %v", err)
+	}
+	if err := os.WriteFile(wifiPath, wifi.Bytes(), 0o644); err != nil {
+		return "", "", fmt.Errorf("ベンチマーク用のCSVの作成に失敗しました: %v", err)
+	}
+	return blePath, wifiPath, nil
+}
+
+func newBenchFixture(b *testing.B) *benchFixture {
+	b.Helper()
+	logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	ctx := context.Background()
+	devices := newMemoryStore()
+	blePath, wifiPath, err := writeBenchCSVs(b.TempDir(), *benchRecords, devices)
+	if err != nil {
+		b.Fatal(err)
+	}
+	cached := newDeviceCache(devices)
+	if err := cached.refresh(ctx); err != nil {
+		b.Fatal(err)
+	}
+	bleSignals, err := parseBLECSV(ctx, blePath, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	wifiSignals, err := parseWifiCSV(ctx, wifiPath, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	return &benchFixture{
+		devices:     devices,
+		cached:      cached,
+		blePath:     blePath,
+		wifiPath:    wifiPath,
+		bleSignals:  bleSignals,
+		wifiSignals: wifiSignals,
+	}
+}
+
+func BenchmarkParseBLECSV(b *testing.B) {
+	f := newBenchFixture(b)
+	for i := 0; i < b.N; i++ {
+		if _, err := parseBLECSV(context.Background(), f.blePath, 0); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParseWifiCSV(b *testing.B) {
+	f := newBenchFixture(b)
+	for i := 0; i < b.N; i++ {
+		if _, err := parseWifiCSV(context.Background(), f.wifiPath, 0); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRoomByBeacons(b *testing.B) {
+	f := newBenchFixture(b)
+	for i := 0; i < b.N; i++ {
+		getRoomIDByBeacons(context.Background(), f.devices, f.bleSignals)
+	}
+}
+
+func BenchmarkRoomByBeaconsCached(b *testing.B) {
+	f := newBenchFixture(b)
+	for i := 0; i < b.N; i++ {
+		getRoomIDByBeacons(context.Background(), f.cached, f.bleSignals)
+	}
+}
+
+func BenchmarkRoomByWifi(b *testing.B) {
+	f := newBenchFixture(b)
+	for i := 0; i < b.N; i++ {
+		getRoomIDByWifi(context.Background(), f.devices, f.wifiSignals)
+	}
+}
+
+func BenchmarkRoomByWifiCached(b *testing.B) {
+	f := newBenchFixture(b)
+	for i := 0; i < b.N; i++ {
+		getRoomIDByWifi(context.Background(), f.cached, f.wifiSignals)
+	}
+}
+
+func BenchmarkDetermineRoomID(b *testing.B) {
+	f := newBenchFixture(b)
+	for i := 0; i < b.N; i++ {
+		if _, err := determineRoomID(context.Background(), f.cached, f.blePath, f.wifiPath); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+)
+
+// TestValidateRepositoryConfig はリポジトリの config.toml が起動時の検証を通ることを確認します
+func TestValidateRepositoryConfig(t *testing.T) {
+	configPath, err := filepath.Abs("../config.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var config Config
+	if _, err := toml.DecodeFile(configPath, &config); err != nil {
+		t.Fatalf("config.toml の読み取りに失敗しました: %v", err)
+	}
+	applyRuntimeDefaults(&config)
+
+	// 書き込み先のディレクトリは相対パスのため、一時ディレクトリで検証します
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	for _, mode := range config.profileNames() {
+		t.Run(mode, func(t *testing.T) {
+			profile, _ := config.profile(mode)
+			// プロファイルのデータベースには接続できないため、接続先だけ SQLite の一時ファイルに置き換えます
+			problems := validateConfig(context.Background(), config, startupConfig{
+				Mode:             mode,
+				Port:             config.ServerPort,
+				ProxyURLs:        profile.ProxyURL,
+				EstimationURL:    profile.EstimationURL,
+				InquiryURL:       profile.InquiryURL,
+				DBDriver:         "sqlite",
+				DBConnStr:        filepath.Join(dir, mode+".db"),
+				SkipRegistration: profile.SkipRegistration,
+				Storage:          profile.Storage,
+			})
+			for _, problem := range problems {
+				t.Errorf("設定エラー: %s", problem)
+			}
+		})
+	}
+}
+
+func TestValidateHostName(t *testing.T) {
+	tests := []struct {
+		host    string
+		wantErr bool
+	}{
+		{"manager", false},
+		{"manager:8010", false},
+		{"192.0.2.1", false},
+		{"[2001:db8::1]:8010", false},
+		{"http://manager", true},
+		{"manager/api", true},
+		{"manager?debug=1", true},
+		{":8010", true},
+	}
+	for _, tt := range tests {
+		err := validateHostName("http", tt.host)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("validateHostName(%q) = %v, wantErr %v", tt.host, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS
+    fingerprint_samples (
+        sample_id SERIAL PRIMARY KEY,
+        room_id INT NOT NULL,
+        sample_type VARCHAR(20) NOT NULL,
+        wifi_key VARCHAR(255) NOT NULL,
+        ble_key VARCHAR(255) NOT NULL,
+        wifi_sha256 CHAR(64) NOT NULL,
+        ble_sha256 CHAR(64) NOT NULL,
+        wifi_size BIGINT NOT NULL,
+        ble_size BIGINT NOT NULL,
+        collected_at TIMESTAMP NOT NULL,
+        duplicate_count INT NOT NULL DEFAULT 0,
+        last_duplicate_at TIMESTAMP
+    );
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_fingerprint_samples_room_id_sha256 ON fingerprint_samples (room_id, wifi_sha256, ble_sha256);
@@ -0,0 +1,3 @@
+ALTER TABLE fingerprint_samples ADD COLUMN IF NOT EXISTS wifi_records INT NOT NULL DEFAULT 0;
+
+ALTER TABLE fingerprint_samples ADD COLUMN IF NOT EXISTS ble_records INT NOT NULL DEFAULT 0;
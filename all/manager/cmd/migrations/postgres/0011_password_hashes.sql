@@ -0,0 +1,2 @@
+-- Basic認証のパスワードの bcrypt のハッシュ。ハッシュを保存したユーザーは平文のパスワード（password）を削除します
+ALTER TABLE users ADD COLUMN IF NOT EXISTS password_hash VARCHAR(60);
@@ -0,0 +1,13 @@
+-- 同じユーザーの未終了セッションが複数ある場合は、最も新しいもの以外を last_seen の時刻で終了します
+UPDATE user_presence_sessions
+SET end_time = last_seen
+WHERE end_time IS NULL
+  AND EXISTS (
+      SELECT 1 FROM user_presence_sessions AS newer
+      WHERE newer.user_id = user_presence_sessions.user_id
+        AND newer.end_time IS NULL
+        AND (newer.start_time > user_presence_sessions.start_time
+             OR (newer.start_time = user_presence_sessions.start_time AND newer.session_id > user_presence_sessions.session_id))
+  );
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_user_presence_sessions_open_user_id ON user_presence_sessions (user_id) WHERE end_time IS NULL;
@@ -0,0 +1,42 @@
+CREATE TABLE IF NOT EXISTS
+    organizations (
+        org_id SERIAL PRIMARY KEY,
+        name VARCHAR(100) NOT NULL UNIQUE,
+        created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+    );
+
+-- 既存のデータはすべて既定の組織（org_id 1）に属します
+INSERT INTO organizations (org_id, name) VALUES (1, 'default') ON CONFLICT DO NOTHING;
+
+SELECT setval(pg_get_serial_sequence('organizations', 'org_id'), GREATEST((SELECT MAX(org_id) FROM organizations), 1));
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS org_id INT NOT NULL DEFAULT 1 REFERENCES organizations (org_id);
+
+ALTER TABLE rooms ADD COLUMN IF NOT EXISTS org_id INT NOT NULL DEFAULT 1 REFERENCES organizations (org_id);
+
+ALTER TABLE beacons ADD COLUMN IF NOT EXISTS org_id INT NOT NULL DEFAULT 1 REFERENCES organizations (org_id);
+
+ALTER TABLE wifi_access_points ADD COLUMN IF NOT EXISTS org_id INT NOT NULL DEFAULT 1 REFERENCES organizations (org_id);
+
+ALTER TABLE user_presence_sessions ADD COLUMN IF NOT EXISTS org_id INT NOT NULL DEFAULT 1 REFERENCES organizations (org_id);
+
+ALTER TABLE user_presence_sessions_archive ADD COLUMN IF NOT EXISTS org_id INT NOT NULL DEFAULT 1;
+
+ALTER TABLE fingerprint_samples ADD COLUMN IF NOT EXISTS org_id INT NOT NULL DEFAULT 1 REFERENCES organizations (org_id);
+
+ALTER TABLE admin_audit_log ADD COLUMN IF NOT EXISTS org_id INT NOT NULL DEFAULT 1 REFERENCES organizations (org_id);
+
+ALTER TABLE dataset_snapshots ADD COLUMN IF NOT EXISTS org_id INT NOT NULL DEFAULT 1 REFERENCES organizations (org_id);
+
+ALTER TABLE history_access_log ADD COLUMN IF NOT EXISTS org_id INT NOT NULL DEFAULT 1 REFERENCES organizations (org_id);
+
+CREATE INDEX IF NOT EXISTS idx_users_org_id ON users (org_id);
+
+CREATE INDEX IF NOT EXISTS idx_rooms_org_id ON rooms (org_id);
+
+-- ネガティブサンプル（room_id 0）は組織ごとに重複を判定します
+DROP INDEX IF EXISTS idx_fingerprint_samples_room_id_sha256;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_fingerprint_samples_org_id_room_id_sha256 ON fingerprint_samples (org_id, room_id, wifi_sha256, ble_sha256);
+
+CREATE INDEX IF NOT EXISTS idx_user_presence_sessions_org_id ON user_presence_sessions (org_id);
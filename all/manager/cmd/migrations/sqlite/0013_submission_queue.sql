@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS
+    submission_queue (
+        queue_id INTEGER PRIMARY KEY AUTOINCREMENT,
+        user_id INT NOT NULL,
+        upload_id INT,
+        wifi_key VARCHAR(255) NOT NULL,
+        ble_key VARCHAR(255) NOT NULL,
+        submitted_at TIMESTAMP NOT NULL,
+        attempts INT NOT NULL DEFAULT 0,
+        last_error TEXT NOT NULL DEFAULT ''
+    );
+
+CREATE INDEX IF NOT EXISTS idx_submission_queue_submitted_at ON submission_queue (submitted_at);
+
+CREATE INDEX IF NOT EXISTS idx_submission_queue_user_id ON submission_queue (user_id);
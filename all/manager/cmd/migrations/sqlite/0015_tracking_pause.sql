@@ -0,0 +1 @@
+ALTER TABLE users ADD COLUMN tracking_paused_until TIMESTAMP;
@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS
+    history_access_log (
+        access_id INTEGER PRIMARY KEY AUTOINCREMENT,
+        requester VARCHAR(20) NOT NULL,
+        target_user_id INT,
+        endpoint VARCHAR(100) NOT NULL,
+        range_from TIMESTAMP NOT NULL,
+        range_to TIMESTAMP NOT NULL,
+        accessed_at TIMESTAMP NOT NULL
+    );
+
+CREATE INDEX IF NOT EXISTS idx_history_access_log_accessed_at ON history_access_log (accessed_at);
+
+CREATE INDEX IF NOT EXISTS idx_history_access_log_target_user_id ON history_access_log (target_user_id, accessed_at);
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+// registeredRoutes は registerRoutes で登録するパターンを集めます。
+// ハンドラーは呼び出さないため、ストアなどは渡さずに登録だけを行います
+func registeredRoutes(t *testing.T) []string {
+	t.Helper()
+	config := Config{}
+	config.Debug.Enabled = true
+	mux := newRouteMux()
+	registerRoutes(mux, routeDeps{config: config, loc: time.UTC})
+	if len(mux.patterns) == 0 {
+		t.Fatal("登録したルートが見つかりません")
+	}
+	return mux.patterns
+}
+
+func TestOpenAPIRoutes(t *testing.T) {
+	undocumented, unrouted, err := checkOpenAPIRoutes(openAPISpec, registeredRoutes(t))
+	if err != nil {
+		t.Fatalf("APIの仕様とルートの照合に失敗しました: %v", err)
+	}
+	for _, pattern := range undocumented {
+		t.Errorf("APIの仕様（openapi.json）に記載されていないルートです: %s", pattern)
+	}
+	for _, specPath := range unrouted {
+		t.Errorf("APIの仕様（openapi.json）に記載したパスに一致するルートがありません: %s", specPath)
+	}
+}
+
+func TestCheckOpenAPIRoutes(t *testing.T) {
+	spec := []byte(`{"paths": {"/api/rooms": {}, "/api/users/{id}/consent": {}, "/api/removed": {}}}`)
+	tests := []struct {
+		name             string
+		patterns         []string
+		wantUndocumented []string
+		wantUnrouted     []string
+	}{
+		{
+			name:         "一致",
+			patterns:     []string{"/api/rooms", "/api/users/", "/api/removed", "/"},
+			wantUnrouted: nil,
+		},
+		{
+			name:             "記載のないルート",
+			patterns:         []string{"/api/rooms", "/api/users/", "/api/removed", "/api/new"},
+			wantUndocumented: []string{"/api/new"},
+		},
+		{
+			name:         "ルートのないパス",
+			patterns:     []string{"/api/rooms", "/api/users/"},
+			wantUnrouted: []string{"/api/removed"},
+		},
+		{
+			name:         "/api 以外のルートは照合しない",
+			patterns:     []string{"/", "/debug/vars"},
+			wantUnrouted: []string{"/api/removed", "/api/rooms", "/api/users/{id}/consent"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			undocumented, unrouted, err := checkOpenAPIRoutes(spec, tt.patterns)
+			if err != nil {
+				t.Fatalf("照合に失敗しました: %v", err)
+			}
+			if !slices.Equal(undocumented, tt.wantUndocumented) {
+				t.Errorf("記載のないルート = %v, want %v", undocumented, tt.wantUndocumented)
+			}
+			if !slices.Equal(unrouted, tt.wantUnrouted) {
+				t.Errorf("ルートのないパス = %v, want %v", unrouted, tt.wantUnrouted)
+			}
+		})
+	}
+}
+
+func TestRouteMatchesSpecPath(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		specPath string
+		want     bool
+	}{
+		{"/api/rooms", "/api/rooms", true},
+		{"/api/rooms", "/api/rooms/{id}", false},
+		{"/api/rooms", "/api/room", false},
+		{"/api/users/", "/api/users/{id}/consent", true},
+		{"/api/users/", "/api/users/", true},
+		{"/api/users/", "/api/usersettings", false},
+		{"/api/users/{id}/consent", "/api/users/{user_id}/consent", true},
+		{"/api/users/{id}/consent", "/api/users/{id}/export", false},
+		{"/api/users/{id}", "/api/users/{id}/consent", false},
+		{"/api/files/{path...}", "/api/files/{dir}/{name}", true},
+		{"/api/admin/", "/api/users/{id}", false},
+	}
+	for _, tt := range tests {
+		if got := routeMatchesSpecPath(tt.pattern, tt.specPath); got != tt.want {
+			t.Errorf("routeMatchesSpecPath(%q, %q) = %v, want %v", tt.pattern, tt.specPath, got, tt.want)
+		}
+	}
+}
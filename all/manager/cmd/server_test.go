@@ -0,0 +1,787 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ハンドラーのテストはすべて memoryStore を使い、データベースなしで実行します
+func TestMain(m *testing.M) {
+	logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	os.Exit(m.Run())
+}
+
+// testCredentials は memoryStore にないユーザーのパスワードを持つ CredentialStore です
+type testCredentials struct {
+	mu    sync.Mutex
+	users map[string]UserCredential
+}
+
+func newTestCredentials(t *testing.T, passwords map[string]string) *testCredentials {
+	t.Helper()
+	creds := &testCredentials{users: make(map[string]UserCredential)}
+	for username, password := range passwords {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		creds.users[username] = UserCredential{Username: username, Hash: string(hash)}
+	}
+	return creds
+}
+
+func (c *testCredentials) Credential(ctx context.Context, username string) (UserCredential, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	credential, ok := c.users[username]
+	if !ok {
+		return UserCredential{}, sql.ErrNoRows
+	}
+	return credential, nil
+}
+
+func (c *testCredentials) SetPasswordHash(ctx context.Context, username string, hash string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.users[username] = UserCredential{Username: username, Hash: hash}
+	return nil
+}
+
+func (c *testCredentials) LegacyCredentials(ctx context.Context) ([]UserCredential, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var legacy []UserCredential
+	for _, credential := range c.users {
+		if credential.Hash == "" && credential.Legacy != "" {
+			legacy = append(legacy, credential)
+		}
+	}
+	return legacy, nil
+}
+
+// testOrgStore は memoryStore のユーザーを orgs の組織に所属させます。orgs にないユーザーは既定の組織です
+type testOrgStore struct {
+	*memoryStore
+	orgs map[string]int
+}
+
+func (s *testOrgStore) PrincipalOrg(ctx context.Context, username string) (int, error) {
+	if orgID, ok := s.orgs[username]; ok {
+		return orgID, nil
+	}
+	return s.memoryStore.PrincipalOrg(ctx, username)
+}
+
+func (s *testOrgStore) UserOrg(ctx context.Context, userID int) (int, error) {
+	username, err := s.UserName(ctx, userID)
+	if err != nil {
+		return 0, err
+	}
+	return s.PrincipalOrg(ctx, username)
+}
+
+// testEstimationServer は推定信頼度 percentage を返す推定サーバーです。failOn 回目以降の呼び出しには status を返します（0 の場合は失敗しません）
+type testEstimationServer struct {
+	*httptest.Server
+	calls atomic.Int32
+}
+
+func newTestEstimationServer(t *testing.T, percentage int, failOn int32, status int) *testEstimationServer {
+	t.Helper()
+	s := &testEstimationServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if call := s.calls.Add(1); failOn > 0 && call >= failOn {
+			http.Error(w, "unavailable", status)
+			return
+		}
+		json.NewEncoder(w).Encode(PredictionResponse{PredictedPercentage: percentage})
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// testServiceUUID・testBSSID は signalCSVs が書き出すビーコン・WiFiアクセスポイントです
+const (
+	testServiceUUID = "0000FE9A-0000-1000-8000-00805F9B34FB"
+	testBSSID       = "02:00:00:00:00:01"
+)
+
+// signalCSVs は testServiceUUID・testBSSID を受信した ble_data・wifi_data の内容を返します
+func signalCSVs(at time.Time) (string, string) {
+	return fmt.Sprintf("%d , %s , -50\n", at.UnixMilli(), testServiceUUID), fmt.Sprintf("%d , %s , -50\n", at.UnixMilli(), testBSSID)
+}
+
+// testDecision は推定信頼度が 70 を超えた場合に在室と判定し、問い合わせサーバーを使わない在室判定のしきい値です
+var testDecision = DecisionConfig{InquiryMin: 101, InquiryMax: 70}
+
+func authenticatedRequest(r *http.Request, username string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), principalKey, username))
+}
+
+func newSubmitRequest(t *testing.T, username string, at time.Time) *http.Request {
+	t.Helper()
+	ble, wifi := signalCSVs(at)
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for field, content := range map[string]string{"ble_data": ble, "wifi_data": wifi} {
+		part, err := writer.CreateFormFile(field, field+".csv")
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(part, content)
+	}
+	writer.Close()
+	r := httptest.NewRequest(http.MethodPost, "/api/signals/submit", &body)
+	r.Header.Set("Content-Type", writer.FormDataContentType())
+	return authenticatedRequest(r, username)
+}
+
+func TestSignalsSubmit(t *testing.T) {
+	tests := []struct {
+		name       string
+		username   string
+		percentage int
+		wantStatus int
+		wantRoom   bool
+		wantResult string
+	}{
+		{name: "在室", username: "alice", percentage: 90, wantStatus: http.StatusOK, wantRoom: true, wantResult: "present"},
+		{name: "不在", username: "alice", percentage: 10, wantStatus: http.StatusOK, wantResult: "absent"},
+		{name: "未登録のユーザー", username: "mallory", percentage: 90, wantStatus: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newMemoryStore()
+			userID := store.AddUser("alice", false)
+			roomID := store.AddRoom("Room 101")
+			store.AddBeacon(testServiceUUID, roomID)
+			blobs := &localBlobStore{root: t.TempDir()}
+			estimation := newTestEstimationServer(t, tt.percentage, 0, 0)
+
+			w := httptest.NewRecorder()
+			r := newSubmitRequest(t, tt.username, time.Now())
+			handleSignalsSubmit(w, r, r.Context(), signalDeps{presence: store, devices: store, uploads: store, blobs: blobs, usage: newStorageUsage(blobs, QuotaConfig{})}, estimation.URL, "", testDecision, SubmitConfig{}, time.UTC, 5*time.Minute, NegativeSampleConfig{})
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			room, err := store.OpenSessionRoom(context.Background(), userID)
+			if tt.wantRoom && (err != nil || room != roomID) {
+				t.Errorf("在室中のルーム = %d (%v), want %d", room, err, roomID)
+			}
+			if !tt.wantRoom && err == nil {
+				t.Errorf("不在の判定で在室セッション（ルーム %d）が作成されました", room)
+			}
+			decisions, err := store.ListDecisions(context.Background(), &userID, 10)
+			if err != nil || len(decisions) != 1 || decisions[0].Decision != tt.wantResult {
+				t.Errorf("在室判定 = %+v (%v), want %s", decisions, err, tt.wantResult)
+			}
+		})
+	}
+}
+
+func TestAdminGating(t *testing.T) {
+	store := newMemoryStore()
+	store.AddUser("admin", true)
+	store.AddUser("member", false)
+	store.AddUser("tenant_admin", true)
+	store.AddUser("legacy_admin", true)
+	orgs := &testOrgStore{memoryStore: store, orgs: map[string]int{"tenant_admin": 2}}
+	creds := newTestCredentials(t, map[string]string{"admin": "admin-pass", "member": "member-pass", "tenant_admin": "tenant-pass"})
+	creds.users["legacy_admin"] = UserCredential{Username: "legacy_admin", Legacy: "legacy-pass"}
+
+	debugOK := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/vars", func(w http.ResponseWriter, r *http.Request) {
+		handleDebug(w, r, requestContext(r), store, debugOK)
+	})
+	mux.HandleFunc("/api/admin/api_keys", func(w http.ResponseWriter, r *http.Request) {
+		handleAdminAPIKeys(w, r, requestContext(r), store, store)
+	})
+	handler := authenticateRequests(orgMiddleware(mux, orgs, store, store, time.UTC), creds, newCredentialCache())
+
+	tests := []struct {
+		name       string
+		path       string
+		username   string
+		password   string
+		wantStatus int
+	}{
+		{"認証情報なしのデバッグ", "/debug/vars", "", "", http.StatusUnauthorized},
+		{"パスワードが違う", "/debug/vars", "admin", "wrong", http.StatusUnauthorized},
+		{"存在しないユーザー", "/debug/vars", "nobody", "admin-pass", http.StatusUnauthorized},
+		{"管理者でないユーザーのデバッグ", "/debug/vars", "member", "member-pass", http.StatusForbidden},
+		{"既定の組織以外の管理者のデバッグ", "/debug/vars", "tenant_admin", "tenant-pass", http.StatusForbidden},
+		{"既定の組織の管理者のデバッグ", "/debug/vars", "admin", "admin-pass", http.StatusOK},
+		{"平文のパスワードの管理者", "/debug/vars", "legacy_admin", "legacy-pass", http.StatusOK},
+		{"匿名の管理者API", "/api/admin/api_keys", "", "", http.StatusForbidden},
+		{"管理者でないユーザーの管理者API", "/api/admin/api_keys", "member", "member-pass", http.StatusForbidden},
+		{"既定の組織以外の管理者の管理者API", "/api/admin/api_keys", "tenant_admin", "tenant-pass", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.username != "" {
+				r.SetBasicAuth(tt.username, tt.password)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("ステータス = %d, want %d（%s）", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") != basicAuthChallenge {
+				t.Errorf("WWW-Authenticate = %q, want %q", w.Header().Get("WWW-Authenticate"), basicAuthChallenge)
+			}
+		})
+	}
+
+	if credential := creds.users["legacy_admin"]; credential.Hash == "" || credential.Legacy != "" {
+		t.Errorf("平文のパスワードが照合後にハッシュに置き換わっていません: %+v", credential)
+	}
+}
+
+func TestOrgScoping(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	store.AddUser("admin", true)
+	store.AddUser("tenant_admin", true)
+	orgs := &testOrgStore{memoryStore: store, orgs: map[string]int{"tenant_admin": 2}}
+
+	defaultKey, err := store.CreateAPIKey(ctx, APIKey{OrgID: defaultOrgID, Name: "default"}, hashAPIKey("default-key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tenantKey, err := store.CreateAPIKey(ctx, APIKey{OrgID: 2, Name: "tenant"}, hashAPIKey("tenant-key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exhaustedKey, err := store.CreateAPIKey(ctx, APIKey{OrgID: 2, Name: "exhausted", MonthlyQuota: 1}, hashAPIKey("exhausted-key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.MeterRequest(ctx, 2, exhaustedKey, usagePeriod(time.Now(), time.UTC), 1); err != nil {
+		t.Fatal(err)
+	}
+
+	handler := orgMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handleAdminAPIKeys(w, r, requestContext(r), store, store)
+	}), orgs, store, store, time.UTC)
+
+	tests := []struct {
+		name       string
+		username   string
+		apiKey     string
+		wantStatus int
+		wantKeys   []int
+	}{
+		{"既定の組織の管理者は既定の組織のキーのみ", "admin", "", http.StatusOK, []int{defaultKey}},
+		{"組織の管理者は自分の組織のキーのみ", "tenant_admin", "", http.StatusOK, []int{tenantKey, exhaustedKey}},
+		{"同じ組織のAPIキー", "tenant_admin", "tenant-key", http.StatusOK, []int{tenantKey, exhaustedKey}},
+		{"組織の異なるAPIキー", "admin", "tenant-key", http.StatusForbidden, nil},
+		{"無効なAPIキー", "admin", "unknown-key", http.StatusUnauthorized, nil},
+		{"今月の上限に達したAPIキー", "tenant_admin", "exhausted-key", http.StatusTooManyRequests, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := authenticatedRequest(httptest.NewRequest(http.MethodGet, "/api/admin/api_keys", nil), tt.username)
+			if tt.apiKey != "" {
+				r.Header.Set("X-API-Key", tt.apiKey)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("ステータス = %d, want %d（%s）", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			var response APIKeyListResponse
+			if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+			var got []int
+			for _, key := range response.Keys {
+				got = append(got, key.KeyID)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.wantKeys) {
+				t.Errorf("APIキー = %v, want %v", got, tt.wantKeys)
+			}
+		})
+	}
+}
+
+func TestPresenceHistoryConsent(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	roomID := store.AddRoom("lab")
+	consenting := store.AddUser("consenting", false)
+	withdrawn := store.AddUser("withdrawn", false)
+	start := time.Now().UTC().Add(-2 * time.Hour)
+	for _, userID := range []int{consenting, withdrawn} {
+		if err := store.StartSession(ctx, userID, roomID, start, 90, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.SetTrackingConsent(ctx, withdrawn, false, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	// 各ハンドラーの応答に含まれるユーザーIDを返します
+	tests := []struct {
+		name  string
+		serve func(w *httptest.ResponseRecorder, r *http.Request) []int
+	}{
+		{
+			name: "全ユーザーの在室履歴",
+			serve: func(w *httptest.ResponseRecorder, r *http.Request) []int {
+				handlePresenceHistory(w, r, requestContext(r), store, store, time.UTC)
+				var response PresenceHistoryResponse
+				json.NewDecoder(w.Body).Decode(&response)
+				var users []int
+				for _, day := range response.AllHistory {
+					for _, user := range day.Users {
+						users = append(users, user.UserID)
+					}
+				}
+				return users
+			},
+		},
+		{
+			name: "ルームの在室履歴",
+			serve: func(w *httptest.ResponseRecorder, r *http.Request) []int {
+				handleRoomPresenceHistory(w, r, requestContext(r), store, store, store, roomID, time.UTC)
+				var response RoomPresenceHistoryResponse
+				json.NewDecoder(w.Body).Decode(&response)
+				var users []int
+				for _, day := range response.History {
+					for _, session := range day.Sessions {
+						users = append(users, session.UserID)
+					}
+				}
+				return users
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := authenticatedRequest(httptest.NewRequest(http.MethodGet, "/api/presence_history", nil), "consenting")
+			w := httptest.NewRecorder()
+			users := tt.serve(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("ステータス = %d（%s）", w.Code, w.Body.String())
+			}
+			if fmt.Sprint(users) != fmt.Sprint([]int{consenting}) {
+				t.Errorf("ユーザー = %v, want [%d]（同意を取り消したユーザー %d を含めません）", users, consenting, withdrawn)
+			}
+		})
+	}
+}
+
+// syncScan は /api/signals/sync で送るスキャン1件です。scannedAt が空の場合は at を RFC 3339 で送ります
+type syncScan struct {
+	at        time.Time
+	scannedAt string
+}
+
+func newSyncRequest(t *testing.T, username string, scans []syncScan) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for i, scan := range scans {
+		ble, wifi := signalCSVs(scan.at)
+		for _, part := range []struct{ field, content string }{{"ble_data", ble}, {"wifi_data", wifi}} {
+			fw, err := form.CreateFormFile(part.field, fmt.Sprintf("%s_%d.csv", part.field, i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.WriteString(fw, part.content)
+		}
+		scannedAt := scan.scannedAt
+		if scannedAt == "" {
+			scannedAt = scan.at.Format(time.RFC3339)
+		}
+		if err := form.WriteField("scanned_at", scannedAt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := form.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/api/signals/sync", &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	return authenticatedRequest(r, username)
+}
+
+func TestSignalsSyncReconciliation(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	hoursAgo := func(h float64) time.Time { return now.Add(-time.Duration(h * float64(time.Hour))) }
+	submitConfig := SubmitConfig{MaxScanAge: 24 * time.Hour, MaxClockSkew: 5 * time.Minute, RetryAfter: 30 * time.Second}
+
+	tests := []struct {
+		name string
+		// recordedAt は同期する前に記録済みの在室判定の時刻です（ゼロ値の場合は記録なし）
+		recordedAt       time.Time
+		withdrawn        bool
+		queued           bool
+		failOn           int32
+		scans            []syncScan
+		wantStatus       int
+		wantDispositions []string
+		// wantSessions はセッションの開始時刻と、終了している場合の終了時刻です
+		wantSessions [][2]time.Time
+	}{
+		{
+			name:             "スキャンした時刻の順に判定",
+			scans:            []syncScan{{at: hoursAgo(1)}, {at: hoursAgo(2)}},
+			wantStatus:       http.StatusOK,
+			wantDispositions: []string{syncApplied, syncApplied},
+			wantSessions:     [][2]time.Time{{hoursAgo(2)}},
+		},
+		{
+			name:             "記録済みの在室判定以前のスキャンは反映しない",
+			recordedAt:       hoursAgo(1.5),
+			scans:            []syncScan{{at: hoursAgo(2)}, {at: hoursAgo(1)}},
+			wantStatus:       http.StatusOK,
+			wantDispositions: []string{syncSuperseded, syncApplied},
+			wantSessions:     [][2]time.Time{{hoursAgo(1)}},
+		},
+		{
+			name:             "inactivity_timeout を超えて空いたスキャンはセッションを分ける",
+			scans:            []syncScan{{at: hoursAgo(5)}, {at: hoursAgo(1)}},
+			wantStatus:       http.StatusOK,
+			wantDispositions: []string{syncApplied, syncApplied},
+			wantSessions:     [][2]time.Time{{hoursAgo(5), hoursAgo(5)}, {hoursAgo(1)}},
+		},
+		{
+			name:             "時刻の不正なスキャンは拒否",
+			scans:            []syncScan{{at: hoursAgo(48)}, {at: hoursAgo(1), scannedAt: "yesterday"}, {at: hoursAgo(1)}},
+			wantStatus:       http.StatusOK,
+			wantDispositions: []string{syncRejected, syncRejected, syncApplied},
+			wantSessions:     [][2]time.Time{{hoursAgo(1)}},
+		},
+		{
+			name:             "推定サーバーが停止したら以降のスキャンを処理しない",
+			failOn:           2,
+			scans:            []syncScan{{at: hoursAgo(3)}, {at: hoursAgo(2)}, {at: hoursAgo(1)}},
+			wantStatus:       http.StatusOK,
+			wantDispositions: []string{syncApplied, syncFailed, syncNotProcessed},
+			wantSessions:     [][2]time.Time{{hoursAgo(3)}},
+		},
+		{
+			name:             "同意を取り消したユーザーは記録しない",
+			withdrawn:        true,
+			scans:            []syncScan{{at: hoursAgo(2)}, {at: hoursAgo(1)}},
+			wantStatus:       http.StatusOK,
+			wantDispositions: []string{syncNotTracked, syncNotTracked},
+		},
+		{
+			name:       "再送待ちの送信がある間は受け付けない",
+			queued:     true,
+			scans:      []syncScan{{at: hoursAgo(1)}},
+			wantStatus: http.StatusConflict,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := newMemoryStore()
+			roomID := store.AddRoom("lab")
+			store.AddBeacon(testServiceUUID, roomID)
+			store.AddWifi(testBSSID, roomID)
+			userID := store.AddUser("user", false)
+			if !tt.recordedAt.IsZero() {
+				if _, err := store.RecordDecision(ctx, PresenceDecision{UserID: userID, Decision: "absent", DecidedAt: tt.recordedAt}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.withdrawn {
+				store.SetTrackingConsent(ctx, userID, false, now)
+			}
+			if tt.queued {
+				store.EnqueueSubmission(ctx, QueuedSubmission{UserID: userID, SubmittedAt: hoursAgo(2)})
+			}
+			estimation := newTestEstimationServer(t, 90, tt.failOn, http.StatusServiceUnavailable)
+			blobs := &localBlobStore{root: t.TempDir()}
+
+			w := httptest.NewRecorder()
+			r := newSyncRequest(t, "user", tt.scans)
+			handleSignalsSync(w, r, requestContext(r), signalDeps{presence: store, userDevices: store, devices: store, uploads: store, queue: store, blobs: blobs, usage: newStorageUsage(blobs, QuotaConfig{})}, estimation.URL, "", testDecision, submitConfig, time.UTC, time.Minute, 90*time.Minute, NegativeSampleConfig{})
+			if w.Code != tt.wantStatus {
+				t.Fatalf("ステータス = %d, want %d（%s）", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			var response SyncResponse
+			if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+			var dispositions []string
+			for _, scan := range response.Scans {
+				dispositions = append(dispositions, scan.Disposition)
+				if scan.Disposition == syncApplied && scan.RoomID != roomID {
+					t.Errorf("スキャン %d のルーム = %d, want %d", scan.Index, scan.RoomID, roomID)
+				}
+			}
+			if fmt.Sprint(dispositions) != fmt.Sprint(tt.wantDispositions) {
+				t.Errorf("処理の結果 = %v, want %v", dispositions, tt.wantDispositions)
+			}
+
+			sessions, err := store.ListUserSessions(ctx, userID, now.Add(-24*time.Hour), now.Add(time.Hour))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(sessions) != len(tt.wantSessions) {
+				t.Fatalf("セッション = %+v, want %d 件", sessions, len(tt.wantSessions))
+			}
+			for i, want := range tt.wantSessions {
+				if !sessions[i].StartTime.Equal(want[0]) {
+					t.Errorf("セッション %d の開始 = %s, want %s", i, sessions[i].StartTime, want[0])
+				}
+				if want[1].IsZero() != (sessions[i].EndTime == nil) || (sessions[i].EndTime != nil && !sessions[i].EndTime.Equal(want[1])) {
+					t.Errorf("セッション %d の終了 = %v, want %s", i, sessions[i].EndTime, want[1])
+				}
+			}
+		})
+	}
+}
+
+func TestDrainSubmissionQueue(t *testing.T) {
+	previous := settings.Load()
+	t.Cleanup(func() { settings.Store(previous) })
+	now := time.Now().UTC().Truncate(time.Second)
+
+	tests := []struct {
+		name      string
+		withdrawn bool
+		// missingFiles は保存ファイルを削除した送信を再送します
+		missingFiles bool
+		age          time.Duration
+		failOn       int32
+		submissions  int
+		wantQueued   int
+		wantAttempts int
+		wantDecided  int
+		wantCalls    int32
+	}{
+		{name: "再送できた送信は削除", age: time.Hour, submissions: 2, wantDecided: 2, wantCalls: 2},
+		{name: "推定サーバーが停止している間は残して打ち切る", age: time.Hour, failOn: 1, submissions: 2, wantQueued: 2, wantAttempts: 1, wantCalls: 1},
+		{name: "同意を取り消したユーザーの送信は破棄", withdrawn: true, age: time.Hour, submissions: 1},
+		{name: "保存ファイルのない送信は破棄", missingFiles: true, age: time.Hour, submissions: 1},
+		{name: "max_age を過ぎた送信は破棄", age: 3 * time.Hour, submissions: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := newMemoryStore()
+			roomID := store.AddRoom("lab")
+			store.AddBeacon(testServiceUUID, roomID)
+			store.AddWifi(testBSSID, roomID)
+			userID := store.AddUser("user", false)
+			if tt.withdrawn {
+				store.SetTrackingConsent(ctx, userID, false, now)
+			}
+			estimation := newTestEstimationServer(t, 90, tt.failOn, http.StatusServiceUnavailable)
+			settings.Store(&runtimeSettings{EstimationURL: estimation.URL, Decision: testDecision})
+
+			root := t.TempDir()
+			blobs := &localBlobStore{root: root}
+			for i := 0; i < tt.submissions; i++ {
+				submittedAt := now.Add(-tt.age + time.Duration(i)*time.Minute)
+				ble, wifi := signalCSVs(submittedAt)
+				submission := QueuedSubmission{
+					UserID:      userID,
+					BleKey:      fmt.Sprintf("uploads/2024-01-01/user/ble_data_%d.csv", i),
+					WifiKey:     fmt.Sprintf("uploads/2024-01-01/user/wifi_data_%d.csv", i),
+					SubmittedAt: submittedAt,
+				}
+				if !tt.missingFiles {
+					for key, content := range map[string]string{submission.BleKey: ble, submission.WifiKey: wifi} {
+						if err := os.MkdirAll(filepath.Dir(blobs.path(key)), 0o755); err != nil {
+							t.Fatal(err)
+						}
+						if err := os.WriteFile(blobs.path(key), []byte(content), 0o644); err != nil {
+							t.Fatal(err)
+						}
+					}
+				}
+				if _, err := store.EnqueueSubmission(ctx, submission); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			drainSubmissionQueue(ctx, signalDeps{presence: store, devices: store, uploads: store, queue: store, orgs: store, tenants: store, blobs: blobs}, RetryQueueConfig{MaxAge: 2 * time.Hour, BatchSize: 10}, time.Minute, NegativeSampleConfig{}, time.UTC)
+
+			queued, err := store.QueuedSubmissions(ctx, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(queued) != tt.wantQueued {
+				t.Fatalf("キューに残った送信 = %d, want %d", len(queued), tt.wantQueued)
+			}
+			// 打ち切った場合は先頭の送信だけ試行回数を記録し、後ろの送信は試行しません
+			for i, submission := range queued {
+				want := 0
+				if i == 0 {
+					want = tt.wantAttempts
+				}
+				if submission.Attempts != want {
+					t.Errorf("送信 %d の試行回数 = %d, want %d", submission.QueueID, submission.Attempts, want)
+				}
+			}
+			decisions, err := store.ListDecisions(ctx, &userID, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(decisions) != tt.wantDecided {
+				t.Errorf("在室判定 = %d 件, want %d 件", len(decisions), tt.wantDecided)
+			}
+			if got := estimation.calls.Load(); got != tt.wantCalls {
+				t.Errorf("推定サーバーの呼び出し = %d, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestEncryptedBlobStore(t *testing.T) {
+	ctx := context.Background()
+	aead, err := newBlobCipher(StorageEncryptionConfig{Key: "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="})
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := &localBlobStore{root: t.TempDir()}
+	blobs := &encryptedBlobStore{BlobStore: local, aead: aead}
+
+	for _, size := range []int{0, 1, encryptedBlobChunkSize, encryptedBlobChunkSize + 1, 3 * encryptedBlobChunkSize} {
+		t.Run(fmt.Sprint(size), func(t *testing.T) {
+			plaintext := bytes.Repeat([]byte("0123456789"), size/10+1)[:size]
+			key := fmt.Sprintf("uploads/%d.csv", size)
+			if err := blobs.Put(ctx, key, bytes.NewReader(plaintext), int64(size)); err != nil {
+				t.Fatalf("Put: %v", err)
+			}
+			infos, err := local.List(ctx, key)
+			if err != nil || len(infos) != 1 {
+				t.Fatalf("List = %v, %v", infos, err)
+			}
+			if want := blobs.sealedSize(int64(size)); infos[0].Size != want {
+				t.Errorf("暗号化したオブジェクトの大きさ = %d, want %d", infos[0].Size, want)
+			}
+			reader, err := blobs.Get(ctx, key)
+			if err != nil {
+				t.Fatalf("Get: %v", err)
+			}
+			got, err := io.ReadAll(reader)
+			reader.Close()
+			if err != nil || !bytes.Equal(got, plaintext) {
+				t.Errorf("復号した内容が一致しません（%d バイト, %v）", len(got), err)
+			}
+		})
+	}
+
+	readAll := func(key string) error {
+		reader, err := blobs.Get(ctx, key)
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+		_, err = io.ReadAll(reader)
+		return err
+	}
+	sealed := func(key string) []byte {
+		data, err := os.ReadFile(local.path(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	key := fmt.Sprintf("uploads/%d.csv", 3*encryptedBlobChunkSize)
+
+	t.Run("別のキーへのすり替え", func(t *testing.T) {
+		if err := local.Put(ctx, "uploads/moved.csv", bytes.NewReader(sealed(key)), -1); err != nil {
+			t.Fatal(err)
+		}
+		if err := readAll("uploads/moved.csv"); err == nil {
+			t.Error("別のキーに移したオブジェクトを復号できました")
+		}
+	})
+	t.Run("チャンク単位の切り詰め", func(t *testing.T) {
+		data := sealed(key)
+		truncated := data[:len(data)-(encryptedBlobChunkSize+aead.Overhead())]
+		if err := local.Put(ctx, key, bytes.NewReader(truncated), -1); err != nil {
+			t.Fatal(err)
+		}
+		if err := readAll(key); err == nil {
+			t.Error("切り詰めたオブジェクトを復号できました")
+		}
+	})
+	t.Run("平文の大きさの不一致", func(t *testing.T) {
+		if err := blobs.Put(ctx, "uploads/short.csv", bytes.NewReader([]byte("abc")), 4); err == nil {
+			t.Error("指定した大きさと異なる平文を保存できました")
+		}
+	})
+	t.Run("暗号化していないオブジェクト", func(t *testing.T) {
+		if err := local.Put(ctx, "uploads/plain.csv", bytes.NewReader([]byte("plain")), 5); err != nil {
+			t.Fatal(err)
+		}
+		if err := readAll("uploads/plain.csv"); err == nil {
+			t.Error("allow_plaintext なしで暗号化していないオブジェクトを読み込めました")
+		}
+		blobs := &encryptedBlobStore{BlobStore: local, aead: aead, allowPlaintext: true}
+		reader, err := blobs.Get(ctx, "uploads/plain.csv")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer reader.Close()
+		if got, err := io.ReadAll(reader); err != nil || string(got) != "plain" {
+			t.Errorf("allow_plaintext で読み込んだ内容 = %q, %v", got, err)
+		}
+	})
+}
+
+func TestStatsPrivacyNoise(t *testing.T) {
+	newPrivacy := func(key string) *statsPrivacy {
+		p := &statsPrivacy{minUsers: 5, epsilon: 1, key: []byte(key)}
+		p.window("heatmap", time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC), time.Date(2026, 4, 8, 0, 0, 0, 0, time.UTC))
+		return p
+	}
+	privacy := newPrivacy("key")
+	first := privacy.noise(10, 1, "1:9")
+	// 繰り返し問い合わせても同じノイズになり、平均して取り除くことはできません
+	for i := 0; i < 10; i++ {
+		if got := newPrivacy("key").noise(10, 1, "1:9"); got != first {
+			t.Fatalf("同じセルのノイズが変わりました: %v, want %v", got, first)
+		}
+	}
+	if privacy.noise(10, 1, "1:10") == first && privacy.noise(10, 1, "2:9") == first {
+		t.Errorf("異なるセルに同じノイズを加えています")
+	}
+	if newPrivacy("other").noise(10, 1, "1:9") == first {
+		t.Errorf("鍵が異なるのに同じノイズを加えています")
+	}
+	var disabled *statsPrivacy
+	if got := disabled.noise(10, 1, "1:9"); got != 10 {
+		t.Errorf("秘匿モードでない場合の値 = %v, want 10", got)
+	}
+}
@@ -0,0 +1,1325 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	_ OrgStore             = (*memoryStore)(nil)
+	_ BuildingStore        = (*memoryStore)(nil)
+	_ LeaseStore           = (*memoryStore)(nil)
+	_ IdempotencyStore     = (*memoryStore)(nil)
+	_ APIKeyStore          = (*memoryStore)(nil)
+	_ UsageStore           = (*memoryStore)(nil)
+	_ TenantSettingsStore  = (*memoryStore)(nil)
+	_ IdentityLinkStore    = (*memoryStore)(nil)
+	_ BuildingAdminStore   = (*memoryStore)(nil)
+	_ RoomAdminStore       = (*memoryStore)(nil)
+	_ UserDeviceStore      = (*memoryStore)(nil)
+	_ PresenceStore        = (*memoryStore)(nil)
+	_ DeviceStore          = (*memoryStore)(nil)
+	_ FingerprintStore     = (*memoryStore)(nil)
+	_ AuditStore           = (*memoryStore)(nil)
+	_ HistoryAccessStore   = (*memoryStore)(nil)
+	_ DatasetStore         = (*memoryStore)(nil)
+	_ UploadStore          = (*memoryStore)(nil)
+	_ SubmissionQueueStore = (*memoryStore)(nil)
+)
+
+// memoryStore は PresenceStore と DeviceStore のインメモリ実装です。
+// データベースを用意せずにハンドラを動かすためのフェイクで、内容はプロセスの終了とともに失われます。
+// すべてのデータを既定の組織のものとして扱います。
+type memoryStore struct {
+	mu sync.Mutex
+	// presenceMu は UpsertPresence の読み取りから書き込みまでを直列化します（各操作は mu を取るため別のロックにしています）
+	presenceMu  sync.Mutex
+	users       map[string]int
+	admins      map[string]bool
+	rooms       map[int]string
+	beacons     map[string]int
+	wifi        map[string]int
+	sessions    []memorySession
+	transitions []RoomTransition
+	decisions   []PresenceDecision
+	samples     []FingerprintSample
+	audit       []AuditEntry
+	access      []HistoryAccessEntry
+	snapshots   []DatasetSnapshot
+	uploads     []UploadRecord
+	queue       []QueuedSubmission
+	nextQueueID int
+	consents    map[int]TrackingConsent
+	idempotency map[string]memoryIdempotentResult
+	apiKeys     []memoryAPIKey
+	usage       map[memoryUsageKey]int64
+	tenants     map[int]TenantSettingsRecord
+	identities  []IdentityLink
+	// buildingAdmins は建物の管理の委任です。memoryStore には建物がないため、委任した建物のルームはありません
+	buildingAdmins []BuildingAdmin
+	// managedBeacons は登録したビーコンです。beacons はこのうちルームに割り当てたもののサービスUUIDからルームへの対応です
+	managedBeacons []ManagedBeacon
+	userDevices    []UserDevice
+}
+
+type memoryAPIKey struct {
+	APIKey
+	hash string
+}
+
+type memoryUsageKey struct {
+	orgID  int
+	keyID  int
+	period string
+	metric string
+}
+
+type memoryIdempotentResult struct {
+	IdempotentResult
+	createdAt time.Time
+}
+
+type memorySession struct {
+	PresenceSession
+	EstimationConfidence int
+	InquiryConfidence    int
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		users:    make(map[string]int),
+		admins:   make(map[string]bool),
+		consents: make(map[int]TrackingConsent),
+		rooms:    make(map[int]string),
+		beacons:  make(map[string]int),
+		wifi:     make(map[string]int),
+	}
+}
+
+func (m *memoryStore) AddUser(username string, admin bool) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id := len(m.users) + 1
+	m.users[username] = id
+	m.admins[username] = admin
+	return id
+}
+
+func (m *memoryStore) AddRoom(roomName string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id := len(m.rooms) + 1
+	m.rooms[id] = roomName
+	return id
+}
+
+func (m *memoryStore) AddBeacon(serviceUUID string, roomID int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.managedBeacons = append(m.managedBeacons, ManagedBeacon{BeaconID: len(m.managedBeacons) + 1, BeaconName: serviceUUID, ServiceUUID: serviceUUID, RoomID: &roomID})
+	m.beacons[strings.ToUpper(serviceUUID)] = roomID
+}
+
+// indexBeacons は managedBeacons から beacons を作り直します。呼び出し側で mu を取得している必要があります
+func (m *memoryStore) indexBeacons() {
+	m.beacons = make(map[string]int)
+	for _, beacon := range m.managedBeacons {
+		if beacon.RoomID != nil && beacon.ServiceUUID != "" {
+			m.beacons[strings.ToUpper(beacon.ServiceUUID)] = *beacon.RoomID
+		}
+	}
+}
+
+func (m *memoryStore) AddWifi(bssid string, roomID int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.wifi[strings.ToLower(bssid)] = roomID
+}
+
+func (m *memoryStore) PingContext(ctx context.Context) error {
+	return nil
+}
+
+func (m *memoryStore) PrincipalOrg(ctx context.Context, username string) (int, error) {
+	if _, err := m.UserIDByName(ctx, username); err != nil {
+		return 0, err
+	}
+	return defaultOrgID, nil
+}
+
+func (m *memoryStore) UserOrg(ctx context.Context, userID int) (int, error) {
+	if _, err := m.UserName(ctx, userID); err != nil {
+		return 0, err
+	}
+	return defaultOrgID, nil
+}
+
+func (m *memoryStore) Organization(ctx context.Context, orgID int) (Organization, error) {
+	if orgID != defaultOrgID {
+		return Organization{}, sql.ErrNoRows
+	}
+	return Organization{OrgID: defaultOrgID, Name: "default"}, nil
+}
+
+func (m *memoryStore) Organizations(ctx context.Context) ([]Organization, error) {
+	return []Organization{{OrgID: defaultOrgID, Name: "default"}}, nil
+}
+
+// memoryStore のルームは階に割り当てられていないため、建物・階は常に空です
+func (m *memoryStore) Buildings(ctx context.Context) ([]Building, error) {
+	return []Building{}, nil
+}
+
+func (m *memoryStore) Building(ctx context.Context, buildingID int) (Building, error) {
+	return Building{}, sql.ErrNoRows
+}
+
+func (m *memoryStore) Floor(ctx context.Context, floorID int) (Floor, error) {
+	return Floor{}, sql.ErrNoRows
+}
+
+func (m *memoryStore) UserIDByName(ctx context.Context, username string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id, ok := m.users[username]
+	if !ok {
+		return 0, sql.ErrNoRows
+	}
+	return id, nil
+}
+
+func (m *memoryStore) UserName(ctx context.Context, userID int) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for username, id := range m.users {
+		if id == userID {
+			return username, nil
+		}
+	}
+	return "", sql.ErrNoRows
+}
+
+func (m *memoryStore) TrackingConsent(ctx context.Context, userID int) (TrackingConsent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if consent, ok := m.consents[userID]; ok {
+		return consent, nil
+	}
+	for _, id := range m.users {
+		if id == userID {
+			return TrackingConsent{UserID: userID, Consent: true}, nil
+		}
+	}
+	return TrackingConsent{}, sql.ErrNoRows
+}
+
+func (m *memoryStore) SetTrackingConsent(ctx context.Context, userID int, consent bool, updatedAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.consents[userID] = TrackingConsent{UserID: userID, Consent: consent, UpdatedAt: &updatedAt, PausedUntil: m.consents[userID].PausedUntil}
+	return nil
+}
+
+func (m *memoryStore) SetTrackingPause(ctx context.Context, userID int, until *time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	consent, ok := m.consents[userID]
+	if !ok {
+		consent = TrackingConsent{UserID: userID, Consent: true}
+	}
+	consent.PausedUntil = until
+	m.consents[userID] = consent
+	return nil
+}
+
+func (m *memoryStore) UsersWithoutConsent(ctx context.Context) (map[int]bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	users := make(map[int]bool)
+	for userID, consent := range m.consents {
+		if !consent.Consent {
+			users[userID] = true
+		}
+	}
+	return users, nil
+}
+
+func (m *memoryStore) IsAdmin(ctx context.Context, username string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.admins[username], nil
+}
+
+func (m *memoryStore) RoomIDsByBeacons(ctx context.Context, serviceUUIDs []string) (map[string]int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rooms := make(map[string]int)
+	for _, serviceUUID := range serviceUUIDs {
+		if roomID, ok := m.beacons[strings.ToUpper(serviceUUID)]; ok {
+			rooms[strings.ToUpper(serviceUUID)] = roomID
+		}
+	}
+	return rooms, nil
+}
+
+func (m *memoryStore) RoomIDsByWifi(ctx context.Context, bssids []string) (map[string]int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rooms := make(map[string]int)
+	for _, bssid := range bssids {
+		if roomID, ok := m.wifi[strings.ToLower(bssid)]; ok {
+			rooms[strings.ToLower(bssid)] = roomID
+		}
+	}
+	return rooms, nil
+}
+
+func (m *memoryStore) RoomMappings(ctx context.Context) (map[int]RoomMappings, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mappings := RoomMappings{Beacons: make(map[string]int, len(m.beacons)), Wifi: make(map[string]int, len(m.wifi))}
+	for key, roomID := range m.beacons {
+		mappings.Beacons[key] = roomID
+	}
+	for key, roomID := range m.wifi {
+		mappings.Wifi[key] = roomID
+	}
+	return map[int]RoomMappings{defaultOrgID: mappings}, nil
+}
+
+func (m *memoryStore) RoomName(ctx context.Context, roomID int) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	roomName, ok := m.rooms[roomID]
+	if !ok {
+		return "", sql.ErrNoRows
+	}
+	return roomName, nil
+}
+
+func (m *memoryStore) OpenSessionRoom(ctx context.Context, userID int) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, session := range m.sessions {
+		if session.UserID == userID && session.EndTime == nil {
+			return session.RoomID, nil
+		}
+	}
+	return 0, sql.ErrNoRows
+}
+
+func (m *memoryStore) StartSession(ctx context.Context, userID int, roomID int, startTime time.Time, estimationConfidence int, inquiryConfidence int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sessions = append(m.sessions, memorySession{
+		PresenceSession: PresenceSession{
+			SessionID: len(m.sessions) + 1,
+			UserID:    userID,
+			RoomID:    roomID,
+			StartTime: startTime,
+			LastSeen:  startTime,
+		},
+		EstimationConfidence: estimationConfidence,
+		InquiryConfidence:    inquiryConfidence,
+	})
+	return nil
+}
+
+func (m *memoryStore) EndOpenSessions(ctx context.Context, userID int, endTime time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var count int64
+	for i := range m.sessions {
+		if m.sessions[i].UserID == userID && m.sessions[i].EndTime == nil {
+			end := endTime
+			m.sessions[i].EndTime = &end
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (m *memoryStore) TouchOpenSession(ctx context.Context, userID int, lastSeen time.Time, estimationConfidence int, inquiryConfidence int) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var count int64
+	for i := range m.sessions {
+		if m.sessions[i].UserID == userID && m.sessions[i].EndTime == nil {
+			m.sessions[i].LastSeen = lastSeen
+			m.sessions[i].EstimationConfidence = estimationConfidence
+			m.sessions[i].InquiryConfidence = inquiryConfidence
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (m *memoryStore) LatestClosedSession(ctx context.Context, userID int, endedAfter time.Time) (int, int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var latest *memorySession
+	for i := range m.sessions {
+		session := &m.sessions[i]
+		if session.UserID != userID || session.EndTime == nil || session.EndTime.Before(endedAfter) {
+			continue
+		}
+		if latest == nil || session.EndTime.After(*latest.EndTime) {
+			latest = session
+		}
+	}
+	if latest == nil {
+		return 0, 0, sql.ErrNoRows
+	}
+	return latest.SessionID, latest.RoomID, nil
+}
+
+func (m *memoryStore) ReopenSession(ctx context.Context, sessionID int, lastSeen time.Time, estimationConfidence int, inquiryConfidence int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.sessions {
+		if m.sessions[i].SessionID == sessionID {
+			m.sessions[i].EndTime = nil
+			m.sessions[i].LastSeen = lastSeen
+			m.sessions[i].EstimationConfidence = estimationConfidence
+			m.sessions[i].InquiryConfidence = inquiryConfidence
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+func (m *memoryStore) EndStaleSessions(ctx context.Context, cutoff time.Time, endTime time.Time) ([]PresenceSession, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var ended []PresenceSession
+	for i := range m.sessions {
+		if m.sessions[i].EndTime == nil && m.sessions[i].LastSeen.Before(cutoff) {
+			end := endTime
+			m.sessions[i].EndTime = &end
+			ended = append(ended, m.sessions[i].PresenceSession)
+		}
+	}
+	return ended, nil
+}
+
+func (m *memoryStore) DuplicateOpenSessions(ctx context.Context) ([]PresenceSession, error) {
+	open := m.filterSessions(func(session PresenceSession) bool {
+		return session.EndTime == nil
+	})
+	counts := make(map[int]int)
+	for _, session := range open {
+		counts[session.UserID]++
+	}
+	var sessions []PresenceSession
+	for _, session := range open {
+		if counts[session.UserID] > 1 {
+			sessions = append(sessions, session)
+		}
+	}
+	sort.SliceStable(sessions, func(i, j int) bool {
+		return sessions[i].UserID < sessions[j].UserID
+	})
+	return sessions, nil
+}
+
+func (m *memoryStore) CloseSessionAtLastSeen(ctx context.Context, sessionID int) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.sessions {
+		if m.sessions[i].SessionID == sessionID && m.sessions[i].EndTime == nil {
+			end := m.sessions[i].LastSeen
+			m.sessions[i].EndTime = &end
+			return 1, nil
+		}
+	}
+	return 0, nil
+}
+
+func (m *memoryStore) UpsertPresence(ctx context.Context, update PresenceUpdate) (PresenceOutcome, error) {
+	m.presenceMu.Lock()
+	defer m.presenceMu.Unlock()
+	return upsertPresenceSteps(ctx, m, update)
+}
+
+func (m *memoryStore) PurgeSessions(ctx context.Context, endedBefore time.Time, archive bool, archivedAt time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var kept []memorySession
+	var removed int64
+	for _, session := range m.sessions {
+		if session.EndTime != nil && session.EndTime.Before(endedBefore) {
+			removed++
+			continue
+		}
+		kept = append(kept, session)
+	}
+	m.sessions = kept
+	return removed, nil
+}
+
+func (m *memoryStore) PurgeDecisions(ctx context.Context, before time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var kept []PresenceDecision
+	for _, decision := range m.decisions {
+		if !decision.DecidedAt.Before(before) {
+			kept = append(kept, decision)
+		}
+	}
+	removed := int64(len(m.decisions) - len(kept))
+	m.decisions = kept
+	return removed, nil
+}
+
+func (m *memoryStore) PurgeTransitions(ctx context.Context, before time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var kept []RoomTransition
+	for _, transition := range m.transitions {
+		if !transition.TransitionedAt.Before(before) {
+			kept = append(kept, transition)
+		}
+	}
+	removed := int64(len(m.transitions) - len(kept))
+	m.transitions = kept
+	return removed, nil
+}
+
+func (m *memoryStore) RecordTransition(ctx context.Context, transition RoomTransition) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	transition.TransitionID = len(m.transitions) + 1
+	m.transitions = append(m.transitions, transition)
+	return nil
+}
+
+func (m *memoryStore) RecordDecision(ctx context.Context, decision PresenceDecision) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	decision.DecisionID = len(m.decisions) + 1
+	m.decisions = append(m.decisions, decision)
+	return decision.DecisionID, nil
+}
+
+func (m *memoryStore) ListDecisions(ctx context.Context, userID *int, limit int) ([]PresenceDecision, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	decisions := []PresenceDecision{}
+	for i := len(m.decisions) - 1; i >= 0 && len(decisions) < limit; i-- {
+		if userID != nil && m.decisions[i].UserID != *userID {
+			continue
+		}
+		decisions = append(decisions, m.decisions[i])
+	}
+	return decisions, nil
+}
+
+// filterSessions は条件に合うセッションを (start_time, session_id) 順に返します
+func (m *memoryStore) filterSessions(match func(PresenceSession) bool) []PresenceSession {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var sessions []PresenceSession
+	for _, session := range m.sessions {
+		if match(session.PresenceSession) {
+			sessions = append(sessions, session.PresenceSession)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		if !sessions[i].StartTime.Equal(sessions[j].StartTime) {
+			return sessions[i].StartTime.Before(sessions[j].StartTime)
+		}
+		return sessions[i].SessionID < sessions[j].SessionID
+	})
+	return sessions
+}
+
+func inRange(t time.Time, from time.Time, to time.Time) bool {
+	return !t.Before(from) && t.Before(to)
+}
+
+func (m *memoryStore) ListSessions(ctx context.Context, from time.Time, to time.Time, after *sessionCursor, limit int) ([]PresenceSession, error) {
+	sessions := m.filterSessions(func(session PresenceSession) bool {
+		if !inRange(session.StartTime, from, to) {
+			return false
+		}
+		if after != nil {
+			if session.StartTime.Before(after.StartTime) {
+				return false
+			}
+			if session.StartTime.Equal(after.StartTime) && session.SessionID <= after.SessionID {
+				return false
+			}
+		}
+		return true
+	})
+	if limit > 0 && len(sessions) > limit {
+		sessions = sessions[:limit]
+	}
+	return sessions, nil
+}
+
+func (m *memoryStore) ListUserSessions(ctx context.Context, userID int, from time.Time, to time.Time) ([]PresenceSession, error) {
+	return m.filterSessions(func(session PresenceSession) bool {
+		return session.UserID == userID && inRange(session.StartTime, from, to)
+	}), nil
+}
+
+func (m *memoryStore) ListRoomSessions(ctx context.Context, roomID int, from time.Time, to time.Time) ([]PresenceSession, error) {
+	return m.filterSessions(func(session PresenceSession) bool {
+		return session.RoomID == roomID && inRange(session.StartTime, from, to)
+	}), nil
+}
+
+func (m *memoryStore) ListUserTransitions(ctx context.Context, userID int, from time.Time, to time.Time) ([]RoomTransition, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	transitions := []RoomTransition{}
+	for _, transition := range m.transitions {
+		if transition.UserID == userID && inRange(transition.TransitionedAt, from, to) {
+			transitions = append(transitions, transition)
+		}
+	}
+	sort.Slice(transitions, func(i, j int) bool {
+		return transitions[i].TransitionedAt.Before(transitions[j].TransitionedAt)
+	})
+	return transitions, nil
+}
+
+func (m *memoryStore) FingerprintSampleByHash(ctx context.Context, roomID int, wifiSHA256 string, bleSHA256 string) (FingerprintSample, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, sample := range m.samples {
+		if sample.RoomID == roomID && sample.WifiSHA256 == wifiSHA256 && sample.BleSHA256 == bleSHA256 {
+			return sample, nil
+		}
+	}
+	return FingerprintSample{}, sql.ErrNoRows
+}
+
+func (m *memoryStore) FingerprintSampleByID(ctx context.Context, sampleID int) (FingerprintSample, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, sample := range m.samples {
+		if sample.SampleID == sampleID {
+			return sample, nil
+		}
+	}
+	return FingerprintSample{}, sql.ErrNoRows
+}
+
+func (m *memoryStore) ListFingerprintSamples(ctx context.Context, filter FingerprintSampleFilter) ([]FingerprintSample, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var samples []FingerprintSample
+	for _, sample := range m.samples {
+		if sample.SampleID <= filter.AfterID || (filter.RoomID != nil && sample.RoomID != *filter.RoomID) ||
+			(filter.SampleType != "" && sample.SampleType != filter.SampleType) {
+			continue
+		}
+		if filter.Limit > 0 && len(samples) >= filter.Limit {
+			break
+		}
+		samples = append(samples, sample)
+	}
+	return samples, nil
+}
+
+func (m *memoryStore) RecordFingerprintSample(ctx context.Context, sample FingerprintSample) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sample.SampleID = len(m.samples) + 1
+	m.samples = append(m.samples, sample)
+	return sample.SampleID, nil
+}
+
+func (m *memoryStore) MarkFingerprintDuplicate(ctx context.Context, sampleID int, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.samples {
+		if m.samples[i].SampleID == sampleID {
+			m.samples[i].DuplicateCount++
+			m.samples[i].LastDuplicateAt = &at
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) RelabelFingerprintSample(ctx context.Context, sample FingerprintSample) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.samples {
+		if m.samples[i].SampleID == sample.SampleID {
+			m.samples[i].RoomID = sample.RoomID
+			m.samples[i].SampleType = sample.SampleType
+			m.samples[i].WifiKey = sample.WifiKey
+			m.samples[i].BleKey = sample.BleKey
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) DeleteFingerprintSample(ctx context.Context, sampleID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.samples {
+		if m.samples[i].SampleID == sampleID {
+			m.samples = append(m.samples[:i], m.samples[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) RecordAudit(ctx context.Context, entry AuditEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry.AuditID = len(m.audit) + 1
+	m.audit = append(m.audit, entry)
+	return nil
+}
+
+func (m *memoryStore) ListAudit(ctx context.Context, limit int) ([]AuditEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entries := []AuditEntry{}
+	for i := len(m.audit) - 1; i >= 0 && len(entries) < limit; i-- {
+		entries = append(entries, m.audit[i])
+	}
+	return entries, nil
+}
+
+func (m *memoryStore) RecordHistoryAccess(ctx context.Context, entry HistoryAccessEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry.AccessID = len(m.access) + 1
+	m.access = append(m.access, entry)
+	return nil
+}
+
+func (m *memoryStore) ListHistoryAccess(ctx context.Context, filter HistoryAccessFilter) ([]HistoryAccessEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entries := []HistoryAccessEntry{}
+	for i := len(m.access) - 1; i >= 0; i-- {
+		entry := m.access[i]
+		if (filter.Requester != "" && entry.Requester != filter.Requester) ||
+			(filter.TargetUserID != nil && entry.TargetUserID != nil && *entry.TargetUserID != *filter.TargetUserID) {
+			continue
+		}
+		if filter.Limit > 0 && len(entries) >= filter.Limit {
+			break
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (m *memoryStore) RecordUpload(ctx context.Context, record UploadRecord) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	record.UploadID = len(m.uploads) + 1
+	m.uploads = append(m.uploads, record)
+	return record.UploadID, nil
+}
+
+func (m *memoryStore) EnqueueSubmission(ctx context.Context, submission QueuedSubmission) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nextQueueID++
+	submission.QueueID = m.nextQueueID
+	m.queue = append(m.queue, submission)
+	return submission.QueueID, nil
+}
+
+func (m *memoryStore) HasQueuedSubmissions(ctx context.Context, userID int) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, submission := range m.queue {
+		if submission.UserID == userID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *memoryStore) QueuedSubmissions(ctx context.Context, limit int) ([]QueuedSubmission, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	submissions := append([]QueuedSubmission{}, m.queue...)
+	sort.SliceStable(submissions, func(i, j int) bool {
+		return submissions[i].SubmittedAt.Before(submissions[j].SubmittedAt)
+	})
+	if len(submissions) > limit {
+		submissions = submissions[:limit]
+	}
+	return submissions, nil
+}
+
+func (m *memoryStore) DeleteQueuedSubmission(ctx context.Context, queueID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, submission := range m.queue {
+		if submission.QueueID == queueID {
+			m.queue = append(m.queue[:i], m.queue[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) RecordSubmissionAttempt(ctx context.Context, queueID int, lastError string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.queue {
+		if m.queue[i].QueueID == queueID {
+			m.queue[i].Attempts++
+			m.queue[i].LastError = lastError
+		}
+	}
+	return nil
+}
+
+// memoryStore は1つのプロセスの中だけで使うため、リースは常に取得できます
+func (m *memoryStore) AcquireLease(ctx context.Context, name string, holder string, now time.Time, ttl time.Duration) (bool, error) {
+	return true, nil
+}
+
+func (m *memoryStore) ReserveIdempotencyKey(ctx context.Context, principal string, key string, path string, now time.Time) (bool, IdempotentResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id := principal + "\x00" + key
+	if stored, ok := m.idempotency[id]; ok {
+		return false, stored.IdempotentResult, nil
+	}
+	if m.idempotency == nil {
+		m.idempotency = make(map[string]memoryIdempotentResult)
+	}
+	m.idempotency[id] = memoryIdempotentResult{IdempotentResult: IdempotentResult{Path: path}, createdAt: now}
+	return true, IdempotentResult{}, nil
+}
+
+func (m *memoryStore) CompleteIdempotencyKey(ctx context.Context, principal string, key string, result IdempotentResult) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id := principal + "\x00" + key
+	if stored, ok := m.idempotency[id]; ok {
+		stored.StatusCode, stored.ContentType, stored.Body = result.StatusCode, result.ContentType, result.Body
+		m.idempotency[id] = stored
+	}
+	return nil
+}
+
+func (m *memoryStore) ReleaseIdempotencyKey(ctx context.Context, principal string, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id := principal + "\x00" + key
+	if stored, ok := m.idempotency[id]; ok && stored.StatusCode == 0 {
+		delete(m.idempotency, id)
+	}
+	return nil
+}
+
+func (m *memoryStore) DeleteExpiredIdempotencyKeys(ctx context.Context, before time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var removed int64
+	for id, stored := range m.idempotency {
+		if stored.createdAt.Before(before) {
+			delete(m.idempotency, id)
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+func (m *memoryStore) APIKeyByHash(ctx context.Context, hash string) (APIKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, key := range m.apiKeys {
+		if key.hash == hash && key.RevokedAt == nil {
+			return key.APIKey, nil
+		}
+	}
+	return APIKey{}, sql.ErrNoRows
+}
+
+func (m *memoryStore) APIKeys(ctx context.Context) ([]APIKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	orgID := orgFromContext(ctx)
+	keys := []APIKey{}
+	for _, key := range m.apiKeys {
+		if orgID == 0 || key.OrgID == orgID {
+			keys = append(keys, key.APIKey)
+		}
+	}
+	return keys, nil
+}
+
+func (m *memoryStore) CreateAPIKey(ctx context.Context, key APIKey, hash string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key.KeyID = len(m.apiKeys) + 1
+	m.apiKeys = append(m.apiKeys, memoryAPIKey{APIKey: key, hash: hash})
+	return key.KeyID, nil
+}
+
+func (m *memoryStore) RevokeAPIKey(ctx context.Context, keyID int, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	orgID := orgFromContext(ctx)
+	if keyID <= 0 || keyID > len(m.apiKeys) {
+		return sql.ErrNoRows
+	}
+	key := &m.apiKeys[keyID-1]
+	if key.RevokedAt != nil || (orgID != 0 && key.OrgID != orgID) {
+		return sql.ErrNoRows
+	}
+	key.RevokedAt = &at
+	return nil
+}
+
+func (m *memoryStore) MeterRequest(ctx context.Context, orgID int, keyID int, period string, quota int64) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id := memoryUsageKey{orgID: orgID, keyID: keyID, period: period, metric: usageRequests}
+	if quota > 0 && m.usage[id] >= quota {
+		return false, nil
+	}
+	if m.usage == nil {
+		m.usage = make(map[memoryUsageKey]int64)
+	}
+	m.usage[id]++
+	return true, nil
+}
+
+func (m *memoryStore) AddUsage(ctx context.Context, orgID int, keyID int, period string, metric string, n int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.usage == nil {
+		m.usage = make(map[memoryUsageKey]int64)
+	}
+	m.usage[memoryUsageKey{orgID: orgID, keyID: keyID, period: period, metric: metric}] += n
+	return nil
+}
+
+func (m *memoryStore) Usage(ctx context.Context, period string) ([]UsageCounter, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	orgID := orgFromContext(ctx)
+	counters := []UsageCounter{}
+	for id, count := range m.usage {
+		if id.period == period && (orgID == 0 || id.orgID == orgID) {
+			counters = append(counters, UsageCounter{OrgID: id.orgID, KeyID: id.keyID, Metric: id.metric, Count: count})
+		}
+	}
+	sort.Slice(counters, func(i, j int) bool {
+		if counters[i].OrgID != counters[j].OrgID {
+			return counters[i].OrgID < counters[j].OrgID
+		}
+		if counters[i].KeyID != counters[j].KeyID {
+			return counters[i].KeyID < counters[j].KeyID
+		}
+		return counters[i].Metric < counters[j].Metric
+	})
+	return counters, nil
+}
+
+func (m *memoryStore) TenantSettings(ctx context.Context, orgID int) (TenantSettingsRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	record, ok := m.tenants[orgID]
+	if !ok {
+		return TenantSettingsRecord{OrgID: orgID}, sql.ErrNoRows
+	}
+	return record, nil
+}
+
+func (m *memoryStore) AllTenantSettings(ctx context.Context) (map[int]TenantSettings, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	all := make(map[int]TenantSettings, len(m.tenants))
+	for orgID, record := range m.tenants {
+		all[orgID] = record.Settings
+	}
+	return all, nil
+}
+
+func (m *memoryStore) SetTenantSettings(ctx context.Context, record TenantSettingsRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.tenants == nil {
+		m.tenants = make(map[int]TenantSettingsRecord)
+	}
+	m.tenants[record.OrgID] = record
+	return nil
+}
+
+func (m *memoryStore) DeleteTenantSettings(ctx context.Context, orgID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.tenants[orgID]; !ok {
+		return sql.ErrNoRows
+	}
+	delete(m.tenants, orgID)
+	return nil
+}
+
+func (m *memoryStore) IdentityLinks(ctx context.Context) ([]IdentityLink, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	orgID := orgFromContext(ctx)
+	links := []IdentityLink{}
+	for _, link := range m.identities {
+		if orgID == 0 || link.OrgID == orgID {
+			links = append(links, link)
+		}
+	}
+	sort.Slice(links, func(i, j int) bool {
+		if links[i].Identity != links[j].Identity {
+			return links[i].Identity < links[j].Identity
+		}
+		if links[i].Site != links[j].Site {
+			return links[i].Site < links[j].Site
+		}
+		return links[i].UserID < links[j].UserID
+	})
+	return links, nil
+}
+
+func (m *memoryStore) CreateIdentityLink(ctx context.Context, link IdentityLink) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	link.LinkID = 1
+	for _, existing := range m.identities {
+		if existing.OrgID == link.OrgID && existing.Site == link.Site && existing.UserID == link.UserID {
+			return 0, sql.ErrNoRows
+		}
+		if existing.LinkID >= link.LinkID {
+			link.LinkID = existing.LinkID + 1
+		}
+	}
+	m.identities = append(m.identities, link)
+	return link.LinkID, nil
+}
+
+func (m *memoryStore) DeleteIdentityLink(ctx context.Context, linkID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	orgID := orgFromContext(ctx)
+	for i, link := range m.identities {
+		if link.LinkID == linkID && (orgID == 0 || link.OrgID == orgID) {
+			m.identities = append(m.identities[:i], m.identities[i+1:]...)
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+func (m *memoryStore) UserDevices(ctx context.Context, userID int) ([]UserDevice, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	devices := []UserDevice{}
+	for _, device := range m.userDevices {
+		if device.UserID == userID {
+			devices = append(devices, device)
+		}
+	}
+	return devices, nil
+}
+
+func (m *memoryStore) UserDevice(ctx context.Context, deviceID int) (UserDevice, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, device := range m.userDevices {
+		if device.DeviceID == deviceID {
+			return device, nil
+		}
+	}
+	return UserDevice{}, sql.ErrNoRows
+}
+
+func (m *memoryStore) CreateUserDevice(ctx context.Context, device UserDevice) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	device.DeviceID = 1
+	for _, existing := range m.userDevices {
+		if existing.DeviceID >= device.DeviceID {
+			device.DeviceID = existing.DeviceID + 1
+		}
+	}
+	m.userDevices = append(m.userDevices, device)
+	return device.DeviceID, nil
+}
+
+func (m *memoryStore) DeleteUserDevice(ctx context.Context, deviceID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, device := range m.userDevices {
+		if device.DeviceID == deviceID {
+			m.userDevices = append(m.userDevices[:i], m.userDevices[i+1:]...)
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+func (m *memoryStore) TouchUserDevice(ctx context.Context, deviceID int, seenAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, device := range m.userDevices {
+		if device.DeviceID == deviceID && (device.LastSeenAt == nil || device.LastSeenAt.Before(seenAt)) {
+			m.userDevices[i].LastSeenAt = &seenAt
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) BuildingAdmins(ctx context.Context) ([]BuildingAdmin, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	orgID := orgFromContext(ctx)
+	admins := []BuildingAdmin{}
+	for _, admin := range m.buildingAdmins {
+		if orgID == 0 || admin.OrgID == orgID {
+			admins = append(admins, admin)
+		}
+	}
+	return admins, nil
+}
+
+func (m *memoryStore) AdminBuildingIDs(ctx context.Context, username string) ([]int, error) {
+	userID, err := m.UserIDByName(ctx, username)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	orgID := orgFromContext(ctx)
+	var buildingIDs []int
+	for _, admin := range m.buildingAdmins {
+		if admin.UserID == userID && (orgID == 0 || admin.OrgID == orgID) {
+			buildingIDs = append(buildingIDs, admin.BuildingID)
+		}
+	}
+	return buildingIDs, nil
+}
+
+func (m *memoryStore) GrantBuildingAdmin(ctx context.Context, admin BuildingAdmin) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, existing := range m.buildingAdmins {
+		if existing.UserID == admin.UserID && existing.BuildingID == admin.BuildingID {
+			return sql.ErrNoRows
+		}
+	}
+	m.buildingAdmins = append(m.buildingAdmins, admin)
+	return nil
+}
+
+func (m *memoryStore) RevokeBuildingAdmin(ctx context.Context, userID int, buildingID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	orgID := orgFromContext(ctx)
+	for i, admin := range m.buildingAdmins {
+		if admin.UserID == userID && admin.BuildingID == buildingID && (orgID == 0 || admin.OrgID == orgID) {
+			m.buildingAdmins = append(m.buildingAdmins[:i], m.buildingAdmins[i+1:]...)
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+// memoryStore のルームは階に割り当てられていないため、floor_id は常に null です
+func (m *memoryStore) ManagedRooms(ctx context.Context) ([]ManagedRoom, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rooms := []ManagedRoom{}
+	for roomID, roomName := range m.rooms {
+		rooms = append(rooms, ManagedRoom{RoomID: roomID, RoomName: roomName})
+	}
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].RoomID < rooms[j].RoomID })
+	return rooms, nil
+}
+
+func (m *memoryStore) ManagedRoom(ctx context.Context, roomID int) (ManagedRoom, error) {
+	roomName, err := m.RoomName(ctx, roomID)
+	if err != nil {
+		return ManagedRoom{}, err
+	}
+	return ManagedRoom{RoomID: roomID, RoomName: roomName}, nil
+}
+
+func (m *memoryStore) CreateRoom(ctx context.Context, room ManagedRoom) (int, error) {
+	return m.AddRoom(room.RoomName), nil
+}
+
+func (m *memoryStore) UpdateRoom(ctx context.Context, room ManagedRoom) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.rooms[room.RoomID]; !ok {
+		return sql.ErrNoRows
+	}
+	m.rooms[room.RoomID] = room.RoomName
+	return nil
+}
+
+func (m *memoryStore) ManagedBeacons(ctx context.Context) ([]ManagedBeacon, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]ManagedBeacon{}, m.managedBeacons...), nil
+}
+
+func (m *memoryStore) ManagedBeacon(ctx context.Context, beaconID int) (ManagedBeacon, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, beacon := range m.managedBeacons {
+		if beacon.BeaconID == beaconID {
+			return beacon, nil
+		}
+	}
+	return ManagedBeacon{}, sql.ErrNoRows
+}
+
+func (m *memoryStore) CreateBeacon(ctx context.Context, beacon ManagedBeacon) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	beacon.BeaconID = 1
+	for _, existing := range m.managedBeacons {
+		if existing.BeaconID >= beacon.BeaconID {
+			beacon.BeaconID = existing.BeaconID + 1
+		}
+	}
+	m.managedBeacons = append(m.managedBeacons, beacon)
+	m.indexBeacons()
+	return beacon.BeaconID, nil
+}
+
+func (m *memoryStore) UpdateBeacon(ctx context.Context, beacon ManagedBeacon) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, existing := range m.managedBeacons {
+		if existing.BeaconID == beacon.BeaconID {
+			m.managedBeacons[i].BeaconName = beacon.BeaconName
+			m.managedBeacons[i].RoomID = beacon.RoomID
+			m.indexBeacons()
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+func (m *memoryStore) DeleteBeacon(ctx context.Context, beaconID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, beacon := range m.managedBeacons {
+		if beacon.BeaconID == beaconID {
+			m.managedBeacons = append(m.managedBeacons[:i], m.managedBeacons[i+1:]...)
+			m.indexBeacons()
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+func (m *memoryStore) LinkUploadDecision(ctx context.Context, uploadID int, decisionID int, roomID *int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if uploadID <= 0 || uploadID > len(m.uploads) {
+		return nil
+	}
+	m.uploads[uploadID-1].DecisionID = &decisionID
+	m.uploads[uploadID-1].RoomID = roomID
+	return nil
+}
+
+func (m *memoryStore) ListUploads(ctx context.Context, filter UploadFilter) ([]UploadRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var records []UploadRecord
+	for _, record := range m.uploads {
+		if record.UploadID <= filter.AfterID || (filter.UserName != "" && record.UserName != filter.UserName) || (filter.Kind != "" && record.Kind != filter.Kind) ||
+			(filter.DecisionID != nil && (record.DecisionID == nil || *record.DecisionID != *filter.DecisionID)) {
+			continue
+		}
+		if filter.Limit > 0 && len(records) >= filter.Limit {
+			break
+		}
+		if record.DecisionID != nil && *record.DecisionID <= len(m.decisions) {
+			record.Decision = m.decisions[*record.DecisionID-1].Decision
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+func (m *memoryStore) CreateSnapshot(ctx context.Context, snapshot DatasetSnapshot) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	snapshot.SnapshotID = len(m.snapshots) + 1
+	snapshot.Manifest = nil
+	m.snapshots = append(m.snapshots, snapshot)
+	return snapshot.SnapshotID, nil
+}
+
+func (m *memoryStore) ListSnapshots(ctx context.Context) ([]DatasetSnapshot, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	snapshots := []DatasetSnapshot{}
+	for i := len(m.snapshots) - 1; i >= 0; i-- {
+		snapshot := m.snapshots[i]
+		snapshot.ManifestJSON = ""
+		snapshots = append(snapshots, snapshot)
+	}
+	return snapshots, nil
+}
+
+func (m *memoryStore) SnapshotByName(ctx context.Context, name string) (DatasetSnapshot, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, snapshot := range m.snapshots {
+		if snapshot.Name == name {
+			return snapshot, nil
+		}
+	}
+	return DatasetSnapshot{}, sql.ErrNoRows
+}
+
+func (m *memoryStore) FingerprintDedupStats(ctx context.Context) (FingerprintDedupStats, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats := FingerprintDedupStats{Samples: len(m.samples)}
+	for _, sample := range m.samples {
+		stats.DuplicateUploads += sample.DuplicateCount
+		stats.DuplicateBytes += int64(sample.DuplicateCount) * (sample.WifiSize + sample.BleSize)
+	}
+	return stats, nil
+}
+
+func (m *memoryStore) CurrentOccupants(ctx context.Context) ([]RoomOccupants, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	usernames := make(map[int]string)
+	for username, id := range m.users {
+		usernames[id] = username
+	}
+
+	rooms := []RoomOccupants{}
+	for roomID, roomName := range m.rooms {
+		room := RoomOccupants{RoomID: roomID, RoomName: roomName, Occupants: []CurrentOccupant{}}
+		for _, session := range m.sessions {
+			if session.RoomID == roomID && session.EndTime == nil {
+				room.Occupants = append(room.Occupants, CurrentOccupant{UserID: usernames[session.UserID], LastSeen: session.LastSeen})
+			}
+		}
+		sort.Slice(room.Occupants, func(i, j int) bool {
+			return room.Occupants[i].UserID < room.Occupants[j].UserID
+		})
+		rooms = append(rooms, room)
+	}
+	return rooms, nil
+}
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS
+    room_transitions (
+        transition_id SERIAL PRIMARY KEY,
+        user_id INT REFERENCES Users (id),
+        from_room_id INT REFERENCES rooms (room_id),
+        to_room_id INT REFERENCES rooms (room_id),
+        transitioned_at TIMESTAMP NOT NULL
+    );
+
+CREATE INDEX IF NOT EXISTS idx_room_transitions_user_id_transitioned_at ON room_transitions (user_id, transitioned_at);
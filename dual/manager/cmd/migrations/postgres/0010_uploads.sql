@@ -0,0 +1,20 @@
+CREATE TABLE IF NOT EXISTS
+    uploads (
+        upload_id SERIAL PRIMARY KEY,
+        kind VARCHAR(20) NOT NULL,
+        user_name VARCHAR(20) NOT NULL,
+        room_id INT,
+        decision_id INT,
+        sample_id INT,
+        wifi_key VARCHAR(255) NOT NULL,
+        ble_key VARCHAR(255) NOT NULL,
+        wifi_size BIGINT NOT NULL,
+        ble_size BIGINT NOT NULL,
+        wifi_sha256 CHAR(64) NOT NULL,
+        ble_sha256 CHAR(64) NOT NULL,
+        uploaded_at TIMESTAMP NOT NULL
+    );
+
+CREATE INDEX IF NOT EXISTS idx_uploads_user_name_uploaded_at ON uploads (user_name, uploaded_at);
+
+CREATE INDEX IF NOT EXISTS idx_uploads_decision_id ON uploads (decision_id);
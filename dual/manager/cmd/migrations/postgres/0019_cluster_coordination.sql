@@ -0,0 +1,20 @@
+CREATE TABLE IF NOT EXISTS
+    job_leases (
+        job_name VARCHAR(100) PRIMARY KEY,
+        holder VARCHAR(255) NOT NULL,
+        expires_at TIMESTAMP NOT NULL
+    );
+
+CREATE TABLE IF NOT EXISTS
+    idempotency_keys (
+        principal VARCHAR(255) NOT NULL,
+        idempotency_key VARCHAR(255) NOT NULL,
+        request_path VARCHAR(255) NOT NULL,
+        status_code INT,
+        content_type VARCHAR(255) NOT NULL DEFAULT '',
+        response_body TEXT NOT NULL DEFAULT '',
+        created_at TIMESTAMP NOT NULL,
+        PRIMARY KEY (principal, idempotency_key)
+    );
+
+CREATE INDEX IF NOT EXISTS idx_idempotency_keys_created_at ON idempotency_keys (created_at);
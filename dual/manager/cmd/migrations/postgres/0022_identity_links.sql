@@ -0,0 +1,14 @@
+-- 集約モードで、サイトごとに異なるユーザーIDを同じ人物（identity）として結び付ける対応表
+CREATE TABLE IF NOT EXISTS
+    identity_links (
+        link_id SERIAL PRIMARY KEY,
+        org_id INT NOT NULL DEFAULT 1 REFERENCES organizations (org_id),
+        identity VARCHAR(100) NOT NULL,
+        site VARCHAR(100) NOT NULL,
+        user_id INT NOT NULL,
+        created_by VARCHAR(20) NOT NULL,
+        created_at TIMESTAMP NOT NULL,
+        UNIQUE (org_id, site, user_id)
+    );
+
+CREATE INDEX IF NOT EXISTS idx_identity_links_org_id_identity ON identity_links (org_id, identity);
@@ -0,0 +1,12 @@
+-- 建物の管理をユーザーに委任する対応表。委任されたユーザーはその建物のルーム・ビーコンとそのルームの履歴だけを管理できます
+CREATE TABLE IF NOT EXISTS
+    building_admins (
+        user_id INT NOT NULL REFERENCES users (id),
+        building_id INT NOT NULL REFERENCES buildings (building_id),
+        org_id INT NOT NULL DEFAULT 1 REFERENCES organizations (org_id),
+        created_by VARCHAR(20) NOT NULL,
+        created_at TIMESTAMP NOT NULL,
+        PRIMARY KEY (user_id, building_id)
+    );
+
+CREATE INDEX IF NOT EXISTS idx_building_admins_org_id ON building_admins (org_id);
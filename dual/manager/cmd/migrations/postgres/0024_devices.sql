@@ -0,0 +1,17 @@
+-- ユーザーが信号の送信に使う端末。1人のユーザーは複数の端末を登録でき、送信ごとの在室判定に送信した端末を記録します
+CREATE TABLE IF NOT EXISTS
+    devices (
+        device_id SERIAL PRIMARY KEY,
+        user_id INT NOT NULL REFERENCES users (id),
+        name VARCHAR(100) NOT NULL,
+        platform VARCHAR(50) NOT NULL DEFAULT '',
+        created_at TIMESTAMP NOT NULL,
+        last_seen_at TIMESTAMP,
+        org_id INT NOT NULL DEFAULT 1 REFERENCES organizations (org_id)
+    );
+
+CREATE INDEX IF NOT EXISTS idx_devices_user_id ON devices (user_id);
+
+ALTER TABLE presence_decisions ADD COLUMN IF NOT EXISTS device_id INT;
+
+ALTER TABLE submission_queue ADD COLUMN IF NOT EXISTS device_id INT;
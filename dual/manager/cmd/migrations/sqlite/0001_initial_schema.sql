@@ -0,0 +1,69 @@
+CREATE TABLE IF NOT EXISTS
+    users (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        user_id VARCHAR(20) NOT NULL UNIQUE,
+        password VARCHAR(20)
+    );
+
+CREATE TABLE IF NOT EXISTS
+    rooms (
+        room_id INTEGER PRIMARY KEY AUTOINCREMENT,
+        room_name VARCHAR(100) NOT NULL,
+        location INT
+    );
+
+CREATE TABLE IF NOT EXISTS
+    beacons (
+        beacon_id INTEGER PRIMARY KEY AUTOINCREMENT,
+        beacon_name VARCHAR(100) NOT NULL,
+        service_uuid CHAR(36),
+        mac_address VARCHAR(17),
+        room_id INT,
+        FOREIGN KEY (room_id) REFERENCES rooms (room_id)
+    );
+
+CREATE TABLE IF NOT EXISTS
+    wifi_access_points (
+        wifi_id INTEGER PRIMARY KEY AUTOINCREMENT,
+        ssid VARCHAR(100) NOT NULL,
+        bssid VARCHAR(17) NOT NULL,
+        room_id INT,
+        FOREIGN KEY (room_id) REFERENCES rooms (room_id)
+    );
+
+CREATE TABLE IF NOT EXISTS
+    roles (
+        role_id INTEGER PRIMARY KEY AUTOINCREMENT,
+        role_name VARCHAR(50) NOT NULL
+    );
+
+CREATE TABLE IF NOT EXISTS
+    user_roles (
+        user_id INT,
+        role_id INT,
+        PRIMARY KEY (user_id, role_id),
+        FOREIGN KEY (user_id) REFERENCES users (id),
+        FOREIGN KEY (role_id) REFERENCES roles (role_id)
+    );
+
+CREATE TABLE IF NOT EXISTS
+    query_server (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        url VARCHAR(255) NOT NULL
+    );
+
+CREATE TABLE IF NOT EXISTS
+    user_presence_sessions (
+        session_id INTEGER PRIMARY KEY AUTOINCREMENT,
+        user_id INT REFERENCES users (id),
+        room_id INT REFERENCES rooms (room_id),
+        start_time TIMESTAMP NOT NULL,
+        end_time TIMESTAMP,
+        last_seen TIMESTAMP NOT NULL
+    );
+
+CREATE INDEX IF NOT EXISTS idx_user_presence_sessions_user_id ON user_presence_sessions (user_id);
+
+CREATE INDEX IF NOT EXISTS idx_user_presence_sessions_end_time ON user_presence_sessions (end_time);
+
+CREATE INDEX IF NOT EXISTS idx_user_presence_sessions_last_seen ON user_presence_sessions (last_seen);
@@ -0,0 +1,3 @@
+ALTER TABLE fingerprint_samples ADD COLUMN wifi_records INT NOT NULL DEFAULT 0;
+
+ALTER TABLE fingerprint_samples ADD COLUMN ble_records INT NOT NULL DEFAULT 0;
@@ -0,0 +1,27 @@
+CREATE TABLE IF NOT EXISTS
+    api_keys (
+        key_id INTEGER PRIMARY KEY AUTOINCREMENT,
+        org_id INT NOT NULL DEFAULT 1,
+        name VARCHAR(100) NOT NULL,
+        key_prefix VARCHAR(20) NOT NULL,
+        key_hash CHAR(64) NOT NULL UNIQUE,
+        monthly_quota BIGINT NOT NULL DEFAULT 0,
+        created_by VARCHAR(20) NOT NULL,
+        created_at TIMESTAMP NOT NULL,
+        revoked_at TIMESTAMP
+    );
+
+-- 組織ごと・APIキーごと（APIキーを使わないリクエストは key_id 0）の月間の利用量
+CREATE TABLE IF NOT EXISTS
+    usage_counters (
+        org_id INT NOT NULL,
+        key_id INT NOT NULL DEFAULT 0,
+        period CHAR(7) NOT NULL,
+        metric VARCHAR(32) NOT NULL,
+        count BIGINT NOT NULL DEFAULT 0,
+        PRIMARY KEY (org_id, key_id, period, metric)
+    );
+
+CREATE INDEX IF NOT EXISTS idx_api_keys_org_id ON api_keys (org_id);
+
+CREATE INDEX IF NOT EXISTS idx_usage_counters_period ON usage_counters (period);
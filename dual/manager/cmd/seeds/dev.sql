@@ -0,0 +1,82 @@
+-- 開発用の初期データ（seed サブコマンドで投入します）。スキーマは migrations で作成します
+-- ユーザーのデータを挿入
+INSERT INTO
+    Users (user_id, password)
+VALUES
+    ('相川 拓哉', 'password1'),
+    ('hihumikan', 'password2'),
+    ('harutiro', 'password3');
+
+-- 部屋のデータを挿入
+INSERT INTO
+    rooms (room_name, location)
+VALUES
+    ('Graduate Students Room', 513),
+    ('Undergraduate Students Room', 514),
+    ('Professors Office', 515);
+
+-- ビーコンデバイスのデータを挿入
+INSERT INTO
+    beacons (
+        beacon_name,
+        service_uuid,
+        mac_address,
+        room_id
+    )
+VALUES
+    (
+        'elpis-001',
+        'd546df97-4757-47ef-be09-3e2dcbdd0c77',
+        'DC:0D:30:1E:33:91',
+        2
+    ),
+    (
+        'elpis-001',
+        'fda50693-a4e2-4fb1-afcf-c6eb07647825',
+        'DC:0D:30:1E:33:91',
+        2
+    ),
+    (
+        'elpis-002',
+        '4e24ac47-b7e6-44f5-957f-1cdcefa2acab',
+        'DC:0D:30:1E:33:84',
+        1
+    ),
+    (
+        'elpis-002',
+        'fda50693-a4e2-4fb1-afcf-c6eb07647825',
+        'DC:0D:30:1E:33:84',
+        1
+    ),
+    (
+        'elpis-003',
+        '722eb21f-8f6a-4ba9-a12f-05c0f970a177',
+        'DC:0D:30:1E:33:3E',
+        2
+    );
+
+-- WiFiアクセスポイントのデータを挿入
+INSERT INTO
+    wifi_access_points (ssid, bssid, room_id)
+VALUES
+    ('KJLB-WorkRoom-g', 'C0:25:A2:A7:2E:1A', 1),
+    ('KJLB-StuRoom-108ac', 'C0:25:A2:A9:b1:4f', 2),
+    ('KJLB-StuRoom-108g', 'c0:25:a2:a7:2e:2a', 2),
+    ('KJLB-104a', '60:84:bd:de:7c:67', 3),
+    ('KJLB-104g', '60:84:bd:de:7c:60', 3);
+
+-- ロールのデータを挿入
+INSERT INTO
+    roles (role_name)
+VALUES
+    ('Admin'),
+    ('User'),
+    ('Guest');
+
+-- ユーザーロールのデータを挿入
+INSERT INTO
+    user_roles (user_id, role_id)
+VALUES
+    (1, 1),
+    (2, 1),
+    (3, 1);
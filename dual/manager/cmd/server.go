@@ -1,1493 +1,17495 @@
 package main
 
 import (
+	"archive/zip"
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"database/sql"
+	"embed"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"expvar"
 	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"log/slog"
+	"maps"
+	"math"
+	"math/rand"
+	"mime"
 	"mime/multipart"
 	"net"
 	"net/http"
+	"net/http/pprof"
+	"net/url"
 	"os"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
+	_ "time/tzdata"
+	"unicode"
 
 	"github.com/BurntSushi/toml"
-	_ "github.com/lib/pq"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
 	"github.com/rs/cors"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/net/dns/dnsmessage"
+	_ "modernc.org/sqlite"
 )
 
-var requestID uint64
+//go:embed migrations/*/*.sql
+var migrationFS embed.FS
+
+//go:embed seeds/dev.sql
+var devSeedSQL string
+
 var logger *slog.Logger
 
+// logLevel はアプリケーションのログの出力レベルです。/api/admin/loglevel から再起動せずに変更できます
+var logLevel = new(slog.LevelVar)
+var tracer = otel.Tracer("kajiLabTeam/elpis_manager")
+
+var negativeSamplesCaptured uint64
+var negativeSamplesSkipped uint64
+
+var uploadFilesRemoved uint64
+var uploadFilesArchived uint64
+var uploadBytesReclaimed uint64
+var uploadRetentionLastRun int64
+
+var registrationHeartbeats uint64
+var registrationHeartbeatFailures uint64
+var registrationLastHeartbeat int64
+var registrationAttempts uint64
+var registrationRestarts uint64
+var remoteConfigLastApplied int64
+var remoteConfigFailures uint64
+
+var retryQueueEnqueued uint64
+var retryQueueReplayed uint64
+var retryQueueDropped uint64
+var retryQueueFailures uint64
+
+var inquirySpeculative uint64
+var inquirySpeculativeDiscarded uint64
+
+var sessionsExpired uint64
+
+var deviceCacheHits uint64
+var deviceCacheMisses uint64
+
+// registrationStates はプロキシのURLごとの登録状態です。/api/health と /debug/vars で公開します
+var registrationStates sync.Map
+
+const (
+	registrationDisabled     = "disabled"
+	registrationPending      = "registering"
+	registrationRegistered   = "registered"
+	registrationFailed       = "failed"
+	registrationDeregistered = "deregistered"
+)
+
+func setRegistrationState(proxyURL string, state string) {
+	registrationStates.Store(proxyURL, state)
+}
+
+// registrationStatesByProxy はプロキシのURLごとの登録状態を返します
+func registrationStatesByProxy() map[string]string {
+	states := make(map[string]string)
+	registrationStates.Range(func(key, value interface{}) bool {
+		states[key.(string)] = value.(string)
+		return true
+	})
+	return states
+}
+
+// currentRegistrationState はサーバー全体の登録状態を返します。いずれかのプロキシに登録できていれば registered です
+func currentRegistrationState() string {
+	states := registrationStatesByProxy()
+	if len(states) == 0 {
+		return registrationDisabled
+	}
+	counts := make(map[string]int)
+	for _, state := range states {
+		counts[state]++
+	}
+	switch {
+	case counts[registrationRegistered] > 0:
+		return registrationRegistered
+	case counts[registrationPending] > 0:
+		return registrationPending
+	case counts[registrationDeregistered] == len(states):
+		return registrationDeregistered
+	}
+	return registrationFailed
+}
+
 type contextKey string
 
 const requestIDKey = contextKey("requestID")
 
+// routeLimitKey は limitRoutes が一致した [RouteLimits] の設定をハンドラーへ渡すためのキーです
+const routeLimitKey = contextKey("routeLimit")
+
+// principalKey は authenticateRequests がパスワードを確認したユーザー名を getUserID へ渡すためのキーです
+const principalKey = contextKey("principal")
+
+// orgIDKey は orgMiddleware がリクエストを送ったユーザーの組織IDをハンドラーとストアへ渡すためのキーです
+const orgIDKey = contextKey("orgID")
+
+// usageMeterKey は orgMiddleware がリクエストの利用量の記録先（usageMeter）をハンドラーへ渡すためのキーです
+const usageMeterKey = contextKey("usageMeter")
+
+// apiVersionKey は apiVersions がリクエストの呼び出したAPIのバージョンをハンドラーへ渡すためのキーです
+const apiVersionKey = contextKey("apiVersion")
+
+// defaultOrgID は組織を導入する前のデータと、登録されていないユーザーからのリクエストが属する組織です
+const defaultOrgID = 1
+
+// withOrg は orgID の組織に限定したコンテキストを返します
+func withOrg(ctx context.Context, orgID int) context.Context {
+	return context.WithValue(ctx, orgIDKey, orgID)
+}
+
+// orgFromContext はコンテキストの組織IDを返します。0の場合は組織で絞り込まず、全組織のデータを対象にします（定期処理など）
+func orgFromContext(ctx context.Context) int {
+	orgID, _ := ctx.Value(orgIDKey).(int)
+	return orgID
+}
+
+// apiVersionFromContext はリクエストの呼び出したAPIのバージョン（/api/v1 以下の場合は "v1"）を返します。
+// バージョンのない /api 以下へのリクエストの場合は空文字列です
+func apiVersionFromContext(ctx context.Context) string {
+	version, _ := ctx.Value(apiVersionKey).(string)
+	return version
+}
+
+// recordOrg は記録する行の組織IDを返します。組織で絞り込まないコンテキストでは既定の組織に記録します
+func recordOrg(ctx context.Context) int {
+	if orgID := orgFromContext(ctx); orgID != 0 {
+		return orgID
+	}
+	return defaultOrgID
+}
+
+// tenantNamespace は組織のフィンガープリントデータ・データセットを保存する名前空間（キーの接頭辞）を返します。
+// 既定の組織は組織を導入する前と同じ場所（空の接頭辞）を使い、それ以外の組織は tenants/{組織ID} 以下に保存します
+func tenantNamespace(orgID int) string {
+	if orgID == defaultOrgID {
+		return ""
+	}
+	return path.Join("tenants", strconv.Itoa(orgID))
+}
+
+// tenantKey は key を組織 orgID の名前空間のキーにします
+func tenantKey(orgID int, key string) string {
+	return path.Join(tenantNamespace(orgID), key)
+}
+
+// splitTenantKey は名前空間付きのキーを組織IDと名前空間内のキーに分けます。tenants/ 以下でないキーは既定の組織のキーです
+func splitTenantKey(key string) (int, string) {
+	if parts := strings.SplitN(key, "/", 3); len(parts) == 3 && parts[0] == "tenants" {
+		if orgID, err := strconv.Atoi(parts[1]); err == nil && orgID > 0 {
+			return orgID, parts[2]
+		}
+	}
+	return defaultOrgID, key
+}
+
+// inTenantNamespace は key が組織 orgID の名前空間のキーかどうかを返します
+func inTenantNamespace(orgID int, key string) bool {
+	keyOrgID, _ := splitTenantKey(key)
+	return keyOrgID == orgID
+}
+
+// requestIDPattern は受け付ける X-Request-ID の形式です。一致しない場合は新しいIDを発行します
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:+/=-]{1,128}$`)
+
+// ResponseCapture は応答のステータスコードとバイト数を記録し、ログ用に応答ボディの先頭 Limit バイトだけを保持します。
+// Limit が0の場合と、ダウンロード（Content-Disposition: attachment）やテキスト以外の応答ではボディを保持しません
 type ResponseCapture struct {
 	http.ResponseWriter
 	StatusCode int
+	Bytes      int
+	Limit      int
 	Body       bytes.Buffer
+	Truncated  bool
+	checked    bool
+	skip       bool
 }
 
 func (r *ResponseCapture) WriteHeader(statusCode int) {
+	r.checkHeader()
 	r.StatusCode = statusCode
 	r.ResponseWriter.WriteHeader(statusCode)
 }
 
 func (r *ResponseCapture) Write(b []byte) (int, error) {
-	r.Body.Write(b)
-	return r.ResponseWriter.Write(b)
+	r.checkHeader()
+	n, err := r.ResponseWriter.Write(b)
+	r.Bytes += n
+	if !r.skip {
+		if room := r.Limit - r.Body.Len(); room < n {
+			r.Body.Write(b[:room])
+			r.Truncated = true
+			r.skip = true
+		} else {
+			r.Body.Write(b[:n])
+		}
+	}
+	return n, err
 }
 
-type Config struct {
-	Mode         string
-	ServerPort   string `toml:"server_port"`
-	Docker       DockerConfig
-	Local        LocalConfig
-	Registration RegistrationConfig
+// Unwrap は http.ResponseController から元の ResponseWriter を使えるようにします
+func (r *ResponseCapture) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
 }
 
-type DockerConfig struct {
-	ProxyURL         string `toml:"proxy_url"`
-	EstimationURL    string `toml:"estimation_url"`
-	InquiryURL       string `toml:"inquiry_url"`
-	DBConnStr        string `toml:"db_conn_str"`
-	SkipRegistration bool   `toml:"skip_registration"`
+// checkHeader は最初の書き込み時に応答ヘッダーを見て、ボディを保持するかを決めます
+func (r *ResponseCapture) checkHeader() {
+	if r.checked {
+		return
+	}
+	r.checked = true
+	r.skip = r.skip || r.Limit <= 0 || !loggableResponse(r.Header())
 }
 
-type LocalConfig struct {
-	ProxyURL         string `toml:"proxy_url"`
-	EstimationURL    string `toml:"estimation_url"`
-	InquiryURL       string `toml:"inquiry_url"`
-	DBConnStr        string `toml:"db_conn_str"`
-	SkipRegistration bool   `toml:"skip_registration"`
+// loggableResponse は応答ボディをログに記録できる形式（JSON・テキスト）かを返します。
+// エクスポートなどのダウンロードはテキストでも記録しません
+func loggableResponse(header http.Header) bool {
+	if strings.HasPrefix(header.Get("Content-Disposition"), "attachment") {
+		return false
+	}
+	contentType := header.Get("Content-Type")
+	if contentType == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if mediaType == "text/event-stream" {
+		return false
+	}
+	return strings.HasPrefix(mediaType, "text/") || mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
 }
 
-type RegistrationConfig struct {
-	SystemURI string `toml:"system_uri"`
+type Config struct {
+	Mode              string
+	ServerPort        string `toml:"server_port"`
+	Timezone          string `toml:"timezone"`
+	Docker            ProfileConfig
+	Local             ProfileConfig
+	Profiles          map[string]ProfileConfig `toml:"profiles"`
+	Registration      RegistrationConfig
+	Session           SessionConfig
+	NegativeSamples   NegativeSampleConfig
+	Reports           ReportsConfig
+	Retention         RetentionConfig
+	UploadRetention   UploadRetentionConfig
+	RetentionPolicy   RetentionPolicyConfig
+	StorageEncryption StorageEncryptionConfig
+	RetryQueue        RetryQueueConfig
+	Quota             QuotaConfig
+	Submit            SubmitConfig
+	RouteLimits       map[string]RouteLimitConfig
+	Upstream          UpstreamConfig
+	EstimationRouting EstimationRoutingConfig
+	DeviceCache       DeviceCacheConfig
+	DeviceScan        DeviceScanConfig
+	Tracing           TracingConfig
+	Log               LogConfig
+	Debug             DebugConfig
+	Decision          DecisionConfig
+	CORS              CORSConfig
+	Vault             VaultConfig
+	MDNS              MDNSConfig
+	Consul            ConsulConfig
+	PublicDisplay     PublicDisplayConfig
+	PrivateStats      PrivateStatsConfig
+	Federation        FederationConfig
+	Cluster           ClusterConfig
 }
 
-type UploadResponse struct {
-	Message string `json:"message"`
-}
+// stringList は1つの文字列と文字列の配列のどちらでも指定できる設定項目です
+type stringList []string
 
-type RegisterRequest struct {
-	Scheme string `json:"scheme"`
-	Host   string `json:"host"`
-	Port   int    `json:"port,omitempty"`
+func (l *stringList) UnmarshalTOML(data interface{}) error {
+	switch value := data.(type) {
+	case string:
+		*l = stringList{value}
+	case []interface{}:
+		list := make(stringList, 0, len(value))
+		for _, item := range value {
+			s, ok := item.(string)
+			if !ok {
+				return fmt.Errorf("文字列の配列である必要があります: %v", value)
+			}
+			list = append(list, s)
+		}
+		*l = list
+	default:
+		return fmt.Errorf("文字列または文字列の配列である必要があります: %v", data)
+	}
+	return nil
 }
 
-type PresenceSession struct {
-	SessionID int        `json:"session_id"`
-	UserID    int        `json:"user_id"`
-	RoomID    int        `json:"room_id"`
-	StartTime time.Time  `json:"start_time"`
-	EndTime   *time.Time `json:"end_time"`
-	LastSeen  time.Time  `json:"last_seen"`
+// ProfileConfig は -mode で選ぶ環境ごとの設定です。[profiles.{名前}] で任意の名前のプロファイルを定義でき、
+// 互換性のため [Docker]・[Local] はそれぞれ docker・local のプロファイルとして扱います
+type ProfileConfig struct {
+	ProxyURL          stringList    `toml:"proxy_url"`
+	EstimationURL     string        `toml:"estimation_url"`
+	InquiryURL        string        `toml:"inquiry_url"`
+	DBDriver          string        `toml:"db_driver"`
+	DBConnStr         string        `toml:"db_conn_str"`
+	DBConnStrFile     string        `toml:"db_conn_str_file"`
+	ReadDBConnStr     string        `toml:"read_db_conn_str"`
+	ReadDBConnStrFile string        `toml:"read_db_conn_str_file"`
+	MaxOpenConns      int           `toml:"max_open_conns"`
+	MaxIdleConns      int           `toml:"max_idle_conns"`
+	ConnMaxLifetime   time.Duration `toml:"conn_max_lifetime"`
+	SkipRegistration  bool          `toml:"skip_registration"`
+	AutoMigrate       bool          `toml:"auto_migrate"`
+	Storage           StorageConfig `toml:"storage"`
 }
 
-type UserPresenceDay struct {
-	Date     string            `json:"date"`
-	Sessions []PresenceSession `json:"sessions"`
+// RegistrationConfig はプロキシへの登録の設定です。heartbeat_interval ごとにプロキシに登録が残っているかを確認し、プロキシの再起動などで失われた場合は登録し直します（0 の場合は確認しません）
+// 登録に失敗した場合は retry_initial から retry_max_wait まで待ち時間を倍にしながら再試行し、max_attempts 回で諦めます（0 の場合は無制限）
+// auth_token を指定した場合は Authorization: Bearer ヘッダーに付けて送り、プロキシがマネージャーを認証できるようにします
+// remote_config を有効にすると、登録後にプロキシの /api/config から共有設定を remote_config_interval ごとに取得して適用します
+type RegistrationConfig struct {
+	SystemURI            string        `toml:"system_uri"`
+	Scheme               string        `toml:"scheme"`
+	AuthToken            string        `toml:"auth_token"`
+	AuthTokenFile        string        `toml:"auth_token_file"`
+	HeartbeatInterval    time.Duration `toml:"heartbeat_interval"`
+	RetryInitial         time.Duration `toml:"retry_initial"`
+	RetryMaxWait         time.Duration `toml:"retry_max_wait"`
+	MaxAttempts          int           `toml:"max_attempts"`
+	RemoteConfig         bool          `toml:"remote_config"`
+	RemoteConfigURL      string        `toml:"remote_config_url"`
+	RemoteConfigInterval time.Duration `toml:"remote_config_interval"`
 }
 
-type AllUsersPresenceDay struct {
-	Date  string               `json:"date"`
-	Users []UserPresenceDetail `json:"users"`
+// MDNSConfig は mDNS によるサーバーの告知の設定です。プロキシを置かない環境で、同じLANの端末が URL を入力せずにサーバーを見つけられるようにします
+type MDNSConfig struct {
+	Enabled  bool   `toml:"enabled"`
+	Instance string `toml:"instance"`
+	Service  string `toml:"service"`
+	Path     string `toml:"path"`
 }
 
-type UserPresenceDetail struct {
-	UserID   int               `json:"user_id"`
-	Sessions []PresenceSession `json:"sessions"`
+// SessionConfig はセッションの設定です。cleanup_interval ごとに、inactivity_timeout の間信号を送っていないユーザーのセッションを終了します
+type SessionConfig struct {
+	MergeGap          time.Duration `toml:"merge_gap"`
+	InactivityTimeout time.Duration `toml:"inactivity_timeout"`
+	CleanupInterval   time.Duration `toml:"cleanup_interval"`
 }
 
-type PresenceHistoryResponse struct {
-	AllHistory []AllUsersPresenceDay `json:"all_history,omitempty"`
+type NegativeSampleConfig struct {
+	// Enabled は省略した場合 true です
+	Enabled *bool `toml:"enabled"`
+	// SampleRate は保存するネガティブサンプルの割合（0〜1）です。省略した場合は 1 で、0 を指定するとすべて保存しません
+	SampleRate *float64 `toml:"sample_rate"`
+	MaxSamples int      `toml:"max_samples"`
+	Dir        string   `toml:"dir"`
 }
 
-type UserPresenceResponse struct {
-	UserID  int               `json:"user_id"`
-	History []UserPresenceDay `json:"history"`
+type ReportsConfig struct {
+	Dir             string `toml:"dir"`
+	ScheduleEnabled bool   `toml:"schedule_enabled"`
 }
 
-type CurrentOccupant struct {
-	UserID   string    `json:"user_id"`
-	LastSeen time.Time `json:"last_seen"`
+type RetentionConfig struct {
+	Months  int  `toml:"months"`
+	Archive bool `toml:"archive"`
 }
 
-type RoomOccupants struct {
-	RoomID    int               `json:"room_id"`
-	RoomName  string            `json:"room_name"`
-	Occupants []CurrentOccupant `json:"occupants"`
+// UploadRetentionConfig はアップロードファイルの保持期間の設定です。
+// archive が true の場合は削除前に archive_storage へコピーします
+type UploadRetentionConfig struct {
+	Days           int           `toml:"days"`
+	Archive        bool          `toml:"archive"`
+	ArchiveStorage StorageConfig `toml:"archive_storage"`
 }
 
-type CurrentOccupantsResponse struct {
-	Rooms []RoomOccupants `json:"rooms"`
+// RetentionPolicyConfig はデータの分類ごとの保持期間です。interval ごとに保持期間を過ぎたデータを分類ごとに削除し、結果を記録します。
+// categories のキーは sessions・decisions・transitions・uploads・fingerprints で、指定しない分類と days・months がともに 0 の分類は削除しません。
+// sessions・uploads を指定しない場合は [Retention] months・archive と [UploadRetention] days・archive を使用します
+type RetentionPolicyConfig struct {
+	Interval   time.Duration            `toml:"interval"`
+	Categories map[string]RetentionRule `toml:"categories"`
 }
 
-type HealthCheckResponse struct {
-	Status    string `json:"status"`
-	Database  string `json:"database"`
-	Timestamp string `json:"timestamp"`
+// RetentionRule は1つの分類の保持期間で、months か月と days 日の合計です。archive は sessions（user_presence_sessions_archive へ移す）と
+// uploads（[UploadRetention.archive_storage] へコピーする）のみ指定できます
+type RetentionRule struct {
+	Days    int  `toml:"days" json:"days"`
+	Months  int  `toml:"months" json:"months"`
+	Archive bool `toml:"archive" json:"archive"`
 }
 
-type PredictionResponse struct {
-	PredictedPercentage int `json:"predicted_percentage"`
-}
+// 保持期間ポリシーの分類です（[RetentionPolicy.categories]）
+const (
+	retentionSessions     = "sessions"
+	retentionDecisions    = "decisions"
+	retentionTransitions  = "transitions"
+	retentionUploads      = "uploads"
+	retentionFingerprints = "fingerprints"
+)
 
-type EstimationServerResponse struct {
-	PercentageProcessed int `json:"percentage_processed"`
-}
+// retentionCategories は保持期間ポリシーを適用する分類とその順序です
+var retentionCategories = []string{retentionSessions, retentionDecisions, retentionTransitions, retentionUploads, retentionFingerprints}
 
-type InquiryRequest struct {
-	WifiData string `json:"wifi_data"`
-	BleData  string `json:"ble_data"`
+// uploadArchiveEnabled は [UploadRetention] または [RetentionPolicy] の uploads でアーカイブが有効かを返します
+func (c Config) uploadArchiveEnabled() bool {
+	return c.UploadRetention.Archive || c.RetentionPolicy.Categories[retentionUploads].Archive
 }
 
-type InquiryResponse struct {
-	ServerConfidence int `json:"percentage_processed"`
+// StorageEncryptionConfig は保存先に書き込むスキャンファイル（送信・収集・ネガティブサンプル・データセット）を AES-GCM で暗号化する設定です。
+// key はbase64でエンコードした16・24・32バイトの鍵で、key_file・vault:{パス}#{キー} でも指定できます。
+// 暗号化していないファイルは読み込めません。運用中に有効にする場合は、暗号化する前に保存したファイルがなくなるまで allow_plaintext を有効にします。
+// 推定サーバーは ./estimation（組織ごとの tenants/{org_id}/estimation を含む）の学習用ファイルを鍵を持たずに直接読むため、
+// 収集したフィンガープリントの推定用のコピーは暗号化しません。このディレクトリはファイルシステムの権限で保護する必要があります
+type StorageEncryptionConfig struct {
+	Enabled        bool   `toml:"enabled"`
+	Key            string `toml:"key"`
+	KeyFile        string `toml:"key_file"`
+	AllowPlaintext bool   `toml:"allow_plaintext"`
 }
 
-type BeaconSignal struct {
-	UUID  string
-	BSSID string
-	RSSI  float64
+// PublicDisplayConfig は廊下のディスプレイなど向けに、誰が在室しているかを明かさずに在室状況を返す
+// /api/current_occupants/anonymous の設定です。mode が count の場合はルームごとの人数だけを、pseudonym の場合は人数に加えて
+// pseudonym_key から求めたユーザーごとの仮名を返します。pseudonym_key が空の場合は起動ごとに生成するため、再起動すると仮名が変わります
+type PublicDisplayConfig struct {
+	Enabled          bool   `toml:"enabled"`
+	Mode             string `toml:"mode"`
+	PseudonymKey     string `toml:"pseudonym_key"`
+	PseudonymKeyFile string `toml:"pseudonym_key_file"`
 }
 
-type WiFiSignal struct {
-	SSID  string
-	BSSID string
-	RSSI  float64
+// PrivateStatsConfig は建物の管理者などと在室統計 (/api/stats/*) を共有するための秘匿モードの設定です。
+// 秘匿モードでは min_users 人未満のユーザーから求めたセルを返さず、残りの値に epsilon から求めた尺度のラプラスノイズを加えます。
+// ノイズは noise_key と集計・期間・セルから決めるため、同じ問い合わせを繰り返しても平均して取り除くことはできません。
+// enabled が true の場合は常に、false の場合はリクエストで private=true を指定した場合に適用します
+type PrivateStatsConfig struct {
+	Enabled      bool    `toml:"enabled"`
+	MinUsers     int     `toml:"min_users"`
+	Epsilon      float64 `toml:"epsilon"`
+	NoiseKey     string  `toml:"noise_key"`
+	NoiseKeyFile string  `toml:"noise_key_file"`
 }
 
-func logConfig(ctx context.Context, msg string, args ...interface{}) {
-	id, _ := ctx.Value(requestIDKey).(uint64)
-	logger.Info(fmt.Sprintf(msg, args...), "request_id", id)
+// FederationConfig は建物ごとに動かしているマネージャー（ピア）の在室状況を集約する設定です。enabled が true の場合、
+// /api/federation/* でピアから取得した在室者・在室履歴をまとめて返します。ピアは [Federation.peers.{サイト名}] で指定し、
+// ルーム・ユーザー・セッションのIDはサイトをまたいで重複するため {サイト名}:{ID} の形式で返します
+type FederationConfig struct {
+	Enabled bool                            `toml:"enabled"`
+	Timeout time.Duration                   `toml:"timeout"`
+	Peers   map[string]FederationPeerConfig `toml:"peers"`
 }
 
-func logRequest(ctx context.Context, msg string, args ...interface{}) {
-	id, _ := ctx.Value(requestIDKey).(uint64)
-	logger.Info(fmt.Sprintf(msg, args...), "request_id", id)
+// FederationPeerConfig は1つのピアの設定です。username・password はピアのBasic認証のユーザーで、ピアはこのユーザーの組織のデータを返します。
+// timezone はピアの [timezone] で、空の場合はこのマネージャーと同じとみなします
+type FederationPeerConfig struct {
+	URL          string `toml:"url"`
+	Username     string `toml:"username"`
+	Password     string `toml:"password"`
+	PasswordFile string `toml:"password_file"`
+	Timezone     string `toml:"timezone"`
 }
 
-func logError(ctx context.Context, msg string, args ...interface{}) {
-	id, _ := ctx.Value(requestIDKey).(uint64)
-	logger.Error(fmt.Sprintf(msg, args...), "request_id", id)
+// ClusterConfig は同じデータベースを使う複数のマネージャーをプロキシの後ろに並べて動かす設定です。
+// セッションの終了・保持期間の適用・リトライキューの再送はデータベースのリースを取得した1つのインスタンスだけが実行します。
+// instance_id はリースの保持者としてログと / の応答に出す名前で、空の場合は {ホスト名}-{ランダムな8文字} です。
+// idempotency_ttl は Idempotency-Key を付けた送信の結果を保持する期間です
+type ClusterConfig struct {
+	InstanceID     string        `toml:"instance_id"`
+	IdempotencyTTL time.Duration `toml:"idempotency_ttl"`
 }
 
-func logInfo(ctx context.Context, msg string, args ...interface{}) {
-	id, _ := ctx.Value(requestIDKey).(uint64)
-	logger.Info(fmt.Sprintf(msg, args...), "request_id", id)
+// RetryQueueConfig は推定サーバーに転送できなかった信号の送信を保存し、後で元の受信時刻のまま在室判定し直す設定です。
+// interval ごとに受信した順に再送し、max_age を過ぎた送信は破棄します（0 の場合は破棄しません）
+type RetryQueueConfig struct {
+	Enabled   bool          `toml:"enabled"`
+	Interval  time.Duration `toml:"interval"`
+	MaxAge    time.Duration `toml:"max_age"`
+	BatchSize int           `toml:"batch_size"`
 }
 
-func forwardFilesToEstimationServer(ctx context.Context, bleFilePath string, wifiFilePath string, estimationURL string) (int, error) {
-	combinedFilePath := filepath.Join(os.TempDir(), fmt.Sprintf("combined_data_%d.csv", time.Now().Unix()))
-	defer os.Remove(combinedFilePath)
+// QuotaConfig はアップロードの容量制限（バイト）の設定です。0 の場合は制限しません。
+// user_bytes はユーザーごとのシグナルデータ（uploads/）、room_bytes は組織・ルームごとのフィンガープリントデータ（manager_fingerprint/）に適用します
+type QuotaConfig struct {
+	UserBytes       int64         `toml:"user_bytes"`
+	RoomBytes       int64         `toml:"room_bytes"`
+	RefreshInterval time.Duration `toml:"refresh_interval"`
+}
 
-	bleFile, err := os.Open(bleFilePath)
-	if err != nil {
-		logError(ctx, "BLEファイルを開くことができませんでした: %v", err)
-		return 0, fmt.Errorf("BLEファイルを開くことができませんでした: %v", err)
-	}
-	defer bleFile.Close()
+// SubmitConfig は信号の送信（/api/signals/submit・/api/signals/server）を処理するワーカーの設定です。
+// workers 件を同時に処理し、queue_size 件まで待たせます。待ち行列が一杯の場合は retry_after を付けて 503 を返します
+type SubmitConfig struct {
+	Workers    int           `toml:"workers"`
+	QueueSize  int           `toml:"queue_size"`
+	RetryAfter time.Duration `toml:"retry_after"`
+	// MaxRecords はBLE・WiFiのCSVそれぞれで受け付ける最大の行数です。再起動せずに再読み込みできます
+	MaxRecords int `toml:"max_records"`
+	// MaxScanAge・MaxClockSkew は scanned_at として受け付ける時刻の範囲です。
+	// サーバーの時刻より max_scan_age を超えて古い、または max_clock_skew を超えて未来の scanned_at は 422 を返します
+	MaxScanAge   time.Duration `toml:"max_scan_age"`
+	MaxClockSkew time.Duration `toml:"max_clock_skew"`
+}
 
-	wifiFile, err := os.Open(wifiFilePath)
-	if err != nil {
-		logError(ctx, "WiFiファイルを開くことができませんでした: %v", err)
-		return 0, fmt.Errorf("WiFiファイルを開くことができませんでした: %v", err)
-	}
-	defer wifiFile.Close()
+// RouteLimitConfig はパスごとの同時に処理するリクエスト数とリクエストボディ・アップロードファイル1件の大きさ（MB）の上限、処理時間の上限です。
+// 0 の項目は制限しません。パスが / で終わる場合はそのパス以下のすべてに適用します。同時実行数を超えた場合は retry_after を付けて 503 を返します。
+// timeout を過ぎるとリクエストのコンテキストが終了し、推定・問い合わせサーバーへの転送やデータベースのクエリを打ち切ります。
+// max_memory_mb は multipart/form-data のファイルをメモリに保持する上限で、超えた分は一時ファイルに書き出します（0 の場合は 32MB）
+type RouteLimitConfig struct {
+	MaxConcurrent int           `toml:"max_concurrent"`
+	MaxBodyMB     int64         `toml:"max_body_mb"`
+	MaxFileMB     int64         `toml:"max_file_mb"`
+	MaxMemoryMB   int64         `toml:"max_memory_mb"`
+	RetryAfter    time.Duration `toml:"retry_after"`
+	Timeout       time.Duration `toml:"timeout"`
+}
 
-	bleReader := csv.NewReader(bleFile)
-	wifiReader := csv.NewReader(wifiFile)
+// defaultMultipartMemoryMB は max_memory_mb を指定しない場合に multipart/form-data をメモリに保持する上限（MB）です
+const defaultMultipartMemoryMB = 32
 
-	bleRecords, err := bleReader.ReadAll()
-	if err != nil {
-		logError(ctx, "BLE CSVの読み取りに失敗しました: %v", err)
-		return 0, fmt.Errorf("BLE CSVの読み取りに失敗しました: %v", err)
+// multipartMemory は ParseMultipartForm に渡すメモリの上限（バイト）を返します
+func (c RouteLimitConfig) multipartMemory() int64 {
+	if c.MaxMemoryMB > 0 {
+		return c.MaxMemoryMB << 20
 	}
+	return defaultMultipartMemoryMB << 20
+}
 
-	wifiRecords, err := wifiReader.ReadAll()
-	if err != nil {
-		logError(ctx, "WiFi CSVの読み取りに失敗しました: %v", err)
-		return 0, fmt.Errorf("WiFi CSVの読み取りに失敗しました: %v", err)
-	}
+// defaultRouteLimits は [RouteLimits] を指定しない場合の上限です。
+// フィンガープリントは1件が大きく一時ファイルも作るため、同時に受け付ける数も制限します
+var defaultRouteLimits = map[string]RouteLimitConfig{
+	"/api/fingerprint/collect": {MaxConcurrent: 8, MaxBodyMB: 64, MaxFileMB: 32, Timeout: 2 * time.Minute},
+	"/api/signals/submit":      {MaxBodyMB: 16, MaxFileMB: 8, Timeout: time.Minute},
+	"/api/signals/server":      {MaxBodyMB: 16, MaxFileMB: 8, Timeout: time.Minute},
+	"/api/signals/sync":        {MaxBodyMB: 128, MaxFileMB: 8, Timeout: 10 * time.Minute},
+}
 
-	combinedRecords := append(bleRecords, wifiRecords...)
+// UpstreamConfig は信号の送信ごとに呼び出す推定サーバー・問い合わせサーバーへの接続の設定です
+type UpstreamConfig struct {
+	Estimation HTTPClientConfig `toml:"estimation"`
+	Inquiry    HTTPClientConfig `toml:"inquiry"`
+}
 
-	combinedFile, err := os.Create(combinedFilePath)
-	if err != nil {
-		logError(ctx, "結合されたCSVファイルの作成に失敗しました: %v", err)
-		return 0, fmt.Errorf("結合されたCSVファイルの作成に失敗しました: %v", err)
-	}
-	defer combinedFile.Close()
+// HTTPClientConfig は接続を使い回す共有HTTPクライアントの設定です。timeout は応答ボディの読み込みまでを含みます。
+// max_conns_per_host が 0 の場合は接続数を制限しません
+type HTTPClientConfig struct {
+	Timeout             time.Duration `toml:"timeout"`
+	DialTimeout         time.Duration `toml:"dial_timeout"`
+	KeepAlive           time.Duration `toml:"keep_alive"`
+	IdleConnTimeout     time.Duration `toml:"idle_conn_timeout"`
+	MaxIdleConnsPerHost int           `toml:"max_idle_conns_per_host"`
+	MaxConnsPerHost     int           `toml:"max_conns_per_host"`
+}
 
-	writer := csv.NewWriter(combinedFile)
-	if err := writer.WriteAll(combinedRecords); err != nil {
-		logError(ctx, "結合されたCSVの書き込みに失敗しました: %v", err)
-		return 0, fmt.Errorf("結合されたCSVの書き込みに失敗しました: %v", err)
-	}
-	writer.Flush()
+// EstimationRoutingConfig は大規模な配置で、エリア（建物・階・ルーム）ごとに別の推定サーバーへ送信を振り分ける設定です。
+// 送信ごとに最も電波の強い登録済みのビーコン・WiFiアクセスポイントのルームを求め、そのルームを含む [EstimationRouting.shards.{名前}] の url へ転送します。
+// rooms・floors・buildings の順にルームに近い指定を優先し、どのシャードにも含まれないルームとルームを決められない送信は estimation_url へ転送します。
+// 階とルームの対応は refresh_interval ごとにデータベースから読み直します。/api/signals/server はファイルを保存せずに流すため振り分けません
+type EstimationRoutingConfig struct {
+	RefreshInterval time.Duration                    `toml:"refresh_interval"`
+	Shards          map[string]EstimationShardConfig `toml:"shards"`
+}
 
-	var requestBody bytes.Buffer
-	writerMultipart := multipart.NewWriter(&requestBody)
-	filePart, err := writerMultipart.CreateFormFile("file", filepath.Base(combinedFilePath))
-	if err != nil {
-		logError(ctx, "フォームファイルの作成に失敗しました: %v", err)
-		return 0, fmt.Errorf("フォームファイルの作成に失敗しました: %v", err)
-	}
+type EstimationShardConfig struct {
+	URL       string `toml:"url"`
+	Buildings []int  `toml:"buildings"`
+	Floors    []int  `toml:"floors"`
+	Rooms     []int  `toml:"rooms"`
+}
 
-	combinedData, err := os.Open(combinedFilePath)
-	if err != nil {
-		logError(ctx, "結合されたCSVファイルのオープンに失敗しました: %v", err)
-		return 0, fmt.Errorf("結合されたCSVファイルのオープンに失敗しました: %v", err)
-	}
-	defer combinedData.Close()
+// DeviceScanConfig は /api/devices/{device_id}/config で端末に配信するスキャンの設定です。scan_interval・min_rssi・upload_batch_size は
+// 建物が開いている勤務時間外の設定で、勤務時間は [DeviceScan.work]、閉館時間は [DeviceScan.closed] の値で上書きします（0 の項目は上書きしません）。
+// 開館時間・勤務時間は [DeviceScan.hours] で指定し、[DeviceScan.buildings.{建物ID}] を指定した建物はその時間に置き換えます
+type DeviceScanConfig struct {
+	ScanInterval    time.Duration                  `toml:"scan_interval"`
+	MinRSSI         int                            `toml:"min_rssi"`
+	UploadBatchSize int                            `toml:"upload_batch_size"`
+	Work            DeviceScanProfile              `toml:"work"`
+	Closed          DeviceScanProfile              `toml:"closed"`
+	Hours           BuildingHoursConfig            `toml:"hours"`
+	Buildings       map[string]BuildingHoursConfig `toml:"buildings"`
+}
 
-	_, err = io.Copy(filePart, combinedData)
-	if err != nil {
-		logError(ctx, "結合されたCSVデータのコピーに失敗しました: %v", err)
-		return 0, fmt.Errorf("結合されたCSVデータのコピーに失敗しました: %v", err)
-	}
+type DeviceScanProfile struct {
+	ScanInterval    time.Duration `toml:"scan_interval"`
+	MinRSSI         int           `toml:"min_rssi"`
+	UploadBatchSize int           `toml:"upload_batch_size"`
+}
 
-	writerMultipart.Close()
+// BuildingHoursConfig は建物の開館時間と勤務時間です。時刻は timezone の "15:04" 形式で、close が open より前の場合は翌日の close までとします。
+// days は開館する曜日（mon・tue・wed・thu・fri・sat・sun）です。open・close を指定しない場合は days の曜日は終日開館し、
+// days を指定しない場合は毎日開館します。work_start・work_end を指定しない場合は勤務時間を設けません
+type BuildingHoursConfig struct {
+	Open      string   `toml:"open"`
+	Close     string   `toml:"close"`
+	WorkStart string   `toml:"work_start"`
+	WorkEnd   string   `toml:"work_end"`
+	Days      []string `toml:"days"`
+}
 
-	req, err := http.NewRequest("POST", estimationURL, &requestBody)
-	if err != nil {
-		logError(ctx, "推定サーバーへのリクエスト作成に失敗しました: %v", err)
-		return 0, fmt.Errorf("推定サーバーへのリクエスト作成に失敗しました: %v", err)
-	}
-	req.Header.Set("Content-Type", writerMultipart.FormDataContentType())
+// DeviceCacheConfig はビーコン・WiFiアクセスポイントとルームの対応をメモリに保持する設定です。
+// refresh_interval ごとにデータベースから読み直します。無効の場合は信号ごとにデータベースへ問い合わせます
+type DeviceCacheConfig struct {
+	Enabled         bool          `toml:"enabled"`
+	RefreshInterval time.Duration `toml:"refresh_interval"`
+}
 
-	logInfo(ctx, "推定サーバーへのリクエストを送信しています")
+// TracingConfig はOpenTelemetryのトレース送信の設定です。endpoint が空の場合は OTEL_EXPORTER_OTLP_ENDPOINT を使用します
+type TracingConfig struct {
+	Enabled     bool    `toml:"enabled"`
+	Endpoint    string  `toml:"endpoint"`
+	Insecure    bool    `toml:"insecure"`
+	ServiceName string  `toml:"service_name"`
+	SampleRatio float64 `toml:"sample_ratio"`
+}
 
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		logError(ctx, "推定サーバーへのリクエスト送信に失敗しました: %v", err)
-		return 0, fmt.Errorf("推定サーバーへのリクエスト送信に失敗しました: %v", err)
-	}
-	defer resp.Body.Close()
+// LogConfig はログの出力形式（text または json）・レベル・出力先の設定です。
+// output には stdout・stderr またはファイルのパスを指定します
+// slow_request・slow_query を超えたリクエスト・クエリは警告として記録します（0 の場合は記録しません）
+type LogConfig struct {
+	Format      string        `toml:"format"`
+	Level       string        `toml:"level"`
+	Output      string        `toml:"output"`
+	SlowRequest time.Duration `toml:"slow_request"`
+	SlowQuery   time.Duration `toml:"slow_query"`
+	// ResponseBody が false の場合は応答ボディを記録しません。記録する場合も先頭の ResponseBodyLimit バイトだけをメモリに保持します
+	ResponseBody      *bool              `toml:"response_body"`
+	ResponseBodyLimit int                `toml:"response_body_limit"`
+	Rotation          LogRotationConfig  `toml:"rotation"`
+	Access            AccessLogConfig    `toml:"access"`
+	Redaction         LogRedactionConfig `toml:"redaction"`
+}
 
-	if resp.StatusCode != http.StatusOK {
-		logError(ctx, "推定サーバーからの無効な応答。ステータスコード: %d", resp.StatusCode)
-		return 0, fmt.Errorf("推定サーバーからの無効な応答。ステータスコード: %d", resp.StatusCode)
-	}
+// LogRedactionConfig はログ・アクセスログに書き込む前に個人情報や認証情報を伏せる設定です。
+// fields は名前のパターン（大文字小文字を区別しない path.Match の形式）で、一致するJSON・フォーム・クエリパラメータの値と
+// 構造化ログの属性を伏せます。headers に一致するヘッダーの値も伏せ、Authorization の場合はアクセスログのユーザー名を伏せます。
+// mask_bssid が true の場合はログに含まれるMACアドレス（BSSID）の下位3バイトを伏せます
+type LogRedactionConfig struct {
+	Enabled   *bool    `toml:"enabled"`
+	Fields    []string `toml:"fields"`
+	Headers   []string `toml:"headers"`
+	MaskBSSID bool     `toml:"mask_bssid"`
+}
 
-	var predictionResp PredictionResponse
-	if err := json.NewDecoder(resp.Body).Decode(&predictionResp); err != nil {
-		logError(ctx, "推定サーバーからの応答のデコードに失敗しました: %v", err)
-		return 0, fmt.Errorf("推定サーバーからの応答のデコードに失敗しました: %v", err)
-	}
+// AccessLogConfig はリクエストごとのアクセスログの設定です。アプリケーションのログとは別の出力先に書き込めます
+type AccessLogConfig struct {
+	Format   string            `toml:"format"`
+	Output   string            `toml:"output"`
+	Rotation LogRotationConfig `toml:"rotation"`
+}
 
-	logInfo(ctx, "推定サーバーからの応答を受信しました: %+v", predictionResp)
-	percentage := int(predictionResp.PredictedPercentage)
+// LogRotationConfig はファイル出力時のログのローテーションの設定です。0 の項目は無効になります。
+// interval で区切った時刻（UTC基準）をまたぐか max_size_mb を超えるとローテーションし、古いファイルは max_backups 個・max_age_days 日まで残します
+type LogRotationConfig struct {
+	MaxSizeMB  int           `toml:"max_size_mb"`
+	Interval   time.Duration `toml:"interval"`
+	MaxBackups int           `toml:"max_backups"`
+	MaxAgeDays int           `toml:"max_age_days"`
+	Compress   bool          `toml:"compress"`
+}
 
-	logInfo(ctx, "推定信頼度を受信しました: %d", percentage)
+// DecisionConfig は在室判定のしきい値です。推定サーバーの信頼度が inquiry_min 以上 inquiry_max 以下の場合は問い合わせサーバーにも問い合わせ、
+// inquiry_max を超える場合は在室、inquiry_min 未満の場合は不在と判定します
+type DecisionConfig struct {
+	InquiryMin int `toml:"inquiry_min"`
+	InquiryMax int `toml:"inquiry_max"`
+	// SpeculativeInquiry が true の場合は推定と同時に問い合わせを送信し、推定信頼度が範囲外なら取り消します
+	SpeculativeInquiry bool `toml:"speculative_inquiry"`
+	// InquiryWin は問い合わせ信頼度が推定信頼度を上回った場合に、セッションを終了する（end_session）か変更しない（keep_session）かです
+	InquiryWin string `toml:"inquiry_win"`
+}
 
-	return percentage, nil
+// CORSConfig はCORSの設定です。allowed_origins には "*" または "https://*.example.com" のようにワイルドカードを1つ含むパターンも指定できます。
+// allowed_origins のみ再読み込みでき、それ以外の変更は再起動するまで反映されません
+type CORSConfig struct {
+	AllowedOrigins   []string `toml:"allowed_origins"`
+	AllowedMethods   []string `toml:"allowed_methods"`
+	AllowedHeaders   []string `toml:"allowed_headers"`
+	AllowCredentials *bool    `toml:"allow_credentials"`
 }
 
-func handleSignalsServerSubmit(w http.ResponseWriter, r *http.Request, ctx context.Context, estimationURL string) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "許可されていないメソッドです。POSTを使用してください。", http.StatusMethodNotAllowed)
-		return
-	}
+// VaultConfig は vault:{パス}#{キー} 形式で指定した秘密情報を読み出すVaultの設定です。
+// address・token が空の場合は環境変数 VAULT_ADDR・VAULT_TOKEN を使用します
+type VaultConfig struct {
+	Address   string        `toml:"address"`
+	Token     string        `toml:"token"`
+	TokenFile string        `toml:"token_file"`
+	Timeout   time.Duration `toml:"timeout"`
+}
 
-	logRequest(ctx, "POST /api/signals/server リクエストを受信しました")
+// ConsulConfig は Consul のサービスカタログへの登録の設定です。プロキシへの登録とは独立して動作します。
+// address・token が空の場合は環境変数 CONSUL_HTTP_ADDR・CONSUL_HTTP_TOKEN を使用します
+type ConsulConfig struct {
+	Enabled                 bool          `toml:"enabled"`
+	Address                 string        `toml:"address"`
+	Token                   string        `toml:"token"`
+	TokenFile               string        `toml:"token_file"`
+	ServiceName             string        `toml:"service_name"`
+	ServiceID               string        `toml:"service_id"`
+	ServiceAddress          string        `toml:"service_address"`
+	Tags                    []string      `toml:"tags"`
+	TTL                     time.Duration `toml:"ttl"`
+	DeregisterCriticalAfter time.Duration `toml:"deregister_critical_after"`
+}
 
-	if err := r.ParseMultipartForm(32 << 20); err != nil {
-		logError(ctx, "multipart/form-dataの解析に失敗しました: %v", err)
-		http.Error(w, "multipart/form-dataの解析に失敗しました", http.StatusBadRequest)
-		return
-	}
+// DebugConfig は /debug 以下の pprof・expvar を公開するかの設定です。公開する場合も管理者のみアクセスできます
+type DebugConfig struct {
+	Enabled bool `toml:"enabled"`
+}
 
-	bleFile, _, err := r.FormFile("ble_data")
-	if err != nil {
-		logError(ctx, "ble_dataファイルの取得に失敗しました: %v", err)
-		http.Error(w, "ble_dataファイルの取得に失敗しました", http.StatusBadRequest)
-		return
-	}
-	defer bleFile.Close()
+type LogLevelResponse struct {
+	Level string `json:"level"`
+}
 
-	wifiFile, _, err := r.FormFile("wifi_data")
-	if err != nil {
-		logError(ctx, "wifi_dataファイルの取得に失敗しました: %v", err)
-		http.Error(w, "wifi_dataファイルの取得に失敗しました", http.StatusBadRequest)
-		return
-	}
-	defer wifiFile.Close()
+type UploadResponse struct {
+	Message string `json:"message"`
+	// Result は在室判定の結果です（room_assigned・session_ended・uncertain・queued・not_tracked）
+	Result string `json:"result,omitempty"`
+	// RoomID は Result が room_assigned の場合に割り当てたルーム、not_tracked の場合に推定したルームです
+	RoomID int `json:"room_id,omitempty"`
+	// NegativeSample は送信したデータをネガティブサンプルとして保存したかどうかです
+	NegativeSample bool `json:"negative_sample,omitempty"`
+}
 
-	tempBleFilePath := filepath.Join(os.TempDir(), fmt.Sprintf("ble_data_%d.csv", time.Now().Unix()))
-	if err := saveUploadedFile(ctx, bleFile, tempBleFilePath); err != nil {
-		logError(ctx, "ble_dataファイルの保存に失敗しました: %v", err)
-		http.Error(w, "ble_dataファイルの保存に失敗しました", http.StatusInternalServerError)
-		return
-	}
-	defer os.Remove(tempBleFilePath)
+// 信号の送信に対する在室判定の結果です。uncertain は問い合わせサーバーの信頼度が上回ったものの
+// [Decision] inquiry_win が keep_session のためセッションを変更しなかったことを、queued は推定サーバーに転送できないため
+// リトライキューに保存したことを、not_tracked はユーザーが在室状況の記録への同意を取り消している、または記録を一時停止しているため
+// 推定だけを行ったことを表します
+const (
+	submitResultRoomAssigned = "room_assigned"
+	submitResultSessionEnded = "session_ended"
+	submitResultUncertain    = "uncertain"
+	submitResultQueued       = "queued"
+	submitResultNotTracked   = "not_tracked"
+)
 
-	tempWifiFilePath := filepath.Join(os.TempDir(), fmt.Sprintf("wifi_data_%d.csv", time.Now().Unix()))
-	if err := saveUploadedFile(ctx, wifiFile, tempWifiFilePath); err != nil {
-		logError(ctx, "wifi_dataファイルの保存に失敗しました: %v", err)
-		http.Error(w, "wifi_dataファイルの保存に失敗しました", http.StatusInternalServerError)
-		return
-	}
-	defer os.Remove(tempWifiFilePath)
+// /api/signals/sync で送信したスキャンごとの処理の結果です。applied は在室判定してセッションに反映したことを、
+// superseded はすでに記録した在室判定の時刻以前のスキャンのため反映しなかったことを、rejected はスキャンの内容・時刻が不正なことを、
+// not_tracked は在室状況を記録しないユーザーのため処理しなかったことを表します。failed は推定サーバーへの転送などに失敗したことを表し、
+// 以降のスキャンは順に判定できないため not_processed として処理しません。端末は failed・not_processed のスキャンを送り直します
+const (
+	syncApplied      = "applied"
+	syncSuperseded   = "superseded"
+	syncRejected     = "rejected"
+	syncNotTracked   = "not_tracked"
+	syncFailed       = "failed"
+	syncNotProcessed = "not_processed"
+)
 
-	percentage, err := forwardFilesToEstimationServer(ctx, tempBleFilePath, tempWifiFilePath, estimationURL)
-	if err != nil {
-		logError(ctx, "推定サーバーへの転送に失敗しました: %v", err)
-		http.Error(w, fmt.Sprintf("推定サーバーへの転送に失敗しました: %v", err), http.StatusInternalServerError)
-		return
-	}
+// SyncScanResult は /api/signals/sync で送信したスキャン1件の処理の結果です。Index は送信した順番（0 から）です
+type SyncScanResult struct {
+	Index       int        `json:"index"`
+	ScannedAt   *time.Time `json:"scanned_at"`
+	Disposition string     `json:"disposition"`
+	// Result・RoomID は Disposition が applied の場合の在室判定の結果です
+	Result string `json:"result,omitempty"`
+	RoomID int    `json:"room_id,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
 
-	percentageInt := percentage
+type SyncResponse struct {
+	Counts map[string]int   `json:"counts"`
+	Scans  []SyncScanResult `json:"scans"`
+}
 
-	response := EstimationServerResponse{
-		PercentageProcessed: percentageInt,
-	}
+// 匿名の在室状況で返す内容です（[PublicDisplay] mode）
+const (
+	publicDisplayCount     = "count"
+	publicDisplayPseudonym = "pseudonym"
+)
 
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(response); err != nil {
-		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
-		http.Error(w, "JSON応答のエンコードに失敗しました", http.StatusInternalServerError)
-		return
-	}
+// 問い合わせサーバーの信頼度が推定サーバーを上回った場合の扱いです（[Decision] inquiry_win）
+const (
+	inquiryWinEndSession  = "end_session"
+	inquiryWinKeepSession = "keep_session"
+)
 
-	logRequest(ctx, "POST /api/signals/server リクエストの処理が完了しました")
+type RegisterRequest struct {
+	Scheme string `json:"scheme"`
+	Host   string `json:"host"`
+	Port   int    `json:"port,omitempty"`
 }
 
-func parseBLECSV(ctx context.Context, filePath string) ([]BeaconSignal, error) {
-	file, err := os.Open(filePath)
-	if err != nil {
+type PresenceSession struct {
+	SessionID int        `json:"session_id"`
+	UserID    int        `json:"user_id"`
+	RoomID    int        `json:"room_id"`
+	StartTime time.Time  `json:"start_time"`
+	EndTime   *time.Time `json:"end_time"`
+	LastSeen  time.Time  `json:"last_seen"`
+}
+
+// FingerprintSample は収集したフィンガープリントデータ（WiFi/BLEのCSVの組）です。
+// 同じルームに同じ内容のデータが再送された場合は保存せず、duplicate_count を増やします
+type FingerprintSample struct {
+	SampleID        int        `json:"sample_id"`
+	RoomID          int        `json:"room_id"`
+	SampleType      string     `json:"sample_type"`
+	WifiKey         string     `json:"-"`
+	BleKey          string     `json:"-"`
+	WifiSHA256      string     `json:"wifi_sha256"`
+	BleSHA256       string     `json:"ble_sha256"`
+	WifiSize        int64      `json:"wifi_size"`
+	BleSize         int64      `json:"ble_size"`
+	WifiRecords     int        `json:"wifi_records"`
+	BleRecords      int        `json:"ble_records"`
+	CollectedAt     time.Time  `json:"collected_at"`
+	CollectedBy     string     `json:"collected_by"`
+	DuplicateCount  int        `json:"duplicate_count"`
+	LastDuplicateAt *time.Time `json:"last_duplicate_at"`
+}
+
+// FingerprintSampleFilter は ListFingerprintSamples の絞り込み条件です。RoomID が nil の場合は全ルームが対象です
+type FingerprintSampleFilter struct {
+	RoomID     *int
+	SampleType string
+	AfterID    int
+	Limit      int
+}
+
+type FingerprintSampleListResponse struct {
+	Samples    []FingerprintSample `json:"samples"`
+	NextCursor string              `json:"next_cursor,omitempty"`
+}
+
+// AuditEntry は管理者による変更操作の記録です
+type AuditEntry struct {
+	AuditID   int       `json:"audit_id"`
+	Actor     string    `json:"actor"`
+	Action    string    `json:"action"`
+	Target    string    `json:"target"`
+	Detail    string    `json:"detail"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type AuditLogResponse struct {
+	Entries []AuditEntry `json:"entries"`
+}
+
+// HistoryAccessEntry は在室履歴の取得の記録です。TargetUserID が nil の場合は全ユーザー（ルーム単位を含む）の履歴を取得したことを示します
+type HistoryAccessEntry struct {
+	AccessID     int       `json:"access_id"`
+	Requester    string    `json:"requester"`
+	TargetUserID *int      `json:"target_user_id"`
+	Endpoint     string    `json:"endpoint"`
+	From         time.Time `json:"from"`
+	To           time.Time `json:"to"`
+	AccessedAt   time.Time `json:"accessed_at"`
+}
+
+// HistoryAccessFilter は在室履歴の取得の記録の絞り込み条件です。TargetUserID を指定した場合、全ユーザーの履歴の取得も含めます
+type HistoryAccessFilter struct {
+	Requester    string
+	TargetUserID *int
+	Limit        int
+}
+
+type HistoryAccessLogResponse struct {
+	Entries []HistoryAccessEntry `json:"entries"`
+}
+
+// Organization はユーザー・ルーム・デバイス・在室データの所属先となる組織（研究室など）です
+type Organization struct {
+	OrgID     int       `json:"org_id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// APIKey は組織に発行したAPIキーです。キー本体は発行時の応答にだけ含め、データベースにはSHA-256のハッシュを保存します。
+// MonthlyQuota は1か月に受け付けるリクエスト数の上限で、0 の場合は制限しません
+type APIKey struct {
+	KeyID        int        `json:"key_id"`
+	OrgID        int        `json:"org_id"`
+	Name         string     `json:"name"`
+	Prefix       string     `json:"prefix"`
+	MonthlyQuota int64      `json:"monthly_quota"`
+	CreatedBy    string     `json:"created_by"`
+	CreatedAt    time.Time  `json:"created_at"`
+	RevokedAt    *time.Time `json:"revoked_at,omitempty"`
+}
+
+type APIKeyListResponse struct {
+	Keys []APIKey `json:"keys"`
+}
+
+// APIKeyCreatedResponse は発行したAPIキーです。Key は再表示できないため、発行した時点で控えておく必要があります
+type APIKeyCreatedResponse struct {
+	APIKey
+	Key string `json:"key"`
+}
+
+// UsageCounter は組織・APIキー（APIキーを使わないリクエストは KeyID 0）ごとの1か月の利用量です
+type UsageCounter struct {
+	OrgID  int
+	KeyID  int
+	Metric string
+	Count  int64
+}
+
+type APIKeyUsage struct {
+	KeyID        int    `json:"key_id"`
+	Name         string `json:"name"`
+	Requests     int64  `json:"requests"`
+	MonthlyQuota int64  `json:"monthly_quota"`
+	Revoked      bool   `json:"revoked"`
+}
+
+// TenantUsage は組織の1か月の利用量です。Requests はAPIキーを付けたリクエストの数、StorageBytes は保存したアップロードファイルの合計です
+type TenantUsage struct {
+	OrgID           int           `json:"org_id"`
+	Name            string        `json:"name"`
+	Requests        int64         `json:"requests"`
+	Submissions     int64         `json:"submissions"`
+	StorageBytes    int64         `json:"storage_bytes"`
+	EstimationCalls int64         `json:"estimation_calls"`
+	InquiryCalls    int64         `json:"inquiry_calls"`
+	Keys            []APIKeyUsage `json:"keys"`
+}
+
+type UsageResponse struct {
+	Month   string        `json:"month"`
+	Tenants []TenantUsage `json:"tenants"`
+}
+
+// TenantSettings は組織ごとに設定ファイルの値を上書きする設定です。指定のない項目は設定ファイル（再読み込みした場合はその値）を使用します。
+// retention のキーは [RetentionPolicy.categories] の分類で、保存先が組織で分かれていない uploads は指定できません
+type TenantSettings struct {
+	InactivityTimeout string                   `json:"inactivity_timeout,omitempty"`
+	InquiryMin        *int                     `json:"inquiry_min,omitempty"`
+	InquiryMax        *int                     `json:"inquiry_max,omitempty"`
+	Retention         map[string]RetentionRule `json:"retention,omitempty"`
+}
+
+type TenantSettingsRecord struct {
+	OrgID     int
+	Settings  TenantSettings
+	UpdatedBy string
+	UpdatedAt time.Time
+}
+
+// TenantSettingsResponse は組織の上書きと、上書きを設定ファイルの値に適用した実際の設定です
+type TenantSettingsResponse struct {
+	OrgID     int               `json:"org_id"`
+	Overrides TenantSettings    `json:"overrides"`
+	Effective EffectiveSettings `json:"effective"`
+	UpdatedBy string            `json:"updated_by,omitempty"`
+	UpdatedAt *time.Time        `json:"updated_at,omitempty"`
+}
+
+type EffectiveSettings struct {
+	InactivityTimeout string                   `json:"inactivity_timeout"`
+	InquiryMin        int                      `json:"inquiry_min"`
+	InquiryMax        int                      `json:"inquiry_max"`
+	Retention         map[string]RetentionRule `json:"retention"`
+}
+
+// FingerprintManifest はデータセットとしてエクスポートしたフィンガープリントデータの一覧です
+type FingerprintManifest struct {
+	GeneratedAt time.Time                  `json:"generated_at"`
+	RoomID      *int                       `json:"room_id,omitempty"`
+	SampleType  string                     `json:"sample_type,omitempty"`
+	Samples     []FingerprintManifestEntry `json:"samples"`
+}
+
+type FingerprintManifestEntry struct {
+	SampleID    int       `json:"sample_id"`
+	RoomID      int       `json:"room_id"`
+	RoomName    string    `json:"room_name"`
+	SampleType  string    `json:"sample_type"`
+	CollectedAt time.Time `json:"collected_at"`
+	CollectedBy string    `json:"collected_by"`
+	WifiFile    string    `json:"wifi_file"`
+	BleFile     string    `json:"ble_file"`
+	WifiSHA256  string    `json:"wifi_sha256"`
+	BleSHA256   string    `json:"ble_sha256"`
+	WifiRecords int       `json:"wifi_records"`
+	BleRecords  int       `json:"ble_records"`
+}
+
+// DatasetSnapshot は名前を付けて固定したフィンガープリントデータセットです。一度作成したスナップショットは変更しません
+type DatasetSnapshot struct {
+	SnapshotID   int                  `json:"snapshot_id"`
+	Name         string               `json:"name"`
+	Description  string               `json:"description"`
+	CreatedBy    string               `json:"created_by"`
+	CreatedAt    time.Time            `json:"created_at"`
+	SampleCount  int                  `json:"sample_count"`
+	ManifestJSON string               `json:"-"`
+	Manifest     *FingerprintManifest `json:"manifest,omitempty"`
+}
+
+type DatasetListResponse struct {
+	Datasets []DatasetSnapshot `json:"datasets"`
+}
+
+type FingerprintDedupStats struct {
+	Samples          int   `json:"samples"`
+	DuplicateUploads int   `json:"duplicate_uploads"`
+	DuplicateBytes   int64 `json:"duplicate_bytes"`
+}
+
+type FingerprintCollectResponse struct {
+	Message   string `json:"message"`
+	SampleID  int    `json:"sample_id"`
+	Duplicate bool   `json:"duplicate"`
+}
+
+type PresenceDecision struct {
+	DecisionID           int       `json:"decision_id"`
+	UserID               int       `json:"user_id"`
+	RoomID               *int      `json:"room_id"`
+	EstimationConfidence int       `json:"estimation_confidence"`
+	InquiryConfidence    *int      `json:"inquiry_confidence"`
+	Decision             string    `json:"decision"`
+	DecidedAt            time.Time `json:"decided_at"`
+	// DeviceID は送信した端末です。device_id を付けずに送信した場合は null です
+	DeviceID *int `json:"device_id"`
+}
+
+// UploadRecord は送信・収集ごとに保存したファイルの記録です。
+// kind が signals の場合は decision_id にその送信の在室判定、fingerprint の場合は sample_id にフィンガープリントデータを関連付けます
+type UploadRecord struct {
+	UploadID   int       `json:"upload_id"`
+	Kind       string    `json:"kind"`
+	UserName   string    `json:"user_name"`
+	RoomID     *int      `json:"room_id"`
+	DecisionID *int      `json:"decision_id"`
+	Decision   string    `json:"decision,omitempty"`
+	SampleID   *int      `json:"sample_id"`
+	WifiKey    string    `json:"wifi_key"`
+	BleKey     string    `json:"ble_key"`
+	WifiSize   int64     `json:"wifi_size"`
+	BleSize    int64     `json:"ble_size"`
+	WifiSHA256 string    `json:"wifi_sha256"`
+	BleSHA256  string    `json:"ble_sha256"`
+	UploadedAt time.Time `json:"uploaded_at"`
+}
+
+// QueuedSubmission は推定サーバーに転送できなかったため、後で元の受信時刻のまま在室判定し直す信号の送信です
+type QueuedSubmission struct {
+	QueueID     int       `json:"queue_id"`
+	UserID      int       `json:"user_id"`
+	UploadID    *int      `json:"upload_id"`
+	WifiKey     string    `json:"wifi_key"`
+	BleKey      string    `json:"ble_key"`
+	SubmittedAt time.Time `json:"submitted_at"`
+	Attempts    int       `json:"attempts"`
+	LastError   string    `json:"last_error"`
+	DeviceID    *int      `json:"device_id"`
+}
+
+// UploadFilter は保存ファイルの記録の絞り込み条件です。AfterID より大きい upload_id を昇順に返します
+type UploadFilter struct {
+	UserName   string
+	Kind       string
+	DecisionID *int
+	AfterID    int
+	Limit      int
+}
+
+// UserDataExport はユーザーのデータのエクスポート（user.json）に含めるユーザーの情報です
+type UserDataExport struct {
+	UserID     int             `json:"user_id"`
+	UserName   string          `json:"user_name"`
+	Consent    TrackingConsent `json:"consent"`
+	ExportedAt time.Time       `json:"exported_at"`
+	Sessions   int             `json:"sessions"`
+	Uploads    int             `json:"uploads"`
+}
+
+type UploadRecordListResponse struct {
+	Uploads    []UploadRecord `json:"uploads"`
+	NextCursor string         `json:"next_cursor,omitempty"`
+}
+
+type PresenceDecisionsResponse struct {
+	Decisions []PresenceDecision `json:"decisions"`
+}
+
+type RoomTransition struct {
+	TransitionID   int       `json:"transition_id"`
+	UserID         int       `json:"user_id"`
+	FromRoomID     int       `json:"from_room_id"`
+	ToRoomID       int       `json:"to_room_id"`
+	TransitionedAt time.Time `json:"transitioned_at"`
+}
+
+type UserTransitionsResponse struct {
+	UserID      int              `json:"user_id"`
+	Transitions []RoomTransition `json:"transitions"`
+}
+
+type NegativeSampleStatsResponse struct {
+	Enabled            bool    `json:"enabled"`
+	SampleRate         float64 `json:"sample_rate"`
+	MaxSamples         int     `json:"max_samples"`
+	Dir                string  `json:"dir"`
+	StoredSamples      int     `json:"stored_samples"`
+	CapturedSinceStart uint64  `json:"captured_since_start"`
+	SkippedSinceStart  uint64  `json:"skipped_since_start"`
+}
+
+type UserPresenceDay struct {
+	Date     string            `json:"date"`
+	Sessions []PresenceSession `json:"sessions"`
+}
+
+type AllUsersPresenceDay struct {
+	Date  string               `json:"date"`
+	Users []UserPresenceDetail `json:"users"`
+}
+
+type UserPresenceDetail struct {
+	UserID   int               `json:"user_id"`
+	Sessions []PresenceSession `json:"sessions"`
+}
+
+type PresenceHistoryResponse struct {
+	AllHistory []AllUsersPresenceDay `json:"all_history,omitempty"`
+	NextCursor string                `json:"next_cursor,omitempty"`
+}
+
+// TrackingConsent はユーザーが在室状況の記録に同意しているかどうかです。UpdatedAt は一度も変更していない場合は null です。
+// PausedUntil は在室状況の記録を一時停止している場合の再開する時刻で、一時停止していない場合は null です
+type TrackingConsent struct {
+	UserID      int        `json:"user_id"`
+	Consent     bool       `json:"consent"`
+	UpdatedAt   *time.Time `json:"updated_at"`
+	PausedUntil *time.Time `json:"paused_until"`
+}
+
+// maxTrackingPause は在室状況の記録を一時停止できる最長の期間です
+const maxTrackingPause = 7 * 24 * time.Hour
+
+// trackingPaused はユーザーが at の時点で在室状況の記録を一時停止しているかを返します
+func trackingPaused(consent TrackingConsent, at time.Time, loc *time.Location) bool {
+	return consent.PausedUntil != nil && at.Before(fromWallClock(*consent.PausedUntil, loc))
+}
+
+type UserPresenceResponse struct {
+	UserID  int               `json:"user_id"`
+	History []UserPresenceDay `json:"history"`
+}
+
+type RoomOccupancyDay struct {
+	Date        string            `json:"date"`
+	UniqueUsers int               `json:"unique_users"`
+	Sessions    []PresenceSession `json:"sessions"`
+}
+
+type RoomPresenceHistoryResponse struct {
+	RoomID   int                `json:"room_id"`
+	RoomName string             `json:"room_name"`
+	History  []RoomOccupancyDay `json:"history"`
+}
+
+type UserPresenceStat struct {
+	PeriodStart           string  `json:"period_start"`
+	UserID                int     `json:"user_id"`
+	SessionCount          int     `json:"session_count"`
+	TotalHours            float64 `json:"total_hours"`
+	AverageSessionMinutes float64 `json:"average_session_minutes"`
+}
+
+type RoomPresenceStat struct {
+	PeriodStart           string  `json:"period_start"`
+	RoomID                int     `json:"room_id"`
+	OccupancyHours        float64 `json:"occupancy_hours"`
+	UniqueVisitors        int     `json:"unique_visitors"`
+	AverageSessionMinutes float64 `json:"average_session_minutes"`
+}
+
+// StatsPrivacyInfo は統計の応答に適用した秘匿モードのパラメータです
+type StatsPrivacyInfo struct {
+	MinUsers int     `json:"min_users"`
+	Epsilon  float64 `json:"epsilon"`
+}
+
+type PresenceStatsResponse struct {
+	Period  string             `json:"period"`
+	From    string             `json:"from"`
+	To      string             `json:"to"`
+	Privacy *StatsPrivacyInfo  `json:"privacy,omitempty"`
+	Users   []UserPresenceStat `json:"users"`
+	Rooms   []RoomPresenceStat `json:"rooms"`
+}
+
+// RoomHeatmapRow の Suppressed は秘匿モードで返さなかった（0 にした）時刻の一覧です
+type RoomHeatmapRow struct {
+	RoomID     int       `json:"room_id"`
+	RoomName   string    `json:"room_name"`
+	Values     []float64 `json:"values"`
+	Suppressed []int     `json:"suppressed,omitempty"`
+	visitors   []int
+}
+
+type HeatmapResponse struct {
+	Granularity string            `json:"granularity"`
+	From        string            `json:"from"`
+	To          string            `json:"to"`
+	Privacy     *StatsPrivacyInfo `json:"privacy,omitempty"`
+	Buckets     []int             `json:"buckets"`
+	Rooms       []RoomHeatmapRow  `json:"rooms"`
+}
+
+type AttendanceDay struct {
+	Date       string    `json:"date"`
+	FirstIn    time.Time `json:"first_in"`
+	LastOut    time.Time `json:"last_out"`
+	TotalHours float64   `json:"total_hours"`
+}
+
+type UserAttendance struct {
+	UserID      int             `json:"user_id"`
+	UserName    string          `json:"user_name"`
+	DaysPresent int             `json:"days_present"`
+	TotalHours  float64         `json:"total_hours"`
+	Days        []AttendanceDay `json:"days"`
+}
+
+type AttendanceReport struct {
+	Month       string           `json:"month"`
+	GeneratedAt time.Time        `json:"generated_at"`
+	Users       []UserAttendance `json:"users"`
+}
+
+type RoomDwellStat struct {
+	RoomID        int     `json:"room_id"`
+	RoomName      string  `json:"room_name"`
+	SessionCount  int     `json:"session_count"`
+	MeanMinutes   float64 `json:"mean_minutes"`
+	MedianMinutes float64 `json:"median_minutes"`
+	P25Minutes    float64 `json:"p25_minutes"`
+	P75Minutes    float64 `json:"p75_minutes"`
+	P90Minutes    float64 `json:"p90_minutes"`
+	P95Minutes    float64 `json:"p95_minutes"`
+	visitors      int
+}
+
+type DwellStatsResponse struct {
+	From    string            `json:"from"`
+	To      string            `json:"to"`
+	Privacy *StatsPrivacyInfo `json:"privacy,omitempty"`
+	Rooms   []RoomDwellStat   `json:"rooms"`
+}
+
+// ForecastPoint の Suppressed は秘匿モードで予測値を返さなかった（0 にした）ことを示します
+type ForecastPoint struct {
+	Time              time.Time `json:"time"`
+	ExpectedOccupants float64   `json:"expected_occupants"`
+	Suppressed        bool      `json:"suppressed,omitempty"`
+}
+
+type RoomForecast struct {
+	RoomID   int             `json:"room_id"`
+	RoomName string          `json:"room_name"`
+	Forecast []ForecastPoint `json:"forecast"`
+}
+
+type ForecastResponse struct {
+	GeneratedAt  time.Time         `json:"generated_at"`
+	HistoryWeeks int               `json:"history_weeks"`
+	Hours        int               `json:"hours"`
+	Privacy      *StatsPrivacyInfo `json:"privacy,omitempty"`
+	Rooms        []RoomForecast    `json:"rooms"`
+}
+
+// seasonalModel はルームごとの曜日(0=日曜)×時刻の平均在室人数と、その時間帯に在室したユーザー数です
+type seasonalModel struct {
+	RoomID   int
+	RoomName string
+	Averages [7][24]float64
+	Visitors [7][24]int
+}
+
+type PurgeResponse struct {
+	Removed  int64     `json:"removed"`
+	Archived bool      `json:"archived"`
+	Cutoff   time.Time `json:"cutoff"`
+}
+
+// SessionRepairResponse は同じユーザーに重複して開いていたセッションの修復結果です。
+// dry_run の場合は closed に終了する予定のセッションを返し、実際には変更しません
+type SessionRepairResponse struct {
+	DryRun bool                `json:"dry_run"`
+	Users  []SessionRepairUser `json:"users"`
+	Closed int                 `json:"closed"`
+}
+
+// SessionRepairUser は1人のユーザーについて残したセッションと終了したセッションです
+type SessionRepairUser struct {
+	UserID int               `json:"user_id"`
+	Kept   PresenceSession   `json:"kept"`
+	Closed []PresenceSession `json:"closed"`
+}
+
+// RequestTooLargeResponse は [RouteLimits] の max_body_mb・max_file_mb を超えた場合の 413 の応答です
+type RequestTooLargeResponse struct {
+	Error      string `json:"error"`
+	Limit      string `json:"limit"`
+	LimitBytes int64  `json:"limit_bytes"`
+	Field      string `json:"field,omitempty"`
+}
+
+type UploadPurgeResponse struct {
+	Removed        int64     `json:"removed"`
+	Archived       int64     `json:"archived"`
+	BytesReclaimed int64     `json:"bytes_reclaimed"`
+	Cutoff         time.Time `json:"cutoff"`
+}
+
+// RetentionCategoryResult は保持期間ポリシーの1つの分類の削除結果です。
+// OrgID は組織ごとの設定（/api/admin/tenant_settings）の保持期間で削除した場合のみ設定します
+type RetentionCategoryResult struct {
+	Category       string    `json:"category"`
+	OrgID          int       `json:"org_id,omitempty"`
+	Cutoff         time.Time `json:"cutoff"`
+	Removed        int64     `json:"removed"`
+	Archived       int64     `json:"archived"`
+	BytesReclaimed int64     `json:"bytes_reclaimed"`
+	Error          string    `json:"error,omitempty"`
+}
+
+// RetentionReport は保持期間ポリシーの1回の適用結果です
+type RetentionReport struct {
+	StartedAt  time.Time                 `json:"started_at"`
+	FinishedAt time.Time                 `json:"finished_at"`
+	Categories []RetentionCategoryResult `json:"categories"`
+}
+
+type RetentionPolicyResponse struct {
+	Interval   string                   `json:"interval"`
+	Categories map[string]RetentionRule `json:"categories"`
+	LastReport *RetentionReport         `json:"last_report"`
+}
+
+type UploadStatsResponse struct {
+	RetentionDays            int        `json:"retention_days"`
+	Archive                  bool       `json:"archive"`
+	StoredFiles              int        `json:"stored_files"`
+	StoredBytes              int64      `json:"stored_bytes"`
+	RemovedSinceStart        uint64     `json:"removed_since_start"`
+	ArchivedSinceStart       uint64     `json:"archived_since_start"`
+	BytesReclaimedSinceStart uint64     `json:"bytes_reclaimed_since_start"`
+	LastRun                  *time.Time `json:"last_run"`
+}
+
+type UserStorageUsage struct {
+	UserName  string `json:"user_name"`
+	Files     int    `json:"files"`
+	UsedBytes int64  `json:"used_bytes"`
+}
+
+type RoomStorageUsage struct {
+	OrgID     int   `json:"org_id"`
+	RoomID    int   `json:"room_id"`
+	Files     int   `json:"files"`
+	UsedBytes int64 `json:"used_bytes"`
+}
+
+// EstimationShardStats は推定サーバーのシャードに振り分けるルームの数と、起動してから振り分けた送信の数です
+type EstimationShardStats struct {
+	URL      string `json:"url"`
+	Rooms    int    `json:"rooms"`
+	Requests uint64 `json:"requests"`
+}
+
+// DeviceCacheResponse はメモリに保持しているビーコン・WiFiアクセスポイントの件数です
+type DeviceCacheResponse struct {
+	Beacons          int       `json:"beacons"`
+	WifiAccessPoints int       `json:"wifi_access_points"`
+	RefreshedAt      time.Time `json:"refreshed_at"`
+}
+
+type StorageUsageResponse struct {
+	UserQuotaBytes int64              `json:"user_quota_bytes"`
+	RoomQuotaBytes int64              `json:"room_quota_bytes"`
+	Users          []UserStorageUsage `json:"users"`
+	Rooms          []RoomStorageUsage `json:"rooms"`
+	UpdatedAt      time.Time          `json:"updated_at"`
+}
+
+// StorageVerifyIssue は検証で見つかった欠損・破損したファイルです。problem は missing・unreadable・corrupted のいずれかです
+type StorageVerifyIssue struct {
+	SampleID       int    `json:"sample_id"`
+	Key            string `json:"key"`
+	Problem        string `json:"problem"`
+	ExpectedSHA256 string `json:"expected_sha256"`
+	ActualSHA256   string `json:"actual_sha256,omitempty"`
+}
+
+type StorageVerifyReport struct {
+	Status          string               `json:"status"`
+	StartedAt       *time.Time           `json:"started_at"`
+	FinishedAt      *time.Time           `json:"finished_at"`
+	CheckedFiles    int                  `json:"checked_files"`
+	MissingFiles    int                  `json:"missing_files"`
+	CorruptedFiles  int                  `json:"corrupted_files"`
+	UnreadableFiles int                  `json:"unreadable_files"`
+	Issues          []StorageVerifyIssue `json:"issues"`
+	Error           string               `json:"error,omitempty"`
+}
+
+type CurrentOccupant struct {
+	UserID   string    `json:"user_id"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+type RoomOccupants struct {
+	RoomID    int               `json:"room_id"`
+	RoomName  string            `json:"room_name"`
+	Occupants []CurrentOccupant `json:"occupants"`
+}
+
+type CurrentOccupantsResponse struct {
+	Rooms []RoomOccupants `json:"rooms"`
+}
+
+// AnonymousRoomOccupancy はユーザーを明かさないルームごとの在室状況です。Pseudonyms は [PublicDisplay] mode が pseudonym の場合のみ返します
+type AnonymousRoomOccupancy struct {
+	RoomID     int      `json:"room_id"`
+	RoomName   string   `json:"room_name"`
+	Count      int      `json:"count"`
+	Pseudonyms []string `json:"pseudonyms,omitempty"`
+}
+
+type AnonymousOccupantsResponse struct {
+	Rooms []AnonymousRoomOccupancy `json:"rooms"`
+}
+
+// FederationSiteStatus はピアから取得できたかどうかです。取得できなかったサイトは他のサイトの結果に含めず、Error に理由を返します
+type FederationSiteStatus struct {
+	Site     string `json:"site"`
+	Timezone string `json:"timezone"`
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+}
+
+// FederatedOccupant の UserID は {サイト名}:{ユーザー名} です
+type FederatedOccupant struct {
+	UserID   string    `json:"user_id"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// FederatedRoomOccupants の RoomID は {サイト名}:{ルームID}、SiteRoomID はピアでのルームIDです
+type FederatedRoomOccupants struct {
+	RoomID     string              `json:"room_id"`
+	Site       string              `json:"site"`
+	SiteRoomID int                 `json:"site_room_id"`
+	RoomName   string              `json:"room_name"`
+	Occupants  []FederatedOccupant `json:"occupants"`
+}
+
+type FederatedOccupantsResponse struct {
+	Sites []FederationSiteStatus   `json:"sites"`
+	Rooms []FederatedRoomOccupants `json:"rooms"`
+}
+
+// FederatedSession はピアの在室セッションです。UserID はセッションのユーザーの {サイト名}:{ユーザーID} で、時刻はサイトのタイムゾーンで返します
+type FederatedSession struct {
+	SessionID string     `json:"session_id"`
+	Site      string     `json:"site"`
+	UserID    string     `json:"user_id"`
+	RoomID    string     `json:"room_id"`
+	StartTime time.Time  `json:"start_time"`
+	EndTime   *time.Time `json:"end_time"`
+	LastSeen  time.Time  `json:"last_seen"`
+}
+
+// FederatedUserPresence の UserID は {サイト名}:{ユーザーID} です。人物（identity）に結び付けたユーザーは UserID を人物の名前にして
+// サイトをまたいでセッションをまとめ、LinkedUserIDs にその日のセッションがあったユーザーを返します
+type FederatedUserPresence struct {
+	UserID        string             `json:"user_id"`
+	LinkedUserIDs []string           `json:"linked_user_ids,omitempty"`
+	Sessions      []FederatedSession `json:"sessions"`
+}
+
+type FederatedPresenceDay struct {
+	Date  string                  `json:"date"`
+	Users []FederatedUserPresence `json:"users"`
+}
+
+type FederatedHistoryResponse struct {
+	Sites      []FederationSiteStatus `json:"sites"`
+	AllHistory []FederatedPresenceDay `json:"all_history"`
+}
+
+// IdentityLink はサイト Site のユーザー UserID（ピアの /api/presence_history の user_id）を人物 Identity に結び付けます。
+// 同じ人物がサイトごとに別のユーザーIDを持つ場合に、集約モードの在室履歴をまとめるために使用します
+type IdentityLink struct {
+	LinkID    int       `json:"link_id"`
+	OrgID     int       `json:"org_id"`
+	Identity  string    `json:"identity"`
+	Site      string    `json:"site"`
+	UserID    int       `json:"user_id"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type IdentityLinkListResponse struct {
+	Links []IdentityLink `json:"links"`
+}
+
+// UserDevice はユーザーが信号の送信に使う端末（スマートフォン・ノートPCなど）です。
+// 1人のユーザーは複数の端末を登録でき、送信に device_id を付けると在室判定ごとに送信した端末を記録します
+type UserDevice struct {
+	DeviceID   int        `json:"device_id"`
+	UserID     int        `json:"user_id"`
+	Name       string     `json:"name"`
+	Platform   string     `json:"platform"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastSeenAt *time.Time `json:"last_seen_at"`
+}
+
+type UserDeviceListResponse struct {
+	Devices []UserDevice `json:"devices"`
+}
+
+const (
+	deviceScanWork   = "work"
+	deviceScanOpen   = "open"
+	deviceScanClosed = "closed"
+)
+
+// DeviceScanSettings は端末に配信するスキャンの設定です。mode は work（勤務時間）・open（勤務時間外）・closed（閉館時間）のいずれかで、
+// valid_until に mode が変わるため端末は valid_until を過ぎたら設定を取得し直します。mode が変わらない場合は null です
+type DeviceScanSettings struct {
+	DeviceID            int        `json:"device_id"`
+	BuildingID          *int       `json:"building_id"`
+	Mode                string     `json:"mode"`
+	ScanIntervalSeconds int        `json:"scan_interval_seconds"`
+	MinRSSI             int        `json:"min_rssi"`
+	UploadBatchSize     int        `json:"upload_batch_size"`
+	ValidUntil          *time.Time `json:"valid_until"`
+}
+
+// BuildingAdmin はユーザー UserID に建物 BuildingID の管理を委任します。
+// 委任されたユーザーは組織の管理者でなくても、その建物の階のルーム・ビーコンと、そのルームの在室判定・ユーザーの履歴を管理できます
+type BuildingAdmin struct {
+	UserID     int       `json:"user_id"`
+	BuildingID int       `json:"building_id"`
+	OrgID      int       `json:"org_id"`
+	CreatedBy  string    `json:"created_by"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type BuildingAdminListResponse struct {
+	Admins []BuildingAdmin `json:"admins"`
+}
+
+// ManagedRoom は /api/admin/rooms で登録・変更するルームです。floor_id が null の場合は階に割り当てません
+type ManagedRoom struct {
+	RoomID   int    `json:"room_id"`
+	RoomName string `json:"room_name"`
+	FloorID  *int   `json:"floor_id"`
+}
+
+type ManagedRoomListResponse struct {
+	Rooms []ManagedRoom `json:"rooms"`
+}
+
+// ManagedBeacon は /api/admin/beacons で登録・変更するビーコンです
+type ManagedBeacon struct {
+	BeaconID    int    `json:"beacon_id"`
+	BeaconName  string `json:"beacon_name"`
+	ServiceUUID string `json:"service_uuid"`
+	RoomID      *int   `json:"room_id"`
+}
+
+type ManagedBeaconListResponse struct {
+	Beacons []ManagedBeacon `json:"beacons"`
+}
+
+// Building は複数の階をまとめる建物です
+type Building struct {
+	BuildingID int     `json:"building_id"`
+	Name       string  `json:"name"`
+	Floors     []Floor `json:"floors"`
+}
+
+// Floor は建物の階です。ルームは rooms.floor_id で階に割り当てます
+type Floor struct {
+	FloorID    int    `json:"floor_id"`
+	BuildingID int    `json:"building_id"`
+	Name       string `json:"name"`
+	Level      int    `json:"level"`
+	RoomIDs    []int  `json:"room_ids"`
+}
+
+type BuildingsResponse struct {
+	Buildings []Building `json:"buildings"`
+}
+
+// FloorOccupantsResponse は階に属するルームの在室者と、階全体の在室人数です
+type FloorOccupantsResponse struct {
+	FloorID    int             `json:"floor_id"`
+	BuildingID int             `json:"building_id"`
+	Name       string          `json:"name"`
+	Level      int             `json:"level"`
+	Occupants  int             `json:"occupants"`
+	Rooms      []RoomOccupants `json:"rooms"`
+}
+
+// OccupancyRollup は複数のルームの在室状況を合算した値です。Suppressed は秘匿モードで集計対象のユーザーが min_users 人未満のため値を返さない場合に true になります
+type OccupancyRollup struct {
+	Rooms            int     `json:"rooms"`
+	CurrentOccupants int     `json:"current_occupants"`
+	SessionCount     int     `json:"session_count"`
+	OccupancyHours   float64 `json:"occupancy_hours"`
+	UniqueVisitors   int     `json:"unique_visitors"`
+	Suppressed       bool    `json:"suppressed,omitempty"`
+}
+
+type FloorStats struct {
+	FloorID int    `json:"floor_id"`
+	Name    string `json:"name"`
+	Level   int    `json:"level"`
+	OccupancyRollup
+}
+
+type BuildingStatsResponse struct {
+	BuildingID int               `json:"building_id"`
+	Name       string            `json:"name"`
+	From       string            `json:"from"`
+	To         string            `json:"to"`
+	Privacy    *StatsPrivacyInfo `json:"privacy,omitempty"`
+	Total      OccupancyRollup   `json:"total"`
+	Floors     []FloorStats      `json:"floors"`
+}
+
+type HealthCheckResponse struct {
+	Status       string            `json:"status"`
+	Instance     string            `json:"instance"`
+	Database     string            `json:"database"`
+	Registration string            `json:"registration"`
+	Proxies      map[string]string `json:"proxies,omitempty"`
+	Timestamp    string            `json:"timestamp"`
+}
+
+// IdempotentResult は Idempotency-Key を付けたリクエストの保存した結果です。StatusCode が 0 の場合は処理中です
+type IdempotentResult struct {
+	Path        string
+	StatusCode  int
+	ContentType string
+	Body        []byte
+}
+
+type PredictionResponse struct {
+	PredictedPercentage int `json:"predicted_percentage"`
+}
+
+type EstimationServerResponse struct {
+	PercentageProcessed int `json:"percentage_processed"`
+}
+
+type InquiryRequest struct {
+	WifiData string `json:"wifi_data"`
+	BleData  string `json:"ble_data"`
+}
+
+type InquiryResponse struct {
+	ServerConfidence int `json:"percentage_processed"`
+}
+
+type BeaconSignal struct {
+	UUID  string
+	BSSID string
+	RSSI  float64
+}
+
+type WiFiSignal struct {
+	SSID  string
+	BSSID string
+	RSSI  float64
+}
+
+// requestIDFromHeader はリクエストの X-Request-ID を返します。指定がないか形式が不正な場合はUUIDを発行します
+func requestIDFromHeader(r *http.Request) string {
+	if id := r.Header.Get("X-Request-ID"); requestIDPattern.MatchString(id) {
+		return id
+	}
+	return uuid.New().String()
+}
+
+// requestContext はリクエストIDを持つコンテキストを返します。loggingMiddleware を経由していればそのIDを引き継ぎます
+func requestContext(r *http.Request) context.Context {
+	if _, ok := r.Context().Value(requestIDKey).(string); ok {
+		return r.Context()
+	}
+	return context.WithValue(r.Context(), requestIDKey, requestIDFromHeader(r))
+}
+
+// setRequestIDHeader は ctx のリクエストIDを送信するリクエストの X-Request-ID に設定します
+func setRequestIDHeader(ctx context.Context, req *http.Request) {
+	if id, ok := ctx.Value(requestIDKey).(string); ok {
+		req.Header.Set("X-Request-ID", id)
+	}
+}
+
+// logAttrs はログに付与するリクエストIDと、トレース中であればトレースIDを返します
+func logAttrs(ctx context.Context) []interface{} {
+	var attrs []interface{}
+	if id, ok := ctx.Value(requestIDKey).(string); ok {
+		attrs = append(attrs, "request_id", id)
+	}
+	if orgID := orgFromContext(ctx); orgID != 0 {
+		attrs = append(attrs, "org_id", orgID)
+	}
+	if version := apiVersionFromContext(ctx); version != "" {
+		attrs = append(attrs, "api_version", version)
+	}
+	if spanContext := trace.SpanContextFromContext(ctx); spanContext.IsValid() {
+		attrs = append(attrs, "trace_id", spanContext.TraceID().String())
+	}
+	return attrs
+}
+
+func logConfig(ctx context.Context, msg string, args ...interface{}) {
+	logger.Info(fmt.Sprintf(msg, args...), logAttrs(ctx)...)
+}
+
+func logRequest(ctx context.Context, msg string, args ...interface{}) {
+	logger.Info(fmt.Sprintf(msg, args...), logAttrs(ctx)...)
+}
+
+func logError(ctx context.Context, msg string, args ...interface{}) {
+	logger.Error(fmt.Sprintf(msg, args...), logAttrs(ctx)...)
+}
+
+func logInfo(ctx context.Context, msg string, args ...interface{}) {
+	logger.Info(fmt.Sprintf(msg, args...), logAttrs(ctx)...)
+}
+
+// openLogOutput は出力先 output を開きます。ファイルの場合は rotation に従ってローテーションするファイルを追記モードで開きます
+func openLogOutput(output string, rotation LogRotationConfig) (io.Writer, error) {
+	switch output {
+	case "", "stdout":
+		return os.Stdout, nil
+	case "stderr":
+		return os.Stderr, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(output), os.ModePerm); err != nil {
+		return nil, fmt.Errorf("ログディレクトリの作成に失敗しました: %v", err)
+	}
+	file := &rotatingFile{path: output, config: rotation}
+	if err := file.open(); err != nil {
+		return nil, fmt.Errorf("ログファイルを開けませんでした: %v", err)
+	}
+	return file, nil
+}
+
+const logBackupTimeFormat = "20060102-150405.000"
+
+// rotatingFile はサイズまたは時刻でローテーションするログファイルです。
+// ローテーションしたファイルは {名前}-{日時}{拡張子} に移動し、圧縮と古いファイルの削除はバックグラウンドで行います
+type rotatingFile struct {
+	mu       sync.Mutex
+	path     string
+	config   LogRotationConfig
+	file     *os.File
+	size     int64
+	openedAt time.Time
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.file = file
+	f.size = info.Size()
+	f.openedAt = time.Now()
+	if f.size > 0 {
+		f.openedAt = info.ModTime()
+	}
+	return nil
+}
+
+// shouldRotate は p を書き込む前にローテーションが必要かを返します
+func (f *rotatingFile) shouldRotate(p []byte, now time.Time) bool {
+	if f.size == 0 {
+		return false
+	}
+	if f.config.MaxSizeMB > 0 && f.size+int64(len(p)) > int64(f.config.MaxSizeMB)<<20 {
+		return true
+	}
+	return f.config.Interval > 0 && !now.Truncate(f.config.Interval).Equal(f.openedAt.Truncate(f.config.Interval))
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if now := time.Now(); f.shouldRotate(p, now) {
+		if err := f.rotate(now); err != nil {
+			fmt.Fprintf(os.Stderr, "ログファイルのローテーションに失敗しました: %v\n", err)
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) rotate(now time.Time) error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+
+	ext := filepath.Ext(f.path)
+	backup := fmt.Sprintf("%s-%s%s", strings.TrimSuffix(f.path, ext), now.Format(logBackupTimeFormat), ext)
+	if err := os.Rename(f.path, backup); err != nil {
+		if openErr := f.open(); openErr != nil {
+			return openErr
+		}
+		return err
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+
+	go f.cleanup(backup)
+	return nil
+}
+
+// cleanup は backup を必要に応じて圧縮し、保持数・保持期間を超えた古いファイルを削除します
+func (f *rotatingFile) cleanup(backup string) {
+	if f.config.Compress {
+		if err := gzipFile(backup); err != nil {
+			logError(context.Background(), "ログファイル %s の圧縮に失敗しました: %v", backup, err)
+		}
+	}
+
+	ext := filepath.Ext(f.path)
+	backups, err := filepath.Glob(strings.TrimSuffix(f.path, ext) + "-*" + ext + "*")
+	if err != nil {
+		return
+	}
+	// ファイル名の日時の降順（新しい順）に並べます
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+
+	cutoff := time.Now().AddDate(0, 0, -f.config.MaxAgeDays)
+	for i, name := range backups {
+		expired := f.config.MaxBackups > 0 && i >= f.config.MaxBackups
+		if !expired && f.config.MaxAgeDays > 0 {
+			if info, err := os.Stat(name); err == nil && info.ModTime().Before(cutoff) {
+				expired = true
+			}
+		}
+		if !expired {
+			continue
+		}
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			logError(context.Background(), "古いログファイル %s の削除に失敗しました: %v", name, err)
+		}
+	}
+}
+
+// gzipFile は name を name.gz に圧縮して元のファイルを削除します
+func gzipFile(name string) error {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(name+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	if _, err := io.Copy(zw, src); err != nil {
+		zw.Close()
+		dst.Close()
+		os.Remove(name + ".gz")
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		dst.Close()
+		os.Remove(name + ".gz")
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	return os.Remove(name)
+}
+
+// newLogger は config の形式・レベルで out に出力するロガーを作成します。[Log.redaction] が有効な場合は書き込む前に値を伏せます
+func newLogger(config LogConfig, out io.Writer) (*slog.Logger, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(config.Level)); err != nil {
+		return nil, fmt.Errorf("ログレベルが無効です: %s", config.Level)
+	}
+	logLevel.Set(level)
+	options := &slog.HandlerOptions{Level: logLevel}
+
+	var handler slog.Handler
+	switch config.Format {
+	case "text":
+		handler = slog.NewTextHandler(out, options)
+	case "json":
+		handler = slog.NewJSONHandler(out, options)
+	default:
+		return nil, fmt.Errorf("ログの形式が無効です: %s（text または json を指定してください）", config.Format)
+	}
+	if redact := newLogRedactor(config.Redaction); redact != nil {
+		handler = &redactingHandler{Handler: handler, redact: redact}
+	}
+	return slog.New(handler), nil
+}
+
+// redactedValue は伏せた値の代わりにログへ書き込む文字列です
+const redactedValue = "[REDACTED]"
+
+var (
+	// jsonFieldPattern はJSONの "キー": 値 に一致します。応答ボディは途中で切れていることがあるため、パースせずに置き換えます
+	jsonFieldPattern = regexp.MustCompile(`"((?:[^"\\]|\\.)*)"(\s*:\s*)("(?:[^"\\]|\\.)*"|-?[0-9][0-9.eE+-]*|true|false|null)`)
+	// formFieldPattern はフォーム・クエリパラメータの キー=値 に一致します
+	formFieldPattern = regexp.MustCompile(`(^|[?&])([^=&?\s]+)=([^&\s"]*)`)
+	// bssidPattern は : または - 区切りのMACアドレスに一致します
+	bssidPattern = regexp.MustCompile(`\b[0-9A-Fa-f]{2}([:-])[0-9A-Fa-f]{2}[:-][0-9A-Fa-f]{2}[:-][0-9A-Fa-f]{2}[:-][0-9A-Fa-f]{2}[:-][0-9A-Fa-f]{2}\b`)
+)
+
+// logRedactor は [Log.redaction] に従ってログに書き込む値を伏せます。nil の場合は何も伏せません
+type logRedactor struct {
+	fields    []string
+	headers   []string
+	maskBSSID bool
+}
+
+// newLogRedactor は config から logRedactor を作成します。無効な場合は nil を返します
+func newLogRedactor(config LogRedactionConfig) *logRedactor {
+	if config.Enabled != nil && !*config.Enabled {
+		return nil
+	}
+	redact := &logRedactor{maskBSSID: config.MaskBSSID}
+	for _, field := range config.Fields {
+		redact.fields = append(redact.fields, strings.ToLower(field))
+	}
+	for _, header := range config.Headers {
+		redact.headers = append(redact.headers, strings.ToLower(header))
+	}
+	return redact
+}
+
+// matchNamePattern は name が patterns のいずれかに一致するかを返します。patterns は小文字のパターンです
+func matchNamePattern(patterns []string, name string) bool {
+	name = strings.ToLower(name)
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// text は自由形式の文字列に含まれるMACアドレスを伏せます
+func (r *logRedactor) text(s string) string {
+	if r == nil || !r.maskBSSID {
+		return s
+	}
+	return bssidPattern.ReplaceAllStringFunc(s, func(mac string) string {
+		separator := mac[2:3]
+		return mac[:8] + separator + "**" + separator + "**" + separator + "**"
+	})
+}
+
+// body はリクエスト・応答ボディのうち fields に一致するJSON・フォームの値を伏せ、MACアドレスを伏せます
+func (r *logRedactor) body(s string) string {
+	if r == nil {
+		return s
+	}
+	if len(r.fields) > 0 {
+		s = jsonFieldPattern.ReplaceAllStringFunc(s, func(field string) string {
+			match := jsonFieldPattern.FindStringSubmatch(field)
+			if !matchNamePattern(r.fields, match[1]) {
+				return field
+			}
+			return `"` + match[1] + `"` + match[2] + `"` + redactedValue + `"`
+		})
+		s = r.query(s)
+	}
+	return r.text(s)
+}
+
+// query はURL・フォームの キー=値 のうち fields に一致する値を伏せます
+func (r *logRedactor) query(s string) string {
+	if r == nil || len(r.fields) == 0 {
+		return s
+	}
+	return formFieldPattern.ReplaceAllStringFunc(s, func(field string) string {
+		match := formFieldPattern.FindStringSubmatch(field)
+		key, err := url.QueryUnescape(match[2])
+		if err != nil {
+			key = match[2]
+		}
+		if !matchNamePattern(r.fields, key) {
+			return field
+		}
+		return match[1] + match[2] + "=" + redactedValue
+	})
+}
+
+// header は headers に一致するヘッダーの値を伏せます。一致しない場合もURLのクエリパラメータとMACアドレスは伏せます
+func (r *logRedactor) header(name string, value string) string {
+	if r == nil || value == "" {
+		return value
+	}
+	if matchNamePattern(r.headers, name) {
+		return redactedValue
+	}
+	return r.text(r.query(value))
+}
+
+// attr は構造化ログの属性のうち fields に一致するキーの値を伏せ、文字列に含まれるMACアドレスを伏せます
+func (r *logRedactor) attr(attr slog.Attr) slog.Attr {
+	if attr.Value.Kind() == slog.KindGroup {
+		group := attr.Value.Group()
+		redacted := make([]slog.Attr, len(group))
+		for i, member := range group {
+			redacted[i] = r.attr(member)
+		}
+		return slog.Attr{Key: attr.Key, Value: slog.GroupValue(redacted...)}
+	}
+	if matchNamePattern(r.fields, attr.Key) {
+		return slog.String(attr.Key, redactedValue)
+	}
+	if attr.Value.Kind() == slog.KindString {
+		return slog.String(attr.Key, r.text(attr.Value.String()))
+	}
+	return attr
+}
+
+// redactingHandler はメッセージと属性を logRedactor で伏せてから Handler に渡します
+type redactingHandler struct {
+	slog.Handler
+	redact *logRedactor
+}
+
+func (h *redactingHandler) Handle(ctx context.Context, record slog.Record) error {
+	redacted := slog.NewRecord(record.Time, record.Level, h.redact.text(record.Message), record.PC)
+	record.Attrs(func(attr slog.Attr) bool {
+		redacted.AddAttrs(h.redact.attr(attr))
+		return true
+	})
+	return h.Handler.Handle(ctx, redacted)
+}
+
+func (h *redactingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, attr := range attrs {
+		redacted[i] = h.redact.attr(attr)
+	}
+	return &redactingHandler{Handler: h.Handler.WithAttrs(redacted), redact: h.redact}
+}
+
+func (h *redactingHandler) WithGroup(name string) slog.Handler {
+	return &redactingHandler{Handler: h.Handler.WithGroup(name), redact: h.redact}
+}
+
+// accessLogger はリクエストごとに1行のアクセスログを書き込みます。
+// format が common の場合はCommon Log Format、json の場合は1行1オブジェクトのJSONで出力します
+type accessLogger struct {
+	format string
+	out    io.Writer
+}
+
+type AccessLogEntry struct {
+	Time       time.Time `json:"time"`
+	RequestID  string    `json:"request_id"`
+	RemoteAddr string    `json:"remote_addr"`
+	User       string    `json:"user,omitempty"`
+	Method     string    `json:"method"`
+	URI        string    `json:"uri"`
+	Proto      string    `json:"proto"`
+	Status     int       `json:"status"`
+	Bytes      int       `json:"bytes"`
+	DurationMs int64     `json:"duration_ms"`
+	Referer    string    `json:"referer,omitempty"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+}
+
+func newAccessLogger(format string, out io.Writer) (*accessLogger, error) {
+	switch format {
+	case "common", "json":
+		return &accessLogger{format: format, out: out}, nil
+	default:
+		return nil, fmt.Errorf("アクセスログの形式が無効です: %s（common または json を指定してください）", format)
+	}
+}
+
+func (l *accessLogger) log(entry AccessLogEntry) {
+	var line []byte
+	if l.format == "json" {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			logger.Error("アクセスログの作成に失敗しました", "request_id", entry.RequestID, "error", err)
+			return
+		}
+		line = append(data, '\n')
+	} else {
+		user := entry.User
+		if user == "" {
+			user = "-"
+		}
+		line = []byte(fmt.Sprintf("%s - %s [%s] %q %d %d\n",
+			entry.RemoteAddr, user, entry.Time.Format("02/Jan/2006:15:04:05 -0700"),
+			entry.Method+" "+entry.URI+" "+entry.Proto, entry.Status, entry.Bytes))
+	}
+
+	// 1行を1回の書き込みで出力し、並行するリクエストの行が混ざらないようにします
+	if _, err := l.out.Write(line); err != nil {
+		logger.Error("アクセスログの書き込みに失敗しました", "request_id", entry.RequestID, "error", err)
+	}
+}
+
+// setupTracing はトレースの伝播方式を設定し、有効な場合はOTLPでトレースを送信するプロバイダーを登録します。
+// 返り値の関数は未送信のスパンを送信して終了します
+func setupTracing(ctx context.Context, config TracingConfig) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if !config.Enabled {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	var options []otlptracehttp.Option
+	if config.Endpoint != "" {
+		options = append(options, otlptracehttp.WithEndpoint(config.Endpoint))
+	}
+	if config.Insecure {
+		options = append(options, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(ctx, options...)
+	if err != nil {
+		return nil, fmt.Errorf("OTLPエクスポーターの作成に失敗しました: %v", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", config.ServiceName))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// endSpan はエラーがあればスパンに記録してから終了します
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// tracedClient は送信するリクエストにトレースコンテキストを付与し、クライアントスパンを記録するHTTPクライアントを返します
+func tracedClient(timeout time.Duration) *http.Client {
+	return &http.Client{Timeout: timeout, Transport: otelhttp.NewTransport(http.DefaultTransport)}
+}
+
+// estimationClient・inquiryClient は推定・問い合わせサーバーへの接続を使い回す共有クライアントです。
+// 起動時に [Upstream] の設定で作り直します
+var estimationClient = tracedClient(30 * time.Second)
+var inquiryClient = tracedClient(30 * time.Second)
+
+// newHTTPClient は config の接続プールとタイムアウトを設定した、トレースを記録するHTTPクライアントを返します
+func newHTTPClient(config HTTPClientConfig) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: config.DialTimeout, KeepAlive: config.KeepAlive}).DialContext
+	transport.IdleConnTimeout = config.IdleConnTimeout
+	transport.MaxIdleConnsPerHost = config.MaxIdleConnsPerHost
+	transport.MaxConnsPerHost = config.MaxConnsPerHost
+	if transport.MaxIdleConns < config.MaxIdleConnsPerHost {
+		transport.MaxIdleConns = config.MaxIdleConnsPerHost
+	}
+	return &http.Client{Timeout: config.Timeout, Transport: otelhttp.NewTransport(transport)}
+}
+
+// drainAndClose は接続を使い回せるよう、読み残した応答ボディを捨ててから閉じます
+func drainAndClose(body io.ReadCloser) {
+	io.Copy(io.Discard, io.LimitReader(body, 64<<10))
+	body.Close()
+}
+
+// errInvalidUpload はクライアントが送ったフォームが不正であることを表します。ハンドラーは 400 を返します
+var errInvalidUpload = errors.New("アップロードされたフォームが不正です")
+
+// errUnsupportedUpload は ble_data・wifi_data がCSVとして扱えない形式であることを表します。ハンドラーは 422 を返します
+var errUnsupportedUpload = errors.New("アップロードされたファイルの形式が不正です")
+
+// errScanTimeOutOfRange は scanned_at がサーバーの時刻から [Submit] max_scan_age・max_clock_skew の範囲を外れていることを表します。ハンドラーは 422 を返します
+var errScanTimeOutOfRange = errors.New("scanned_at が受け付ける時刻の範囲外です")
+
+// parseScannedAt は端末が信号をスキャンした時刻 scanned_at（RFC 3339 または UNIX 秒）を解釈します。
+// now より max_scan_age を超えて古い、または max_clock_skew を超えて未来の場合は errScanTimeOutOfRange を返します
+func parseScannedAt(value string, now time.Time, config SubmitConfig) (time.Time, error) {
+	scannedAt, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		seconds, parseErr := strconv.ParseInt(value, 10, 64)
+		if parseErr != nil {
+			return time.Time{}, fmt.Errorf("scanned_at はRFC 3339形式またはUNIX秒で指定してください: %s", value)
+		}
+		scannedAt = time.Unix(seconds, 0)
+	}
+
+	if scannedAt.Before(now.Add(-config.MaxScanAge)) {
+		return time.Time{}, fmt.Errorf("%w（%s はサーバーの時刻より max_scan_age（%s）を超えて古い時刻です）", errScanTimeOutOfRange, value, config.MaxScanAge)
+	}
+	if scannedAt.After(now.Add(config.MaxClockSkew)) {
+		return time.Time{}, fmt.Errorf("%w（%s はサーバーの時刻より max_clock_skew（%s）を超えて未来の時刻です）", errScanTimeOutOfRange, value, config.MaxClockSkew)
+	}
+	return scannedAt.In(now.Location()), nil
+}
+
+// signalUploadTypes は ble_data・wifi_data に受け付ける Content-Type です。
+// 多くのHTTPクライアントは拡張子から種類を判断できないファイルを application/octet-stream で送るため、これと指定なしは内容で判断します
+var signalUploadTypes = map[string]bool{
+	"text/csv":                 true,
+	"application/csv":          true,
+	"text/plain":               true,
+	"application/octet-stream": true,
+}
+
+const (
+	// uploadSniffBytes は ble_data・wifi_data の内容を確認するために読み込む先頭のバイト数です
+	uploadSniffBytes = 4096
+	// uploadSniffRecords は ble_data・wifi_data の形式を確認する先頭の行数です
+	uploadSniffRecords = 5
+)
+
+// checkSignalUpload は ble_data・wifi_data の Content-Type と先頭 head の内容を確認し、CSVとして扱えない場合は errUnsupportedUpload を返します。
+// head がファイルの途中で切れている場合（truncated）は最後の不完全な行を確認しません。
+// 先頭の行に見出しがあってもよいよう、uploadSniffRecords 行のうち1行でも「タイムスタンプ, ID, RSSI」の形式であれば受け付けます。
+// 何も検出できなかった場合は見出しの行だけを送るクライアントがあるため、3列以上の1行だけのファイルも受け付けます
+func checkSignalUpload(field string, contentType string, head []byte, truncated bool) error {
+	if contentType != "" {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil || !signalUploadTypes[mediaType] {
+			return fmt.Errorf("%w: %s の Content-Type（%s）は受け付けていません。text/csv で送信してください", errUnsupportedUpload, field, contentType)
+		}
+	}
+	if len(head) == 0 {
+		return nil
+	}
+	if bytes.IndexByte(head, 0) >= 0 || !strings.HasPrefix(http.DetectContentType(head), "text/") {
+		return fmt.Errorf("%w: %s はテキストのCSVではありません（バイナリデータを含んでいます）", errUnsupportedUpload, field)
+	}
+	if truncated {
+		if end := bytes.LastIndexByte(head, '\n'); end >= 0 {
+			head = head[:end+1]
+		}
+	}
+
+	reader := csv.NewReader(bytes.NewReader(head))
+	reader.FieldsPerRecord = -1
+	records := 0
+	headerOnly := false
+	for ; records < uploadSniffRecords; records++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %s の %d 行目をCSVとして読み取れません: %v", errUnsupportedUpload, field, records+1, err)
+		}
+		if len(record) < 3 {
+			continue
+		}
+		if _, err := strconv.ParseFloat(strings.TrimSpace(record[2]), 64); err == nil {
+			return nil
+		}
+		if records == 0 {
+			headerOnly = true
+		}
+	}
+	if records == 0 || (records == 1 && headerOnly) {
+		return nil
+	}
+	return fmt.Errorf("%w: %s の先頭 %d 行に「タイムスタンプ, ID, RSSI」の形式の行がありません", errUnsupportedUpload, field, records)
+}
+
+// checkUploadedFile は ParseMultipartForm で受け取った ble_data・wifi_data を checkSignalUpload で確認し、読み込み位置を先頭に戻します
+func checkUploadedFile(field string, file multipart.File, header *multipart.FileHeader) error {
+	head := make([]byte, uploadSniffBytes)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return fmt.Errorf("%sの読み取りに失敗しました: %v", field, err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("%sのシークに失敗しました: %v", field, err)
+	}
+	return checkSignalUpload(field, header.Header.Get("Content-Type"), head[:n], n == len(head))
+}
+
+// checkSignalPart は受信中の ble_data・wifi_data の先頭を checkSignalUpload で確認し、確認した部分も含めて読み込める Reader を返します
+func checkSignalPart(part *multipart.Part, maxFileBytes int64) (io.Reader, error) {
+	buffered := bufio.NewReaderSize(limitFileReader(part, part.FormName(), maxFileBytes), uploadSniffBytes)
+	head, err := buffered.Peek(uploadSniffBytes)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, fmt.Errorf("%w: %sの読み取りに失敗しました: %w", errInvalidUpload, part.FormName(), err)
+	}
+	if err := checkSignalUpload(part.FormName(), part.Header.Get("Content-Type"), head, len(head) == uploadSniffBytes); err != nil {
+		return nil, err
+	}
+	return buffered, nil
+}
+
+// errTooManyRecords はCSVの行数が [Submit] max_records を超えたことを表します。ハンドラーは 413 を返します
+var errTooManyRecords = errors.New("CSVの行数が上限を超えています")
+
+// readCSVRecords は src のCSVを1行ずつ読み込んで fn に渡します。ファイル全体をメモリに読み込みません。
+// fn に渡す record は次の行で再利用されるため、保持する場合は値をコピーしてください。
+// maxRecords 行を超えた場合は errTooManyRecords を返します（0 の場合は制限しません）
+func readCSVRecords(src io.Reader, maxRecords int, fn func(record []string) error) error {
+	reader := csv.NewReader(src)
+	reader.ReuseRecord = true
+	for count := 0; ; count++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if maxRecords > 0 && count >= maxRecords {
+			return fmt.Errorf("%w（%d 行）", errTooManyRecords, maxRecords)
+		}
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+}
+
+// copyCSVRecords は src のCSVを1行ずつ dst に書き込みます
+func copyCSVRecords(dst *csv.Writer, src io.Reader) error {
+	return readCSVRecords(src, currentSettings().MaxRecords, dst.Write)
+}
+
+// postCombinedCSV は fill が書き込んだBLE・WiFiの結合CSVを multipart で推定サーバーに送信し、推定信頼度を返します。
+// リクエストボディはパイプで送るため、アップロードの大きさによらずメモリ使用量は一定です
+func postCombinedCSV(ctx context.Context, estimationURL string, fill func(*csv.Writer) error) (int, error) {
+	body, bodyWriter := io.Pipe()
+	form := multipart.NewWriter(bodyWriter)
+	fillErr := make(chan error, 1)
+	go func() {
+		err := writeCombinedForm(form, fill)
+		bodyWriter.CloseWithError(err)
+		fillErr <- err
+	}()
+
+	percentage, err := sendToEstimationServer(ctx, estimationURL, body, form.FormDataContentType())
+	// 推定サーバーが途中で応答した場合もフォームの書き込みを止め、ゴルーチンの終了を待ちます
+	body.Close()
+	ferr := <-fillErr
+	// フォームが不正な場合は送信エラーよりも優先して返し、クライアントに 400・413 を返せるようにします
+	if _, tooLarge := uploadLimitExceeded(ferr); tooLarge || errors.Is(ferr, errInvalidUpload) || errors.Is(ferr, errUnsupportedUpload) || errors.Is(ferr, errTooManyRecords) {
+		return 0, ferr
+	}
+	if err != nil {
+		return 0, err
+	}
+	if ferr != nil {
+		return 0, ferr
+	}
+	return percentage, nil
+}
+
+func writeCombinedForm(form *multipart.Writer, fill func(*csv.Writer) error) error {
+	part, err := form.CreateFormFile("file", fmt.Sprintf("combined_data_%d.csv", time.Now().Unix()))
+	if err != nil {
+		return fmt.Errorf("フォームファイルの作成に失敗しました: %v", err)
+	}
+	writer := csv.NewWriter(part)
+	if err := fill(writer); err != nil {
+		return err
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return fmt.Errorf("結合されたCSVの書き込みに失敗しました: %v", err)
+	}
+	return form.Close()
+}
+
+// estimationUnavailableError は推定サーバーに接続できない・5xx を返したなど、時間をおいて再送すれば判定できる失敗を表します
+type estimationUnavailableError struct {
+	err error
+}
+
+func (e *estimationUnavailableError) Error() string { return e.err.Error() }
+
+func (e *estimationUnavailableError) Unwrap() error { return e.err }
+
+// estimationUnavailable は err が推定サーバーの停止による失敗かを返します
+func estimationUnavailable(err error) bool {
+	var unavailable *estimationUnavailableError
+	return errors.As(err, &unavailable)
+}
+
+func sendToEstimationServer(ctx context.Context, estimationURL string, body io.Reader, contentType string) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", estimationURL, body)
+	if err != nil {
+		logError(ctx, "推定サーバーへのリクエスト作成に失敗しました: %v", err)
+		return 0, fmt.Errorf("推定サーバーへのリクエスト作成に失敗しました: %v", err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	setRequestIDHeader(ctx, req)
+
+	logInfo(ctx, "推定サーバーへのリクエストを送信しています")
+	recordUsage(ctx, usageEstimationCalls, 1)
+
+	resp, err := estimationClient.Do(req)
+	if err != nil {
+		logError(ctx, "推定サーバーへのリクエスト送信に失敗しました: %v", err)
+		return 0, &estimationUnavailableError{fmt.Errorf("推定サーバーへのリクエスト送信に失敗しました: %v", err)}
+	}
+	defer drainAndClose(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		logError(ctx, "推定サーバーからの無効な応答。ステータスコード: %d", resp.StatusCode)
+		err := fmt.Errorf("推定サーバーからの無効な応答。ステータスコード: %d", resp.StatusCode)
+		if resp.StatusCode >= http.StatusInternalServerError {
+			return 0, &estimationUnavailableError{err}
+		}
+		return 0, err
+	}
+
+	var predictionResp PredictionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&predictionResp); err != nil {
+		logError(ctx, "推定サーバーからの応答のデコードに失敗しました: %v", err)
+		return 0, fmt.Errorf("推定サーバーからの応答のデコードに失敗しました: %v", err)
+	}
+
+	logInfo(ctx, "推定サーバーからの応答を受信しました: %+v", predictionResp)
+	percentage := int(predictionResp.PredictedPercentage)
+
+	logInfo(ctx, "推定信頼度を受信しました: %d", percentage)
+
+	return percentage, nil
+}
+
+func forwardFilesToEstimationServer(ctx context.Context, bleFilePath string, wifiFilePath string, estimationURL string) (int, error) {
+	bleFile, err := os.Open(bleFilePath)
+	if err != nil {
+		logError(ctx, "BLEファイルを開くことができませんでした: %v", err)
+		return 0, fmt.Errorf("BLEファイルを開くことができませんでした: %v", err)
+	}
+	defer bleFile.Close()
+
+	wifiFile, err := os.Open(wifiFilePath)
+	if err != nil {
+		logError(ctx, "WiFiファイルを開くことができませんでした: %v", err)
+		return 0, fmt.Errorf("WiFiファイルを開くことができませんでした: %v", err)
+	}
+	defer wifiFile.Close()
+
+	return postCombinedCSV(ctx, estimationURL, func(writer *csv.Writer) error {
+		if err := copyCSVRecords(writer, bleFile); err != nil {
+			logError(ctx, "BLE CSVの読み取りに失敗しました: %v", err)
+			return fmt.Errorf("BLE CSVの読み取りに失敗しました: %w", err)
+		}
+		if err := copyCSVRecords(writer, wifiFile); err != nil {
+			logError(ctx, "WiFi CSVの読み取りに失敗しました: %v", err)
+			return fmt.Errorf("WiFi CSVの読み取りに失敗しました: %w", err)
+		}
+		return nil
+	})
+}
+
+// handleSignalsServerSubmit は受信した ble_data・wifi_data をそのまま推定サーバーへ流します。
+// ble_data より先に wifi_data が届いた場合のみ、結合CSVの順序を保つため wifi_data を一時ファイルに退避します
+func handleSignalsServerSubmit(w http.ResponseWriter, r *http.Request, ctx context.Context, estimationURL string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "許可されていないメソッドです。POSTを使用してください。", http.StatusMethodNotAllowed)
+		return
+	}
+
+	logRequest(ctx, "POST /api/signals/server リクエストを受信しました")
+
+	parts, err := r.MultipartReader()
+	if err != nil {
+		logError(ctx, "multipart/form-dataの解析に失敗しました: %v", err)
+		http.Error(w, "multipart/form-dataの解析に失敗しました", http.StatusBadRequest)
+		return
+	}
+
+	maxFileBytes := routeLimitFromContext(ctx).MaxFileMB << 20
+	percentage, err := postCombinedCSV(ctx, estimationURL, func(writer *csv.Writer) error {
+		return streamSignalParts(ctx, parts, writer, maxFileBytes)
+	})
+	if limitErr, ok := uploadLimitExceeded(err); ok {
+		writeUploadTooLarge(w, ctx, limitErr)
+		return
+	}
+	if errors.Is(err, errTooManyRecords) {
+		logError(ctx, "%v", err)
+		http.Error(w, errTooManyRecords.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if errors.Is(err, errUnsupportedUpload) {
+		logError(ctx, "%v", err)
+		http.Error(w, strings.TrimPrefix(err.Error(), errUnsupportedUpload.Error()+": "), http.StatusUnprocessableEntity)
+		return
+	}
+	if errors.Is(err, errInvalidUpload) {
+		logError(ctx, "%v", err)
+		http.Error(w, strings.TrimPrefix(err.Error(), errInvalidUpload.Error()+": "), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		logError(ctx, "推定サーバーへの転送に失敗しました: %v", err)
+		http.Error(w, fmt.Sprintf("推定サーバーへの転送に失敗しました: %v", err), failureStatus(ctx))
+		return
+	}
+
+	percentageInt := percentage
+
+	response := EstimationServerResponse{
+		PercentageProcessed: percentageInt,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
+		http.Error(w, "JSON応答のエンコードに失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	logRequest(ctx, "POST /api/signals/server リクエストの処理が完了しました")
+}
+
+// streamSignalParts は multipart の ble_data・wifi_data をこの順で writer に書き込みます。
+// それぞれ先頭を checkSignalPart で確認してから書き込むため、CSVでないファイルは推定サーバーに1行も送りません。
+// maxFileBytes が 0 より大きい場合は、それを超えたファイルの読み込みを *uploadLimitError で打ち切ります
+func streamSignalParts(ctx context.Context, parts *multipart.Reader, writer *csv.Writer, maxFileBytes int64) error {
+	var wifiSpool *os.File
+	defer func() {
+		if wifiSpool != nil {
+			wifiSpool.Close()
+			os.Remove(wifiSpool.Name())
+		}
+	}()
+
+	bleDone, wifiDone := false, false
+	for {
+		part, err := parts.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%w: multipart/form-dataの解析に失敗しました: %w", errInvalidUpload, err)
+		}
+
+		if part.FormName() != "ble_data" && part.FormName() != "wifi_data" {
+			part.Close()
+			continue
+		}
+		file, err := checkSignalPart(part, maxFileBytes)
+		if err != nil {
+			return err
+		}
+		switch part.FormName() {
+		case "ble_data":
+			if err := copyCSVRecords(writer, file); err != nil {
+				return fmt.Errorf("%w: BLE CSVの読み取りに失敗しました: %w", errInvalidUpload, err)
+			}
+			bleDone = true
+			if wifiSpool != nil {
+				if _, err := wifiSpool.Seek(0, io.SeekStart); err != nil {
+					return fmt.Errorf("wifi_dataの一時ファイルのシークに失敗しました: %v", err)
+				}
+				if err := copyCSVRecords(writer, wifiSpool); err != nil {
+					return fmt.Errorf("%w: WiFi CSVの読み取りに失敗しました: %w", errInvalidUpload, err)
+				}
+				wifiDone = true
+			}
+		case "wifi_data":
+			if bleDone {
+				if err := copyCSVRecords(writer, file); err != nil {
+					return fmt.Errorf("%w: WiFi CSVの読み取りに失敗しました: %w", errInvalidUpload, err)
+				}
+				wifiDone = true
+				break
+			}
+			logInfo(ctx, "wifi_dataがble_dataより先に届いたため一時ファイルに退避します")
+			wifiSpool, err = os.CreateTemp("", "wifi_data_*.csv")
+			if err != nil {
+				return fmt.Errorf("wifi_dataの一時ファイルの作成に失敗しました: %v", err)
+			}
+			if _, err := io.Copy(wifiSpool, file); err != nil {
+				return fmt.Errorf("wifi_dataファイルの保存に失敗しました: %w", err)
+			}
+		}
+		part.Close()
+	}
+
+	if !bleDone {
+		return fmt.Errorf("%w: ble_dataファイルの取得に失敗しました", errInvalidUpload)
+	}
+	if !wifiDone {
+		return fmt.Errorf("%w: wifi_dataファイルの取得に失敗しました", errInvalidUpload)
+	}
+	return nil
+}
+
+// parseBLECSV は maxRecords 行（0 の場合は制限なし）までのBLE CSVを読み込みます
+func parseBLECSV(ctx context.Context, filePath string, maxRecords int) ([]BeaconSignal, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
 		logError(ctx, "BLE CSVファイルのオープンに失敗しました: %v", err)
 		return nil, fmt.Errorf("BLE CSVファイルのオープンに失敗しました: %v", err)
 	}
-	defer file.Close()
+	defer file.Close()
+
+	var signals []BeaconSignal
+	err = readCSVRecords(file, maxRecords, func(record []string) error {
+		if len(record) < 3 {
+			return nil
+		}
+		rssi, err := strconv.ParseFloat(strings.TrimSpace(record[2]), 64)
+		if err != nil {
+			return nil
+		}
+		signals = append(signals, BeaconSignal{
+			UUID:  strings.Clone(strings.TrimSpace(record[1])),
+			BSSID: "",
+			RSSI:  rssi,
+		})
+		return nil
+	})
+	if err != nil {
+		logError(ctx, "BLE CSVの読み取りに失敗しました: %v", err)
+		return nil, fmt.Errorf("BLE CSVの読み取りに失敗しました: %w", err)
+	}
+
+	return signals, nil
+}
+
+// parseWifiCSV は maxRecords 行（0 の場合は制限なし）までのWiFi CSVを読み込みます
+func parseWifiCSV(ctx context.Context, filePath string, maxRecords int) ([]WiFiSignal, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		logError(ctx, "WiFi CSVファイルのオープンに失敗しました: %v", err)
+		return nil, fmt.Errorf("WiFi CSVファイルのオープンに失敗しました: %v", err)
+	}
+	defer file.Close()
+
+	var signals []WiFiSignal
+	err = readCSVRecords(file, maxRecords, func(record []string) error {
+		if len(record) < 3 {
+			return nil
+		}
+		rssi, err := strconv.ParseFloat(strings.TrimSpace(record[2]), 64)
+		if err != nil {
+			return nil
+		}
+		signals = append(signals, WiFiSignal{
+			SSID:  strings.Clone(strings.TrimSpace(record[0])),
+			BSSID: strings.Clone(strings.TrimSpace(record[1])),
+			RSSI:  rssi,
+		})
+		return nil
+	})
+	if err != nil {
+		logError(ctx, "WiFi CSVの読み取りに失敗しました: %v", err)
+		return nil, fmt.Errorf("WiFi CSVの読み取りに失敗しました: %w", err)
+	}
+
+	return signals, nil
+}
+
+// deviceCache はビーコン・WiFiアクセスポイントとルームの対応をメモリに保持する DeviceStore です。
+// 信号ごとにデータベースへ問い合わせないよう refresh_interval ごとに両テーブルを読み直し、
+// 一度も読み込めていない間と、組織で絞り込まないコンテキストでは元の DeviceStore に問い合わせます
+type deviceCache struct {
+	DeviceStore
+	mu sync.RWMutex
+	// mappings は組織IDごとの対応です
+	mappings    map[int]RoomMappings
+	loaded      bool
+	refreshedAt time.Time
+}
+
+func newDeviceCache(devices DeviceStore) *deviceCache {
+	return &deviceCache{DeviceStore: devices}
+}
+
+// refresh はビーコン・WiFiアクセスポイントの対応を読み直して置き換えます
+func (c *deviceCache) refresh(ctx context.Context) error {
+	mappings, err := c.DeviceStore.RoomMappings(ctx)
+	if err != nil {
+		return fmt.Errorf("ビーコン・WiFiアクセスポイントの読み込みに失敗しました: %v", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.mappings = mappings
+	c.loaded = true
+	c.refreshedAt = time.Now()
+	return nil
+}
+
+func (c *deviceCache) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := c.refresh(ctx); err != nil {
+			logError(ctx, "%v", err)
+		}
+	}
+}
+
+// lookup は keys のうち orgID の組織の table に登録されているもののルームIDを返します。読み込み前と orgID が0の場合は ok が false です
+func (c *deviceCache) lookup(orgID int, table func(RoomMappings) map[string]int, keys []string, normalize func(string) string) (rooms map[string]int, ok bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if !c.loaded || orgID == 0 {
+		return nil, false
+	}
+	mappings := table(c.mappings[orgID])
+
+	rooms = make(map[string]int)
+	for _, key := range keys {
+		key = normalize(key)
+		if roomID, found := mappings[key]; found {
+			rooms[key] = roomID
+			atomic.AddUint64(&deviceCacheHits, 1)
+		} else {
+			atomic.AddUint64(&deviceCacheMisses, 1)
+		}
+	}
+	return rooms, true
+}
+
+func (c *deviceCache) RoomIDsByBeacons(ctx context.Context, serviceUUIDs []string) (map[string]int, error) {
+	if rooms, ok := c.lookup(orgFromContext(ctx), func(m RoomMappings) map[string]int { return m.Beacons }, serviceUUIDs, strings.ToUpper); ok {
+		return rooms, nil
+	}
+	return c.DeviceStore.RoomIDsByBeacons(ctx, serviceUUIDs)
+}
+
+func (c *deviceCache) RoomIDsByWifi(ctx context.Context, bssids []string) (map[string]int, error) {
+	if rooms, ok := c.lookup(orgFromContext(ctx), func(m RoomMappings) map[string]int { return m.Wifi }, bssids, strings.ToLower); ok {
+		return rooms, nil
+	}
+	return c.DeviceStore.RoomIDsByWifi(ctx, bssids)
+}
+
+func (c *deviceCache) stats() DeviceCacheResponse {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	response := DeviceCacheResponse{RefreshedAt: c.refreshedAt}
+	for _, mappings := range c.mappings {
+		response.Beacons += len(mappings.Beacons)
+		response.WifiAccessPoints += len(mappings.Wifi)
+	}
+	return response
+}
+
+// handleAdminDeviceCacheRefresh はビーコン・WiFiアクセスポイントをデータベースで直接変更した後に、
+// refresh_interval を待たずにメモリ上の対応を読み直します
+func handleAdminDeviceCacheRefresh(w http.ResponseWriter, r *http.Request, ctx context.Context, presence PresenceStore, audit AuditStore, cache *deviceCache) {
+	if !requireSystemAdmin(w, r, ctx, presence) {
+		return
+	}
+
+	if cache == nil {
+		http.Error(w, "[DeviceCache] が無効です", http.StatusNotFound)
+		return
+	}
+	if err := cache.refresh(ctx); err != nil {
+		logError(ctx, "%v", err)
+		http.Error(w, "ビーコン・WiFiアクセスポイントの読み込みに失敗しました", http.StatusInternalServerError)
+		return
+	}
+	response := cache.stats()
+	recordAudit(ctx, audit, r, "device_cache.refresh", "device_cache", fmt.Sprintf("beacons=%d wifi_access_points=%d", response.Beacons, response.WifiAccessPoints))
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
+	}
+}
+
+// getRoomIDByBeacons はすべてのビーコンを1回の問い合わせで照合し、登録済みのうち最も電波の強いビーコンのルームIDを返します。
+// RSSIが同じ場合はCSVで先に現れたものを優先します。一致するビーコンがない場合は0を返します
+func getRoomIDByBeacons(ctx context.Context, devices DeviceStore, beacons []BeaconSignal) (int, error) {
+	if len(beacons) == 0 {
+		return 0, nil
+	}
+	serviceUUIDs := make([]string, 0, len(beacons))
+	for _, beacon := range beacons {
+		serviceUUIDs = append(serviceUUIDs, beacon.UUID)
+	}
+	rooms, err := devices.RoomIDsByBeacons(ctx, serviceUUIDs)
+	if err != nil {
+		return 0, fmt.Errorf("ビーコンの照合に失敗しました: %v", err)
+	}
+
+	best := -1
+	var roomID int
+	for i, beacon := range beacons {
+		id, ok := rooms[strings.ToUpper(beacon.UUID)]
+		if !ok || (best >= 0 && beacon.RSSI <= beacons[best].RSSI) {
+			continue
+		}
+		best, roomID = i, id
+	}
+	if best >= 0 {
+		logInfo(ctx, "ビーコン UUID=%s (RSSI=%.2f) に対するルームID=%d を見つけました（一致 %d 件）", beacons[best].UUID, beacons[best].RSSI, roomID, len(rooms))
+	}
+	return roomID, nil
+}
+
+// getRoomIDByWifi はすべてのアクセスポイントを1回の問い合わせで照合し、登録済みのうち最も電波の強いアクセスポイントのルームIDを返します
+func getRoomIDByWifi(ctx context.Context, devices DeviceStore, signals []WiFiSignal) (int, error) {
+	if len(signals) == 0 {
+		return 0, nil
+	}
+	bssids := make([]string, 0, len(signals))
+	for _, wifi := range signals {
+		bssids = append(bssids, wifi.BSSID)
+	}
+	rooms, err := devices.RoomIDsByWifi(ctx, bssids)
+	if err != nil {
+		return 0, fmt.Errorf("WiFiアクセスポイントの照合に失敗しました: %v", err)
+	}
+
+	best := -1
+	var roomID int
+	for i, wifi := range signals {
+		id, ok := rooms[strings.ToLower(wifi.BSSID)]
+		if !ok || (best >= 0 && wifi.RSSI <= signals[best].RSSI) {
+			continue
+		}
+		best, roomID = i, id
+	}
+	if best >= 0 {
+		logInfo(ctx, "WiFi BSSID=%s (RSSI=%.2f) に対するルームID=%d を見つけました（一致 %d 件）", signals[best].BSSID, signals[best].RSSI, roomID, len(rooms))
+	}
+	return roomID, nil
+}
+
+func determineRoomID(ctx context.Context, devices DeviceStore, bleFilePath string, wifiFilePath string) (int, error) {
+	roomID, err := matchRoomID(ctx, devices, bleFilePath, wifiFilePath)
+	if err != nil {
+		return 0, err
+	}
+	if roomID == 0 {
+		logError(ctx, "有効なBLEまたはWiFiアクセスポイントが見つかりません")
+		return 0, fmt.Errorf("有効なBLEまたはWiFiアクセスポイントが見つかりません")
+	}
+	return roomID, nil
+}
+
+// matchRoomID は最も電波の強い登録済みのビーコンのルームを、ビーコンで決まらない場合はWiFiアクセスポイントのルームを返します。
+// どちらも登録されていない場合は0を返します
+func matchRoomID(ctx context.Context, devices DeviceStore, bleFilePath string, wifiFilePath string) (int, error) {
+	bleSignals, err := parseBLECSV(ctx, bleFilePath, currentSettings().MaxRecords)
+	if err != nil {
+		return 0, err
+	}
+
+	wifiSignals, err := parseWifiCSV(ctx, wifiFilePath, currentSettings().MaxRecords)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(bleSignals) == 0 && len(wifiSignals) == 0 {
+		logError(ctx, "BLEおよびWiFi信号が見つかりません")
+		return 0, fmt.Errorf("BLEおよびWiFi信号が見つかりません")
+	}
+
+	bleRoomID, err := getRoomIDByBeacons(ctx, devices, bleSignals)
+	if err != nil {
+		logError(ctx, "%v", err)
+		return 0, err
+	}
+
+	// ビーコンで決まった場合はWiFiを照合しません
+	var wifiRoomID int
+	if bleRoomID == 0 {
+		wifiRoomID, err = getRoomIDByWifi(ctx, devices, wifiSignals)
+		if err != nil {
+			logError(ctx, "%v", err)
+			return 0, err
+		}
+	}
+
+	if bleRoomID != 0 {
+		return bleRoomID, nil
+	}
+	return wifiRoomID, nil
+}
+
+// estimationRoutes は [EstimationRouting] でシャードを指定した場合の振り分け先です。nil の場合はすべての送信を estimation_url へ転送します
+var estimationRoutes *estimationRouter
+
+// estimationRouter は [EstimationRouting] に従って、送信ごとにルームを含むシャードの推定サーバーを選びます。
+// 階とルームの対応は refresh_interval ごとに読み直し、一度も読み込めていない間は rooms で指定したルームだけを振り分けます
+type estimationRouter struct {
+	buildings BuildingStore
+	shards    map[string]EstimationShardConfig
+	mu        sync.RWMutex
+	// rooms はルームIDごとのシャード名です
+	rooms map[int]string
+	// requests はシャードごとの振り分けた送信の数です
+	requests map[string]*uint64
+}
+
+// newEstimationRouter は config からシャードの振り分け先を作成します。シャードを指定しない場合は nil を返します
+func newEstimationRouter(buildings BuildingStore, config EstimationRoutingConfig) *estimationRouter {
+	if len(config.Shards) == 0 {
+		return nil
+	}
+	e := &estimationRouter{buildings: buildings, shards: config.Shards, rooms: make(map[int]string), requests: make(map[string]*uint64, len(config.Shards))}
+	for name, shard := range config.Shards {
+		e.requests[name] = new(uint64)
+		for _, roomID := range shard.Rooms {
+			e.rooms[roomID] = name
+		}
+	}
+	return e
+}
+
+// refresh はすべての組織の建物・階のルームからルームごとのシャードを求め直して置き換えます
+func (e *estimationRouter) refresh(ctx context.Context) error {
+	buildings, err := e.buildings.Buildings(withOrg(ctx, 0))
+	if err != nil {
+		return fmt.Errorf("推定サーバーの振り分けに使う建物・階の読み込みに失敗しました: %v", err)
+	}
+
+	byBuilding := make(map[int]string)
+	byFloor := make(map[int]string)
+	rooms := make(map[int]string)
+	for name, shard := range e.shards {
+		for _, buildingID := range shard.Buildings {
+			byBuilding[buildingID] = name
+		}
+		for _, floorID := range shard.Floors {
+			byFloor[floorID] = name
+		}
+		for _, roomID := range shard.Rooms {
+			rooms[roomID] = name
+		}
+	}
+	for _, building := range buildings {
+		for _, floor := range building.Floors {
+			name, ok := byFloor[floor.FloorID]
+			if !ok {
+				name, ok = byBuilding[building.BuildingID]
+			}
+			if !ok {
+				continue
+			}
+			for _, roomID := range floor.RoomIDs {
+				if _, explicit := rooms[roomID]; !explicit {
+					rooms[roomID] = name
+				}
+			}
+		}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.rooms = rooms
+	return nil
+}
+
+func (e *estimationRouter) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := e.refresh(ctx); err != nil {
+			logError(ctx, "%v", err)
+		}
+	}
+}
+
+// resolve は送信のルームを含むシャードの名前と推定サーバーのURLを返します。シャードが決まらない場合は空の名前と fallback を返します
+func (e *estimationRouter) resolve(ctx context.Context, devices DeviceStore, bleFilePath string, wifiFilePath string, fallback string) (string, string) {
+	if e == nil {
+		return "", fallback
+	}
+	roomID, err := matchRoomID(ctx, devices, bleFilePath, wifiFilePath)
+	if err != nil || roomID == 0 {
+		return "", fallback
+	}
+
+	e.mu.RLock()
+	name, ok := e.rooms[roomID]
+	e.mu.RUnlock()
+	if !ok {
+		return "", fallback
+	}
+	atomic.AddUint64(e.requests[name], 1)
+	logInfo(ctx, "ルームID %d の送信を推定サーバーのシャード %s へ転送します", roomID, name)
+	return name, e.shards[name].URL
+}
+
+func (e *estimationRouter) stats() map[string]EstimationShardStats {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	stats := make(map[string]EstimationShardStats, len(e.shards))
+	for name, shard := range e.shards {
+		stats[name] = EstimationShardStats{URL: shard.URL, Requests: atomic.LoadUint64(e.requests[name])}
+	}
+	for _, name := range e.rooms {
+		shard := stats[name]
+		shard.Rooms++
+		stats[name] = shard
+	}
+	return stats
+}
+
+func forwardFilesToInquiryServer(ctx context.Context, wifiFilePath string, bleFilePath string, inquiryURL string) (int, error) {
+	wifiData, err := os.ReadFile(wifiFilePath)
+	if err != nil {
+		logError(ctx, "WiFiデータの読み取りに失敗しました: %v", err)
+		return 0, fmt.Errorf("WiFiデータの読み取りに失敗しました: %v", err)
+	}
+
+	bleData, err := os.ReadFile(bleFilePath)
+	if err != nil {
+		logError(ctx, "BLEデータの読み取りに失敗しました: %v", err)
+		return 0, fmt.Errorf("BLEデータの読み取りに失敗しました: %v", err)
+	}
+
+	inquiryReq := InquiryRequest{
+		WifiData: string(wifiData),
+		BleData:  string(bleData),
+	}
+
+	reqBody, err := json.Marshal(inquiryReq)
+	if err != nil {
+		logError(ctx, "問い合わせリクエストのエンコードに失敗しました: %v", err)
+		return 0, fmt.Errorf("問い合わせリクエストのエンコードに失敗しました: %v", err)
+	}
+
+	logInfo(ctx, "問い合わせサーバーへのリクエストを送信しています")
+
+	req, err := http.NewRequestWithContext(ctx, "POST", inquiryURL, bytes.NewBuffer(reqBody))
+	if err != nil {
+		logError(ctx, "問い合わせサーバーへのリクエスト作成に失敗しました: %v", err)
+		return 0, fmt.Errorf("問い合わせサーバーへのリクエスト作成に失敗しました: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	setRequestIDHeader(ctx, req)
+	recordUsage(ctx, usageInquiryCalls, 1)
+
+	resp, err := inquiryClient.Do(req)
+	if err != nil {
+		// 推定と同時に送った問い合わせを取り消した場合はエラーとして記録しません
+		if ctx.Err() == context.Canceled {
+			return 0, ctx.Err()
+		}
+		logError(ctx, "問い合わせサーバーへのリクエスト送信に失敗しました: %v", err)
+		return 0, fmt.Errorf("問い合わせサーバーへのリクエスト送信に失敗しました: %v", err)
+	}
+	defer drainAndClose(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		logError(ctx, "問い合わせサーバーからの無効な応答。ステータスコード: %d", resp.StatusCode)
+		return 0, fmt.Errorf("問い合わせサーバーからの無効な応答。ステータスコード: %d", resp.StatusCode)
+	}
+
+	var inquiryResp InquiryResponse
+	if err := json.NewDecoder(resp.Body).Decode(&inquiryResp); err != nil {
+		logError(ctx, "問い合わせサーバーからの応答のデコードに失敗しました: %v", err)
+		return 0, fmt.Errorf("問い合わせサーバーからの応答のデコードに失敗しました: %v", err)
+	}
+
+	logInfo(ctx, "問い合わせサーバーからの応答を受信しました: %+v", inquiryResp)
+	logInfo(ctx, "問い合わせ信頼度を受信しました: %d", inquiryResp.ServerConfidence)
+
+	return inquiryResp.ServerConfidence, nil
+}
+
+// inquiryCall は別のゴルーチンで送信中の問い合わせです。
+// 問い合わせは推定の結果を入力に使わないため、推定と同時に送信して待ち時間を重ねられます
+type inquiryCall struct {
+	cancel     context.CancelFunc
+	done       chan struct{}
+	confidence int
+	err        error
+	waited     bool
+}
+
+func startInquiry(ctx context.Context, wifiFilePath string, bleFilePath string, inquiryURL string) *inquiryCall {
+	ctx, cancel := context.WithCancel(ctx)
+	call := &inquiryCall{cancel: cancel, done: make(chan struct{})}
+	go func() {
+		defer close(call.done)
+		inquiryCtx, inquirySpan := tracer.Start(ctx, "inquiry.forward")
+		call.confidence, call.err = forwardFilesToInquiryServer(inquiryCtx, wifiFilePath, bleFilePath, inquiryURL)
+		inquirySpan.SetAttributes(attribute.Int("elpis.inquiry_confidence", call.confidence))
+		endSpan(inquirySpan, call.err)
+	}()
+	return call
+}
+
+// wait は問い合わせの完了を待って信頼度を返します
+func (c *inquiryCall) wait() (int, error) {
+	<-c.done
+	c.waited = true
+	c.cancel()
+	return c.confidence, c.err
+}
+
+// abandon は結果を使わない問い合わせを取り消し、ゴルーチンの終了を待ちます。
+// 問い合わせはアップロードされたファイルを読むため、ファイルを削除する前に呼び出してください
+func (c *inquiryCall) abandon() {
+	if c.waited {
+		return
+	}
+	c.cancel()
+	<-c.done
+	atomic.AddUint64(&inquirySpeculativeDiscarded, 1)
+}
+
+// getUserID はリクエストを送ったユーザーのユーザー名を返します。authenticateRequests がパスワードを確認したユーザー名だけを使い、
+// Authorization ヘッダーのユーザー名はそのまま信用しません
+func getUserID(r *http.Request) string {
+	if username, ok := r.Context().Value(principalKey).(string); ok && username != "" {
+		return username
+	}
+	return "anonymous"
+}
+
+func getUserIDFromDB(ctx context.Context, presence PresenceStore, username string) (int, error) {
+	userID, err := presence.UserIDByName(ctx, username)
+	if err != nil {
+		logError(ctx, "ユーザーIDの取得に失敗しました: %v", err)
+		return 0, err
+	}
+	return userID, nil
+}
+
+// basicAuthChallenge は認証に失敗したリクエストに付ける WWW-Authenticate ヘッダーです
+const basicAuthChallenge = `Basic realm="elpis", charset="UTF-8"`
+
+// credentialCacheTTL は一度確認したユーザー名とパスワードの組を、bcrypt で照合し直さずに受け付ける時間です
+const credentialCacheTTL = 5 * time.Minute
+
+// credentialCache は確認済みのユーザー名とパスワードの組を覚えておき、リクエストのたびに bcrypt で照合しないようにします。
+// パスワードそのものではなく、ユーザー名とパスワードの SHA-256 だけを保持します
+type credentialCache struct {
+	mu      sync.Mutex
+	entries map[[32]byte]time.Time
+}
+
+func newCredentialCache() *credentialCache {
+	return &credentialCache{entries: make(map[[32]byte]time.Time)}
+}
+
+func credentialDigest(username, password string) [32]byte {
+	return sha256.Sum256([]byte(username + "\x00" + password))
+}
+
+func (c *credentialCache) verified(username, password string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expiresAt, ok := c.entries[credentialDigest(username, password)]
+	return ok && now.Before(expiresAt)
+}
+
+func (c *credentialCache) remember(username, password string, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= 1024 {
+		for digest, expiresAt := range c.entries {
+			if !now.Before(expiresAt) {
+				delete(c.entries, digest)
+			}
+		}
+	}
+	c.entries[credentialDigest(username, password)] = now.Add(credentialCacheTTL)
+}
+
+// verifyPassword はユーザーのパスワードを password_hash（bcrypt）で照合します。ハッシュ化する前の平文のパスワードしかないユーザーは
+// 平文で照合し、一致した場合はその場でハッシュに置き換えます。ユーザーが存在しない・パスワードがない・一致しない場合は false を返します
+func verifyPassword(ctx context.Context, creds CredentialStore, username, password string) (bool, error) {
+	credential, err := creds.Credential(ctx, username)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if credential.Hash != "" {
+		return bcrypt.CompareHashAndPassword([]byte(credential.Hash), []byte(password)) == nil, nil
+	}
+	if credential.Legacy == "" || subtle.ConstantTimeCompare([]byte(credential.Legacy), []byte(password)) != 1 {
+		return false, nil
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		logError(ctx, "パスワードのハッシュ化に失敗しました: %v", err)
+		return true, nil
+	}
+	if err := creds.SetPasswordHash(ctx, username, string(hash)); err != nil {
+		logError(ctx, "ユーザー %s のパスワードのハッシュの保存に失敗しました: %v", username, err)
+	}
+	return true, nil
+}
+
+// hashLegacyPasswords は平文のパスワードしかないユーザーのパスワードを bcrypt のハッシュに置き換え、平文を削除します
+func hashLegacyPasswords(ctx context.Context, creds CredentialStore) (int, error) {
+	legacy, err := creds.LegacyCredentials(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for _, credential := range legacy {
+		hash, err := bcrypt.GenerateFromPassword([]byte(credential.Legacy), bcrypt.DefaultCost)
+		if err != nil {
+			return 0, fmt.Errorf("ユーザー %s のパスワードのハッシュ化に失敗しました: %v", credential.Username, err)
+		}
+		if err := creds.SetPasswordHash(ctx, credential.Username, string(hash)); err != nil {
+			return 0, fmt.Errorf("ユーザー %s のパスワードのハッシュの保存に失敗しました: %v", credential.Username, err)
+		}
+	}
+	return len(legacy), nil
+}
+
+// authenticateRequests はBasic認証のユーザー名とパスワードを確認します。認証情報のないリクエストは匿名として通し、
+// ユーザーが存在しない・パスワードが一致しない場合は 401 を返します。確認したユーザー名をコンテキストに設定し、後続の getUserID・組織・管理者の確認はこのユーザー名を使います
+func authenticateRequests(next http.Handler, creds CredentialStore, cache *credentialCache) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		if !ok || username == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx := r.Context()
+		now := time.Now()
+		if !cache.verified(username, password, now) {
+			valid, err := verifyPassword(ctx, creds, username, password)
+			if err != nil {
+				logError(ctx, "ユーザー %s の認証情報の取得に失敗しました: %v", username, err)
+				http.Error(w, "認証情報の確認に失敗しました", http.StatusInternalServerError)
+				return
+			}
+			if !valid {
+				logError(ctx, "ユーザー %s の認証に失敗しました", username)
+				w.Header().Set("WWW-Authenticate", basicAuthChallenge)
+				http.Error(w, "ユーザー名またはパスワードが正しくありません", http.StatusUnauthorized)
+				return
+			}
+			cache.remember(username, password, now)
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey, username)))
+	})
+}
+
+func saveUploadedFile(ctx context.Context, file multipart.File, path string) error {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		logError(ctx, "ファイルのシークに失敗しました: %v", err)
+		return err
+	}
+
+	outFile, err := os.Create(path)
+	if err != nil {
+		logError(ctx, "ファイルの作成に失敗しました: %v", err)
+		return err
+	}
+	defer outFile.Close()
+
+	if _, err := io.Copy(outFile, file); err != nil {
+		logError(ctx, "ファイルのコピーに失敗しました: %v", err)
+		return err
+	}
+	return nil
+}
+
+// keyedMutex はキーごとの排他ロックです。ゼロ値で使用でき、誰も待っていないキーのロックは解放時に削除します
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[int]*keyedLock
+}
+
+type keyedLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// lock は key のロックを取得し、解放する関数を返します。解放する関数は2回目以降の呼び出しでは何もしません
+func (k *keyedMutex) lock(key int) func() {
+	k.mu.Lock()
+	if k.locks == nil {
+		k.locks = make(map[int]*keyedLock)
+	}
+	l, ok := k.locks[key]
+	if !ok {
+		l = &keyedLock{}
+		k.locks[key] = l
+	}
+	l.refs++
+	k.mu.Unlock()
+
+	l.mu.Lock()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Unlock()
+			k.mu.Lock()
+			l.refs--
+			if l.refs == 0 {
+				delete(k.locks, key)
+			}
+			k.mu.Unlock()
+		})
+	}
+}
+
+// presenceLocks はユーザーIDごとに在室セッションの更新を直列化します。端末が同じ信号を二重に送った場合などに、
+// 一方のセッション終了ともう一方のセッション更新が入れ替わらないようにします。
+// プロセス内のロックのため、複数のインスタンス間の整合性は UpsertPresence のトランザクションで保ちます
+var presenceLocks keyedMutex
+
+// jobLeases は定期処理のリースをこのインスタンスの ID で取得します。実行するインスタンスが変わった場合はログに記録します
+type jobLeases struct {
+	store  LeaseStore
+	holder string
+	mu     sync.Mutex
+	held   map[string]bool
+}
+
+func newJobLeases(store LeaseStore, holder string) *jobLeases {
+	return &jobLeases{store: store, holder: holder, held: make(map[string]bool)}
+}
+
+// hold は name の定期処理をこのインスタンスで実行してよいかを返します。リースは次の実行まで途切れないよう interval の1.5倍の間保持し、
+// 保持していたインスタンスが停止した場合は期限が切れた後に他のインスタンスが引き継ぎます
+func (l *jobLeases) hold(ctx context.Context, name string, interval time.Duration) bool {
+	acquired, err := l.store.AcquireLease(ctx, name, l.holder, time.Now().UTC(), interval*3/2)
+	if err != nil {
+		logError(ctx, "定期処理 %s のリースの取得に失敗しました: %v", name, err)
+		acquired = false
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if held, known := l.held[name]; !known || held != acquired {
+		if acquired {
+			logInfo(ctx, "定期処理 %s をこのインスタンス（%s）で実行します", name, l.holder)
+		} else {
+			logInfo(ctx, "定期処理 %s は他のインスタンスが実行しています", name)
+		}
+		l.held[name] = acquired
+	}
+	return acquired
+}
+
+// defaultInstanceID は [Cluster] instance_id を指定しない場合のインスタンスの名前です
+func defaultInstanceID() string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "manager"
+	}
+	return hostname + "-" + uuid.New().String()[:8]
+}
+
+func endUserSession(ctx context.Context, presence PresenceStore, userID int, endTime time.Time) error {
+	rowsAffected, err := presence.EndOpenSessions(ctx, userID, endTime)
+	if err != nil {
+		logError(ctx, "セッションの終了に失敗しました: %v", err)
+		return fmt.Errorf("セッションの終了に失敗しました: %v", err)
+	}
+	if rowsAffected > 0 {
+		logInfo(ctx, "ユーザーID %d のセッションを %s に終了しました", userID, endTime)
+	}
+	return nil
+}
+
+func updateUserPresence(ctx context.Context, presence PresenceStore, userID int, estimationConfidence int, inquiryConfidence int, lastSeen time.Time, roomID int, mergeGap time.Duration) error {
+	if inquiryConfidence > estimationConfidence {
+		err := endUserSession(ctx, presence, userID, lastSeen)
+		if err != nil {
+			return fmt.Errorf("セッションの終了に失敗しました: %v", err)
+		}
+		return nil
+	}
+
+	outcome, err := presence.UpsertPresence(ctx, PresenceUpdate{
+		UserID:               userID,
+		RoomID:               roomID,
+		SeenAt:               lastSeen,
+		EstimationConfidence: estimationConfidence,
+		InquiryConfidence:    inquiryConfidence,
+		MergeGap:             mergeGap,
+	})
+	if err != nil {
+		logError(ctx, "プレゼンスの更新に失敗しました: %v", err)
+		return fmt.Errorf("プレゼンスの更新に失敗しました: %v", err)
+	}
+
+	switch outcome.Action {
+	case presenceTouched:
+		logInfo(ctx, "ユーザーID %d のlast_seenを更新しました", userID)
+	case presenceReopened:
+		logInfo(ctx, "ユーザーID %d のセッションID %d を再開しました", userID, outcome.SessionID)
+	case presenceMoved:
+		logInfo(ctx, "ユーザーID %d がルームID %d からルームID %d へ移動しました", userID, outcome.FromRoomID, roomID)
+	case presenceStarted:
+		logInfo(ctx, "ユーザーID %d の新しいセッションをルームID %d で開始しました", userID, roomID)
+	}
+	return nil
+}
+
+// recordPresenceDecision は1回の送信に対する在室判定の結果を、送信した端末 deviceID（不明な場合は nil）とともに記録します
+func recordPresenceDecision(ctx context.Context, presence PresenceStore, userID int, deviceID *int, roomID int, estimationConfidence int, inquiryConfidence sql.NullInt64, decision string, decidedAt time.Time) (int, error) {
+	record := PresenceDecision{
+		UserID:               userID,
+		EstimationConfidence: estimationConfidence,
+		Decision:             decision,
+		DecidedAt:            decidedAt,
+		DeviceID:             deviceID,
+	}
+	if roomID != 0 {
+		record.RoomID = &roomID
+	}
+	if inquiryConfidence.Valid {
+		confidence := int(inquiryConfidence.Int64)
+		record.InquiryConfidence = &confidence
+	}
+
+	decisionID, err := presence.RecordDecision(ctx, record)
+	if err != nil {
+		logError(ctx, "在室判定の記録に失敗しました: %v", err)
+		return 0, fmt.Errorf("在室判定の記録に失敗しました: %v", err)
+	}
+	return decisionID, nil
+}
+
+// errPoolFull はワーカーの待ち行列が一杯であることを表します
+var errPoolFull = errors.New("処理待ちの送信が上限に達しています")
+
+// workerPool は決まった数のワーカーで処理を実行し、推定・問い合わせサーバーへの同時リクエスト数を制限します
+type workerPool struct {
+	jobs     chan func()
+	active   int64
+	rejected uint64
+}
+
+func newWorkerPool(workers int, queueSize int) *workerPool {
+	p := &workerPool{jobs: make(chan func(), queueSize)}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for job := range p.jobs {
+				atomic.AddInt64(&p.active, 1)
+				job()
+				atomic.AddInt64(&p.active, -1)
+			}
+		}()
+	}
+	return p
+}
+
+// do は job をワーカーで実行し、終わるまで待ちます。待ち行列が一杯の場合はすぐに errPoolFull を返します。
+// 待っている間に ctx が終了した場合は job を実行せずに戻ります
+func (p *workerPool) do(ctx context.Context, job func()) error {
+	const (
+		queued int32 = iota
+		running
+		abandoned
+	)
+	state := queued
+	done := make(chan struct{})
+	task := func() {
+		if !atomic.CompareAndSwapInt32(&state, queued, running) {
+			return
+		}
+		defer close(done)
+		job()
+	}
+
+	select {
+	case p.jobs <- task:
+	default:
+		atomic.AddUint64(&p.rejected, 1)
+		return errPoolFull
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		if atomic.CompareAndSwapInt32(&state, queued, abandoned) {
+			return ctx.Err()
+		}
+		// すでに実行中の場合は応答を書き終えるまで待ちます
+		<-done
+		return nil
+	}
+}
+
+// stats は待ち行列の長さ・実行中の件数・拒否した件数を返します
+func (p *workerPool) stats() map[string]interface{} {
+	return map[string]interface{}{
+		"queue_depth":    len(p.jobs),
+		"queue_capacity": cap(p.jobs),
+		"active":         atomic.LoadInt64(&p.active),
+		"rejected":       atomic.LoadUint64(&p.rejected),
+	}
+}
+
+// maxIdempotentResponse は Idempotency-Key の結果として保存する応答ボディの上限です。超えた応答は保存せず、再送された場合はもう一度処理します
+const maxIdempotentResponse = 1 << 20
+
+// idempotent は Idempotency-Key ヘッダーを付けたリクエストの結果を保存し、同じユーザーが同じキーで再送した場合は処理せずに保存した結果を返します。
+// 結果はデータベースに保存するため、再送が別のインスタンスに届いても二重に処理しません。5xx の応答は保存せず、再送で処理し直します
+func idempotent(results IdempotencyStore, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			handler(w, r)
+			return
+		}
+		ctx := requestContext(r)
+		if len(key) > 255 {
+			logError(ctx, "Idempotency-Key が長すぎます: %d 文字", len(key))
+			http.Error(w, "Idempotency-Key は255文字以内である必要があります", http.StatusBadRequest)
+			return
+		}
+
+		principal := getUserID(r)
+		reserved, stored, err := results.ReserveIdempotencyKey(ctx, principal, key, r.URL.Path, time.Now().UTC())
+		if err != nil {
+			logError(ctx, "Idempotency-Key の記録に失敗しました: %v", err)
+			http.Error(w, "Idempotency-Key の記録に失敗しました", http.StatusInternalServerError)
+			return
+		}
+		if !reserved {
+			switch {
+			case stored.Path != r.URL.Path:
+				logError(ctx, "Idempotency-Key %s は %s で使用済みです", key, stored.Path)
+				http.Error(w, "Idempotency-Key は別のAPIで使用されています", http.StatusUnprocessableEntity)
+			case stored.StatusCode == 0:
+				logError(ctx, "Idempotency-Key %s のリクエストを処理中です", key)
+				http.Error(w, "同じ Idempotency-Key のリクエストを処理中です", http.StatusConflict)
+			default:
+				logInfo(ctx, "Idempotency-Key %s の保存済みの結果を返します", key)
+				if stored.ContentType != "" {
+					w.Header().Set("Content-Type", stored.ContentType)
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(stored.StatusCode)
+				w.Write(stored.Body)
+			}
+			return
+		}
+
+		capture := &ResponseCapture{ResponseWriter: w, StatusCode: http.StatusOK, Limit: maxIdempotentResponse}
+		handler(capture, r)
+
+		// 応答後にクライアントが切断していても結果は保存します
+		ctx = context.WithoutCancel(ctx)
+		if capture.StatusCode >= http.StatusInternalServerError || capture.skip {
+			if err := results.ReleaseIdempotencyKey(ctx, principal, key); err != nil {
+				logError(ctx, "Idempotency-Key の記録の削除に失敗しました: %v", err)
+			}
+			return
+		}
+		result := IdempotentResult{Path: r.URL.Path, StatusCode: capture.StatusCode, ContentType: capture.Header().Get("Content-Type"), Body: capture.Body.Bytes()}
+		if err := results.CompleteIdempotencyKey(ctx, principal, key, result); err != nil {
+			logError(ctx, "Idempotency-Key の結果の保存に失敗しました: %v", err)
+		}
+	}
+}
+
+// cleanUpIdempotencyKeys は interval ごとに ttl を過ぎた Idempotency-Key の結果を削除します
+func cleanUpIdempotencyKeys(ctx context.Context, results IdempotencyStore, leases *jobLeases, ttl time.Duration, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		<-ticker.C
+		if !leases.hold(ctx, "idempotency_cleanup", interval) {
+			continue
+		}
+		removed, err := results.DeleteExpiredIdempotencyKeys(ctx, time.Now().UTC().Add(-ttl))
+		if err != nil {
+			logError(ctx, "期限を過ぎた Idempotency-Key の削除に失敗しました: %v", err)
+		} else if removed > 0 {
+			logInfo(ctx, "期限を過ぎた Idempotency-Key を %d 件削除しました", removed)
+		}
+	}
+}
+
+// limitSubmissions は pool で handler を実行し、待ち行列が一杯の場合は Retry-After を付けて 503 を返します
+func limitSubmissions(pool *workerPool, retryAfter time.Duration, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := pool.do(r.Context(), func() { handler(w, r) })
+		if errors.Is(err, errPoolFull) {
+			ctx := requestContext(r)
+			logger.Warn("送信の処理待ちが上限に達したため拒否しました", append(logAttrs(ctx), "queue_depth", len(pool.jobs))...)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			http.Error(w, "サーバーが混み合っています。しばらくしてから再送してください", http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			logInfo(requestContext(r), "処理待ちの間にクライアントが切断しました: %v", err)
+		}
+	}
+}
+
+// routeLimiter は1つのパスの同時実行数とリクエストボディの上限を適用します
+type routeLimiter struct {
+	pattern  string
+	config   RouteLimitConfig
+	slots    chan struct{}
+	rejected uint64
+	tooLarge uint64
+	timedOut uint64
+}
+
+// routeLimits は [RouteLimits] のパスごとの上限です。長いパスから順に照合します
+type routeLimits []*routeLimiter
+
+func newRouteLimits(config map[string]RouteLimitConfig) routeLimits {
+	var limits routeLimits
+	for pattern, limit := range config {
+		limiter := &routeLimiter{pattern: pattern, config: limit}
+		if limit.MaxConcurrent > 0 {
+			limiter.slots = make(chan struct{}, limit.MaxConcurrent)
+		}
+		limits = append(limits, limiter)
+	}
+	sort.Slice(limits, func(i, j int) bool { return len(limits[i].pattern) > len(limits[j].pattern) })
+	return limits
+}
+
+func (l routeLimits) match(path string) *routeLimiter {
+	for _, limiter := range l {
+		if path == limiter.pattern || (strings.HasSuffix(limiter.pattern, "/") && strings.HasPrefix(path, limiter.pattern)) {
+			return limiter
+		}
+	}
+	return nil
+}
+
+func (l routeLimits) stats() map[string]interface{} {
+	stats := make(map[string]interface{}, len(l))
+	for _, limiter := range l {
+		stats[limiter.pattern] = map[string]interface{}{
+			"active":         len(limiter.slots),
+			"max_concurrent": limiter.config.MaxConcurrent,
+			"max_body_mb":    limiter.config.MaxBodyMB,
+			"max_file_mb":    limiter.config.MaxFileMB,
+			"timeout":        limiter.config.Timeout.String(),
+			"rejected":       atomic.LoadUint64(&limiter.rejected),
+			"too_large":      atomic.LoadUint64(&limiter.tooLarge),
+			"timed_out":      atomic.LoadUint64(&limiter.timedOut),
+		}
+	}
+	return stats
+}
+
+// limitRoutes は [RouteLimits] に一致するリクエストの同時実行数とボディの大きさ、処理時間を制限します。
+// Content-Length が上限を超える場合はすぐに 413 を返し、チャンク形式などで読み込み中に超えた場合はハンドラーの読み込みがエラーになります。
+// timeout はクライアントの切断と同じくリクエストのコンテキストの終了として各ハンドラーに伝わります
+func limitRoutes(next http.Handler, limits routeLimits) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limiter := limits.match(r.URL.Path)
+		if limiter == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx := requestContext(r)
+
+		if maxBytes := limiter.config.MaxBodyMB << 20; maxBytes > 0 {
+			if r.ContentLength > maxBytes {
+				atomic.AddUint64(&limiter.tooLarge, 1)
+				writeUploadTooLarge(w, ctx, &uploadLimitError{Limit: "max_body_mb", LimitBytes: maxBytes})
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+		}
+		r = r.WithContext(context.WithValue(r.Context(), routeLimitKey, limiter.config))
+
+		if limiter.slots != nil {
+			select {
+			case limiter.slots <- struct{}{}:
+				defer func() { <-limiter.slots }()
+			default:
+				atomic.AddUint64(&limiter.rejected, 1)
+				logger.Warn("同時に処理できるリクエスト数を超えたため拒否しました", append(logAttrs(ctx), "path", limiter.pattern, "max_concurrent", limiter.config.MaxConcurrent)...)
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(limiter.config.RetryAfter.Seconds()))))
+				http.Error(w, "サーバーが混み合っています。しばらくしてから再送してください", http.StatusServiceUnavailable)
+				return
+			}
+		}
+
+		if limiter.config.Timeout > 0 {
+			timeoutCtx, cancel := context.WithTimeout(r.Context(), limiter.config.Timeout)
+			defer cancel()
+			r = r.WithContext(timeoutCtx)
+		}
+		next.ServeHTTP(w, r)
+		if errors.Is(r.Context().Err(), context.DeadlineExceeded) {
+			atomic.AddUint64(&limiter.timedOut, 1)
+			logger.Warn("処理時間の上限を超えたリクエストを打ち切りました", append(logAttrs(ctx), "path", limiter.pattern, "timeout", limiter.config.Timeout.String())...)
+		}
+	})
+}
+
+// apiVersionPrefixes はバージョン付きのパスの接頭辞と、そのバージョンです
+var apiVersionPrefixes = map[string]string{
+	"/api/v1/": "v1",
+}
+
+// apiVersions はバージョン付きのパス（/api/v1/...）へのリクエストを、バージョンのない /api/... のパスに読み替えて同じハンドラーで処理し、
+// バージョンをコンテキストに設定します。応答の形式を変える場合はハンドラーで apiVersionFromContext により分岐し、
+// バージョンのない /api/... は従来の形式のまま残します。[RouteLimits]・Idempotency-Key・ログは読み替えた後のパスで扱い、
+// アクセスログには送られたままのURIを記録します
+func apiVersions(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for prefix, version := range apiVersionPrefixes {
+			if !strings.HasPrefix(r.URL.Path, prefix) {
+				continue
+			}
+			u := *r.URL
+			u.Path = "/api/" + strings.TrimPrefix(u.Path, prefix)
+			u.RawPath = ""
+			r = r.WithContext(context.WithValue(r.Context(), apiVersionKey, version))
+			r.URL = &u
+			break
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// orgMiddleware はリクエストを送ったユーザー（authenticateRequests がパスワードを確認したユーザー）の所属する組織をコンテキストに設定します。
+// ストアの読み書きはこの組織のデータに限定されます。匿名のリクエストは既定の組織として扱います。
+// X-API-Key ヘッダーを付けたリクエストはキーを発行した組織として扱い、キーの今月のリクエスト数が上限に達している場合は 429 を返します
+func orgMiddleware(next http.Handler, orgs OrgStore, keys APIKeyStore, usage UsageStore, loc *time.Location) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := requestContext(r)
+		orgID := defaultOrgID
+		registered := false
+		if username := getUserID(r); username != "anonymous" {
+			principalOrg, err := orgs.PrincipalOrg(ctx, username)
+			if err != nil && err != sql.ErrNoRows {
+				logError(ctx, "ユーザー %s の組織の取得に失敗しました: %v", username, err)
+				http.Error(w, "組織の取得に失敗しました", http.StatusInternalServerError)
+				return
+			}
+			if err == nil {
+				orgID, registered = principalOrg, true
+			}
+		}
+
+		meter := &usageMeter{store: usage, loc: loc}
+		if rawKey := r.Header.Get("X-API-Key"); rawKey != "" {
+			key, err := keys.APIKeyByHash(ctx, hashAPIKey(rawKey))
+			if err == sql.ErrNoRows {
+				logError(ctx, "無効なAPIキーが送信されました")
+				http.Error(w, "APIキーが無効です", http.StatusUnauthorized)
+				return
+			}
+			if err != nil {
+				logError(ctx, "APIキーの確認に失敗しました: %v", err)
+				http.Error(w, "APIキーの確認に失敗しました", http.StatusInternalServerError)
+				return
+			}
+			if registered && orgID != key.OrgID {
+				logError(ctx, "ユーザー %s の組織とAPIキー %d の組織が一致しません", getUserID(r), key.KeyID)
+				http.Error(w, "APIキーを発行した組織のユーザーではありません", http.StatusForbidden)
+				return
+			}
+
+			now := time.Now()
+			allowed, err := usage.MeterRequest(ctx, key.OrgID, key.KeyID, usagePeriod(now, loc), key.MonthlyQuota)
+			if err != nil {
+				logError(ctx, "APIキーの利用量の記録に失敗しました: %v", err)
+				http.Error(w, "APIキーの利用量の記録に失敗しました", http.StatusInternalServerError)
+				return
+			}
+			if !allowed {
+				logger.Warn("APIキーの今月のリクエスト数が上限に達したため拒否しました", append(logAttrs(ctx), "key_id", key.KeyID, "monthly_quota", key.MonthlyQuota)...)
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(untilNextPeriod(now, loc).Seconds()))))
+				http.Error(w, "APIキーの今月のリクエスト数が上限に達しました", http.StatusTooManyRequests)
+				return
+			}
+			orgID, meter.keyID = key.OrgID, key.KeyID
+		}
+		ctx = context.WithValue(withOrg(ctx, orgID), usageMeterKey, meter)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// 組織ごとに記録する利用量の種類です。requests はAPIキーを付けたリクエストだけを数えます
+const (
+	usageRequests        = "requests"
+	usageSubmissions     = "submissions"
+	usageStorageBytes    = "storage_bytes"
+	usageEstimationCalls = "estimation_calls"
+	usageInquiryCalls    = "inquiry_calls"
+)
+
+// usageMeter はリクエストの利用量の記録先です。keyID はAPIキーを使わないリクエストでは 0 です
+type usageMeter struct {
+	store UsageStore
+	keyID int
+	loc   *time.Location
+}
+
+// usagePeriod は利用量を集計する月（loc の暦）を YYYY-MM で返します
+func usagePeriod(t time.Time, loc *time.Location) string {
+	return t.In(loc).Format("2006-01")
+}
+
+// untilNextPeriod は now から翌月（loc の暦）の1日0時までの時間を返します
+func untilNextPeriod(now time.Time, loc *time.Location) time.Duration {
+	local := now.In(loc)
+	return time.Date(local.Year(), local.Month()+1, 1, 0, 0, 0, 0, loc).Sub(now)
+}
+
+// recordUsage はリクエストの組織・APIキーの今月の利用量に n を加えます。
+// orgMiddleware を通らない定期処理（リトライキューの再送など）では記録しません。記録に失敗しても処理は続けます
+func recordUsage(ctx context.Context, metric string, n int64) {
+	meter, ok := ctx.Value(usageMeterKey).(*usageMeter)
+	if !ok || n <= 0 {
+		return
+	}
+	err := meter.store.AddUsage(context.WithoutCancel(ctx), recordOrg(ctx), meter.keyID, usagePeriod(time.Now(), meter.loc), metric, n)
+	if err != nil {
+		logError(ctx, "利用量（%s）の記録に失敗しました: %v", metric, err)
+	}
+}
+
+// apiKeyPrefix は発行するAPIキーの先頭の文字列です。ログや設定ファイルに紛れたキーを見分けられるようにします
+const apiKeyPrefix = "elpis_"
+
+// generateAPIKey は新しいAPIキーとそのハッシュを返します
+func generateAPIKey() (string, string, error) {
+	secret := make([]byte, 24)
+	if _, err := cryptorand.Read(secret); err != nil {
+		return "", "", fmt.Errorf("APIキーの生成に失敗しました: %v", err)
+	}
+	key := apiKeyPrefix + hex.EncodeToString(secret)
+	return key, hashAPIKey(key), nil
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// failureStatus は ctx が [RouteLimits] の timeout で打ち切られていれば 504、それ以外は 500 を返します
+func failureStatus(ctx context.Context) int {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusInternalServerError
+}
+
+// checkSignalFiles は ble_data・wifi_data を checkUploadedFile で確認し、CSVとして扱えない場合は 422 を返して false を返します
+func checkSignalFiles(w http.ResponseWriter, ctx context.Context, bleFile multipart.File, bleHeader *multipart.FileHeader, wifiFile multipart.File, wifiHeader *multipart.FileHeader) bool {
+	for _, upload := range []struct {
+		field  string
+		file   multipart.File
+		header *multipart.FileHeader
+	}{
+		{"ble_data", bleFile, bleHeader},
+		{"wifi_data", wifiFile, wifiHeader},
+	} {
+		err := checkUploadedFile(upload.field, upload.file, upload.header)
+		if errors.Is(err, errUnsupportedUpload) {
+			logError(ctx, "%v", err)
+			http.Error(w, strings.TrimPrefix(err.Error(), errUnsupportedUpload.Error()+": "), http.StatusUnprocessableEntity)
+			return false
+		}
+		if err != nil {
+			logError(ctx, "%v", err)
+			http.Error(w, fmt.Sprintf("%sの読み取りに失敗しました", upload.field), http.StatusInternalServerError)
+			return false
+		}
+	}
+	return true
+}
+
+// routeLimitFromContext は limitRoutes が一致した [RouteLimits] の設定を返します。一致しなかった場合はゼロ値（制限なし）です
+func routeLimitFromContext(ctx context.Context) RouteLimitConfig {
+	limit, _ := ctx.Value(routeLimitKey).(RouteLimitConfig)
+	return limit
+}
+
+// uploadLimitError はリクエストボディまたはアップロードファイルが [RouteLimits] の上限を超えたことを表します。
+// Limit は超えた項目（max_body_mb・max_file_mb）、Field は max_file_mb を超えたフォームの項目名です
+type uploadLimitError struct {
+	Limit      string
+	LimitBytes int64
+	Field      string
+}
+
+func (e *uploadLimitError) Error() string {
+	if e.Field != "" {
+		return fmt.Sprintf("%s が %s（%dバイト）を超えています", e.Field, e.Limit, e.LimitBytes)
+	}
+	return fmt.Sprintf("リクエストボディが %s（%dバイト）を超えています", e.Limit, e.LimitBytes)
+}
+
+// uploadLimitExceeded は err が [RouteLimits] の max_body_mb・max_file_mb を超えて読み込んだことによるエラーであれば、その内容を返します
+func uploadLimitExceeded(err error) (*uploadLimitError, bool) {
+	var limitErr *uploadLimitError
+	if errors.As(err, &limitErr) {
+		return limitErr, true
+	}
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return &uploadLimitError{Limit: "max_body_mb", LimitBytes: maxBytesErr.Limit}, true
+	}
+	return nil, false
+}
+
+// writeUploadTooLarge は超えた上限を含む 413 を返します。クライアントは limit_bytes を見て送信する大きさを調整できます
+func writeUploadTooLarge(w http.ResponseWriter, ctx context.Context, limitErr *uploadLimitError) {
+	logError(ctx, "%v", limitErr)
+	response := RequestTooLargeResponse{
+		Error:      limitErr.Error(),
+		Limit:      limitErr.Limit,
+		LimitBytes: limitErr.LimitBytes,
+		Field:      limitErr.Field,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
+	}
+}
+
+// fileLimitReader は limit バイトを超えて読み込んだ時点で *uploadLimitError を返します
+type fileLimitReader struct {
+	r     io.Reader
+	field string
+	limit int64
+	read  int64
+}
+
+func (f *fileLimitReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	f.read += int64(n)
+	if f.read > f.limit {
+		return n, &uploadLimitError{Limit: "max_file_mb", LimitBytes: f.limit, Field: f.field}
+	}
+	return n, err
+}
+
+// limitFileReader は limit が 0 より大きければ max_file_mb を確認する Reader で r を包みます
+func limitFileReader(r io.Reader, field string, limit int64) io.Reader {
+	if limit <= 0 {
+		return r
+	}
+	return &fileLimitReader{r: r, field: field, limit: limit}
+}
+
+// parseUploadForm は [RouteLimits] の max_memory_mb までをメモリに保持して multipart/form-data を解析し、
+// max_body_mb を超えた場合や max_file_mb を超えるファイルがあった場合は *uploadLimitError を返します
+func parseUploadForm(ctx context.Context, r *http.Request) error {
+	limit := routeLimitFromContext(ctx)
+	if err := r.ParseMultipartForm(limit.multipartMemory()); err != nil {
+		if limitErr, ok := uploadLimitExceeded(err); ok {
+			return limitErr
+		}
+		return err
+	}
+	maxFileBytes := limit.MaxFileMB << 20
+	if maxFileBytes <= 0 {
+		return nil
+	}
+	fields := make([]string, 0, len(r.MultipartForm.File))
+	for field := range r.MultipartForm.File {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		for _, header := range r.MultipartForm.File[field] {
+			if header.Size > maxFileBytes {
+				return &uploadLimitError{Limit: "max_file_mb", LimitBytes: maxFileBytes, Field: field}
+			}
+		}
+	}
+	return nil
+}
+
+// signalDeps は信号の送信・同期とリトライキューの再送で使うストアです。queue が nil の場合はリトライキューを使いません
+type signalDeps struct {
+	presence    PresenceStore
+	userDevices UserDeviceStore
+	devices     DeviceStore
+	uploads     UploadStore
+	queue       SubmissionQueueStore
+	orgs        OrgStore
+	tenants     TenantSettingsStore
+	blobs       BlobStore
+	usage       *storageUsage
+}
+
+// handleSignalsSubmit は受信した信号を保存して在室判定します。queue が nil でなければ、推定サーバーに転送できなかった送信を
+// リトライキューに保存して 202 を返します。scanned_at が指定された場合は受信した時刻の代わりにその時刻でセッションを更新します。
+// device_id が指定された場合は、ユーザーの登録した端末であることを確認して在室判定とともに記録します
+func handleSignalsSubmit(w http.ResponseWriter, r *http.Request, ctx context.Context, deps signalDeps, estimationURL string, inquiryURL string, decisionConfig DecisionConfig, submitConfig SubmitConfig, loc *time.Location, mergeGap time.Duration, negativeConfig NegativeSampleConfig) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "許可されていないメソッドです。POSTを使用してください。", http.StatusMethodNotAllowed)
+		return
+	}
+
+	_, parseSpan := tracer.Start(ctx, "multipart.parse")
+	err := parseUploadForm(ctx, r)
+	endSpan(parseSpan, err)
+	if limitErr, ok := uploadLimitExceeded(err); ok {
+		writeUploadTooLarge(w, ctx, limitErr)
+		return
+	}
+	if err != nil {
+		logError(ctx, "リクエストの解析に失敗しました: %v", err)
+		http.Error(w, "リクエストの解析に失敗しました", http.StatusBadRequest)
+		return
+	}
+
+	wifiFile, wifiHeader, err := r.FormFile("wifi_data")
+	if err != nil {
+		logError(ctx, "WiFiデータファイルの読み取りに失敗しました: %v", err)
+		http.Error(w, "WiFiデータファイルの読み取りに失敗しました", http.StatusBadRequest)
+		return
+	}
+	defer wifiFile.Close()
+
+	bleFile, bleHeader, err := r.FormFile("ble_data")
+	if err != nil {
+		logError(ctx, "BLEデータファイルの読み取りに失敗しました: %v", err)
+		http.Error(w, "BLEデータファイルの読み取りに失敗しました", http.StatusBadRequest)
+		return
+	}
+	defer bleFile.Close()
+
+	if !checkSignalFiles(w, ctx, bleFile, bleHeader, wifiFile, wifiHeader) {
+		return
+	}
+
+	currentTime := time.Now().In(loc)
+	// オフラインでためた送信はスキャンした時刻で記録できるよう、端末が scanned_at を送った場合はその時刻を使います
+	seenAt := currentTime
+	if value := r.FormValue("scanned_at"); value != "" {
+		seenAt, err = parseScannedAt(value, currentTime, submitConfig)
+		if errors.Is(err, errScanTimeOutOfRange) {
+			logError(ctx, "%v", err)
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if err != nil {
+			logError(ctx, "%v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	username := getUserID(r)
+	userID, err := getUserIDFromDB(ctx, deps.presence, username)
+	if err != nil {
+		logError(ctx, "ユーザーが見つかりません: %v", err)
+		http.Error(w, "ユーザーが見つかりません", http.StatusUnauthorized)
+		return
+	}
+
+	deviceID, ok := submissionDevice(w, r, ctx, deps.userDevices, userID)
+	if !ok {
+		return
+	}
+
+	consent, err := deps.presence.TrackingConsent(ctx, userID)
+	if err != nil {
+		logError(ctx, "ユーザーID %d の同意の確認に失敗しました: %v", userID, err)
+		http.Error(w, "同意の確認に失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	// 推定サーバーへの転送やルーム判定はローカルのファイルを読むため、作業用ディレクトリに書き出してから保存先へ格納します
+	workDir, err := os.MkdirTemp("", "elpis_upload_")
+	if err != nil {
+		logError(ctx, "作業ディレクトリの作成に失敗しました: %v", err)
+		http.Error(w, "ディレクトリの作成に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(workDir)
+
+	currentDate := currentTime.Format("2006-01-02")
+	unixTime := currentTime.Unix()
+	wifiFileName := fmt.Sprintf("wifi_data_%d.csv", unixTime)
+	bleFileName := fmt.Sprintf("ble_data_%d.csv", unixTime)
+
+	wifiFilePath := filepath.Join(workDir, wifiFileName)
+	bleFilePath := filepath.Join(workDir, bleFileName)
+
+	if err := saveUploadedFile(ctx, wifiFile, wifiFilePath); err != nil {
+		logError(ctx, "WiFiデータの保存に失敗しました: %v", err)
+		http.Error(w, "WiFiデータの保存に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	if err := saveUploadedFile(ctx, bleFile, bleFilePath); err != nil {
+		logError(ctx, "BLEデータの保存に失敗しました: %v", err)
+		http.Error(w, "BLEデータの保存に失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	wifiFileInfo, err := os.Stat(wifiFilePath)
+	if err != nil {
+		logError(ctx, "WiFiデータの検証に失敗しました: %v", err)
+		http.Error(w, "WiFiデータの検証に失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	bleFileInfo, err := os.Stat(bleFilePath)
+	if err != nil {
+		logError(ctx, "BLEデータの検証に失敗しました: %v", err)
+		http.Error(w, "BLEデータの検証に失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	var emptyFiles []string
+	if wifiFileInfo.Size() == 0 {
+		emptyFiles = append(emptyFiles, "WiFiデータファイルが空です")
+	}
+	if bleFileInfo.Size() == 0 {
+		emptyFiles = append(emptyFiles, "BLEデータファイルが空です")
+	}
+
+	if len(emptyFiles) > 0 {
+		errorMessage := strings.Join(emptyFiles, "; ")
+		logError(ctx, "ユーザーID %d が空のファイルをアップロードしました", userID)
+		http.Error(w, errorMessage, http.StatusBadRequest)
+		return
+	}
+
+	if !consent.Consent || trackingPaused(consent, currentTime, loc) {
+		// 同意を取り消した・記録を一時停止しているユーザーの送信はファイルを保存せず、推定したルームを返すだけでセッション・在室判定を記録しません
+		response, err := decideSignals(ctx, deps, estimationURL, inquiryURL, decisionConfig, mergeGap, negativeConfig, userID, deviceID, bleFilePath, wifiFilePath, seenAt, 0, false)
+		writeSignalsDecision(w, ctx, response, err)
+		return
+	}
+
+	if deviceID != nil {
+		if err := deps.userDevices.TouchUserDevice(ctx, *deviceID, seenAt.UTC()); err != nil {
+			logError(ctx, "端末 %d の最終送信時刻の記録に失敗しました: %v", *deviceID, err)
+		}
+	}
+
+	uploadSize := wifiFileInfo.Size() + bleFileInfo.Size()
+	if err := deps.usage.reserveUser(ctx, username, uploadSize); err == errQuotaExceeded {
+		logError(ctx, "ユーザー %s の容量制限を超えたためアップロードを拒否しました", username)
+		http.Error(w, "ユーザーの容量制限を超えています", http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		logError(ctx, "使用容量の確認に失敗しました: %v", err)
+		http.Error(w, "使用容量の確認に失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	uploadPrefix := path.Join("uploads", currentDate, username)
+	if err := putBlobFile(ctx, deps.blobs, path.Join(uploadPrefix, wifiFileName), wifiFilePath); err != nil {
+		logError(ctx, "WiFiデータの保存に失敗しました: %v", err)
+		deps.usage.releaseUser(username, uploadSize)
+		http.Error(w, "WiFiデータの保存に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	if err := putBlobFile(ctx, deps.blobs, path.Join(uploadPrefix, bleFileName), bleFilePath); err != nil {
+		logError(ctx, "BLEデータの保存に失敗しました: %v", err)
+		deps.usage.releaseUser(username, uploadSize)
+		http.Error(w, "BLEデータの保存に失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	uploadID, err := recordUpload(ctx, deps.uploads, UploadRecord{
+		Kind:       "signals",
+		UserName:   username,
+		WifiKey:    path.Join(uploadPrefix, wifiFileName),
+		BleKey:     path.Join(uploadPrefix, bleFileName),
+		UploadedAt: currentTime,
+	}, wifiFile, bleFile)
+	if err != nil {
+		logError(ctx, "ユーザーID %d の保存ファイルの記録に失敗しました: %v", userID, err)
+	}
+
+	if deps.queue != nil {
+		// 同じユーザーの送信が再送を待っている間は、受信した順に判定されるよう後ろに並べます
+		queued, err := deps.queue.HasQueuedSubmissions(ctx, userID)
+		if err != nil {
+			logError(ctx, "リトライキューの確認に失敗しました: %v", err)
+		} else if queued {
+			writeQueuedSubmission(w, ctx, deps.queue, userID, deviceID, uploadID, path.Join(uploadPrefix, wifiFileName), path.Join(uploadPrefix, bleFileName), seenAt)
+			return
+		}
+	}
+
+	response, err := decideSignals(ctx, deps, estimationURL, inquiryURL, decisionConfig, mergeGap, negativeConfig, userID, deviceID, bleFilePath, wifiFilePath, seenAt, uploadID, true)
+	if err != nil && deps.queue != nil && ctx.Err() == nil && estimationUnavailable(err) {
+		logError(ctx, "%v", err)
+		writeQueuedSubmission(w, ctx, deps.queue, userID, deviceID, uploadID, path.Join(uploadPrefix, wifiFileName), path.Join(uploadPrefix, bleFileName), seenAt)
+		return
+	}
+	writeSignalsDecision(w, ctx, response, err)
+}
+
+// errEmptySyncScan はスキャンの ble_data・wifi_data のいずれかが空であることを表します
+var errEmptySyncScan = errors.New("BLE・WiFiデータファイルが空です")
+
+// handleSignalsSync はオフラインの間に端末にたまったスキャンをまとめて受け取り、スキャンした時刻の順に在室判定して
+// セッションをさかのぼって組み立て直します。ble_data・wifi_data・scanned_at はスキャンごとに同じ順番で繰り返して送ります。
+// すでに記録したユーザーの最新の在室判定の時刻以前のスキャンは、ほかの端末などで記録済みのデータを変えないよう反映しません。
+// 前のスキャンから inactivity_timeout を超えて空いた場合は、定期処理がセッションを終了していたはずのため前のスキャンの時刻でセッションを終了します
+func handleSignalsSync(w http.ResponseWriter, r *http.Request, ctx context.Context, deps signalDeps, estimationURL string, inquiryURL string, decisionConfig DecisionConfig, submitConfig SubmitConfig, loc *time.Location, mergeGap time.Duration, inactivityTimeout time.Duration, negativeConfig NegativeSampleConfig) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "許可されていないメソッドです。POSTを使用してください。", http.StatusMethodNotAllowed)
+		return
+	}
+
+	_, parseSpan := tracer.Start(ctx, "multipart.parse")
+	err := parseUploadForm(ctx, r)
+	endSpan(parseSpan, err)
+	if limitErr, ok := uploadLimitExceeded(err); ok {
+		writeUploadTooLarge(w, ctx, limitErr)
+		return
+	}
+	if err != nil {
+		logError(ctx, "リクエストの解析に失敗しました: %v", err)
+		http.Error(w, "リクエストの解析に失敗しました", http.StatusBadRequest)
+		return
+	}
+
+	bleHeaders := r.MultipartForm.File["ble_data"]
+	wifiHeaders := r.MultipartForm.File["wifi_data"]
+	scannedAts := r.MultipartForm.Value["scanned_at"]
+	if len(bleHeaders) == 0 || len(wifiHeaders) != len(bleHeaders) || len(scannedAts) != len(bleHeaders) {
+		logError(ctx, "スキャンの数が一致しません: ble_data=%d wifi_data=%d scanned_at=%d", len(bleHeaders), len(wifiHeaders), len(scannedAts))
+		http.Error(w, "ble_data・wifi_data・scanned_at をスキャンごとに同じ数だけ指定してください", http.StatusBadRequest)
+		return
+	}
+
+	username := getUserID(r)
+	userID, err := getUserIDFromDB(ctx, deps.presence, username)
+	if err != nil {
+		logError(ctx, "ユーザーが見つかりません: %v", err)
+		http.Error(w, "ユーザーが見つかりません", http.StatusUnauthorized)
+		return
+	}
+
+	deviceID, ok := submissionDevice(w, r, ctx, deps.userDevices, userID)
+	if !ok {
+		return
+	}
+
+	consent, err := deps.presence.TrackingConsent(ctx, userID)
+	if err != nil {
+		logError(ctx, "ユーザーID %d の同意の確認に失敗しました: %v", userID, err)
+		http.Error(w, "同意の確認に失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	if deps.queue != nil {
+		// リトライキューの送信より前の時刻のスキャンを先に判定すると順番が入れ替わるため、再送が終わるまで受け付けません
+		queued, err := deps.queue.HasQueuedSubmissions(ctx, userID)
+		if err != nil {
+			logError(ctx, "リトライキューの確認に失敗しました: %v", err)
+			http.Error(w, "リトライキューの確認に失敗しました", http.StatusInternalServerError)
+			return
+		}
+		if queued {
+			logError(ctx, "ユーザーID %d の再送待ちの送信があるため同期を受け付けません", userID)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(submitConfig.RetryAfter.Seconds()))))
+			http.Error(w, "再送待ちの送信があります。しばらくしてから同期してください", http.StatusConflict)
+			return
+		}
+	}
+
+	currentTime := time.Now().In(loc)
+	results := make([]SyncScanResult, len(bleHeaders))
+	var pending []int
+	for i, value := range scannedAts {
+		results[i].Index = i
+		scannedAt, err := parseScannedAt(value, currentTime, submitConfig)
+		if err != nil {
+			results[i].Disposition, results[i].Reason = syncRejected, err.Error()
+			continue
+		}
+		results[i].ScannedAt = &scannedAt
+		pending = append(pending, i)
+	}
+	sort.SliceStable(pending, func(a, b int) bool {
+		return results[pending[a]].ScannedAt.Before(*results[pending[b]].ScannedAt)
+	})
+
+	if !consent.Consent || trackingPaused(consent, currentTime, loc) {
+		for _, i := range pending {
+			results[i].Disposition = syncNotTracked
+		}
+		writeSyncResponse(w, ctx, results)
+		return
+	}
+
+	decisions, err := deps.presence.ListDecisions(ctx, &userID, 1)
+	if err != nil {
+		logError(ctx, "ユーザーID %d の在室判定の取得に失敗しました: %v", userID, err)
+		http.Error(w, "在室判定の取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	var recordedUntil time.Time
+	if len(decisions) > 0 {
+		recordedUntil = fromWallClock(decisions[0].DecidedAt, loc)
+	}
+
+	workDir, err := os.MkdirTemp("", "elpis_sync_")
+	if err != nil {
+		logError(ctx, "作業ディレクトリの作成に失敗しました: %v", err)
+		http.Error(w, "ディレクトリの作成に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(workDir)
+
+	stopped, applied := false, false
+	for _, i := range pending {
+		result := &results[i]
+		scannedAt := *result.ScannedAt
+		if stopped {
+			result.Disposition = syncNotProcessed
+			continue
+		}
+		if !scannedAt.After(recordedUntil) {
+			result.Disposition = syncSuperseded
+			result.Reason = fmt.Sprintf("記録済みの在室判定の時刻（%s）以前のスキャンです", recordedUntil.Format(time.RFC3339))
+			continue
+		}
+
+		bleFilePath, wifiFilePath, uploadID, err := storeSyncScan(ctx, deps.blobs, deps.uploads, deps.usage, workDir, username, currentTime, i, bleHeaders[i], wifiHeaders[i])
+		if errors.Is(err, errUnsupportedUpload) || errors.Is(err, errEmptySyncScan) || errors.Is(err, errQuotaExceeded) {
+			result.Disposition, result.Reason = syncRejected, strings.TrimPrefix(err.Error(), errUnsupportedUpload.Error()+": ")
+			continue
+		}
+		if err != nil {
+			logError(ctx, "スキャン %d の保存に失敗しました: %v", i, err)
+			result.Disposition, result.Reason, stopped = syncFailed, err.Error(), true
+			continue
+		}
+
+		if !recordedUntil.IsZero() && scannedAt.Sub(recordedUntil) > inactivityTimeout {
+			if err := endUserSession(ctx, deps.presence, userID, recordedUntil); err != nil {
+				result.Disposition, result.Reason, stopped = syncFailed, err.Error(), true
+				continue
+			}
+		}
+
+		response, err := decideSignals(ctx, deps, estimationURL, inquiryURL, decisionConfig, mergeGap, negativeConfig, userID, deviceID, bleFilePath, wifiFilePath, scannedAt, uploadID, true)
+		if errors.Is(err, errTooManyRecords) {
+			result.Disposition, result.Reason = syncRejected, err.Error()
+			continue
+		}
+		if err != nil {
+			logError(ctx, "スキャン %d の在室判定に失敗しました: %v", i, err)
+			result.Disposition, result.Reason, stopped = syncFailed, err.Error(), true
+			continue
+		}
+		result.Disposition, result.Result, result.RoomID = syncApplied, response.Result, response.RoomID
+		recordedUntil, applied = scannedAt, true
+	}
+
+	if deviceID != nil && applied {
+		if err := deps.userDevices.TouchUserDevice(ctx, *deviceID, recordedUntil.UTC()); err != nil {
+			logError(ctx, "端末 %d の最終送信時刻の記録に失敗しました: %v", *deviceID, err)
+		}
+	}
+
+	writeSyncResponse(w, ctx, results)
+}
+
+// storeSyncScan はスキャン index のファイルを確認して作業用ディレクトリに書き出し、/api/signals/submit と同じく保存先へ格納して記録します
+func storeSyncScan(ctx context.Context, blobs BlobStore, uploads UploadStore, usage *storageUsage, workDir string, username string, receivedAt time.Time, index int, bleHeader *multipart.FileHeader, wifiHeader *multipart.FileHeader) (string, string, int, error) {
+	bleFile, err := bleHeader.Open()
+	if err != nil {
+		return "", "", 0, fmt.Errorf("BLEデータファイルの読み取りに失敗しました: %v", err)
+	}
+	defer bleFile.Close()
+	wifiFile, err := wifiHeader.Open()
+	if err != nil {
+		return "", "", 0, fmt.Errorf("WiFiデータファイルの読み取りに失敗しました: %v", err)
+	}
+	defer wifiFile.Close()
+
+	if err := checkUploadedFile("ble_data", bleFile, bleHeader); err != nil {
+		return "", "", 0, err
+	}
+	if err := checkUploadedFile("wifi_data", wifiFile, wifiHeader); err != nil {
+		return "", "", 0, err
+	}
+	if bleHeader.Size == 0 || wifiHeader.Size == 0 {
+		return "", "", 0, errEmptySyncScan
+	}
+
+	wifiFileName := fmt.Sprintf("wifi_data_%d_%d.csv", receivedAt.Unix(), index)
+	bleFileName := fmt.Sprintf("ble_data_%d_%d.csv", receivedAt.Unix(), index)
+	wifiFilePath := filepath.Join(workDir, wifiFileName)
+	bleFilePath := filepath.Join(workDir, bleFileName)
+	if err := saveUploadedFile(ctx, wifiFile, wifiFilePath); err != nil {
+		return "", "", 0, fmt.Errorf("WiFiデータの保存に失敗しました: %v", err)
+	}
+	if err := saveUploadedFile(ctx, bleFile, bleFilePath); err != nil {
+		return "", "", 0, fmt.Errorf("BLEデータの保存に失敗しました: %v", err)
+	}
+
+	uploadSize := wifiHeader.Size + bleHeader.Size
+	if err := usage.reserveUser(ctx, username, uploadSize); err != nil {
+		return "", "", 0, err
+	}
+
+	uploadPrefix := path.Join("uploads", receivedAt.Format("2006-01-02"), username)
+	if err := putBlobFile(ctx, blobs, path.Join(uploadPrefix, wifiFileName), wifiFilePath); err != nil {
+		usage.releaseUser(username, uploadSize)
+		return "", "", 0, fmt.Errorf("WiFiデータの保存に失敗しました: %v", err)
+	}
+	if err := putBlobFile(ctx, blobs, path.Join(uploadPrefix, bleFileName), bleFilePath); err != nil {
+		usage.releaseUser(username, uploadSize)
+		return "", "", 0, fmt.Errorf("BLEデータの保存に失敗しました: %v", err)
+	}
+
+	uploadID, err := recordUpload(ctx, uploads, UploadRecord{
+		Kind:       "signals",
+		UserName:   username,
+		WifiKey:    path.Join(uploadPrefix, wifiFileName),
+		BleKey:     path.Join(uploadPrefix, bleFileName),
+		UploadedAt: receivedAt,
+	}, wifiFile, bleFile)
+	if err != nil {
+		logError(ctx, "ユーザー %s の保存ファイルの記録に失敗しました: %v", username, err)
+	}
+	return bleFilePath, wifiFilePath, uploadID, nil
+}
+
+// writeSyncResponse はスキャンごとの処理の結果を処理の結果ごとの件数とともに返します
+func writeSyncResponse(w http.ResponseWriter, ctx context.Context, results []SyncScanResult) {
+	response := SyncResponse{Counts: make(map[string]int), Scans: results}
+	for _, result := range results {
+		response.Counts[result.Disposition]++
+	}
+	logInfo(ctx, "%d 件のスキャンを同期しました: %v", len(results), response.Counts)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
+		http.Error(w, "JSON応答のエンコードに失敗しました", http.StatusInternalServerError)
+	}
+}
+
+// submissionDevice は送信の device_id パラメータの端末を返します。指定しない場合は nil を返します。
+// 送信したユーザーの端末でない場合はエラー応答を返し、false を返します
+func submissionDevice(w http.ResponseWriter, r *http.Request, ctx context.Context, userDevices UserDeviceStore, userID int) (*int, bool) {
+	value := r.FormValue("device_id")
+	if value == "" {
+		return nil, true
+	}
+	deviceID, err := strconv.Atoi(value)
+	if err != nil {
+		logError(ctx, "device_idパラメータが無効です: %s", value)
+		http.Error(w, "device_idパラメータは整数である必要があります。", http.StatusBadRequest)
+		return nil, false
+	}
+	device, err := userDevices.UserDevice(ctx, deviceID)
+	if err == sql.ErrNoRows || (err == nil && device.UserID != userID) {
+		logError(ctx, "ユーザーID %d の端末ではありません: %d", userID, deviceID)
+		http.Error(w, "device_idの端末が見つかりません。/api/devices で登録した端末を指定してください", http.StatusBadRequest)
+		return nil, false
+	}
+	if err != nil {
+		logError(ctx, "端末の取得に失敗しました: %v", err)
+		http.Error(w, "端末の取得に失敗しました", http.StatusInternalServerError)
+		return nil, false
+	}
+	return &deviceID, true
+}
+
+// writeSignalsDecision は decideSignals の結果を応答として返します
+func writeSignalsDecision(w http.ResponseWriter, ctx context.Context, response UploadResponse, err error) {
+	if errors.Is(err, errTooManyRecords) {
+		logError(ctx, "%v", err)
+		http.Error(w, errTooManyRecords.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		logError(ctx, "%v", err)
+		http.Error(w, err.Error(), failureStatus(ctx))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
+		http.Error(w, "JSON応答のエンコードに失敗しました", http.StatusInternalServerError)
+		return
+	}
+}
+
+// decideSignals は ble・wifi のファイルから在室判定を行い、セッションの更新から在室判定の記録までを行います。
+// seenAt は信号を受信した時刻（scanned_at が指定された場合はスキャンした時刻）です。リトライキューから再送する場合は元の時刻を渡し、
+// セッションをさかのぼって更新します。deviceID は送信した端末（device_id を付けずに送信した場合は nil）で、在室判定とともに記録します。
+// track が false の場合は推定したルームを返すだけで何も記録しません
+func decideSignals(ctx context.Context, deps signalDeps, estimationURL string, inquiryURL string, decisionConfig DecisionConfig, mergeGap time.Duration, negativeConfig NegativeSampleConfig, userID int, deviceID *int, bleFilePath string, wifiFilePath string, seenAt time.Time, uploadID int, track bool) (UploadResponse, error) {
+	// 推定信頼度が範囲内かどうかは推定の完了までわからないため、speculative_inquiry が有効な場合は先に問い合わせを始めます
+	var inquiry *inquiryCall
+	if decisionConfig.SpeculativeInquiry {
+		atomic.AddUint64(&inquirySpeculative, 1)
+		inquiry = startInquiry(ctx, wifiFilePath, bleFilePath, inquiryURL)
+		defer inquiry.abandon()
+	}
+
+	shard, estimationURL := estimationRoutes.resolve(ctx, deps.devices, bleFilePath, wifiFilePath, estimationURL)
+	estimationCtx, estimationSpan := tracer.Start(ctx, "estimation.forward")
+	if shard != "" {
+		estimationSpan.SetAttributes(attribute.String("elpis.estimation_shard", shard))
+	}
+	estimationConfidence, err := forwardFilesToEstimationServer(estimationCtx, bleFilePath, wifiFilePath, estimationURL)
+	estimationSpan.SetAttributes(attribute.Int("elpis.estimation_confidence", estimationConfidence))
+	endSpan(estimationSpan, err)
+	if err != nil {
+		return UploadResponse{}, fmt.Errorf("推定サーバーへの転送に失敗しました: %w", err)
+	}
+
+	var roomID int
+	var decidedInquiry sql.NullInt64
+	var inquiryConfidence int
+	inquiryBand := estimationConfidence >= decisionConfig.InquiryMin && estimationConfidence <= decisionConfig.InquiryMax
+	if inquiryBand {
+		if inquiry == nil {
+			inquiry = startInquiry(ctx, wifiFilePath, bleFilePath, inquiryURL)
+		}
+		inquiryConfidence, err = inquiry.wait()
+		if err != nil {
+			return UploadResponse{}, fmt.Errorf("問い合わせサーバーへの転送に失敗しました: %v", err)
+		}
+		decidedInquiry = sql.NullInt64{Int64: int64(inquiryConfidence), Valid: true}
+	}
+
+	if !track {
+		response := UploadResponse{Message: "在室状況を記録しないため、推定したルームのみを返します", Result: submitResultNotTracked}
+		if estimationConfidence > decisionConfig.InquiryMax || (inquiryBand && estimationConfidence >= inquiryConfidence) {
+			response.RoomID, err = determineRoomID(ctx, deps.devices, bleFilePath, wifiFilePath)
+			if err != nil {
+				return UploadResponse{}, fmt.Errorf("ルームIDの決定に失敗しました: %v", err)
+			}
+		}
+		return response, nil
+	}
+
+	// 推定・問い合わせの待ち時間は直列化せず、セッションの更新から在室判定の記録までを同じユーザーの送信ごとに1つずつ行います
+	unlock := presenceLocks.lock(userID)
+	defer unlock()
+	decision := "absent"
+	result := submitResultSessionEnded
+	var negativeSaved bool
+	if inquiryBand {
+		if estimationConfidence >= inquiryConfidence {
+			roomID, err = determineRoomID(ctx, deps.devices, bleFilePath, wifiFilePath)
+			if err != nil {
+				return UploadResponse{}, fmt.Errorf("ルームIDの決定に失敗しました: %v", err)
+			}
+			logInfo(ctx, "ユーザーID %d に対するルームID %d を決定しました", userID, roomID)
+			decision, result = "present", submitResultRoomAssigned
+
+			err = updateUserPresence(ctx, deps.presence, userID, estimationConfidence, inquiryConfidence, seenAt, roomID, mergeGap)
+			if err != nil {
+				logError(ctx, "ユーザーID %d のプレゼンス更新に失敗しました: %v", userID, err)
+			}
+		} else if decisionConfig.InquiryWin == inquiryWinKeepSession {
+			// 問い合わせ信頼度が上回っても在室中のセッションは変更せず、判定できなかったものとして記録します
+			decision, result = "uncertain", submitResultUncertain
+			logInfo(ctx, "問い合わせ信頼度 %d が推定信頼度 %d を上回りましたが、inquiry_win が keep_session のためユーザーID %d のセッションを変更しません", inquiryConfidence, estimationConfidence, userID)
+		} else {
+			err = endUserSession(ctx, deps.presence, userID, seenAt)
+			if err != nil {
+				logError(ctx, "ユーザーID %d のセッション終了に失敗しました: %v", userID, err)
+			} else {
+				logInfo(ctx, "ユーザーID %d のセッションを終了しました", userID)
+			}
+		}
+
+		// 問い合わせ信頼度が上回ったデータは inquiry_win にかかわらずネガティブサンプルの候補です
+		if estimationConfidence < inquiryConfidence {
+			negativeSaved, err = saveNegativeSample(ctx, deps.blobs, negativeConfig, wifiFilePath, bleFilePath, seenAt.Unix())
+			if err != nil {
+				return UploadResponse{}, fmt.Errorf("ネガティブサンプルの保存に失敗しました: %v", err)
+			}
+			if negativeSaved {
+				logInfo(ctx, "ユーザーID %d のデータをネガティブサンプルとして保存しました", userID)
+			}
+		}
+	} else {
+		if estimationConfidence > decisionConfig.InquiryMax {
+			roomID, err = determineRoomID(ctx, deps.devices, bleFilePath, wifiFilePath)
+			if err != nil {
+				return UploadResponse{}, fmt.Errorf("ルームIDの決定に失敗しました: %v", err)
+			}
+			logInfo(ctx, "ユーザーID %d に対するルームID %d を決定しました", userID, roomID)
+			decision, result = "present", submitResultRoomAssigned
+
+			err = updateUserPresence(ctx, deps.presence, userID, estimationConfidence, 0, seenAt, roomID, mergeGap)
+			if err != nil {
+				logError(ctx, "ユーザーID %d のプレゼンス更新に失敗しました: %v", userID, err)
+			}
+		} else {
+			err = endUserSession(ctx, deps.presence, userID, seenAt)
+			if err != nil {
+				logError(ctx, "ユーザーID %d のセッション終了に失敗しました: %v", userID, err)
+			} else {
+				logInfo(ctx, "ユーザーID %d のセッションを終了しました", userID)
+			}
+		}
+	}
+
+	decisionID, err := recordPresenceDecision(ctx, deps.presence, userID, deviceID, roomID, estimationConfidence, decidedInquiry, decision, seenAt)
+	unlock()
+	if err != nil {
+		logError(ctx, "ユーザーID %d の在室判定の記録に失敗しました: %v", userID, err)
+	} else if uploadID != 0 {
+		var decidedRoom *int
+		if roomID != 0 {
+			decidedRoom = &roomID
+		}
+		if err := deps.uploads.LinkUploadDecision(ctx, uploadID, decisionID, decidedRoom); err != nil {
+			logError(ctx, "保存ファイル %d と在室判定の関連付けに失敗しました: %v", uploadID, err)
+		}
+	}
+
+	return UploadResponse{Message: "シグナルデータを受信しました", Result: result, RoomID: roomID, NegativeSample: negativeSaved}, nil
+}
+
+// writeQueuedSubmission は送信をリトライキューに保存し、後で判定することを 202 で返します
+func writeQueuedSubmission(w http.ResponseWriter, ctx context.Context, queue SubmissionQueueStore, userID int, deviceID *int, uploadID int, wifiKey string, bleKey string, submittedAt time.Time) {
+	submission := QueuedSubmission{UserID: userID, WifiKey: wifiKey, BleKey: bleKey, SubmittedAt: submittedAt, DeviceID: deviceID}
+	if uploadID != 0 {
+		submission.UploadID = &uploadID
+	}
+	queueID, err := queue.EnqueueSubmission(ctx, submission)
+	if err != nil {
+		logError(ctx, "リトライキューへの保存に失敗しました: %v", err)
+		http.Error(w, "信号データの保存に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	atomic.AddUint64(&retryQueueEnqueued, 1)
+	logInfo(ctx, "ユーザーID %d の送信をリトライキュー（ID %d）に保存しました", userID, queueID)
+
+	response := UploadResponse{Message: "信号データを保存しました。推定サーバーで処理できるようになり次第、受信した時刻で在室判定します", Result: submitResultQueued}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
+	}
+}
+
+// replayQueuedSubmissions は interval ごとにリトライキューの送信を受信した順に在室判定し直します
+func replayQueuedSubmissions(ctx context.Context, deps signalDeps, leases *jobLeases, config RetryQueueConfig, mergeGap time.Duration, negativeConfig NegativeSampleConfig, loc *time.Location) {
+	ticker := time.NewTicker(config.Interval)
+	defer ticker.Stop()
+
+	for {
+		<-ticker.C
+		// 同じ送信を複数のインスタンスが再送しないよう、リースを保持するインスタンスのみが再送します
+		if !leases.hold(ctx, "retry_queue", config.Interval) {
+			continue
+		}
+		drainSubmissionQueue(ctx, deps, config, mergeGap, negativeConfig, loc)
+	}
+}
+
+// drainSubmissionQueue はリトライキューが空になるまで送信を受信した順に再送します。
+// 推定サーバーがまだ応答しない場合は順序を保つためその時点で打ち切り、次の interval に先頭から再送します。
+// 保存ファイルが削除されているなど再送しても判定できない送信と、max_age を過ぎた送信は破棄します。
+// 各送信はユーザーの所属する組織のビーコン・WiFiアクセスポイントとルーム、組織ごとの在室判定のしきい値で判定します
+func drainSubmissionQueue(ctx context.Context, deps signalDeps, config RetryQueueConfig, mergeGap time.Duration, negativeConfig NegativeSampleConfig, loc *time.Location) {
+	for {
+		submissions, err := deps.queue.QueuedSubmissions(ctx, config.BatchSize)
+		if err != nil {
+			logError(ctx, "リトライキューの取得に失敗しました: %v", err)
+			return
+		}
+
+		for _, submission := range submissions {
+			submittedAt := fromWallClock(submission.SubmittedAt, loc)
+			if config.MaxAge > 0 && time.Since(submittedAt) > config.MaxAge {
+				atomic.AddUint64(&retryQueueDropped, 1)
+				logger.Warn("保存期間を過ぎたため再送せずに破棄しました", append(logAttrs(ctx), "queue_id", submission.QueueID, "user_id", submission.UserID, "submitted_at", submittedAt.Format(time.RFC3339), "attempts", submission.Attempts)...)
+				if err := deps.queue.DeleteQueuedSubmission(ctx, submission.QueueID); err != nil {
+					logError(ctx, "リトライキュー %d の削除に失敗しました: %v", submission.QueueID, err)
+					return
+				}
+				continue
+			}
+
+			orgID, err := deps.orgs.UserOrg(ctx, submission.UserID)
+			if err != nil && err != sql.ErrNoRows {
+				logError(ctx, "ユーザーID %d の組織の取得に失敗しました: %v", submission.UserID, err)
+				return
+			}
+			replayCtx := withOrg(context.WithValue(ctx, requestIDKey, fmt.Sprintf("retry-queue-%d", submission.QueueID)), orgID)
+			if err == sql.ErrNoRows {
+				err = fmt.Errorf("ユーザーID %d が存在しません", submission.UserID)
+			} else {
+				err = replaySubmission(replayCtx, deps, mergeGap, negativeConfig, submission, submittedAt, loc)
+			}
+			if err != nil && estimationUnavailable(err) {
+				atomic.AddUint64(&retryQueueFailures, 1)
+				if err := deps.queue.RecordSubmissionAttempt(ctx, submission.QueueID, err.Error()); err != nil {
+					logError(ctx, "リトライキュー %d の再送失敗の記録に失敗しました: %v", submission.QueueID, err)
+				}
+				logger.Warn("推定サーバーが応答しないため再送を中断しました", append(logAttrs(replayCtx), "error", err.Error())...)
+				return
+			}
+			if err != nil {
+				atomic.AddUint64(&retryQueueDropped, 1)
+				logError(replayCtx, "ユーザーID %d の送信を再送できないため破棄しました: %v", submission.UserID, err)
+			} else {
+				atomic.AddUint64(&retryQueueReplayed, 1)
+				logInfo(replayCtx, "ユーザーID %d の %s に受信した送信を再送しました", submission.UserID, submittedAt.Format(time.RFC3339))
+			}
+			if err := deps.queue.DeleteQueuedSubmission(ctx, submission.QueueID); err != nil {
+				logError(ctx, "リトライキュー %d の削除に失敗しました: %v", submission.QueueID, err)
+				return
+			}
+		}
+
+		if len(submissions) < config.BatchSize {
+			return
+		}
+	}
+}
+
+// replaySubmission は保存した ble・wifi のファイルを作業用ディレクトリに読み込み、元の受信時刻 submittedAt で在室判定します
+func replaySubmission(ctx context.Context, deps signalDeps, mergeGap time.Duration, negativeConfig NegativeSampleConfig, submission QueuedSubmission, submittedAt time.Time, loc *time.Location) error {
+	workDir, err := os.MkdirTemp("", "elpis_retry_")
+	if err != nil {
+		return fmt.Errorf("作業ディレクトリの作成に失敗しました: %v", err)
+	}
+	defer os.RemoveAll(workDir)
+
+	bleFilePath := filepath.Join(workDir, path.Base(submission.BleKey))
+	wifiFilePath := filepath.Join(workDir, path.Base(submission.WifiKey))
+	if err := getBlobFile(ctx, deps.blobs, submission.BleKey, bleFilePath); err != nil {
+		return fmt.Errorf("保存ファイル %s の読み込みに失敗しました: %v", submission.BleKey, err)
+	}
+	if err := getBlobFile(ctx, deps.blobs, submission.WifiKey, wifiFilePath); err != nil {
+		return fmt.Errorf("保存ファイル %s の読み込みに失敗しました: %v", submission.WifiKey, err)
+	}
+
+	var uploadID int
+	if submission.UploadID != nil {
+		uploadID = *submission.UploadID
+	}
+	// 送信してから同意を取り消した・記録を一時停止した場合は、再送しても在室状況を記録しません
+	consent, err := deps.presence.TrackingConsent(ctx, submission.UserID)
+	if err != nil {
+		return fmt.Errorf("ユーザーID %d の同意の確認に失敗しました: %v", submission.UserID, err)
+	}
+	if !consent.Consent {
+		return fmt.Errorf("ユーザーID %d は在室状況の記録への同意を取り消しています", submission.UserID)
+	}
+	if trackingPaused(consent, time.Now(), loc) {
+		return fmt.Errorf("ユーザーID %d は在室状況の記録を一時停止しています", submission.UserID)
+	}
+	current := currentSettings()
+	decision := tenantOverrides(ctx, deps.tenants).decision(current.Decision)
+	_, err = decideSignals(ctx, deps, current.EstimationURL, current.InquiryURL, decision, mergeGap, negativeConfig, submission.UserID, submission.DeviceID, bleFilePath, wifiFilePath, submittedAt, uploadID, true)
+	return err
+}
+
+// negativeSampleKey は組織 orgID のネガティブサンプルの保存先（[NegativeSamples] dir を組織の名前空間に置いたもの）を返します
+func negativeSampleKey(orgID int, config NegativeSampleConfig) string {
+	return tenantKey(orgID, blobKey(config.Dir))
+}
+
+// countNegativeSamples は prefix 以下に保存済みのネガティブサンプル数（WiFi/BLEの組の数）を返します
+func countNegativeSamples(ctx context.Context, blobs BlobStore, prefix string) (int, error) {
+	blobInfos, err := blobs.List(ctx, prefix)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, info := range blobInfos {
+		if matched, _ := path.Match("wifi_data_negative_*.csv", path.Base(info.Key)); matched {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// negativeSampleRecountInterval は覚えているネガティブサンプル数を、保存先を一覧して数え直す間隔です
+const negativeSampleRecountInterval = 5 * time.Minute
+
+// negativeSampleCounter は保存先ごとのネガティブサンプル数を覚えておき、max_samples の確認のたびに保存先を一覧しないようにします。
+// 保存したサンプルはその場で加算し、最初の確認時と negativeSampleRecountInterval ごとに一覧して数え直します
+type negativeSampleCounter struct {
+	mu     sync.Mutex
+	counts map[string]negativeSampleCount
+}
+
+// generation は数え直すたびに増やし、数え直す前の予約を release で戻さないようにします
+type negativeSampleCount struct {
+	stored     int
+	countedAt  time.Time
+	generation uint64
+}
+
+var negativeSampleCounts = &negativeSampleCounter{counts: make(map[string]negativeSampleCount)}
+
+// reserve は prefix のネガティブサンプル数が max 未満であれば1件分を加算して true と予約した時点の世代を返します。一覧は mu を保持せずに行います
+func (c *negativeSampleCounter) reserve(ctx context.Context, blobs BlobStore, prefix string, max int) (uint64, bool, error) {
+	c.mu.Lock()
+	count, ok := c.counts[prefix]
+	c.mu.Unlock()
+	if !ok || time.Since(count.countedAt) >= negativeSampleRecountInterval {
+		stored, err := countNegativeSamples(ctx, blobs, prefix)
+		if err != nil {
+			return 0, false, err
+		}
+		c.mu.Lock()
+		c.counts[prefix] = negativeSampleCount{stored: stored, countedAt: time.Now(), generation: c.counts[prefix].generation + 1}
+		c.mu.Unlock()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	count = c.counts[prefix]
+	if count.stored >= max {
+		return 0, false, nil
+	}
+	count.stored++
+	c.counts[prefix] = count
+	return count.generation, true, nil
+}
+
+// release は保存に失敗したサンプルの分を reserve で加算した数から戻します。
+// 予約の後に数え直していた場合、失敗したサンプルは一覧した数に含まれていないため戻しません
+func (c *negativeSampleCounter) release(prefix string, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if count, ok := c.counts[prefix]; ok && count.generation == generation && count.stored > 0 {
+		count.stored--
+		c.counts[prefix] = count
+	}
+}
+
+// saveNegativeSample は設定に従ってネガティブサンプルを送信したユーザーの組織の名前空間に保存します。max_samples は組織ごとに適用します。
+// 保存しなかった場合はfalseを返します
+func saveNegativeSample(ctx context.Context, blobs BlobStore, config NegativeSampleConfig, wifiFilePath string, bleFilePath string, unixTime int64) (bool, error) {
+	if !*config.Enabled {
+		return false, nil
+	}
+	dir := negativeSampleKey(recordOrg(ctx), config)
+
+	if sampleRate := *config.SampleRate; sampleRate < 1 && rand.Float64() >= sampleRate {
+		atomic.AddUint64(&negativeSamplesSkipped, 1)
+		logInfo(ctx, "サンプリング率 %.2f によりネガティブサンプルの保存をスキップしました", sampleRate)
+		return false, nil
+	}
+
+	var generation uint64
+	if config.MaxSamples > 0 {
+		var reserved bool
+		var err error
+		generation, reserved, err = negativeSampleCounts.reserve(ctx, blobs, dir, config.MaxSamples)
+		if err != nil {
+			logError(ctx, "ネガティブサンプル数の取得に失敗しました: %v", err)
+			return false, err
+		}
+		if !reserved {
+			atomic.AddUint64(&negativeSamplesSkipped, 1)
+			logInfo(ctx, "ネガティブサンプルが上限 %d 件に達しているため保存をスキップしました", config.MaxSamples)
+			return false, nil
+		}
+	}
+
+	negativeWifiKey := path.Join(dir, fmt.Sprintf("wifi_data_negative_%d.csv", unixTime))
+	negativeBleKey := path.Join(dir, fmt.Sprintf("ble_data_negative_%d.csv", unixTime))
+
+	if err := putBlobFile(ctx, blobs, negativeWifiKey, wifiFilePath); err != nil {
+		logError(ctx, "WiFiデータのネガティブサンプルへのコピーに失敗しました: %v", err)
+		negativeSampleCounts.release(dir, generation)
+		return false, err
+	}
+
+	if err := putBlobFile(ctx, blobs, negativeBleKey, bleFilePath); err != nil {
+		logError(ctx, "BLEデータのネガティブサンプルへのコピーに失敗しました: %v", err)
+		negativeSampleCounts.release(dir, generation)
+		return false, err
+	}
+
+	atomic.AddUint64(&negativeSamplesCaptured, 1)
+	return true, nil
+}
+
+func handleAdminNegativeSamples(w http.ResponseWriter, r *http.Request, ctx context.Context, presence PresenceStore, blobs BlobStore, config NegativeSampleConfig) {
+	if !requireSystemAdmin(w, r, ctx, presence) {
+		return
+	}
+
+	stored, err := countNegativeSamples(ctx, blobs, negativeSampleKey(recordOrg(ctx), config))
+	if err != nil {
+		logError(ctx, "ネガティブサンプル数の取得に失敗しました: %v", err)
+		http.Error(w, "ネガティブサンプル数の取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	response := NegativeSampleStatsResponse{
+		Enabled:            *config.Enabled,
+		SampleRate:         *config.SampleRate,
+		MaxSamples:         config.MaxSamples,
+		Dir:                config.Dir,
+		StoredSamples:      stored,
+		CapturedSinceStart: atomic.LoadUint64(&negativeSamplesCaptured),
+		SkippedSinceStart:  atomic.LoadUint64(&negativeSamplesSkipped),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
+		http.Error(w, "JSON応答のエンコードに失敗しました", http.StatusInternalServerError)
+	}
+}
+
+// xlsxStreamWriter は1シートのみのXLSXファイルを行単位でストリーム出力します
+type xlsxStreamWriter struct {
+	zip   *zip.Writer
+	sheet io.Writer
+	row   int
+}
+
+func newXLSXStreamWriter(w io.Writer, sheetName string) (*xlsxStreamWriter, error) {
+	zw := zip.NewWriter(w)
+	files := []struct {
+		name    string
+		content string
+	}{
+		{"[Content_Types].xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"><Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/><Default Extension="xml" ContentType="application/xml"/><Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/><Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/></Types>`},
+		{"_rels/.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/></Relationships>`},
+		{"xl/workbook.xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets><sheet name="` + xmlEscape(sheetName) + `" sheetId="1" r:id="rId1"/></sheets></workbook>`},
+		{"xl/_rels/workbook.xml.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/></Relationships>`},
+	}
+	for _, f := range files {
+		fw, err := zw.Create(f.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.WriteString(fw, f.content); err != nil {
+			return nil, err
+		}
+	}
+
+	sheet, err := zw.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.WriteString(sheet, `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`); err != nil {
+		return nil, err
+	}
+	return &xlsxStreamWriter{zip: zw, sheet: sheet}, nil
+}
+
+func (x *xlsxStreamWriter) WriteRow(values []string) error {
+	x.row++
+	var b strings.Builder
+	fmt.Fprintf(&b, `<row r="%d">`, x.row)
+	for _, v := range values {
+		b.WriteString(`<c t="inlineStr"><is><t>`)
+		b.WriteString(xmlEscape(v))
+		b.WriteString(`</t></is></c>`)
+	}
+	b.WriteString(`</row>`)
+	_, err := io.WriteString(x.sheet, b.String())
+	return err
+}
+
+func (x *xlsxStreamWriter) Close() error {
+	if _, err := io.WriteString(x.sheet, `</sheetData></worksheet>`); err != nil {
+		return err
+	}
+	return x.zip.Close()
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+func handleSignalsServer(w http.ResponseWriter, r *http.Request, ctx context.Context, estimationURL string) {
+	handleSignalsServerSubmit(w, r, ctx, estimationURL)
+}
+
+// maxHistoryRange は履歴クエリで一度に取得できる最大期間です
+const maxHistoryRange = 93 * 24 * time.Hour
+
+func parseHistoryDate(value string, loc *time.Location) (time.Time, error) {
+	date, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, loc), nil
+}
+
+// parseHistoryRange はクエリパラメータから履歴の取得期間 [from, to) を決定します。
+// date は from の旧名として扱い、to は指定日を含むように翌日0時に変換します。
+// to が省略された場合は現在時刻までとし、上限を超える分は切り詰めます。
+// 旧形式の date だけを指定した場合は従来どおり指定日から現在までを返し、期間の上限は適用しません。
+func parseHistoryRange(r *http.Request, loc *time.Location) (time.Time, time.Time, error) {
+	query := r.URL.Query()
+	fromStr := query.Get("from")
+	toStr := query.Get("to")
+	legacyDate := false
+	if fromStr == "" {
+		fromStr = query.Get("date")
+		legacyDate = fromStr != "" && toStr == ""
+	}
+
+	now := time.Now().In(loc)
+	var from, to time.Time
+	var err error
+
+	if toStr != "" {
+		to, err = parseHistoryDate(toStr, loc)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("toパラメータが無効です。形式はYYYY-MM-DDである必要があります。")
+		}
+		to = to.AddDate(0, 0, 1)
+	} else {
+		to = now
+	}
+
+	if fromStr != "" {
+		from, err = parseHistoryDate(fromStr, loc)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("日付パラメータが無効です。形式はYYYY-MM-DDである必要があります。")
+		}
+		if toStr == "" && to.Before(from) {
+			to = from.AddDate(0, 0, 1)
+		}
+	} else {
+		from = to.AddDate(0, -1, 0)
+	}
+
+	if !from.Before(to) {
+		return time.Time{}, time.Time{}, fmt.Errorf("fromはto以前の日付である必要があります。")
+	}
+	if legacyDate {
+		return from, to, nil
+	}
+	if toStr == "" && to.Sub(from) > maxHistoryRange {
+		to = from.Add(maxHistoryRange)
+	}
+	if to.Sub(from) > maxHistoryRange {
+		return time.Time{}, time.Time{}, fmt.Errorf("取得期間は最大%d日までです。", int(maxHistoryRange.Hours()/24))
+	}
+
+	return from, to, nil
+}
+
+const (
+	defaultPageSize = 500
+	maxPageSize     = 5000
+)
+
+type sessionCursor struct {
+	StartTime time.Time
+	SessionID int
+}
+
+func encodeSessionCursor(session PresenceSession) string {
+	raw := fmt.Sprintf("%d:%d", session.StartTime.UnixNano(), session.SessionID)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeSessionCursor(cursor string) (*sessionCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.SplitN(string(raw), ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("カーソルの形式が不正です")
+	}
+	nanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	sessionID, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	return &sessionCursor{StartTime: time.Unix(0, nanos).UTC(), SessionID: sessionID}, nil
+}
+
+// parsePageParams は limit と cursor クエリパラメータを解析します。
+// どちらも指定されていない場合は limit=0（ページングなし）を返します。
+func parsePageParams(r *http.Request) (int, *sessionCursor, error) {
+	query := r.URL.Query()
+	limitStr := query.Get("limit")
+	cursorStr := query.Get("cursor")
+
+	limit := 0
+	if limitStr != "" {
+		parsed, err := strconv.Atoi(limitStr)
+		if err != nil || parsed <= 0 {
+			return 0, nil, fmt.Errorf("limitパラメータは正の整数である必要があります。")
+		}
+		if parsed > maxPageSize {
+			parsed = maxPageSize
+		}
+		limit = parsed
+	}
+
+	var after *sessionCursor
+	if cursorStr != "" {
+		cursor, err := decodeSessionCursor(cursorStr)
+		if err != nil {
+			return 0, nil, fmt.Errorf("cursorパラメータが無効です。")
+		}
+		after = cursor
+		if limit == 0 {
+			limit = defaultPageSize
+		}
+	}
+
+	return limit, after, nil
+}
+
+// requestLocation は tz パラメータ（Asia/Tokyo や UTC などのIANAタイムゾーン名）で指定したタイムゾーンを返します。
+// 指定がない場合はサーバーのタイムゾーン loc を返し、無効な場合は400を返して false を返します
+func requestLocation(w http.ResponseWriter, r *http.Request, ctx context.Context, loc *time.Location) (*time.Location, bool) {
+	tz := r.URL.Query().Get("tz")
+	if tz == "" {
+		return loc, true
+	}
+	requested, err := time.LoadLocation(tz)
+	if err != nil {
+		logError(ctx, "tzパラメータが無効です: %s", tz)
+		http.Error(w, "tzパラメータはIANAタイムゾーン名（例: Asia/Tokyo、UTC）である必要があります", http.StatusBadRequest)
+		return nil, false
+	}
+	return requested, true
+}
+
+func handlePresenceHistory(w http.ResponseWriter, r *http.Request, ctx context.Context, presence PresenceStore, accessLog HistoryAccessStore, loc *time.Location) {
+	from, to, err := parseHistoryRange(r, loc)
+	if err != nil {
+		logError(ctx, "期間パラメータが無効です: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	limit, after, err := parsePageParams(r)
+	if err != nil {
+		logError(ctx, "ページングパラメータが無効です: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	fetchLimit := 0
+	if limit > 0 {
+		fetchLimit = limit + 1
+	}
+
+	sessions, err := presence.ListSessions(ctx, from, to, after, fetchLimit)
+	if err != nil {
+		logError(ctx, "プレゼンス履歴の取得に失敗しました: %v", err)
+		http.Error(w, "プレゼンス履歴の取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	var nextCursor string
+	if limit > 0 && len(sessions) > limit {
+		sessions = sessions[:limit]
+		nextCursor = encodeSessionCursor(sessions[limit-1])
+	}
+
+	// カーソルは除外する前の最後のセッションから求めるため、除外によってページの件数が limit より少なくなることがあります
+	sessions, err = excludeUsersWithoutConsent(ctx, presence, sessions)
+	if err != nil {
+		logError(ctx, "%v", err)
+		http.Error(w, "プレゼンス履歴の取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	recordHistoryAccess(ctx, accessLog, r, nil, from, to)
+
+	dayUserMap := make(map[string]map[int][]PresenceSession)
+	for _, session := range sessions {
+		date := session.StartTime.In(loc).Format("2006-01-02")
+		if _, exists := dayUserMap[date]; !exists {
+			dayUserMap[date] = make(map[int][]PresenceSession)
+		}
+		dayUserMap[date][session.UserID] = append(dayUserMap[date][session.UserID], session)
+	}
+
+	var allHistory []AllUsersPresenceDay
+	for date, usersMap := range dayUserMap {
+		var users []UserPresenceDetail
+		for userID, userSessions := range usersMap {
+			users = append(users, UserPresenceDetail{
+				UserID:   userID,
+				Sessions: userSessions,
+			})
+		}
+		allHistory = append(allHistory, AllUsersPresenceDay{
+			Date:  date,
+			Users: users,
+		})
+	}
+
+	sort.Slice(allHistory, func(i, j int) bool {
+		return allHistory[i].Date < allHistory[j].Date
+	})
+
+	response := PresenceHistoryResponse{
+		AllHistory: allHistory,
+		NextCursor: nextCursor,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
+		http.Error(w, "JSON応答のエンコードに失敗しました", http.StatusInternalServerError)
+	}
+}
+
+type sessionExportRow struct {
+	SessionID int
+	UserID    int
+	UserName  string
+	RoomID    int
+	RoomName  string
+	StartTime time.Time
+	EndTime   sql.NullTime
+	LastSeen  time.Time
+}
+
+var sessionExportHeader = []string{"session_id", "user_id", "user_name", "room_id", "room_name", "start_time", "end_time", "last_seen", "duration_minutes"}
+
+func (row sessionExportRow) values(loc *time.Location) []string {
+	end := row.LastSeen
+	endStr := ""
+	if row.EndTime.Valid {
+		end = row.EndTime.Time
+		endStr = row.EndTime.Time.In(loc).Format(time.RFC3339)
+	}
+	return []string{
+		strconv.Itoa(row.SessionID),
+		strconv.Itoa(row.UserID),
+		row.UserName,
+		strconv.Itoa(row.RoomID),
+		row.RoomName,
+		row.StartTime.In(loc).Format(time.RFC3339),
+		endStr,
+		row.LastSeen.In(loc).Format(time.RFC3339),
+		strconv.FormatFloat(end.Sub(row.StartTime).Minutes(), 'f', 1, 64),
+	}
+}
+
+// csvValues は values と同じ列を返しますが、ユーザー名・ルーム名は escapeCSVFormula でエスケープします。
+// 数値や日時の列は数式として解釈されないため、負の数などはそのまま出力します
+func (row sessionExportRow) csvValues(loc *time.Location) []string {
+	row.UserName = escapeCSVFormula(row.UserName)
+	row.RoomName = escapeCSVFormula(row.RoomName)
+	return row.values(loc)
+}
+
+// escapeCSVFormula は表計算ソフトが数式として解釈する文字（=・+・-・@・タブ・CR）で始まる文字列の先頭に ' を付けます。
+// ユーザー名やルーム名に埋め込まれた数式が、エクスポートしたCSVを開いたときに実行されないようにします
+func escapeCSVFormula(v string) string {
+	if v != "" && strings.ContainsRune("=+-@\t\r", rune(v[0])) {
+		return "'" + v
+	}
+	return v
+}
+
+// streamSessionsForExport は期間内のセッションを1行ずつ fn に渡します。全件をメモリに保持しません
+func streamSessionsForExport(ctx context.Context, reports ReportStore, from time.Time, to time.Time, fn func(sessionExportRow) error) error {
+	rows, err := reports.QueryReport(ctx, querySessionsForExport, from, to, orgFromContext(ctx))
+	if err != nil {
+		logError(ctx, "エクスポート用セッションのクエリに失敗しました: %v", err)
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var row sessionExportRow
+		if err := rows.Scan(&row.SessionID, &row.UserID, &row.UserName, &row.RoomID, &row.RoomName, &row.StartTime, &row.EndTime, &row.LastSeen); err != nil {
+			continue
+		}
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+func handlePresenceHistoryExport(w http.ResponseWriter, r *http.Request, ctx context.Context, reports ReportStore, accessLog HistoryAccessStore, loc *time.Location) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "xlsx" {
+		logError(ctx, "formatパラメータが無効です: %s", format)
+		http.Error(w, "formatパラメータはcsvまたはxlsxである必要があります。", http.StatusBadRequest)
+		return
+	}
+
+	from, to, err := parseHistoryRange(r, loc)
+	if err != nil {
+		logError(ctx, "期間パラメータが無効です: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	recordHistoryAccess(ctx, accessLog, r, nil, from, to)
+
+	fileName := fmt.Sprintf("presence_history_%s_%s.%s", from.Format("20060102"), to.AddDate(0, 0, -1).Format("20060102"), format)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fileName))
+
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		writer := csv.NewWriter(w)
+		if err := writer.Write(sessionExportHeader); err != nil {
+			logError(ctx, "CSVヘッダーの書き込みに失敗しました: %v", err)
+			return
+		}
+		err = streamSessionsForExport(ctx, reports, from, to, func(row sessionExportRow) error {
+			return writer.Write(row.csvValues(loc))
+		})
+		writer.Flush()
+		if err == nil {
+			err = writer.Error()
+		}
+	} else {
+		w.Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+		sheet, openErr := newXLSXStreamWriter(w, "presence_history")
+		if openErr != nil {
+			logError(ctx, "XLSXの作成に失敗しました: %v", openErr)
+			return
+		}
+		if err := sheet.WriteRow(sessionExportHeader); err != nil {
+			logError(ctx, "XLSXヘッダーの書き込みに失敗しました: %v", err)
+			return
+		}
+		err = streamSessionsForExport(ctx, reports, from, to, func(row sessionExportRow) error {
+			return sheet.WriteRow(row.values(loc))
+		})
+		if closeErr := sheet.Close(); err == nil {
+			err = closeErr
+		}
+	}
+
+	if err != nil {
+		// ヘッダー送信後のため、ログのみ出力します
+		logError(ctx, "在室履歴のエクスポートに失敗しました: %v", err)
+		return
+	}
+	logInfo(ctx, "在室履歴を%s形式でエクスポートしました", format)
+}
+
+func handleUserPresenceHistory(w http.ResponseWriter, r *http.Request, ctx context.Context, presence PresenceStore, accessLog HistoryAccessStore, userID int, loc *time.Location) {
+	from, to, err := parseHistoryRange(r, loc)
+	if err != nil {
+		logError(ctx, "期間パラメータが無効です: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !requireTrackingConsent(w, ctx, presence, userID) {
+		return
+	}
+
+	sessions, err := presence.ListUserSessions(ctx, userID, from, to)
+	if err != nil {
+		logError(ctx, "ユーザープレゼンス履歴の取得に失敗しました: %v", err)
+		http.Error(w, "ユーザープレゼンス履歴の取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	recordHistoryAccess(ctx, accessLog, r, &userID, from, to)
+
+	historyMap := make(map[string][]PresenceSession)
+	for _, session := range sessions {
+		date := session.StartTime.In(loc).Format("2006-01-02")
+		historyMap[date] = append(historyMap[date], session)
+	}
+
+	var userHistory []UserPresenceDay
+	for date, sessions := range historyMap {
+		userHistory = append(userHistory, UserPresenceDay{
+			Date:     date,
+			Sessions: sessions,
+		})
+	}
+
+	sort.Slice(userHistory, func(i, j int) bool {
+		return userHistory[i].Date < userHistory[j].Date
+	})
+
+	response := UserPresenceResponse{
+		UserID:  userID,
+		History: userHistory,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
+		http.Error(w, "JSON応答のエンコードに失敗しました", http.StatusInternalServerError)
+	}
+}
+
+func handleRoomPresenceHistory(w http.ResponseWriter, r *http.Request, ctx context.Context, presence PresenceStore, devices DeviceStore, accessLog HistoryAccessStore, roomID int, loc *time.Location) {
+	from, to, err := parseHistoryRange(r, loc)
+	if err != nil {
+		logError(ctx, "期間パラメータが無効です: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	roomName, err := devices.RoomName(ctx, roomID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "ルームが見つかりません", http.StatusNotFound)
+			return
+		}
+		logError(ctx, "ルームの取得に失敗しました: %v", err)
+		http.Error(w, "ルームの取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	sessions, err := presence.ListRoomSessions(ctx, roomID, from, to)
+	if err == nil {
+		sessions, err = excludeUsersWithoutConsent(ctx, presence, sessions)
+	}
+	if err != nil {
+		logError(ctx, "ルームの在室履歴の取得に失敗しました: %v", err)
+		http.Error(w, "ルームの在室履歴の取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	recordHistoryAccess(ctx, accessLog, r, nil, from, to)
+
+	historyMap := make(map[string][]PresenceSession)
+	for _, session := range sessions {
+		date := session.StartTime.In(loc).Format("2006-01-02")
+		historyMap[date] = append(historyMap[date], session)
+	}
+
+	history := []RoomOccupancyDay{}
+	for date, daySessions := range historyMap {
+		users := make(map[int]bool)
+		for _, session := range daySessions {
+			users[session.UserID] = true
+		}
+		history = append(history, RoomOccupancyDay{
+			Date:        date,
+			UniqueUsers: len(users),
+			Sessions:    daySessions,
+		})
+	}
+
+	sort.Slice(history, func(i, j int) bool {
+		return history[i].Date < history[j].Date
+	})
+
+	response := RoomPresenceHistoryResponse{
+		RoomID:   roomID,
+		RoomName: roomName,
+		History:  history,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
+		http.Error(w, "JSON応答のエンコードに失敗しました", http.StatusInternalServerError)
+	}
+}
+
+// excludeUsersWithoutConsent は在室状況の記録への同意を取り消したユーザーのセッションを除きます
+func excludeUsersWithoutConsent(ctx context.Context, presence PresenceStore, sessions []PresenceSession) ([]PresenceSession, error) {
+	withdrawn, err := presence.UsersWithoutConsent(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("同意を取り消したユーザーの取得に失敗しました: %v", err)
+	}
+	if len(withdrawn) == 0 {
+		return sessions, nil
+	}
+
+	filtered := make([]PresenceSession, 0, len(sessions))
+	for _, session := range sessions {
+		if !withdrawn[session.UserID] {
+			filtered = append(filtered, session)
+		}
+	}
+	return filtered, nil
+}
+
+// requireTrackingConsent はユーザーが在室状況の記録への同意を取り消している場合にエラー応答を返し、falseを返します
+func requireTrackingConsent(w http.ResponseWriter, ctx context.Context, presence PresenceStore, userID int) bool {
+	consent, err := presence.TrackingConsent(ctx, userID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "ユーザーが見つかりません", http.StatusNotFound)
+		return false
+	}
+	if err != nil {
+		logError(ctx, "ユーザーID %d の同意の確認に失敗しました: %v", userID, err)
+		http.Error(w, "同意の確認に失敗しました", http.StatusInternalServerError)
+		return false
+	}
+	if !consent.Consent {
+		logError(ctx, "在室状況の記録への同意を取り消したユーザーID %d の履歴が要求されました", userID)
+		http.Error(w, "ユーザーが在室状況の記録への同意を取り消しているため、履歴を返せません", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// handleTrackingConsent はユーザーの在室状況の記録への同意を返します。PUT の場合は consent パラメータで変更します。
+// 本人または管理者のみ利用できます。同意を取り消した場合は在室中のセッションをその時点で終了します
+func handleTrackingConsent(w http.ResponseWriter, r *http.Request, ctx context.Context, presence PresenceStore, audit AuditStore, userID int, loc *time.Location) {
+	if requesterID, err := presence.UserIDByName(ctx, getUserID(r)); err != nil || requesterID != userID {
+		if !requireAdmin(w, r, ctx, presence) {
+			return
+		}
+	}
+
+	if _, err := presence.TrackingConsent(ctx, userID); err == sql.ErrNoRows {
+		http.Error(w, "ユーザーが見つかりません", http.StatusNotFound)
+		return
+	} else if err != nil {
+		logError(ctx, "ユーザーID %d の同意の取得に失敗しました: %v", userID, err)
+		http.Error(w, "同意の取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	if r.Method == http.MethodPut {
+		consentStr := r.FormValue("consent")
+		consent, err := strconv.ParseBool(consentStr)
+		if err != nil {
+			logError(ctx, "consentパラメータが無効です: %s", consentStr)
+			http.Error(w, "consentパラメータは true または false である必要があります", http.StatusBadRequest)
+			return
+		}
+
+		now := time.Now().In(loc)
+		unlock := presenceLocks.lock(userID)
+		err = presence.SetTrackingConsent(ctx, userID, consent, now)
+		if err == nil && !consent {
+			err = endUserSession(ctx, presence, userID, now)
+		}
+		unlock()
+		if err != nil {
+			logError(ctx, "ユーザーID %d の同意の変更に失敗しました: %v", userID, err)
+			http.Error(w, "同意の変更に失敗しました", http.StatusInternalServerError)
+			return
+		}
+		recordAudit(ctx, audit, r, "users.consent", strconv.Itoa(userID), fmt.Sprintf("consent=%v", consent))
+		logInfo(ctx, "ユーザーID %d の在室状況の記録への同意を %v に変更しました", userID, consent)
+	}
+
+	consent, err := presence.TrackingConsent(ctx, userID)
+	if err != nil {
+		logError(ctx, "ユーザーID %d の同意の取得に失敗しました: %v", userID, err)
+		http.Error(w, "同意の取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(consent); err != nil {
+		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
+	}
+}
+
+// handleUserDataExport はユーザーのすべての在室セッション（CSV・JSON）と保存した送信・収集のファイルをZIPで返します。
+// 本人または管理者のみ利用できます。建物の管理者には管理するルームのセッション・ファイルだけを返します。保持期間を過ぎて削除されたファイルは含めません
+func handleUserDataExport(w http.ResponseWriter, r *http.Request, ctx context.Context, presence PresenceStore, devices DeviceStore, uploads UploadStore, blobs BlobStore, audit AuditStore, scopes BuildingAdminStore, buildings BuildingStore, userID int, loc *time.Location) {
+	var scope *adminScope
+	if requesterID, err := presence.UserIDByName(ctx, getUserID(r)); err != nil || requesterID != userID {
+		var ok bool
+		if scope, ok = requireScopedAdmin(w, r, ctx, presence, scopes, buildings); !ok {
+			return
+		}
+	}
+
+	username, err := presence.UserName(ctx, userID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "ユーザーが見つかりません", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logError(ctx, "ユーザーID %d の取得に失敗しました: %v", userID, err)
+		http.Error(w, "ユーザーの取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	consent, err := presence.TrackingConsent(ctx, userID)
+	if err != nil {
+		logError(ctx, "ユーザーID %d の同意の取得に失敗しました: %v", userID, err)
+		http.Error(w, "同意の取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now().In(loc)
+	sessions, err := presence.ListUserSessions(ctx, userID, time.Unix(0, 0), now.Add(24*time.Hour))
+	if err != nil {
+		logError(ctx, "ユーザーID %d のセッションの取得に失敗しました: %v", userID, err)
+		http.Error(w, "セッションの取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	records, err := uploads.ListUploads(ctx, UploadFilter{UserName: username})
+	if err != nil {
+		logError(ctx, "ユーザー %s の保存ファイルの記録の取得に失敗しました: %v", username, err)
+		http.Error(w, "保存ファイルの記録の取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	if scope != nil {
+		sessions = scope.filterSessions(sessions)
+		filtered := make([]UploadRecord, 0, len(records))
+		for _, record := range records {
+			if scope.allowsRoom(record.RoomID) {
+				filtered = append(filtered, record)
+			}
+		}
+		records = filtered
+	}
+	if sessions == nil {
+		sessions = []PresenceSession{}
+	}
+	if records == nil {
+		records = []UploadRecord{}
+	}
+
+	roomNames := make(map[int]string)
+	rows := [][]string{sessionExportHeader}
+	for _, session := range sessions {
+		name, ok := roomNames[session.RoomID]
+		if !ok {
+			if name, err = devices.RoomName(ctx, session.RoomID); err != nil {
+				name = ""
+			}
+			roomNames[session.RoomID] = name
+		}
+		row := sessionExportRow{
+			SessionID: session.SessionID,
+			UserID:    session.UserID,
+			UserName:  username,
+			RoomID:    session.RoomID,
+			RoomName:  name,
+			StartTime: session.StartTime,
+			LastSeen:  session.LastSeen,
+		}
+		if session.EndTime != nil {
+			row.EndTime = sql.NullTime{Time: *session.EndTime, Valid: true}
+		}
+		rows = append(rows, row.csvValues(loc))
+	}
+
+	recordAudit(ctx, audit, r, "users.export", strconv.Itoa(userID), fmt.Sprintf("sessions=%d uploads=%d", len(sessions), len(records)))
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"user_%d_export_%s.zip\"", userID, now.Format("20060102")))
+	zw := zip.NewWriter(w)
+	err = writeJSONToZip(zw, "user.json", UserDataExport{
+		UserID:     userID,
+		UserName:   username,
+		Consent:    consent,
+		ExportedAt: now,
+		Sessions:   len(sessions),
+		Uploads:    len(records),
+	})
+	if err == nil {
+		err = writeJSONToZip(zw, "sessions.json", sessions)
+	}
+	if err == nil {
+		var fw io.Writer
+		if fw, err = zw.Create("sessions.csv"); err == nil {
+			err = csv.NewWriter(fw).WriteAll(rows)
+		}
+	}
+	if err == nil {
+		err = writeJSONToZip(zw, "uploads.json", records)
+	}
+	if err != nil {
+		// ヘッダー送信後のため、ログのみ出力します
+		logError(ctx, "ユーザーID %d のデータのエクスポートに失敗しました: %v", userID, err)
+		return
+	}
+	for _, record := range records {
+		for _, key := range []string{record.WifiKey, record.BleKey} {
+			if key == "" {
+				continue
+			}
+			name := fmt.Sprintf("uploads/%d_%s", record.UploadID, path.Base(key))
+			if err := writeBlobToZip(ctx, zw, blobs, key, name); err != nil {
+				logError(ctx, "保存ファイル %s を出力できませんでした（アップロードID: %d）: %v", key, record.UploadID, err)
+			}
+		}
+	}
+	if err := zw.Close(); err != nil {
+		logError(ctx, "ZIPの書き込みに失敗しました: %v", err)
+		return
+	}
+	logInfo(ctx, "ユーザーID %d のデータをエクスポートしました（セッション %d 件、保存ファイル %d 件）", userID, len(sessions), len(records))
+}
+
+// writeJSONToZip は v をインデント付きのJSONとしてZIPの name に書き込みます
+func writeJSONToZip(zw *zip.Writer, name string, v interface{}) error {
+	fw, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(fw)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// handleTrackingPause はユーザーの在室状況の記録の一時停止を返します。PUT の場合は duration パラメータの期間だけ記録を一時停止し、
+// DELETE の場合は再開します。本人または管理者のみ利用できます。一時停止した場合は在室中のセッションをその時点で終了し、
+// 一時停止中の送信は推定したルームを返すだけで記録しないため、現在の在室者にも含まれません
+func handleTrackingPause(w http.ResponseWriter, r *http.Request, ctx context.Context, presence PresenceStore, audit AuditStore, userID int, loc *time.Location) {
+	if requesterID, err := presence.UserIDByName(ctx, getUserID(r)); err != nil || requesterID != userID {
+		if !requireAdmin(w, r, ctx, presence) {
+			return
+		}
+	}
+
+	if _, err := presence.TrackingConsent(ctx, userID); err == sql.ErrNoRows {
+		http.Error(w, "ユーザーが見つかりません", http.StatusNotFound)
+		return
+	} else if err != nil {
+		logError(ctx, "ユーザーID %d の同意の取得に失敗しました: %v", userID, err)
+		http.Error(w, "同意の取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		durationStr := r.FormValue("duration")
+		duration, err := time.ParseDuration(durationStr)
+		if err != nil || duration <= 0 || duration > maxTrackingPause {
+			logError(ctx, "durationパラメータが無効です: %s", durationStr)
+			http.Error(w, fmt.Sprintf("durationパラメータは %s 以下の正の期間（例: 8h）である必要があります", maxTrackingPause), http.StatusBadRequest)
+			return
+		}
+
+		now := time.Now().In(loc)
+		until := now.Add(duration)
+		unlock := presenceLocks.lock(userID)
+		err = presence.SetTrackingPause(ctx, userID, &until)
+		if err == nil {
+			err = endUserSession(ctx, presence, userID, now)
+		}
+		unlock()
+		if err != nil {
+			logError(ctx, "ユーザーID %d の記録の一時停止に失敗しました: %v", userID, err)
+			http.Error(w, "記録の一時停止に失敗しました", http.StatusInternalServerError)
+			return
+		}
+		recordAudit(ctx, audit, r, "users.pause", strconv.Itoa(userID), "until="+until.Format(time.RFC3339))
+		logInfo(ctx, "ユーザーID %d の在室状況の記録を %s まで一時停止しました", userID, until.Format(time.RFC3339))
+	case http.MethodDelete:
+		if err := presence.SetTrackingPause(ctx, userID, nil); err != nil {
+			logError(ctx, "ユーザーID %d の記録の再開に失敗しました: %v", userID, err)
+			http.Error(w, "記録の再開に失敗しました", http.StatusInternalServerError)
+			return
+		}
+		recordAudit(ctx, audit, r, "users.pause", strconv.Itoa(userID), "resumed")
+		logInfo(ctx, "ユーザーID %d の在室状況の記録を再開しました", userID)
+	}
+
+	consent, err := presence.TrackingConsent(ctx, userID)
+	if err != nil {
+		logError(ctx, "ユーザーID %d の同意の取得に失敗しました: %v", userID, err)
+		http.Error(w, "同意の取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	if !trackingPaused(consent, time.Now(), loc) {
+		consent.PausedUntil = nil
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(consent); err != nil {
+		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
+	}
+}
+
+func handleUserTransitions(w http.ResponseWriter, r *http.Request, ctx context.Context, presence PresenceStore, accessLog HistoryAccessStore, userID int, loc *time.Location) {
+	from, to, err := parseHistoryRange(r, loc)
+	if err != nil {
+		logError(ctx, "期間パラメータが無効です: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !requireTrackingConsent(w, ctx, presence, userID) {
+		return
+	}
+
+	transitions, err := presence.ListUserTransitions(ctx, userID, from, to)
+	if err != nil {
+		logError(ctx, "ルーム移動履歴の取得に失敗しました: %v", err)
+		http.Error(w, "ルーム移動履歴の取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	recordHistoryAccess(ctx, accessLog, r, &userID, from, to)
+
+	response := UserTransitionsResponse{
+		UserID:      userID,
+		Transitions: transitions,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
+		http.Error(w, "JSON応答のエンコードに失敗しました", http.StatusInternalServerError)
+	}
+}
+
+// statsPeriods は統計APIで指定できる集計単位とdate_truncの単位の対応です
+var statsPeriods = map[string]string{
+	"daily":  "day",
+	"weekly": "week",
+}
+
+// statsPrivacy は統計の秘匿モード（[PrivateStats]）の処理です。nil の場合は値をそのまま返します
+type statsPrivacy struct {
+	minUsers int
+	epsilon  float64
+	key      []byte
+	scope    string
+}
+
+// requestStatsPrivacy はリクエストに適用する秘匿モードを返します。[PrivateStats] enabled が true の場合は private=false でも解除できません
+func requestStatsPrivacy(r *http.Request, config PrivateStatsConfig) (*statsPrivacy, error) {
+	enabled := config.Enabled
+	if privateStr := r.URL.Query().Get("private"); privateStr != "" {
+		parsed, err := strconv.ParseBool(privateStr)
+		if err != nil {
+			return nil, errors.New("privateパラメータは true または false である必要があります。")
+		}
+		enabled = enabled || parsed
+	}
+	if !enabled {
+		return nil, nil
+	}
+	return &statsPrivacy{minUsers: config.MinUsers, epsilon: config.Epsilon, key: []byte(config.NoiseKey)}, nil
+}
+
+// window はノイズを決める集計の名前と期間を設定します。to を省略した問い合わせは期間の終わりが毎回変わるため、
+// 期間は時単位に丸め、1時間のあいだは同じ問い合わせに同じノイズを加えます
+func (p *statsPrivacy) window(name string, from time.Time, to time.Time) {
+	if p == nil {
+		return
+	}
+	p.scope = fmt.Sprintf("%s:%d:%d", name, from.Unix()/3600, to.Unix()/3600)
+}
+
+func (p *statsPrivacy) info() *StatsPrivacyInfo {
+	if p == nil {
+		return nil
+	}
+	return &StatsPrivacyInfo{MinUsers: p.minUsers, Epsilon: p.epsilon}
+}
+
+// suppressed は users 人のユーザーから求めた値を返してはならない場合に true を返します
+func (p *statsPrivacy) suppressed(users int) bool {
+	return p != nil && users < p.minUsers
+}
+
+// noise は value に尺度 sensitivity/epsilon のラプラスノイズを加えます。在室人数や時間は負にならないため0で切り捨てます。
+// ノイズは鍵・window で設定した集計と期間・cell の HMAC から決めるため、同じセルを何度問い合わせても同じ値を返します
+func (p *statsPrivacy) noise(value float64, sensitivity float64, cell string) float64 {
+	if p == nil {
+		return value
+	}
+	mac := hmac.New(sha256.New, p.key)
+	mac.Write([]byte(p.scope))
+	mac.Write([]byte{0})
+	mac.Write([]byte(cell))
+	// HMAC の上位53ビットから (-0.5, 0.5) の一様乱数を作ります
+	u := (float64(binary.BigEndian.Uint64(mac.Sum(nil))>>11)+0.5)/(1<<53) - 0.5
+	scale := sensitivity / p.epsilon
+	return math.Max(0, value-scale*math.Copysign(1, u)*math.Log(1-2*math.Abs(u)))
+}
+
+// noiseCount は1人が最大1だけ変えられる件数・人数にノイズを加えます
+func (p *statsPrivacy) noiseCount(value int, cell string) int {
+	return int(math.Round(p.noise(float64(value), 1, cell)))
+}
+
+// noisePerUser は時間などの合計・平均にノイズを加えます。1人がどれだけ変えられるかに上限がないため、
+// users 人あたりの値を感度とみなします。感度を集計した値から求めるため、これらの値には差分プライバシーの保証はありません。
+// 人数・件数（noiseCount）とは異なり、個人の寄与を埋もれさせるための目安として扱ってください
+func (p *statsPrivacy) noisePerUser(value float64, users int, cell string) float64 {
+	if users <= 0 {
+		return p.noise(value, value, cell)
+	}
+	return p.noise(value, value/float64(users), cell)
+}
+
+// fetchUserPresenceStats はユーザー別の在室統計を返します。記録への同意を取り消したユーザーは含めません
+func fetchUserPresenceStats(ctx context.Context, reports ReportStore, truncUnit string, from time.Time, to time.Time) ([]UserPresenceStat, error) {
+	rows, err := reports.QueryReport(ctx, queryUserPresenceStats, truncUnit, from, to, orgFromContext(ctx))
+	if err != nil {
+		logError(ctx, "ユーザー統計のクエリに失敗しました: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := []UserPresenceStat{}
+	for rows.Next() {
+		var stat UserPresenceStat
+		if err := rows.Scan(&stat.PeriodStart, &stat.UserID, &stat.SessionCount, &stat.TotalHours, &stat.AverageSessionMinutes); err != nil {
+			continue
+		}
+		stats = append(stats, stat)
+	}
+
+	if err := rows.Err(); err != nil {
+		logError(ctx, "ユーザー統計の読み取り中にエラーが発生しました: %v", err)
+		return nil, err
+	}
+	return stats, nil
+}
+
+func fetchRoomPresenceStats(ctx context.Context, reports ReportStore, truncUnit string, from time.Time, to time.Time) ([]RoomPresenceStat, error) {
+	rows, err := reports.QueryReport(ctx, queryRoomPresenceStats, truncUnit, from, to, orgFromContext(ctx))
+	if err != nil {
+		logError(ctx, "ルーム統計のクエリに失敗しました: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := []RoomPresenceStat{}
+	for rows.Next() {
+		var stat RoomPresenceStat
+		if err := rows.Scan(&stat.PeriodStart, &stat.RoomID, &stat.OccupancyHours, &stat.UniqueVisitors, &stat.AverageSessionMinutes); err != nil {
+			continue
+		}
+		stats = append(stats, stat)
+	}
+
+	if err := rows.Err(); err != nil {
+		logError(ctx, "ルーム統計の読み取り中にエラーが発生しました: %v", err)
+		return nil, err
+	}
+	return stats, nil
+}
+
+// handlePresenceStats はユーザー別・ルーム別の在室統計を返します。秘匿モードではユーザー別の統計を返さず、
+// unique_visitors が min_users 未満のルームを除いた上で各値にノイズを加えます
+func handlePresenceStats(w http.ResponseWriter, r *http.Request, ctx context.Context, reports ReportStore, loc *time.Location, privateConfig PrivateStatsConfig) {
+	if !requirePostgres(w, ctx, reports) {
+		return
+	}
+
+	privacy, err := requestStatsPrivacy(r, privateConfig)
+	if err != nil {
+		logError(ctx, "privateパラメータが無効です: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	period := r.URL.Query().Get("period")
+	if period == "" {
+		period = "daily"
+	}
+	truncUnit, ok := statsPeriods[period]
+	if !ok {
+		logError(ctx, "periodパラメータが無効です: %s", period)
+		http.Error(w, "periodパラメータはdailyまたはweeklyである必要があります。", http.StatusBadRequest)
+		return
+	}
+
+	from, to, err := parseHistoryRange(r, loc)
+	if err != nil {
+		logError(ctx, "期間パラメータが無効です: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	privacy.window("presence:"+period, from, to)
+
+	userStats := []UserPresenceStat{}
+	if privacy == nil {
+		userStats, err = fetchUserPresenceStats(ctx, reports, truncUnit, from, to)
+		if err != nil {
+			http.Error(w, "ユーザー統計の取得に失敗しました", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	roomStats, err := fetchRoomPresenceStats(ctx, reports, truncUnit, from, to)
+	if err != nil {
+		http.Error(w, "ルーム統計の取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	if privacy != nil {
+		released := []RoomPresenceStat{}
+		for _, stat := range roomStats {
+			if privacy.suppressed(stat.UniqueVisitors) {
+				continue
+			}
+			cell := fmt.Sprintf("%s:%d", stat.PeriodStart, stat.RoomID)
+			stat.OccupancyHours = privacy.noisePerUser(stat.OccupancyHours, stat.UniqueVisitors, cell+":hours")
+			stat.AverageSessionMinutes = privacy.noisePerUser(stat.AverageSessionMinutes, stat.UniqueVisitors, cell+":minutes")
+			stat.UniqueVisitors = privacy.noiseCount(stat.UniqueVisitors, cell+":visitors")
+			released = append(released, stat)
+		}
+		roomStats = released
+	}
+
+	response := PresenceStatsResponse{
+		Period:  period,
+		From:    from.Format(time.RFC3339),
+		To:      to.Format(time.RFC3339),
+		Privacy: privacy.info(),
+		Users:   userStats,
+		Rooms:   roomStats,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
+		http.Error(w, "JSON応答のエンコードに失敗しました", http.StatusInternalServerError)
+	}
+}
+
+// fetchHourlyHeatmap は期間内の各時間帯について、ルームごとの平均在室人数と在室したユーザー数を時刻(0-23)別に集計します
+func fetchHourlyHeatmap(ctx context.Context, reports ReportStore, from time.Time, to time.Time) ([]RoomHeatmapRow, error) {
+	rows, err := reports.QueryReport(ctx, queryHourlyHeatmap, from, to, orgFromContext(ctx))
+	if err != nil {
+		logError(ctx, "ヒートマップのクエリに失敗しました: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	heatmap := []RoomHeatmapRow{}
+	indexByRoom := make(map[int]int)
+	for rows.Next() {
+		var roomID, hour, visitors int
+		var roomName string
+		var average float64
+		if err := rows.Scan(&roomID, &roomName, &hour, &average, &visitors); err != nil {
+			continue
+		}
+		idx, exists := indexByRoom[roomID]
+		if !exists {
+			heatmap = append(heatmap, RoomHeatmapRow{
+				RoomID:   roomID,
+				RoomName: roomName,
+				Values:   make([]float64, 24),
+				visitors: make([]int, 24),
+			})
+			idx = len(heatmap) - 1
+			indexByRoom[roomID] = idx
+		}
+		if hour >= 0 && hour < 24 {
+			heatmap[idx].Values[hour] = average
+			heatmap[idx].visitors[hour] = visitors
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		logError(ctx, "ヒートマップの読み取り中にエラーが発生しました: %v", err)
+		return nil, err
+	}
+	return heatmap, nil
+}
+
+// startOfHour は t を loc での正時に切り捨てます。time.Truncate は UTC を基準に切り捨てるため、
+// UTC との時差が1時間単位でないタイムゾーンでは時間帯の区切りがずれます
+func startOfHour(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc)
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, loc)
+}
+
+func handleHeatmap(w http.ResponseWriter, r *http.Request, ctx context.Context, reports ReportStore, loc *time.Location, privateConfig PrivateStatsConfig) {
+	if !requirePostgres(w, ctx, reports) {
+		return
+	}
+
+	privacy, err := requestStatsPrivacy(r, privateConfig)
+	if err != nil {
+		logError(ctx, "privateパラメータが無効です: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	granularity := r.URL.Query().Get("granularity")
+	if granularity == "" {
+		granularity = "hour"
+	}
+	if granularity != "hour" {
+		logError(ctx, "granularityパラメータが無効です: %s", granularity)
+		http.Error(w, "granularityパラメータはhourである必要があります。", http.StatusBadRequest)
+		return
+	}
+
+	from, to, err := parseHistoryRange(r, loc)
+	if err != nil {
+		logError(ctx, "期間パラメータが無効です: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	from = startOfHour(from, loc)
+	to = startOfHour(to, loc)
+	if !from.Before(to) {
+		http.Error(w, "期間は1時間以上である必要があります。", http.StatusBadRequest)
+		return
+	}
+	privacy.window("heatmap", from, to)
+
+	heatmap, err := fetchHourlyHeatmap(ctx, reports, from, to)
+	if err != nil {
+		http.Error(w, "ヒートマップの取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	if privacy != nil {
+		// 1人が変えられる各時間帯の在室人数は最大1のため、その平均の感度も1です
+		for i := range heatmap {
+			for hour, value := range heatmap[i].Values {
+				if privacy.suppressed(heatmap[i].visitors[hour]) {
+					heatmap[i].Values[hour] = 0
+					heatmap[i].Suppressed = append(heatmap[i].Suppressed, hour)
+					continue
+				}
+				heatmap[i].Values[hour] = privacy.noise(value, 1, fmt.Sprintf("%d:%d", heatmap[i].RoomID, hour))
+			}
+		}
+	}
+
+	buckets := make([]int, 24)
+	for i := range buckets {
+		buckets[i] = i
+	}
+
+	response := HeatmapResponse{
+		Granularity: granularity,
+		From:        from.Format(time.RFC3339),
+		To:          to.Format(time.RFC3339),
+		Privacy:     privacy.info(),
+		Buckets:     buckets,
+		Rooms:       heatmap,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
+		http.Error(w, "JSON応答のエンコードに失敗しました", http.StatusInternalServerError)
+	}
+}
+
+// buildAttendanceReport は指定した月 (monthStart から1か月) のユーザー別出席サマリーを作成します
+func buildAttendanceReport(ctx context.Context, reports ReportStore, monthStart time.Time, loc *time.Location) (AttendanceReport, error) {
+	report := AttendanceReport{
+		Month:       monthStart.Format("2006-01"),
+		GeneratedAt: time.Now().In(loc),
+		Users:       []UserAttendance{},
+	}
+
+	rows, err := reports.QueryReport(ctx, queryAttendanceDays, monthStart, monthStart.AddDate(0, 1, 0), orgFromContext(ctx))
+	if err != nil {
+		logError(ctx, "出席レポートのクエリに失敗しました: %v", err)
+		return report, err
+	}
+	defer rows.Close()
+
+	indexByUser := make(map[int]int)
+	for rows.Next() {
+		var userID int
+		var userName string
+		var day AttendanceDay
+		if err := rows.Scan(&userID, &userName, &day.Date, &day.FirstIn, &day.LastOut, &day.TotalHours); err != nil {
+			continue
+		}
+		idx, exists := indexByUser[userID]
+		if !exists {
+			report.Users = append(report.Users, UserAttendance{UserID: userID, UserName: userName, Days: []AttendanceDay{}})
+			idx = len(report.Users) - 1
+			indexByUser[userID] = idx
+		}
+		user := &report.Users[idx]
+		user.Days = append(user.Days, day)
+		user.DaysPresent++
+		user.TotalHours += day.TotalHours
+	}
+
+	if err := rows.Err(); err != nil {
+		logError(ctx, "出席レポートの読み取り中にエラーが発生しました: %v", err)
+		return report, err
+	}
+	return report, nil
+}
+
+// renderAttendancePDF は出席レポートをPDFとして出力します。日本語のユーザー名を表示するため、
+// PDFビューアに標準で用意されている HeiseiKakuGo-W5 フォントを埋め込みなしで参照します。
+func renderAttendancePDF(report AttendanceReport) []byte {
+	lines := []string{
+		fmt.Sprintf("出席レポート %s", report.Month),
+		fmt.Sprintf("作成日時: %s", report.GeneratedAt.Format("2006-01-02 15:04")),
+		"",
+	}
+	for _, user := range report.Users {
+		lines = append(lines, fmt.Sprintf("%s (ID: %d)  出席日数: %d日  合計: %.1f時間", user.UserName, user.UserID, user.DaysPresent, user.TotalHours))
+		for _, day := range user.Days {
+			lines = append(lines, fmt.Sprintf("    %s  入室 %s  退室 %s  %.1f時間", day.Date, day.FirstIn.Format("15:04"), day.LastOut.Format("15:04"), day.TotalHours))
+		}
+		lines = append(lines, "")
+	}
+	if len(report.Users) == 0 {
+		lines = append(lines, "この月の在室記録はありません")
+	}
+
+	return buildTextPDF(lines)
+}
+
+// buildTextPDF はテキスト行のみからなるA4のPDFを作成します。
+// 日本語はフォントを埋め込まず、Adobe の標準日本語フォント（HeiseiKakuGo-W5, Adobe-Japan1）を名前で参照します。
+// 表示には日本語フォントを代替できるビューアー（Adobe Acrobat Reader と日本語フォントパック、ブラウザ内蔵のビューアー、macOS のプレビューなど）が必要で、
+// 日本語フォントのないビューアーや印刷環境では文字化けします
+func buildTextPDF(lines []string) []byte {
+	const linesPerPage = 52
+
+	var pages [][]string
+	for start := 0; start < len(lines); start += linesPerPage {
+		end := start + linesPerPage
+		if end > len(lines) {
+			end = len(lines)
+		}
+		pages = append(pages, lines[start:end])
+	}
+	if len(pages) == 0 {
+		pages = append(pages, []string{})
+	}
+
+	// オブジェクト番号: 1=Catalog, 2=Pages, 3=Type0フォント, 4=CIDフォント, 5=FontDescriptor, 6以降=ページとコンテンツ
+	var objects []string
+	pageRefs := make([]string, len(pages))
+	for i := range pages {
+		pageRefs[i] = fmt.Sprintf("%d 0 R", 6+i*2)
+	}
+	objects = append(objects,
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(pageRefs, " "), len(pages)),
+		"<< /Type /Font /Subtype /Type0 /BaseFont /HeiseiKakuGo-W5 /Encoding /UniJIS-UCS2-H /DescendantFonts [4 0 R] >>",
+		"<< /Type /Font /Subtype /CIDFontType0 /BaseFont /HeiseiKakuGo-W5 /CIDSystemInfo << /Registry (Adobe) /Ordering (Japan1) /Supplement 2 >> /FontDescriptor 5 0 R >>",
+		"<< /Type /FontDescriptor /FontName /HeiseiKakuGo-W5 /Flags 4 /FontBBox [-92 -250 1010 922] /ItalicAngle 0 /Ascent 880 /Descent -120 /CapHeight 880 /StemV 93 >>",
+	)
+
+	for i, pageLines := range pages {
+		var content strings.Builder
+		content.WriteString("BT /F1 10 Tf 14 TL 40 800 Td\n")
+		for _, line := range pageLines {
+			content.WriteString("<")
+			for _, r := range line {
+				if r > 0xFFFF {
+					r = '?'
+				}
+				fmt.Fprintf(&content, "%04X", r)
+			}
+			content.WriteString("> Tj T*\n")
+		}
+		content.WriteString("ET")
+
+		objects = append(objects,
+			fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 595 842] /Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>", 7+i*2),
+			fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", content.Len(), content.String()),
+		)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, obj := range objects {
+		offsets[i] = buf.Len()
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+	xrefOffset := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xrefOffset)
+	return buf.Bytes()
+}
+
+func parseReportMonth(value string, loc *time.Location) (time.Time, error) {
+	if value == "" {
+		now := time.Now().In(loc)
+		return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, loc), nil
+	}
+	month, err := time.Parse("2006-01", value)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Date(month.Year(), month.Month(), 1, 0, 0, 0, 0, loc), nil
+}
+
+func handleAttendanceReport(w http.ResponseWriter, r *http.Request, ctx context.Context, reports ReportStore, loc *time.Location) {
+	if !requirePostgres(w, ctx, reports) {
+		return
+	}
+
+	monthStart, err := parseReportMonth(r.URL.Query().Get("month"), loc)
+	if err != nil {
+		logError(ctx, "monthパラメータが無効です: %v", err)
+		http.Error(w, "monthパラメータが無効です。形式はYYYY-MMである必要があります。", http.StatusBadRequest)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "pdf" {
+		http.Error(w, "formatパラメータはjsonまたはpdfである必要があります。", http.StatusBadRequest)
+		return
+	}
+
+	report, err := buildAttendanceReport(ctx, reports, monthStart, loc)
+	if err != nil {
+		http.Error(w, "出席レポートの作成に失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	if format == "pdf" {
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fmt.Sprintf("attendance_%s.pdf", report.Month)))
+		if _, err := w.Write(renderAttendancePDF(report)); err != nil {
+			logError(ctx, "PDF応答の書き込みに失敗しました: %v", err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
+		http.Error(w, "JSON応答のエンコードに失敗しました", http.StatusInternalServerError)
+	}
+}
+
+// generateMonthlyReports は組織ごとに前月の出席レポートが未作成であればJSONとPDFで保存します。1時間ごとに確認します
+func generateMonthlyReports(ctx context.Context, reports ReportStore, orgs OrgStore, config ReportsConfig, loc *time.Location) {
+	ticker := time.NewTicker(1 * time.Hour)
+	defer ticker.Stop()
+
+	for {
+		now := time.Now().In(loc)
+		previousMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, loc).AddDate(0, -1, 0)
+
+		organizations, err := orgs.Organizations(ctx)
+		if err != nil {
+			logError(ctx, "組織の一覧の取得に失敗しました: %v", err)
+		}
+		for _, org := range organizations {
+			orgCtx := withOrg(ctx, org.OrgID)
+			base := filepath.Join(orgReportDir(config.Dir, org.OrgID), fmt.Sprintf("attendance_%s", previousMonth.Format("2006-01")))
+			if _, err := os.Stat(base + ".json"); !os.IsNotExist(err) {
+				continue
+			}
+
+			report, err := buildAttendanceReport(orgCtx, reports, previousMonth, loc)
+			if err != nil {
+				logError(orgCtx, "定期出席レポートの作成に失敗しました: %v", err)
+			} else if err := saveAttendanceReport(report, base); err != nil {
+				logError(orgCtx, "定期出席レポートの保存に失敗しました: %v", err)
+			} else {
+				logInfo(orgCtx, "%s の出席レポートを保存しました: %s", report.Month, base)
+			}
+		}
+
+		<-ticker.C
+	}
+}
+
+// orgReportDir は組織の出席レポートの保存先です。既定の組織は dir に、それ以外の組織は dir/org_{組織ID} に保存します
+func orgReportDir(dir string, orgID int) string {
+	if orgID == defaultOrgID {
+		return dir
+	}
+	return filepath.Join(dir, fmt.Sprintf("org_%d", orgID))
+}
+
+func saveAttendanceReport(report AttendanceReport, base string) error {
+	if err := os.MkdirAll(filepath.Dir(base), os.ModePerm); err != nil {
+		return err
+	}
+	if err := os.WriteFile(base+".pdf", renderAttendancePDF(report), 0644); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	// JSONの存在で作成済みを判定するため、PDFの後に書き込みます
+	return os.WriteFile(base+".json", data, 0644)
+}
+
+func fetchRoomDwellStats(ctx context.Context, reports ReportStore, from time.Time, to time.Time) ([]RoomDwellStat, error) {
+	rows, err := reports.QueryReport(ctx, queryRoomDwellStats, from, to, orgFromContext(ctx))
+	if err != nil {
+		logError(ctx, "滞在時間統計のクエリに失敗しました: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := []RoomDwellStat{}
+	for rows.Next() {
+		var stat RoomDwellStat
+		if err := rows.Scan(&stat.RoomID, &stat.RoomName, &stat.SessionCount, &stat.visitors, &stat.MeanMinutes, &stat.MedianMinutes,
+			&stat.P25Minutes, &stat.P75Minutes, &stat.P90Minutes, &stat.P95Minutes); err != nil {
+			continue
+		}
+		stats = append(stats, stat)
+	}
+
+	if err := rows.Err(); err != nil {
+		logError(ctx, "滞在時間統計の読み取り中にエラーが発生しました: %v", err)
+		return nil, err
+	}
+	return stats, nil
+}
+
+// handleDwellStats はルームごとの滞在時間の分布を返します。秘匿モードでは滞在したユーザーが min_users 人未満のルームを除きます
+func handleDwellStats(w http.ResponseWriter, r *http.Request, ctx context.Context, reports ReportStore, loc *time.Location, privateConfig PrivateStatsConfig) {
+	if !requirePostgres(w, ctx, reports) {
+		return
+	}
+
+	privacy, err := requestStatsPrivacy(r, privateConfig)
+	if err != nil {
+		logError(ctx, "privateパラメータが無効です: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	from, to, err := parseHistoryRange(r, loc)
+	if err != nil {
+		logError(ctx, "期間パラメータが無効です: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	privacy.window("dwell", from, to)
+
+	stats, err := fetchRoomDwellStats(ctx, reports, from, to)
+	if err != nil {
+		http.Error(w, "滞在時間統計の取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	if privacy != nil {
+		released := []RoomDwellStat{}
+		for _, stat := range stats {
+			if privacy.suppressed(stat.visitors) {
+				continue
+			}
+			for i, minutes := range []*float64{&stat.MeanMinutes, &stat.MedianMinutes, &stat.P25Minutes, &stat.P75Minutes, &stat.P90Minutes, &stat.P95Minutes} {
+				*minutes = privacy.noisePerUser(*minutes, stat.visitors, fmt.Sprintf("%d:minutes:%d", stat.RoomID, i))
+			}
+			stat.SessionCount = int(math.Round(privacy.noisePerUser(float64(stat.SessionCount), stat.visitors, fmt.Sprintf("%d:sessions", stat.RoomID))))
+			released = append(released, stat)
+		}
+		stats = released
+	}
+
+	response := DwellStatsResponse{
+		From:    from.Format(time.RFC3339),
+		To:      to.Format(time.RFC3339),
+		Privacy: privacy.info(),
+		Rooms:   stats,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
+		http.Error(w, "JSON応答のエンコードに失敗しました", http.StatusInternalServerError)
+	}
+}
+
+// fitSeasonalModel は [from, to) の履歴から曜日×時刻ごとの平均在室人数を算出します
+func fitSeasonalModel(ctx context.Context, reports ReportStore, from time.Time, to time.Time) ([]seasonalModel, error) {
+	rows, err := reports.QueryReport(ctx, querySeasonalModel, from, to, orgFromContext(ctx))
+	if err != nil {
+		logError(ctx, "予測モデル用のクエリに失敗しました: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	models := []seasonalModel{}
+	indexByRoom := make(map[int]int)
+	for rows.Next() {
+		var roomID, dow, hour, visitors int
+		var roomName string
+		var average float64
+		if err := rows.Scan(&roomID, &roomName, &dow, &hour, &average, &visitors); err != nil {
+			continue
+		}
+		idx, exists := indexByRoom[roomID]
+		if !exists {
+			models = append(models, seasonalModel{RoomID: roomID, RoomName: roomName})
+			idx = len(models) - 1
+			indexByRoom[roomID] = idx
+		}
+		if dow >= 0 && dow < 7 && hour >= 0 && hour < 24 {
+			models[idx].Averages[dow][hour] = average
+			models[idx].Visitors[dow][hour] = visitors
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		logError(ctx, "予測モデル用データの読み取り中にエラーが発生しました: %v", err)
+		return nil, err
+	}
+	return models, nil
+}
+
+func handleForecast(w http.ResponseWriter, r *http.Request, ctx context.Context, reports ReportStore, loc *time.Location, privateConfig PrivateStatsConfig) {
+	if !requirePostgres(w, ctx, reports) {
+		return
+	}
+
+	privacy, err := requestStatsPrivacy(r, privateConfig)
+	if err != nil {
+		logError(ctx, "privateパラメータが無効です: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	hours := 24
+	if hoursStr := r.URL.Query().Get("hours"); hoursStr != "" {
+		parsed, err := strconv.Atoi(hoursStr)
+		if err != nil || parsed < 24 || parsed > 168 {
+			http.Error(w, "hoursパラメータは24から168の整数である必要があります。", http.StatusBadRequest)
+			return
+		}
+		hours = parsed
+	}
+
+	historyWeeks := 8
+	if weeksStr := r.URL.Query().Get("weeks"); weeksStr != "" {
+		parsed, err := strconv.Atoi(weeksStr)
+		if err != nil || parsed < 1 || parsed > 13 {
+			http.Error(w, "weeksパラメータは1から13の整数である必要があります。", http.StatusBadRequest)
+			return
+		}
+		historyWeeks = parsed
+	}
+
+	now := time.Now().In(loc)
+	to := startOfHour(now, loc)
+	from := to.AddDate(0, 0, -7*historyWeeks)
+	privacy.window("forecast", from, to)
+
+	models, err := fitSeasonalModel(ctx, reports, from, to)
+	if err != nil {
+		http.Error(w, "予測モデルの作成に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	if privacy != nil {
+		// 同じ曜日・時刻の予測値が揃うよう、ノイズは予測点ではなくモデルに加えます
+		for i := range models {
+			for dow := range models[i].Averages {
+				for hour, value := range models[i].Averages[dow] {
+					if privacy.suppressed(models[i].Visitors[dow][hour]) {
+						models[i].Averages[dow][hour] = 0
+						continue
+					}
+					models[i].Averages[dow][hour] = privacy.noise(value, 1, fmt.Sprintf("%d:%d:%d", models[i].RoomID, dow, hour))
+				}
+			}
+		}
+	}
+
+	response := ForecastResponse{
+		GeneratedAt:  now,
+		HistoryWeeks: historyWeeks,
+		Hours:        hours,
+		Privacy:      privacy.info(),
+		Rooms:        []RoomForecast{},
+	}
+	for _, model := range models {
+		forecast := RoomForecast{
+			RoomID:   model.RoomID,
+			RoomName: model.RoomName,
+			Forecast: make([]ForecastPoint, 0, hours),
+		}
+		for i := 1; i <= hours; i++ {
+			slot := to.Add(time.Duration(i) * time.Hour)
+			forecast.Forecast = append(forecast.Forecast, ForecastPoint{
+				Time:              slot,
+				ExpectedOccupants: model.Averages[slot.Weekday()][slot.Hour()],
+				Suppressed:        privacy.suppressed(model.Visitors[slot.Weekday()][slot.Hour()]),
+			})
+		}
+		response.Rooms = append(response.Rooms, forecast)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
+		http.Error(w, "JSON応答のエンコードに失敗しました", http.StatusInternalServerError)
+	}
+}
+
+// handleOrganization はリクエストを送ったユーザーの所属する組織を返します
+func handleOrganization(w http.ResponseWriter, r *http.Request, ctx context.Context, orgs OrgStore) {
+	org, err := orgs.Organization(ctx, recordOrg(ctx))
+	if err != nil {
+		logError(ctx, "組織の取得に失敗しました: %v", err)
+		http.Error(w, "組織の取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(org); err != nil {
+		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
+		http.Error(w, "JSON応答のエンコードに失敗しました", http.StatusInternalServerError)
+	}
+}
+
+// handleAdminAPIKeys はリクエストを送った管理者の組織に発行したAPIキーの一覧を返します
+func handleAdminAPIKeys(w http.ResponseWriter, r *http.Request, ctx context.Context, presence PresenceStore, keys APIKeyStore) {
+	if !requireAdmin(w, r, ctx, presence) {
+		return
+	}
+
+	apiKeys, err := keys.APIKeys(ctx)
+	if err != nil {
+		logError(ctx, "APIキーの一覧取得に失敗しました: %v", err)
+		http.Error(w, "APIキーの一覧取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(APIKeyListResponse{Keys: apiKeys}); err != nil {
+		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
+		http.Error(w, "JSON応答のエンコードに失敗しました", http.StatusInternalServerError)
+	}
+}
+
+// handleAdminAPIKeyCreate はリクエストを送った管理者の組織にAPIキーを発行します。キー本体はこの応答でだけ返します
+func handleAdminAPIKeyCreate(w http.ResponseWriter, r *http.Request, ctx context.Context, presence PresenceStore, keys APIKeyStore, audit AuditStore) {
+	if !requireAdmin(w, r, ctx, presence) {
+		return
+	}
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" || len(name) > 100 {
+		logError(ctx, "APIキーの名前が無効です: %q", name)
+		http.Error(w, "nameパラメータは100文字以内で指定する必要があります。", http.StatusBadRequest)
+		return
+	}
+	var quota int64
+	if quotaStr := r.FormValue("monthly_quota"); quotaStr != "" {
+		parsed, err := strconv.ParseInt(quotaStr, 10, 64)
+		if err != nil || parsed < 0 {
+			logError(ctx, "monthly_quotaパラメータが無効です: %s", quotaStr)
+			http.Error(w, "monthly_quotaパラメータは0以上の整数である必要があります。", http.StatusBadRequest)
+			return
+		}
+		quota = parsed
+	}
+
+	rawKey, hash, err := generateAPIKey()
+	if err != nil {
+		logError(ctx, "%v", err)
+		http.Error(w, "APIキーの発行に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	key := APIKey{
+		OrgID:        recordOrg(ctx),
+		Name:         name,
+		Prefix:       rawKey[:len(apiKeyPrefix)+6],
+		MonthlyQuota: quota,
+		CreatedBy:    getUserID(r),
+		CreatedAt:    time.Now().UTC(),
+	}
+	key.KeyID, err = keys.CreateAPIKey(ctx, key, hash)
+	if err != nil {
+		logError(ctx, "APIキーの記録に失敗しました: %v", err)
+		http.Error(w, "APIキーの発行に失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(ctx, audit, r, "api_keys.create", fmt.Sprintf("api_key:%d", key.KeyID), fmt.Sprintf("name=%s monthly_quota=%d", name, quota))
+	logInfo(ctx, "APIキー %d（%s）を発行しました", key.KeyID, name)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(APIKeyCreatedResponse{APIKey: key, Key: rawKey}); err != nil {
+		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
+	}
+}
+
+// handleAdminAPIKeyRevoke はリクエストを送った管理者の組織のAPIキーを失効させます。失効したキーを付けたリクエストは 401 になります
+func handleAdminAPIKeyRevoke(w http.ResponseWriter, r *http.Request, ctx context.Context, presence PresenceStore, keys APIKeyStore, audit AuditStore, keyID int) {
+	if !requireAdmin(w, r, ctx, presence) {
+		return
+	}
+
+	err := keys.RevokeAPIKey(ctx, keyID, time.Now().UTC())
+	if err == sql.ErrNoRows {
+		http.Error(w, "APIキーが見つかりません", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logError(ctx, "APIキーの失効に失敗しました: %v", err)
+		http.Error(w, "APIキーの失効に失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(ctx, audit, r, "api_keys.revoke", fmt.Sprintf("api_key:%d", keyID), "")
+	logInfo(ctx, "APIキー %d を失効させました", keyID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAdminUsage は month（YYYY-MM、省略した場合は今月）の組織ごとの送信数・保存容量・推定/問い合わせサーバーの呼び出し回数と、
+// APIキーごとのリクエスト数を返します。既定の組織の管理者にはすべての組織を、それ以外の管理者には自分の組織だけを返します
+func handleAdminUsage(w http.ResponseWriter, r *http.Request, ctx context.Context, presence PresenceStore, orgs OrgStore, keys APIKeyStore, usage UsageStore, loc *time.Location) {
+	if !requireAdmin(w, r, ctx, presence) {
+		return
+	}
+
+	month := r.URL.Query().Get("month")
+	if month == "" {
+		month = usagePeriod(time.Now(), loc)
+	} else if _, err := time.Parse("2006-01", month); err != nil {
+		logError(ctx, "monthパラメータが無効です: %s", month)
+		http.Error(w, "monthパラメータは YYYY-MM 形式である必要があります。", http.StatusBadRequest)
+		return
+	}
+	if orgFromContext(ctx) == defaultOrgID {
+		ctx = withOrg(ctx, 0)
+	}
+	scope := orgFromContext(ctx)
+
+	organizations, err := orgs.Organizations(ctx)
+	if err != nil {
+		logError(ctx, "組織の一覧取得に失敗しました: %v", err)
+		http.Error(w, "利用量の取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	apiKeys, err := keys.APIKeys(ctx)
+	if err != nil {
+		logError(ctx, "APIキーの一覧取得に失敗しました: %v", err)
+		http.Error(w, "利用量の取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	counters, err := usage.Usage(ctx, month)
+	if err != nil {
+		logError(ctx, "利用量の取得に失敗しました: %v", err)
+		http.Error(w, "利用量の取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	requests := make(map[int]int64)
+	totals := make(map[int]*TenantUsage)
+	for _, counter := range counters {
+		tenant, ok := totals[counter.OrgID]
+		if !ok {
+			tenant = &TenantUsage{}
+			totals[counter.OrgID] = tenant
+		}
+		switch counter.Metric {
+		case usageRequests:
+			tenant.Requests += counter.Count
+			requests[counter.KeyID] += counter.Count
+		case usageSubmissions:
+			tenant.Submissions += counter.Count
+		case usageStorageBytes:
+			tenant.StorageBytes += counter.Count
+		case usageEstimationCalls:
+			tenant.EstimationCalls += counter.Count
+		case usageInquiryCalls:
+			tenant.InquiryCalls += counter.Count
+		}
+	}
+
+	response := UsageResponse{Month: month, Tenants: []TenantUsage{}}
+	for _, org := range organizations {
+		if scope != 0 && org.OrgID != scope {
+			continue
+		}
+		tenant := TenantUsage{}
+		if total, ok := totals[org.OrgID]; ok {
+			tenant = *total
+		}
+		tenant.OrgID, tenant.Name, tenant.Keys = org.OrgID, org.Name, []APIKeyUsage{}
+		for _, key := range apiKeys {
+			if key.OrgID == org.OrgID {
+				tenant.Keys = append(tenant.Keys, APIKeyUsage{KeyID: key.KeyID, Name: key.Name, Requests: requests[key.KeyID], MonthlyQuota: key.MonthlyQuota, Revoked: key.RevokedAt != nil})
+			}
+		}
+		response.Tenants = append(response.Tenants, tenant)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
+		http.Error(w, "JSON応答のエンコードに失敗しました", http.StatusInternalServerError)
+	}
+}
+
+func handleCurrentOccupants(w http.ResponseWriter, r *http.Request, ctx context.Context, presence PresenceStore) {
+	rooms, err := presence.CurrentOccupants(ctx)
+	if err != nil {
+		logError(ctx, "現在の占有者の取得に失敗しました: %v", err)
+		http.Error(w, "現在の占有者の取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	response := CurrentOccupantsResponse{
+		Rooms: rooms,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
+		http.Error(w, "JSON応答のエンコードに失敗しました", http.StatusInternalServerError)
+	}
+}
+
+// handleBuildings は建物と階の一覧を、各階に割り当てられたルームのIDとともに返します
+func handleBuildings(w http.ResponseWriter, r *http.Request, ctx context.Context, buildings BuildingStore) {
+	list, err := buildings.Buildings(ctx)
+	if err != nil {
+		logError(ctx, "建物の一覧の取得に失敗しました: %v", err)
+		http.Error(w, "建物の一覧の取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(BuildingsResponse{Buildings: list}); err != nil {
+		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
+		http.Error(w, "JSON応答のエンコードに失敗しました", http.StatusInternalServerError)
+	}
+}
+
+// handleFloorOccupants は階に属するルームの現在の在室者を /api/current_occupants と同じ形式で返します
+func handleFloorOccupants(w http.ResponseWriter, r *http.Request, ctx context.Context, buildings BuildingStore, presence PresenceStore, floorID int) {
+	floor, err := buildings.Floor(ctx, floorID)
+	if err == sql.ErrNoRows {
+		logError(ctx, "階ID %d が見つかりません", floorID)
+		http.Error(w, "階が見つかりません", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logError(ctx, "階ID %d の取得に失敗しました: %v", floorID, err)
+		http.Error(w, "階の取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	rooms, err := presence.CurrentOccupants(ctx)
+	if err != nil {
+		logError(ctx, "現在の占有者の取得に失敗しました: %v", err)
+		http.Error(w, "現在の占有者の取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	onFloor := make(map[int]bool, len(floor.RoomIDs))
+	for _, roomID := range floor.RoomIDs {
+		onFloor[roomID] = true
+	}
+	response := FloorOccupantsResponse{
+		FloorID:    floor.FloorID,
+		BuildingID: floor.BuildingID,
+		Name:       floor.Name,
+		Level:      floor.Level,
+		Rooms:      []RoomOccupants{},
+	}
+	for _, room := range rooms {
+		if !onFloor[room.RoomID] {
+			continue
+		}
+		response.Occupants += len(room.Occupants)
+		response.Rooms = append(response.Rooms, room)
+	}
+	sort.Slice(response.Rooms, func(i, j int) bool { return response.Rooms[i].RoomID < response.Rooms[j].RoomID })
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
+		http.Error(w, "JSON応答のエンコードに失敗しました", http.StatusInternalServerError)
+	}
+}
+
+// occupancyTally は階・建物単位の集計途中の値です
+type occupancyTally struct {
+	rooms    int
+	current  int
+	sessions int
+	hours    float64
+	users    map[int]bool
+}
+
+func (t *occupancyTally) add(session PresenceSession, to time.Time) {
+	end := session.LastSeen
+	if session.EndTime != nil {
+		end = *session.EndTime
+	}
+	if end.After(to) {
+		end = to
+	}
+	t.sessions++
+	if end.After(session.StartTime) {
+		t.hours += end.Sub(session.StartTime).Hours()
+	}
+	t.users[session.UserID] = true
+}
+
+// rollup は集計結果を返します。秘匿モードではユーザーが min_users 人未満の場合に値を伏せ、それ以外は cell ごとに決まるノイズを加えます
+func (t *occupancyTally) rollup(privacy *statsPrivacy, cell string) OccupancyRollup {
+	visitors := len(t.users)
+	if privacy.suppressed(visitors) {
+		return OccupancyRollup{Rooms: t.rooms, Suppressed: true}
+	}
+	return OccupancyRollup{
+		Rooms:            t.rooms,
+		CurrentOccupants: privacy.noiseCount(t.current, cell+":current"),
+		SessionCount:     int(math.Round(privacy.noisePerUser(float64(t.sessions), visitors, cell+":sessions"))),
+		OccupancyHours:   privacy.noisePerUser(t.hours, visitors, cell+":hours"),
+		UniqueVisitors:   privacy.noiseCount(visitors, cell+":visitors"),
+	}
+}
+
+// handleBuildingStats は期間内に開始したセッションと現在の在室者を、階ごとと建物全体に合算して返します。
+// 集計はアプリケーション側で行うため SQLite でも利用できます
+func handleBuildingStats(w http.ResponseWriter, r *http.Request, ctx context.Context, buildings BuildingStore, presence PresenceStore, buildingID int, loc *time.Location, privateConfig PrivateStatsConfig) {
+	privacy, err := requestStatsPrivacy(r, privateConfig)
+	if err != nil {
+		logError(ctx, "privateパラメータが無効です: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	from, to, err := parseHistoryRange(r, loc)
+	if err != nil {
+		logError(ctx, "期間パラメータが無効です: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	privacy.window(fmt.Sprintf("building:%d", buildingID), from, to)
+
+	building, err := buildings.Building(ctx, buildingID)
+	if err == sql.ErrNoRows {
+		logError(ctx, "建物ID %d が見つかりません", buildingID)
+		http.Error(w, "建物が見つかりません", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logError(ctx, "建物ID %d の取得に失敗しました: %v", buildingID, err)
+		http.Error(w, "建物の取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	sessions, err := presence.ListSessions(ctx, from, to, nil, 0)
+	if err == nil {
+		sessions, err = excludeUsersWithoutConsent(ctx, presence, sessions)
+	}
+	if err != nil {
+		logError(ctx, "在室履歴の取得に失敗しました: %v", err)
+		http.Error(w, "在室履歴の取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	occupants, err := presence.CurrentOccupants(ctx)
+	if err != nil {
+		logError(ctx, "現在の占有者の取得に失敗しました: %v", err)
+		http.Error(w, "現在の占有者の取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	total := &occupancyTally{users: make(map[int]bool)}
+	tallies := make([]*occupancyTally, len(building.Floors))
+	roomFloor := make(map[int]int)
+	for i, floor := range building.Floors {
+		tallies[i] = &occupancyTally{rooms: len(floor.RoomIDs), users: make(map[int]bool)}
+		total.rooms += len(floor.RoomIDs)
+		for _, roomID := range floor.RoomIDs {
+			roomFloor[roomID] = i
+		}
+	}
+	for _, session := range sessions {
+		if i, ok := roomFloor[session.RoomID]; ok {
+			tallies[i].add(session, to)
+			total.add(session, to)
+		}
+	}
+	for _, room := range occupants {
+		if i, ok := roomFloor[room.RoomID]; ok {
+			tallies[i].current += len(room.Occupants)
+			total.current += len(room.Occupants)
+		}
+	}
+
+	response := BuildingStatsResponse{
+		BuildingID: building.BuildingID,
+		Name:       building.Name,
+		From:       from.Format(time.RFC3339),
+		To:         to.Format(time.RFC3339),
+		Privacy:    privacy.info(),
+		Total:      total.rollup(privacy, "building"),
+		Floors:     make([]FloorStats, 0, len(building.Floors)),
+	}
+	for i, floor := range building.Floors {
+		response.Floors = append(response.Floors, FloorStats{
+			FloorID:         floor.FloorID,
+			Name:            floor.Name,
+			Level:           floor.Level,
+			OccupancyRollup: tallies[i].rollup(privacy, fmt.Sprintf("floor:%d", floor.FloorID)),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
+		http.Error(w, "JSON応答のエンコードに失敗しました", http.StatusInternalServerError)
+	}
+}
+
+// handleAnonymousOccupants はルームごとの在室人数を、mode が pseudonym の場合はユーザーIDの代わりに仮名を付けて返します
+func handleAnonymousOccupants(w http.ResponseWriter, r *http.Request, ctx context.Context, presence PresenceStore, mode string, pseudonymKey []byte) {
+	rooms, err := presence.CurrentOccupants(ctx)
+	if err != nil {
+		logError(ctx, "現在の占有者の取得に失敗しました: %v", err)
+		http.Error(w, "現在の占有者の取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	response := AnonymousOccupantsResponse{Rooms: make([]AnonymousRoomOccupancy, 0, len(rooms))}
+	for _, room := range rooms {
+		occupancy := AnonymousRoomOccupancy{RoomID: room.RoomID, RoomName: room.RoomName, Count: len(room.Occupants)}
+		if mode == publicDisplayPseudonym {
+			occupancy.Pseudonyms = make([]string, 0, len(room.Occupants))
+			for _, occupant := range room.Occupants {
+				occupancy.Pseudonyms = append(occupancy.Pseudonyms, pseudonymize(pseudonymKey, occupant.UserID))
+			}
+			// 在室者はユーザーIDの順に並んでいるため、並び順から推測されないよう仮名の順に並べ替えます
+			sort.Strings(occupancy.Pseudonyms)
+		}
+		response.Rooms = append(response.Rooms, occupancy)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
+		http.Error(w, "JSON応答のエンコードに失敗しました", http.StatusInternalServerError)
+	}
+}
+
+// pseudonymize はユーザーIDから key を使った HMAC-SHA256 の先頭12文字を仮名として返します。
+// ユーザーIDの一覧から総当たりで元に戻せないよう、key を知らなければ求められない値にしています
+func pseudonymize(key []byte, userID string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(userID))
+	return hex.EncodeToString(mac.Sum(nil))[:12]
+}
+
+// publicDisplayKey は仮名に使う鍵を返します。pseudonym_key が空の場合は起動ごとにランダムな鍵を生成します
+func publicDisplayKey(config PublicDisplayConfig) ([]byte, error) {
+	if config.PseudonymKey != "" {
+		return []byte(config.PseudonymKey), nil
+	}
+	key := make([]byte, 32)
+	if _, err := cryptorand.Read(key); err != nil {
+		return nil, fmt.Errorf("仮名の鍵を生成できませんでした: %v", err)
+	}
+	return key, nil
+}
+
+// federationSite は在室状況を取得するピアです
+type federationSite struct {
+	name   string
+	config FederationPeerConfig
+	loc    *time.Location
+}
+
+// federation は [Federation] のピアから在室状況を取得します
+type federation struct {
+	client *http.Client
+	sites  []federationSite
+}
+
+// newFederation は [Federation] のピアをサイト名の順に並べて返します。timezone が空のピアは loc を使用します
+func newFederation(config FederationConfig, loc *time.Location) (*federation, error) {
+	f := &federation{client: tracedClient(config.Timeout)}
+	for name, peer := range config.Peers {
+		site := federationSite{name: name, config: peer, loc: loc}
+		if peer.Timezone != "" {
+			peerLoc, err := time.LoadLocation(peer.Timezone)
+			if err != nil {
+				return nil, fmt.Errorf("[Federation.peers.%s] timezone が無効です: %v", name, err)
+			}
+			site.loc = peerLoc
+		}
+		f.sites = append(f.sites, site)
+	}
+	sort.Slice(f.sites, func(i, j int) bool { return f.sites[i].name < f.sites[j].name })
+	return f, nil
+}
+
+// get はピアの path にGETリクエストを送り、JSONの応答を v に読み込みます
+func (f *federation) get(ctx context.Context, site federationSite, path string, query url.Values, v interface{}) error {
+	peerURL := strings.TrimRight(site.config.URL, "/") + path
+	if len(query) > 0 {
+		peerURL += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, peerURL, nil)
+	if err != nil {
+		return err
+	}
+	if site.config.Username != "" {
+		req.SetBasicAuth(site.config.Username, site.config.Password)
+	}
+	setRequestIDHeader(ctx, req)
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer drainAndClose(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s が %d を返しました", path, resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("%s の応答を読み取れませんでした: %v", path, err)
+	}
+	return nil
+}
+
+// each はすべてのサイトに対して fetch を並行に呼び出し、サイトごとの結果を返します
+func (f *federation) each(ctx context.Context, fetch func(site federationSite) error) []FederationSiteStatus {
+	statuses := make([]FederationSiteStatus, len(f.sites))
+	var wg sync.WaitGroup
+	for i, site := range f.sites {
+		wg.Add(1)
+		go func(i int, site federationSite) {
+			defer wg.Done()
+			statuses[i] = FederationSiteStatus{Site: site.name, Timezone: site.loc.String(), Status: "ok"}
+			if err := fetch(site); err != nil {
+				logError(ctx, "サイト %s から在室状況を取得できませんでした: %v", site.name, err)
+				statuses[i].Status = "unreachable"
+				statuses[i].Error = err.Error()
+			}
+		}(i, site)
+	}
+	wg.Wait()
+	return statuses
+}
+
+// federatedID はピアでのIDを、サイトをまたいで一意な {サイト名}:{ID} にします
+func federatedID(site string, id interface{}) string {
+	return fmt.Sprintf("%s:%v", site, id)
+}
+
+// hasSite は name が [Federation.peers] のサイトかどうかを返します
+func (f *federation) hasSite(name string) bool {
+	for _, site := range f.sites {
+		if site.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// handleFederatedOccupants は各ピアの /api/current_occupants をまとめて返します。取得できなかったサイトは sites に理由を返し、他のサイトの結果のみを返します
+func handleFederatedOccupants(w http.ResponseWriter, r *http.Request, ctx context.Context, f *federation) {
+	results := make([][]RoomOccupants, len(f.sites))
+	index := make(map[string]int, len(f.sites))
+	for i, site := range f.sites {
+		index[site.name] = i
+	}
+	statuses := f.each(ctx, func(site federationSite) error {
+		var response CurrentOccupantsResponse
+		if err := f.get(ctx, site, "/api/current_occupants", nil, &response); err != nil {
+			return err
+		}
+		results[index[site.name]] = response.Rooms
+		return nil
+	})
+
+	response := FederatedOccupantsResponse{Sites: statuses, Rooms: []FederatedRoomOccupants{}}
+	for i, site := range f.sites {
+		rooms := results[i]
+		sort.Slice(rooms, func(a, b int) bool { return rooms[a].RoomID < rooms[b].RoomID })
+		for _, room := range rooms {
+			federated := FederatedRoomOccupants{
+				RoomID:     federatedID(site.name, room.RoomID),
+				Site:       site.name,
+				SiteRoomID: room.RoomID,
+				RoomName:   room.RoomName,
+				Occupants:  make([]FederatedOccupant, 0, len(room.Occupants)),
+			}
+			for _, occupant := range room.Occupants {
+				federated.Occupants = append(federated.Occupants, FederatedOccupant{
+					UserID:   federatedID(site.name, occupant.UserID),
+					LastSeen: occupant.LastSeen.In(site.loc),
+				})
+			}
+			response.Rooms = append(response.Rooms, federated)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
+		http.Error(w, "JSON応答のエンコードに失敗しました", http.StatusInternalServerError)
+	}
+}
+
+// fetchPeerSessions はピアの /api/presence_history からセッションをすべて取得します。from・to の日付は tz（このリクエストのタイムゾーン）で解釈させ、
+// サイトのタイムゾーンが異なっても同じ期間を取得します
+func (f *federation) fetchPeerSessions(ctx context.Context, site federationSite, r *http.Request, loc *time.Location) ([]PresenceSession, error) {
+	query := url.Values{}
+	for _, key := range []string{"from", "to", "date"} {
+		if value := r.URL.Query().Get(key); value != "" {
+			query.Set(key, value)
+		}
+	}
+	query.Set("tz", loc.String())
+	query.Set("limit", strconv.Itoa(maxPageSize))
+
+	var sessions []PresenceSession
+	for {
+		var page PresenceHistoryResponse
+		if err := f.get(ctx, site, "/api/presence_history", query, &page); err != nil {
+			return nil, err
+		}
+		for _, day := range page.AllHistory {
+			for _, user := range day.Users {
+				sessions = append(sessions, user.Sessions...)
+			}
+		}
+		if page.NextCursor == "" {
+			return sessions, nil
+		}
+		query.Set("cursor", page.NextCursor)
+	}
+}
+
+// handleFederatedHistory は各ピアの在室履歴を、このリクエストのタイムゾーンの日付ごとにまとめて返します
+func handleFederatedHistory(w http.ResponseWriter, r *http.Request, ctx context.Context, f *federation, links IdentityLinkStore, accessLog HistoryAccessStore, loc *time.Location) {
+	from, to, err := parseHistoryRange(r, loc)
+	if err != nil {
+		logError(ctx, "期間パラメータが無効です: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	identityLinks, err := links.IdentityLinks(ctx)
+	if err != nil {
+		logError(ctx, "人物の対応表の取得に失敗しました: %v", err)
+		http.Error(w, "人物の対応表の取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	identities := make(map[string]string, len(identityLinks))
+	for _, link := range identityLinks {
+		identities[federatedID(link.Site, link.UserID)] = link.Identity
+	}
+
+	results := make([][]PresenceSession, len(f.sites))
+	index := make(map[string]int, len(f.sites))
+	for i, site := range f.sites {
+		index[site.name] = i
+	}
+	statuses := f.each(ctx, func(site federationSite) error {
+		sessions, err := f.fetchPeerSessions(ctx, site, r, loc)
+		if err != nil {
+			return err
+		}
+		results[index[site.name]] = sessions
+		return nil
+	})
+	recordHistoryAccess(ctx, accessLog, r, nil, from, to)
+
+	dayUserMap := make(map[string]map[string][]FederatedSession)
+	for i, site := range f.sites {
+		for _, session := range results[i] {
+			userID := federatedID(site.name, session.UserID)
+			federated := FederatedSession{
+				SessionID: federatedID(site.name, session.SessionID),
+				Site:      site.name,
+				UserID:    userID,
+				RoomID:    federatedID(site.name, session.RoomID),
+				StartTime: session.StartTime.In(site.loc),
+				LastSeen:  session.LastSeen.In(site.loc),
+			}
+			if session.EndTime != nil {
+				end := session.EndTime.In(site.loc)
+				federated.EndTime = &end
+			}
+			date := session.StartTime.In(loc).Format("2006-01-02")
+			if _, exists := dayUserMap[date]; !exists {
+				dayUserMap[date] = make(map[string][]FederatedSession)
+			}
+			// 人物に結び付けたユーザーのセッションは人物の名前でまとめます。人物の名前は : を含まないため {サイト名}:{ユーザーID} と重なりません
+			key := userID
+			if identity, ok := identities[userID]; ok {
+				key = identity
+			}
+			dayUserMap[date][key] = append(dayUserMap[date][key], federated)
+		}
+	}
+
+	response := FederatedHistoryResponse{Sites: statuses, AllHistory: []FederatedPresenceDay{}}
+	for date, usersMap := range dayUserMap {
+		day := FederatedPresenceDay{Date: date}
+		for userID, sessions := range usersMap {
+			sort.Slice(sessions, func(i, j int) bool { return sessions[i].StartTime.Before(sessions[j].StartTime) })
+			user := FederatedUserPresence{UserID: userID, Sessions: sessions}
+			if !strings.Contains(userID, ":") {
+				seen := make(map[string]bool)
+				for _, session := range sessions {
+					if !seen[session.UserID] {
+						seen[session.UserID] = true
+						user.LinkedUserIDs = append(user.LinkedUserIDs, session.UserID)
+					}
+				}
+				sort.Strings(user.LinkedUserIDs)
+			}
+			day.Users = append(day.Users, user)
+		}
+		sort.Slice(day.Users, func(i, j int) bool { return day.Users[i].UserID < day.Users[j].UserID })
+		response.AllHistory = append(response.AllHistory, day)
+	}
+	sort.Slice(response.AllHistory, func(i, j int) bool {
+		return response.AllHistory[i].Date < response.AllHistory[j].Date
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
+		http.Error(w, "JSON応答のエンコードに失敗しました", http.StatusInternalServerError)
+	}
+}
+
+// handleAdminIdentityLinks はリクエストを送った管理者の組織の人物の対応表を、人物・サイト・ユーザーIDの順に返します
+func handleAdminIdentityLinks(w http.ResponseWriter, r *http.Request, ctx context.Context, presence PresenceStore, links IdentityLinkStore) {
+	if !requireAdmin(w, r, ctx, presence) {
+		return
+	}
+
+	identityLinks, err := links.IdentityLinks(ctx)
+	if err != nil {
+		logError(ctx, "人物の対応表の取得に失敗しました: %v", err)
+		http.Error(w, "人物の対応表の取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(IdentityLinkListResponse{Links: identityLinks}); err != nil {
+		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
+		http.Error(w, "JSON応答のエンコードに失敗しました", http.StatusInternalServerError)
+	}
+}
+
+// handleAdminIdentityLinkCreate はサイト site のユーザー user_id を人物 identity に結び付けます。
+// 1人のユーザーは1人の人物にだけ結び付けられるため、結び付け済みのユーザーは 409 を返します
+func handleAdminIdentityLinkCreate(w http.ResponseWriter, r *http.Request, ctx context.Context, presence PresenceStore, links IdentityLinkStore, audit AuditStore, f *federation) {
+	if !requireAdmin(w, r, ctx, presence) {
+		return
+	}
+
+	identity := strings.TrimSpace(r.FormValue("identity"))
+	if identity == "" || len(identity) > 100 || strings.Contains(identity, ":") {
+		logError(ctx, "人物の名前が無効です: %q", identity)
+		http.Error(w, "identityパラメータは : を含まない100文字以内で指定する必要があります。", http.StatusBadRequest)
+		return
+	}
+	site := r.FormValue("site")
+	if !f.hasSite(site) {
+		logError(ctx, "サイトが見つかりません: %q", site)
+		http.Error(w, "siteパラメータには [Federation.peers] のサイト名を指定する必要があります。", http.StatusBadRequest)
+		return
+	}
+	userID, err := strconv.Atoi(r.FormValue("user_id"))
+	if err != nil || userID <= 0 {
+		logError(ctx, "user_idパラメータが無効です: %s", r.FormValue("user_id"))
+		http.Error(w, "user_idパラメータは正の整数である必要があります。", http.StatusBadRequest)
+		return
+	}
+
+	link := IdentityLink{
+		OrgID:     recordOrg(ctx),
+		Identity:  identity,
+		Site:      site,
+		UserID:    userID,
+		CreatedBy: getUserID(r),
+		CreatedAt: time.Now().UTC(),
+	}
+	link.LinkID, err = links.CreateIdentityLink(ctx, link)
+	if err == sql.ErrNoRows {
+		http.Error(w, "このユーザーは既に人物に結び付けられています", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		logError(ctx, "人物の対応の記録に失敗しました: %v", err)
+		http.Error(w, "人物の対応の記録に失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(ctx, audit, r, "identity_links.create", fmt.Sprintf("identity_link:%d", link.LinkID), fmt.Sprintf("identity=%s user=%s", identity, federatedID(site, userID)))
+	logInfo(ctx, "%s を人物 %s に結び付けました", federatedID(site, userID), identity)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(link); err != nil {
+		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
+	}
+}
+
+// handleAdminIdentityLinkDelete はリクエストを送った管理者の組織の人物の対応を削除します
+func handleAdminIdentityLinkDelete(w http.ResponseWriter, r *http.Request, ctx context.Context, presence PresenceStore, links IdentityLinkStore, audit AuditStore, linkID int) {
+	if !requireAdmin(w, r, ctx, presence) {
+		return
+	}
+
+	err := links.DeleteIdentityLink(ctx, linkID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "人物の対応が見つかりません", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logError(ctx, "人物の対応の削除に失敗しました: %v", err)
+		http.Error(w, "人物の対応の削除に失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(ctx, audit, r, "identity_links.delete", fmt.Sprintf("identity_link:%d", linkID), "")
+	logInfo(ctx, "人物の対応 %d を削除しました", linkID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleDevices はリクエストを送ったユーザーの端末の一覧を返します。管理者は user_id で他のユーザーの端末を指定できます
+func handleDevices(w http.ResponseWriter, r *http.Request, ctx context.Context, presence PresenceStore, userDevices UserDeviceStore) {
+	requesterID, err := getUserIDFromDB(ctx, presence, getUserID(r))
+	if err != nil {
+		logError(ctx, "ユーザーが見つかりません: %v", err)
+		http.Error(w, "ユーザーが見つかりません", http.StatusUnauthorized)
+		return
+	}
+	userID := requesterID
+	if userIDStr := r.URL.Query().Get("user_id"); userIDStr != "" {
+		userID, err = strconv.Atoi(userIDStr)
+		if err != nil {
+			logError(ctx, "user_idパラメータが無効です: %v", err)
+			http.Error(w, "user_idパラメータは整数である必要があります。", http.StatusBadRequest)
+			return
+		}
+		if userID != requesterID && !requireAdmin(w, r, ctx, presence) {
+			return
+		}
+	}
+
+	devices, err := userDevices.UserDevices(ctx, userID)
+	if err != nil {
+		logError(ctx, "ユーザーID %d の端末の取得に失敗しました: %v", userID, err)
+		http.Error(w, "端末の取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(UserDeviceListResponse{Devices: devices}); err != nil {
+		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
+		http.Error(w, "JSON応答のエンコードに失敗しました", http.StatusInternalServerError)
+	}
+}
+
+// handleDeviceCreate はリクエストを送ったユーザーの端末 name（platform は ios・android・macos など任意の文字列）を登録します。
+// 返した device_id を信号の送信に付けると、在室判定ごとに送信した端末を記録します
+func handleDeviceCreate(w http.ResponseWriter, r *http.Request, ctx context.Context, presence PresenceStore, userDevices UserDeviceStore, audit AuditStore) {
+	userID, err := getUserIDFromDB(ctx, presence, getUserID(r))
+	if err != nil {
+		logError(ctx, "ユーザーが見つかりません: %v", err)
+		http.Error(w, "ユーザーが見つかりません", http.StatusUnauthorized)
+		return
+	}
+
+	device := UserDevice{
+		UserID:    userID,
+		Name:      strings.TrimSpace(r.FormValue("name")),
+		Platform:  strings.TrimSpace(r.FormValue("platform")),
+		CreatedAt: time.Now().UTC(),
+	}
+	if device.Name == "" || len(device.Name) > 100 {
+		logError(ctx, "端末名が無効です: %q", device.Name)
+		http.Error(w, "nameパラメータは100文字以内で指定する必要があります。", http.StatusBadRequest)
+		return
+	}
+	if len(device.Platform) > 50 {
+		logError(ctx, "platformパラメータが無効です: %q", device.Platform)
+		http.Error(w, "platformパラメータは50文字以内で指定する必要があります。", http.StatusBadRequest)
+		return
+	}
+
+	device.DeviceID, err = userDevices.CreateUserDevice(ctx, device)
+	if err != nil {
+		logError(ctx, "端末の登録に失敗しました: %v", err)
+		http.Error(w, "端末の登録に失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(ctx, audit, r, "devices.create", fmt.Sprintf("device:%d", device.DeviceID), fmt.Sprintf("user_id=%d name=%s", userID, device.Name))
+	logInfo(ctx, "ユーザーID %d の端末 %s（ID %d）を登録しました", userID, device.Name, device.DeviceID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(device); err != nil {
+		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
+	}
+}
+
+// ownedDevice は deviceID の端末を返します。端末が存在しない、またはリクエストを送ったユーザーの端末でなく管理者でもない場合は
+// エラー応答を返し、false を返します
+func ownedDevice(w http.ResponseWriter, r *http.Request, ctx context.Context, presence PresenceStore, userDevices UserDeviceStore, deviceID int) (UserDevice, bool) {
+	device, err := userDevices.UserDevice(ctx, deviceID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "端末が見つかりません", http.StatusNotFound)
+		return UserDevice{}, false
+	}
+	if err != nil {
+		logError(ctx, "端末の取得に失敗しました: %v", err)
+		http.Error(w, "端末の取得に失敗しました", http.StatusInternalServerError)
+		return UserDevice{}, false
+	}
+	if requesterID, err := presence.UserIDByName(ctx, getUserID(r)); err != nil || requesterID != device.UserID {
+		if !requireAdmin(w, r, ctx, presence) {
+			return UserDevice{}, false
+		}
+	}
+	return device, true
+}
+
+// handleDeviceDelete は端末の登録を削除します。記録済みの在室判定の device_id はそのまま残します
+func handleDeviceDelete(w http.ResponseWriter, r *http.Request, ctx context.Context, presence PresenceStore, userDevices UserDeviceStore, audit AuditStore, deviceID int) {
+	device, ok := ownedDevice(w, r, ctx, presence, userDevices, deviceID)
+	if !ok {
+		return
+	}
+
+	if err := userDevices.DeleteUserDevice(ctx, deviceID); err == sql.ErrNoRows {
+		http.Error(w, "端末が見つかりません", http.StatusNotFound)
+		return
+	} else if err != nil {
+		logError(ctx, "端末の削除に失敗しました: %v", err)
+		http.Error(w, "端末の削除に失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(ctx, audit, r, "devices.delete", fmt.Sprintf("device:%d", deviceID), fmt.Sprintf("user_id=%d", device.UserID))
+	logInfo(ctx, "ユーザーID %d の端末 %d を削除しました", device.UserID, deviceID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleDeviceConfig は端末のスキャン間隔・RSSIのしきい値・送信をまとめる件数を返します。building_id を指定しない場合は、
+// 端末のユーザーが在室中のルームの建物（在室中でない場合は [DeviceScan.hours]）の開館・勤務時間から時間帯を決めます
+func handleDeviceConfig(w http.ResponseWriter, r *http.Request, ctx context.Context, presence PresenceStore, userDevices UserDeviceStore, buildings BuildingStore, scan DeviceScanConfig, loc *time.Location, deviceID int) {
+	device, ok := ownedDevice(w, r, ctx, presence, userDevices, deviceID)
+	if !ok {
+		return
+	}
+
+	var buildingID *int
+	if buildingIDStr := r.URL.Query().Get("building_id"); buildingIDStr != "" {
+		id, err := strconv.Atoi(buildingIDStr)
+		if err != nil {
+			logError(ctx, "building_idパラメータが無効です: %v", err)
+			http.Error(w, "building_idパラメータは整数である必要があります。", http.StatusBadRequest)
+			return
+		}
+		buildingID = &id
+	} else if roomID, err := presence.OpenSessionRoom(ctx, device.UserID); err == nil {
+		list, err := buildings.Buildings(ctx)
+		if err != nil {
+			logError(ctx, "建物の一覧の取得に失敗しました: %v", err)
+			http.Error(w, "建物の一覧の取得に失敗しました", http.StatusInternalServerError)
+			return
+		}
+		for _, building := range list {
+			for _, floor := range building.Floors {
+				if slices.Contains(floor.RoomIDs, roomID) {
+					id := building.BuildingID
+					buildingID = &id
+				}
+			}
+		}
+	} else if err != sql.ErrNoRows {
+		logError(ctx, "ユーザーID %d の在室中のルームの取得に失敗しました: %v", device.UserID, err)
+		http.Error(w, "在室中のルームの取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	settings := scan.settings(buildingID, time.Now().In(loc))
+	settings.DeviceID = deviceID
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(settings); err != nil {
+		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
+		http.Error(w, "JSON応答のエンコードに失敗しました", http.StatusInternalServerError)
+	}
+}
+
+func handleAdminBuildingAdmins(w http.ResponseWriter, r *http.Request, ctx context.Context, presence PresenceStore, scopes BuildingAdminStore) {
+	if !requireAdmin(w, r, ctx, presence) {
+		return
+	}
+
+	admins, err := scopes.BuildingAdmins(ctx)
+	if err != nil {
+		logError(ctx, "建物の管理の委任の取得に失敗しました: %v", err)
+		http.Error(w, "建物の管理の委任の取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(BuildingAdminListResponse{Admins: admins}); err != nil {
+		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
+		http.Error(w, "JSON応答のエンコードに失敗しました", http.StatusInternalServerError)
+	}
+}
+
+// handleAdminBuildingAdminGrant はユーザー user_id に建物 building_id の管理を委任します。委任済みの場合は 409 を返します
+func handleAdminBuildingAdminGrant(w http.ResponseWriter, r *http.Request, ctx context.Context, presence PresenceStore, scopes BuildingAdminStore, buildings BuildingStore, audit AuditStore) {
+	if !requireAdmin(w, r, ctx, presence) {
+		return
+	}
+
+	userID, err := strconv.Atoi(r.FormValue("user_id"))
+	if err != nil || userID <= 0 {
+		logError(ctx, "user_idパラメータが無効です: %s", r.FormValue("user_id"))
+		http.Error(w, "user_idパラメータは正の整数である必要があります。", http.StatusBadRequest)
+		return
+	}
+	buildingID, err := strconv.Atoi(r.FormValue("building_id"))
+	if err != nil || buildingID <= 0 {
+		logError(ctx, "building_idパラメータが無効です: %s", r.FormValue("building_id"))
+		http.Error(w, "building_idパラメータは正の整数である必要があります。", http.StatusBadRequest)
+		return
+	}
+	if _, err := presence.UserName(ctx, userID); err == sql.ErrNoRows {
+		http.Error(w, "ユーザーが見つかりません", http.StatusNotFound)
+		return
+	} else if err != nil {
+		logError(ctx, "ユーザーID %d の取得に失敗しました: %v", userID, err)
+		http.Error(w, "ユーザーの取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	if _, err := buildings.Building(ctx, buildingID); err == sql.ErrNoRows {
+		http.Error(w, "建物が見つかりません", http.StatusNotFound)
+		return
+	} else if err != nil {
+		logError(ctx, "建物の取得に失敗しました: %v", err)
+		http.Error(w, "建物の取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	admin := BuildingAdmin{
+		UserID:     userID,
+		BuildingID: buildingID,
+		OrgID:      recordOrg(ctx),
+		CreatedBy:  getUserID(r),
+		CreatedAt:  time.Now().UTC(),
+	}
+	err = scopes.GrantBuildingAdmin(ctx, admin)
+	if err == sql.ErrNoRows {
+		http.Error(w, "このユーザーには既にこの建物の管理を委任しています", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		logError(ctx, "建物の管理の委任に失敗しました: %v", err)
+		http.Error(w, "建物の管理の委任に失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(ctx, audit, r, "building_admins.grant", fmt.Sprintf("building:%d", buildingID), fmt.Sprintf("user_id=%d", userID))
+	logInfo(ctx, "ユーザーID %d に建物 %d の管理を委任しました", userID, buildingID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(admin); err != nil {
+		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
+	}
+}
+
+func handleAdminBuildingAdminRevoke(w http.ResponseWriter, r *http.Request, ctx context.Context, presence PresenceStore, scopes BuildingAdminStore, audit AuditStore, buildingID int, userID int) {
+	if !requireAdmin(w, r, ctx, presence) {
+		return
+	}
+
+	err := scopes.RevokeBuildingAdmin(ctx, userID, buildingID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "建物の管理の委任が見つかりません", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logError(ctx, "建物の管理の委任の取り消しに失敗しました: %v", err)
+		http.Error(w, "建物の管理の委任の取り消しに失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(ctx, audit, r, "building_admins.revoke", fmt.Sprintf("building:%d", buildingID), fmt.Sprintf("user_id=%d", userID))
+	logInfo(ctx, "ユーザーID %d への建物 %d の管理の委任を取り消しました", userID, buildingID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// roomFloorParam は floor_id パラメータの階を返します。空の場合は nil（階に割り当てない）を返しますが、
+// 建物の管理者はルームを管理する建物の階に割り当てる必要があります。指定できない場合はエラー応答を返し、false を返します
+func roomFloorParam(w http.ResponseWriter, r *http.Request, ctx context.Context, buildings BuildingStore, scope *adminScope) (*int, bool) {
+	value := r.FormValue("floor_id")
+	if value == "" {
+		if scope != nil {
+			logError(ctx, "建物の管理者が階に割り当てずにルームを登録しようとしました: %s", getUserID(r))
+			http.Error(w, "建物の管理者は floor_id に管理する建物の階を指定する必要があります", http.StatusForbidden)
+			return nil, false
+		}
+		return nil, true
+	}
+	floorID, err := strconv.Atoi(value)
+	if err != nil {
+		logError(ctx, "floor_idパラメータが無効です: %s", value)
+		http.Error(w, "floor_idパラメータは整数である必要があります。", http.StatusBadRequest)
+		return nil, false
+	}
+	if _, err := buildings.Floor(ctx, floorID); err == sql.ErrNoRows {
+		logError(ctx, "階が見つかりません: %d", floorID)
+		http.Error(w, "floor_idの階が見つかりません", http.StatusBadRequest)
+		return nil, false
+	} else if err != nil {
+		logError(ctx, "階の取得に失敗しました: %v", err)
+		http.Error(w, "階の取得に失敗しました", http.StatusInternalServerError)
+		return nil, false
+	}
+	if !scope.allowsFloor(floorID) {
+		logError(ctx, "管理していない階へのルームの割り当てが要求されました: %s floor=%d", getUserID(r), floorID)
+		http.Error(w, "この階を管理する権限がありません", http.StatusForbidden)
+		return nil, false
+	}
+	return &floorID, true
+}
+
+// handleAdminRooms はルームの一覧を返します。建物の管理者には管理する建物のルームだけを返します
+func handleAdminRooms(w http.ResponseWriter, r *http.Request, ctx context.Context, presence PresenceStore, scopes BuildingAdminStore, buildings BuildingStore, rooms RoomAdminStore) {
+	scope, ok := requireScopedAdmin(w, r, ctx, presence, scopes, buildings)
+	if !ok {
+		return
+	}
+
+	all, err := rooms.ManagedRooms(ctx)
+	if err != nil {
+		logError(ctx, "ルームの取得に失敗しました: %v", err)
+		http.Error(w, "ルームの取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	response := ManagedRoomListResponse{Rooms: []ManagedRoom{}}
+	for _, room := range all {
+		if scope.allowsRoom(&room.RoomID) {
+			response.Rooms = append(response.Rooms, room)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
+		http.Error(w, "JSON応答のエンコードに失敗しました", http.StatusInternalServerError)
+	}
+}
+
+// handleAdminRoomCreate は room_name のルームを登録し、floor_id の階に割り当てます
+func handleAdminRoomCreate(w http.ResponseWriter, r *http.Request, ctx context.Context, presence PresenceStore, scopes BuildingAdminStore, buildings BuildingStore, rooms RoomAdminStore, audit AuditStore) {
+	scope, ok := requireScopedAdmin(w, r, ctx, presence, scopes, buildings)
+	if !ok {
+		return
+	}
+
+	room := ManagedRoom{RoomName: strings.TrimSpace(r.FormValue("room_name"))}
+	if room.RoomName == "" || len(room.RoomName) > 100 {
+		logError(ctx, "ルーム名が無効です: %q", room.RoomName)
+		http.Error(w, "room_nameパラメータは100文字以内で指定する必要があります。", http.StatusBadRequest)
+		return
+	}
+	if room.FloorID, ok = roomFloorParam(w, r, ctx, buildings, scope); !ok {
+		return
+	}
+
+	roomID, err := rooms.CreateRoom(ctx, room)
+	if err != nil {
+		logError(ctx, "ルームの登録に失敗しました: %v", err)
+		http.Error(w, "ルームの登録に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	room.RoomID = roomID
+
+	recordAudit(ctx, audit, r, "rooms.create", fmt.Sprintf("room:%d", roomID), fmt.Sprintf("name=%s", room.RoomName))
+	logInfo(ctx, "ルーム %s（ID %d）を登録しました", room.RoomName, roomID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(room); err != nil {
+		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
+	}
+}
+
+// handleAdminRoomUpdate はルームの名前（room_name）・階（floor_id、空の場合は割り当てを解除）のうち指定したものを変更します。
+// 建物の管理者は管理する建物のルームを、管理する建物の階にだけ移せます
+func handleAdminRoomUpdate(w http.ResponseWriter, r *http.Request, ctx context.Context, presence PresenceStore, scopes BuildingAdminStore, buildings BuildingStore, rooms RoomAdminStore, audit AuditStore, roomID int) {
+	scope, ok := requireScopedAdmin(w, r, ctx, presence, scopes, buildings)
+	if !ok {
+		return
+	}
+
+	room, err := rooms.ManagedRoom(ctx, roomID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "ルームが見つかりません", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logError(ctx, "ルームの取得に失敗しました: %v", err)
+		http.Error(w, "ルームの取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	if !scope.allowsRoom(&room.RoomID) {
+		logError(ctx, "管理していないルームの変更が要求されました: %s room=%d", getUserID(r), roomID)
+		http.Error(w, "このルームを管理する権限がありません", http.StatusForbidden)
+		return
+	}
+
+	if name := strings.TrimSpace(r.FormValue("room_name")); name != "" {
+		if len(name) > 100 {
+			logError(ctx, "ルーム名が無効です: %q", name)
+			http.Error(w, "room_nameパラメータは100文字以内で指定する必要があります。", http.StatusBadRequest)
+			return
+		}
+		room.RoomName = name
+	}
+	if _, present := r.Form["floor_id"]; present {
+		if room.FloorID, ok = roomFloorParam(w, r, ctx, buildings, scope); !ok {
+			return
+		}
+	}
+
+	if err := rooms.UpdateRoom(ctx, room); err == sql.ErrNoRows {
+		http.Error(w, "ルームが見つかりません", http.StatusNotFound)
+		return
+	} else if err != nil {
+		logError(ctx, "ルームの変更に失敗しました: %v", err)
+		http.Error(w, "ルームの変更に失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	floor := "none"
+	if room.FloorID != nil {
+		floor = strconv.Itoa(*room.FloorID)
+	}
+	recordAudit(ctx, audit, r, "rooms.update", fmt.Sprintf("room:%d", roomID), fmt.Sprintf("name=%s floor=%s", room.RoomName, floor))
+	logInfo(ctx, "ルーム %d を変更しました", roomID)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(room); err != nil {
+		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
+	}
+}
+
+// beaconRoomParam は room_id パラメータのルームを返します。空の場合は nil（ルームに割り当てない）を返しますが、
+// 建物の管理者はビーコンを管理するルームに割り当てる必要があります。指定できない場合はエラー応答を返し、false を返します
+func beaconRoomParam(w http.ResponseWriter, r *http.Request, ctx context.Context, rooms RoomAdminStore, scope *adminScope) (*int, bool) {
+	var roomID *int
+	if value := r.FormValue("room_id"); value != "" {
+		id, err := strconv.Atoi(value)
+		if err != nil {
+			logError(ctx, "room_idパラメータが無効です: %s", value)
+			http.Error(w, "room_idパラメータは整数である必要があります。", http.StatusBadRequest)
+			return nil, false
+		}
+		if _, err := rooms.ManagedRoom(ctx, id); err == sql.ErrNoRows {
+			logError(ctx, "ルームが見つかりません: %d", id)
+			http.Error(w, "room_idのルームが見つかりません", http.StatusBadRequest)
+			return nil, false
+		} else if err != nil {
+			logError(ctx, "ルームの取得に失敗しました: %v", err)
+			http.Error(w, "ルームの取得に失敗しました", http.StatusInternalServerError)
+			return nil, false
+		}
+		roomID = &id
+	}
+	if !scope.allowsRoom(roomID) {
+		logError(ctx, "管理していないルームへのビーコンの割り当てが要求されました: %s", getUserID(r))
+		http.Error(w, "建物の管理者は room_id に管理するルームを指定する必要があります", http.StatusForbidden)
+		return nil, false
+	}
+	return roomID, true
+}
+
+// refreshDeviceCache はビーコンの登録を変更した後、[DeviceCache] が有効な場合にすぐに反映します
+func refreshDeviceCache(ctx context.Context, cache *deviceCache) {
+	if cache == nil {
+		return
+	}
+	if err := cache.refresh(ctx); err != nil {
+		logError(ctx, "%v（次の refresh_interval で読み直します）", err)
+	}
+}
+
+// handleAdminBeacons はビーコンの一覧を返します。建物の管理者には管理するルームに割り当てたビーコンだけを返します
+func handleAdminBeacons(w http.ResponseWriter, r *http.Request, ctx context.Context, presence PresenceStore, scopes BuildingAdminStore, buildings BuildingStore, rooms RoomAdminStore) {
+	scope, ok := requireScopedAdmin(w, r, ctx, presence, scopes, buildings)
+	if !ok {
+		return
+	}
+
+	all, err := rooms.ManagedBeacons(ctx)
+	if err != nil {
+		logError(ctx, "ビーコンの取得に失敗しました: %v", err)
+		http.Error(w, "ビーコンの取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	response := ManagedBeaconListResponse{Beacons: []ManagedBeacon{}}
+	for _, beacon := range all {
+		if scope.allowsRoom(beacon.RoomID) {
+			response.Beacons = append(response.Beacons, beacon)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
+		http.Error(w, "JSON応答のエンコードに失敗しました", http.StatusInternalServerError)
+	}
+}
+
+// handleAdminBeaconCreate はサービスUUID service_uuid のビーコン beacon_name を登録し、room_id のルームに割り当てます
+func handleAdminBeaconCreate(w http.ResponseWriter, r *http.Request, ctx context.Context, presence PresenceStore, scopes BuildingAdminStore, buildings BuildingStore, rooms RoomAdminStore, audit AuditStore, cache *deviceCache) {
+	scope, ok := requireScopedAdmin(w, r, ctx, presence, scopes, buildings)
+	if !ok {
+		return
+	}
+
+	beacon := ManagedBeacon{
+		BeaconName:  strings.TrimSpace(r.FormValue("beacon_name")),
+		ServiceUUID: strings.TrimSpace(r.FormValue("service_uuid")),
+	}
+	if beacon.BeaconName == "" || len(beacon.BeaconName) > 100 {
+		logError(ctx, "ビーコン名が無効です: %q", beacon.BeaconName)
+		http.Error(w, "beacon_nameパラメータは100文字以内で指定する必要があります。", http.StatusBadRequest)
+		return
+	}
+	if beacon.ServiceUUID == "" || len(beacon.ServiceUUID) > 36 {
+		logError(ctx, "サービスUUIDが無効です: %q", beacon.ServiceUUID)
+		http.Error(w, "service_uuidパラメータは36文字以内で指定する必要があります。", http.StatusBadRequest)
+		return
+	}
+	if beacon.RoomID, ok = beaconRoomParam(w, r, ctx, rooms, scope); !ok {
+		return
+	}
+
+	beaconID, err := rooms.CreateBeacon(ctx, beacon)
+	if err != nil {
+		logError(ctx, "ビーコンの登録に失敗しました: %v", err)
+		http.Error(w, "ビーコンの登録に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	beacon.BeaconID = beaconID
+	refreshDeviceCache(ctx, cache)
+
+	recordAudit(ctx, audit, r, "beacons.create", fmt.Sprintf("beacon:%d", beaconID), fmt.Sprintf("service_uuid=%s", beacon.ServiceUUID))
+	logInfo(ctx, "ビーコン %s（ID %d）を登録しました", beacon.BeaconName, beaconID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(beacon); err != nil {
+		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
+	}
+}
+
+// managedBeacon は beaconID のビーコンを返します。存在しない・管理できないビーコンの場合はエラー応答を返し、false を返します
+func managedBeacon(w http.ResponseWriter, r *http.Request, ctx context.Context, rooms RoomAdminStore, scope *adminScope, beaconID int) (ManagedBeacon, bool) {
+	beacon, err := rooms.ManagedBeacon(ctx, beaconID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "ビーコンが見つかりません", http.StatusNotFound)
+		return ManagedBeacon{}, false
+	}
+	if err != nil {
+		logError(ctx, "ビーコンの取得に失敗しました: %v", err)
+		http.Error(w, "ビーコンの取得に失敗しました", http.StatusInternalServerError)
+		return ManagedBeacon{}, false
+	}
+	if !scope.allowsRoom(beacon.RoomID) {
+		logError(ctx, "管理していないビーコンの変更が要求されました: %s beacon=%d", getUserID(r), beaconID)
+		http.Error(w, "このビーコンを管理する権限がありません", http.StatusForbidden)
+		return ManagedBeacon{}, false
+	}
+	return beacon, true
+}
+
+// handleAdminBeaconUpdate はビーコンの名前（beacon_name）・ルーム（room_id、空の場合は割り当てを解除）のうち指定したものを変更します
+func handleAdminBeaconUpdate(w http.ResponseWriter, r *http.Request, ctx context.Context, presence PresenceStore, scopes BuildingAdminStore, buildings BuildingStore, rooms RoomAdminStore, audit AuditStore, cache *deviceCache, beaconID int) {
+	scope, ok := requireScopedAdmin(w, r, ctx, presence, scopes, buildings)
+	if !ok {
+		return
+	}
+	beacon, ok := managedBeacon(w, r, ctx, rooms, scope, beaconID)
+	if !ok {
+		return
+	}
+
+	if name := strings.TrimSpace(r.FormValue("beacon_name")); name != "" {
+		if len(name) > 100 {
+			logError(ctx, "ビーコン名が無効です: %q", name)
+			http.Error(w, "beacon_nameパラメータは100文字以内で指定する必要があります。", http.StatusBadRequest)
+			return
+		}
+		beacon.BeaconName = name
+	}
+	if _, present := r.Form["room_id"]; present {
+		if beacon.RoomID, ok = beaconRoomParam(w, r, ctx, rooms, scope); !ok {
+			return
+		}
+	}
+
+	if err := rooms.UpdateBeacon(ctx, beacon); err == sql.ErrNoRows {
+		http.Error(w, "ビーコンが見つかりません", http.StatusNotFound)
+		return
+	} else if err != nil {
+		logError(ctx, "ビーコンの変更に失敗しました: %v", err)
+		http.Error(w, "ビーコンの変更に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	refreshDeviceCache(ctx, cache)
+
+	room := "none"
+	if beacon.RoomID != nil {
+		room = strconv.Itoa(*beacon.RoomID)
+	}
+	recordAudit(ctx, audit, r, "beacons.update", fmt.Sprintf("beacon:%d", beaconID), fmt.Sprintf("name=%s room=%s", beacon.BeaconName, room))
+	logInfo(ctx, "ビーコン %d を変更しました", beaconID)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(beacon); err != nil {
+		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
+	}
+}
+
+func handleAdminBeaconDelete(w http.ResponseWriter, r *http.Request, ctx context.Context, presence PresenceStore, scopes BuildingAdminStore, buildings BuildingStore, rooms RoomAdminStore, audit AuditStore, cache *deviceCache, beaconID int) {
+	scope, ok := requireScopedAdmin(w, r, ctx, presence, scopes, buildings)
+	if !ok {
+		return
+	}
+	if _, ok := managedBeacon(w, r, ctx, rooms, scope, beaconID); !ok {
+		return
+	}
+
+	if err := rooms.DeleteBeacon(ctx, beaconID); err == sql.ErrNoRows {
+		http.Error(w, "ビーコンが見つかりません", http.StatusNotFound)
+		return
+	} else if err != nil {
+		logError(ctx, "ビーコンの削除に失敗しました: %v", err)
+		http.Error(w, "ビーコンの削除に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	refreshDeviceCache(ctx, cache)
+
+	recordAudit(ctx, audit, r, "beacons.delete", fmt.Sprintf("beacon:%d", beaconID), "")
+	logInfo(ctx, "ビーコン %d を削除しました", beaconID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleHealthCheck(w http.ResponseWriter, r *http.Request, ctx context.Context, presence PresenceStore, instanceID string, loc *time.Location) {
+	response := HealthCheckResponse{
+		Status:       "ok",
+		Instance:     instanceID,
+		Registration: currentRegistrationState(),
+		Proxies:      registrationStatesByProxy(),
+		Timestamp:    time.Now().In(loc).Format(time.RFC3339),
+	}
+
+	if err := presence.PingContext(ctx); err != nil {
+		response.Status = "error"
+		response.Database = "Unavailable"
+	} else {
+		response.Database = "Available"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if response.Status == "ok" {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logError(ctx, "HealthCheck JSON応答のエンコードに失敗しました: %v", err)
+	}
+}
+
+func isAdminUser(ctx context.Context, presence PresenceStore, username string) (bool, error) {
+	isAdmin, err := presence.IsAdmin(ctx, username)
+	if err != nil {
+		logError(ctx, "ロールの確認に失敗しました: %v", err)
+		return false, err
+	}
+	return isAdmin, nil
+}
+
+// requireAdmin はリクエスト元が管理者でない場合にエラー応答を返し、falseを返します
+func requireAdmin(w http.ResponseWriter, r *http.Request, ctx context.Context, presence PresenceStore) bool {
+	username := getUserID(r)
+	isAdmin, err := isAdminUser(ctx, presence, username)
+	if err != nil {
+		http.Error(w, "ロールの確認に失敗しました", http.StatusInternalServerError)
+		return false
+	}
+	if !isAdmin {
+		logError(ctx, "管理者権限のないユーザーがアクセスしました: %s", username)
+		http.Error(w, "管理者権限が必要です", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// requireSystemAdmin はサーバー全体に影響する操作（保持期間の適用・設定の再読み込みなど）のために、
+// リクエストを送ったユーザーが既定の組織の管理者であることを確認します
+func requireSystemAdmin(w http.ResponseWriter, r *http.Request, ctx context.Context, presence PresenceStore) bool {
+	if !requireAdmin(w, r, ctx, presence) {
+		return false
+	}
+	if orgID := orgFromContext(ctx); orgID != 0 && orgID != defaultOrgID {
+		logError(ctx, "既定の組織以外の管理者がサーバー全体の操作にアクセスしました: %s", getUserID(r))
+		http.Error(w, "この操作は既定の組織の管理者のみ実行できます", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// adminScope は建物の管理を委任されたユーザーが管理できる建物・階・ルームです。nil の場合は組織の管理者で、組織全体を管理できます
+type adminScope struct {
+	buildings map[int]bool
+	floors    map[int]bool
+	rooms     map[int]bool
+}
+
+func (s *adminScope) allowsBuilding(buildingID int) bool {
+	return s == nil || s.buildings[buildingID]
+}
+
+func (s *adminScope) allowsFloor(floorID int) bool {
+	return s == nil || s.floors[floorID]
+}
+
+// allowsRoom は roomID が管理できるルームかを返します。roomID が nil（ルームに割り当てていない）の場合は組織の管理者だけが管理できます
+func (s *adminScope) allowsRoom(roomID *int) bool {
+	return s == nil || (roomID != nil && s.rooms[*roomID])
+}
+
+// filterSessions は管理できるルームのセッションだけを返します
+func (s *adminScope) filterSessions(sessions []PresenceSession) []PresenceSession {
+	if s == nil {
+		return sessions
+	}
+	filtered := make([]PresenceSession, 0, len(sessions))
+	for _, session := range sessions {
+		if s.rooms[session.RoomID] {
+			filtered = append(filtered, session)
+		}
+	}
+	return filtered
+}
+
+// requireScopedAdmin はリクエスト元が組織の管理者または建物の管理を委任されたユーザーであることを確認し、管理できる範囲を返します。
+// どちらでもない場合はエラー応答を返し、false を返します
+func requireScopedAdmin(w http.ResponseWriter, r *http.Request, ctx context.Context, presence PresenceStore, scopes BuildingAdminStore, buildings BuildingStore) (*adminScope, bool) {
+	username := getUserID(r)
+	isAdmin, err := isAdminUser(ctx, presence, username)
+	if err != nil {
+		http.Error(w, "ロールの確認に失敗しました", http.StatusInternalServerError)
+		return nil, false
+	}
+	if isAdmin {
+		return nil, true
+	}
+
+	buildingIDs, err := scopes.AdminBuildingIDs(ctx, username)
+	if err != nil {
+		logError(ctx, "建物の管理の委任の確認に失敗しました: %v", err)
+		http.Error(w, "ロールの確認に失敗しました", http.StatusInternalServerError)
+		return nil, false
+	}
+	if len(buildingIDs) == 0 {
+		logError(ctx, "管理者権限のないユーザーがアクセスしました: %s", username)
+		http.Error(w, "管理者権限が必要です", http.StatusForbidden)
+		return nil, false
+	}
+
+	scope := &adminScope{buildings: make(map[int]bool), floors: make(map[int]bool), rooms: make(map[int]bool)}
+	for _, buildingID := range buildingIDs {
+		scope.buildings[buildingID] = true
+	}
+	all, err := buildings.Buildings(ctx)
+	if err != nil {
+		logError(ctx, "建物の取得に失敗しました: %v", err)
+		http.Error(w, "建物の取得に失敗しました", http.StatusInternalServerError)
+		return nil, false
+	}
+	for _, building := range all {
+		if !scope.buildings[building.BuildingID] {
+			continue
+		}
+		for _, floor := range building.Floors {
+			scope.floors[floor.FloorID] = true
+			for _, roomID := range floor.RoomIDs {
+				scope.rooms[roomID] = true
+			}
+		}
+	}
+	return scope, true
+}
+
+// handleAdminPresenceDecisions は在室判定の記録を新しい順に返します。建物の管理者には管理するルームの判定だけを返し、
+// その場合の limit は絞り込む前の件数です
+func handleAdminPresenceDecisions(w http.ResponseWriter, r *http.Request, ctx context.Context, presence PresenceStore, scopes BuildingAdminStore, buildings BuildingStore) {
+	scope, ok := requireScopedAdmin(w, r, ctx, presence, scopes, buildings)
+	if !ok {
+		return
+	}
+
+	limit := 100
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		parsed, err := strconv.Atoi(limitStr)
+		if err != nil || parsed <= 0 {
+			logError(ctx, "limitパラメータが無効です: %s", limitStr)
+			http.Error(w, "limitパラメータは正の整数である必要があります。", http.StatusBadRequest)
+			return
+		}
+		if parsed > 1000 {
+			parsed = 1000
+		}
+		limit = parsed
+	}
+
+	var userFilter *int
+	if userIDStr := r.URL.Query().Get("user_id"); userIDStr != "" {
+		userID, err := strconv.Atoi(userIDStr)
+		if err != nil {
+			logError(ctx, "user_idパラメータが無効です: %v", err)
+			http.Error(w, "user_idパラメータは整数である必要があります。", http.StatusBadRequest)
+			return
+		}
+		userFilter = &userID
+	}
+
+	decisions, err := presence.ListDecisions(ctx, userFilter, limit)
+	if err != nil {
+		logError(ctx, "在室判定の取得に失敗しました: %v", err)
+		http.Error(w, "在室判定の取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	if scope != nil {
+		filtered := make([]PresenceDecision, 0, len(decisions))
+		for _, decision := range decisions {
+			if scope.allowsRoom(decision.RoomID) {
+				filtered = append(filtered, decision)
+			}
+		}
+		decisions = filtered
+	}
+
+	response := PresenceDecisionsResponse{
+		Decisions: decisions,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
+		http.Error(w, "JSON応答のエンコードに失敗しました", http.StatusInternalServerError)
+	}
+}
+
+// cleanUpOldSessions は [Session] inactivity_timeout（組織ごとの設定で上書きした場合はその値）の間信号のないユーザーのセッションを
+// interval ごとに終了し、終了したセッションごとに session_expired のイベントをログに記録します
+func cleanUpOldSessions(ctx context.Context, presence PresenceStore, orgs OrgStore, tenants TenantSettingsStore, leases *jobLeases, interval time.Duration, loc *time.Location) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		<-ticker.C
+		if !leases.hold(ctx, "session_cleanup", interval) {
+			continue
+		}
+		overrides, err := tenants.AllTenantSettings(ctx)
+		if err != nil {
+			logError(ctx, "組織ごとの設定の取得に失敗しました: %v", err)
+			continue
+		}
+		now := time.Now().In(loc)
+		timeout := currentSettings().InactivityTimeout
+
+		err = forEachTenant(ctx, orgs, overrides, func(ctx context.Context, settings TenantSettings) {
+			cutoffTime := now.Add(-settings.inactivityTimeout(timeout))
+			ended, err := presence.EndStaleSessions(ctx, cutoffTime, now)
+			if err != nil {
+				logError(ctx, "古いセッションの終了に失敗しました: %v", err)
+				return
+			}
+
+			atomic.AddUint64(&sessionsExpired, uint64(len(ended)))
+			for _, session := range ended {
+				logger.Info("信号のないユーザーのセッションを終了しました", append(logAttrs(ctx),
+					"event", "session_expired",
+					"session_id", session.SessionID,
+					"user_id", session.UserID,
+					"room_id", session.RoomID,
+					"last_seen", session.LastSeen.In(loc).Format(time.RFC3339))...)
+			}
+		})
+		if err != nil {
+			logError(ctx, "組織の一覧取得に失敗しました: %v", err)
+		}
+	}
+}
+
+// repairDuplicateOpenSessions は開いたセッションが重複しているユーザーごとに最も新しいセッションだけを残し、
+// 他のセッションを最後に信号を受信した時刻で終了します。dryRun の場合は終了する予定のセッションを返すだけです
+func repairDuplicateOpenSessions(ctx context.Context, presence PresenceStore, dryRun bool) (SessionRepairResponse, error) {
+	response := SessionRepairResponse{DryRun: dryRun, Users: []SessionRepairUser{}}
+
+	sessions, err := presence.DuplicateOpenSessions(ctx)
+	if err != nil {
+		return response, fmt.Errorf("重複したセッションの取得に失敗しました: %v", err)
+	}
+
+	// sessions はユーザー・開始時刻の順なので、ユーザーごとの最後のセッションが最も新しいものです
+	for start := 0; start < len(sessions); {
+		end := start
+		for end < len(sessions) && sessions[end].UserID == sessions[start].UserID {
+			end++
+		}
+		group := sessions[start:end]
+		start = end
+
+		user := SessionRepairUser{
+			UserID: group[0].UserID,
+			Kept:   group[len(group)-1],
+			Closed: []PresenceSession{},
+		}
+		if dryRun {
+			user.Closed = append(user.Closed, group[:len(group)-1]...)
+		} else {
+			unlock := presenceLocks.lock(user.UserID)
+			for _, session := range group[:len(group)-1] {
+				closed, err := presence.CloseSessionAtLastSeen(ctx, session.SessionID)
+				if err != nil {
+					unlock()
+					return response, fmt.Errorf("セッション %d の終了に失敗しました: %v", session.SessionID, err)
+				}
+				if closed == 0 {
+					// 取得してから終了するまでの間に信号の送信などで終了していた場合です
+					continue
+				}
+				endTime := session.LastSeen
+				session.EndTime = &endTime
+				user.Closed = append(user.Closed, session)
+			}
+			unlock()
+		}
+		response.Closed += len(user.Closed)
+		response.Users = append(response.Users, user)
+	}
+	return response, nil
+}
+
+// checkDuplicateOpenSessions は同じユーザーに開いたセッションが重複していないかを確認し、重複していれば警告を記録します
+func checkDuplicateOpenSessions(ctx context.Context, presence PresenceStore) {
+	report, err := repairDuplicateOpenSessions(ctx, presence, true)
+	if err != nil {
+		logError(ctx, "%v", err)
+		return
+	}
+	if len(report.Users) == 0 {
+		return
+	}
+	logger.Warn("開いたセッションが重複しているユーザーがいます。POST /api/admin/sessions/repair で最も新しいセッション以外を終了できます",
+		append(logAttrs(ctx), "users", len(report.Users), "sessions", report.Closed)...)
+}
+
+func handleAdminSessionRepair(w http.ResponseWriter, r *http.Request, ctx context.Context, presence PresenceStore, audit AuditStore) {
+	if !requireAdmin(w, r, ctx, presence) {
+		return
+	}
+
+	dryRun := false
+	if dryRunStr := r.URL.Query().Get("dry_run"); dryRunStr != "" {
+		parsed, err := strconv.ParseBool(dryRunStr)
+		if err != nil {
+			logError(ctx, "dry_runパラメータが無効です: %s", dryRunStr)
+			http.Error(w, "dry_runパラメータは true または false である必要があります。", http.StatusBadRequest)
+			return
+		}
+		dryRun = parsed
+	}
+
+	response, err := repairDuplicateOpenSessions(ctx, presence, dryRun)
+	if err != nil {
+		logError(ctx, "%v", err)
+		http.Error(w, "重複したセッションの修復に失敗しました", failureStatus(ctx))
+		return
+	}
+	if !dryRun {
+		if response.Closed > 0 {
+			logInfo(ctx, "重複して開いていたセッションを %d 件終了しました（ユーザー %d 人）", response.Closed, len(response.Users))
+		}
+		recordAudit(ctx, audit, r, "sessions.repair", "user_presence_sessions", fmt.Sprintf("users=%d closed=%d", len(response.Users), response.Closed))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
+	}
+}
+
+// purgeCutoff は保持期間 months を過ぎたとみなす時刻を返します
+func purgeCutoff(months int, loc *time.Location) time.Time {
+	return time.Now().In(loc).AddDate(0, -months, 0)
+}
+
+func handleAdminPurge(w http.ResponseWriter, r *http.Request, ctx context.Context, presence PresenceStore, config RetentionConfig, loc *time.Location) {
+	if !requireSystemAdmin(w, r, ctx, presence) {
+		return
+	}
+
+	months := config.Months
+	if monthsStr := r.URL.Query().Get("months"); monthsStr != "" {
+		parsed, err := strconv.Atoi(monthsStr)
+		if err != nil || parsed <= 0 {
+			logError(ctx, "monthsパラメータが無効です: %s", monthsStr)
+			http.Error(w, "monthsパラメータは正の整数である必要があります。", http.StatusBadRequest)
+			return
+		}
+		months = parsed
+	}
+	if months <= 0 {
+		logError(ctx, "保持期間が設定されていません")
+		http.Error(w, "保持期間が設定されていません。monthsパラメータを指定してください。", http.StatusBadRequest)
+		return
+	}
+
+	cutoff := purgeCutoff(months, loc)
+	// サーバー全体の操作のため、すべての組織のセッションを削除します
+	removed, err := presence.PurgeSessions(withOrg(ctx, 0), cutoff, config.Archive, time.Now().In(loc))
+	if err != nil {
+		logError(ctx, "古いセッションの削除に失敗しました: %v", err)
+		http.Error(w, "古いセッションの削除に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	logInfo(ctx, "%s より前に終了したセッションを %d 件削除しました（アーカイブ: %v）", cutoff.Format("2006-01-02"), removed, config.Archive)
+
+	response := PurgeResponse{
+		Removed:  removed,
+		Archived: config.Archive,
+		Cutoff:   cutoff,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
+		http.Error(w, "JSON応答のエンコードに失敗しました", http.StatusInternalServerError)
+	}
+}
+
+// purgeUploads は cutoff より前に保存されたアップロードファイルを削除します。
+// archive が nil でなければ削除前にそちらへコピーし、コピーに失敗したファイルは削除しません
+func purgeUploads(ctx context.Context, blobs BlobStore, archive BlobStore, cutoff time.Time) (UploadPurgeResponse, error) {
+	result := UploadPurgeResponse{Cutoff: cutoff}
+
+	blobInfos, err := blobs.List(ctx, "uploads")
+	if err != nil {
+		return result, fmt.Errorf("アップロードファイルの一覧取得に失敗しました: %v", err)
+	}
+
+	for _, info := range blobInfos {
+		if !info.ModTime.Before(cutoff) {
+			continue
+		}
+
+		if archive != nil {
+			if err := copyBlob(ctx, blobs, archive, info); err != nil {
+				logError(ctx, "アップロードファイル %s のアーカイブに失敗しました: %v", info.Key, err)
+				continue
+			}
+			result.Archived++
+		}
+
+		if err := blobs.Delete(ctx, info.Key); err != nil {
+			logError(ctx, "アップロードファイル %s の削除に失敗しました: %v", info.Key, err)
+			continue
+		}
+		result.Removed++
+		result.BytesReclaimed += info.Size
+	}
+
+	atomic.AddUint64(&uploadFilesRemoved, uint64(result.Removed))
+	atomic.AddUint64(&uploadFilesArchived, uint64(result.Archived))
+	atomic.AddUint64(&uploadBytesReclaimed, uint64(result.BytesReclaimed))
+	atomic.StoreInt64(&uploadRetentionLastRun, time.Now().Unix())
+	return result, nil
+}
+
+// copyBlob は src のオブジェクトを同じキーで dst にコピーします。
+// 同じ鍵で暗号化するストアの間では、復号せずに暗号化したままコピーします（info.Size は暗号化したオブジェクトの大きさです）
+func copyBlob(ctx context.Context, src BlobStore, dst BlobStore, info BlobInfo) error {
+	if encryptedSrc, ok := src.(*encryptedBlobStore); ok {
+		if encryptedDst, ok := dst.(*encryptedBlobStore); ok && encryptedSrc.aead == encryptedDst.aead {
+			src, dst = encryptedSrc.BlobStore, encryptedDst.BlobStore
+		}
+	}
+	reader, err := src.Get(ctx, info.Key)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	return dst.Put(ctx, info.Key, reader, info.Size)
+}
+
+// purgeFingerprints は cutoff より前に収集したフィンガープリントデータの記録・保存ファイル・推定用のファイルを削除し、
+// 削除した件数と保存ファイルの合計サイズを返します
+func purgeFingerprints(ctx context.Context, fingerprints FingerprintStore, blobs BlobStore, cutoff time.Time, loc *time.Location) (int64, int64, error) {
+	// 削除しながら一覧を進めるとカーソルがずれるため、対象を集めてから削除します
+	var expired []FingerprintSample
+	filter := FingerprintSampleFilter{Limit: maxPageSize}
+	for {
+		samples, err := fingerprints.ListFingerprintSamples(ctx, filter)
+		if err != nil {
+			return 0, 0, fmt.Errorf("フィンガープリントデータの一覧取得に失敗しました: %v", err)
+		}
+		for _, sample := range samples {
+			if fromWallClock(sample.CollectedAt, loc).Before(cutoff) {
+				expired = append(expired, sample)
+			}
+		}
+		if len(samples) < filter.Limit {
+			break
+		}
+		filter.AfterID = samples[len(samples)-1].SampleID
+	}
+
+	var removed, bytesReclaimed int64
+	for _, sample := range expired {
+		if err := fingerprints.DeleteFingerprintSample(ctx, sample.SampleID); err != nil {
+			logError(ctx, "フィンガープリントデータ %d の削除に失敗しました: %v", sample.SampleID, err)
+			continue
+		}
+		deleteFingerprintFiles(ctx, blobs, sample)
+		removed++
+		bytesReclaimed += sample.WifiSize + sample.BleSize
+	}
+	return removed, bytesReclaimed, nil
+}
+
+// retentionEnforcer は [RetentionPolicy] に従って保持期間を過ぎたデータを分類ごとに削除し、直前の結果を保持します
+type retentionEnforcer struct {
+	running      sync.Mutex
+	mu           sync.Mutex
+	presence     PresenceStore
+	fingerprints FingerprintStore
+	orgs         OrgStore
+	tenants      TenantSettingsStore
+	blobs        BlobStore
+	archive      BlobStore
+	policy       RetentionPolicyConfig
+	loc          *time.Location
+	last         *RetentionReport
+}
+
+func newRetentionEnforcer(presence PresenceStore, fingerprints FingerprintStore, orgs OrgStore, tenants TenantSettingsStore, blobs BlobStore, archive BlobStore, policy RetentionPolicyConfig, loc *time.Location) *retentionEnforcer {
+	return &retentionEnforcer{presence: presence, fingerprints: fingerprints, orgs: orgs, tenants: tenants, blobs: blobs, archive: archive, policy: policy, loc: loc}
+}
+
+// schedule は起動時と interval ごとに、リースを保持している場合のみ enforce を実行します
+func (e *retentionEnforcer) schedule(ctx context.Context, leases *jobLeases) {
+	ticker := time.NewTicker(e.policy.Interval)
+	defer ticker.Stop()
+
+	for {
+		if leases.hold(ctx, "retention", e.policy.Interval) {
+			e.enforce(ctx)
+		}
+		<-ticker.C
+	}
+}
+
+// enforce は保持期間を指定したすべての分類について、保持期間を過ぎたデータを削除します。
+// 組織ごとの設定で保持期間を上書きした分類は組織ごとに削除し、上書きした組織の結果は org_id を付けて別に記録します。
+// 1つの分類の削除に失敗しても他の分類は続け、失敗は結果の error に記録します。同時に実行した場合は前の実行の終了を待ちます
+func (e *retentionEnforcer) enforce(ctx context.Context) RetentionReport {
+	e.running.Lock()
+	defer e.running.Unlock()
+
+	// 保持期間はサーバー全体に適用するため、管理者のリクエストから実行した場合も組織で絞り込みません
+	ctx = withOrg(ctx, 0)
+	report := RetentionReport{StartedAt: time.Now().In(e.loc), Categories: []RetentionCategoryResult{}}
+	overrides, err := e.tenants.AllTenantSettings(ctx)
+	if err != nil {
+		logError(ctx, "組織ごとの設定の取得に失敗したため、設定ファイルの保持期間のみ適用します: %v", err)
+	}
+	var organizations []Organization
+	for _, category := range retentionCategories {
+		rule, ok := e.policy.Categories[category]
+		ok = ok && (rule.Days != 0 || rule.Months != 0)
+
+		tenantRules := make(map[int]RetentionRule)
+		for orgID, settings := range overrides {
+			if tenantRule, set := settings.Retention[category]; set {
+				tenantRules[orgID] = tenantRule
+			}
+		}
+		if len(tenantRules) == 0 {
+			if ok {
+				report.Categories = append(report.Categories, e.apply(ctx, category, rule, report.StartedAt))
+			}
+			continue
+		}
+
+		if organizations == nil {
+			if organizations, err = e.orgs.Organizations(ctx); err != nil {
+				logError(ctx, "組織の一覧取得に失敗しました: %v", err)
+				report.Categories = append(report.Categories, RetentionCategoryResult{Category: category, Error: err.Error()})
+				continue
+			}
+		}
+		shared := RetentionCategoryResult{Category: category, Cutoff: report.StartedAt.AddDate(0, -rule.Months, -rule.Days)}
+		for _, org := range organizations {
+			orgCtx := withOrg(ctx, org.OrgID)
+			tenantRule, set := tenantRules[org.OrgID]
+			switch {
+			case set && (tenantRule.Days != 0 || tenantRule.Months != 0):
+				result := e.apply(orgCtx, category, tenantRule, report.StartedAt)
+				result.OrgID = org.OrgID
+				report.Categories = append(report.Categories, result)
+			case !set && ok:
+				result := e.apply(orgCtx, category, rule, report.StartedAt)
+				shared.Removed += result.Removed
+				shared.Archived += result.Archived
+				shared.BytesReclaimed += result.BytesReclaimed
+				if result.Error != "" && shared.Error == "" {
+					shared.Error = result.Error
+				}
+			}
+		}
+		if ok {
+			report.Categories = append(report.Categories, shared)
+		}
+	}
+	report.FinishedAt = time.Now().In(e.loc)
+
+	e.mu.Lock()
+	e.last = &report
+	e.mu.Unlock()
+	return report
+}
+
+// apply は category の rule の保持期間を過ぎたデータを削除し、結果をログに記録して返します
+func (e *retentionEnforcer) apply(ctx context.Context, category string, rule RetentionRule, startedAt time.Time) RetentionCategoryResult {
+	result := RetentionCategoryResult{Category: category, Cutoff: startedAt.AddDate(0, -rule.Months, -rule.Days)}
+	if err := e.purge(ctx, category, rule, &result); err != nil {
+		result.Error = err.Error()
+		logError(ctx, "保持期間を過ぎた %s の削除に失敗しました: %v", category, err)
+	} else if result.Removed > 0 {
+		logInfo(ctx, "%s より前の %s を %d 件削除しました（アーカイブ: %d 件, 解放: %d バイト）", result.Cutoff.Format("2006-01-02"), category, result.Removed, result.Archived, result.BytesReclaimed)
+	}
+	return result
+}
+
+// purge は category の cutoff より前のデータを削除し、件数を result に設定します
+func (e *retentionEnforcer) purge(ctx context.Context, category string, rule RetentionRule, result *RetentionCategoryResult) error {
+	var err error
+	switch category {
+	case retentionSessions:
+		result.Removed, err = e.presence.PurgeSessions(ctx, result.Cutoff, rule.Archive, time.Now().In(e.loc))
+		if rule.Archive {
+			result.Archived = result.Removed
+		}
+	case retentionDecisions:
+		result.Removed, err = e.presence.PurgeDecisions(ctx, result.Cutoff)
+	case retentionTransitions:
+		result.Removed, err = e.presence.PurgeTransitions(ctx, result.Cutoff)
+	case retentionUploads:
+		archive := e.archive
+		if !rule.Archive {
+			archive = nil
+		}
+		var purged UploadPurgeResponse
+		purged, err = purgeUploads(ctx, e.blobs, archive, result.Cutoff)
+		result.Removed, result.Archived, result.BytesReclaimed = purged.Removed, purged.Archived, purged.BytesReclaimed
+	case retentionFingerprints:
+		result.Removed, result.BytesReclaimed, err = purgeFingerprints(ctx, e.fingerprints, e.blobs, result.Cutoff, e.loc)
+	}
+	return err
+}
+
+// lastReport は直前の適用結果を返します。まだ適用していない場合は nil です
+func (e *retentionEnforcer) lastReport() *RetentionReport {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.last
+}
+
+// handleAdminRetention は保持期間ポリシーと直前の適用結果を返します。POST の場合はすぐに適用してその結果を返します
+func handleAdminRetention(w http.ResponseWriter, r *http.Request, ctx context.Context, presence PresenceStore, audit AuditStore, enforcer *retentionEnforcer) {
+	if !requireSystemAdmin(w, r, ctx, presence) {
+		return
+	}
+
+	var response interface{}
+	if r.Method == http.MethodPost {
+		report := enforcer.enforce(ctx)
+		var removed int64
+		for _, result := range report.Categories {
+			removed += result.Removed
+		}
+		recordAudit(ctx, audit, r, "retention.enforce", "retention_policy", fmt.Sprintf("removed=%d", removed))
+		response = report
+	} else {
+		response = RetentionPolicyResponse{
+			Interval:   enforcer.policy.Interval.String(),
+			Categories: enforcer.policy.Categories,
+			LastReport: enforcer.lastReport(),
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
+		http.Error(w, "JSON応答のエンコードに失敗しました", http.StatusInternalServerError)
+	}
+}
+
+func handleAdminUploadsPurge(w http.ResponseWriter, r *http.Request, ctx context.Context, presence PresenceStore, blobs BlobStore, archive BlobStore, config UploadRetentionConfig) {
+	if !requireSystemAdmin(w, r, ctx, presence) {
+		return
+	}
+
+	days := config.Days
+	if daysStr := r.URL.Query().Get("days"); daysStr != "" {
+		parsed, err := strconv.Atoi(daysStr)
+		if err != nil || parsed <= 0 {
+			logError(ctx, "daysパラメータが無効です: %s", daysStr)
+			http.Error(w, "daysパラメータは正の整数である必要があります。", http.StatusBadRequest)
+			return
+		}
+		days = parsed
+	}
+	if days <= 0 {
+		logError(ctx, "アップロードファイルの保持期間が設定されていません")
+		http.Error(w, "保持期間が設定されていません。daysパラメータを指定してください。", http.StatusBadRequest)
+		return
+	}
+
+	cutoff := time.Now().AddDate(0, 0, -days)
+	response, err := purgeUploads(ctx, blobs, archive, cutoff)
+	if err != nil {
+		logError(ctx, "古いアップロードファイルの削除に失敗しました: %v", err)
+		http.Error(w, "古いアップロードファイルの削除に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	logInfo(ctx, "%s より前のアップロードファイルを %d 件削除しました（アーカイブ: %d 件, 解放: %d バイト）", cutoff.Format("2006-01-02"), response.Removed, response.Archived, response.BytesReclaimed)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
+		http.Error(w, "JSON応答のエンコードに失敗しました", http.StatusInternalServerError)
+	}
+}
+
+func handleAdminUploadStats(w http.ResponseWriter, r *http.Request, ctx context.Context, presence PresenceStore, blobs BlobStore, config UploadRetentionConfig) {
+	if !requireSystemAdmin(w, r, ctx, presence) {
+		return
+	}
+
+	blobInfos, err := blobs.List(ctx, "uploads")
+	if err != nil {
+		logError(ctx, "アップロードファイルの一覧取得に失敗しました: %v", err)
+		http.Error(w, "アップロードファイルの一覧取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	response := UploadStatsResponse{
+		RetentionDays:            config.Days,
+		Archive:                  config.Archive,
+		StoredFiles:              len(blobInfos),
+		RemovedSinceStart:        atomic.LoadUint64(&uploadFilesRemoved),
+		ArchivedSinceStart:       atomic.LoadUint64(&uploadFilesArchived),
+		BytesReclaimedSinceStart: atomic.LoadUint64(&uploadBytesReclaimed),
+	}
+	for _, info := range blobInfos {
+		response.StoredBytes += info.Size
+	}
+	if lastRun := atomic.LoadInt64(&uploadRetentionLastRun); lastRun > 0 {
+		t := time.Unix(lastRun, 0)
+		response.LastRun = &t
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
+		http.Error(w, "JSON応答のエンコードに失敗しました", http.StatusInternalServerError)
+	}
+}
+
+var errQuotaExceeded = errors.New("容量制限を超えています")
+
+// storageUsage はユーザーごと・ルームごとの保存済みファイルの容量を保持します。
+// 保存先の一覧取得は重いため refresh_interval ごとにバックグラウンドで再集計し、その間は受け付けたアップロードのサイズを加算します
+type storageUsage struct {
+	mu        sync.Mutex
+	blobs     BlobStore
+	config    QuotaConfig
+	users     map[string]UserStorageUsage
+	rooms     map[roomStorageKey]RoomStorageUsage
+	updatedAt time.Time
+	// refreshing はバックグラウンドで再集計している間 true です
+	refreshing bool
+}
+
+// roomStorageKey は容量を集計する単位です。ネガティブサンプル（ルームID 0）を含め、ルームの容量は組織ごとに数えます
+type roomStorageKey struct {
+	orgID  int
+	roomID int
+}
+
+func newStorageUsage(blobs BlobStore, config QuotaConfig) *storageUsage {
+	return &storageUsage{blobs: blobs, config: config}
+}
+
+// scan は保存先を一覧してユーザーごと・ルームごとの使用量を集計します。mu は使いません
+func (u *storageUsage) scan(ctx context.Context) (map[string]UserStorageUsage, map[roomStorageKey]RoomStorageUsage, error) {
+	users := make(map[string]UserStorageUsage)
+	rooms := make(map[roomStorageKey]RoomStorageUsage)
+
+	uploads, err := u.blobs.List(ctx, "uploads")
+	if err != nil {
+		return nil, nil, fmt.Errorf("アップロードファイルの一覧取得に失敗しました: %v", err)
+	}
+	for _, info := range uploads {
+		// uploads/{日付}/{ユーザー名}/{ファイル名}
+		parts := strings.Split(info.Key, "/")
+		if len(parts) < 4 {
+			continue
+		}
+		user := users[parts[2]]
+		user.UserName = parts[2]
+		user.Files++
+		user.UsedBytes += info.Size
+		users[parts[2]] = user
+	}
+
+	fingerprintFiles, err := u.blobs.List(ctx, "manager_fingerprint")
+	if err != nil {
+		return nil, nil, fmt.Errorf("フィンガープリントデータの一覧取得に失敗しました: %v", err)
+	}
+	tenantFiles, err := u.blobs.List(ctx, "tenants")
+	if err != nil {
+		return nil, nil, fmt.Errorf("組織のフィンガープリントデータの一覧取得に失敗しました: %v", err)
+	}
+	for _, info := range append(fingerprintFiles, tenantFiles...) {
+		// [tenants/{組織ID}/]manager_fingerprint/{ルームID}/{ファイル名}
+		orgID, key := splitTenantKey(info.Key)
+		parts := strings.Split(key, "/")
+		if len(parts) < 3 || parts[0] != "manager_fingerprint" {
+			continue
+		}
+		roomID, err := strconv.Atoi(parts[1])
+		if err != nil {
+			continue
+		}
+		id := roomStorageKey{orgID: orgID, roomID: roomID}
+		room := rooms[id]
+		room.OrgID = orgID
+		room.RoomID = roomID
+		room.Files++
+		room.UsedBytes += info.Size
+		rooms[id] = room
+	}
+
+	return users, rooms, nil
+}
+
+// refresh は保存先を一覧して使用量を集計し直します。一覧と集計は mu を保持せずに行い、集計した結果の入れ替えだけを mu を保持して行います。
+// 一覧している間に加算したアップロードは、一覧に含まれなかった場合は次の再集計まで数えません
+func (u *storageUsage) refresh(ctx context.Context) error {
+	users, rooms, err := u.scan(ctx)
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.refreshing = false
+	if err != nil {
+		return err
+	}
+	u.users = users
+	u.rooms = rooms
+	u.updatedAt = time.Now()
+	return nil
+}
+
+// ensureFresh は集計が refresh_interval より古い場合に再集計します。まだ一度も集計していない場合はその場で集計し、
+// それ以外はバックグラウンドで集計して、終わるまでは現在の使用量を使います
+func (u *storageUsage) ensureFresh(ctx context.Context) error {
+	u.mu.Lock()
+	loaded := u.users != nil
+	if loaded && (u.refreshing || time.Since(u.updatedAt) < u.config.RefreshInterval) {
+		u.mu.Unlock()
+		return nil
+	}
+	u.refreshing = true
+	u.mu.Unlock()
+
+	if !loaded {
+		return u.refresh(ctx)
+	}
+	go func() {
+		refreshCtx := context.WithValue(context.Background(), requestIDKey, ctx.Value(requestIDKey))
+		if err := u.refresh(refreshCtx); err != nil {
+			logError(refreshCtx, "使用容量の再集計に失敗しました: %v", err)
+		}
+	}()
+	return nil
+}
+
+// reserveUser は username のシグナルデータとして size バイトを保存できるか確認し、できる場合は使用量に加算します。
+// 制限を超える場合は errQuotaExceeded を返します
+func (u *storageUsage) reserveUser(ctx context.Context, username string, size int64) error {
+	if u.config.UserBytes <= 0 {
+		return nil
+	}
+
+	if err := u.ensureFresh(ctx); err != nil {
+		return err
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	user := u.users[username]
+	if user.UsedBytes+size > u.config.UserBytes {
+		return errQuotaExceeded
+	}
+	user.UserName = username
+	user.Files += 2
+	user.UsedBytes += size
+	u.users[username] = user
+	return nil
+}
+
+// reserveRoom は roomID のフィンガープリントデータとして size バイトを保存できるか確認し、できる場合は使用量に加算します。
+// 制限を超える場合は errQuotaExceeded を返します
+func (u *storageUsage) reserveRoom(ctx context.Context, roomID int, size int64) error {
+	if u.config.RoomBytes <= 0 {
+		return nil
+	}
+
+	if err := u.ensureFresh(ctx); err != nil {
+		return err
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	id := roomStorageKey{orgID: recordOrg(ctx), roomID: roomID}
+	room := u.rooms[id]
+	if room.UsedBytes+size > u.config.RoomBytes {
+		return errQuotaExceeded
+	}
+	room.OrgID = id.orgID
+	room.RoomID = roomID
+	room.Files += 2
+	room.UsedBytes += size
+	u.rooms[id] = room
+	return nil
+}
+
+// releaseUser は保存に失敗したシグナルデータの分を reserveUser で加算した使用量から戻します
+func (u *storageUsage) releaseUser(username string, size int64) {
+	if u.config.UserBytes <= 0 {
+		return
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	user, ok := u.users[username]
+	if !ok {
+		return
+	}
+	// 加算した後に再集計した場合は、保存しなかったファイルが集計に含まれていないため戻しません
+	if user.Files >= 2 && user.UsedBytes >= size {
+		user.Files -= 2
+		user.UsedBytes -= size
+	}
+	u.users[username] = user
+}
+
+// releaseRoom は保存に失敗したフィンガープリントデータの分を reserveRoom で加算した使用量から戻します
+func (u *storageUsage) releaseRoom(ctx context.Context, roomID int, size int64) {
+	if u.config.RoomBytes <= 0 {
+		return
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	id := roomStorageKey{orgID: recordOrg(ctx), roomID: roomID}
+	room, ok := u.rooms[id]
+	if !ok {
+		return
+	}
+	// 加算した後に再集計した場合は、保存しなかったファイルが集計に含まれていないため戻しません
+	if room.Files >= 2 && room.UsedBytes >= size {
+		room.Files -= 2
+		room.UsedBytes -= size
+	}
+	u.rooms[id] = room
+}
+
+// report は保存先を集計し直して現在の使用量を返します
+func (u *storageUsage) report(ctx context.Context) (StorageUsageResponse, error) {
+	if err := u.refresh(ctx); err != nil {
+		return StorageUsageResponse{}, err
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	response := StorageUsageResponse{
+		UserQuotaBytes: u.config.UserBytes,
+		RoomQuotaBytes: u.config.RoomBytes,
+		Users:          []UserStorageUsage{},
+		Rooms:          []RoomStorageUsage{},
+		UpdatedAt:      u.updatedAt,
+	}
+	for _, user := range u.users {
+		response.Users = append(response.Users, user)
+	}
+	for _, room := range u.rooms {
+		response.Rooms = append(response.Rooms, room)
+	}
+	sort.Slice(response.Users, func(i, j int) bool { return response.Users[i].UserName < response.Users[j].UserName })
+	sort.Slice(response.Rooms, func(i, j int) bool {
+		if response.Rooms[i].OrgID != response.Rooms[j].OrgID {
+			return response.Rooms[i].OrgID < response.Rooms[j].OrgID
+		}
+		return response.Rooms[i].RoomID < response.Rooms[j].RoomID
+	})
+	return response, nil
+}
+
+func handleAdminStorage(w http.ResponseWriter, r *http.Request, ctx context.Context, presence PresenceStore, usage *storageUsage) {
+	if !requireSystemAdmin(w, r, ctx, presence) {
+		return
+	}
+
+	response, err := usage.report(ctx)
+	if err != nil {
+		logError(ctx, "使用容量の集計に失敗しました: %v", err)
+		http.Error(w, "使用容量の集計に失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
+		http.Error(w, "JSON応答のエンコードに失敗しました", http.StatusInternalServerError)
+	}
+}
+
+// storageVerifier は保存済みのフィンガープリントデータを読み直し、記録したSHA-256と一致するかを検証します。
+// 検証はバックグラウンドで1件ずつ実行し、最後の結果を保持します
+type storageVerifier struct {
+	mu           sync.Mutex
+	fingerprints FingerprintStore
+	blobs        BlobStore
+	report       StorageVerifyReport
+}
+
+func newStorageVerifier(fingerprints FingerprintStore, blobs BlobStore) *storageVerifier {
+	return &storageVerifier{fingerprints: fingerprints, blobs: blobs, report: StorageVerifyReport{Status: "idle", Issues: []StorageVerifyIssue{}}}
+}
+
+// start は検証を開始します。既に実行中の場合は false を返します
+func (v *storageVerifier) start(ctx context.Context) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.report.Status == "running" {
+		return false
+	}
+
+	startedAt := time.Now()
+	v.report = StorageVerifyReport{Status: "running", StartedAt: &startedAt, Issues: []StorageVerifyIssue{}}
+	go v.run(context.WithValue(context.Background(), requestIDKey, ctx.Value(requestIDKey)))
+	return true
+}
+
+func (v *storageVerifier) run(ctx context.Context) {
+	filter := FingerprintSampleFilter{Limit: maxPageSize}
+	var runErr error
+	for {
+		samples, err := v.fingerprints.ListFingerprintSamples(ctx, filter)
+		if err != nil {
+			runErr = fmt.Errorf("フィンガープリントデータの一覧取得に失敗しました: %v", err)
+			break
+		}
+
+		for _, sample := range samples {
+			v.verify(ctx, sample.SampleID, sample.WifiKey, sample.WifiSHA256)
+			v.verify(ctx, sample.SampleID, sample.BleKey, sample.BleSHA256)
+		}
+
+		if len(samples) < filter.Limit {
+			break
+		}
+		filter.AfterID = samples[len(samples)-1].SampleID
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	finishedAt := time.Now()
+	v.report.FinishedAt = &finishedAt
+	if runErr != nil {
+		v.report.Status = "failed"
+		v.report.Error = runErr.Error()
+		logError(ctx, "保存ファイルの検証に失敗しました: %v", runErr)
+		return
+	}
+	v.report.Status = "completed"
+	logInfo(ctx, "保存ファイルの検証が完了しました（検証: %d 件, 欠損: %d 件, 破損: %d 件）", v.report.CheckedFiles, v.report.MissingFiles, v.report.CorruptedFiles)
+}
+
+// verify は key のファイルを読み直して expected と比較し、結果を report に反映します
+func (v *storageVerifier) verify(ctx context.Context, sampleID int, key string, expected string) {
+	actual, err := hashBlob(ctx, v.blobs, key)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.report.CheckedFiles++
+	switch {
+	case os.IsNotExist(err):
+		v.report.MissingFiles++
+		v.report.Issues = append(v.report.Issues, StorageVerifyIssue{SampleID: sampleID, Key: key, Problem: "missing", ExpectedSHA256: expected})
+		logError(ctx, "保存ファイル %s が見つかりません（サンプルID: %d）", key, sampleID)
+	case err != nil:
+		v.report.UnreadableFiles++
+		v.report.Issues = append(v.report.Issues, StorageVerifyIssue{SampleID: sampleID, Key: key, Problem: "unreadable", ExpectedSHA256: expected})
+		logError(ctx, "保存ファイル %s の読み取りに失敗しました: %v", key, err)
+	case actual != expected:
+		v.report.CorruptedFiles++
+		v.report.Issues = append(v.report.Issues, StorageVerifyIssue{SampleID: sampleID, Key: key, Problem: "corrupted", ExpectedSHA256: expected, ActualSHA256: actual})
+		logError(ctx, "保存ファイル %s のSHA-256が一致しません（サンプルID: %d）", key, sampleID)
+	}
+}
+
+// snapshot は現在の検証結果のコピーを返します
+func (v *storageVerifier) snapshot() StorageVerifyReport {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	report := v.report
+	report.Issues = append([]StorageVerifyIssue{}, v.report.Issues...)
+	return report
+}
+
+// hashBlob は key のオブジェクトのSHA-256（16進数）を返します
+func hashBlob(ctx context.Context, blobs BlobStore, key string) (string, error) {
+	reader, err := blobs.Get(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, reader); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// handleAdminStorageVerify は POST で検証を開始し、GET で実行中または直前の検証結果を返します
+func handleAdminStorageVerify(w http.ResponseWriter, r *http.Request, ctx context.Context, presence PresenceStore, verifier *storageVerifier) {
+	if !requireSystemAdmin(w, r, ctx, presence) {
+		return
+	}
+
+	status := http.StatusOK
+	if r.Method == http.MethodPost {
+		if !verifier.start(ctx) {
+			http.Error(w, "保存ファイルの検証は既に実行中です", http.StatusConflict)
+			return
+		}
+		logInfo(ctx, "保存ファイルの検証を開始しました")
+		status = http.StatusAccepted
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(verifier.snapshot()); err != nil {
+		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
+	}
+}
+
+// handleAdminLogLevel は現在のログレベルを返します。PUT の場合は level パラメータ（debug・info・warn・error）に変更します
+func handleAdminLogLevel(w http.ResponseWriter, r *http.Request, ctx context.Context, presence PresenceStore, audit AuditStore) {
+	if !requireSystemAdmin(w, r, ctx, presence) {
+		return
+	}
+
+	if r.Method == http.MethodPut {
+		levelStr := r.FormValue("level")
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(levelStr)); err != nil {
+			logError(ctx, "levelパラメータが無効です: %s", levelStr)
+			http.Error(w, "levelパラメータは debug・info・warn・error のいずれかである必要があります", http.StatusBadRequest)
+			return
+		}
+
+		previous := logLevel.Level()
+		logLevel.Set(level)
+		recordAudit(ctx, audit, r, "loglevel.update", "loglevel", fmt.Sprintf("level=%s->%s", previous, level))
+		logger.Warn("ログレベルを変更しました", append(logAttrs(ctx), "from", previous.String(), "to", level.String())...)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(LogLevelResponse{Level: logLevel.Level().String()}); err != nil {
+		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
+	}
+}
+
+// publishDebugVars は /debug/vars で公開する実行時の統計を登録します
+func publishDebugVars(submitPool *workerPool, limits routeLimits, devicesCache *deviceCache) {
+	expvar.Publish("goroutines", expvar.Func(func() interface{} {
+		return runtime.NumGoroutine()
+	}))
+	expvar.Publish("elpis", expvar.Func(func() interface{} {
+		vars := map[string]interface{}{
+			"negative_samples_captured":       atomic.LoadUint64(&negativeSamplesCaptured),
+			"negative_samples_skipped":        atomic.LoadUint64(&negativeSamplesSkipped),
+			"upload_files_removed":            atomic.LoadUint64(&uploadFilesRemoved),
+			"upload_files_archived":           atomic.LoadUint64(&uploadFilesArchived),
+			"upload_bytes_reclaimed":          atomic.LoadUint64(&uploadBytesReclaimed),
+			"registration_heartbeats":         atomic.LoadUint64(&registrationHeartbeats),
+			"registration_heartbeat_failures": atomic.LoadUint64(&registrationHeartbeatFailures),
+			"registration_last_heartbeat":     atomic.LoadInt64(&registrationLastHeartbeat),
+			"registration_attempts":           atomic.LoadUint64(&registrationAttempts),
+			"registration_restarts":           atomic.LoadUint64(&registrationRestarts),
+			"remote_config_last_applied":      atomic.LoadInt64(&remoteConfigLastApplied),
+			"remote_config_failures":          atomic.LoadUint64(&remoteConfigFailures),
+			"registration_state":              currentRegistrationState(),
+			"registration_proxies":            registrationStatesByProxy(),
+			"submit_pool":                     submitPool.stats(),
+			"route_limits":                    limits.stats(),
+			"inquiry_speculative":             atomic.LoadUint64(&inquirySpeculative),
+			"inquiry_speculative_discarded":   atomic.LoadUint64(&inquirySpeculativeDiscarded),
+			"sessions_expired":                atomic.LoadUint64(&sessionsExpired),
+			"retry_queue_enqueued":            atomic.LoadUint64(&retryQueueEnqueued),
+			"retry_queue_replayed":            atomic.LoadUint64(&retryQueueReplayed),
+			"retry_queue_dropped":             atomic.LoadUint64(&retryQueueDropped),
+			"retry_queue_failures":            atomic.LoadUint64(&retryQueueFailures),
+			"device_cache_hits":               atomic.LoadUint64(&deviceCacheHits),
+			"device_cache_misses":             atomic.LoadUint64(&deviceCacheMisses),
+		}
+		if devicesCache != nil {
+			vars["device_cache"] = devicesCache.stats()
+		}
+		if estimationRoutes != nil {
+			vars["estimation_shards"] = estimationRoutes.stats()
+		}
+		return vars
+	}))
+}
+
+// debugHandlers は /debug 以下で公開する pprof・expvar のハンドラーです
+var debugHandlers = map[string]http.Handler{
+	"/debug/pprof/":        http.HandlerFunc(pprof.Index),
+	"/debug/pprof/cmdline": http.HandlerFunc(pprof.Cmdline),
+	"/debug/pprof/profile": http.HandlerFunc(pprof.Profile),
+	"/debug/pprof/symbol":  http.HandlerFunc(pprof.Symbol),
+	"/debug/pprof/trace":   http.HandlerFunc(pprof.Trace),
+	"/debug/vars":          expvar.Handler(),
+}
+
+// handleDebug は既定の組織の管理者にだけ pprof・expvar を返します。プロファイルはメモリの内容を含むため、
+// 認証情報のないリクエストには WWW-Authenticate を付けて 401 を返し、ブラウザや go tool pprof にパスワードの入力を求めます
+func handleDebug(w http.ResponseWriter, r *http.Request, ctx context.Context, presence PresenceStore, handler http.Handler) {
+	if getUserID(r) == "anonymous" {
+		logError(ctx, "認証情報のないリクエストがデバッグ用のエンドポイントにアクセスしました: %s", r.URL.Path)
+		w.Header().Set("WWW-Authenticate", basicAuthChallenge)
+		http.Error(w, "認証が必要です", http.StatusUnauthorized)
+		return
+	}
+	if !requireSystemAdmin(w, r, ctx, presence) {
+		return
+	}
+	handler.ServeHTTP(w, r)
+}
+
+// requestBodyLogLimit はリクエストボディを記録する場合に読み込む上限（バイト）です。記録する内容は sanitizeString でさらに短くします
+const requestBodyLogLimit = 64 * 1024
+
+// openAPISpec は /api/openapi.json で返すAPIの仕様です。ルートを追加・変更した場合はこのファイルも更新します
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// swaggerUIFiles は /api/docs で配信する Swagger UI（swagger-ui-dist）です。ファイルは Git で管理せず、
+// make swagger-ui-manager でバージョンを固定して取得してからビルドします
+//
+//go:embed swaggerui
+var swaggerUIFiles embed.FS
+
+// swaggerUIAssets は /api/docs/ 以下で配信する swaggerUIFiles のファイルです
+var swaggerUIAssets = map[string]string{
+	"swagger-ui.css":       "text/css; charset=utf-8",
+	"swagger-ui-bundle.js": "text/javascript; charset=utf-8",
+}
+
+const apiDocsPage = `<!DOCTYPE html>
+<html lang="ja">
+<head>
+<meta charset="utf-8">
+<title>信号データ管理API</title>
+<link rel="stylesheet" href="/api/docs/swagger-ui.css">
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="/api/docs/swagger-ui-bundle.js"></script>
+<script>
+window.ui = SwaggerUIBundle({url: "/api/openapi.json", dom_id: "#swagger-ui"});
+</script>
+</body>
+</html>
+`
+
+// routeMux は登録したパターンを記録する ServeMux です。起動時にAPIの仕様と突き合わせるために使います
+type routeMux struct {
+	*http.ServeMux
+	patterns []string
+}
+
+func newRouteMux() *routeMux {
+	return &routeMux{ServeMux: http.NewServeMux()}
+}
+
+func (m *routeMux) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	m.patterns = append(m.patterns, pattern)
+	m.ServeMux.HandleFunc(pattern, handler)
+}
+
+// routeDeps は registerRoutes でハンドラーに渡す設定・ストアなどです
+type routeDeps struct {
+	config        Config
+	store         *sqlStore
+	readStore     *sqlStore
+	devices       DeviceStore
+	devicesCache  *deviceCache
+	signals       signalDeps
+	blobs         BlobStore
+	uploadArchive BlobStore
+	usage         *storageUsage
+	verifier      *storageVerifier
+	retention     *retentionEnforcer
+	reloader      *configReloader
+	submitPool    *workerPool
+	apiSpec       []byte
+	loc           *time.Location
+}
+
+// registerRoutes は mux にすべてのルートを登録します。登録したパターンは mux.patterns に残り、起動時とテストでAPIの仕様と突き合わせます
+func registerRoutes(mux *routeMux, deps routeDeps) {
+	config, store, readStore, loc := deps.config, deps.store, deps.readStore, deps.loc
+	devices, devicesCache, signals := deps.devices, deps.devicesCache, deps.signals
+	blobs, uploadArchive, usage, verifier := deps.blobs, deps.uploadArchive, deps.usage, deps.verifier
+	retention, reloader, submitPool := deps.retention, deps.reloader, deps.submitPool
+
+	mux.HandleFunc("/api/users/", func(w http.ResponseWriter, r *http.Request) {
+		ctx := requestContext(r)
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(parts) == 4 && parts[0] == "api" && parts[1] == "users" && parts[3] == "consent" {
+			userID, err := strconv.Atoi(parts[2])
+			if err != nil {
+				logError(ctx, "無効なユーザーIDです: %v", err)
+				http.Error(w, "無効なユーザーIDです", http.StatusBadRequest)
+				return
+			}
+			if r.Method != http.MethodGet && r.Method != http.MethodPut {
+				logError(ctx, "許可されていないメソッドです: %s", r.Method)
+				http.Error(w, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+				return
+			}
+			// 同意の変更はセッションの終了を伴うためプライマリで行います
+			handleTrackingConsent(w, r, ctx, store, store, userID, loc)
+			return
+		}
+		if len(parts) == 4 && parts[0] == "api" && parts[1] == "users" && parts[3] == "pause" {
+			userID, err := strconv.Atoi(parts[2])
+			if err != nil {
+				logError(ctx, "無効なユーザーIDです: %v", err)
+				http.Error(w, "無効なユーザーIDです", http.StatusBadRequest)
+				return
+			}
+			if r.Method != http.MethodGet && r.Method != http.MethodPut && r.Method != http.MethodDelete {
+				logError(ctx, "許可されていないメソッドです: %s", r.Method)
+				http.Error(w, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+				return
+			}
+			handleTrackingPause(w, r, ctx, store, store, userID, loc)
+			return
+		}
+		if len(parts) == 4 && parts[0] == "api" && parts[1] == "users" && r.Method == http.MethodGet {
+			userIDStr := parts[2]
+			userID, err := strconv.Atoi(userIDStr)
+			if err != nil {
+				logError(ctx, "無効なユーザーIDです: %v", err)
+				http.Error(w, "無効なユーザーIDです", http.StatusBadRequest)
+				return
+			}
+			switch parts[3] {
+			case "presence_history":
+				if loc, ok := requestLocation(w, r, ctx, loc); ok {
+					handleUserPresenceHistory(w, r, ctx, readStore, store, userID, loc)
+				}
+				return
+			case "transitions":
+				if loc, ok := requestLocation(w, r, ctx, loc); ok {
+					handleUserTransitions(w, r, ctx, readStore, store, userID, loc)
+				}
+				return
+			case "export":
+				if loc, ok := requestLocation(w, r, ctx, loc); ok {
+					handleUserDataExport(w, r, ctx, readStore, devices, readStore, blobs, store, store, readStore, userID, loc)
+				}
+				return
+			}
+		}
+		http.NotFound(w, r)
+	})
+
+	mux.HandleFunc("/api/devices", func(w http.ResponseWriter, r *http.Request) {
+		ctx := requestContext(r)
+		switch r.Method {
+		case http.MethodGet:
+			handleDevices(w, r, ctx, store, store)
+		case http.MethodPost:
+			handleDeviceCreate(w, r, ctx, store, store, store)
+		default:
+			logError(ctx, "許可されていないメソッドです: %s", r.Method)
+			http.Error(w, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+		}
+	})
+
+	mux.HandleFunc("/api/devices/", func(w http.ResponseWriter, r *http.Request) {
+		ctx := requestContext(r)
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(parts) == 3 && r.Method == http.MethodDelete {
+			deviceID, err := strconv.Atoi(parts[2])
+			if err != nil {
+				logError(ctx, "無効な端末IDです: %v", err)
+				http.Error(w, "無効な端末IDです", http.StatusBadRequest)
+				return
+			}
+			handleDeviceDelete(w, r, ctx, store, store, store, deviceID)
+			return
+		}
+		if len(parts) == 4 && parts[3] == "config" && r.Method == http.MethodGet {
+			deviceID, err := strconv.Atoi(parts[2])
+			if err != nil {
+				logError(ctx, "無効な端末IDです: %v", err)
+				http.Error(w, "無効な端末IDです", http.StatusBadRequest)
+				return
+			}
+			handleDeviceConfig(w, r, ctx, store, store, store, currentSettings().DeviceScan, loc, deviceID)
+			return
+		}
+		http.NotFound(w, r)
+	})
+
+	mux.HandleFunc("/api/rooms/", func(w http.ResponseWriter, r *http.Request) {
+		ctx := requestContext(r)
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(parts) == 4 && parts[0] == "api" && parts[1] == "rooms" && r.Method == http.MethodGet {
+			roomID, err := strconv.Atoi(parts[2])
+			if err != nil {
+				logError(ctx, "無効なルームIDです: %v", err)
+				http.Error(w, "無効なルームIDです", http.StatusBadRequest)
+				return
+			}
+			switch parts[3] {
+			case "presence_history":
+				if loc, ok := requestLocation(w, r, ctx, loc); ok {
+					handleRoomPresenceHistory(w, r, ctx, readStore, readStore, store, roomID, loc)
+				}
+				return
+			}
+		}
+		http.NotFound(w, r)
+	})
+
+	mux.HandleFunc("/api/presence_history", func(w http.ResponseWriter, r *http.Request) {
+		ctx := requestContext(r)
+		if r.Method != http.MethodGet {
+			logError(ctx, "許可されていないメソッドです: %s", r.Method)
+			http.Error(w, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+			return
+		}
+		loc, ok := requestLocation(w, r, ctx, loc)
+		if !ok {
+			return
+		}
+		handlePresenceHistory(w, r, ctx, readStore, store, loc)
+	})
+
+	mux.HandleFunc("/api/stats/presence", func(w http.ResponseWriter, r *http.Request) {
+		ctx := requestContext(r)
+		if r.Method != http.MethodGet {
+			logError(ctx, "許可されていないメソッドです: %s", r.Method)
+			http.Error(w, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+			return
+		}
+		loc, ok := requestLocation(w, r, ctx, loc)
+		if !ok {
+			return
+		}
+		handlePresenceStats(w, r, ctx, readStore, loc, config.PrivateStats)
+	})
+
+	mux.HandleFunc("/api/stats/heatmap", func(w http.ResponseWriter, r *http.Request) {
+		ctx := requestContext(r)
+		if r.Method != http.MethodGet {
+			logError(ctx, "許可されていないメソッドです: %s", r.Method)
+			http.Error(w, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+			return
+		}
+		loc, ok := requestLocation(w, r, ctx, loc)
+		if !ok {
+			return
+		}
+		handleHeatmap(w, r, ctx, readStore, loc, config.PrivateStats)
+	})
+
+	mux.HandleFunc("/api/presence_history/export", func(w http.ResponseWriter, r *http.Request) {
+		ctx := requestContext(r)
+		if r.Method != http.MethodGet {
+			logError(ctx, "許可されていないメソッドです: %s", r.Method)
+			http.Error(w, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+			return
+		}
+		loc, ok := requestLocation(w, r, ctx, loc)
+		if !ok {
+			return
+		}
+		handlePresenceHistoryExport(w, r, ctx, readStore, store, loc)
+	})
+
+	mux.HandleFunc("/api/reports/attendance", func(w http.ResponseWriter, r *http.Request) {
+		ctx := requestContext(r)
+		if r.Method != http.MethodGet {
+			logError(ctx, "許可されていないメソッドです: %s", r.Method)
+			http.Error(w, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+			return
+		}
+		loc, ok := requestLocation(w, r, ctx, loc)
+		if !ok {
+			return
+		}
+		handleAttendanceReport(w, r, ctx, readStore, loc)
+	})
+
+	mux.HandleFunc("/api/stats/dwell", func(w http.ResponseWriter, r *http.Request) {
+		ctx := requestContext(r)
+		if r.Method != http.MethodGet {
+			logError(ctx, "許可されていないメソッドです: %s", r.Method)
+			http.Error(w, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+			return
+		}
+		loc, ok := requestLocation(w, r, ctx, loc)
+		if !ok {
+			return
+		}
+		handleDwellStats(w, r, ctx, readStore, loc, config.PrivateStats)
+	})
+
+	mux.HandleFunc("/api/stats/forecast", func(w http.ResponseWriter, r *http.Request) {
+		ctx := requestContext(r)
+		if r.Method != http.MethodGet {
+			logError(ctx, "許可されていないメソッドです: %s", r.Method)
+			http.Error(w, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+			return
+		}
+		loc, ok := requestLocation(w, r, ctx, loc)
+		if !ok {
+			return
+		}
+		handleForecast(w, r, ctx, readStore, loc, config.PrivateStats)
+	})
+
+	mux.HandleFunc("/api/current_occupants", func(w http.ResponseWriter, r *http.Request) {
+		ctx := requestContext(r)
+		if r.Method != http.MethodGet {
+			logError(ctx, "許可されていないメソッドです: %s", r.Method)
+			http.Error(w, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+			return
+		}
+		handleCurrentOccupants(w, r, ctx, readStore)
+	})
+
+	mux.HandleFunc("/api/organization", func(w http.ResponseWriter, r *http.Request) {
+		ctx := requestContext(r)
+		if r.Method != http.MethodGet {
+			logError(ctx, "許可されていないメソッドです: %s", r.Method)
+			http.Error(w, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+			return
+		}
+		handleOrganization(w, r, ctx, store)
+	})
+
+	mux.HandleFunc("/api/buildings", func(w http.ResponseWriter, r *http.Request) {
+		ctx := requestContext(r)
+		if r.Method != http.MethodGet {
+			logError(ctx, "許可されていないメソッドです: %s", r.Method)
+			http.Error(w, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+			return
+		}
+		handleBuildings(w, r, ctx, readStore)
+	})
+
+	mux.HandleFunc("/api/buildings/", func(w http.ResponseWriter, r *http.Request) {
+		ctx := requestContext(r)
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(parts) == 4 && parts[0] == "api" && parts[1] == "buildings" && parts[3] == "stats" && r.Method == http.MethodGet {
+			buildingID, err := strconv.Atoi(parts[2])
+			if err != nil {
+				logError(ctx, "無効な建物IDです: %v", err)
+				http.Error(w, "無効な建物IDです", http.StatusBadRequest)
+				return
+			}
+			if loc, ok := requestLocation(w, r, ctx, loc); ok {
+				handleBuildingStats(w, r, ctx, readStore, readStore, buildingID, loc, config.PrivateStats)
+			}
+			return
+		}
+		http.NotFound(w, r)
+	})
+
+	mux.HandleFunc("/api/floors/", func(w http.ResponseWriter, r *http.Request) {
+		ctx := requestContext(r)
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(parts) == 4 && parts[0] == "api" && parts[1] == "floors" && parts[3] == "occupants" && r.Method == http.MethodGet {
+			floorID, err := strconv.Atoi(parts[2])
+			if err != nil {
+				logError(ctx, "無効な階IDです: %v", err)
+				http.Error(w, "無効な階IDです", http.StatusBadRequest)
+				return
+			}
+			handleFloorOccupants(w, r, ctx, readStore, readStore, floorID)
+			return
+		}
+		http.NotFound(w, r)
+	})
+
+	pseudonymKey, err := publicDisplayKey(config.PublicDisplay)
+	if err != nil {
+		logError(context.Background(), "%v", err)
+		os.Exit(1)
+	}
+	if config.PrivateStats.NoiseKey == "" {
+		// 起動ごとに鍵が変わるため、再起動の前後やインスタンスごとに同じ問い合わせへ異なるノイズを加えます
+		noiseKey := make([]byte, 32)
+		if _, err := cryptorand.Read(noiseKey); err != nil {
+			logError(context.Background(), "統計のノイズの鍵を生成できませんでした: %v", err)
+			os.Exit(1)
+		}
+		config.PrivateStats.NoiseKey = hex.EncodeToString(noiseKey)
+	}
+	var peers *federation
+	if config.Federation.Enabled {
+		peers, err = newFederation(config.Federation, loc)
+		if err != nil {
+			logError(context.Background(), "%v", err)
+			os.Exit(1)
+		}
+	}
+	mux.HandleFunc("/api/federation/current_occupants", func(w http.ResponseWriter, r *http.Request) {
+		ctx := requestContext(r)
+		if peers == nil {
+			logError(ctx, "集約モードは [Federation] で無効になっています")
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodGet {
+			logError(ctx, "許可されていないメソッドです: %s", r.Method)
+			http.Error(w, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+			return
+		}
+		handleFederatedOccupants(w, r, ctx, peers)
+	})
+
+	mux.HandleFunc("/api/federation/presence_history", func(w http.ResponseWriter, r *http.Request) {
+		ctx := requestContext(r)
+		if peers == nil {
+			logError(ctx, "集約モードは [Federation] で無効になっています")
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodGet {
+			logError(ctx, "許可されていないメソッドです: %s", r.Method)
+			http.Error(w, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+			return
+		}
+		// ピアの認証情報で取得した全サイトの履歴を返すため、このマネージャーの管理者に限ります
+		if !requireAdmin(w, r, ctx, store) {
+			return
+		}
+		loc, ok := requestLocation(w, r, ctx, loc)
+		if !ok {
+			return
+		}
+		handleFederatedHistory(w, r, ctx, peers, store, store, loc)
+	})
+
+	mux.HandleFunc("/api/admin/identity_links", func(w http.ResponseWriter, r *http.Request) {
+		ctx := requestContext(r)
+		if peers == nil {
+			logError(ctx, "集約モードは [Federation] で無効になっています")
+			http.NotFound(w, r)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			handleAdminIdentityLinks(w, r, ctx, store, store)
+		case http.MethodPost:
+			handleAdminIdentityLinkCreate(w, r, ctx, store, store, store, peers)
+		default:
+			logError(ctx, "許可されていないメソッドです: %s", r.Method)
+			http.Error(w, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+		}
+	})
+
+	mux.HandleFunc("/api/admin/identity_links/", func(w http.ResponseWriter, r *http.Request) {
+		ctx := requestContext(r)
+		if peers == nil {
+			logError(ctx, "集約モードは [Federation] で無効になっています")
+			http.NotFound(w, r)
+			return
+		}
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(parts) == 4 && r.Method == http.MethodDelete {
+			linkID, err := strconv.Atoi(parts[3])
+			if err != nil {
+				logError(ctx, "無効な対応IDです: %v", err)
+				http.Error(w, "無効な対応IDです", http.StatusBadRequest)
+				return
+			}
+			handleAdminIdentityLinkDelete(w, r, ctx, store, store, store, linkID)
+			return
+		}
+		http.NotFound(w, r)
+	})
+
+	mux.HandleFunc("/api/admin/building_admins", func(w http.ResponseWriter, r *http.Request) {
+		ctx := requestContext(r)
+		switch r.Method {
+		case http.MethodGet:
+			handleAdminBuildingAdmins(w, r, ctx, store, store)
+		case http.MethodPost:
+			handleAdminBuildingAdminGrant(w, r, ctx, store, store, store, store)
+		default:
+			logError(ctx, "許可されていないメソッドです: %s", r.Method)
+			http.Error(w, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+		}
+	})
+
+	mux.HandleFunc("/api/admin/building_admins/", func(w http.ResponseWriter, r *http.Request) {
+		ctx := requestContext(r)
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(parts) == 5 && r.Method == http.MethodDelete {
+			buildingID, err := strconv.Atoi(parts[3])
+			if err != nil {
+				logError(ctx, "無効な建物IDです: %v", err)
+				http.Error(w, "無効な建物IDです", http.StatusBadRequest)
+				return
+			}
+			userID, err := strconv.Atoi(parts[4])
+			if err != nil {
+				logError(ctx, "無効なユーザーIDです: %v", err)
+				http.Error(w, "無効なユーザーIDです", http.StatusBadRequest)
+				return
+			}
+			handleAdminBuildingAdminRevoke(w, r, ctx, store, store, store, buildingID, userID)
+			return
+		}
+		http.NotFound(w, r)
+	})
+
+	mux.HandleFunc("/api/admin/rooms", func(w http.ResponseWriter, r *http.Request) {
+		ctx := requestContext(r)
+		switch r.Method {
+		case http.MethodGet:
+			handleAdminRooms(w, r, ctx, store, store, store, store)
+		case http.MethodPost:
+			handleAdminRoomCreate(w, r, ctx, store, store, store, store, store)
+		default:
+			logError(ctx, "許可されていないメソッドです: %s", r.Method)
+			http.Error(w, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+		}
+	})
+
+	mux.HandleFunc("/api/admin/rooms/", func(w http.ResponseWriter, r *http.Request) {
+		ctx := requestContext(r)
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(parts) == 4 && r.Method == http.MethodPut {
+			roomID, err := strconv.Atoi(parts[3])
+			if err != nil {
+				logError(ctx, "無効なルームIDです: %v", err)
+				http.Error(w, "無効なルームIDです", http.StatusBadRequest)
+				return
+			}
+			handleAdminRoomUpdate(w, r, ctx, store, store, store, store, store, roomID)
+			return
+		}
+		http.NotFound(w, r)
+	})
+
+	mux.HandleFunc("/api/admin/beacons", func(w http.ResponseWriter, r *http.Request) {
+		ctx := requestContext(r)
+		switch r.Method {
+		case http.MethodGet:
+			handleAdminBeacons(w, r, ctx, store, store, store, store)
+		case http.MethodPost:
+			handleAdminBeaconCreate(w, r, ctx, store, store, store, store, store, devicesCache)
+		default:
+			logError(ctx, "許可されていないメソッドです: %s", r.Method)
+			http.Error(w, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+		}
+	})
+
+	mux.HandleFunc("/api/admin/beacons/", func(w http.ResponseWriter, r *http.Request) {
+		ctx := requestContext(r)
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(parts) != 4 {
+			http.NotFound(w, r)
+			return
+		}
+		beaconID, err := strconv.Atoi(parts[3])
+		if err != nil {
+			logError(ctx, "無効なビーコンIDです: %v", err)
+			http.Error(w, "無効なビーコンIDです", http.StatusBadRequest)
+			return
+		}
+		switch r.Method {
+		case http.MethodPut:
+			handleAdminBeaconUpdate(w, r, ctx, store, store, store, store, store, devicesCache, beaconID)
+		case http.MethodDelete:
+			handleAdminBeaconDelete(w, r, ctx, store, store, store, store, store, devicesCache, beaconID)
+		default:
+			logError(ctx, "許可されていないメソッドです: %s", r.Method)
+			http.Error(w, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+		}
+	})
+
+	mux.HandleFunc("/api/current_occupants/anonymous", func(w http.ResponseWriter, r *http.Request) {
+		ctx := requestContext(r)
+		if !config.PublicDisplay.Enabled {
+			logError(ctx, "匿名の在室状況は [PublicDisplay] で無効になっています")
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodGet {
+			logError(ctx, "許可されていないメソッドです: %s", r.Method)
+			http.Error(w, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+			return
+		}
+		handleAnonymousOccupants(w, r, ctx, readStore, config.PublicDisplay.Mode, pseudonymKey)
+	})
+
+	mux.HandleFunc("/api/admin/presence_decisions", func(w http.ResponseWriter, r *http.Request) {
+		ctx := requestContext(r)
+		if r.Method != http.MethodGet {
+			logError(ctx, "許可されていないメソッドです: %s", r.Method)
+			http.Error(w, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+			return
+		}
+		handleAdminPresenceDecisions(w, r, ctx, store, store, store)
+	})
+
+	mux.HandleFunc("/api/admin/negative_samples", func(w http.ResponseWriter, r *http.Request) {
+		ctx := requestContext(r)
+		if r.Method != http.MethodGet {
+			logError(ctx, "許可されていないメソッドです: %s", r.Method)
+			http.Error(w, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+			return
+		}
+		handleAdminNegativeSamples(w, r, ctx, store, blobs, config.NegativeSamples)
+	})
+
+	mux.HandleFunc("/api/admin/purge", func(w http.ResponseWriter, r *http.Request) {
+		ctx := requestContext(r)
+		if r.Method != http.MethodPost {
+			logError(ctx, "許可されていないメソッドです: %s", r.Method)
+			http.Error(w, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+			return
+		}
+		handleAdminPurge(w, r, ctx, store, config.Retention, loc)
+	})
+
+	mux.HandleFunc("/api/admin/fingerprints", func(w http.ResponseWriter, r *http.Request) {
+		ctx := requestContext(r)
+		if r.Method != http.MethodGet {
+			logError(ctx, "許可されていないメソッドです: %s", r.Method)
+			http.Error(w, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+			return
+		}
+		handleAdminFingerprints(w, r, ctx, store, readStore)
+	})
+
+	mux.HandleFunc("/api/admin/fingerprints/", func(w http.ResponseWriter, r *http.Request) {
+		ctx := requestContext(r)
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(parts) < 4 || len(parts) > 5 {
+			http.NotFound(w, r)
+			return
+		}
+		sampleID, err := strconv.Atoi(parts[3])
+		if err != nil {
+			logError(ctx, "無効なサンプルIDです: %v", err)
+			http.Error(w, "無効なサンプルIDです", http.StatusBadRequest)
+			return
+		}
+		switch {
+		case len(parts) == 4 && r.Method == http.MethodDelete:
+			handleAdminFingerprintDelete(w, r, ctx, store, store, store, blobs, sampleID)
+		case len(parts) == 5 && parts[4] == "download" && r.Method == http.MethodGet:
+			handleAdminFingerprintDownload(w, r, ctx, store, readStore, blobs, sampleID)
+		case len(parts) == 5 && parts[4] == "relabel" && r.Method == http.MethodPost:
+			handleAdminFingerprintRelabel(w, r, ctx, store, store, store, store, blobs, sampleID)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+
+	mux.HandleFunc("/api/admin/fingerprints/export", func(w http.ResponseWriter, r *http.Request) {
+		ctx := requestContext(r)
+		if r.Method != http.MethodGet {
+			logError(ctx, "許可されていないメソッドです: %s", r.Method)
+			http.Error(w, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+			return
+		}
+		handleAdminFingerprintExport(w, r, ctx, store, readStore, readStore, blobs)
+	})
+
+	mux.HandleFunc("/api/admin/fingerprints/dedup", func(w http.ResponseWriter, r *http.Request) {
+		ctx := requestContext(r)
+		if r.Method != http.MethodGet {
+			logError(ctx, "許可されていないメソッドです: %s", r.Method)
+			http.Error(w, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+			return
+		}
+		handleAdminFingerprintDedup(w, r, ctx, store, store)
+	})
+
+	mux.HandleFunc("/api/admin/datasets", func(w http.ResponseWriter, r *http.Request) {
+		ctx := requestContext(r)
+		switch r.Method {
+		case http.MethodGet:
+			handleAdminDatasets(w, r, ctx, store, readStore)
+		case http.MethodPost:
+			handleAdminDatasetCreate(w, r, ctx, store, store, store, store, store, blobs)
+		default:
+			logError(ctx, "許可されていないメソッドです: %s", r.Method)
+			http.Error(w, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+		}
+	})
+
+	mux.HandleFunc("/api/admin/datasets/", func(w http.ResponseWriter, r *http.Request) {
+		ctx := requestContext(r)
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if r.Method == http.MethodGet && len(parts) == 4 {
+			handleAdminDataset(w, r, ctx, store, readStore, blobs, parts[3], false)
+			return
+		}
+		if r.Method == http.MethodGet && len(parts) == 5 && parts[4] == "download" {
+			handleAdminDataset(w, r, ctx, store, readStore, blobs, parts[3], true)
+			return
+		}
+		http.NotFound(w, r)
+	})
+
+	mux.HandleFunc("/api/admin/audit_log", func(w http.ResponseWriter, r *http.Request) {
+		ctx := requestContext(r)
+		if r.Method != http.MethodGet {
+			logError(ctx, "許可されていないメソッドです: %s", r.Method)
+			http.Error(w, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+			return
+		}
+		handleAdminAuditLog(w, r, ctx, store, readStore)
+	})
+
+	mux.HandleFunc("/api/admin/history_access", func(w http.ResponseWriter, r *http.Request) {
+		ctx := requestContext(r)
+		if r.Method != http.MethodGet {
+			logError(ctx, "許可されていないメソッドです: %s", r.Method)
+			http.Error(w, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+			return
+		}
+		handleAdminHistoryAccessLog(w, r, ctx, store, readStore)
+	})
+
+	mux.HandleFunc("/api/admin/uploads", func(w http.ResponseWriter, r *http.Request) {
+		ctx := requestContext(r)
+		if r.Method != http.MethodGet {
+			logError(ctx, "許可されていないメソッドです: %s", r.Method)
+			http.Error(w, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+			return
+		}
+		handleAdminUploadStats(w, r, ctx, store, blobs, config.UploadRetention)
+	})
+
+	mux.HandleFunc("/api/admin/uploads/records", func(w http.ResponseWriter, r *http.Request) {
+		ctx := requestContext(r)
+		if r.Method != http.MethodGet {
+			logError(ctx, "許可されていないメソッドです: %s", r.Method)
+			http.Error(w, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+			return
+		}
+		handleAdminUploadRecords(w, r, ctx, store, readStore)
+	})
+
+	mux.HandleFunc("/api/admin/uploads/purge", func(w http.ResponseWriter, r *http.Request) {
+		ctx := requestContext(r)
+		if r.Method != http.MethodPost {
+			logError(ctx, "許可されていないメソッドです: %s", r.Method)
+			http.Error(w, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+			return
+		}
+		handleAdminUploadsPurge(w, r, ctx, store, blobs, uploadArchive, config.UploadRetention)
+	})
+
+	mux.HandleFunc("/api/admin/storage", func(w http.ResponseWriter, r *http.Request) {
+		ctx := requestContext(r)
+		if r.Method != http.MethodGet {
+			logError(ctx, "許可されていないメソッドです: %s", r.Method)
+			http.Error(w, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+			return
+		}
+		handleAdminStorage(w, r, ctx, store, usage)
+	})
+
+	mux.HandleFunc("/api/admin/retention", func(w http.ResponseWriter, r *http.Request) {
+		ctx := requestContext(r)
+		if r.Method != http.MethodGet && r.Method != http.MethodPost {
+			logError(ctx, "許可されていないメソッドです: %s", r.Method)
+			http.Error(w, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+			return
+		}
+		handleAdminRetention(w, r, ctx, store, store, retention)
+	})
+
+	mux.HandleFunc("/api/admin/storage/verify", func(w http.ResponseWriter, r *http.Request) {
+		ctx := requestContext(r)
+		if r.Method != http.MethodGet && r.Method != http.MethodPost {
+			logError(ctx, "許可されていないメソッドです: %s", r.Method)
+			http.Error(w, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+			return
+		}
+		handleAdminStorageVerify(w, r, ctx, store, verifier)
+	})
+
+	mux.HandleFunc("/api/admin/config/reload", func(w http.ResponseWriter, r *http.Request) {
+		ctx := requestContext(r)
+		if r.Method != http.MethodPost {
+			logError(ctx, "許可されていないメソッドです: %s", r.Method)
+			http.Error(w, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+			return
+		}
+		handleAdminConfigReload(w, r, ctx, store, store, reloader)
+	})
+
+	mux.HandleFunc("/api/admin/device_cache/refresh", func(w http.ResponseWriter, r *http.Request) {
+		ctx := requestContext(r)
+		if r.Method != http.MethodPost {
+			logError(ctx, "許可されていないメソッドです: %s", r.Method)
+			http.Error(w, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+			return
+		}
+		handleAdminDeviceCacheRefresh(w, r, ctx, store, store, devicesCache)
+	})
+
+	mux.HandleFunc("/api/admin/sessions/repair", func(w http.ResponseWriter, r *http.Request) {
+		ctx := requestContext(r)
+		if r.Method != http.MethodPost {
+			logError(ctx, "許可されていないメソッドです: %s", r.Method)
+			http.Error(w, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+			return
+		}
+		handleAdminSessionRepair(w, r, ctx, store, store)
+	})
+
+	mux.HandleFunc("/api/admin/loglevel", func(w http.ResponseWriter, r *http.Request) {
+		ctx := requestContext(r)
+		if r.Method != http.MethodGet && r.Method != http.MethodPut {
+			logError(ctx, "許可されていないメソッドです: %s", r.Method)
+			http.Error(w, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+			return
+		}
+		handleAdminLogLevel(w, r, ctx, store, store)
+	})
+
+	mux.HandleFunc("/api/admin/api_keys", func(w http.ResponseWriter, r *http.Request) {
+		ctx := requestContext(r)
+		switch r.Method {
+		case http.MethodGet:
+			handleAdminAPIKeys(w, r, ctx, store, store)
+		case http.MethodPost:
+			handleAdminAPIKeyCreate(w, r, ctx, store, store, store)
+		default:
+			logError(ctx, "許可されていないメソッドです: %s", r.Method)
+			http.Error(w, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+		}
+	})
+
+	mux.HandleFunc("/api/admin/api_keys/", func(w http.ResponseWriter, r *http.Request) {
+		ctx := requestContext(r)
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(parts) == 4 && r.Method == http.MethodDelete {
+			keyID, err := strconv.Atoi(parts[3])
+			if err != nil {
+				logError(ctx, "無効なAPIキーIDです: %v", err)
+				http.Error(w, "無効なAPIキーIDです", http.StatusBadRequest)
+				return
+			}
+			handleAdminAPIKeyRevoke(w, r, ctx, store, store, store, keyID)
+			return
+		}
+		http.NotFound(w, r)
+	})
+
+	mux.HandleFunc("/api/admin/tenant_settings", func(w http.ResponseWriter, r *http.Request) {
+		ctx := requestContext(r)
+		if r.Method != http.MethodGet && r.Method != http.MethodPut && r.Method != http.MethodDelete {
+			logError(ctx, "許可されていないメソッドです: %s", r.Method)
+			http.Error(w, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+			return
+		}
+		handleAdminTenantSettings(w, r, ctx, store, store, store, store, config.RetentionPolicy)
+	})
+
+	mux.HandleFunc("/api/admin/usage", func(w http.ResponseWriter, r *http.Request) {
+		ctx := requestContext(r)
+		if r.Method != http.MethodGet {
+			logError(ctx, "許可されていないメソッドです: %s", r.Method)
+			http.Error(w, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+			return
+		}
+		handleAdminUsage(w, r, ctx, store, store, store, readStore, loc)
+	})
+
+	if config.Debug.Enabled {
+		for pattern, handler := range debugHandlers {
+			handler := handler
+			mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+				ctx := requestContext(r)
+				handleDebug(w, r, ctx, store, handler)
+			})
+		}
+	}
+
+	mux.HandleFunc("/api/signals/submit", idempotent(store, limitSubmissions(submitPool, config.Submit.RetryAfter, func(w http.ResponseWriter, r *http.Request) {
+		ctx := requestContext(r)
+		current := currentSettings()
+		decision := tenantOverrides(ctx, store).decision(current.Decision)
+		handleSignalsSubmit(w, r, ctx, signals, current.EstimationURL, current.InquiryURL, decision, config.Submit, loc, config.Session.MergeGap, config.NegativeSamples)
+	})))
+
+	mux.HandleFunc("/api/signals/sync", idempotent(store, limitSubmissions(submitPool, config.Submit.RetryAfter, func(w http.ResponseWriter, r *http.Request) {
+		ctx := requestContext(r)
+		current := currentSettings()
+		overrides := tenantOverrides(ctx, store)
+		handleSignalsSync(w, r, ctx, signals, current.EstimationURL, current.InquiryURL, overrides.decision(current.Decision), config.Submit, loc, config.Session.MergeGap, overrides.inactivityTimeout(current.InactivityTimeout), config.NegativeSamples)
+	})))
+
+	mux.HandleFunc("/api/signals/server", limitSubmissions(submitPool, config.Submit.RetryAfter, func(w http.ResponseWriter, r *http.Request) {
+		ctx := requestContext(r)
+		current := currentSettings()
+		handleSignalsServer(w, r, ctx, current.EstimationURL)
+	}))
+
+	mux.HandleFunc("/api/fingerprint/collect", idempotent(store, func(w http.ResponseWriter, r *http.Request) {
+		ctx := requestContext(r)
+		handleFingerprintCollect(w, r, ctx, store, store, store, blobs, usage, loc)
+	}))
+
+	mux.HandleFunc("/api/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		ctx := requestContext(r)
+		if r.Method != http.MethodGet {
+			logError(ctx, "許可されていないメソッドです: %s", r.Method)
+			http.Error(w, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+			return
+		}
+		handleOpenAPISpec(w, r, ctx, deps.apiSpec)
+	})
+
+	mux.HandleFunc("/api/docs", func(w http.ResponseWriter, r *http.Request) {
+		ctx := requestContext(r)
+		if r.Method != http.MethodGet {
+			logError(ctx, "許可されていないメソッドです: %s", r.Method)
+			http.Error(w, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+			return
+		}
+		handleAPIDocs(w, r, ctx)
+	})
+
+	mux.HandleFunc("/api/docs/", func(w http.ResponseWriter, r *http.Request) {
+		ctx := requestContext(r)
+		if r.Method != http.MethodGet {
+			logError(ctx, "許可されていないメソッドです: %s", r.Method)
+			http.Error(w, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+			return
+		}
+		handleAPIDocsAsset(w, r, ctx, strings.TrimPrefix(r.URL.Path, "/api/docs/"))
+	})
+
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		ctx := requestContext(r)
+		handleHealthCheck(w, r, ctx, store, config.Cluster.InstanceID, loc)
+	})
+}
+
+// openAPIDocument は埋め込んだ仕様の servers の先頭に、仕様を返したサーバー自身を指す "/" を加えます。
+// Swagger UI はリクエストを先頭の servers に送るため、/api/docs から試したリクエストが本番サーバーに届かないようにします
+func openAPIDocument(spec []byte) ([]byte, error) {
+	var doc map[string]interface{}
+	if err := json.Unmarshal(spec, &doc); err != nil {
+		return nil, err
+	}
+	servers, _ := doc["servers"].([]interface{})
+	doc["servers"] = append([]interface{}{map[string]interface{}{"url": "/", "description": "このサーバー"}}, servers...)
+	return json.Marshal(doc)
+}
+
+// checkOpenAPIRoutes は /api 以下に登録したルートと仕様の paths を routeMatchesSpecPath で突き合わせ、
+// 仕様に記載のないルートと、どのルートにも一致しない仕様のパスを返します
+func checkOpenAPIRoutes(spec []byte, patterns []string) (undocumented []string, unrouted []string, err error) {
+	var doc struct {
+		Paths map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(spec, &doc); err != nil {
+		return nil, nil, err
+	}
+	for _, pattern := range patterns {
+		if !strings.HasPrefix(pattern, "/api/") {
+			continue
+		}
+		documented := false
+		for specPath := range doc.Paths {
+			if routeMatchesSpecPath(pattern, specPath) {
+				documented = true
+				break
+			}
+		}
+		if !documented {
+			undocumented = append(undocumented, pattern)
+		}
+	}
+	for specPath := range doc.Paths {
+		if !strings.HasPrefix(specPath, "/api/") {
+			continue
+		}
+		routed := false
+		for _, pattern := range patterns {
+			if strings.HasPrefix(pattern, "/api/") && routeMatchesSpecPath(pattern, specPath) {
+				routed = true
+				break
+			}
+		}
+		if !routed {
+			unrouted = append(unrouted, specPath)
+		}
+	}
+	sort.Strings(unrouted)
+	return undocumented, unrouted, nil
+}
+
+// routeMatchesSpecPath はルートのパターンと仕様のパスをセグメントごとに比べます。仕様の {param} とパターンのワイルドカード
+// （{name}）は任意の1セグメントに、パターン末尾の {name...} は残りのセグメントに一致します。
+// "/" で終わるパターンはその下のパスに一致し、それ以外のパターンはセグメントの数が同じパスにだけ一致します
+func routeMatchesSpecPath(pattern string, specPath string) bool {
+	patternSegments := strings.Split(strings.Trim(pattern, "/"), "/")
+	specSegments := strings.Split(strings.Trim(specPath, "/"), "/")
+	subtree := strings.HasSuffix(pattern, "/")
+	for i, segment := range patternSegments {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "...}") {
+			return len(specSegments) >= i
+		}
+		if i >= len(specSegments) {
+			return false
+		}
+		if isPathWildcard(segment) || isPathWildcard(specSegments[i]) {
+			continue
+		}
+		if segment != specSegments[i] {
+			return false
+		}
+	}
+	if subtree {
+		return len(specSegments) >= len(patternSegments)
+	}
+	return len(specSegments) == len(patternSegments)
+}
+
+// isPathWildcard はパスのセグメントが {param} の形のワイルドカードかどうかを返します
+func isPathWildcard(segment string) bool {
+	return len(segment) > 2 && strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}")
+}
+
+func handleOpenAPISpec(w http.ResponseWriter, r *http.Request, ctx context.Context, spec []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(spec); err != nil {
+		logError(ctx, "APIの仕様の送信に失敗しました: %v", err)
+	}
+}
+
+// handleAPIDocs は /api/openapi.json を表示する Swagger UI のページを返します。Swagger UI 本体は埋め込んだ swaggerUIFiles から配信します
+func handleAPIDocs(w http.ResponseWriter, r *http.Request, ctx context.Context) {
+	for name := range swaggerUIAssets {
+		if _, err := fs.Stat(swaggerUIFiles, "swaggerui/"+name); err != nil {
+			logError(ctx, "Swagger UI の %s が埋め込まれていません。make swagger-ui-manager で取得してからビルドしてください", name)
+			http.Error(w, "Swagger UI が埋め込まれていません", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if _, err := io.WriteString(w, apiDocsPage); err != nil {
+		logError(ctx, "APIドキュメントの送信に失敗しました: %v", err)
+	}
+}
+
+// handleAPIDocsAsset は埋め込んだ Swagger UI のファイルを返します
+func handleAPIDocsAsset(w http.ResponseWriter, r *http.Request, ctx context.Context, name string) {
+	contentType, ok := swaggerUIAssets[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	data, err := swaggerUIFiles.ReadFile("swaggerui/" + name)
+	if err != nil {
+		logError(ctx, "Swagger UI の %s が埋め込まれていません。make swagger-ui-manager で取得してからビルドしてください", name)
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	if _, err := w.Write(data); err != nil {
+		logError(ctx, "Swagger UI の %s の送信に失敗しました: %v", name, err)
+	}
+}
+
+// loggingMiddleware はリクエストとアクセスログを記録します。応答ボディは先頭 responseBodyLimit バイトまで記録し、0 の場合は記録しません。
+// redact が nil でなければ、ボディ・URL・ヘッダーは伏せてから記録します
+func loggingMiddleware(next http.Handler, access *accessLogger, responseBodyLimit int, redact *logRedactor) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		id := requestIDFromHeader(r)
+		w.Header().Set("X-Request-ID", id)
+
+		startTime := time.Now()
+
+		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			ip = r.RemoteAddr
+		}
+
+		excludedPaths := map[string]bool{
+			"/api/signals/server":      true,
+			"/api/signals/submit":      true,
+			"/api/signals/sync":        true,
+			"/api/fingerprint/collect": true,
+		}
+
+		// multipart はファイルを含むため記録しません。[RouteLimits] の max_body_mb と同時実行数の制限は内側の limitRoutes で
+		// 適用するため、ここでは先頭 requestBodyLogLimit バイトだけを読み、残りはハンドラーが limitRoutes を通して読みます
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		excludeBody := excludedPaths[r.URL.Path] || strings.HasPrefix(mediaType, "multipart/")
+
+		var requestBody string
+
+		if r.Body != nil && r.Body != http.NoBody && !excludeBody {
+			head, err := io.ReadAll(io.LimitReader(r.Body, requestBodyLogLimit))
+			if err != nil {
+				logger.Error("リクエストボディの読み取りに失敗しました", "request_id", id, "error", err)
+			} else {
+				requestBody = string(head)
+			}
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(head), r.Body), r.Body}
+		}
+
+		capture := &ResponseCapture{
+			ResponseWriter: w,
+			StatusCode:     http.StatusOK,
+			Limit:          responseBodyLimit,
+		}
+		// /debug 以下はプロファイルなどのバイナリを返すため応答ボディを記録しません
+		if strings.HasPrefix(r.URL.Path, "/debug/") {
+			capture.Limit = 0
+		}
+
+		ctx := context.WithValue(r.Context(), requestIDKey, id)
+
+		if !excludeBody && requestBody != "" {
+			logRequest(ctx, "内容: %s", redact.body(sanitizeString(requestBody)))
+		}
+
+		next.ServeHTTP(capture, r.WithContext(ctx))
+
+		elapsed := time.Since(startTime)
+		user, _, _ := r.BasicAuth()
+		access.log(AccessLogEntry{
+			Time:       startTime,
+			RequestID:  id,
+			RemoteAddr: ip,
+			User:       redact.header("Authorization", user),
+			Method:     r.Method,
+			URI:        redact.header("", r.RequestURI),
+			Proto:      r.Proto,
+			Status:     capture.StatusCode,
+			Bytes:      capture.Bytes,
+			DurationMs: elapsed.Milliseconds(),
+			Referer:    redact.header("Referer", r.Referer()),
+			UserAgent:  redact.header("User-Agent", r.UserAgent()),
+		})
+
+		if capture.Body.Len() > 0 {
+			// 保持する量は responseBodyLimit で制限済みのため、sanitizeString の1000文字の上限は使いません
+			responseBody := strings.Join(strings.Fields(strings.ToValidUTF8(capture.Body.String(), "")), " ")
+			if capture.Truncated {
+				responseBody = fmt.Sprintf("%s...(省略 全%dバイト)", responseBody, capture.Bytes)
+			}
+			logRequest(ctx, "応答ボディ: %s", redact.body(responseBody))
+		}
+
+		if slowRequest := currentSettings().SlowRequest; slowRequest > 0 && elapsed >= slowRequest {
+			logger.Warn("処理に時間がかかったリクエストです", append(logAttrs(ctx),
+				"method", r.Method, "path", r.URL.Path, "status", capture.StatusCode, "duration_ms", elapsed.Milliseconds())...)
+		}
+	})
+}
+
+func sanitizeString(s string) string {
+	const maxLength = 1000
+	if len(s) > maxLength {
+		return s[:maxLength] + "...(省略)"
+	}
+
+	s = strings.ReplaceAll(s, "\n", " ")
+	s = strings.ReplaceAll(s, "\r", " ")
+	s = strings.Join(strings.Fields(s), " ")
+	return s
+}
+
+// requireOrgRoom は roomID がリクエストを送ったユーザーの組織のルームであることを確認します。room_id 0（ネガティブサンプル）は常に受け付けます。
+// 他の組織のルームは存在しないルームと同じく 404 を返します
+func requireOrgRoom(w http.ResponseWriter, ctx context.Context, devices DeviceStore, roomID int) bool {
+	if roomID == 0 {
+		return true
+	}
+	if _, err := devices.RoomName(ctx, roomID); err == sql.ErrNoRows {
+		logError(ctx, "ルームが見つかりません: %d", roomID)
+		http.Error(w, "ルームが見つかりません", http.StatusNotFound)
+		return false
+	} else if err != nil {
+		logError(ctx, "ルームの取得に失敗しました: %v", err)
+		http.Error(w, "ルームの取得に失敗しました", http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+func handleFingerprintCollect(w http.ResponseWriter, r *http.Request, ctx context.Context, fingerprints FingerprintStore, uploads UploadStore, devices DeviceStore, blobs BlobStore, usage *storageUsage, loc *time.Location) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "許可されていないメソッドです。POSTを使用してください。", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := parseUploadForm(ctx, r); err != nil {
+		if limitErr, ok := uploadLimitExceeded(err); ok {
+			writeUploadTooLarge(w, ctx, limitErr)
+			return
+		}
+		logError(ctx, "multipart/form-dataの解析に失敗しました: %v", err)
+		http.Error(w, "multipart/form-dataの解析に失敗しました", http.StatusBadRequest)
+		return
+	}
+
+	roomIDStr := r.FormValue("room_id")
+	if roomIDStr == "" {
+		logError(ctx, "room_idが指定されていません")
+		http.Error(w, "room_idを指定してください。", http.StatusBadRequest)
+		return
+	}
+
+	roomID, err := strconv.Atoi(roomIDStr)
+	if err != nil {
+		logError(ctx, "無効なroom_idです: %v", err)
+		http.Error(w, "room_idは整数でなければなりません。", http.StatusBadRequest)
+		return
+	}
+	if !requireOrgRoom(w, ctx, devices, roomID) {
+		return
+	}
+
+	sampleType := fingerprintSampleType(roomID)
+
+	wifiFile, wifiHeader, err := r.FormFile("wifi_data")
+	if err != nil {
+		logError(ctx, "wifi_dataファイルの取得に失敗しました: %v", err)
+		http.Error(w, "wifi_dataファイルの取得に失敗しました。", http.StatusBadRequest)
+		return
+	}
+	defer wifiFile.Close()
+
+	bleFile, bleHeader, err := r.FormFile("ble_data")
+	if err != nil {
+		logError(ctx, "ble_dataファイルの取得に失敗しました: %v", err)
+		http.Error(w, "ble_dataファイルの取得に失敗しました。", http.StatusBadRequest)
+		return
+	}
+	defer bleFile.Close()
+
+	if !checkSignalFiles(w, ctx, bleFile, bleHeader, wifiFile, wifiHeader) {
+		return
+	}
+
+	wifiSHA256, wifiSize, err := hashUploadedFile(wifiFile)
+	if err != nil {
+		logError(ctx, "wifi_dataのハッシュ計算に失敗しました: %v", err)
+		http.Error(w, "wifi_dataの読み取りに失敗しました。", http.StatusInternalServerError)
+		return
+	}
+	bleSHA256, bleSize, err := hashUploadedFile(bleFile)
+	if err != nil {
+		logError(ctx, "ble_dataのハッシュ計算に失敗しました: %v", err)
+		http.Error(w, "ble_dataの読み取りに失敗しました。", http.StatusInternalServerError)
+		return
+	}
+
+	existing, err := fingerprints.FingerprintSampleByHash(ctx, roomID, wifiSHA256, bleSHA256)
+	if err == nil {
+		if err := fingerprints.MarkFingerprintDuplicate(ctx, existing.SampleID, time.Now().In(loc)); err != nil {
+			logError(ctx, "重複したフィンガープリントデータの記録に失敗しました: %v", err)
+		}
+		logInfo(ctx, "RoomID: %d の重複したフィンガープリントデータのため保存をスキップしました。サンプルID: %d", roomID, existing.SampleID)
+
+		response := FingerprintCollectResponse{Message: "同じ内容のフィンガープリントデータが保存済みのため保存をスキップしました", SampleID: existing.SampleID, Duplicate: true}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
+			http.Error(w, "応答の作成に失敗しました。", http.StatusInternalServerError)
+		}
+		return
+	}
+	if err != sql.ErrNoRows {
+		logError(ctx, "フィンガープリントデータの重複確認に失敗しました: %v", err)
+		http.Error(w, "フィンガープリントデータの重複確認に失敗しました。", http.StatusInternalServerError)
+		return
+	}
+
+	if err := usage.reserveRoom(ctx, roomID, wifiSize+bleSize); err == errQuotaExceeded {
+		logError(ctx, "RoomID: %d の容量制限を超えたためフィンガープリントデータを拒否しました", roomID)
+		http.Error(w, "ルームの容量制限を超えています。", http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		logError(ctx, "使用容量の確認に失敗しました: %v", err)
+		http.Error(w, "使用容量の確認に失敗しました。", http.StatusInternalServerError)
+		return
+	}
+
+	// 推定用のファイル・保存ファイルとも収集したユーザーの組織の名前空間に保存します
+	namespace := tenantNamespace(recordOrg(ctx))
+	saveDir := estimationSamplePath(namespace, sampleType, roomID, "")
+
+	if err := os.MkdirAll(saveDir, os.ModePerm); err != nil {
+		logError(ctx, "保存ディレクトリの作成に失敗しました: %v", err)
+		usage.releaseRoom(ctx, roomID, wifiSize+bleSize)
+		http.Error(w, "保存ディレクトリの作成に失敗しました。", http.StatusInternalServerError)
+		return
+	}
+
+	collectedAt := time.Now().In(loc)
+	timestamp := collectedAt.Unix()
+	wifiFileName := fmt.Sprintf("wifi_data_%d.csv", timestamp)
+	bleFileName := fmt.Sprintf("ble_data_%d.csv", timestamp)
+
+	wifiFilePath := filepath.Join(saveDir, wifiFileName)
+	bleFilePath := filepath.Join(saveDir, bleFileName)
+
+	managerWifiKey := fingerprintKey(namespace, roomID, wifiFileName)
+	managerBleKey := fingerprintKey(namespace, roomID, bleFileName)
+
+	if err := saveUploadedFile(ctx, wifiFile, wifiFilePath); err != nil {
+		logError(ctx, "wifi_dataの保存に失敗しました: %v", err)
+		usage.releaseRoom(ctx, roomID, wifiSize+bleSize)
+		http.Error(w, "wifi_dataの保存に失敗しました。", http.StatusInternalServerError)
+		return
+	}
+	if err := saveUploadedFile(ctx, bleFile, bleFilePath); err != nil {
+		logError(ctx, "ble_dataの保存に失敗しました: %v", err)
+		usage.releaseRoom(ctx, roomID, wifiSize+bleSize)
+		http.Error(w, "ble_dataの保存に失敗しました。", http.StatusInternalServerError)
+		return
+	}
+
+	// 追加: [tenants/{org_id}/]manager_fingerprint/{room_id} に保存
+	if err := putBlobFile(ctx, blobs, managerWifiKey, wifiFilePath); err != nil {
+		logError(ctx, "manager_fingerprintへのwifi_dataの保存に失敗しました: %v", err)
+		usage.releaseRoom(ctx, roomID, wifiSize+bleSize)
+		http.Error(w, "manager_fingerprintへのwifi_dataの保存に失敗しました。", http.StatusInternalServerError)
+		return
+	}
+	if err := putBlobFile(ctx, blobs, managerBleKey, bleFilePath); err != nil {
+		logError(ctx, "manager_fingerprintへのble_dataの保存に失敗しました: %v", err)
+		usage.releaseRoom(ctx, roomID, wifiSize+bleSize)
+		http.Error(w, "manager_fingerprintへのble_dataの保存に失敗しました。", http.StatusInternalServerError)
+		return
+	}
+
+	wifiRecords, bleRecords := countFingerprintRecords(ctx, wifiFilePath, bleFilePath)
+
+	sampleID, err := fingerprints.RecordFingerprintSample(ctx, FingerprintSample{
+		RoomID:      roomID,
+		SampleType:  sampleType,
+		WifiKey:     managerWifiKey,
+		BleKey:      managerBleKey,
+		WifiSHA256:  wifiSHA256,
+		BleSHA256:   bleSHA256,
+		WifiSize:    wifiSize,
+		BleSize:     bleSize,
+		WifiRecords: wifiRecords,
+		BleRecords:  bleRecords,
+		CollectedAt: collectedAt,
+		CollectedBy: getUserID(r),
+	})
+	if err != nil {
+		logError(ctx, "フィンガープリントデータの記録に失敗しました: %v", err)
+		http.Error(w, "フィンガープリントデータの記録に失敗しました。", http.StatusInternalServerError)
+		return
+	}
+
+	upload := UploadRecord{
+		Kind:       "fingerprint",
+		UserName:   getUserID(r),
+		RoomID:     &roomID,
+		SampleID:   &sampleID,
+		WifiKey:    managerWifiKey,
+		BleKey:     managerBleKey,
+		WifiSize:   wifiSize,
+		BleSize:    bleSize,
+		WifiSHA256: wifiSHA256,
+		BleSHA256:  bleSHA256,
+		UploadedAt: collectedAt,
+	}
+	if _, err := uploads.RecordUpload(ctx, upload); err != nil {
+		logError(ctx, "保存ファイルの記録に失敗しました: %v", err)
+	} else {
+		recordUploadUsage(ctx, upload)
+	}
+
+	response := FingerprintCollectResponse{Message: "フィンガープリントデータを正常に受信しました", SampleID: sampleID}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
+		http.Error(w, "応答の作成に失敗しました。", http.StatusInternalServerError)
+		return
+	}
+
+	logInfo(ctx, "フィンガープリントデータを正常に受信しました。サンプルタイプ: %s, RoomID: %s", sampleType, roomIDStr)
+}
+
+// recordUpload は wifiFile と bleFile のハッシュとサイズを record に設定して保存ファイルの記録を追加します
+func recordUpload(ctx context.Context, uploads UploadStore, record UploadRecord, wifiFile multipart.File, bleFile multipart.File) (int, error) {
+	var err error
+	if record.WifiSHA256, record.WifiSize, err = hashUploadedFile(wifiFile); err != nil {
+		return 0, fmt.Errorf("WiFiデータのハッシュ計算に失敗しました: %v", err)
+	}
+	if record.BleSHA256, record.BleSize, err = hashUploadedFile(bleFile); err != nil {
+		return 0, fmt.Errorf("BLEデータのハッシュ計算に失敗しました: %v", err)
+	}
+	uploadID, err := uploads.RecordUpload(ctx, record)
+	if err == nil {
+		recordUploadUsage(ctx, record)
+	}
+	return uploadID, err
+}
+
+// recordUploadUsage は保存したアップロードを送信1件と保存容量として利用量に加えます
+func recordUploadUsage(ctx context.Context, record UploadRecord) {
+	recordUsage(ctx, usageSubmissions, 1)
+	recordUsage(ctx, usageStorageBytes, record.WifiSize+record.BleSize)
+}
+
+func handleAdminUploadRecords(w http.ResponseWriter, r *http.Request, ctx context.Context, presence PresenceStore, uploads UploadStore) {
+	if !requireAdmin(w, r, ctx, presence) {
+		return
+	}
+
+	query := r.URL.Query()
+	filter := UploadFilter{UserName: query.Get("user"), Kind: query.Get("kind"), Limit: defaultPageSize}
+	if filter.Kind != "" && filter.Kind != "signals" && filter.Kind != "fingerprint" {
+		logError(ctx, "kindパラメータが無効です: %s", filter.Kind)
+		http.Error(w, "kindパラメータは signals または fingerprint である必要があります。", http.StatusBadRequest)
+		return
+	}
+	if decisionIDStr := query.Get("decision_id"); decisionIDStr != "" {
+		decisionID, err := strconv.Atoi(decisionIDStr)
+		if err != nil || decisionID <= 0 {
+			logError(ctx, "decision_idパラメータが無効です: %s", decisionIDStr)
+			http.Error(w, "decision_idパラメータは正の整数である必要があります。", http.StatusBadRequest)
+			return
+		}
+		filter.DecisionID = &decisionID
+	}
+	if limitStr := query.Get("limit"); limitStr != "" {
+		limit, err := strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 {
+			logError(ctx, "limitパラメータが無効です: %s", limitStr)
+			http.Error(w, "limitパラメータは正の整数である必要があります。", http.StatusBadRequest)
+			return
+		}
+		if limit > maxPageSize {
+			limit = maxPageSize
+		}
+		filter.Limit = limit
+	}
+	if cursorStr := query.Get("cursor"); cursorStr != "" {
+		afterID, err := strconv.Atoi(cursorStr)
+		if err != nil || afterID < 0 {
+			logError(ctx, "cursorパラメータが無効です: %s", cursorStr)
+			http.Error(w, "cursorパラメータが無効です。", http.StatusBadRequest)
+			return
+		}
+		filter.AfterID = afterID
+	}
+
+	records, err := uploads.ListUploads(ctx, filter)
+	if err != nil {
+		logError(ctx, "保存ファイルの記録の取得に失敗しました: %v", err)
+		http.Error(w, "保存ファイルの記録の取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	response := UploadRecordListResponse{Uploads: records}
+	if response.Uploads == nil {
+		response.Uploads = []UploadRecord{}
+	}
+	if len(records) == filter.Limit {
+		response.NextCursor = strconv.Itoa(records[len(records)-1].UploadID)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
+		http.Error(w, "JSON応答のエンコードに失敗しました", http.StatusInternalServerError)
+	}
+}
+
+// hashUploadedFile はアップロードされたファイルのSHA-256（16進数）とサイズを返します
+func hashUploadedFile(file multipart.File) (string, int64, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", 0, err
+	}
+
+	hasher := sha256.New()
+	size, err := io.Copy(hasher, file)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), size, nil
+}
+
+func handleAdminFingerprintDedup(w http.ResponseWriter, r *http.Request, ctx context.Context, presence PresenceStore, fingerprints FingerprintStore) {
+	if !requireAdmin(w, r, ctx, presence) {
+		return
+	}
+
+	stats, err := fingerprints.FingerprintDedupStats(ctx)
+	if err != nil {
+		logError(ctx, "フィンガープリントデータの重複統計の取得に失敗しました: %v", err)
+		http.Error(w, "フィンガープリントデータの重複統計の取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
+		http.Error(w, "JSON応答のエンコードに失敗しました", http.StatusInternalServerError)
+	}
+}
+
+// countFingerprintRecords はWiFi/BLEのCSVに含まれる有効な信号の件数を返します。読み取れない場合は0件とします
+func countFingerprintRecords(ctx context.Context, wifiFilePath string, bleFilePath string) (int, int) {
+	wifiSignals, _ := parseWifiCSV(ctx, wifiFilePath, 0)
+	bleSignals, _ := parseBLECSV(ctx, bleFilePath, 0)
+	return len(wifiSignals), len(bleSignals)
+}
+
+// parseFingerprintFilter は room_id と sample_type パラメータから絞り込み条件を作ります
+func parseFingerprintFilter(r *http.Request, limit int) (FingerprintSampleFilter, error) {
+	query := r.URL.Query()
+	filter := FingerprintSampleFilter{SampleType: query.Get("sample_type"), Limit: limit}
+	if roomIDStr := query.Get("room_id"); roomIDStr != "" {
+		roomID, err := strconv.Atoi(roomIDStr)
+		if err != nil || roomID < 0 {
+			return filter, fmt.Errorf("room_idパラメータは0以上の整数である必要があります。")
+		}
+		filter.RoomID = &roomID
+	}
+	if filter.SampleType != "" && filter.SampleType != "positive" && filter.SampleType != "negative" {
+		return filter, fmt.Errorf("sample_typeパラメータは positive または negative である必要があります。")
+	}
+	return filter, nil
+}
+
+func handleAdminFingerprints(w http.ResponseWriter, r *http.Request, ctx context.Context, presence PresenceStore, fingerprints FingerprintStore) {
+	if !requireAdmin(w, r, ctx, presence) {
+		return
+	}
+
+	query := r.URL.Query()
+	filter, err := parseFingerprintFilter(r, defaultPageSize)
+	if err != nil {
+		logError(ctx, "フィンガープリントデータの絞り込み条件が無効です: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if limitStr := query.Get("limit"); limitStr != "" {
+		limit, err := strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 {
+			logError(ctx, "limitパラメータが無効です: %s", limitStr)
+			http.Error(w, "limitパラメータは正の整数である必要があります。", http.StatusBadRequest)
+			return
+		}
+		if limit > maxPageSize {
+			limit = maxPageSize
+		}
+		filter.Limit = limit
+	}
+	if cursorStr := query.Get("cursor"); cursorStr != "" {
+		afterID, err := strconv.Atoi(cursorStr)
+		if err != nil || afterID < 0 {
+			logError(ctx, "cursorパラメータが無効です: %s", cursorStr)
+			http.Error(w, "cursorパラメータが無効です。", http.StatusBadRequest)
+			return
+		}
+		filter.AfterID = afterID
+	}
+
+	samples, err := fingerprints.ListFingerprintSamples(ctx, filter)
+	if err != nil {
+		logError(ctx, "フィンガープリントデータの一覧取得に失敗しました: %v", err)
+		http.Error(w, "フィンガープリントデータの一覧取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	response := FingerprintSampleListResponse{Samples: samples}
+	if response.Samples == nil {
+		response.Samples = []FingerprintSample{}
+	}
+	if len(samples) == filter.Limit {
+		response.NextCursor = strconv.Itoa(samples[len(samples)-1].SampleID)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
+		http.Error(w, "JSON応答のエンコードに失敗しました", http.StatusInternalServerError)
+	}
+}
+
+// handleAdminFingerprintDownload はサンプルのCSVを返します。file=wifi または file=ble の場合はそのCSVのみ、
+// 指定がない場合は両方をまとめたZIPを返します
+func handleAdminFingerprintDownload(w http.ResponseWriter, r *http.Request, ctx context.Context, presence PresenceStore, fingerprints FingerprintStore, blobs BlobStore, sampleID int) {
+	if !requireAdmin(w, r, ctx, presence) {
+		return
+	}
+
+	sample, err := fingerprints.FingerprintSampleByID(ctx, sampleID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "フィンガープリントデータが見つかりません", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logError(ctx, "フィンガープリントデータの取得に失敗しました: %v", err)
+		http.Error(w, "フィンガープリントデータの取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	if !inTenantNamespace(recordOrg(ctx), sample.WifiKey) || !inTenantNamespace(recordOrg(ctx), sample.BleKey) {
+		logError(ctx, "フィンガープリントデータ %d のファイルが組織の名前空間の外にあります: %s, %s", sampleID, sample.WifiKey, sample.BleKey)
+		http.Error(w, "フィンガープリントデータが見つかりません", http.StatusNotFound)
+		return
+	}
+
+	var keys []string
+	switch r.URL.Query().Get("file") {
+	case "":
+		keys = []string{sample.WifiKey, sample.BleKey}
+	case "wifi":
+		keys = []string{sample.WifiKey}
+	case "ble":
+		keys = []string{sample.BleKey}
+	default:
+		http.Error(w, "fileパラメータは wifi または ble である必要があります。", http.StatusBadRequest)
+		return
+	}
+
+	readers := make([]io.ReadCloser, 0, len(keys))
+	defer func() {
+		for _, reader := range readers {
+			reader.Close()
+		}
+	}()
+	for _, key := range keys {
+		reader, err := blobs.Get(ctx, key)
+		if os.IsNotExist(err) {
+			logError(ctx, "フィンガープリントデータのファイル %s が見つかりません", key)
+			http.Error(w, "フィンガープリントデータのファイルが見つかりません", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			logError(ctx, "フィンガープリントデータのファイル %s の読み取りに失敗しました: %v", key, err)
+			http.Error(w, "フィンガープリントデータのファイルの読み取りに失敗しました", http.StatusInternalServerError)
+			return
+		}
+		readers = append(readers, reader)
+	}
+
+	if len(keys) == 1 {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", path.Base(keys[0])))
+		if _, err := io.Copy(w, readers[0]); err != nil {
+			logError(ctx, "フィンガープリントデータの送信に失敗しました: %v", err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"fingerprint_%d.zip\"", sample.SampleID))
+	zw := zip.NewWriter(w)
+	for i, key := range keys {
+		fw, err := zw.Create(path.Base(key))
+		if err != nil {
+			logError(ctx, "ZIPエントリの作成に失敗しました: %v", err)
+			return
+		}
+		if _, err := io.Copy(fw, readers[i]); err != nil {
+			logError(ctx, "フィンガープリントデータの送信に失敗しました: %v", err)
+			return
+		}
+	}
+	if err := zw.Close(); err != nil {
+		logError(ctx, "ZIPの書き込みに失敗しました: %v", err)
+	}
+}
+
+// buildFingerprintManifest は条件に合うフィンガープリントデータを順に store へ渡し、成功したものの一覧を返します。
+// store が失敗したサンプルと、ファイルがリクエストした組織の名前空間の外にあるサンプルはログに記録して一覧から除きます
+func buildFingerprintManifest(ctx context.Context, fingerprints FingerprintStore, devices DeviceStore, filter FingerprintSampleFilter, store func(sample FingerprintSample, entry FingerprintManifestEntry) error) (FingerprintManifest, error) {
+	manifest := FingerprintManifest{GeneratedAt: time.Now(), RoomID: filter.RoomID, SampleType: filter.SampleType, Samples: []FingerprintManifestEntry{}}
+	roomNames := make(map[int]string)
+	orgID := recordOrg(ctx)
+
+	for {
+		samples, err := fingerprints.ListFingerprintSamples(ctx, filter)
+		if err != nil {
+			return manifest, fmt.Errorf("フィンガープリントデータの一覧取得に失敗しました: %v", err)
+		}
+
+		for _, sample := range samples {
+			if !inTenantNamespace(orgID, sample.WifiKey) || !inTenantNamespace(orgID, sample.BleKey) {
+				logError(ctx, "フィンガープリントデータ %d のファイルが組織の名前空間の外にあるため出力しません", sample.SampleID)
+				continue
+			}
+			entry := FingerprintManifestEntry{
+				SampleID:    sample.SampleID,
+				RoomID:      sample.RoomID,
+				SampleType:  sample.SampleType,
+				CollectedAt: sample.CollectedAt,
+				CollectedBy: sample.CollectedBy,
+				WifiFile:    path.Join(strconv.Itoa(sample.RoomID), path.Base(sample.WifiKey)),
+				BleFile:     path.Join(strconv.Itoa(sample.RoomID), path.Base(sample.BleKey)),
+				WifiSHA256:  sample.WifiSHA256,
+				BleSHA256:   sample.BleSHA256,
+				WifiRecords: sample.WifiRecords,
+				BleRecords:  sample.BleRecords,
+			}
+			if name, ok := roomNames[sample.RoomID]; ok {
+				entry.RoomName = name
+			} else if sample.RoomID != 0 {
+				name, err := devices.RoomName(ctx, sample.RoomID)
+				if err != nil {
+					logError(ctx, "ルームID %d の名前の取得に失敗しました: %v", sample.RoomID, err)
+				}
+				roomNames[sample.RoomID] = name
+				entry.RoomName = name
+			}
+
+			if err := store(sample, entry); err != nil {
+				logError(ctx, "フィンガープリントデータ %d を出力できませんでした: %v", sample.SampleID, err)
+				continue
+			}
+			manifest.Samples = append(manifest.Samples, entry)
+		}
+
+		if filter.Limit <= 0 || len(samples) < filter.Limit {
+			break
+		}
+		filter.AfterID = samples[len(samples)-1].SampleID
+	}
+	return manifest, nil
+}
+
+// handleAdminFingerprintExport は条件に合うフィンガープリントデータのCSVと manifest.json をまとめたZIPをストリーム出力します。
+// CSVはZIP内の {room_id}/ 以下に格納します
+func handleAdminFingerprintExport(w http.ResponseWriter, r *http.Request, ctx context.Context, presence PresenceStore, fingerprints FingerprintStore, devices DeviceStore, blobs BlobStore) {
+	if !requireAdmin(w, r, ctx, presence) {
+		return
+	}
+
+	filter, err := parseFingerprintFilter(r, maxPageSize)
+	if err != nil {
+		logError(ctx, "フィンガープリントデータの絞り込み条件が無効です: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"fingerprints_%s.zip\"", time.Now().Format("20060102_150405")))
+	zw := zip.NewWriter(w)
+
+	manifest, err := buildFingerprintManifest(ctx, fingerprints, devices, filter, func(sample FingerprintSample, entry FingerprintManifestEntry) error {
+		if err := writeBlobToZip(ctx, zw, blobs, sample.WifiKey, entry.WifiFile); err != nil {
+			return err
+		}
+		return writeBlobToZip(ctx, zw, blobs, sample.BleKey, entry.BleFile)
+	})
+	if err != nil {
+		logError(ctx, "%v", err)
+		return
+	}
+
+	if err := writeManifestToZip(zw, manifest); err != nil {
+		logError(ctx, "manifest.jsonの書き込みに失敗しました: %v", err)
+		return
+	}
+	if err := zw.Close(); err != nil {
+		logError(ctx, "ZIPの書き込みに失敗しました: %v", err)
+		return
+	}
+	logInfo(ctx, "フィンガープリントデータを %d 件エクスポートしました", len(manifest.Samples))
+}
+
+// writeManifestToZip は manifest を manifest.json としてZIPに書き込みます
+func writeManifestToZip(zw *zip.Writer, manifest FingerprintManifest) error {
+	return writeJSONToZip(zw, "manifest.json", manifest)
+}
+
+var datasetNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,100}$`)
+
+// datasetKey は組織 orgID のスナップショット name に固定したファイルのキーを返します
+func datasetKey(orgID int, name string, file string) string {
+	return tenantKey(orgID, path.Join("datasets", name, file))
+}
+
+// handleAdminDatasetCreate は現在のフィンガープリントデータを名前付きのスナップショットとして固定します。
+// CSVは組織の名前空間の datasets/{name}/ 以下にコピーするため、その後サンプルが削除・付け替えされてもスナップショットの内容は変わりません
+func handleAdminDatasetCreate(w http.ResponseWriter, r *http.Request, ctx context.Context, presence PresenceStore, fingerprints FingerprintStore, devices DeviceStore, datasets DatasetStore, audit AuditStore, blobs BlobStore) {
+	if !requireAdmin(w, r, ctx, presence) {
+		return
+	}
+
+	name := r.FormValue("name")
+	if !datasetNamePattern.MatchString(name) {
+		logError(ctx, "データセット名が無効です: %s", name)
+		http.Error(w, "nameパラメータは英数字と . _ - からなる100文字以内の名前である必要があります。", http.StatusBadRequest)
+		return
+	}
+
+	filter, err := parseFingerprintFilter(r, maxPageSize)
+	if err != nil {
+		logError(ctx, "フィンガープリントデータの絞り込み条件が無効です: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if _, err := datasets.SnapshotByName(ctx, name); err == nil {
+		http.Error(w, "同じ名前のデータセットが既に存在します", http.StatusConflict)
+		return
+	} else if err != sql.ErrNoRows {
+		logError(ctx, "データセットの確認に失敗しました: %v", err)
+		http.Error(w, "データセットの確認に失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	manifest, err := buildFingerprintManifest(ctx, fingerprints, devices, filter, func(sample FingerprintSample, entry FingerprintManifestEntry) error {
+		if err := copyBlobTo(ctx, blobs, sample.WifiKey, datasetKey(recordOrg(ctx), name, entry.WifiFile)); err != nil {
+			return err
+		}
+		return copyBlobTo(ctx, blobs, sample.BleKey, datasetKey(recordOrg(ctx), name, entry.BleFile))
+	})
+	if err != nil {
+		logError(ctx, "%v", err)
+		http.Error(w, "データセットの作成に失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	manifestJSON, err := json.Marshal(manifest)
+	if err != nil {
+		logError(ctx, "マニフェストのエンコードに失敗しました: %v", err)
+		http.Error(w, "データセットの作成に失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	snapshot := DatasetSnapshot{
+		Name:         name,
+		Description:  r.FormValue("description"),
+		CreatedBy:    getUserID(r),
+		CreatedAt:    manifest.GeneratedAt,
+		SampleCount:  len(manifest.Samples),
+		ManifestJSON: string(manifestJSON),
+	}
+	snapshot.SnapshotID, err = datasets.CreateSnapshot(ctx, snapshot)
+	if err != nil {
+		logError(ctx, "データセットの記録に失敗しました: %v", err)
+		http.Error(w, "データセットの作成に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	snapshot.Manifest = &manifest
+
+	recordAudit(ctx, audit, r, "dataset.create", fmt.Sprintf("dataset:%s", name), fmt.Sprintf("samples=%d", snapshot.SampleCount))
+	logInfo(ctx, "データセット %s を作成しました（%d 件）", name, snapshot.SampleCount)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(snapshot); err != nil {
+		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
+	}
+}
+
+func handleAdminDatasets(w http.ResponseWriter, r *http.Request, ctx context.Context, presence PresenceStore, datasets DatasetStore) {
+	if !requireAdmin(w, r, ctx, presence) {
+		return
+	}
+
+	snapshots, err := datasets.ListSnapshots(ctx)
+	if err != nil {
+		logError(ctx, "データセットの一覧取得に失敗しました: %v", err)
+		http.Error(w, "データセットの一覧取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(DatasetListResponse{Datasets: snapshots}); err != nil {
+		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
+		http.Error(w, "JSON応答のエンコードに失敗しました", http.StatusInternalServerError)
+	}
+}
+
+// handleAdminDataset はスナップショットとそのマニフェストを返します。download が true の場合は固定したCSVをZIPで返します
+func handleAdminDataset(w http.ResponseWriter, r *http.Request, ctx context.Context, presence PresenceStore, datasets DatasetStore, blobs BlobStore, name string, download bool) {
+	if !requireAdmin(w, r, ctx, presence) {
+		return
+	}
+
+	snapshot, err := datasets.SnapshotByName(ctx, name)
+	if err == sql.ErrNoRows {
+		http.Error(w, "データセットが見つかりません", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logError(ctx, "データセットの取得に失敗しました: %v", err)
+		http.Error(w, "データセットの取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	var manifest FingerprintManifest
+	if err := json.Unmarshal([]byte(snapshot.ManifestJSON), &manifest); err != nil {
+		logError(ctx, "マニフェストのデコードに失敗しました: %v", err)
+		http.Error(w, "データセットの取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	snapshot.Manifest = &manifest
+
+	if !download {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(snapshot); err != nil {
+			logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
+			http.Error(w, "JSON応答のエンコードに失敗しました", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"dataset_%s.zip\"", snapshot.Name))
+	zw := zip.NewWriter(w)
+	for _, entry := range manifest.Samples {
+		for _, file := range []string{entry.WifiFile, entry.BleFile} {
+			if err := writeBlobToZip(ctx, zw, blobs, datasetKey(recordOrg(ctx), snapshot.Name, file), file); err != nil {
+				logError(ctx, "データセット %s のファイル %s を出力できませんでした: %v", snapshot.Name, file, err)
+			}
+		}
+	}
+	if err := writeManifestToZip(zw, manifest); err != nil {
+		logError(ctx, "manifest.jsonの書き込みに失敗しました: %v", err)
+		return
+	}
+	if err := zw.Close(); err != nil {
+		logError(ctx, "ZIPの書き込みに失敗しました: %v", err)
+	}
+}
+
+// writeBlobToZip は key のオブジェクトをZIPの name に書き込みます
+func writeBlobToZip(ctx context.Context, zw *zip.Writer, blobs BlobStore, key string, name string) error {
+	reader, err := blobs.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	fw, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, reader)
+	return err
+}
+
+// fingerprintSampleType はルームIDからサンプルタイプを返します。ルームIDが0のデータはネガティブサンプルです
+func fingerprintSampleType(roomID int) string {
+	if roomID == 0 {
+		return "negative"
+	}
+	return "positive"
+}
+
+// estimationSamplePath は推定サーバーの学習用ディレクトリ（名前空間 namespace の estimation/）内のファイルパスを返します
+func estimationSamplePath(namespace string, sampleType string, roomID int, fileName string) string {
+	return filepath.Join(filepath.FromSlash(namespace), "estimation", sampleType+"_samples", strconv.Itoa(roomID), fileName)
+}
+
+// fingerprintKey は名前空間 namespace の manager_fingerprint/{ルームID}/ に保存するファイルのキーを返します
+func fingerprintKey(namespace string, roomID int, fileName string) string {
+	return path.Join(namespace, "manager_fingerprint", strconv.Itoa(roomID), fileName)
+}
+
+// keyNamespace は key の名前空間を返します
+func keyNamespace(key string) string {
+	orgID, _ := splitTenantKey(key)
+	return tenantNamespace(orgID)
+}
+
+// relabeledFingerprintKey は付け替え先のルームでのキーを、元のキーと同じ名前空間で返します。ファイル名はタイムスタンプのみで作られるため、
+// 付け替え先に同名のファイルがある場合はサンプルIDを付けて上書きを避けます
+func relabeledFingerprintKey(ctx context.Context, blobs BlobStore, roomID int, key string, sampleID int) string {
+	newKey := fingerprintKey(keyNamespace(key), roomID, path.Base(key))
+	existing, err := blobs.Get(ctx, newKey)
+	if err != nil {
+		return newKey
+	}
+	existing.Close()
+	return strings.TrimSuffix(newKey, ".csv") + fmt.Sprintf("_%d.csv", sampleID)
+}
+
+// copyBlobTo は from のオブジェクトを to にコピーします
+func copyBlobTo(ctx context.Context, blobs BlobStore, from string, to string) error {
+	reader, err := blobs.Get(ctx, from)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	return blobs.Put(ctx, to, reader, -1)
+}
+
+// moveBlob は from のオブジェクトを to へ移動します
+func moveBlob(ctx context.Context, blobs BlobStore, from string, to string) error {
+	if err := copyBlobTo(ctx, blobs, from, to); err != nil {
+		return err
+	}
+	return blobs.Delete(ctx, from)
+}
+
+// recordAudit は管理者の操作を監査ログに記録します。記録に失敗しても操作自体は取り消しません
+func recordAudit(ctx context.Context, audit AuditStore, r *http.Request, action string, target string, detail string) {
+	entry := AuditEntry{
+		Actor:     getUserID(r),
+		Action:    action,
+		Target:    target,
+		Detail:    detail,
+		CreatedAt: time.Now(),
+	}
+	if err := audit.RecordAudit(ctx, entry); err != nil {
+		logError(ctx, "監査ログの記録に失敗しました: %v", err)
+	}
+}
+
+// recordHistoryAccess は誰がどのユーザー（nil の場合は全ユーザー）のどの期間の在室履歴を取得したかを記録します。
+// 記録に失敗しても取得自体は取り消しません
+func recordHistoryAccess(ctx context.Context, accessLog HistoryAccessStore, r *http.Request, targetUserID *int, from time.Time, to time.Time) {
+	entry := HistoryAccessEntry{
+		Requester:    getUserID(r),
+		TargetUserID: targetUserID,
+		Endpoint:     r.URL.Path,
+		From:         from,
+		To:           to,
+		AccessedAt:   time.Now(),
+	}
+	if err := accessLog.RecordHistoryAccess(ctx, entry); err != nil {
+		logError(ctx, "在室履歴の取得の記録に失敗しました: %v", err)
+	}
+}
+
+// handleAdminFingerprintDelete はサンプルの記録と保存済みのCSVを削除します
+func handleAdminFingerprintDelete(w http.ResponseWriter, r *http.Request, ctx context.Context, presence PresenceStore, fingerprints FingerprintStore, audit AuditStore, blobs BlobStore, sampleID int) {
+	if !requireAdmin(w, r, ctx, presence) {
+		return
+	}
+
+	sample, err := fingerprints.FingerprintSampleByID(ctx, sampleID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "フィンガープリントデータが見つかりません", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logError(ctx, "フィンガープリントデータの取得に失敗しました: %v", err)
+		http.Error(w, "フィンガープリントデータの取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	if err := fingerprints.DeleteFingerprintSample(ctx, sampleID); err != nil {
+		logError(ctx, "フィンガープリントデータの削除に失敗しました: %v", err)
+		http.Error(w, "フィンガープリントデータの削除に失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	deleteFingerprintFiles(ctx, blobs, sample)
+
+	recordAudit(ctx, audit, r, "fingerprint.delete", fmt.Sprintf("fingerprint_sample:%d", sampleID), fmt.Sprintf("room_id=%d sample_type=%s", sample.RoomID, sample.SampleType))
+	logInfo(ctx, "フィンガープリントデータ %d を削除しました", sampleID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteFingerprintFiles はサンプルの保存ファイルと推定用のファイルを削除します。削除できなかったファイルはログに記録します
+func deleteFingerprintFiles(ctx context.Context, blobs BlobStore, sample FingerprintSample) {
+	for _, key := range []string{sample.WifiKey, sample.BleKey} {
+		if err := blobs.Delete(ctx, key); err != nil {
+			logError(ctx, "フィンガープリントデータのファイル %s の削除に失敗しました: %v", key, err)
+		}
+		if err := os.Remove(estimationSamplePath(keyNamespace(key), sample.SampleType, sample.RoomID, path.Base(key))); err != nil && !os.IsNotExist(err) {
+			logError(ctx, "推定用フィンガープリントデータの削除に失敗しました: %v", err)
+		}
+	}
+}
+
+// handleAdminFingerprintRelabel はサンプルのルームを付け替え、CSVを新しいルーム（ポジティブ/ネガティブ）の保存先へ移動します
+func handleAdminFingerprintRelabel(w http.ResponseWriter, r *http.Request, ctx context.Context, presence PresenceStore, fingerprints FingerprintStore, devices DeviceStore, audit AuditStore, blobs BlobStore, sampleID int) {
+	if !requireAdmin(w, r, ctx, presence) {
+		return
+	}
+
+	roomIDStr := r.FormValue("room_id")
+	roomID, err := strconv.Atoi(roomIDStr)
+	if err != nil || roomID < 0 {
+		logError(ctx, "room_idパラメータが無効です: %s", roomIDStr)
+		http.Error(w, "room_idパラメータは0以上の整数である必要があります。", http.StatusBadRequest)
+		return
+	}
+	if !requireOrgRoom(w, ctx, devices, roomID) {
+		return
+	}
+
+	sample, err := fingerprints.FingerprintSampleByID(ctx, sampleID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "フィンガープリントデータが見つかりません", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logError(ctx, "フィンガープリントデータの取得に失敗しました: %v", err)
+		http.Error(w, "フィンガープリントデータの取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	if sample.RoomID == roomID {
+		http.Error(w, "フィンガープリントデータは既にこのルームのデータです", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := fingerprints.FingerprintSampleByHash(ctx, roomID, sample.WifiSHA256, sample.BleSHA256); err == nil {
+		http.Error(w, "同じ内容のフィンガープリントデータが付け替え先のルームに保存済みです", http.StatusConflict)
+		return
+	} else if err != sql.ErrNoRows {
+		logError(ctx, "フィンガープリントデータの重複確認に失敗しました: %v", err)
+		http.Error(w, "フィンガープリントデータの重複確認に失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	relabeled := sample
+	relabeled.RoomID = roomID
+	relabeled.SampleType = fingerprintSampleType(roomID)
+	relabeled.WifiKey = relabeledFingerprintKey(ctx, blobs, roomID, sample.WifiKey, sampleID)
+	relabeled.BleKey = relabeledFingerprintKey(ctx, blobs, roomID, sample.BleKey, sampleID)
+
+	moves := [][2]string{{sample.WifiKey, relabeled.WifiKey}, {sample.BleKey, relabeled.BleKey}}
+	for i, move := range moves {
+		if err := moveBlob(ctx, blobs, move[0], move[1]); err != nil {
+			logError(ctx, "フィンガープリントデータのファイル %s の移動に失敗しました: %v", move[0], err)
+			for _, done := range moves[:i] {
+				moveBlob(ctx, blobs, done[1], done[0])
+			}
+			http.Error(w, "フィンガープリントデータのファイルの移動に失敗しました", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := fingerprints.RelabelFingerprintSample(ctx, relabeled); err != nil {
+		logError(ctx, "フィンガープリントデータのルーム変更に失敗しました: %v", err)
+		for _, move := range moves {
+			moveBlob(ctx, blobs, move[1], move[0])
+		}
+		http.Error(w, "フィンガープリントデータのルーム変更に失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	for _, move := range moves {
+		from := estimationSamplePath(keyNamespace(move[0]), sample.SampleType, sample.RoomID, path.Base(move[0]))
+		to := estimationSamplePath(keyNamespace(move[1]), relabeled.SampleType, relabeled.RoomID, path.Base(move[1]))
+		if err := os.MkdirAll(filepath.Dir(to), os.ModePerm); err != nil {
+			logError(ctx, "保存ディレクトリの作成に失敗しました: %v", err)
+			continue
+		}
+		if err := os.Rename(from, to); err != nil && !os.IsNotExist(err) {
+			logError(ctx, "推定用フィンガープリントデータの移動に失敗しました: %v", err)
+		}
+	}
+
+	recordAudit(ctx, audit, r, "fingerprint.relabel", fmt.Sprintf("fingerprint_sample:%d", sampleID), fmt.Sprintf("room_id=%d->%d", sample.RoomID, roomID))
+	logInfo(ctx, "フィンガープリントデータ %d のルームを %d から %d に変更しました", sampleID, sample.RoomID, roomID)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(relabeled); err != nil {
+		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
+		http.Error(w, "JSON応答のエンコードに失敗しました", http.StatusInternalServerError)
+	}
+}
+
+func handleAdminAuditLog(w http.ResponseWriter, r *http.Request, ctx context.Context, presence PresenceStore, audit AuditStore) {
+	if !requireAdmin(w, r, ctx, presence) {
+		return
+	}
+
+	limit := 100
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		parsed, err := strconv.Atoi(limitStr)
+		if err != nil || parsed <= 0 {
+			logError(ctx, "limitパラメータが無効です: %s", limitStr)
+			http.Error(w, "limitパラメータは正の整数である必要があります。", http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+
+	entries, err := audit.ListAudit(ctx, limit)
+	if err != nil {
+		logError(ctx, "監査ログの取得に失敗しました: %v", err)
+		http.Error(w, "監査ログの取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(AuditLogResponse{Entries: entries}); err != nil {
+		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
+		http.Error(w, "JSON応答のエンコードに失敗しました", http.StatusInternalServerError)
+	}
+}
+
+// handleAdminHistoryAccessLog は在室履歴の取得の記録を新しい順に返します。
+// user_id を指定した場合はそのユーザーの履歴と全ユーザーの履歴の取得を、requester を指定した場合はそのユーザーによる取得を返します
+func handleAdminHistoryAccessLog(w http.ResponseWriter, r *http.Request, ctx context.Context, presence PresenceStore, accessLog HistoryAccessStore) {
+	if !requireAdmin(w, r, ctx, presence) {
+		return
+	}
+
+	query := r.URL.Query()
+	filter := HistoryAccessFilter{Requester: query.Get("requester"), Limit: 100}
+	if limitStr := query.Get("limit"); limitStr != "" {
+		parsed, err := strconv.Atoi(limitStr)
+		if err != nil || parsed <= 0 {
+			logError(ctx, "limitパラメータが無効です: %s", limitStr)
+			http.Error(w, "limitパラメータは正の整数である必要があります。", http.StatusBadRequest)
+			return
+		}
+		filter.Limit = parsed
+	}
+	if userIDStr := query.Get("user_id"); userIDStr != "" {
+		userID, err := strconv.Atoi(userIDStr)
+		if err != nil {
+			logError(ctx, "user_idパラメータが無効です: %s", userIDStr)
+			http.Error(w, "user_idパラメータは整数である必要があります。", http.StatusBadRequest)
+			return
+		}
+		filter.TargetUserID = &userID
+	}
+
+	entries, err := accessLog.ListHistoryAccess(ctx, filter)
+	if err != nil {
+		logError(ctx, "在室履歴の取得の記録の読み込みに失敗しました: %v", err)
+		http.Error(w, "在室履歴の取得の記録の読み込みに失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(HistoryAccessLogResponse{Entries: entries}); err != nil {
+		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
+		http.Error(w, "JSON応答のエンコードに失敗しました", http.StatusInternalServerError)
+	}
+}
+
+// BlobStore はアップロードされたスキャンファイルの保存先を抽象化したインターフェースです。
+// キーは "uploads/2006-01-02/user/wifi_data_1.csv" のようなスラッシュ区切りの相対パスです。
+type BlobStore interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+	// List は prefix 以下のオブジェクトを再帰的に返します
+	List(ctx context.Context, prefix string) ([]BlobInfo, error)
+}
+
+type BlobInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// StorageConfig はアップロードファイルの保存先の設定です。backend は "local"（既定）または "s3" です
+type StorageConfig struct {
+	Backend       string `toml:"backend"`
+	Dir           string `toml:"dir"`
+	Endpoint      string `toml:"endpoint"`
+	Bucket        string `toml:"bucket"`
+	Region        string `toml:"region"`
+	AccessKey     string `toml:"access_key"`
+	AccessKeyFile string `toml:"access_key_file"`
+	SecretKey     string `toml:"secret_key"`
+	SecretKeyFile string `toml:"secret_key_file"`
+	UseSSL        bool   `toml:"use_ssl"`
+}
+
+// openBlobStore は設定に応じた BlobStore を返します。S3のバケットが存在しない場合は作成します
+func openBlobStore(ctx context.Context, config StorageConfig) (BlobStore, error) {
+	switch config.Backend {
+	case "", "local":
+		return &localBlobStore{root: config.Dir}, nil
+	case "s3":
+		client, err := minio.New(config.Endpoint, &minio.Options{
+			Creds:  credentials.NewStaticV4(config.AccessKey, config.SecretKey, ""),
+			Secure: config.UseSSL,
+			Region: config.Region,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("S3クライアントの作成に失敗しました: %v", err)
+		}
+
+		exists, err := client.BucketExists(ctx, config.Bucket)
+		if err != nil {
+			return nil, fmt.Errorf("バケット %s の確認に失敗しました: %v", config.Bucket, err)
+		}
+		if !exists {
+			if err := client.MakeBucket(ctx, config.Bucket, minio.MakeBucketOptions{Region: config.Region}); err != nil {
+				return nil, fmt.Errorf("バケット %s の作成に失敗しました: %v", config.Bucket, err)
+			}
+		}
+		return &s3BlobStore{client: client, bucket: config.Bucket}, nil
+	default:
+		return nil, fmt.Errorf("サポートされていないストレージバックエンドです: %s", config.Backend)
+	}
+}
+
+// blobKey はディレクトリパスを BlobStore のキーに変換します
+func blobKey(dir string) string {
+	return strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(dir)), "/")
+}
+
+// getBlobFile は key のオブジェクトをローカルの filePath に書き出します
+func getBlobFile(ctx context.Context, blobs BlobStore, key string, filePath string) error {
+	reader, err := blobs.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	file, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, reader); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// putBlobFile はローカルのファイルを key として保存します
+func putBlobFile(ctx context.Context, blobs BlobStore, key string, filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	return blobs.Put(ctx, key, file, info.Size())
+}
+
+// encryptedBlobMagic は暗号化したオブジェクトの先頭に付ける識別子です。これがないオブジェクトは暗号化する前に保存したものとして扱います
+var encryptedBlobMagic = []byte("ELPISENC1")
+
+// encryptedBlobChunkSize は暗号化したオブジェクトを区切るチャンクの平文の大きさです
+const encryptedBlobChunkSize = 64 * 1024
+
+// newBlobCipher は [StorageEncryption] key から AES-GCM を作成します
+func newBlobCipher(config StorageEncryptionConfig) (cipher.AEAD, error) {
+	key, err := base64.StdEncoding.DecodeString(config.Key)
+	if err != nil {
+		return nil, fmt.Errorf("[StorageEncryption] key はbase64でエンコードする必要があります: %v", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("[StorageEncryption] key は16・24・32バイトである必要があります: %v", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptedBlobStore は BlobStore に書き込むオブジェクトを暗号化し、読み込むときに復号します。
+// 形式は encryptedBlobMagic・ノンスの接頭辞・暗号化したチャンクの順です（STREAM 方式）。平文を encryptedBlobChunkSize ごとに
+// 区切り、ノンスの接頭辞・チャンクの番号・最後のチャンクかどうかをノンスに、オブジェクトのキーを追加データにして暗号化するため、
+// チャンクの入れ替え・切り詰めや別のキーへのオブジェクトのすり替えは復号の失敗になります。オブジェクト全体をメモリに読み込まずに暗号化・復号します。
+// allowPlaintext が false の場合、encryptedBlobMagic のないオブジェクトの読み込みはエラーにします
+type encryptedBlobStore struct {
+	BlobStore
+	aead           cipher.AEAD
+	allowPlaintext bool
+}
+
+// noncePrefixSize はノンスのうちオブジェクトごとに乱数で決める接頭辞の長さです。残りはチャンクの番号（4バイト）と最後のチャンクかどうか（1バイト）です
+func (e *encryptedBlobStore) noncePrefixSize() int {
+	return e.aead.NonceSize() - 5
+}
+
+// sealedSize は size バイトの平文を暗号化したオブジェクトの大きさを返します。size が負（不明）の場合は -1 を返します
+func (e *encryptedBlobStore) sealedSize(size int64) int64 {
+	if size < 0 {
+		return -1
+	}
+	chunks := (size + encryptedBlobChunkSize - 1) / encryptedBlobChunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+	return int64(len(encryptedBlobMagic)+e.noncePrefixSize()) + size + chunks*int64(e.aead.Overhead())
+}
+
+func (e *encryptedBlobStore) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	header := make([]byte, len(encryptedBlobMagic)+e.noncePrefixSize())
+	copy(header, encryptedBlobMagic)
+	if _, err := cryptorand.Read(header[len(encryptedBlobMagic):]); err != nil {
+		return fmt.Errorf("ノンスの生成に失敗しました: %v", err)
+	}
+	sealer := &blobSealer{
+		aead:   e.aead,
+		prefix: header[len(encryptedBlobMagic):],
+		aad:    []byte(key),
+		src:    bufio.NewReaderSize(r, encryptedBlobChunkSize),
+		size:   size,
+		buf:    header,
+	}
+	return e.BlobStore.Put(ctx, key, sealer, e.sealedSize(size))
+}
+
+func (e *encryptedBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	reader, err := e.BlobStore.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	src := bufio.NewReaderSize(reader, encryptedBlobChunkSize+e.aead.Overhead())
+	if magic, _ := src.Peek(len(encryptedBlobMagic)); !bytes.Equal(magic, encryptedBlobMagic) {
+		if !e.allowPlaintext {
+			reader.Close()
+			return nil, fmt.Errorf("オブジェクト %s は暗号化されていません（暗号化する前のファイルを読み込む場合は [StorageEncryption] allow_plaintext を有効にしてください）", key)
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{src, reader}, nil
+	}
+	prefix := make([]byte, e.noncePrefixSize())
+	if _, err := src.Discard(len(encryptedBlobMagic)); err != nil {
+		reader.Close()
+		return nil, err
+	}
+	if _, err := io.ReadFull(src, prefix); err != nil {
+		reader.Close()
+		return nil, fmt.Errorf("暗号化したオブジェクト %s が壊れています", key)
+	}
+	return &blobOpener{aead: e.aead, prefix: prefix, aad: []byte(key), key: key, src: src, closer: reader}, nil
+}
+
+// blobNonce はチャンクの番号と最後のチャンクかどうかからノンスを作ります
+func blobNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, len(prefix)+5)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[len(prefix):], counter)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// readBlobChunk は src から最大 n バイトを読み込み、その後にデータが残っていなければ last を true にします
+func readBlobChunk(src *bufio.Reader, n int) (chunk []byte, last bool, err error) {
+	chunk = make([]byte, n)
+	read, err := io.ReadFull(src, chunk)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return chunk[:read], true, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if _, err := src.Peek(1); err == io.EOF {
+		return chunk, true, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	return chunk, false, nil
+}
+
+// blobSealer は平文をチャンクごとに暗号化しながら読み出す io.Reader です。size が 0 以上の場合、平文の大きさが一致しなければエラーにします
+type blobSealer struct {
+	aead    cipher.AEAD
+	prefix  []byte
+	aad     []byte
+	src     *bufio.Reader
+	size    int64
+	read    int64
+	counter uint32
+	buf     []byte
+	done    bool
+}
+
+func (s *blobSealer) Read(p []byte) (int, error) {
+	for len(s.buf) == 0 {
+		if s.done {
+			return 0, io.EOF
+		}
+		chunk, last, err := readBlobChunk(s.src, encryptedBlobChunkSize)
+		if err != nil {
+			return 0, err
+		}
+		s.read += int64(len(chunk))
+		if last && s.size >= 0 && s.read != s.size {
+			return 0, fmt.Errorf("平文の大きさが一致しません（%d バイトを指定し、%d バイトを読み込みました）", s.size, s.read)
+		}
+		if !last && s.counter == math.MaxUint32 {
+			return 0, errors.New("暗号化できるオブジェクトの大きさを超えています")
+		}
+		s.buf = s.aead.Seal(chunk[:0], blobNonce(s.prefix, s.counter, last), chunk, s.aad)
+		s.counter++
+		s.done = last
+	}
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+// blobOpener は暗号化したオブジェクトをチャンクごとに復号しながら読み出す io.ReadCloser です
+type blobOpener struct {
+	aead    cipher.AEAD
+	prefix  []byte
+	aad     []byte
+	key     string
+	src     *bufio.Reader
+	closer  io.Closer
+	counter uint32
+	buf     []byte
+	done    bool
+}
+
+func (o *blobOpener) Read(p []byte) (int, error) {
+	for len(o.buf) == 0 {
+		if o.done {
+			return 0, io.EOF
+		}
+		chunk, last, err := readBlobChunk(o.src, encryptedBlobChunkSize+o.aead.Overhead())
+		if err != nil {
+			return 0, err
+		}
+		if !last && o.counter == math.MaxUint32 {
+			return 0, fmt.Errorf("暗号化したオブジェクト %s が壊れています", o.key)
+		}
+		plaintext, err := o.aead.Open(chunk[:0], blobNonce(o.prefix, o.counter, last), chunk, o.aad)
+		if err != nil {
+			return 0, fmt.Errorf("オブジェクト %s を復号できませんでした: %v", o.key, err)
+		}
+		o.buf = plaintext
+		o.counter++
+		o.done = last
+	}
+	n := copy(p, o.buf)
+	o.buf = o.buf[n:]
+	return n, nil
+}
+
+func (o *blobOpener) Close() error {
+	return o.closer.Close()
+}
+
+// localBlobStore は root 以下のローカルディスクにオブジェクトを保存します
+type localBlobStore struct {
+	root string
+}
+
+// path はキーを root 配下のファイルパスに変換します。".." で root の外を指すことはできません
+func (l *localBlobStore) path(key string) string {
+	return filepath.Join(l.root, filepath.FromSlash(blobKey(key)))
+}
+
+func (l *localBlobStore) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	filePath := l.path(key)
+	if err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
+		return err
+	}
+
+	outFile, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+	defer outFile.Close()
+
+	_, err = io.Copy(outFile, r)
+	return err
+}
+
+func (l *localBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	return os.Open(l.path(key))
+}
+
+func (l *localBlobStore) Delete(ctx context.Context, key string) error {
+	if err := os.Remove(l.path(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (l *localBlobStore) List(ctx context.Context, prefix string) ([]BlobInfo, error) {
+	root := filepath.Join(l.root, ".")
+	var blobInfos []BlobInfo
+	err := filepath.WalkDir(l.path(prefix), func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, filePath)
+		if err != nil {
+			return err
+		}
+		blobInfos = append(blobInfos, BlobInfo{Key: filepath.ToSlash(rel), Size: info.Size(), ModTime: info.ModTime()})
+		return nil
+	})
+	return blobInfos, err
+}
+
+// s3BlobStore はS3互換のオブジェクトストレージ（MinIOなど）にオブジェクトを保存します
+type s3BlobStore struct {
+	client *minio.Client
+	bucket string
+}
+
+func (s *s3BlobStore) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	_, err := s.client.PutObject(ctx, s.bucket, blobKey(key), r, size, minio.PutObjectOptions{ContentType: "text/csv"})
+	return err
+}
+
+// Get はオブジェクトが存在しない場合、ローカルディスクと同じく os.ErrNotExist を返します
+func (s *s3BlobStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	object, err := s.client.GetObject(ctx, s.bucket, blobKey(key), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := object.Stat(); err != nil {
+		object.Close()
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, os.ErrNotExist
+		}
+		return nil, err
+	}
+	return object, nil
+}
+
+func (s *s3BlobStore) Delete(ctx context.Context, key string) error {
+	return s.client.RemoveObject(ctx, s.bucket, blobKey(key), minio.RemoveObjectOptions{})
+}
+
+func (s *s3BlobStore) List(ctx context.Context, prefix string) ([]BlobInfo, error) {
+	prefix = blobKey(prefix)
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	var blobInfos []BlobInfo
+	for object := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if object.Err != nil {
+			return nil, object.Err
+		}
+		blobInfos = append(blobInfos, BlobInfo{Key: object.Key, Size: object.Size, ModTime: object.LastModified})
+	}
+	return blobInfos, nil
+}
+
+// Store はプレゼンス判定・セッション管理が使うSQL層を抽象化したインターフェースです。
+// クエリは $1 形式のプレースホルダーで記述し、ドライバごとの差異は実装側で吸収します。
+type Store interface {
+	Driver() string
+	DB() *sql.DB
+	Rebind(query string) string
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	PingContext(ctx context.Context) error
+	Close() error
+}
+
+// sqlExecutor は *sql.DB と *sql.Tx に共通するクエリ実行のメソッドです
+type sqlExecutor interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+type sqlStore struct {
+	db     *sql.DB
+	exec   sqlExecutor
+	driver string
+	stmts  *stmtCache
+}
+
+var placeholderPattern = regexp.MustCompile(`\$(\d+)`)
+
+// openStore は db_driver の設定に応じてPostgreSQLまたはSQLiteのストアを開きます
+func openStore(driver string, connStr string) (*sqlStore, error) {
+	switch driver {
+	case "postgres":
+		db, err := sql.Open("postgres", connStr)
+		if err != nil {
+			return nil, err
+		}
+		return &sqlStore{db: db, exec: db, driver: "postgres", stmts: &stmtCache{stmts: make(map[string]*sql.Stmt)}}, nil
+	case "sqlite":
+		dsn := connStr
+		if !strings.HasPrefix(dsn, "file:") {
+			dsn = "file:" + dsn
+		}
+		if !strings.Contains(dsn, "?") {
+			dsn += "?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_time_format=sqlite"
+		}
+		db, err := sql.Open("sqlite", dsn)
+		if err != nil {
+			return nil, err
+		}
+		// SQLiteは書き込みが直列化されるため、接続を1本に絞ってロック競合を避けます
+		db.SetMaxOpenConns(1)
+		return &sqlStore{db: db, exec: db, driver: "sqlite", stmts: &stmtCache{stmts: make(map[string]*sql.Stmt)}}, nil
+	default:
+		return nil, fmt.Errorf("未対応のデータベースドライバです: %s", driver)
+	}
+}
+
+// configurePool は設定ファイルで指定されたコネクションプールの上限を適用します。0の項目はドライバの既定値のままにします
+func (s *sqlStore) configurePool(ctx context.Context, maxOpenConns int, maxIdleConns int, connMaxLifetime time.Duration) {
+	if maxOpenConns > 0 {
+		if s.driver == "sqlite" {
+			logInfo(ctx, "SQLiteでは接続数を1に固定するため max_open_conns=%d は無視します", maxOpenConns)
+		} else {
+			s.db.SetMaxOpenConns(maxOpenConns)
+		}
+	}
+	if maxIdleConns > 0 {
+		s.db.SetMaxIdleConns(maxIdleConns)
+	}
+	if connMaxLifetime > 0 {
+		s.db.SetConnMaxLifetime(connMaxLifetime)
+	}
+}
+
+func (s *sqlStore) Driver() string {
+	return s.driver
+}
+
+func (s *sqlStore) DB() *sql.DB {
+	return s.db
+}
+
+// Rebind は $1 形式のプレースホルダーをドライバの形式に書き換えます
+func (s *sqlStore) Rebind(query string) string {
+	if s.driver == "sqlite" {
+		return placeholderPattern.ReplaceAllString(query, "?$1")
+	}
+	return query
+}
+
+// bindArgs はSQLiteでもPostgreSQLのTIMESTAMP型と同じくタイムゾーンを落とした壁時計の時刻で保存・比較されるよう、時刻の引数を変換します
+func (s *sqlStore) bindArgs(args []interface{}) []interface{} {
+	if s.driver != "sqlite" {
+		return args
+	}
+	bound := make([]interface{}, len(args))
+	for i, arg := range args {
+		switch v := arg.(type) {
+		case time.Time:
+			bound[i] = wallClock(v)
+		case sql.NullTime:
+			if v.Valid {
+				v.Time = wallClock(v.Time)
+			}
+			bound[i] = v
+		default:
+			bound[i] = arg
+		}
+	}
+	return bound
+}
+
+// wallClock は t の表示上の日時をそのままUTCとして扱った時刻を返します
+func wallClock(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+}
+
+// fromWallClock は TIMESTAMP 型から読み込んだ壁時計の時刻を loc の時刻として解釈し直します
+func fromWallClock(t time.Time, loc *time.Location) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), loc)
+}
+
+func (s *sqlStore) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return s.exec.ExecContext(ctx, s.Rebind(query), s.bindArgs(args)...)
+}
+
+func (s *sqlStore) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return s.exec.QueryContext(ctx, s.Rebind(query), s.bindArgs(args)...)
+}
+
+func (s *sqlStore) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return s.exec.QueryRowContext(ctx, s.Rebind(query), s.bindArgs(args)...)
+}
+
+func (s *sqlStore) PingContext(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+func (s *sqlStore) Close() error {
+	s.stmts.mu.Lock()
+	for _, stmt := range s.stmts.stmts {
+		stmt.Close()
+	}
+	s.stmts.mu.Unlock()
+	return s.db.Close()
+}
+
+// PresenceUpdate は在室と判定された1回の送信でセッションに反映する内容です
+type PresenceUpdate struct {
+	UserID               int
+	RoomID               int
+	SeenAt               time.Time
+	EstimationConfidence int
+	InquiryConfidence    int
+	MergeGap             time.Duration
+}
+
+const (
+	presenceTouched  = "touched"
+	presenceMoved    = "moved"
+	presenceReopened = "reopened"
+	presenceStarted  = "started"
+)
+
+// PresenceOutcome は UpsertPresence がセッションに対して行った操作です
+type PresenceOutcome struct {
+	Action     string
+	SessionID  int
+	FromRoomID int
+}
+
+// PresenceStore はユーザー・在室セッション・在室判定の永続化を扱うインターフェースです
+type PresenceStore interface {
+	PingContext(ctx context.Context) error
+	UserIDByName(ctx context.Context, username string) (int, error)
+	// UserName はユーザーのIDからユーザー名を返します。ユーザーが存在しない場合は sql.ErrNoRows を返します
+	UserName(ctx context.Context, userID int) (string, error)
+	IsAdmin(ctx context.Context, username string) (bool, error)
+	OpenSessionRoom(ctx context.Context, userID int) (int, error)
+	StartSession(ctx context.Context, userID int, roomID int, startTime time.Time, estimationConfidence int, inquiryConfidence int) error
+	EndOpenSessions(ctx context.Context, userID int, endTime time.Time) (int64, error)
+	TouchOpenSession(ctx context.Context, userID int, lastSeen time.Time, estimationConfidence int, inquiryConfidence int) (int64, error)
+	LatestClosedSession(ctx context.Context, userID int, endedAfter time.Time) (int, int, error)
+	ReopenSession(ctx context.Context, sessionID int, lastSeen time.Time, estimationConfidence int, inquiryConfidence int) error
+	// EndStaleSessions は cutoff より前から last_seen が更新されていない未終了セッションを endTime で終了し、終了したセッションを返します
+	EndStaleSessions(ctx context.Context, cutoff time.Time, endTime time.Time) ([]PresenceSession, error)
+	// DuplicateOpenSessions は開いたセッションが2件以上あるユーザーの、開いたセッションをユーザー・開始時刻の順に返します
+	DuplicateOpenSessions(ctx context.Context) ([]PresenceSession, error)
+	// CloseSessionAtLastSeen は開いたままのセッションを最後に信号を受信した時刻で終了します
+	CloseSessionAtLastSeen(ctx context.Context, sessionID int) (int64, error)
+	UpsertPresence(ctx context.Context, update PresenceUpdate) (PresenceOutcome, error)
+	PurgeSessions(ctx context.Context, endedBefore time.Time, archive bool, archivedAt time.Time) (int64, error)
+	// PurgeDecisions は before より前の在室判定を削除し、削除件数を返します
+	PurgeDecisions(ctx context.Context, before time.Time) (int64, error)
+	// PurgeTransitions は before より前のルーム移動を削除し、削除件数を返します
+	PurgeTransitions(ctx context.Context, before time.Time) (int64, error)
+	RecordTransition(ctx context.Context, transition RoomTransition) error
+	RecordDecision(ctx context.Context, decision PresenceDecision) (int, error)
+	ListDecisions(ctx context.Context, userID *int, limit int) ([]PresenceDecision, error)
+	ListSessions(ctx context.Context, from time.Time, to time.Time, after *sessionCursor, limit int) ([]PresenceSession, error)
+	ListUserSessions(ctx context.Context, userID int, from time.Time, to time.Time) ([]PresenceSession, error)
+	ListRoomSessions(ctx context.Context, roomID int, from time.Time, to time.Time) ([]PresenceSession, error)
+	ListUserTransitions(ctx context.Context, userID int, from time.Time, to time.Time) ([]RoomTransition, error)
+	CurrentOccupants(ctx context.Context) ([]RoomOccupants, error)
+	// TrackingConsent はユーザーの在室状況の記録への同意を返します。ユーザーが存在しない場合は sql.ErrNoRows を返します
+	TrackingConsent(ctx context.Context, userID int) (TrackingConsent, error)
+	SetTrackingConsent(ctx context.Context, userID int, consent bool, updatedAt time.Time) error
+	// SetTrackingPause は until まで在室状況の記録を一時停止します。until が nil の場合は再開します
+	SetTrackingPause(ctx context.Context, userID int, until *time.Time) error
+	// UsersWithoutConsent は在室状況の記録への同意を取り消したユーザーのIDを返します
+	UsersWithoutConsent(ctx context.Context) (map[int]bool, error)
+}
+
+// DeviceStore はビーコン・WiFiアクセスポイントとルームの対応を扱うインターフェースです
+type DeviceStore interface {
+	// RoomIDsByBeacons は serviceUUIDs のうち登録済みのビーコンについて、大文字のサービスUUIDからルームIDへの対応を返します
+	RoomIDsByBeacons(ctx context.Context, serviceUUIDs []string) (map[string]int, error)
+	// RoomIDsByWifi は bssids のうち登録済みのアクセスポイントについて、小文字のBSSIDからルームIDへの対応を返します
+	RoomIDsByWifi(ctx context.Context, bssids []string) (map[string]int, error)
+	RoomName(ctx context.Context, roomID int) (string, error)
+	// RoomMappings はルームに割り当てられたすべてのビーコン・WiFiアクセスポイントを組織IDごとに返します
+	RoomMappings(ctx context.Context) (map[int]RoomMappings, error)
+}
+
+// RoomMappings はビーコンのサービスUUID（大文字）・WiFiアクセスポイントのBSSID（小文字）からルームIDへの対応です
+type RoomMappings struct {
+	Beacons map[string]int
+	Wifi    map[string]int
+}
+
+// FingerprintStore は収集したフィンガープリントデータの記録と重複判定を扱うインターフェースです
+type FingerprintStore interface {
+	// FingerprintSampleByHash は同じルーム・同じ内容のサンプルを返します。存在しない場合は sql.ErrNoRows を返します
+	FingerprintSampleByHash(ctx context.Context, roomID int, wifiSHA256 string, bleSHA256 string) (FingerprintSample, error)
+	FingerprintSampleByID(ctx context.Context, sampleID int) (FingerprintSample, error)
+	ListFingerprintSamples(ctx context.Context, filter FingerprintSampleFilter) ([]FingerprintSample, error)
+	RecordFingerprintSample(ctx context.Context, sample FingerprintSample) (int, error)
+	MarkFingerprintDuplicate(ctx context.Context, sampleID int, at time.Time) error
+	// RelabelFingerprintSample は sample.SampleID のルーム・サンプルタイプ・保存先キーを sample の値に更新します
+	RelabelFingerprintSample(ctx context.Context, sample FingerprintSample) error
+	DeleteFingerprintSample(ctx context.Context, sampleID int) error
+	FingerprintDedupStats(ctx context.Context) (FingerprintDedupStats, error)
+}
+
+// AuditStore は管理者操作の監査ログを扱うインターフェースです
+type AuditStore interface {
+	RecordAudit(ctx context.Context, entry AuditEntry) error
+	ListAudit(ctx context.Context, limit int) ([]AuditEntry, error)
+}
+
+// HistoryAccessStore は在室履歴の取得の記録を扱うインターフェースです
+type HistoryAccessStore interface {
+	RecordHistoryAccess(ctx context.Context, entry HistoryAccessEntry) error
+	// ListHistoryAccess は記録を新しい順に返します
+	ListHistoryAccess(ctx context.Context, filter HistoryAccessFilter) ([]HistoryAccessEntry, error)
+}
+
+// DatasetStore はデータセットのスナップショットを扱うインターフェースです
+type DatasetStore interface {
+	CreateSnapshot(ctx context.Context, snapshot DatasetSnapshot) (int, error)
+	// ListSnapshots はマニフェストを除いたスナップショットの一覧を新しい順に返します
+	ListSnapshots(ctx context.Context) ([]DatasetSnapshot, error)
+	// SnapshotByName はマニフェストを含むスナップショットを返します。存在しない場合は sql.ErrNoRows を返します
+	SnapshotByName(ctx context.Context, name string) (DatasetSnapshot, error)
+}
+
+// UploadStore は送信・収集ごとの保存ファイルの記録を扱うインターフェースです
+type UploadStore interface {
+	RecordUpload(ctx context.Context, record UploadRecord) (int, error)
+	// LinkUploadDecision は保存ファイルの記録に在室判定と判定したルームを関連付けます
+	LinkUploadDecision(ctx context.Context, uploadID int, decisionID int, roomID *int) error
+	ListUploads(ctx context.Context, filter UploadFilter) ([]UploadRecord, error)
+}
+
+// SubmissionQueueStore は推定サーバーの停止中に受け付けた信号の送信（リトライキュー）を扱うインターフェースです
+type SubmissionQueueStore interface {
+	EnqueueSubmission(ctx context.Context, submission QueuedSubmission) (int, error)
+	// HasQueuedSubmissions はユーザーに再送を待つ送信があるかを返します
+	HasQueuedSubmissions(ctx context.Context, userID int) (bool, error)
+	// QueuedSubmissions は再送を待つ送信を受信した順に最大 limit 件返します
+	QueuedSubmissions(ctx context.Context, limit int) ([]QueuedSubmission, error)
+	DeleteQueuedSubmission(ctx context.Context, queueID int) error
+	// RecordSubmissionAttempt は再送に失敗した回数と最後のエラーを記録します
+	RecordSubmissionAttempt(ctx context.Context, queueID int, lastError string) error
+}
+
+// ReportStore は統計・レポート・エクスポート用の集計クエリを実行します。多くの集計は PostgreSQL 固有の関数を使うため、
+// 呼び出す前に requirePostgres でドライバを確認します
+type ReportStore interface {
+	Driver() string
+	// QueryReport は namedQuery として宣言した集計クエリを実行します
+	QueryReport(ctx context.Context, q namedQuery, args ...interface{}) (*sql.Rows, error)
+}
+
+// OrgStore は組織とユーザーの所属を扱うインターフェースです。ユーザー名・ユーザーIDは組織をまたいで一意です
+type OrgStore interface {
+	// PrincipalOrg はユーザー名の所属する組織のIDを返します。ユーザーが存在しない場合は sql.ErrNoRows を返します
+	PrincipalOrg(ctx context.Context, username string) (int, error)
+	// UserOrg はユーザーIDの所属する組織のIDを返します。ユーザーが存在しない場合は sql.ErrNoRows を返します
+	UserOrg(ctx context.Context, userID int) (int, error)
+	Organization(ctx context.Context, orgID int) (Organization, error)
+	Organizations(ctx context.Context) ([]Organization, error)
+}
+
+// UserCredential はユーザーのパスワードです。Hash は bcrypt のハッシュで、Legacy はハッシュ化する前の平文のパスワードです
+type UserCredential struct {
+	Username string
+	Hash     string
+	Legacy   string
+}
+
+// CredentialStore はBasic認証で照合するユーザーのパスワードを読み書きします
+type CredentialStore interface {
+	// Credential はユーザー名のパスワードを返します。ユーザーが存在しない場合は sql.ErrNoRows を返します
+	Credential(ctx context.Context, username string) (UserCredential, error)
+	// SetPasswordHash はユーザーのパスワードのハッシュを保存し、平文のパスワードを削除します
+	SetPasswordHash(ctx context.Context, username string, hash string) error
+	// LegacyCredentials は平文のパスワードしかないユーザーを返します
+	LegacyCredentials(ctx context.Context) ([]UserCredential, error)
+}
+
+// LeaseStore は定期処理を複数のインスタンスのうち1つだけが実行するためのリースを扱うインターフェースです。
+// 期限はインスタンスの時刻で判定するため、インスタンス間の時刻は NTP などで合わせておく必要があります
+type LeaseStore interface {
+	// AcquireLease は name のリースを holder が now から ttl の間保持します。他の holder が期限内のリースを保持している場合は false を返します
+	AcquireLease(ctx context.Context, name string, holder string, now time.Time, ttl time.Duration) (bool, error)
+}
+
+// IdempotencyStore は Idempotency-Key を付けたリクエストの結果をインスタンス間で共有するインターフェースです
+type IdempotencyStore interface {
+	// ReserveIdempotencyKey は principal の key の処理を始めます。すでに記録がある場合は false と記録済みの結果を返します
+	ReserveIdempotencyKey(ctx context.Context, principal string, key string, path string, now time.Time) (bool, IdempotentResult, error)
+	CompleteIdempotencyKey(ctx context.Context, principal string, key string, result IdempotentResult) error
+	// ReleaseIdempotencyKey は処理中の記録を削除し、同じキーで再送できるようにします
+	ReleaseIdempotencyKey(ctx context.Context, principal string, key string) error
+	DeleteExpiredIdempotencyKeys(ctx context.Context, before time.Time) (int64, error)
+}
+
+// APIKeyStore は組織に発行したAPIキーを扱うインターフェースです。APIKeyByHash 以外は組織で絞り込みます
+type APIKeyStore interface {
+	// APIKeyByHash は失効していないAPIキーをハッシュから探します。存在しない場合は sql.ErrNoRows を返します
+	APIKeyByHash(ctx context.Context, hash string) (APIKey, error)
+	// APIKeys は失効したキーを含めて発行した順に返します
+	APIKeys(ctx context.Context) ([]APIKey, error)
+	CreateAPIKey(ctx context.Context, key APIKey, hash string) (int, error)
+	// RevokeAPIKey はキーを失効させます。存在しないか失効済みの場合は sql.ErrNoRows を返します
+	RevokeAPIKey(ctx context.Context, keyID int, at time.Time) error
+}
+
+// UsageStore は組織・APIキーごとの月間の利用量を扱うインターフェースです。period は YYYY-MM 形式の月です
+type UsageStore interface {
+	// MeterRequest はAPIキーのリクエストを1件記録します。今月のリクエスト数が quota（0 の場合は無制限）に達している場合は記録せずに false を返します
+	MeterRequest(ctx context.Context, orgID int, keyID int, period string, quota int64) (bool, error)
+	AddUsage(ctx context.Context, orgID int, keyID int, period string, metric string, n int64) error
+	Usage(ctx context.Context, period string) ([]UsageCounter, error)
+}
+
+// TenantSettingsStore は組織ごとに設定ファイルの値を上書きする設定を扱うインターフェースです
+type TenantSettingsStore interface {
+	// TenantSettings は組織の上書きを返します。上書きを設定していない場合は sql.ErrNoRows を返します
+	TenantSettings(ctx context.Context, orgID int) (TenantSettingsRecord, error)
+	// AllTenantSettings は上書きを設定したすべての組織の上書きを組織IDごとに返します
+	AllTenantSettings(ctx context.Context) (map[int]TenantSettings, error)
+	SetTenantSettings(ctx context.Context, record TenantSettingsRecord) error
+	// DeleteTenantSettings は組織の上書きを削除します。上書きを設定していない場合は sql.ErrNoRows を返します
+	DeleteTenantSettings(ctx context.Context, orgID int) error
+}
+
+// IdentityLinkStore は集約モードの人物の対応表を扱うインターフェースです。組織で絞り込みます
+type IdentityLinkStore interface {
+	IdentityLinks(ctx context.Context) ([]IdentityLink, error)
+	// CreateIdentityLink は対応を記録します。サイトのユーザーが既に結び付けられている場合は sql.ErrNoRows を返します
+	CreateIdentityLink(ctx context.Context, link IdentityLink) (int, error)
+	// DeleteIdentityLink は対応を削除します。存在しない場合は sql.ErrNoRows を返します
+	DeleteIdentityLink(ctx context.Context, linkID int) error
+}
+
+// UserDeviceStore はユーザーの端末の登録を扱うインターフェースです。端末が存在しない場合は sql.ErrNoRows を返します
+type UserDeviceStore interface {
+	UserDevices(ctx context.Context, userID int) ([]UserDevice, error)
+	UserDevice(ctx context.Context, deviceID int) (UserDevice, error)
+	CreateUserDevice(ctx context.Context, device UserDevice) (int, error)
+	DeleteUserDevice(ctx context.Context, deviceID int) error
+	// TouchUserDevice は端末から最後に送信を受けた時刻を記録します
+	TouchUserDevice(ctx context.Context, deviceID int, seenAt time.Time) error
+}
+
+// BuildingAdminStore は建物の管理の委任を扱うインターフェースです
+type BuildingAdminStore interface {
+	BuildingAdmins(ctx context.Context) ([]BuildingAdmin, error)
+	// AdminBuildingIDs はユーザー username が管理を委任された建物のIDを返します
+	AdminBuildingIDs(ctx context.Context, username string) ([]int, error)
+	// GrantBuildingAdmin は委任を記録します。既に委任している場合は sql.ErrNoRows を返します
+	GrantBuildingAdmin(ctx context.Context, admin BuildingAdmin) error
+	// RevokeBuildingAdmin は委任を取り消します。存在しない場合は sql.ErrNoRows を返します
+	RevokeBuildingAdmin(ctx context.Context, userID int, buildingID int) error
+}
+
+// RoomAdminStore はルーム・ビーコンの登録を扱うインターフェースです。ルーム・ビーコンが存在しない場合は sql.ErrNoRows を返します
+type RoomAdminStore interface {
+	ManagedRooms(ctx context.Context) ([]ManagedRoom, error)
+	ManagedRoom(ctx context.Context, roomID int) (ManagedRoom, error)
+	CreateRoom(ctx context.Context, room ManagedRoom) (int, error)
+	UpdateRoom(ctx context.Context, room ManagedRoom) error
+	ManagedBeacons(ctx context.Context) ([]ManagedBeacon, error)
+	ManagedBeacon(ctx context.Context, beaconID int) (ManagedBeacon, error)
+	CreateBeacon(ctx context.Context, beacon ManagedBeacon) (int, error)
+	UpdateBeacon(ctx context.Context, beacon ManagedBeacon) error
+	DeleteBeacon(ctx context.Context, beaconID int) error
+}
+
+// BuildingStore は建物・階とルームの割り当てを扱うインターフェースです。建物・階が存在しない場合は sql.ErrNoRows を返します
+type BuildingStore interface {
+	// Buildings は建物の一覧を、階（level の順）とそのルームを含めて返します
+	Buildings(ctx context.Context) ([]Building, error)
+	Building(ctx context.Context, buildingID int) (Building, error)
+	Floor(ctx context.Context, floorID int) (Floor, error)
+}
+
+var (
+	_ OrgStore             = (*sqlStore)(nil)
+	_ BuildingStore        = (*sqlStore)(nil)
+	_ LeaseStore           = (*sqlStore)(nil)
+	_ IdempotencyStore     = (*sqlStore)(nil)
+	_ APIKeyStore          = (*sqlStore)(nil)
+	_ UsageStore           = (*sqlStore)(nil)
+	_ TenantSettingsStore  = (*sqlStore)(nil)
+	_ IdentityLinkStore    = (*sqlStore)(nil)
+	_ BuildingAdminStore   = (*sqlStore)(nil)
+	_ RoomAdminStore       = (*sqlStore)(nil)
+	_ UserDeviceStore      = (*sqlStore)(nil)
+	_ PresenceStore        = (*sqlStore)(nil)
+	_ DeviceStore          = (*sqlStore)(nil)
+	_ FingerprintStore     = (*sqlStore)(nil)
+	_ AuditStore           = (*sqlStore)(nil)
+	_ HistoryAccessStore   = (*sqlStore)(nil)
+	_ DatasetStore         = (*sqlStore)(nil)
+	_ UploadStore          = (*sqlStore)(nil)
+	_ SubmissionQueueStore = (*sqlStore)(nil)
+	_ ReportStore          = (*sqlStore)(nil)
+)
+
+// namedQuery はストア層が使うSQLです。パッケージ変数として一箇所で宣言し、
+// ストアごとに初回使用時に一度だけ準備した文を使い回します
+type namedQuery struct {
+	name string
+	sql  string
+}
+
+var (
+	// 組織IDの引数が0の場合は組織で絞り込みません（orgFromContext を参照）
+	queryUserIDByName    = namedQuery{"user_id_by_name", `SELECT id FROM users WHERE user_id = $1 AND (org_id = $2 OR $2 = 0)`}
+	queryUserName        = namedQuery{"user_name", `SELECT user_id FROM users WHERE id = $1 AND (org_id = $2 OR $2 = 0)`}
+	queryPrincipalOrg    = namedQuery{"principal_org", `SELECT org_id FROM users WHERE user_id = $1`}
+	queryCredential      = namedQuery{"credential", `SELECT user_id, COALESCE(password_hash, ''), COALESCE(password, '') FROM users WHERE user_id = $1`}
+	querySetPasswordHash = namedQuery{"set_password_hash", `UPDATE users SET password_hash = $2, password = NULL WHERE user_id = $1`}
+	queryLegacyPasswords = namedQuery{"legacy_passwords", `
+        SELECT user_id, password
+        FROM users
+        WHERE password_hash IS NULL AND password IS NOT NULL AND password <> ''
+        ORDER BY id`}
+	queryUserOrg         = namedQuery{"user_org", `SELECT org_id FROM users WHERE id = $1`}
+	queryOrganization    = namedQuery{"organization", `SELECT org_id, name, created_at FROM organizations WHERE org_id = $1`}
+	queryOrganizations   = namedQuery{"organizations", `SELECT org_id, name, created_at FROM organizations ORDER BY org_id`}
+	queryTrackingConsent = namedQuery{"tracking_consent", `
+        SELECT id, tracking_consent, consent_updated_at, tracking_paused_until
+        FROM users
+        WHERE id = $1 AND (org_id = $2 OR $2 = 0)
+    `}
+	queryBuildings = namedQuery{"buildings", `SELECT building_id, name FROM buildings WHERE (org_id = $1 OR $1 = 0) ORDER BY building_id`}
+	queryBuilding  = namedQuery{"building", `SELECT building_id, name FROM buildings WHERE building_id = $1 AND (org_id = $2 OR $2 = 0)`}
+	// 階ごとにルームの数だけ行を返します（ルームのない階は room_id が NULL の1行）。建物IDの引数が0の場合はすべての建物の階を返します
+	queryFloors = namedQuery{"floors", `
+        SELECT floors.floor_id, floors.building_id, floors.name, floors.level, rooms.room_id
+        FROM floors
+        JOIN buildings ON buildings.building_id = floors.building_id
+        LEFT JOIN rooms ON rooms.floor_id = floors.floor_id
+        WHERE (floors.building_id = $1 OR $1 = 0) AND (buildings.org_id = $2 OR $2 = 0)
+        ORDER BY floors.building_id, floors.level, floors.floor_id, rooms.room_id
+    `}
+	queryFloor = namedQuery{"floor", `
+        SELECT floors.floor_id, floors.building_id, floors.name, floors.level, rooms.room_id
+        FROM floors
+        JOIN buildings ON buildings.building_id = floors.building_id
+        LEFT JOIN rooms ON rooms.floor_id = floors.floor_id
+        WHERE floors.floor_id = $1 AND (buildings.org_id = $2 OR $2 = 0)
+        ORDER BY rooms.room_id
+    `}
+	querySetTrackingPause = namedQuery{"set_tracking_pause", `
+        UPDATE users
+        SET tracking_paused_until = $2
+        WHERE id = $1 AND (org_id = $3 OR $3 = 0)
+    `}
+	querySetTrackingConsent = namedQuery{"set_tracking_consent", `
+        UPDATE users
+        SET tracking_consent = $2, consent_updated_at = $3
+        WHERE id = $1 AND (org_id = $4 OR $4 = 0)
+    `}
+	queryUsersWithoutConsent = namedQuery{"users_without_consent", `
+        SELECT id
+        FROM users
+        WHERE NOT tracking_consent AND (org_id = $1 OR $1 = 0)
+    `}
+	queryIsAdmin = namedQuery{"is_admin", `
+        SELECT EXISTS (
+            SELECT 1 FROM users
+            JOIN user_roles ON user_roles.user_id = users.id
+            JOIN roles ON roles.role_id = user_roles.role_id
+            WHERE users.user_id = $1 AND roles.role_name = 'Admin' AND (users.org_id = $2 OR $2 = 0)
+        )
+    `}
+	// $1 はPostgreSQLでは配列、SQLiteではJSON配列の文字列です（listArg を参照）
+	queryRoomIDsByBeacons = namedQuery{"room_ids_by_beacons", `
+        SELECT service_uuid, room_id FROM beacons
+        WHERE UPPER(service_uuid) = ANY($1) AND room_id IS NOT NULL AND (org_id = $2 OR $2 = 0)
+        ORDER BY beacon_id
+    `}
+	queryRoomIDsByBeaconsSQLite = namedQuery{"room_ids_by_beacons_sqlite", `
+        SELECT service_uuid, room_id FROM beacons
+        WHERE UPPER(service_uuid) IN (SELECT value FROM json_each($1)) AND room_id IS NOT NULL AND (org_id = $2 OR $2 = 0)
+        ORDER BY beacon_id
+    `}
+	queryRoomIDsByWifi = namedQuery{"room_ids_by_wifi", `
+        SELECT bssid, room_id FROM wifi_access_points
+        WHERE LOWER(bssid) = ANY($1) AND room_id IS NOT NULL AND (org_id = $2 OR $2 = 0)
+        ORDER BY wifi_id
+    `}
+	queryRoomIDsByWifiSQLite = namedQuery{"room_ids_by_wifi_sqlite", `
+        SELECT bssid, room_id FROM wifi_access_points
+        WHERE LOWER(bssid) IN (SELECT value FROM json_each($1)) AND room_id IS NOT NULL AND (org_id = $2 OR $2 = 0)
+        ORDER BY wifi_id
+    `}
+	queryRoomMappingsBeacons = namedQuery{"room_mappings_beacons", `
+        SELECT org_id, service_uuid, room_id FROM beacons
+        WHERE service_uuid IS NOT NULL AND room_id IS NOT NULL
+        ORDER BY beacon_id
+    `}
+	queryRoomMappingsWifi = namedQuery{"room_mappings_wifi", `
+        SELECT org_id, bssid, room_id FROM wifi_access_points
+        WHERE room_id IS NOT NULL
+        ORDER BY wifi_id
+    `}
+	queryRoomName        = namedQuery{"room_name", `SELECT room_name FROM rooms WHERE room_id = $1 AND (org_id = $2 OR $2 = 0)`}
+	queryOpenSessionRoom = namedQuery{"open_session_room", `
+        SELECT room_id FROM user_presence_sessions
+        WHERE user_id = $1 AND end_time IS NULL
+    `}
+	queryStartSession = namedQuery{"start_session", `
+        INSERT INTO user_presence_sessions (user_id, room_id, start_time, last_seen, estimation_confidence, inquiry_confidence, org_id)
+        SELECT $1, $2, $3, $3, $4, $5, org_id FROM users WHERE id = $1
+    `}
+	queryEndOpenSessions = namedQuery{"end_open_sessions", `
+        UPDATE user_presence_sessions
+        SET end_time = $1
+        WHERE user_id = $2 AND end_time IS NULL
+    `}
+	queryTouchOpenSession = namedQuery{"touch_open_session", `
+        UPDATE user_presence_sessions
+        SET last_seen = $1, estimation_confidence = $3, inquiry_confidence = $4
+        WHERE user_id = $2 AND end_time IS NULL
+    `}
+	queryLatestClosedSession = namedQuery{"latest_closed_session", `
+        SELECT session_id, room_id FROM user_presence_sessions
+        WHERE user_id = $1 AND end_time IS NOT NULL AND end_time >= $2
+        ORDER BY end_time DESC
+        LIMIT 1
+    `}
+	queryReopenSession = namedQuery{"reopen_session", `
+        UPDATE user_presence_sessions
+        SET end_time = NULL, last_seen = $1, estimation_confidence = $3, inquiry_confidence = $4
+        WHERE session_id = $2
+    `}
+	queryEndStaleSessions = namedQuery{"end_stale_sessions", `
+        UPDATE user_presence_sessions
+        SET end_time = $2
+        WHERE end_time IS NULL AND last_seen < $1 AND (org_id = $3 OR $3 = 0)
+        RETURNING session_id, user_id, room_id, start_time, end_time, last_seen
+    `}
+	queryDuplicateOpenSessions = namedQuery{"duplicate_open_sessions", `
+        SELECT session_id, user_id, room_id, start_time, end_time, last_seen
+        FROM user_presence_sessions
+        WHERE end_time IS NULL AND (org_id = $1 OR $1 = 0) AND user_id IN (
+            SELECT user_id
+            FROM user_presence_sessions
+            WHERE end_time IS NULL
+            GROUP BY user_id
+            HAVING COUNT(*) > 1
+        )
+        ORDER BY user_id, start_time, session_id
+    `}
+	queryCloseSessionAtLastSeen = namedQuery{"close_session_at_last_seen", `
+        UPDATE user_presence_sessions
+        SET end_time = last_seen
+        WHERE session_id = $1 AND end_time IS NULL AND (org_id = $2 OR $2 = 0)
+    `}
+	queryRecordTransition = namedQuery{"record_transition", `
+        INSERT INTO room_transitions (user_id, from_room_id, to_room_id, transitioned_at)
+        VALUES ($1, $2, $3, $4)
+    `}
+	queryRecordDecision = namedQuery{"record_decision", `
+        INSERT INTO presence_decisions (user_id, room_id, estimation_confidence, inquiry_confidence, decision, decided_at, device_id)
+        VALUES ($1, $2, $3, $4, $5, $6, $7)
+        RETURNING decision_id
+    `}
+	queryListDecisions = namedQuery{"list_decisions", `
+        SELECT decision_id, user_id, room_id, estimation_confidence, inquiry_confidence, decision, decided_at, device_id
+        FROM presence_decisions
+        WHERE ($2 = 0 OR user_id IN (SELECT id FROM users WHERE org_id = $2))
+        ORDER BY decided_at DESC
+        LIMIT $1
+    `}
+	queryListUserDecisions = namedQuery{"list_user_decisions", `
+        SELECT decision_id, user_id, room_id, estimation_confidence, inquiry_confidence, decision, decided_at, device_id
+        FROM presence_decisions
+        WHERE user_id = $2 AND ($3 = 0 OR user_id IN (SELECT id FROM users WHERE org_id = $3))
+        ORDER BY decided_at DESC
+        LIMIT $1
+    `}
+	querySessionsInRange = namedQuery{"sessions_in_range", `
+        SELECT session_id, user_id, room_id, start_time, end_time, last_seen
+        FROM user_presence_sessions
+        WHERE start_time >= $1 AND start_time < $2 AND (org_id = $4 OR $4 = 0)
+        ORDER BY start_time, session_id
+        LIMIT $3
+    `}
+	querySessionsAfterCursor = namedQuery{"sessions_after_cursor", `
+        SELECT session_id, user_id, room_id, start_time, end_time, last_seen
+        FROM user_presence_sessions
+        WHERE start_time >= $1 AND start_time < $2 AND (org_id = $6 OR $6 = 0)
+          AND (start_time, session_id) > ($4, $5)
+        ORDER BY start_time, session_id
+        LIMIT $3
+    `}
+	queryUserSessions = namedQuery{"user_sessions", `
+        SELECT session_id, user_id, room_id, start_time, end_time, last_seen
+        FROM user_presence_sessions
+        WHERE user_id = $1 AND start_time >= $2 AND start_time < $3 AND (org_id = $4 OR $4 = 0)
+        ORDER BY start_time
+    `}
+	queryRoomSessions = namedQuery{"room_sessions", `
+        SELECT session_id, user_id, room_id, start_time, end_time, last_seen
+        FROM user_presence_sessions
+        WHERE room_id = $1 AND start_time >= $2 AND start_time < $3 AND (org_id = $4 OR $4 = 0)
+        ORDER BY start_time
+    `}
+	queryUserTransitions = namedQuery{"user_transitions", `
+        SELECT transition_id, user_id, from_room_id, to_room_id, transitioned_at
+        FROM room_transitions
+        WHERE user_id = $1 AND transitioned_at >= $2 AND transitioned_at < $3
+          AND ($4 = 0 OR user_id IN (SELECT id FROM users WHERE org_id = $4))
+        ORDER BY transitioned_at
+    `}
+	// queryLockPresenceUser は同じユーザーの在室判定の反映をトランザクションの終わりまで直列化します
+	queryLockPresenceUser = namedQuery{"lock_presence_user", `
+        SELECT id FROM users WHERE id = $1 FOR UPDATE
+    `}
+	// queryUpsertPresence は在室セッションの更新・ルーム移動・直前セッションの再開・新規開始を1文で行います。
+	// データ変更を伴うCTEはすべて同じスナップショットを参照するため、各CTEは open と recent の結果だけで分岐します。
+	queryUpsertPresence = namedQuery{"upsert_presence", `
+    WITH open AS (
+        SELECT session_id, room_id FROM user_presence_sessions
+        WHERE user_id = $1 AND end_time IS NULL
+        ORDER BY start_time DESC
+        LIMIT 1
+        FOR UPDATE
+    ),
+    touched AS (
+        UPDATE user_presence_sessions
+        SET last_seen = $3, estimation_confidence = $4, inquiry_confidence = $5
+        WHERE session_id = (SELECT session_id FROM open WHERE room_id = $2)
+        RETURNING session_id
+    ),
+    closed AS (
+        UPDATE user_presence_sessions
+        SET end_time = $3
+        WHERE user_id = $1 AND end_time IS NULL
+          AND EXISTS (SELECT 1 FROM open WHERE room_id <> $2)
+        RETURNING session_id
+    ),
+    moved AS (
+        INSERT INTO room_transitions (user_id, from_room_id, to_room_id, transitioned_at)
+        SELECT $1, room_id, $2, $3 FROM open WHERE room_id <> $2
+        RETURNING from_room_id
+    ),
+    recent AS (
+        SELECT session_id, room_id FROM user_presence_sessions
+        WHERE user_id = $1 AND end_time IS NOT NULL AND end_time >= $6
+          AND NOT EXISTS (SELECT 1 FROM open)
+        ORDER BY end_time DESC
+        LIMIT 1
+    ),
+    reopened AS (
+        UPDATE user_presence_sessions
+        SET end_time = NULL, last_seen = $3, estimation_confidence = $4, inquiry_confidence = $5
+        WHERE session_id = (SELECT session_id FROM recent WHERE room_id = $2)
+        RETURNING session_id
+    ),
+    started AS (
+        INSERT INTO user_presence_sessions (user_id, room_id, start_time, last_seen, estimation_confidence, inquiry_confidence, org_id)
+        SELECT $1, $2, $3, $3, $4, $5, org_id FROM users
+        WHERE id = $1
+          AND NOT EXISTS (SELECT 1 FROM open WHERE room_id = $2)
+          AND NOT EXISTS (SELECT 1 FROM recent WHERE room_id = $2)
+        RETURNING session_id
+    )
+    SELECT
+        CASE
+            WHEN EXISTS (SELECT 1 FROM touched) THEN 'touched'
+            WHEN EXISTS (SELECT 1 FROM reopened) THEN 'reopened'
+            WHEN EXISTS (SELECT 1 FROM moved) THEN 'moved'
+            ELSE 'started'
+        END,
+        COALESCE((SELECT session_id FROM touched), (SELECT session_id FROM reopened), (SELECT session_id FROM started), 0),
+        COALESCE((SELECT from_room_id FROM moved), 0)
+`}
+	queryArchiveSessions = namedQuery{"archive_sessions", `
+        INSERT INTO user_presence_sessions_archive
+            (session_id, user_id, room_id, start_time, end_time, last_seen, estimation_confidence, inquiry_confidence, archived_at, org_id)
+        SELECT session_id, user_id, room_id, start_time, end_time, last_seen, estimation_confidence, inquiry_confidence, $2, org_id
+        FROM user_presence_sessions
+        WHERE end_time IS NOT NULL AND end_time < $1 AND (org_id = $3 OR $3 = 0)
+    `}
+	queryPurgeSessions = namedQuery{"purge_sessions", `
+        DELETE FROM user_presence_sessions
+        WHERE end_time IS NOT NULL AND end_time < $1 AND (org_id = $2 OR $2 = 0)
+    `}
+	queryPurgeDecisions = namedQuery{"purge_decisions", `
+        DELETE FROM presence_decisions
+        WHERE decided_at < $1 AND ($2 = 0 OR user_id IN (SELECT id FROM users WHERE org_id = $2))
+    `}
+	queryPurgeTransitions = namedQuery{"purge_transitions", `
+        DELETE FROM room_transitions
+        WHERE transitioned_at < $1 AND ($2 = 0 OR user_id IN (SELECT id FROM users WHERE org_id = $2))
+    `}
+	queryFingerprintSampleByHash = namedQuery{"fingerprint_sample_by_hash", `
+        SELECT sample_id, room_id, sample_type, wifi_key, ble_key, wifi_sha256, ble_sha256, wifi_size, ble_size, wifi_records, ble_records, collected_at, collected_by, duplicate_count, last_duplicate_at
+        FROM fingerprint_samples
+        WHERE room_id = $1 AND wifi_sha256 = $2 AND ble_sha256 = $3 AND org_id = $4
+    `}
+	queryFingerprintSampleByID = namedQuery{"fingerprint_sample_by_id", `
+        SELECT sample_id, room_id, sample_type, wifi_key, ble_key, wifi_sha256, ble_sha256, wifi_size, ble_size, wifi_records, ble_records, collected_at, collected_by, duplicate_count, last_duplicate_at
+        FROM fingerprint_samples
+        WHERE sample_id = $1 AND (org_id = $2 OR $2 = 0)
+    `}
+	// room_id が負の場合・sample_type が空の場合はその条件で絞り込みません
+	queryListFingerprintSamples = namedQuery{"list_fingerprint_samples", `
+        SELECT sample_id, room_id, sample_type, wifi_key, ble_key, wifi_sha256, ble_sha256, wifi_size, ble_size, wifi_records, ble_records, collected_at, collected_by, duplicate_count, last_duplicate_at
+        FROM fingerprint_samples
+        WHERE sample_id > $1 AND (room_id = $2 OR $2 < 0) AND (sample_type = $3 OR $3 = '') AND (org_id = $5 OR $5 = 0)
+        ORDER BY sample_id
+        LIMIT $4
+    `}
+	queryRecordFingerprintSample = namedQuery{"record_fingerprint_sample", `
+        INSERT INTO fingerprint_samples (room_id, sample_type, wifi_key, ble_key, wifi_sha256, ble_sha256, wifi_size, ble_size, wifi_records, ble_records, collected_at, collected_by, org_id)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+        RETURNING sample_id
+    `}
+	queryMarkFingerprintDuplicate = namedQuery{"mark_fingerprint_duplicate", `
+        UPDATE fingerprint_samples
+        SET duplicate_count = duplicate_count + 1, last_duplicate_at = $2
+        WHERE sample_id = $1 AND (org_id = $3 OR $3 = 0)
+    `}
+	queryRelabelFingerprintSample = namedQuery{"relabel_fingerprint_sample", `
+        UPDATE fingerprint_samples
+        SET room_id = $2, sample_type = $3, wifi_key = $4, ble_key = $5
+        WHERE sample_id = $1 AND (org_id = $6 OR $6 = 0)
+    `}
+	queryDeleteFingerprintSample = namedQuery{"delete_fingerprint_sample", `DELETE FROM fingerprint_samples WHERE sample_id = $1 AND (org_id = $2 OR $2 = 0)`}
+	queryRecordAudit             = namedQuery{"record_audit", `
+        INSERT INTO admin_audit_log (actor, action, target, detail, created_at, org_id)
+        VALUES ($1, $2, $3, $4, $5, $6)
+    `}
+	queryListAudit = namedQuery{"list_audit", `
+        SELECT audit_id, actor, action, target, COALESCE(detail, ''), created_at
+        FROM admin_audit_log
+        WHERE (org_id = $2 OR $2 = 0)
+        ORDER BY created_at DESC, audit_id DESC
+        LIMIT $1
+    `}
+	queryRecordHistoryAccess = namedQuery{"record_history_access", `
+        INSERT INTO history_access_log (requester, target_user_id, endpoint, range_from, range_to, accessed_at, org_id)
+        VALUES ($1, $2, $3, $4, $5, $6, $7)
+    `}
+	queryListHistoryAccess = namedQuery{"list_history_access", `
+        SELECT access_id, requester, target_user_id, endpoint, range_from, range_to, accessed_at
+        FROM history_access_log
+        WHERE (requester = $1 OR $1 = '') AND (target_user_id = $2 OR target_user_id IS NULL OR $2 < 0) AND (org_id = $4 OR $4 = 0)
+        ORDER BY accessed_at DESC, access_id DESC
+        LIMIT $3
+    `}
+	queryRecordUpload = namedQuery{"record_upload", `
+        INSERT INTO uploads (kind, user_name, room_id, decision_id, sample_id, wifi_key, ble_key, wifi_size, ble_size, wifi_sha256, ble_sha256, uploaded_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+        RETURNING upload_id
+    `}
+	queryEnqueueSubmission = namedQuery{"enqueue_submission", `
+        INSERT INTO submission_queue (user_id, upload_id, wifi_key, ble_key, submitted_at, attempts, last_error, device_id)
+        VALUES ($1, $2, $3, $4, $5, 0, '', $6)
+        RETURNING queue_id
+    `}
+	queryCountUserQueuedSubmissions = namedQuery{"count_user_queued_submissions", `
+        SELECT COUNT(*)
+        FROM submission_queue
+        WHERE user_id = $1
+    `}
+	queryQueuedSubmissions = namedQuery{"queued_submissions", `
+        SELECT queue_id, user_id, upload_id, wifi_key, ble_key, submitted_at, attempts, last_error, device_id
+        FROM submission_queue
+        ORDER BY submitted_at, queue_id
+        LIMIT $1
+    `}
+	queryDeleteQueuedSubmission = namedQuery{"delete_queued_submission", `
+        DELETE FROM submission_queue
+        WHERE queue_id = $1
+    `}
+	queryRecordSubmissionAttempt = namedQuery{"record_submission_attempt", `
+        UPDATE submission_queue
+        SET attempts = attempts + 1, last_error = $2
+        WHERE queue_id = $1
+    `}
+	// 期限切れか同じ holder のリースのみ更新するため、更新した行数が0の場合は他のインスタンスが保持しています
+	queryAcquireLease = namedQuery{"acquire_lease", `
+        INSERT INTO job_leases (job_name, holder, expires_at)
+        VALUES ($1, $2, $3)
+        ON CONFLICT (job_name) DO UPDATE SET holder = excluded.holder, expires_at = excluded.expires_at
+        WHERE job_leases.holder = excluded.holder OR job_leases.expires_at < $4
+    `}
+	queryReserveIdempotencyKey = namedQuery{"reserve_idempotency_key", `
+        INSERT INTO idempotency_keys (principal, idempotency_key, request_path, created_at)
+        VALUES ($1, $2, $3, $4)
+        ON CONFLICT (principal, idempotency_key) DO NOTHING
+    `}
+	queryIdempotentResult = namedQuery{"idempotent_result", `
+        SELECT request_path, status_code, content_type, response_body
+        FROM idempotency_keys
+        WHERE principal = $1 AND idempotency_key = $2
+    `}
+	queryCompleteIdempotencyKey = namedQuery{"complete_idempotency_key", `
+        UPDATE idempotency_keys
+        SET status_code = $3, content_type = $4, response_body = $5
+        WHERE principal = $1 AND idempotency_key = $2
+    `}
+	queryReleaseIdempotencyKey = namedQuery{"release_idempotency_key", `
+        DELETE FROM idempotency_keys
+        WHERE principal = $1 AND idempotency_key = $2 AND status_code IS NULL
+    `}
+	queryDeleteExpiredIdempotencyKeys = namedQuery{"delete_expired_idempotency_keys", `
+        DELETE FROM idempotency_keys
+        WHERE created_at < $1
+    `}
+	queryAPIKeyByHash = namedQuery{"api_key_by_hash", `
+        SELECT key_id, org_id, name, key_prefix, monthly_quota, created_by, created_at, revoked_at
+        FROM api_keys
+        WHERE key_hash = $1 AND revoked_at IS NULL
+    `}
+	queryAPIKeys = namedQuery{"api_keys", `
+        SELECT key_id, org_id, name, key_prefix, monthly_quota, created_by, created_at, revoked_at
+        FROM api_keys
+        WHERE (org_id = $1 OR $1 = 0)
+        ORDER BY key_id
+    `}
+	queryCreateAPIKey = namedQuery{"create_api_key", `
+        INSERT INTO api_keys (org_id, name, key_prefix, key_hash, monthly_quota, created_by, created_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7)
+        RETURNING key_id
+    `}
+	queryRevokeAPIKey = namedQuery{"revoke_api_key", `
+        UPDATE api_keys
+        SET revoked_at = $2
+        WHERE key_id = $1 AND revoked_at IS NULL AND (org_id = $3 OR $3 = 0)
+    `}
+	// 今月のリクエスト数が上限に達している場合は更新しないため、更新した行数が0の場合は拒否します
+	queryMeterRequest = namedQuery{"meter_request", `
+        INSERT INTO usage_counters (org_id, key_id, period, metric, count)
+        VALUES ($1, $2, $3, 'requests', 1)
+        ON CONFLICT (org_id, key_id, period, metric) DO UPDATE SET count = usage_counters.count + 1
+        WHERE $4 = 0 OR usage_counters.count < $4
+    `}
+	queryAddUsage = namedQuery{"add_usage", `
+        INSERT INTO usage_counters (org_id, key_id, period, metric, count)
+        VALUES ($1, $2, $3, $4, $5)
+        ON CONFLICT (org_id, key_id, period, metric) DO UPDATE SET count = usage_counters.count + excluded.count
+    `}
+	queryTenantSettings    = namedQuery{"tenant_settings", `SELECT settings, updated_by, updated_at FROM tenant_settings WHERE org_id = $1`}
+	queryAllTenantSettings = namedQuery{"all_tenant_settings", `SELECT org_id, settings FROM tenant_settings ORDER BY org_id`}
+	querySetTenantSettings = namedQuery{"set_tenant_settings", `
+        INSERT INTO tenant_settings (org_id, settings, updated_by, updated_at)
+        VALUES ($1, $2, $3, $4)
+        ON CONFLICT (org_id) DO UPDATE SET settings = excluded.settings, updated_by = excluded.updated_by, updated_at = excluded.updated_at
+    `}
+	queryDeleteTenantSettings = namedQuery{"delete_tenant_settings", `DELETE FROM tenant_settings WHERE org_id = $1`}
+	queryUsage                = namedQuery{"usage", `
+        SELECT org_id, key_id, metric, count
+        FROM usage_counters
+        WHERE period = $1 AND (org_id = $2 OR $2 = 0)
+        ORDER BY org_id, key_id, metric
+    `}
+	queryIdentityLinks = namedQuery{"identity_links", `
+        SELECT link_id, org_id, identity, site, user_id, created_by, created_at
+        FROM identity_links
+        WHERE (org_id = $1 OR $1 = 0)
+        ORDER BY identity, site, user_id
+    `}
+	// 結び付け済みのユーザーは挿入しないため、返す行がない場合は sql.ErrNoRows になります
+	queryCreateIdentityLink = namedQuery{"create_identity_link", `
+        INSERT INTO identity_links (org_id, identity, site, user_id, created_by, created_at)
+        VALUES ($1, $2, $3, $4, $5, $6)
+        ON CONFLICT (org_id, site, user_id) DO NOTHING
+        RETURNING link_id
+    `}
+	queryDeleteIdentityLink = namedQuery{"delete_identity_link", `
+        DELETE FROM identity_links
+        WHERE link_id = $1 AND (org_id = $2 OR $2 = 0)
+    `}
+	queryUserDevices = namedQuery{"user_devices", `
+        SELECT device_id, user_id, name, platform, created_at, last_seen_at
+        FROM devices
+        WHERE user_id = $1 AND (org_id = $2 OR $2 = 0)
+        ORDER BY device_id
+    `}
+	queryUserDevice = namedQuery{"user_device", `
+        SELECT device_id, user_id, name, platform, created_at, last_seen_at
+        FROM devices
+        WHERE device_id = $1 AND (org_id = $2 OR $2 = 0)
+    `}
+	queryCreateUserDevice = namedQuery{"create_user_device", `
+        INSERT INTO devices (user_id, name, platform, created_at, org_id)
+        VALUES ($1, $2, $3, $4, $5)
+        RETURNING device_id
+    `}
+	queryDeleteUserDevice = namedQuery{"delete_user_device", `
+        DELETE FROM devices
+        WHERE device_id = $1 AND (org_id = $2 OR $2 = 0)
+    `}
+	queryTouchUserDevice = namedQuery{"touch_user_device", `
+        UPDATE devices
+        SET last_seen_at = $2
+        WHERE device_id = $1 AND (last_seen_at IS NULL OR last_seen_at < $2)
+    `}
+	queryBuildingAdmins = namedQuery{"building_admins", `
+        SELECT user_id, building_id, org_id, created_by, created_at
+        FROM building_admins
+        WHERE (org_id = $1 OR $1 = 0)
+        ORDER BY building_id, user_id
+    `}
+	queryAdminBuildingIDs = namedQuery{"admin_building_ids", `
+        SELECT building_admins.building_id
+        FROM building_admins
+        JOIN users ON users.id = building_admins.user_id
+        WHERE users.user_id = $1 AND (building_admins.org_id = $2 OR $2 = 0)
+        ORDER BY building_admins.building_id
+    `}
+	// 委任済みの場合は挿入しないため、返す行がない場合は sql.ErrNoRows になります
+	queryGrantBuildingAdmin = namedQuery{"grant_building_admin", `
+        INSERT INTO building_admins (user_id, building_id, org_id, created_by, created_at)
+        VALUES ($1, $2, $3, $4, $5)
+        ON CONFLICT (user_id, building_id) DO NOTHING
+        RETURNING user_id
+    `}
+	queryRevokeBuildingAdmin = namedQuery{"revoke_building_admin", `
+        DELETE FROM building_admins
+        WHERE user_id = $1 AND building_id = $2 AND (org_id = $3 OR $3 = 0)
+    `}
+	queryManagedRooms = namedQuery{"managed_rooms", `
+        SELECT room_id, room_name, floor_id
+        FROM rooms
+        WHERE (org_id = $1 OR $1 = 0)
+        ORDER BY room_id
+    `}
+	queryManagedRoom = namedQuery{"managed_room", `
+        SELECT room_id, room_name, floor_id
+        FROM rooms
+        WHERE room_id = $1 AND (org_id = $2 OR $2 = 0)
+    `}
+	queryCreateRoom = namedQuery{"create_room", `
+        INSERT INTO rooms (room_name, floor_id, org_id)
+        VALUES ($1, $2, $3)
+        RETURNING room_id
+    `}
+	queryUpdateRoom = namedQuery{"update_room", `
+        UPDATE rooms
+        SET room_name = $2, floor_id = $3
+        WHERE room_id = $1 AND (org_id = $4 OR $4 = 0)
+    `}
+	queryManagedBeacons = namedQuery{"managed_beacons", `
+        SELECT beacon_id, beacon_name, COALESCE(service_uuid, ''), room_id
+        FROM beacons
+        WHERE (org_id = $1 OR $1 = 0)
+        ORDER BY beacon_id
+    `}
+	queryManagedBeacon = namedQuery{"managed_beacon", `
+        SELECT beacon_id, beacon_name, COALESCE(service_uuid, ''), room_id
+        FROM beacons
+        WHERE beacon_id = $1 AND (org_id = $2 OR $2 = 0)
+    `}
+	queryCreateBeacon = namedQuery{"create_beacon", `
+        INSERT INTO beacons (beacon_name, service_uuid, room_id, org_id)
+        VALUES ($1, $2, $3, $4)
+        RETURNING beacon_id
+    `}
+	queryUpdateBeacon = namedQuery{"update_beacon", `
+        UPDATE beacons
+        SET beacon_name = $2, room_id = $3
+        WHERE beacon_id = $1 AND (org_id = $4 OR $4 = 0)
+    `}
+	queryDeleteBeacon = namedQuery{"delete_beacon", `
+        DELETE FROM beacons
+        WHERE beacon_id = $1 AND (org_id = $2 OR $2 = 0)
+    `}
+	queryLinkUploadDecision = namedQuery{"link_upload_decision", `
+        UPDATE uploads
+        SET decision_id = $2, room_id = $3
+        WHERE upload_id = $1
+    `}
+	// user_name・kind が空の場合・decision_id が負の場合はその条件で絞り込みません
+	queryListUploads = namedQuery{"list_uploads", `
+        SELECT u.upload_id, u.kind, u.user_name, u.room_id, u.decision_id, COALESCE(d.decision, ''), u.sample_id,
+               u.wifi_key, u.ble_key, u.wifi_size, u.ble_size, u.wifi_sha256, u.ble_sha256, u.uploaded_at
+        FROM uploads u
+        LEFT JOIN presence_decisions d ON d.decision_id = u.decision_id
+        WHERE u.upload_id > $1 AND (u.user_name = $2 OR $2 = '') AND (u.kind = $3 OR $3 = '') AND (u.decision_id = $4 OR $4 < 0)
+          AND ($6 = 0 OR u.user_name IN (SELECT user_id FROM users WHERE org_id = $6))
+        ORDER BY u.upload_id
+        LIMIT $5
+    `}
+	queryCreateSnapshot = namedQuery{"create_snapshot", `
+        INSERT INTO dataset_snapshots (name, description, created_by, created_at, sample_count, manifest, org_id)
+        VALUES ($1, $2, $3, $4, $5, $6, $7)
+        RETURNING snapshot_id
+    `}
+	queryListSnapshots = namedQuery{"list_snapshots", `
+        SELECT snapshot_id, name, description, created_by, created_at, sample_count
+        FROM dataset_snapshots
+        WHERE (org_id = $1 OR $1 = 0)
+        ORDER BY created_at DESC, snapshot_id DESC
+    `}
+	querySnapshotByName = namedQuery{"snapshot_by_name", `
+        SELECT snapshot_id, name, description, created_by, created_at, sample_count, manifest
+        FROM dataset_snapshots
+        WHERE name = $1 AND (org_id = $2 OR $2 = 0)
+    `}
+	queryFingerprintDedupStats = namedQuery{"fingerprint_dedup_stats", `
+        SELECT COUNT(*), COALESCE(SUM(duplicate_count), 0), COALESCE(SUM(duplicate_count * (wifi_size + ble_size)), 0)
+        FROM fingerprint_samples
+        WHERE (org_id = $1 OR $1 = 0)
+    `}
+	queryCurrentOccupants = namedQuery{"current_occupants", `
+        SELECT 
+            rooms.room_id, 
+            rooms.room_name, 
+            users.user_id, 
+            user_presence_sessions.last_seen
+        FROM 
+            rooms
+        LEFT JOIN 
+            user_presence_sessions ON rooms.room_id = user_presence_sessions.room_id AND user_presence_sessions.end_time IS NULL
+        LEFT JOIN 
+            users ON user_presence_sessions.user_id = users.id
+        WHERE 
+            (rooms.org_id = $1 OR $1 = 0)
+        ORDER BY 
+            rooms.room_id, users.user_id
+    `}
+	querySessionsForExport = namedQuery{"sessions_for_export", `
+        SELECT
+            user_presence_sessions.session_id,
+            user_presence_sessions.user_id,
+            COALESCE(users.user_id, ''),
+            user_presence_sessions.room_id,
+            COALESCE(rooms.room_name, ''),
+            user_presence_sessions.start_time,
+            user_presence_sessions.end_time,
+            user_presence_sessions.last_seen
+        FROM user_presence_sessions
+        LEFT JOIN users ON users.id = user_presence_sessions.user_id
+        LEFT JOIN rooms ON rooms.room_id = user_presence_sessions.room_id
+        WHERE user_presence_sessions.start_time >= $1 AND user_presence_sessions.start_time < $2
+            AND COALESCE(users.tracking_consent, TRUE)
+            AND (user_presence_sessions.org_id = $3 OR $3 = 0)
+        ORDER BY user_presence_sessions.start_time, user_presence_sessions.session_id
+    `}
+	queryUserPresenceStats = namedQuery{"user_presence_stats", `
+        SELECT
+            TO_CHAR(DATE_TRUNC($1, user_presence_sessions.start_time), 'YYYY-MM-DD') AS period_start,
+            user_presence_sessions.user_id,
+            COUNT(*) AS session_count,
+            COALESCE(SUM(EXTRACT(EPOCH FROM COALESCE(user_presence_sessions.end_time, user_presence_sessions.last_seen) - user_presence_sessions.start_time)) / 3600, 0) AS total_hours,
+            COALESCE(AVG(EXTRACT(EPOCH FROM COALESCE(user_presence_sessions.end_time, user_presence_sessions.last_seen) - user_presence_sessions.start_time)) / 60, 0) AS average_minutes
+        FROM user_presence_sessions
+        LEFT JOIN users ON users.id = user_presence_sessions.user_id
+        WHERE user_presence_sessions.start_time >= $2 AND user_presence_sessions.start_time < $3
+            AND COALESCE(users.tracking_consent, TRUE)
+            AND (user_presence_sessions.org_id = $4 OR $4 = 0)
+        GROUP BY 1, user_presence_sessions.user_id
+        ORDER BY 1, user_presence_sessions.user_id
+    `}
+	queryRoomPresenceStats = namedQuery{"room_presence_stats", `
+        SELECT
+            TO_CHAR(DATE_TRUNC($1, start_time), 'YYYY-MM-DD') AS period_start,
+            room_id,
+            COALESCE(SUM(EXTRACT(EPOCH FROM COALESCE(end_time, last_seen) - start_time)) / 3600, 0) AS occupancy_hours,
+            COUNT(DISTINCT user_id) AS unique_visitors,
+            COALESCE(AVG(EXTRACT(EPOCH FROM COALESCE(end_time, last_seen) - start_time)) / 60, 0) AS average_minutes
+        FROM user_presence_sessions
+        WHERE start_time >= $2 AND start_time < $3 AND (org_id = $4 OR $4 = 0)
+        GROUP BY 1, room_id
+        ORDER BY 1, room_id
+    `}
+	queryHourlyHeatmap = namedQuery{"hourly_heatmap", `
+        WITH slots AS (
+            SELECT generate_series($1::TIMESTAMP, $2::TIMESTAMP - INTERVAL '1 hour', INTERVAL '1 hour') AS slot_start
+        ),
+        presence AS (
+            SELECT rooms.room_id, rooms.room_name, slots.slot_start, user_presence_sessions.user_id
+            FROM slots
+            CROSS JOIN rooms
+            LEFT JOIN user_presence_sessions
+                ON user_presence_sessions.room_id = rooms.room_id
+                AND user_presence_sessions.start_time < slots.slot_start + INTERVAL '1 hour'
+                AND COALESCE(user_presence_sessions.end_time, user_presence_sessions.last_seen) > slots.slot_start
+            WHERE (rooms.org_id = $3 OR $3 = 0)
+        ),
+        counts AS (
+            SELECT room_id, room_name, slot_start, COUNT(DISTINCT user_id) AS occupants
+            FROM presence
+            GROUP BY room_id, room_name, slot_start
+        ),
+        hourly AS (
+            SELECT room_id, room_name, EXTRACT(HOUR FROM slot_start)::INT AS hour, AVG(occupants)::FLOAT AS average_occupants
+            FROM counts
+            GROUP BY room_id, room_name, hour
+        ),
+        visitors AS (
+            SELECT room_id, EXTRACT(HOUR FROM slot_start)::INT AS hour, COUNT(DISTINCT user_id) AS visitors
+            FROM presence
+            GROUP BY room_id, hour
+        )
+        SELECT hourly.room_id, hourly.room_name, hourly.hour, hourly.average_occupants, visitors.visitors
+        FROM hourly
+        JOIN visitors ON visitors.room_id = hourly.room_id AND visitors.hour = hourly.hour
+        ORDER BY hourly.room_id, hourly.hour
+    `}
+	queryAttendanceDays = namedQuery{"attendance_days", `
+        SELECT
+            user_presence_sessions.user_id,
+            COALESCE(users.user_id, ''),
+            TO_CHAR(user_presence_sessions.start_time, 'YYYY-MM-DD') AS day,
+            MIN(user_presence_sessions.start_time) AS first_in,
+            MAX(COALESCE(user_presence_sessions.end_time, user_presence_sessions.last_seen)) AS last_out,
+            COALESCE(SUM(EXTRACT(EPOCH FROM COALESCE(user_presence_sessions.end_time, user_presence_sessions.last_seen) - user_presence_sessions.start_time)) / 3600, 0) AS hours
+        FROM user_presence_sessions
+        LEFT JOIN users ON users.id = user_presence_sessions.user_id
+        WHERE user_presence_sessions.start_time >= $1 AND user_presence_sessions.start_time < $2
+            AND COALESCE(users.tracking_consent, TRUE)
+            AND (user_presence_sessions.org_id = $3 OR $3 = 0)
+        GROUP BY user_presence_sessions.user_id, users.user_id, day
+        ORDER BY user_presence_sessions.user_id, day
+    `}
+	queryRoomDwellStats = namedQuery{"room_dwell_stats", `
+        WITH durations AS (
+            SELECT
+                room_id,
+                user_id,
+                EXTRACT(EPOCH FROM COALESCE(end_time, last_seen) - start_time) / 60 AS minutes
+            FROM user_presence_sessions
+            WHERE start_time >= $1 AND start_time < $2 AND (org_id = $3 OR $3 = 0)
+        )
+        SELECT
+            durations.room_id,
+            COALESCE(rooms.room_name, ''),
+            COUNT(*),
+            COUNT(DISTINCT durations.user_id),
+            AVG(minutes),
+            PERCENTILE_CONT(0.5) WITHIN GROUP (ORDER BY minutes),
+            PERCENTILE_CONT(0.25) WITHIN GROUP (ORDER BY minutes),
+            PERCENTILE_CONT(0.75) WITHIN GROUP (ORDER BY minutes),
+            PERCENTILE_CONT(0.9) WITHIN GROUP (ORDER BY minutes),
+            PERCENTILE_CONT(0.95) WITHIN GROUP (ORDER BY minutes)
+        FROM durations
+        LEFT JOIN rooms ON rooms.room_id = durations.room_id
+        GROUP BY durations.room_id, rooms.room_name
+        ORDER BY durations.room_id
+    `}
+	querySeasonalModel = namedQuery{"seasonal_model", `
+        WITH slots AS (
+            SELECT generate_series($1::TIMESTAMP, $2::TIMESTAMP - INTERVAL '1 hour', INTERVAL '1 hour') AS slot_start
+        ),
+        presence AS (
+            SELECT rooms.room_id, rooms.room_name, slots.slot_start, user_presence_sessions.user_id
+            FROM slots
+            CROSS JOIN rooms
+            LEFT JOIN user_presence_sessions
+                ON user_presence_sessions.room_id = rooms.room_id
+                AND user_presence_sessions.start_time < slots.slot_start + INTERVAL '1 hour'
+                AND COALESCE(user_presence_sessions.end_time, user_presence_sessions.last_seen) > slots.slot_start
+            WHERE (rooms.org_id = $3 OR $3 = 0)
+        ),
+        counts AS (
+            SELECT room_id, room_name, slot_start, COUNT(DISTINCT user_id) AS occupants
+            FROM presence
+            GROUP BY room_id, room_name, slot_start
+        ),
+        averages AS (
+            SELECT room_id, room_name, EXTRACT(DOW FROM slot_start)::INT AS dow, EXTRACT(HOUR FROM slot_start)::INT AS hour, AVG(occupants)::FLOAT AS average_occupants
+            FROM counts
+            GROUP BY room_id, room_name, dow, hour
+        ),
+        visitors AS (
+            SELECT room_id, EXTRACT(DOW FROM slot_start)::INT AS dow, EXTRACT(HOUR FROM slot_start)::INT AS hour, COUNT(DISTINCT user_id) AS visitors
+            FROM presence
+            GROUP BY room_id, dow, hour
+        )
+        SELECT averages.room_id, averages.room_name, averages.dow, averages.hour, averages.average_occupants, visitors.visitors
+        FROM averages
+        JOIN visitors ON visitors.room_id = averages.room_id AND visitors.dow = averages.dow AND visitors.hour = averages.hour
+        ORDER BY averages.room_id, averages.dow, averages.hour
+    `}
+)
+
+// noRowLimit は件数を制限しない場合に LIMIT へ渡す値です
+const noRowLimit = math.MaxInt32
+
+// stmtCache は準備済みの文をクエリ名ごとに保持します。トランザクション用のストアとも共有します
+type stmtCache struct {
+	mu    sync.Mutex
+	stmts map[string]*sql.Stmt
+}
+
+// prepare は q を初回のみ準備し、トランザクション内ではそのトランザクションに紐づけた文を返します。
+// トランザクション内で未準備の文はトランザクション上で準備します（SQLiteは接続が1本のため s.db では準備できません）。
+// s.db での準備は接続を待つことがあるため、接続を持ったトランザクションが同じロックを待って詰まらないようロックの外で行います
+func (s *sqlStore) prepare(ctx context.Context, q namedQuery) (*sql.Stmt, error) {
+	tx, inTx := s.exec.(*sql.Tx)
+
+	s.stmts.mu.Lock()
+	stmt, ok := s.stmts.stmts[q.name]
+	s.stmts.mu.Unlock()
+	if !ok && inTx {
+		return tx.PrepareContext(ctx, s.Rebind(q.sql))
+	}
+	if !ok {
+		prepared, err := s.db.PrepareContext(ctx, s.Rebind(q.sql))
+		if err != nil {
+			return nil, fmt.Errorf("クエリ %s の準備に失敗しました: %v", q.name, err)
+		}
+		s.stmts.mu.Lock()
+		if existing, ok := s.stmts.stmts[q.name]; ok {
+			// 同時に準備された場合は先に登録された文を使います
+			prepared.Close()
+			prepared = existing
+		} else {
+			s.stmts.stmts[q.name] = prepared
+		}
+		s.stmts.mu.Unlock()
+		stmt = prepared
+	}
+
+	if inTx {
+		return tx.StmtContext(ctx, stmt), nil
+	}
+	return stmt, nil
+}
+
+// startQuery はクエリ名をスパン名とするDBクエリのスパンを開始し、クエリの終了時に呼び出す関数を返します。
+// 終了時の関数はスパンを終了し、[Log] の slow_query を超えていれば警告を記録します
+func (s *sqlStore) startQuery(ctx context.Context, q namedQuery) (context.Context, func(error)) {
+	ctx, span := tracer.Start(ctx, "db."+q.name, trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("db.system", s.driver), attribute.String("db.operation", q.name)))
+	startTime := time.Now()
+
+	return ctx, func(err error) {
+		if elapsed, slowQuery := time.Since(startTime), currentSettings().SlowQuery; slowQuery > 0 && elapsed >= slowQuery {
+			logger.Warn("時間がかかったクエリです", append(logAttrs(ctx), "query", q.name, "duration_ms", elapsed.Milliseconds())...)
+		}
+		endSpan(span, err)
+	}
+}
+
+func (s *sqlStore) execNamed(ctx context.Context, q namedQuery, args ...interface{}) (result sql.Result, err error) {
+	ctx, finish := s.startQuery(ctx, q)
+	defer func() { finish(err) }()
+
+	stmt, err := s.prepare(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.ExecContext(ctx, s.bindArgs(args)...)
+}
+
+// queryNamed のスパンは行の読み込みを含まず、クエリの実行までを計測します
+func (s *sqlStore) queryNamed(ctx context.Context, q namedQuery, args ...interface{}) (rows *sql.Rows, err error) {
+	ctx, finish := s.startQuery(ctx, q)
+	defer func() { finish(err) }()
+
+	stmt, err := s.prepare(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.QueryContext(ctx, s.bindArgs(args)...)
+}
+
+// scanNamed は1行を返すクエリを実行して dest に読み込みます
+func (s *sqlStore) scanNamed(ctx context.Context, q namedQuery, args []interface{}, dest ...interface{}) (err error) {
+	ctx, finish := s.startQuery(ctx, q)
+	defer func() {
+		if err == sql.ErrNoRows {
+			finish(nil)
+			return
+		}
+		finish(err)
+	}()
+
+	stmt, err := s.prepare(ctx, q)
+	if err != nil {
+		return err
+	}
+	return stmt.QueryRowContext(ctx, s.bindArgs(args)...).Scan(dest...)
+}
+
+func (s *sqlStore) QueryReport(ctx context.Context, q namedQuery, args ...interface{}) (*sql.Rows, error) {
+	return s.queryNamed(ctx, q, args...)
+}
+
+// withTx は fn をトランザクション内で実行し、エラーがなければコミットします
+func (s *sqlStore) withTx(ctx context.Context, fn func(txStore *sqlStore) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(&sqlStore{db: s.db, exec: tx, driver: s.driver, stmts: s.stmts}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// scanSessionRows はセッション一覧を返すクエリの結果を読み込みます
+func scanSessionRows(rows *sql.Rows) ([]PresenceSession, error) {
+	defer rows.Close()
+
+	var sessions []PresenceSession
+	for rows.Next() {
+		var session PresenceSession
+		var endTime sql.NullTime
+		if err := rows.Scan(&session.SessionID, &session.UserID, &session.RoomID, &session.StartTime, &endTime, &session.LastSeen); err != nil {
+			continue
+		}
+		if endTime.Valid {
+			session.EndTime = &endTime.Time
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+func (s *sqlStore) UserIDByName(ctx context.Context, username string) (int, error) {
+	var userID int
+	err := s.scanNamed(ctx, queryUserIDByName, []interface{}{username, orgFromContext(ctx)}, &userID)
+	return userID, err
+}
+
+func (s *sqlStore) Credential(ctx context.Context, username string) (UserCredential, error) {
+	var credential UserCredential
+	err := s.scanNamed(ctx, queryCredential, []interface{}{username}, &credential.Username, &credential.Hash, &credential.Legacy)
+	return credential, err
+}
+
+func (s *sqlStore) SetPasswordHash(ctx context.Context, username string, hash string) error {
+	_, err := s.execNamed(ctx, querySetPasswordHash, username, hash)
+	return err
+}
+
+func (s *sqlStore) LegacyCredentials(ctx context.Context) ([]UserCredential, error) {
+	rows, err := s.queryNamed(ctx, queryLegacyPasswords)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var credentials []UserCredential
+	for rows.Next() {
+		var credential UserCredential
+		if err := rows.Scan(&credential.Username, &credential.Legacy); err != nil {
+			return nil, err
+		}
+		credentials = append(credentials, credential)
+	}
+	return credentials, rows.Err()
+}
+
+func (s *sqlStore) UserName(ctx context.Context, userID int) (string, error) {
+	var username string
+	err := s.scanNamed(ctx, queryUserName, []interface{}{userID, orgFromContext(ctx)}, &username)
+	return username, err
+}
+
+func (s *sqlStore) PrincipalOrg(ctx context.Context, username string) (int, error) {
+	var orgID int
+	err := s.scanNamed(ctx, queryPrincipalOrg, []interface{}{username}, &orgID)
+	return orgID, err
+}
+
+func (s *sqlStore) UserOrg(ctx context.Context, userID int) (int, error) {
+	var orgID int
+	err := s.scanNamed(ctx, queryUserOrg, []interface{}{userID}, &orgID)
+	return orgID, err
+}
+
+func (s *sqlStore) Organization(ctx context.Context, orgID int) (Organization, error) {
+	var org Organization
+	err := s.scanNamed(ctx, queryOrganization, []interface{}{orgID}, &org.OrgID, &org.Name, &org.CreatedAt)
+	return org, err
+}
+
+func (s *sqlStore) Organizations(ctx context.Context) ([]Organization, error) {
+	rows, err := s.queryNamed(ctx, queryOrganizations)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var orgs []Organization
+	for rows.Next() {
+		var org Organization
+		if err := rows.Scan(&org.OrgID, &org.Name, &org.CreatedAt); err != nil {
+			return nil, err
+		}
+		orgs = append(orgs, org)
+	}
+	return orgs, rows.Err()
+}
+
+func (s *sqlStore) Buildings(ctx context.Context) ([]Building, error) {
+	rows, err := s.queryNamed(ctx, queryBuildings, orgFromContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	buildings := []Building{}
+	for rows.Next() {
+		building := Building{Floors: []Floor{}}
+		if err := rows.Scan(&building.BuildingID, &building.Name); err != nil {
+			return nil, err
+		}
+		buildings = append(buildings, building)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	floors, err := s.floors(ctx, queryFloors, 0)
+	if err != nil {
+		return nil, err
+	}
+	for i := range buildings {
+		for _, floor := range floors {
+			if floor.BuildingID == buildings[i].BuildingID {
+				buildings[i].Floors = append(buildings[i].Floors, floor)
+			}
+		}
+	}
+	return buildings, nil
+}
+
+func (s *sqlStore) Building(ctx context.Context, buildingID int) (Building, error) {
+	building := Building{Floors: []Floor{}}
+	if err := s.scanNamed(ctx, queryBuilding, []interface{}{buildingID, orgFromContext(ctx)}, &building.BuildingID, &building.Name); err != nil {
+		return Building{}, err
+	}
+	floors, err := s.floors(ctx, queryFloors, buildingID)
+	if err != nil {
+		return Building{}, err
+	}
+	building.Floors = append(building.Floors, floors...)
+	return building, nil
+}
+
+func (s *sqlStore) Floor(ctx context.Context, floorID int) (Floor, error) {
+	floors, err := s.floors(ctx, queryFloor, floorID)
+	if err != nil {
+		return Floor{}, err
+	}
+	if len(floors) == 0 {
+		return Floor{}, sql.ErrNoRows
+	}
+	return floors[0], nil
+}
+
+// floors は queryFloors / queryFloor の行を階ごとにまとめます。行は階ごとに連続している前提です
+func (s *sqlStore) floors(ctx context.Context, query namedQuery, id int) ([]Floor, error) {
+	rows, err := s.queryNamed(ctx, query, id, orgFromContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	floors := []Floor{}
+	for rows.Next() {
+		var floor Floor
+		var roomID sql.NullInt64
+		if err := rows.Scan(&floor.FloorID, &floor.BuildingID, &floor.Name, &floor.Level, &roomID); err != nil {
+			return nil, err
+		}
+		if len(floors) == 0 || floors[len(floors)-1].FloorID != floor.FloorID {
+			floor.RoomIDs = []int{}
+			floors = append(floors, floor)
+		}
+		if roomID.Valid {
+			last := &floors[len(floors)-1]
+			last.RoomIDs = append(last.RoomIDs, int(roomID.Int64))
+		}
+	}
+	return floors, rows.Err()
+}
+
+func (s *sqlStore) TrackingConsent(ctx context.Context, userID int) (TrackingConsent, error) {
+	var consent TrackingConsent
+	var updatedAt, pausedUntil sql.NullTime
+	err := s.scanNamed(ctx, queryTrackingConsent, []interface{}{userID, orgFromContext(ctx)}, &consent.UserID, &consent.Consent, &updatedAt, &pausedUntil)
+	if updatedAt.Valid {
+		consent.UpdatedAt = &updatedAt.Time
+	}
+	if pausedUntil.Valid {
+		consent.PausedUntil = &pausedUntil.Time
+	}
+	return consent, err
+}
+
+func (s *sqlStore) SetTrackingPause(ctx context.Context, userID int, until *time.Time) error {
+	var pausedUntil sql.NullTime
+	if until != nil {
+		pausedUntil = sql.NullTime{Time: *until, Valid: true}
+	}
+	_, err := s.execNamed(ctx, querySetTrackingPause, userID, pausedUntil, orgFromContext(ctx))
+	return err
+}
+
+func (s *sqlStore) SetTrackingConsent(ctx context.Context, userID int, consent bool, updatedAt time.Time) error {
+	_, err := s.execNamed(ctx, querySetTrackingConsent, userID, consent, updatedAt, orgFromContext(ctx))
+	return err
+}
+
+func (s *sqlStore) UsersWithoutConsent(ctx context.Context) (map[int]bool, error) {
+	rows, err := s.queryNamed(ctx, queryUsersWithoutConsent, orgFromContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := make(map[int]bool)
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		users[userID] = true
+	}
+	return users, rows.Err()
+}
+
+func (s *sqlStore) IsAdmin(ctx context.Context, username string) (bool, error) {
+	var isAdmin bool
+	err := s.scanNamed(ctx, queryIsAdmin, []interface{}{username, orgFromContext(ctx)}, &isAdmin)
+	return isAdmin, err
+}
+
+// listArg は values を正規化・重複排除し、1つの引数として渡せる形で返します。
+// PostgreSQLでは = ANY($1) に渡す配列、SQLiteでは json_each($1) に渡すJSON配列の文字列です
+func (s *sqlStore) listArg(values []string, normalize func(string) string) (interface{}, error) {
+	seen := make(map[string]bool, len(values))
+	list := make([]string, 0, len(values))
+	for _, value := range values {
+		value = normalize(strings.TrimSpace(value))
+		if value == "" || seen[value] {
+			continue
+		}
+		seen[value] = true
+		list = append(list, value)
+	}
+	if s.driver != "sqlite" {
+		return pq.StringArray(list), nil
+	}
+	encoded, err := json.Marshal(list)
+	if err != nil {
+		return nil, err
+	}
+	return string(encoded), nil
+}
+
+func (s *sqlStore) RoomIDsByBeacons(ctx context.Context, serviceUUIDs []string) (map[string]int, error) {
+	arg, err := s.listArg(serviceUUIDs, strings.ToUpper)
+	if err != nil {
+		return nil, err
+	}
+	q := queryRoomIDsByBeacons
+	if s.driver == "sqlite" {
+		q = queryRoomIDsByBeaconsSQLite
+	}
+	return s.scanRoomMappings(ctx, q, strings.ToUpper, arg, orgFromContext(ctx))
+}
+
+func (s *sqlStore) RoomIDsByWifi(ctx context.Context, bssids []string) (map[string]int, error) {
+	arg, err := s.listArg(bssids, strings.ToLower)
+	if err != nil {
+		return nil, err
+	}
+	q := queryRoomIDsByWifi
+	if s.driver == "sqlite" {
+		q = queryRoomIDsByWifiSQLite
+	}
+	return s.scanRoomMappings(ctx, q, strings.ToLower, arg, orgFromContext(ctx))
+}
+
+func (s *sqlStore) RoomMappings(ctx context.Context) (map[int]RoomMappings, error) {
+	mappings := make(map[int]RoomMappings)
+	orgMappings := func(orgID int) RoomMappings {
+		if _, ok := mappings[orgID]; !ok {
+			mappings[orgID] = RoomMappings{Beacons: make(map[string]int), Wifi: make(map[string]int)}
+		}
+		return mappings[orgID]
+	}
+	if err := s.scanOrgRoomMappings(ctx, queryRoomMappingsBeacons, strings.ToUpper, func(orgID int) map[string]int { return orgMappings(orgID).Beacons }); err != nil {
+		return nil, err
+	}
+	if err := s.scanOrgRoomMappings(ctx, queryRoomMappingsWifi, strings.ToLower, func(orgID int) map[string]int { return orgMappings(orgID).Wifi }); err != nil {
+		return nil, err
+	}
+	return mappings, nil
+}
+
+// scanOrgRoomMappings は (組織ID, キー, ルームID) を返すクエリの結果を target が返す組織ごとの対応へ読み込みます。
+// 同じ組織で同じキーが複数ある場合は最初の行を使用します
+func (s *sqlStore) scanOrgRoomMappings(ctx context.Context, q namedQuery, normalize func(string) string, target func(orgID int) map[string]int) error {
+	rows, err := s.queryNamed(ctx, q)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var orgID, roomID int
+		var key string
+		if err := rows.Scan(&orgID, &key, &roomID); err != nil {
+			return err
+		}
+		key = normalize(strings.TrimSpace(key))
+		mappings := target(orgID)
+		if _, ok := mappings[key]; !ok {
+			mappings[key] = roomID
+		}
+	}
+	return rows.Err()
+}
+
+// scanRoomMappings は (キー, ルームID) を返すクエリの結果を読み込みます。同じキーが複数ある場合は最初の行を使用します
+func (s *sqlStore) scanRoomMappings(ctx context.Context, q namedQuery, normalize func(string) string, args ...interface{}) (map[string]int, error) {
+	rows, err := s.queryNamed(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	mappings := make(map[string]int)
+	for rows.Next() {
+		var key string
+		var roomID int
+		if err := rows.Scan(&key, &roomID); err != nil {
+			return nil, err
+		}
+		key = normalize(strings.TrimSpace(key))
+		if _, ok := mappings[key]; !ok {
+			mappings[key] = roomID
+		}
+	}
+	return mappings, rows.Err()
+}
+
+func (s *sqlStore) RoomName(ctx context.Context, roomID int) (string, error) {
+	var roomName string
+	err := s.scanNamed(ctx, queryRoomName, []interface{}{roomID, orgFromContext(ctx)}, &roomName)
+	return roomName, err
+}
+
+// OpenSessionRoom は終了していないセッションのルームIDを返します。セッションがない場合は sql.ErrNoRows を返します
+func (s *sqlStore) OpenSessionRoom(ctx context.Context, userID int) (int, error) {
+	var roomID int
+	err := s.scanNamed(ctx, queryOpenSessionRoom, []interface{}{userID}, &roomID)
+	return roomID, err
+}
+
+func (s *sqlStore) StartSession(ctx context.Context, userID int, roomID int, startTime time.Time, estimationConfidence int, inquiryConfidence int) error {
+	_, err := s.execNamed(ctx, queryStartSession, userID, roomID, startTime, estimationConfidence, inquiryConfidence)
+	return err
+}
+
+func (s *sqlStore) EndOpenSessions(ctx context.Context, userID int, endTime time.Time) (int64, error) {
+	result, err := s.execNamed(ctx, queryEndOpenSessions, endTime, userID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (s *sqlStore) TouchOpenSession(ctx context.Context, userID int, lastSeen time.Time, estimationConfidence int, inquiryConfidence int) (int64, error) {
+	result, err := s.execNamed(ctx, queryTouchOpenSession, lastSeen, userID, estimationConfidence, inquiryConfidence)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// LatestClosedSession は endedAfter 以降に終了した直近のセッションのIDとルームIDを返します
+func (s *sqlStore) LatestClosedSession(ctx context.Context, userID int, endedAfter time.Time) (int, int, error) {
+	var sessionID, roomID int
+	err := s.scanNamed(ctx, queryLatestClosedSession, []interface{}{userID, endedAfter}, &sessionID, &roomID)
+	return sessionID, roomID, err
+}
+
+func (s *sqlStore) ReopenSession(ctx context.Context, sessionID int, lastSeen time.Time, estimationConfidence int, inquiryConfidence int) error {
+	_, err := s.execNamed(ctx, queryReopenSession, lastSeen, sessionID, estimationConfidence, inquiryConfidence)
+	return err
+}
+
+// EndStaleSessions は1つの UPDATE 文で期限切れのセッションをまとめて終了します。
+// 信号の送信で last_seen が同時に更新された行は WHERE を満たさなくなるため終了しません
+func (s *sqlStore) EndStaleSessions(ctx context.Context, cutoff time.Time, endTime time.Time) ([]PresenceSession, error) {
+	rows, err := s.queryNamed(ctx, queryEndStaleSessions, cutoff, endTime, orgFromContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	return scanSessionRows(rows)
+}
+
+func (s *sqlStore) DuplicateOpenSessions(ctx context.Context) ([]PresenceSession, error) {
+	rows, err := s.queryNamed(ctx, queryDuplicateOpenSessions, orgFromContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	return scanSessionRows(rows)
+}
+
+func (s *sqlStore) CloseSessionAtLastSeen(ctx context.Context, sessionID int) (int64, error) {
+	result, err := s.execNamed(ctx, queryCloseSessionAtLastSeen, sessionID, orgFromContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (s *sqlStore) RecordTransition(ctx context.Context, transition RoomTransition) error {
+	_, err := s.execNamed(ctx, queryRecordTransition, transition.UserID, transition.FromRoomID, transition.ToRoomID, transition.TransitionedAt)
+	return err
+}
+
+func (s *sqlStore) RecordDecision(ctx context.Context, decision PresenceDecision) (int, error) {
+	var room, inquiry sql.NullInt64
+	if decision.RoomID != nil {
+		room = sql.NullInt64{Int64: int64(*decision.RoomID), Valid: true}
+	}
+	if decision.InquiryConfidence != nil {
+		inquiry = sql.NullInt64{Int64: int64(*decision.InquiryConfidence), Valid: true}
+	}
+
+	var decisionID int
+	err := s.scanNamed(ctx, queryRecordDecision, []interface{}{decision.UserID, room, decision.EstimationConfidence, inquiry, decision.Decision, decision.DecidedAt, nullableInt(decision.DeviceID)}, &decisionID)
+	return decisionID, err
+}
+
+// ListDecisions は在室判定を新しい順に返します。userID が nil の場合は全ユーザーが対象です
+func (s *sqlStore) ListDecisions(ctx context.Context, userID *int, limit int) ([]PresenceDecision, error) {
+	var rows *sql.Rows
+	var err error
+	if userID != nil {
+		rows, err = s.queryNamed(ctx, queryListUserDecisions, limit, *userID, orgFromContext(ctx))
+	} else {
+		rows, err = s.queryNamed(ctx, queryListDecisions, limit, orgFromContext(ctx))
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	decisions := []PresenceDecision{}
+	for rows.Next() {
+		var decision PresenceDecision
+		var roomID sql.NullInt64
+		var inquiryConfidence sql.NullInt64
+		var deviceID sql.NullInt64
+		if err := rows.Scan(&decision.DecisionID, &decision.UserID, &roomID, &decision.EstimationConfidence, &inquiryConfidence, &decision.Decision, &decision.DecidedAt, &deviceID); err != nil {
+			continue
+		}
+		decision.DeviceID = intPointer(deviceID)
+		if roomID.Valid {
+			id := int(roomID.Int64)
+			decision.RoomID = &id
+		}
+		if inquiryConfidence.Valid {
+			confidence := int(inquiryConfidence.Int64)
+			decision.InquiryConfidence = &confidence
+		}
+		decisions = append(decisions, decision)
+	}
+	return decisions, rows.Err()
+}
+
+// ListSessions は期間内のセッションを (start_time, session_id) 順に返します。
+// after を指定するとそのカーソルより後のセッションのみを返し、limit が0の場合は件数を制限しません。
+func (s *sqlStore) ListSessions(ctx context.Context, from time.Time, to time.Time, after *sessionCursor, limit int) ([]PresenceSession, error) {
+	if limit <= 0 {
+		limit = noRowLimit
+	}
+
+	var rows *sql.Rows
+	var err error
+	if after != nil {
+		rows, err = s.queryNamed(ctx, querySessionsAfterCursor, from, to, limit, after.StartTime, after.SessionID, orgFromContext(ctx))
+	} else {
+		rows, err = s.queryNamed(ctx, querySessionsInRange, from, to, limit, orgFromContext(ctx))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return scanSessionRows(rows)
+}
+
+func (s *sqlStore) ListUserSessions(ctx context.Context, userID int, from time.Time, to time.Time) ([]PresenceSession, error) {
+	rows, err := s.queryNamed(ctx, queryUserSessions, userID, from, to, orgFromContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	return scanSessionRows(rows)
+}
+
+func (s *sqlStore) ListRoomSessions(ctx context.Context, roomID int, from time.Time, to time.Time) ([]PresenceSession, error) {
+	rows, err := s.queryNamed(ctx, queryRoomSessions, roomID, from, to, orgFromContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	return scanSessionRows(rows)
+}
+
+func (s *sqlStore) ListUserTransitions(ctx context.Context, userID int, from time.Time, to time.Time) ([]RoomTransition, error) {
+	rows, err := s.queryNamed(ctx, queryUserTransitions, userID, from, to, orgFromContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	transitions := []RoomTransition{}
+	for rows.Next() {
+		var transition RoomTransition
+		if err := rows.Scan(&transition.TransitionID, &transition.UserID, &transition.FromRoomID, &transition.ToRoomID, &transition.TransitionedAt); err != nil {
+			continue
+		}
+		transitions = append(transitions, transition)
+	}
+	return transitions, rows.Err()
+}
+
+// UpsertPresence は在室判定をセッションに反映します。PostgreSQLでは1文のCTEで、
+// データ変更を伴うCTEを持たないSQLiteではトランザクション内の逐次クエリで処理します。
+// 未終了のセッションがない場合は CTE の FOR UPDATE でロックできる行がなく、同じユーザーの同時送信がどちらも新しいセッションを
+// 開始してしまうため、PostgreSQLでは先にユーザーの行をロックします。SQLiteは接続が1つのためトランザクションが直列に実行されます
+func (s *sqlStore) UpsertPresence(ctx context.Context, update PresenceUpdate) (PresenceOutcome, error) {
+	var outcome PresenceOutcome
+	if s.driver != "postgres" {
+		err := s.withTx(ctx, func(txStore *sqlStore) error {
+			var err error
+			outcome, err = upsertPresenceSteps(ctx, txStore, update)
+			return err
+		})
+		return outcome, err
+	}
+
+	var recentSince sql.NullTime
+	if update.MergeGap > 0 {
+		recentSince = sql.NullTime{Time: update.SeenAt.Add(-update.MergeGap), Valid: true}
+	}
+
+	args := []interface{}{update.UserID, update.RoomID, update.SeenAt, update.EstimationConfidence, update.InquiryConfidence, recentSince}
+	err := s.withTx(ctx, func(txStore *sqlStore) error {
+		var lockedID int
+		if err := txStore.scanNamed(ctx, queryLockPresenceUser, []interface{}{update.UserID}, &lockedID); err != nil {
+			return err
+		}
+		return txStore.scanNamed(ctx, queryUpsertPresence, args, &outcome.Action, &outcome.SessionID, &outcome.FromRoomID)
+	})
+	return outcome, err
+}
+
+// upsertPresenceSteps は UpsertPresence と同じ処理を個別のストア操作の組み合わせで行います
+func upsertPresenceSteps(ctx context.Context, presence PresenceStore, update PresenceUpdate) (PresenceOutcome, error) {
+	existingRoomID, err := presence.OpenSessionRoom(ctx, update.UserID)
+	if err != nil && err != sql.ErrNoRows {
+		return PresenceOutcome{}, err
+	}
+
+	if err == nil {
+		if existingRoomID == update.RoomID {
+			if _, err := presence.TouchOpenSession(ctx, update.UserID, update.SeenAt, update.EstimationConfidence, update.InquiryConfidence); err != nil {
+				return PresenceOutcome{}, err
+			}
+			return PresenceOutcome{Action: presenceTouched}, nil
+		}
+
+		if _, err := presence.EndOpenSessions(ctx, update.UserID, update.SeenAt); err != nil {
+			return PresenceOutcome{}, err
+		}
+		if err := presence.StartSession(ctx, update.UserID, update.RoomID, update.SeenAt, update.EstimationConfidence, update.InquiryConfidence); err != nil {
+			return PresenceOutcome{}, err
+		}
+		err := presence.RecordTransition(ctx, RoomTransition{
+			UserID:         update.UserID,
+			FromRoomID:     existingRoomID,
+			ToRoomID:       update.RoomID,
+			TransitionedAt: update.SeenAt,
+		})
+		if err != nil {
+			return PresenceOutcome{}, err
+		}
+		return PresenceOutcome{Action: presenceMoved, FromRoomID: existingRoomID}, nil
+	}
+
+	if update.MergeGap > 0 {
+		sessionID, prevRoomID, err := presence.LatestClosedSession(ctx, update.UserID, update.SeenAt.Add(-update.MergeGap))
+		if err != nil && err != sql.ErrNoRows {
+			return PresenceOutcome{}, err
+		}
+		if err == nil && prevRoomID == update.RoomID {
+			if err := presence.ReopenSession(ctx, sessionID, update.SeenAt, update.EstimationConfidence, update.InquiryConfidence); err != nil {
+				return PresenceOutcome{}, err
+			}
+			return PresenceOutcome{Action: presenceReopened, SessionID: sessionID}, nil
+		}
+	}
+
+	if err := presence.StartSession(ctx, update.UserID, update.RoomID, update.SeenAt, update.EstimationConfidence, update.InquiryConfidence); err != nil {
+		return PresenceOutcome{}, err
+	}
+	return PresenceOutcome{Action: presenceStarted}, nil
+}
+
+// PurgeSessions は endedBefore より前に終了したセッションを削除し、削除件数を返します。
+// archive が true の場合は削除前に user_presence_sessions_archive へ移します。未終了のセッションは対象外です
+func (s *sqlStore) PurgeSessions(ctx context.Context, endedBefore time.Time, archive bool, archivedAt time.Time) (int64, error) {
+	var removed int64
+	err := s.withTx(ctx, func(txStore *sqlStore) error {
+		if archive {
+			if _, err := txStore.execNamed(ctx, queryArchiveSessions, endedBefore, archivedAt, orgFromContext(ctx)); err != nil {
+				return err
+			}
+		}
+
+		result, err := txStore.execNamed(ctx, queryPurgeSessions, endedBefore, orgFromContext(ctx))
+		if err != nil {
+			return err
+		}
+		removed, err = result.RowsAffected()
+		return err
+	})
+	return removed, err
+}
+
+func (s *sqlStore) PurgeDecisions(ctx context.Context, before time.Time) (int64, error) {
+	result, err := s.execNamed(ctx, queryPurgeDecisions, before, orgFromContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (s *sqlStore) PurgeTransitions(ctx context.Context, before time.Time) (int64, error) {
+	result, err := s.execNamed(ctx, queryPurgeTransitions, before, orgFromContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// scanFingerprintSample は fingerprint_samples の1行を読み込みます。scan には (*sql.Row).Scan または (*sql.Rows).Scan を渡します
+func scanFingerprintSample(scan func(dest ...interface{}) error) (FingerprintSample, error) {
+	var sample FingerprintSample
+	var lastDuplicateAt sql.NullTime
+	err := scan(&sample.SampleID, &sample.RoomID, &sample.SampleType, &sample.WifiKey, &sample.BleKey, &sample.WifiSHA256, &sample.BleSHA256,
+		&sample.WifiSize, &sample.BleSize, &sample.WifiRecords, &sample.BleRecords, &sample.CollectedAt, &sample.CollectedBy, &sample.DuplicateCount, &lastDuplicateAt)
+	if lastDuplicateAt.Valid {
+		sample.LastDuplicateAt = &lastDuplicateAt.Time
+	}
+	return sample, err
+}
+
+func (s *sqlStore) FingerprintSampleByHash(ctx context.Context, roomID int, wifiSHA256 string, bleSHA256 string) (FingerprintSample, error) {
+	return scanFingerprintSample(func(dest ...interface{}) error {
+		return s.scanNamed(ctx, queryFingerprintSampleByHash, []interface{}{roomID, wifiSHA256, bleSHA256, recordOrg(ctx)}, dest...)
+	})
+}
+
+func (s *sqlStore) FingerprintSampleByID(ctx context.Context, sampleID int) (FingerprintSample, error) {
+	return scanFingerprintSample(func(dest ...interface{}) error {
+		return s.scanNamed(ctx, queryFingerprintSampleByID, []interface{}{sampleID, orgFromContext(ctx)}, dest...)
+	})
+}
+
+func (s *sqlStore) ListFingerprintSamples(ctx context.Context, filter FingerprintSampleFilter) ([]FingerprintSample, error) {
+	roomID := -1
+	if filter.RoomID != nil {
+		roomID = *filter.RoomID
+	}
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = noRowLimit
+	}
+
+	rows, err := s.queryNamed(ctx, queryListFingerprintSamples, filter.AfterID, roomID, filter.SampleType, limit, orgFromContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var samples []FingerprintSample
+	for rows.Next() {
+		sample, err := scanFingerprintSample(rows.Scan)
+		if err != nil {
+			continue
+		}
+		samples = append(samples, sample)
+	}
+	return samples, rows.Err()
+}
+
+func (s *sqlStore) RecordFingerprintSample(ctx context.Context, sample FingerprintSample) (int, error) {
+	var sampleID int
+	err := s.scanNamed(ctx, queryRecordFingerprintSample, []interface{}{sample.RoomID, sample.SampleType, sample.WifiKey, sample.BleKey,
+		sample.WifiSHA256, sample.BleSHA256, sample.WifiSize, sample.BleSize, sample.WifiRecords, sample.BleRecords, sample.CollectedAt, sample.CollectedBy, recordOrg(ctx)}, &sampleID)
+	return sampleID, err
+}
+
+func (s *sqlStore) MarkFingerprintDuplicate(ctx context.Context, sampleID int, at time.Time) error {
+	_, err := s.execNamed(ctx, queryMarkFingerprintDuplicate, sampleID, at, orgFromContext(ctx))
+	return err
+}
+
+func (s *sqlStore) RelabelFingerprintSample(ctx context.Context, sample FingerprintSample) error {
+	_, err := s.execNamed(ctx, queryRelabelFingerprintSample, sample.SampleID, sample.RoomID, sample.SampleType, sample.WifiKey, sample.BleKey, orgFromContext(ctx))
+	return err
+}
+
+func (s *sqlStore) DeleteFingerprintSample(ctx context.Context, sampleID int) error {
+	_, err := s.execNamed(ctx, queryDeleteFingerprintSample, sampleID, orgFromContext(ctx))
+	return err
+}
+
+func (s *sqlStore) RecordAudit(ctx context.Context, entry AuditEntry) error {
+	_, err := s.execNamed(ctx, queryRecordAudit, entry.Actor, entry.Action, entry.Target, entry.Detail, entry.CreatedAt, recordOrg(ctx))
+	return err
+}
+
+func (s *sqlStore) ListAudit(ctx context.Context, limit int) ([]AuditEntry, error) {
+	rows, err := s.queryNamed(ctx, queryListAudit, limit, orgFromContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var entry AuditEntry
+		if err := rows.Scan(&entry.AuditID, &entry.Actor, &entry.Action, &entry.Target, &entry.Detail, &entry.CreatedAt); err != nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func (s *sqlStore) RecordHistoryAccess(ctx context.Context, entry HistoryAccessEntry) error {
+	_, err := s.execNamed(ctx, queryRecordHistoryAccess, entry.Requester, nullableInt(entry.TargetUserID), entry.Endpoint, entry.From, entry.To, entry.AccessedAt, recordOrg(ctx))
+	return err
+}
+
+func (s *sqlStore) ListHistoryAccess(ctx context.Context, filter HistoryAccessFilter) ([]HistoryAccessEntry, error) {
+	targetUserID := -1
+	if filter.TargetUserID != nil {
+		targetUserID = *filter.TargetUserID
+	}
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = noRowLimit
+	}
+
+	rows, err := s.queryNamed(ctx, queryListHistoryAccess, filter.Requester, targetUserID, limit, orgFromContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []HistoryAccessEntry{}
+	for rows.Next() {
+		var entry HistoryAccessEntry
+		var target sql.NullInt64
+		if err := rows.Scan(&entry.AccessID, &entry.Requester, &target, &entry.Endpoint, &entry.From, &entry.To, &entry.AccessedAt); err != nil {
+			continue
+		}
+		entry.TargetUserID = intPointer(target)
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func nullableInt(v *int) sql.NullInt64 {
+	if v == nil {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: int64(*v), Valid: true}
+}
+
+func intPointer(v sql.NullInt64) *int {
+	if !v.Valid {
+		return nil
+	}
+	i := int(v.Int64)
+	return &i
+}
+
+func (s *sqlStore) RecordUpload(ctx context.Context, record UploadRecord) (int, error) {
+	var uploadID int
+	err := s.scanNamed(ctx, queryRecordUpload, []interface{}{record.Kind, record.UserName, nullableInt(record.RoomID), nullableInt(record.DecisionID), nullableInt(record.SampleID),
+		record.WifiKey, record.BleKey, record.WifiSize, record.BleSize, record.WifiSHA256, record.BleSHA256, record.UploadedAt}, &uploadID)
+	return uploadID, err
+}
+
+func (s *sqlStore) EnqueueSubmission(ctx context.Context, submission QueuedSubmission) (int, error) {
+	var queueID int
+	err := s.scanNamed(ctx, queryEnqueueSubmission, []interface{}{submission.UserID, nullableInt(submission.UploadID), submission.WifiKey, submission.BleKey, submission.SubmittedAt, nullableInt(submission.DeviceID)}, &queueID)
+	return queueID, err
+}
+
+func (s *sqlStore) HasQueuedSubmissions(ctx context.Context, userID int) (bool, error) {
+	var count int
+	err := s.scanNamed(ctx, queryCountUserQueuedSubmissions, []interface{}{userID}, &count)
+	return count > 0, err
+}
+
+func (s *sqlStore) QueuedSubmissions(ctx context.Context, limit int) ([]QueuedSubmission, error) {
+	rows, err := s.queryNamed(ctx, queryQueuedSubmissions, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var submissions []QueuedSubmission
+	for rows.Next() {
+		var submission QueuedSubmission
+		var uploadID, deviceID sql.NullInt64
+		if err := rows.Scan(&submission.QueueID, &submission.UserID, &uploadID, &submission.WifiKey, &submission.BleKey, &submission.SubmittedAt, &submission.Attempts, &submission.LastError, &deviceID); err != nil {
+			return nil, err
+		}
+		submission.UploadID = intPointer(uploadID)
+		submission.DeviceID = intPointer(deviceID)
+		submissions = append(submissions, submission)
+	}
+	return submissions, rows.Err()
+}
+
+func (s *sqlStore) DeleteQueuedSubmission(ctx context.Context, queueID int) error {
+	_, err := s.execNamed(ctx, queryDeleteQueuedSubmission, queueID)
+	return err
+}
+
+func (s *sqlStore) RecordSubmissionAttempt(ctx context.Context, queueID int, lastError string) error {
+	_, err := s.execNamed(ctx, queryRecordSubmissionAttempt, queueID, lastError)
+	return err
+}
+
+func (s *sqlStore) AcquireLease(ctx context.Context, name string, holder string, now time.Time, ttl time.Duration) (bool, error) {
+	result, err := s.execNamed(ctx, queryAcquireLease, name, holder, now.Add(ttl), now)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	return rows > 0, err
+}
+
+func (s *sqlStore) ReserveIdempotencyKey(ctx context.Context, principal string, key string, path string, now time.Time) (bool, IdempotentResult, error) {
+	inserted, err := s.execNamed(ctx, queryReserveIdempotencyKey, principal, key, path, now)
+	if err != nil {
+		return false, IdempotentResult{}, err
+	}
+	if rows, err := inserted.RowsAffected(); err != nil || rows > 0 {
+		return err == nil, IdempotentResult{}, err
+	}
+
+	var result IdempotentResult
+	var statusCode sql.NullInt64
+	var body string
+	err = s.scanNamed(ctx, queryIdempotentResult, []interface{}{principal, key}, &result.Path, &statusCode, &result.ContentType, &body)
+	if err == sql.ErrNoRows {
+		// 確保できなかった後に処理中の記録が削除された場合は、処理中として扱います
+		return false, IdempotentResult{Path: path}, nil
+	}
+	result.StatusCode = int(statusCode.Int64)
+	result.Body = []byte(body)
+	return false, result, err
+}
+
+func (s *sqlStore) CompleteIdempotencyKey(ctx context.Context, principal string, key string, result IdempotentResult) error {
+	_, err := s.execNamed(ctx, queryCompleteIdempotencyKey, principal, key, result.StatusCode, result.ContentType, string(result.Body))
+	return err
+}
+
+func (s *sqlStore) ReleaseIdempotencyKey(ctx context.Context, principal string, key string) error {
+	_, err := s.execNamed(ctx, queryReleaseIdempotencyKey, principal, key)
+	return err
+}
+
+func (s *sqlStore) DeleteExpiredIdempotencyKeys(ctx context.Context, before time.Time) (int64, error) {
+	result, err := s.execNamed(ctx, queryDeleteExpiredIdempotencyKeys, before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (s *sqlStore) APIKeyByHash(ctx context.Context, hash string) (APIKey, error) {
+	var key APIKey
+	var revokedAt sql.NullTime
+	err := s.scanNamed(ctx, queryAPIKeyByHash, []interface{}{hash}, &key.KeyID, &key.OrgID, &key.Name, &key.Prefix, &key.MonthlyQuota, &key.CreatedBy, &key.CreatedAt, &revokedAt)
+	return key, err
+}
+
+func (s *sqlStore) APIKeys(ctx context.Context) ([]APIKey, error) {
+	rows, err := s.queryNamed(ctx, queryAPIKeys, orgFromContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	return scanAPIKeys(rows)
+}
+
+func scanAPIKeys(rows *sql.Rows) ([]APIKey, error) {
+	defer rows.Close()
+	keys := []APIKey{}
+	for rows.Next() {
+		var key APIKey
+		var revokedAt sql.NullTime
+		if err := rows.Scan(&key.KeyID, &key.OrgID, &key.Name, &key.Prefix, &key.MonthlyQuota, &key.CreatedBy, &key.CreatedAt, &revokedAt); err != nil {
+			return nil, err
+		}
+		if revokedAt.Valid {
+			key.RevokedAt = &revokedAt.Time
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+func (s *sqlStore) CreateAPIKey(ctx context.Context, key APIKey, hash string) (int, error) {
+	var keyID int
+	err := s.scanNamed(ctx, queryCreateAPIKey, []interface{}{key.OrgID, key.Name, key.Prefix, hash, key.MonthlyQuota, key.CreatedBy, key.CreatedAt}, &keyID)
+	return keyID, err
+}
+
+func (s *sqlStore) RevokeAPIKey(ctx context.Context, keyID int, at time.Time) error {
+	result, err := s.execNamed(ctx, queryRevokeAPIKey, keyID, at, orgFromContext(ctx))
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil || rows == 0 {
+		if err == nil {
+			err = sql.ErrNoRows
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *sqlStore) MeterRequest(ctx context.Context, orgID int, keyID int, period string, quota int64) (bool, error) {
+	result, err := s.execNamed(ctx, queryMeterRequest, orgID, keyID, period, quota)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	return rows > 0, err
+}
+
+func (s *sqlStore) AddUsage(ctx context.Context, orgID int, keyID int, period string, metric string, n int64) error {
+	_, err := s.execNamed(ctx, queryAddUsage, orgID, keyID, period, metric, n)
+	return err
+}
+
+func (s *sqlStore) Usage(ctx context.Context, period string) ([]UsageCounter, error) {
+	rows, err := s.queryNamed(ctx, queryUsage, period, orgFromContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counters := []UsageCounter{}
+	for rows.Next() {
+		var counter UsageCounter
+		if err := rows.Scan(&counter.OrgID, &counter.KeyID, &counter.Metric, &counter.Count); err != nil {
+			return nil, err
+		}
+		counters = append(counters, counter)
+	}
+	return counters, rows.Err()
+}
+
+func (s *sqlStore) TenantSettings(ctx context.Context, orgID int) (TenantSettingsRecord, error) {
+	record := TenantSettingsRecord{OrgID: orgID}
+	var settings string
+	if err := s.scanNamed(ctx, queryTenantSettings, []interface{}{orgID}, &settings, &record.UpdatedBy, &record.UpdatedAt); err != nil {
+		return record, err
+	}
+	if err := json.Unmarshal([]byte(settings), &record.Settings); err != nil {
+		return record, fmt.Errorf("組織 %d の設定のデコードに失敗しました: %v", orgID, err)
+	}
+	return record, nil
+}
+
+func (s *sqlStore) AllTenantSettings(ctx context.Context) (map[int]TenantSettings, error) {
+	rows, err := s.queryNamed(ctx, queryAllTenantSettings)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	all := make(map[int]TenantSettings)
+	for rows.Next() {
+		var orgID int
+		var settings string
+		if err := rows.Scan(&orgID, &settings); err != nil {
+			return nil, err
+		}
+		var decoded TenantSettings
+		if err := json.Unmarshal([]byte(settings), &decoded); err != nil {
+			return nil, fmt.Errorf("組織 %d の設定のデコードに失敗しました: %v", orgID, err)
+		}
+		all[orgID] = decoded
+	}
+	return all, rows.Err()
+}
+
+func (s *sqlStore) SetTenantSettings(ctx context.Context, record TenantSettingsRecord) error {
+	settings, err := json.Marshal(record.Settings)
+	if err != nil {
+		return err
+	}
+	_, err = s.execNamed(ctx, querySetTenantSettings, record.OrgID, string(settings), record.UpdatedBy, record.UpdatedAt)
+	return err
+}
+
+func (s *sqlStore) DeleteTenantSettings(ctx context.Context, orgID int) error {
+	result, err := s.execNamed(ctx, queryDeleteTenantSettings, orgID)
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil || rows == 0 {
+		if err == nil {
+			err = sql.ErrNoRows
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *sqlStore) IdentityLinks(ctx context.Context) ([]IdentityLink, error) {
+	rows, err := s.queryNamed(ctx, queryIdentityLinks, orgFromContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	links := []IdentityLink{}
+	for rows.Next() {
+		var link IdentityLink
+		if err := rows.Scan(&link.LinkID, &link.OrgID, &link.Identity, &link.Site, &link.UserID, &link.CreatedBy, &link.CreatedAt); err != nil {
+			return nil, err
+		}
+		links = append(links, link)
+	}
+	return links, rows.Err()
+}
+
+func (s *sqlStore) CreateIdentityLink(ctx context.Context, link IdentityLink) (int, error) {
+	var linkID int
+	err := s.scanNamed(ctx, queryCreateIdentityLink, []interface{}{link.OrgID, link.Identity, link.Site, link.UserID, link.CreatedBy, link.CreatedAt}, &linkID)
+	return linkID, err
+}
+
+func (s *sqlStore) DeleteIdentityLink(ctx context.Context, linkID int) error {
+	result, err := s.execNamed(ctx, queryDeleteIdentityLink, linkID, orgFromContext(ctx))
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil || rows == 0 {
+		if err == nil {
+			err = sql.ErrNoRows
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *sqlStore) UserDevices(ctx context.Context, userID int) ([]UserDevice, error) {
+	rows, err := s.queryNamed(ctx, queryUserDevices, userID, orgFromContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	devices := []UserDevice{}
+	for rows.Next() {
+		var device UserDevice
+		var lastSeenAt sql.NullTime
+		if err := rows.Scan(&device.DeviceID, &device.UserID, &device.Name, &device.Platform, &device.CreatedAt, &lastSeenAt); err != nil {
+			return nil, err
+		}
+		if lastSeenAt.Valid {
+			device.LastSeenAt = &lastSeenAt.Time
+		}
+		devices = append(devices, device)
+	}
+	return devices, rows.Err()
+}
+
+func (s *sqlStore) UserDevice(ctx context.Context, deviceID int) (UserDevice, error) {
+	var device UserDevice
+	var lastSeenAt sql.NullTime
+	if err := s.scanNamed(ctx, queryUserDevice, []interface{}{deviceID, orgFromContext(ctx)}, &device.DeviceID, &device.UserID, &device.Name, &device.Platform, &device.CreatedAt, &lastSeenAt); err != nil {
+		return UserDevice{}, err
+	}
+	if lastSeenAt.Valid {
+		device.LastSeenAt = &lastSeenAt.Time
+	}
+	return device, nil
+}
+
+func (s *sqlStore) CreateUserDevice(ctx context.Context, device UserDevice) (int, error) {
+	var deviceID int
+	err := s.scanNamed(ctx, queryCreateUserDevice, []interface{}{device.UserID, device.Name, device.Platform, device.CreatedAt, recordOrg(ctx)}, &deviceID)
+	return deviceID, err
+}
+
+func (s *sqlStore) DeleteUserDevice(ctx context.Context, deviceID int) error {
+	result, err := s.execNamed(ctx, queryDeleteUserDevice, deviceID, orgFromContext(ctx))
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil || rows == 0 {
+		if err == nil {
+			err = sql.ErrNoRows
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *sqlStore) TouchUserDevice(ctx context.Context, deviceID int, seenAt time.Time) error {
+	_, err := s.execNamed(ctx, queryTouchUserDevice, deviceID, seenAt)
+	return err
+}
+
+func (s *sqlStore) BuildingAdmins(ctx context.Context) ([]BuildingAdmin, error) {
+	rows, err := s.queryNamed(ctx, queryBuildingAdmins, orgFromContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	admins := []BuildingAdmin{}
+	for rows.Next() {
+		var admin BuildingAdmin
+		if err := rows.Scan(&admin.UserID, &admin.BuildingID, &admin.OrgID, &admin.CreatedBy, &admin.CreatedAt); err != nil {
+			return nil, err
+		}
+		admins = append(admins, admin)
+	}
+	return admins, rows.Err()
+}
+
+func (s *sqlStore) AdminBuildingIDs(ctx context.Context, username string) ([]int, error) {
+	rows, err := s.queryNamed(ctx, queryAdminBuildingIDs, username, orgFromContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var buildingIDs []int
+	for rows.Next() {
+		var buildingID int
+		if err := rows.Scan(&buildingID); err != nil {
+			return nil, err
+		}
+		buildingIDs = append(buildingIDs, buildingID)
+	}
+	return buildingIDs, rows.Err()
+}
+
+func (s *sqlStore) GrantBuildingAdmin(ctx context.Context, admin BuildingAdmin) error {
+	var userID int
+	return s.scanNamed(ctx, queryGrantBuildingAdmin, []interface{}{admin.UserID, admin.BuildingID, admin.OrgID, admin.CreatedBy, admin.CreatedAt}, &userID)
+}
+
+func (s *sqlStore) RevokeBuildingAdmin(ctx context.Context, userID int, buildingID int) error {
+	result, err := s.execNamed(ctx, queryRevokeBuildingAdmin, userID, buildingID, orgFromContext(ctx))
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil || rows == 0 {
+		if err == nil {
+			err = sql.ErrNoRows
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *sqlStore) ManagedRooms(ctx context.Context) ([]ManagedRoom, error) {
+	rows, err := s.queryNamed(ctx, queryManagedRooms, orgFromContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	rooms := []ManagedRoom{}
+	for rows.Next() {
+		var room ManagedRoom
+		var floorID sql.NullInt64
+		if err := rows.Scan(&room.RoomID, &room.RoomName, &floorID); err != nil {
+			return nil, err
+		}
+		room.FloorID = intPointer(floorID)
+		rooms = append(rooms, room)
+	}
+	return rooms, rows.Err()
+}
+
+func (s *sqlStore) ManagedRoom(ctx context.Context, roomID int) (ManagedRoom, error) {
+	var room ManagedRoom
+	var floorID sql.NullInt64
+	if err := s.scanNamed(ctx, queryManagedRoom, []interface{}{roomID, orgFromContext(ctx)}, &room.RoomID, &room.RoomName, &floorID); err != nil {
+		return ManagedRoom{}, err
+	}
+	room.FloorID = intPointer(floorID)
+	return room, nil
+}
+
+func (s *sqlStore) CreateRoom(ctx context.Context, room ManagedRoom) (int, error) {
+	var roomID int
+	err := s.scanNamed(ctx, queryCreateRoom, []interface{}{room.RoomName, nullableInt(room.FloorID), recordOrg(ctx)}, &roomID)
+	return roomID, err
+}
+
+func (s *sqlStore) UpdateRoom(ctx context.Context, room ManagedRoom) error {
+	result, err := s.execNamed(ctx, queryUpdateRoom, room.RoomID, room.RoomName, nullableInt(room.FloorID), orgFromContext(ctx))
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil || rows == 0 {
+		if err == nil {
+			err = sql.ErrNoRows
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *sqlStore) ManagedBeacons(ctx context.Context) ([]ManagedBeacon, error) {
+	rows, err := s.queryNamed(ctx, queryManagedBeacons, orgFromContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	beacons := []ManagedBeacon{}
+	for rows.Next() {
+		var beacon ManagedBeacon
+		var roomID sql.NullInt64
+		if err := rows.Scan(&beacon.BeaconID, &beacon.BeaconName, &beacon.ServiceUUID, &roomID); err != nil {
+			return nil, err
+		}
+		beacon.RoomID = intPointer(roomID)
+		beacons = append(beacons, beacon)
+	}
+	return beacons, rows.Err()
+}
+
+func (s *sqlStore) ManagedBeacon(ctx context.Context, beaconID int) (ManagedBeacon, error) {
+	var beacon ManagedBeacon
+	var roomID sql.NullInt64
+	if err := s.scanNamed(ctx, queryManagedBeacon, []interface{}{beaconID, orgFromContext(ctx)}, &beacon.BeaconID, &beacon.BeaconName, &beacon.ServiceUUID, &roomID); err != nil {
+		return ManagedBeacon{}, err
+	}
+	beacon.RoomID = intPointer(roomID)
+	return beacon, nil
+}
+
+func (s *sqlStore) CreateBeacon(ctx context.Context, beacon ManagedBeacon) (int, error) {
+	var beaconID int
+	err := s.scanNamed(ctx, queryCreateBeacon, []interface{}{beacon.BeaconName, beacon.ServiceUUID, nullableInt(beacon.RoomID), recordOrg(ctx)}, &beaconID)
+	return beaconID, err
+}
+
+func (s *sqlStore) UpdateBeacon(ctx context.Context, beacon ManagedBeacon) error {
+	result, err := s.execNamed(ctx, queryUpdateBeacon, beacon.BeaconID, beacon.BeaconName, nullableInt(beacon.RoomID), orgFromContext(ctx))
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil || rows == 0 {
+		if err == nil {
+			err = sql.ErrNoRows
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *sqlStore) DeleteBeacon(ctx context.Context, beaconID int) error {
+	result, err := s.execNamed(ctx, queryDeleteBeacon, beaconID, orgFromContext(ctx))
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil || rows == 0 {
+		if err == nil {
+			err = sql.ErrNoRows
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *sqlStore) LinkUploadDecision(ctx context.Context, uploadID int, decisionID int, roomID *int) error {
+	_, err := s.execNamed(ctx, queryLinkUploadDecision, uploadID, decisionID, nullableInt(roomID))
+	return err
+}
+
+func (s *sqlStore) ListUploads(ctx context.Context, filter UploadFilter) ([]UploadRecord, error) {
+	decisionID := -1
+	if filter.DecisionID != nil {
+		decisionID = *filter.DecisionID
+	}
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = noRowLimit
+	}
+
+	rows, err := s.queryNamed(ctx, queryListUploads, filter.AfterID, filter.UserName, filter.Kind, decisionID, limit, orgFromContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []UploadRecord
+	for rows.Next() {
+		var record UploadRecord
+		var roomID, recordDecisionID, sampleID sql.NullInt64
+		if err := rows.Scan(&record.UploadID, &record.Kind, &record.UserName, &roomID, &recordDecisionID, &record.Decision, &sampleID,
+			&record.WifiKey, &record.BleKey, &record.WifiSize, &record.BleSize, &record.WifiSHA256, &record.BleSHA256, &record.UploadedAt); err != nil {
+			continue
+		}
+		record.RoomID = intPointer(roomID)
+		record.DecisionID = intPointer(recordDecisionID)
+		record.SampleID = intPointer(sampleID)
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+func (s *sqlStore) CreateSnapshot(ctx context.Context, snapshot DatasetSnapshot) (int, error) {
+	var snapshotID int
+	err := s.scanNamed(ctx, queryCreateSnapshot, []interface{}{snapshot.Name, snapshot.Description, snapshot.CreatedBy, snapshot.CreatedAt, snapshot.SampleCount, snapshot.ManifestJSON, recordOrg(ctx)}, &snapshotID)
+	return snapshotID, err
+}
+
+func (s *sqlStore) ListSnapshots(ctx context.Context) ([]DatasetSnapshot, error) {
+	rows, err := s.queryNamed(ctx, queryListSnapshots, orgFromContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	snapshots := []DatasetSnapshot{}
+	for rows.Next() {
+		var snapshot DatasetSnapshot
+		if err := rows.Scan(&snapshot.SnapshotID, &snapshot.Name, &snapshot.Description, &snapshot.CreatedBy, &snapshot.CreatedAt, &snapshot.SampleCount); err != nil {
+			continue
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	return snapshots, rows.Err()
+}
+
+func (s *sqlStore) SnapshotByName(ctx context.Context, name string) (DatasetSnapshot, error) {
+	var snapshot DatasetSnapshot
+	err := s.scanNamed(ctx, querySnapshotByName, []interface{}{name, orgFromContext(ctx)},
+		&snapshot.SnapshotID, &snapshot.Name, &snapshot.Description, &snapshot.CreatedBy, &snapshot.CreatedAt, &snapshot.SampleCount, &snapshot.ManifestJSON)
+	return snapshot, err
+}
+
+func (s *sqlStore) FingerprintDedupStats(ctx context.Context) (FingerprintDedupStats, error) {
+	var stats FingerprintDedupStats
+	err := s.scanNamed(ctx, queryFingerprintDedupStats, []interface{}{orgFromContext(ctx)}, &stats.Samples, &stats.DuplicateUploads, &stats.DuplicateBytes)
+	return stats, err
+}
+
+// CurrentOccupants は全ルームとその現在の在室者を返します。在室者のいないルームも含みます
+func (s *sqlStore) CurrentOccupants(ctx context.Context) ([]RoomOccupants, error) {
+	rows, err := s.queryNamed(ctx, queryCurrentOccupants, orgFromContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roomsMap := make(map[int]RoomOccupants)
+
+	for rows.Next() {
+		var roomID int
+		var roomName string
+		var userID sql.NullString
+		var lastSeen sql.NullTime
+
+		if err := rows.Scan(&roomID, &roomName, &userID, &lastSeen); err != nil {
+			continue
+		}
+
+		if _, exists := roomsMap[roomID]; !exists {
+			roomsMap[roomID] = RoomOccupants{
+				RoomID:    roomID,
+				RoomName:  roomName,
+				Occupants: []CurrentOccupant{},
+			}
+		}
+
+		if userID.Valid {
+			occupant := CurrentOccupant{
+				UserID:   userID.String,
+				LastSeen: lastSeen.Time,
+			}
+			room := roomsMap[roomID]
+			room.Occupants = append(room.Occupants, occupant)
+			roomsMap[roomID] = room
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rooms := []RoomOccupants{}
+	for _, room := range roomsMap {
+		rooms = append(rooms, room)
+	}
+	return rooms, nil
+}
+
+// requirePostgres は集計系などPostgreSQL固有のSQLを使う機能をSQLite構成で呼び出した場合に501を返します
+func requirePostgres(w http.ResponseWriter, ctx context.Context, reports ReportStore) bool {
+	if reports.Driver() == "postgres" {
+		return true
+	}
+	logError(ctx, "データベースドライバ %s ではこの機能を利用できません", reports.Driver())
+	http.Error(w, "この機能はPostgreSQL構成でのみ利用できます", http.StatusNotImplemented)
+	return false
+}
+
+// migrationLockID は複数インスタンスが同時にマイグレーションを実行しないためのアドバイザリロックのIDです
+const migrationLockID = 5571
+
+type migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// loadMigrations はドライバごとのディレクトリに埋め込まれたマイグレーションをバージョン順に読み込みます
+// pendingMigrations は未適用のマイグレーションの名前を返します
+func pendingMigrations(ctx context.Context, store Store) ([]string, error) {
+	migrations, err := loadMigrations(store.Driver())
+	if err != nil {
+		return nil, fmt.Errorf("マイグレーションの読み込みに失敗しました: %v", err)
+	}
+
+	applied := make(map[int]bool)
+	// schema_migrations がない場合は一度もマイグレーションしていないため、すべて未適用とします
+	if rows, err := store.DB().QueryContext(ctx, "SELECT version FROM schema_migrations"); err == nil {
+		for rows.Next() {
+			var version int
+			if err := rows.Scan(&version); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("適用済みマイグレーションの読み取りに失敗しました: %v", err)
+			}
+			applied[version] = true
+		}
+		rows.Close()
+	}
+
+	var pending []string
+	for _, m := range migrations {
+		if !applied[m.Version] {
+			pending = append(pending, m.Name)
+		}
+	}
+	return pending, nil
+}
+
+// seedDevData は開発用の初期データ（ユーザー・ルーム・ビーコン・WiFiアクセスポイント・ロール）を投入します。
+// ユーザーが既に登録されている場合は何もせず false を返します
+func seedDevData(ctx context.Context, store Store) (bool, error) {
+	var users int
+	if err := store.DB().QueryRowContext(ctx, "SELECT COUNT(*) FROM users").Scan(&users); err != nil {
+		return false, fmt.Errorf("ユーザー数の取得に失敗しました: %v", err)
+	}
+	if users > 0 {
+		return false, nil
+	}
+
+	tx, err := store.DB().BeginTx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("トランザクションの開始に失敗しました: %v", err)
+	}
+	for _, statement := range strings.Split(devSeedSQL, ";\n") {
+		if strings.TrimSpace(statement) == "" {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			tx.Rollback()
+			return false, fmt.Errorf("初期データの投入に失敗しました: %v", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("初期データのコミットに失敗しました: %v", err)
+	}
+	return true, nil
+}
+
+func loadMigrations(driver string) ([]migration, error) {
+	dir := "migrations/" + driver
+	entries, err := migrationFS.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []migration
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".sql") {
+			continue
+		}
+		versionStr, _, found := strings.Cut(name, "_")
+		if !found {
+			return nil, fmt.Errorf("マイグレーションファイル名が不正です: %s", name)
+		}
+		version, err := strconv.Atoi(versionStr)
+		if err != nil {
+			return nil, fmt.Errorf("マイグレーションファイル名が不正です: %s", name)
+		}
+		content, err := migrationFS.ReadFile(dir + "/" + name)
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, migration{Version: version, Name: name, SQL: string(content)})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// runMigrations は埋め込まれたマイグレーションのうち未適用のものを順に適用し、適用した件数を返します
+func runMigrations(ctx context.Context, store Store) (int, error) {
+	migrations, err := loadMigrations(store.Driver())
+	if err != nil {
+		return 0, fmt.Errorf("マイグレーションの読み込みに失敗しました: %v", err)
+	}
+
+	conn, err := store.DB().Conn(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("データベース接続の取得に失敗しました: %v", err)
+	}
+	defer conn.Close()
+
+	// SQLiteは単一ノード前提のため、アドバイザリロックはPostgreSQLでのみ取得します
+	if store.Driver() == "postgres" {
+		if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockID); err != nil {
+			return 0, fmt.Errorf("マイグレーションロックの取得に失敗しました: %v", err)
+		}
+		defer conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", migrationLockID)
+	}
+
+	if _, err := conn.ExecContext(ctx, `
+        CREATE TABLE IF NOT EXISTS schema_migrations (
+            version INT PRIMARY KEY,
+            name VARCHAR(255) NOT NULL,
+            applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+        )
+    `); err != nil {
+		return 0, fmt.Errorf("schema_migrationsテーブルの作成に失敗しました: %v", err)
+	}
+
+	applied := make(map[int]bool)
+	rows, err := conn.QueryContext(ctx, "SELECT version FROM schema_migrations")
+	if err != nil {
+		return 0, fmt.Errorf("適用済みマイグレーションの取得に失敗しました: %v", err)
+	}
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("適用済みマイグレーションの読み取りに失敗しました: %v", err)
+		}
+		applied[version] = true
+	}
+	rows.Close()
+
+	count := 0
+	for _, m := range migrations {
+		if applied[m.Version] {
+			continue
+		}
+
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return count, fmt.Errorf("トランザクションの開始に失敗しました: %v", err)
+		}
+		if _, err := tx.ExecContext(ctx, m.SQL); err != nil {
+			tx.Rollback()
+			return count, fmt.Errorf("マイグレーション %s の適用に失敗しました: %v", m.Name, err)
+		}
+		if _, err := tx.ExecContext(ctx, store.Rebind("INSERT INTO schema_migrations (version, name) VALUES ($1, $2)"), m.Version, m.Name); err != nil {
+			tx.Rollback()
+			return count, fmt.Errorf("マイグレーション %s の記録に失敗しました: %v", m.Name, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return count, fmt.Errorf("マイグレーション %s のコミットに失敗しました: %v", m.Name, err)
+		}
+
+		logInfo(ctx, "マイグレーション %s を適用しました", m.Name)
+		count++
+	}
 
-	reader := csv.NewReader(file)
-	records, err := reader.ReadAll()
-	if err != nil {
-		logError(ctx, "BLE CSVの読み取りに失敗しました: %v", err)
-		return nil, fmt.Errorf("BLE CSVの読み取りに失敗しました: %v", err)
+	return count, nil
+}
+
+// runtimeSettings は SIGHUP または /api/admin/config/reload で再起動せずに再読み込みできる設定です。
+// 処理中のリクエストは開始時の設定のまま処理を続けます
+type runtimeSettings struct {
+	EstimationURL     string
+	InquiryURL        string
+	Decision          DecisionConfig
+	InactivityTimeout time.Duration
+	SlowRequest       time.Duration
+	SlowQuery         time.Duration
+	LogLevel          slog.Level
+	CORSOrigins       []string
+	MaxRecords        int
+	DeviceScan        DeviceScanConfig
+}
+
+var settings atomic.Pointer[runtimeSettings]
+
+// currentSettings は現在の再読み込み可能な設定を返します。読み込み前はしきい値などを0とした設定を返します
+func currentSettings() *runtimeSettings {
+	if current := settings.Load(); current != nil {
+		return current
 	}
+	return &runtimeSettings{}
+}
 
-	var signals []BeaconSignal
-	for _, record := range records {
-		if len(record) < 3 {
-			continue
+var defaultCORSOrigins = []string{"http://localhost:5173", "https://elpis.kajilab.dev", "https://elpis-a.kajilab.dev", "https://elpis-b.kajilab.dev"}
+
+// corsOriginAllowed は origin が許可するオリジンのいずれかに一致するかを返します
+func corsOriginAllowed(allowed []string, origin string) bool {
+	for _, pattern := range allowed {
+		if pattern == "*" || pattern == origin {
+			return true
 		}
-		rssi, err := strconv.ParseFloat(strings.TrimSpace(record[2]), 64)
-		if err != nil {
-			continue
+		if prefix, suffix, ok := strings.Cut(pattern, "*"); ok && len(origin) >= len(prefix)+len(suffix) &&
+			strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) {
+			return true
 		}
-		signal := BeaconSignal{
-			UUID:  strings.TrimSpace(record[1]),
-			BSSID: "",
-			RSSI:  rssi,
+	}
+	return false
+}
+
+// applyRuntimeDefaults は再読み込み可能な項目の既定値を設定します
+func applyRuntimeDefaults(config *Config) {
+	if config.Log.Level == "" {
+		config.Log.Level = "info"
+	}
+	if config.Submit.MaxRecords <= 0 {
+		config.Submit.MaxRecords = 10000
+	}
+	if config.Session.InactivityTimeout <= 0 {
+		config.Session.InactivityTimeout = 21 * time.Minute
+	}
+	if config.Decision.InquiryMin == 0 && config.Decision.InquiryMax == 0 {
+		config.Decision.InquiryMin = 20
+		config.Decision.InquiryMax = 70
+	}
+	if config.Decision.InquiryWin == "" {
+		config.Decision.InquiryWin = inquiryWinEndSession
+	}
+	if config.DeviceScan.ScanInterval <= 0 {
+		config.DeviceScan.ScanInterval = 30 * time.Second
+	}
+	if config.DeviceScan.MinRSSI == 0 {
+		config.DeviceScan.MinRSSI = -90
+	}
+	if config.DeviceScan.UploadBatchSize <= 0 {
+		config.DeviceScan.UploadBatchSize = 10
+	}
+	if len(config.CORS.AllowedOrigins) == 0 {
+		config.CORS.AllowedOrigins = defaultCORSOrigins
+	}
+	if len(config.CORS.AllowedMethods) == 0 {
+		config.CORS.AllowedMethods = []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"}
+	}
+	if len(config.CORS.AllowedHeaders) == 0 {
+		config.CORS.AllowedHeaders = []string{"Content-Type", "Authorization", "X-API-Key"}
+	}
+	if config.CORS.AllowCredentials == nil {
+		allowCredentials := true
+		config.CORS.AllowCredentials = &allowCredentials
+	}
+}
+
+// profile は mode という名前のプロファイルを返します。[profiles] に同じ名前がある場合は [Docker]・[Local] より優先します
+func (c Config) profile(mode string) (ProfileConfig, bool) {
+	if profile, ok := c.Profiles[mode]; ok {
+		return profile, true
+	}
+	switch mode {
+	case "docker":
+		return c.Docker, true
+	case "local":
+		return c.Local, true
+	}
+	return ProfileConfig{}, false
+}
+
+// profileNames は選択できるプロファイル名の一覧を返します
+func (c Config) profileNames() []string {
+	names := []string{"docker", "local"}
+	for name := range c.Profiles {
+		if !slices.Contains(names, name) {
+			names = append(names, name)
 		}
-		signals = append(signals, signal)
 	}
+	sort.Strings(names)
+	return names
+}
 
-	return signals, nil
+// siteNames は [Federation.peers] のサイト名を名前の順に返します
+func (c FederationConfig) siteNames() []string {
+	names := make([]string, 0, len(c.Peers))
+	for name := range c.Peers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
 }
 
-func parseWifiCSV(ctx context.Context, filePath string) ([]WiFiSignal, error) {
-	file, err := os.Open(filePath)
-	if err != nil {
-		logError(ctx, "WiFi CSVファイルのオープンに失敗しました: %v", err)
-		return nil, fmt.Errorf("WiFi CSVファイルのオープンに失敗しました: %v", err)
+// shardNames は [EstimationRouting.shards] のシャード名を名前の順に返します
+func (c EstimationRoutingConfig) shardNames() []string {
+	names := make([]string, 0, len(c.Shards))
+	for name := range c.Shards {
+		names = append(names, name)
 	}
-	defer file.Close()
+	sort.Strings(names)
+	return names
+}
+
+func checkDeviceScanConfig(config DeviceScanConfig) error {
+	for _, profile := range []struct {
+		name   string
+		config DeviceScanProfile
+	}{{"[DeviceScan]", DeviceScanProfile{config.ScanInterval, config.MinRSSI, config.UploadBatchSize}}, {"[DeviceScan.work]", config.Work}, {"[DeviceScan.closed]", config.Closed}} {
+		if profile.config.ScanInterval < 0 || profile.config.UploadBatchSize < 0 || profile.config.MinRSSI > 0 {
+			return fmt.Errorf("%s の scan_interval・upload_batch_size は0以上、min_rssi は0以下である必要があります", profile.name)
+		}
+	}
+	if err := config.Hours.check(); err != nil {
+		return fmt.Errorf("[DeviceScan.hours] %v", err)
+	}
+	for key, hours := range config.Buildings {
+		if _, err := strconv.Atoi(key); err != nil {
+			return fmt.Errorf("[DeviceScan.buildings] のキーは建物ID である必要があります: %q", key)
+		}
+		if err := hours.check(); err != nil {
+			return fmt.Errorf("[DeviceScan.buildings.%s] %v", key, err)
+		}
+	}
+	return nil
+}
 
-	reader := csv.NewReader(file)
-	records, err := reader.ReadAll()
+// clockMinutes は "15:04" 形式の時刻を0時からの分に変換します
+func clockMinutes(clock string) (int, error) {
+	t, err := time.Parse("15:04", clock)
 	if err != nil {
-		logError(ctx, "WiFi CSVの読み取りに失敗しました: %v", err)
-		return nil, fmt.Errorf("WiFi CSVの読み取りに失敗しました: %v", err)
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// withinClock は minute が start から end の前まで（end が start より前の場合は日をまたぐ）に含まれるかを返します
+func withinClock(minute, start, end int) bool {
+	if start <= end {
+		return start <= minute && minute < end
 	}
+	return minute >= start || minute < end
+}
 
-	var signals []WiFiSignal
-	for _, record := range records {
-		if len(record) < 3 {
+var weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+func (h BuildingHoursConfig) check() error {
+	for _, pair := range [][2]string{{h.Open, h.Close}, {h.WorkStart, h.WorkEnd}} {
+		if (pair[0] == "") != (pair[1] == "") {
+			return fmt.Errorf("open・close と work_start・work_end はそれぞれ両方を指定する必要があります")
+		}
+		if pair[0] == "" {
 			continue
 		}
-		rssi, err := strconv.ParseFloat(strings.TrimSpace(record[2]), 64)
+		start, err := clockMinutes(pair[0])
 		if err != nil {
-			continue
+			return fmt.Errorf("時刻は 15:04 の形式である必要があります: %q", pair[0])
 		}
-		signal := WiFiSignal{
-			SSID:  strings.TrimSpace(record[0]),
-			BSSID: strings.TrimSpace(record[1]),
-			RSSI:  rssi,
+		end, err := clockMinutes(pair[1])
+		if err != nil {
+			return fmt.Errorf("時刻は 15:04 の形式である必要があります: %q", pair[1])
+		}
+		if start == end {
+			return fmt.Errorf("開始と終了に同じ時刻は指定できません: %s", pair[0])
+		}
+	}
+	for _, day := range h.Days {
+		if !slices.Contains(weekdayNames, day) {
+			return fmt.Errorf("days は mon・tue・wed・thu・fri・sat・sun のいずれかである必要があります: %q", day)
 		}
-		signals = append(signals, signal)
 	}
+	return nil
+}
 
-	return signals, nil
+func (h BuildingHoursConfig) openOn(day time.Weekday) bool {
+	return len(h.Days) == 0 || slices.Contains(h.Days, weekdayNames[day])
 }
 
-func getRoomIDByBeacon(ctx context.Context, db *sql.DB, beacon BeaconSignal) (int, error) {
-	var roomID int
-	query := `
-        SELECT room_id FROM beacons 
-        WHERE UPPER(service_uuid) = UPPER($1)
-        LIMIT 1
-    `
-	err := db.QueryRow(query, beacon.UUID).Scan(&roomID)
-	if err != nil {
-		return 0, err
+// isOpen は at に建物が開いているかを返します。日をまたぐ開館時間は open の曜日の開館として扱います
+func (h BuildingHoursConfig) isOpen(at time.Time) bool {
+	if h.Open == "" {
+		return h.openOn(at.Weekday())
 	}
-	logInfo(ctx, "ビーコン UUID=%s (RSSI=%.2f) に対するルームID=%d を見つけました", beacon.UUID, beacon.RSSI, roomID)
-	return roomID, nil
+	open, _ := clockMinutes(h.Open)
+	closing, _ := clockMinutes(h.Close)
+	minute := at.Hour()*60 + at.Minute()
+	if !withinClock(minute, open, closing) {
+		return false
+	}
+	if open > closing && minute < closing {
+		return h.openOn((at.Weekday() + 6) % 7)
+	}
+	return h.openOn(at.Weekday())
 }
 
-func getRoomIDByWifi(ctx context.Context, db *sql.DB, wifi WiFiSignal) (int, error) {
-	var roomID int
-	query := `
-        SELECT room_id FROM wifi_access_points 
-        WHERE LOWER(bssid) = LOWER($1)
-        LIMIT 1
-    `
-	err := db.QueryRow(query, wifi.BSSID).Scan(&roomID)
-	if err != nil {
-		return 0, err
+// mode は at の時間帯が勤務時間・勤務時間外・閉館時間のいずれかを返します
+func (h BuildingHoursConfig) mode(at time.Time) string {
+	if !h.isOpen(at) {
+		return deviceScanClosed
 	}
-	logInfo(ctx, "WiFi BSSID=%s (RSSI=%.2f) に対するルームID=%d を見つけました", wifi.BSSID, wifi.RSSI, roomID)
-	return roomID, nil
+	if h.WorkStart != "" {
+		start, _ := clockMinutes(h.WorkStart)
+		end, _ := clockMinutes(h.WorkEnd)
+		if withinClock(at.Hour()*60+at.Minute(), start, end) {
+			return deviceScanWork
+		}
+	}
+	return deviceScanOpen
 }
 
-func determineRoomID(ctx context.Context, db *sql.DB, bleFilePath string, wifiFilePath string) (int, error) {
-	bleSignals, err := parseBLECSV(ctx, bleFilePath)
-	if err != nil {
-		return 0, err
+// nextChange は at より後で最初に mode が変わる時刻を返します。1週間のうちに変わらない場合は nil を返します
+func (h BuildingHoursConfig) nextChange(at time.Time) *time.Time {
+	current := h.mode(at)
+	boundaries := []int{0}
+	for _, clock := range []string{h.Open, h.Close, h.WorkStart, h.WorkEnd} {
+		if minute, err := clockMinutes(clock); err == nil {
+			boundaries = append(boundaries, minute)
+		}
+	}
+	sort.Ints(boundaries)
+	for day := 0; day <= 7; day++ {
+		midnight := time.Date(at.Year(), at.Month(), at.Day()+day, 0, 0, 0, 0, at.Location())
+		for _, minute := range boundaries {
+			t := midnight.Add(time.Duration(minute) * time.Minute)
+			if t.After(at) && h.mode(t) != current {
+				return &t
+			}
+		}
 	}
+	return nil
+}
 
-	wifiSignals, err := parseWifiCSV(ctx, wifiFilePath)
-	if err != nil {
-		return 0, err
+// settings は建物 buildingID（nil の場合は [DeviceScan.hours]）の at の時間帯の設定を返します
+func (c DeviceScanConfig) settings(buildingID *int, at time.Time) DeviceScanSettings {
+	hours := c.Hours
+	if buildingID != nil {
+		if building, ok := c.Buildings[strconv.Itoa(*buildingID)]; ok {
+			hours = building
+		}
+	}
+	settings := DeviceScanSettings{
+		BuildingID:          buildingID,
+		Mode:                hours.mode(at),
+		ScanIntervalSeconds: int(c.ScanInterval / time.Second),
+		MinRSSI:             c.MinRSSI,
+		UploadBatchSize:     c.UploadBatchSize,
+		ValidUntil:          hours.nextChange(at),
+	}
+	profile := DeviceScanProfile{}
+	switch settings.Mode {
+	case deviceScanWork:
+		profile = c.Work
+	case deviceScanClosed:
+		profile = c.Closed
+	}
+	if profile.ScanInterval > 0 {
+		settings.ScanIntervalSeconds = int(profile.ScanInterval / time.Second)
+	}
+	if profile.MinRSSI != 0 {
+		settings.MinRSSI = profile.MinRSSI
+	}
+	if profile.UploadBatchSize > 0 {
+		settings.UploadBatchSize = profile.UploadBatchSize
 	}
+	return settings
+}
 
-	if len(bleSignals) == 0 && len(wifiSignals) == 0 {
-		logError(ctx, "BLEおよびWiFi信号が見つかりません")
-		return 0, fmt.Errorf("BLEおよびWiFi信号が見つかりません")
+func checkDecisionConfig(config DecisionConfig) error {
+	if config.InquiryMin < 0 || config.InquiryMax > 100 || config.InquiryMin > config.InquiryMax {
+		return fmt.Errorf("[Decision] は 0 <= inquiry_min <= inquiry_max <= 100 である必要があります: inquiry_min=%d inquiry_max=%d", config.InquiryMin, config.InquiryMax)
 	}
+	if config.InquiryWin != inquiryWinEndSession && config.InquiryWin != inquiryWinKeepSession {
+		return fmt.Errorf("[Decision] inquiry_win は %s または %s である必要があります: %q", inquiryWinEndSession, inquiryWinKeepSession, config.InquiryWin)
+	}
+	return nil
+}
 
-	var bleRoomID int
-	for _, beacon := range bleSignals {
-		roomID, err := getRoomIDByBeacon(ctx, db, beacon)
-		if err != nil {
-			continue
+// newRuntimeSettings は既定値を適用した設定から再読み込み可能な設定を作成します
+func newRuntimeSettings(config Config, mode string) (*runtimeSettings, error) {
+	profile, _ := config.profile(mode)
+	estimationURL, inquiryURL := profile.EstimationURL, profile.InquiryURL
+	var problems []string
+	for _, u := range []string{estimationURL, inquiryURL} {
+		if err := validateHTTPURL(u); err != nil {
+			problems = append(problems, fmt.Sprintf("URL %q が無効です: %v", u, err))
 		}
-		bleRoomID = roomID
-		break
+	}
+	if err := checkDecisionConfig(config.Decision); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if err := checkDeviceScanConfig(config.DeviceScan); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if *config.CORS.AllowCredentials && slices.Contains(config.CORS.AllowedOrigins, "*") {
+		problems = append(problems, "[CORS] allow_credentials が true の場合は allowed_origins に \"*\" を指定できません")
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(config.Log.Level)); err != nil {
+		problems = append(problems, fmt.Sprintf("ログレベルが無効です: %s", config.Log.Level))
+	}
+	if len(problems) > 0 {
+		return nil, errors.New(strings.Join(problems, "; "))
 	}
 
-	var wifiRoomID int
-	for _, wifi := range wifiSignals {
-		roomID, err := getRoomIDByWifi(ctx, db, wifi)
-		if err != nil {
-			continue
-		}
-		wifiRoomID = roomID
-		break
+	return &runtimeSettings{
+		EstimationURL:     estimationURL,
+		InquiryURL:        inquiryURL,
+		Decision:          config.Decision,
+		InactivityTimeout: config.Session.InactivityTimeout,
+		SlowRequest:       config.Log.SlowRequest,
+		SlowQuery:         config.Log.SlowQuery,
+		LogLevel:          level,
+		CORSOrigins:       config.CORS.AllowedOrigins,
+		MaxRecords:        config.Submit.MaxRecords,
+		DeviceScan:        config.DeviceScan,
+	}, nil
+}
+
+// configReloader は設定ファイルと環境変数を読み直して再読み込み可能な設定を差し替えます。
+// プロキシから共有設定を取得している場合は、その値を設定ファイルより優先します。
+// ポートやデータベースなどそれ以外の項目の変更は再起動するまで反映されません
+type configReloader struct {
+	mu     sync.Mutex
+	path   string
+	mode   string
+	remote *RemoteConfigResponse
+}
+
+func (c *configReloader) reload(ctx context.Context) (*runtimeSettings, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.reloadLocked(ctx)
+}
+
+// applyRemote はプロキシから取得した共有設定を適用します。前回と同じ場合は何もしません
+func (c *configReloader) applyRemote(ctx context.Context, remote RemoteConfigResponse) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.remote != nil && reflect.DeepEqual(*c.remote, remote) {
+		return nil
 	}
 
-	if bleRoomID != 0 {
-		return bleRoomID, nil
-	} else if wifiRoomID != 0 {
-		return wifiRoomID, nil
-	} else {
-		logError(ctx, "有効なBLEまたはWiFiアクセスポイントが見つかりません")
-		return 0, fmt.Errorf("有効なBLEまたはWiFiアクセスポイントが見つかりません")
+	previous := c.remote
+	c.remote = &remote
+	if _, err := c.reloadLocked(ctx); err != nil {
+		c.remote = previous
+		return err
 	}
+	return nil
 }
 
-func forwardFilesToInquiryServer(ctx context.Context, wifiFilePath string, bleFilePath string, inquiryURL string, confidence int) (int, error) {
-	wifiData, err := os.ReadFile(wifiFilePath)
-	if err != nil {
-		logError(ctx, "WiFiデータの読み取りに失敗しました: %v", err)
-		return 0, fmt.Errorf("WiFiデータの読み取りに失敗しました: %v", err)
+func (c *configReloader) reloadLocked(ctx context.Context) (*runtimeSettings, error) {
+	var config Config
+	if _, err := toml.DecodeFile(c.path, &config); err != nil {
+		return nil, fmt.Errorf("設定ファイルの読み取りに失敗しました: %v", err)
+	}
+	if _, err := applyEnvOverrides(&config); err != nil {
+		return nil, err
+	}
+	applyRuntimeDefaults(&config)
+	if c.remote != nil {
+		if err := c.remote.apply(&config); err != nil {
+			return nil, fmt.Errorf("プロキシの共有設定が無効です: %v", err)
+		}
 	}
 
-	bleData, err := os.ReadFile(bleFilePath)
+	next, err := newRuntimeSettings(config, c.mode)
 	if err != nil {
-		logError(ctx, "BLEデータの読み取りに失敗しました: %v", err)
-		return 0, fmt.Errorf("BLEデータの読み取りに失敗しました: %v", err)
+		return nil, fmt.Errorf("設定が無効なため再読み込みを中止しました: %v", err)
 	}
+	previous := currentSettings()
+	settings.Store(next)
+	logLevel.Set(next.LogLevel)
 
-	inquiryReq := InquiryRequest{
-		WifiData: string(wifiData),
-		BleData:  string(bleData),
+	logInfo(ctx, "設定を再読み込みしました: estimation_url=%s inquiry_url=%s inquiry_min=%d inquiry_max=%d inactivity_timeout=%s slow_request=%s slow_query=%s level=%s cors=%v remote=%v",
+		next.EstimationURL, next.InquiryURL, next.Decision.InquiryMin, next.Decision.InquiryMax, next.InactivityTimeout, next.SlowRequest, next.SlowQuery, next.LogLevel, next.CORSOrigins, c.remote != nil)
+	if previous.EstimationURL != next.EstimationURL || previous.InquiryURL != next.InquiryURL {
+		logInfo(ctx, "転送先のURLを変更しました: %s, %s -> %s, %s", previous.EstimationURL, previous.InquiryURL, next.EstimationURL, next.InquiryURL)
 	}
+	return next, nil
+}
 
-	reqBody, err := json.Marshal(inquiryReq)
-	if err != nil {
-		logError(ctx, "問い合わせリクエストのエンコードに失敗しました: %v", err)
-		return 0, fmt.Errorf("問い合わせリクエストのエンコードに失敗しました: %v", err)
+// watchReloadSignal は SIGHUP を受け取るたびに設定を再読み込みします
+func (c *configReloader) watchReloadSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		ctx := context.Background()
+		if _, err := c.reload(ctx); err != nil {
+			logError(ctx, "SIGHUPによる設定の再読み込みに失敗しました: %v", err)
+		}
 	}
+}
 
-	logInfo(ctx, "問い合わせサーバーへのリクエストを送信しています")
+type ConfigReloadResponse struct {
+	EstimationURL      string   `json:"estimation_url"`
+	InquiryURL         string   `json:"inquiry_url"`
+	InquiryMin         int      `json:"inquiry_min"`
+	InquiryMax         int      `json:"inquiry_max"`
+	SpeculativeInquiry bool     `json:"speculative_inquiry"`
+	InquiryWin         string   `json:"inquiry_win"`
+	InactivityTimeout  string   `json:"inactivity_timeout"`
+	SlowRequest        string   `json:"slow_request"`
+	SlowQuery          string   `json:"slow_query"`
+	LogLevel           string   `json:"log_level"`
+	CORSOrigins        []string `json:"cors_origins"`
+	MaxRecords         int      `json:"max_records"`
+}
 
-	resp, err := http.Post(inquiryURL, "application/json", bytes.NewBuffer(reqBody))
-	if err != nil {
-		logError(ctx, "問い合わせサーバーへのリクエスト送信に失敗しました: %v", err)
-		return 0, fmt.Errorf("問い合わせサーバーへのリクエスト送信に失敗しました: %v", err)
+// handleAdminConfigReload は設定を再読み込みし、反映した設定を返します
+func handleAdminConfigReload(w http.ResponseWriter, r *http.Request, ctx context.Context, presence PresenceStore, audit AuditStore, reloader *configReloader) {
+	if !requireSystemAdmin(w, r, ctx, presence) {
+		return
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		logError(ctx, "問い合わせサーバーからの無効な応答。ステータスコード: %d", resp.StatusCode)
-		return 0, fmt.Errorf("問い合わせサーバーからの無効な応答。ステータスコード: %d", resp.StatusCode)
+	next, err := reloader.reload(ctx)
+	if err != nil {
+		logError(ctx, "設定の再読み込みに失敗しました: %v", err)
+		http.Error(w, fmt.Sprintf("設定の再読み込みに失敗しました: %v", err), http.StatusBadRequest)
+		return
 	}
+	recordAudit(ctx, audit, r, "config.reload", "config", fmt.Sprintf("inquiry_min=%d inquiry_max=%d level=%s", next.Decision.InquiryMin, next.Decision.InquiryMax, next.LogLevel))
 
-	var inquiryResp InquiryResponse
-	if err := json.NewDecoder(resp.Body).Decode(&inquiryResp); err != nil {
-		logError(ctx, "問い合わせサーバーからの応答のデコードに失敗しました: %v", err)
-		return 0, fmt.Errorf("問い合わせサーバーからの応答のデコードに失敗しました: %v", err)
+	w.Header().Set("Content-Type", "application/json")
+	response := ConfigReloadResponse{
+		EstimationURL:      next.EstimationURL,
+		InquiryURL:         next.InquiryURL,
+		InquiryMin:         next.Decision.InquiryMin,
+		InquiryMax:         next.Decision.InquiryMax,
+		SpeculativeInquiry: next.Decision.SpeculativeInquiry,
+		InquiryWin:         next.Decision.InquiryWin,
+		InactivityTimeout:  next.InactivityTimeout.String(),
+		SlowRequest:        next.SlowRequest.String(),
+		SlowQuery:          next.SlowQuery.String(),
+		LogLevel:           next.LogLevel.String(),
+		CORSOrigins:        next.CORSOrigins,
+		MaxRecords:         next.MaxRecords,
+	}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
 	}
+}
 
-	logInfo(ctx, "問い合わせサーバーからの応答を受信しました: %+v", inquiryResp)
-	logInfo(ctx, "問い合わせ信頼度を受信しました: %d", inquiryResp.ServerConfidence)
+// tenantRetentionCategories は組織ごとに保持期間を上書きできる分類です
+var tenantRetentionCategories = []string{retentionSessions, retentionDecisions, retentionTransitions, retentionFingerprints}
 
-	return inquiryResp.ServerConfidence, nil
+// validate は上書きの値を確認します。しきい値は base に上書きを適用した値で確認します
+func (t TenantSettings) validate(base DecisionConfig) error {
+	if t.InactivityTimeout != "" {
+		if timeout, err := time.ParseDuration(t.InactivityTimeout); err != nil || timeout <= 0 {
+			return fmt.Errorf("inactivity_timeout が無効です: %q", t.InactivityTimeout)
+		}
+	}
+	if decision := t.decision(base); decision.InquiryMin < 0 || decision.InquiryMax > 100 || decision.InquiryMin > decision.InquiryMax {
+		return fmt.Errorf("0 <= inquiry_min <= inquiry_max <= 100 である必要があります: inquiry_min=%d inquiry_max=%d", decision.InquiryMin, decision.InquiryMax)
+	}
+	for category, rule := range t.Retention {
+		if !slices.Contains(tenantRetentionCategories, category) {
+			return fmt.Errorf("retention の分類は %s のいずれかである必要があります: %q", strings.Join(tenantRetentionCategories, "・"), category)
+		}
+		if rule.Days < 0 || rule.Months < 0 {
+			return fmt.Errorf("retention.%s の days・months は0以上である必要があります", category)
+		}
+		if rule.Archive && category != retentionSessions {
+			return fmt.Errorf("retention.%s の archive は sessions のみ指定できます", category)
+		}
+	}
+	return nil
 }
 
-func getUserID(r *http.Request) string {
-	username, _, ok := r.BasicAuth()
-	if ok && username != "" {
-		return username
+// decision は base に在室判定のしきい値の上書きを適用した設定を返します
+func (t TenantSettings) decision(base DecisionConfig) DecisionConfig {
+	if t.InquiryMin != nil {
+		base.InquiryMin = *t.InquiryMin
 	}
-	return "anonymous"
+	if t.InquiryMax != nil {
+		base.InquiryMax = *t.InquiryMax
+	}
+	return base
 }
 
-func getUserIDFromDB(ctx context.Context, db *sql.DB, username string) (int, error) {
-	var userID int
-	err := db.QueryRowContext(ctx, "SELECT id FROM users WHERE user_id = $1", username).Scan(&userID)
-	if err != nil {
-		logError(ctx, "ユーザーIDの取得に失敗しました: %v", err)
-		return 0, err
+// inactivityTimeout は上書きがあればその値を、なければ base を返します
+func (t TenantSettings) inactivityTimeout(base time.Duration) time.Duration {
+	if timeout, err := time.ParseDuration(t.InactivityTimeout); err == nil && timeout > 0 {
+		return timeout
 	}
-	return userID, nil
+	return base
 }
 
-func saveUploadedFile(ctx context.Context, file multipart.File, path string) error {
-	if _, err := file.Seek(0, io.SeekStart); err != nil {
-		logError(ctx, "ファイルのシークに失敗しました: %v", err)
-		return err
+// tenantOverrides は ctx の組織の上書きを返します。取得に失敗した場合は設定ファイルの値で処理を続けます
+func tenantOverrides(ctx context.Context, tenants TenantSettingsStore) TenantSettings {
+	record, err := tenants.TenantSettings(ctx, recordOrg(ctx))
+	if err != nil && err != sql.ErrNoRows {
+		logError(ctx, "組織ごとの設定の取得に失敗したため、設定ファイルの値を使用します: %v", err)
 	}
+	return record.Settings
+}
 
-	outFile, err := os.Create(path)
+// forEachTenant は上書きを設定した組織がない場合はすべての組織を対象に fn を1回だけ実行し、
+// ある場合は組織ごとにその組織に限定したコンテキストと上書きで fn を実行します
+func forEachTenant(ctx context.Context, orgs OrgStore, overrides map[int]TenantSettings, fn func(ctx context.Context, settings TenantSettings)) error {
+	if len(overrides) == 0 {
+		fn(ctx, TenantSettings{})
+		return nil
+	}
+	organizations, err := orgs.Organizations(ctx)
 	if err != nil {
-		logError(ctx, "ファイルの作成に失敗しました: %v", err)
 		return err
 	}
-	defer outFile.Close()
-
-	if _, err := io.Copy(outFile, file); err != nil {
-		logError(ctx, "ファイルのコピーに失敗しました: %v", err)
-		return err
+	for _, org := range organizations {
+		fn(withOrg(ctx, org.OrgID), overrides[org.OrgID])
 	}
 	return nil
 }
 
-func startUserSession(ctx context.Context, db *sql.DB, userID int, roomID int, startTime time.Time) error {
-	_, err := db.ExecContext(ctx, `
-        INSERT INTO user_presence_sessions (user_id, room_id, start_time, last_seen)
-        VALUES ($1, $2, $3, $3)
-    `, userID, roomID, startTime)
-	if err != nil {
-		logError(ctx, "セッションの開始に失敗しました: %v", err)
-		return fmt.Errorf("セッションの開始に失敗しました: %v", err)
+// handleAdminTenantSettings は組織ごとの設定の上書きと、上書きを適用した実際の設定を返します。
+// PUT の場合はJSONのボディで上書きを置き換え、DELETE の場合は上書きを削除して設定ファイルの値に戻します。
+// 対象はリクエストを送った管理者の組織で、既定の組織の管理者は org_id パラメータで他の組織を指定できます
+func handleAdminTenantSettings(w http.ResponseWriter, r *http.Request, ctx context.Context, presence PresenceStore, orgs OrgStore, tenants TenantSettingsStore, audit AuditStore, policy RetentionPolicyConfig) {
+	if !requireAdmin(w, r, ctx, presence) {
+		return
 	}
-	return nil
+
+	orgID := recordOrg(ctx)
+	if orgIDStr := r.URL.Query().Get("org_id"); orgIDStr != "" {
+		parsed, err := strconv.Atoi(orgIDStr)
+		if err != nil || parsed <= 0 {
+			logError(ctx, "org_idパラメータが無効です: %s", orgIDStr)
+			http.Error(w, "org_idパラメータは正の整数である必要があります。", http.StatusBadRequest)
+			return
+		}
+		if parsed != orgID && !requireSystemAdmin(w, r, ctx, presence) {
+			return
+		}
+		orgID = parsed
+	}
+	if _, err := orgs.Organization(ctx, orgID); err == sql.ErrNoRows {
+		http.Error(w, "組織が見つかりません", http.StatusNotFound)
+		return
+	} else if err != nil {
+		logError(ctx, "組織の取得に失敗しました: %v", err)
+		http.Error(w, "組織の取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	current := currentSettings()
+	switch r.Method {
+	case http.MethodPut:
+		var settings TenantSettings
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&settings); err != nil {
+			logError(ctx, "組織ごとの設定のデコードに失敗しました: %v", err)
+			http.Error(w, fmt.Sprintf("組織ごとの設定はJSONで指定する必要があります: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := settings.validate(current.Decision); err != nil {
+			logError(ctx, "組織ごとの設定が無効です: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		record := TenantSettingsRecord{OrgID: orgID, Settings: settings, UpdatedBy: getUserID(r), UpdatedAt: time.Now().UTC()}
+		if err := tenants.SetTenantSettings(ctx, record); err != nil {
+			logError(ctx, "組織ごとの設定の保存に失敗しました: %v", err)
+			http.Error(w, "組織ごとの設定の保存に失敗しました", http.StatusInternalServerError)
+			return
+		}
+		encoded, _ := json.Marshal(settings)
+		recordAudit(ctx, audit, r, "tenant_settings.update", fmt.Sprintf("organization:%d", orgID), string(encoded))
+		logInfo(ctx, "組織 %d の設定を更新しました: %s", orgID, encoded)
+	case http.MethodDelete:
+		if err := tenants.DeleteTenantSettings(ctx, orgID); err != nil && err != sql.ErrNoRows {
+			logError(ctx, "組織ごとの設定の削除に失敗しました: %v", err)
+			http.Error(w, "組織ごとの設定の削除に失敗しました", http.StatusInternalServerError)
+			return
+		}
+		recordAudit(ctx, audit, r, "tenant_settings.delete", fmt.Sprintf("organization:%d", orgID), "")
+		logInfo(ctx, "組織 %d の設定を設定ファイルの値に戻しました", orgID)
+	}
+
+	record, err := tenants.TenantSettings(ctx, orgID)
+	if err != nil && err != sql.ErrNoRows {
+		logError(ctx, "組織ごとの設定の取得に失敗しました: %v", err)
+		http.Error(w, "組織ごとの設定の取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	decision := record.Settings.decision(current.Decision)
+	response := TenantSettingsResponse{
+		OrgID:     orgID,
+		Overrides: record.Settings,
+		Effective: EffectiveSettings{
+			InactivityTimeout: record.Settings.inactivityTimeout(current.InactivityTimeout).String(),
+			InquiryMin:        decision.InquiryMin,
+			InquiryMax:        decision.InquiryMax,
+			Retention:         make(map[string]RetentionRule),
+		},
+	}
+	for category, rule := range policy.Categories {
+		response.Effective.Retention[category] = rule
+	}
+	for category, rule := range record.Settings.Retention {
+		response.Effective.Retention[category] = rule
+	}
+	if err == nil {
+		response.UpdatedBy, response.UpdatedAt = record.UpdatedBy, &record.UpdatedAt
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
+		http.Error(w, "JSON応答のエンコードに失敗しました", http.StatusInternalServerError)
+	}
+}
+
+// RemoteConfigResponse はプロキシの /api/config が返す共有設定です。指定のない項目は設定ファイルの値を使用します
+type RemoteConfigResponse struct {
+	InquiryMin        *int     `json:"inquiry_min,omitempty"`
+	InquiryMax        *int     `json:"inquiry_max,omitempty"`
+	InactivityTimeout string   `json:"inactivity_timeout,omitempty"`
+	CORSOrigins       []string `json:"cors_origins,omitempty"`
 }
 
-func endUserSession(ctx context.Context, db *sql.DB, userID int, endTime time.Time) error {
-	result, err := db.ExecContext(ctx, `
-        UPDATE user_presence_sessions
-        SET end_time = $1
-        WHERE user_id = $2 AND end_time IS NULL
-    `, endTime, userID)
-	if err != nil {
-		logError(ctx, "セッションの終了に失敗しました: %v", err)
-		return fmt.Errorf("セッションの終了に失敗しました: %v", err)
+func (r RemoteConfigResponse) apply(config *Config) error {
+	if r.InquiryMin != nil {
+		config.Decision.InquiryMin = *r.InquiryMin
 	}
-
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		logError(ctx, "RowsAffectedの取得に失敗しました: %v", err)
-		return fmt.Errorf("RowsAffectedの取得に失敗しました: %v", err)
+	if r.InquiryMax != nil {
+		config.Decision.InquiryMax = *r.InquiryMax
 	}
-	if rowsAffected > 0 {
-		logInfo(ctx, "ユーザーID %d のセッションを %s に終了しました", userID, endTime)
+	if r.InactivityTimeout != "" {
+		timeout, err := time.ParseDuration(r.InactivityTimeout)
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("inactivity_timeout が無効です: %q", r.InactivityTimeout)
+		}
+		config.Session.InactivityTimeout = timeout
+	}
+	if len(r.CORSOrigins) > 0 {
+		config.CORS.AllowedOrigins = r.CORSOrigins
 	}
 	return nil
 }
 
-func updateLastSeen(ctx context.Context, db *sql.DB, userID int, lastSeen time.Time) error {
-	result, err := db.ExecContext(ctx, `
-        UPDATE user_presence_sessions
-        SET last_seen = $1
-        WHERE user_id = $2 AND end_time IS NULL
-    `, lastSeen, userID)
-	if err != nil {
-		logError(ctx, "last_seenの更新に失敗しました: %v", err)
-		return fmt.Errorf("last_seenの更新に失敗しました: %v", err)
-	}
-
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		logError(ctx, "RowsAffectedの取得に失敗しました: %v", err)
-		return fmt.Errorf("RowsAffectedの取得に失敗しました: %v", err)
+// remoteConfigURLs は共有設定を取得するURLを返します。remote_config_url がない場合は各プロキシの /api/config を順に使用します
+func remoteConfigURLs(config RegistrationConfig, proxyURLs []string) []string {
+	if config.RemoteConfigURL != "" {
+		return []string{config.RemoteConfigURL}
 	}
-	if rowsAffected > 0 {
-		logInfo(ctx, "ユーザーID %d のlast_seenを更新しました", userID)
+	var urls []string
+	for _, proxyURL := range proxyURLs {
+		u, err := url.Parse(proxyURL)
+		if err != nil {
+			continue
+		}
+		u.Path = "/api/config"
+		urls = append(urls, u.String())
 	}
-	return nil
+	return urls
 }
 
-func updateUserPresence(ctx context.Context, db *sql.DB, userID int, estimationConfidence int, inquiryConfidence int, lastSeen time.Time, roomID int) error {
-	if inquiryConfidence > estimationConfidence {
-		err := endUserSession(ctx, db, userID, lastSeen)
+// fetchRemoteConfig は urls を順に試し、最初に取得できた共有設定を返します
+func fetchRemoteConfig(ctx context.Context, client *http.Client, urls []string, authToken string) (RemoteConfigResponse, string, error) {
+	var errs []string
+	for _, configURL := range urls {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, configURL, nil)
 		if err != nil {
-			return fmt.Errorf("セッションの終了に失敗しました: %v", err)
+			errs = append(errs, err.Error())
+			continue
 		}
-	} else {
-		var existingRoomID int
-		err := db.QueryRowContext(ctx, `
-            SELECT room_id FROM user_presence_sessions
-            WHERE user_id = $1 AND end_time IS NULL
-        `, userID).Scan(&existingRoomID)
+		if authToken != "" {
+			req.Header.Set("Authorization", "Bearer "+authToken)
+		}
+		setRequestIDHeader(ctx, req)
 
+		resp, err := client.Do(req)
 		if err != nil {
-			if err == sql.ErrNoRows {
-				err = startUserSession(ctx, db, userID, roomID, lastSeen)
-				if err != nil {
-					return fmt.Errorf("新しいセッションの開始に失敗しました: %v", err)
-				}
-				logInfo(ctx, "ユーザーID %d の新しいセッションをルームID %d で開始しました", userID, roomID)
-			} else {
-				return fmt.Errorf("現在のセッションの取得に失敗しました: %v", err)
-			}
+			errs = append(errs, err.Error())
+			continue
+		}
+		var remote RemoteConfigResponse
+		if resp.StatusCode != http.StatusOK {
+			errs = append(errs, fmt.Sprintf("%s が %d を返しました", configURL, resp.StatusCode))
+		} else if err := json.NewDecoder(resp.Body).Decode(&remote); err != nil {
+			errs = append(errs, fmt.Sprintf("%s の応答を読み取れませんでした: %v", configURL, err))
 		} else {
-			err = updateLastSeen(ctx, db, userID, lastSeen)
-			if err != nil {
-				return fmt.Errorf("last_seenの更新に失敗しました: %v", err)
-			}
+			resp.Body.Close()
+			return remote, configURL, nil
 		}
+		resp.Body.Close()
 	}
-	return nil
+	return RemoteConfigResponse{}, "", errors.New(strings.Join(errs, "; "))
 }
 
-func handleSignalsSubmit(w http.ResponseWriter, r *http.Request, ctx context.Context, db *sql.DB, estimationURL string, inquiryURL string, loc *time.Location) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "許可されていないメソッドです。POSTを使用してください。", http.StatusMethodNotAllowed)
-		return
+// pollRemoteConfig はプロキシへの登録が完了した後、interval ごとに共有設定を取得して適用します。ctx が終了すると戻ります
+func pollRemoteConfig(ctx context.Context, reloader *configReloader, urls []string, authToken string, interval time.Duration) {
+	client := tracedClient(10 * time.Second)
+	wait := time.Second
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		if currentRegistrationState() != registrationRegistered {
+			wait = time.Second
+			continue
+		}
+		wait = interval
+
+		remote, source, err := fetchRemoteConfig(ctx, client, urls, authToken)
+		if err == nil {
+			err = reloader.applyRemote(ctx, remote)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			atomic.AddUint64(&remoteConfigFailures, 1)
+			logger.Warn("プロキシの共有設定を適用できませんでした。現在の設定を使い続けます", append(logAttrs(ctx), "error", err)...)
+			continue
+		}
+		atomic.StoreInt64(&remoteConfigLastApplied, time.Now().Unix())
+		logger.Debug("プロキシの共有設定を確認しました", append(logAttrs(ctx), "source", source)...)
 	}
+}
 
-	if err := r.ParseMultipartForm(32 << 20); err != nil {
-		logError(ctx, "リクエストの解析に失敗しました: %v", err)
-		http.Error(w, "リクエストの解析に失敗しました", http.StatusBadRequest)
-		return
+// startupConfig はモードに応じて選んだプロファイルの設定値です
+type startupConfig struct {
+	Mode             string
+	Port             string
+	ProxyURLs        []string
+	EstimationURL    string
+	InquiryURL       string
+	DBDriver         string
+	DBConnStr        string
+	ReadDBConnStr    string
+	SkipRegistration bool
+	Storage          StorageConfig
+}
+
+// validateConfig は起動前に設定を検証し、見つかった問題をすべて返します
+func validateConfig(ctx context.Context, config Config, startup startupConfig) []string {
+	var problems []string
+	addProblem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
 	}
 
-	wifiFile, _, err := r.FormFile("wifi_data")
-	if err != nil {
-		logError(ctx, "WiFiデータファイルの読み取りに失敗しました: %v", err)
-		http.Error(w, "WiFiデータファイルの読み取りに失敗しました", http.StatusBadRequest)
-		return
+	if _, ok := config.profile(startup.Mode); !ok {
+		// プロファイルがない場合は以降の項目がすべて未設定になるため、この問題のみを返します
+		addProblem("mode に指定したプロファイル %q が定義されていません（選択できるプロファイル: %s）", startup.Mode, strings.Join(config.profileNames(), ", "))
+		return problems
+	}
+	if port, err := strconv.Atoi(startup.Port); err != nil || port < 1 || port > 65535 {
+		addProblem("server_port は 1〜65535 の整数である必要があります: %q", startup.Port)
 	}
-	defer wifiFile.Close()
 
-	bleFile, _, err := r.FormFile("ble_data")
-	if err != nil {
-		logError(ctx, "BLEデータファイルの読み取りに失敗しました: %v", err)
-		http.Error(w, "BLEデータファイルの読み取りに失敗しました", http.StatusBadRequest)
-		return
+	urls := []struct {
+		key      string
+		value    string
+		required bool
+	}{
+		{"estimation_url", startup.EstimationURL, true},
+		{"inquiry_url", startup.InquiryURL, true},
+	}
+	for _, u := range urls {
+		if u.value == "" {
+			if u.required {
+				addProblem("%s が設定されていません", u.key)
+			}
+			continue
+		}
+		if err := validateHTTPURL(u.value); err != nil {
+			addProblem("%s が無効です（%s）: %v", u.key, u.value, err)
+		}
+	}
+	if len(startup.ProxyURLs) == 0 && !startup.SkipRegistration {
+		addProblem("proxy_url が設定されていません")
+	}
+	for _, proxyURL := range startup.ProxyURLs {
+		if err := validateHTTPURL(proxyURL); err != nil {
+			addProblem("proxy_url が無効です（%s）: %v", proxyURL, err)
+		}
 	}
-	defer bleFile.Close()
 
-	username := getUserID(r)
-	userID, err := getUserIDFromDB(ctx, db, username)
-	if err != nil {
-		logError(ctx, "ユーザーが見つかりません: %v", err)
-		http.Error(w, "ユーザーが見つかりません", http.StatusUnauthorized)
-		return
+	switch startup.DBDriver {
+	case "postgres", "sqlite":
+		if err := checkDatabase(ctx, startup.DBDriver, startup.DBConnStr); err != nil {
+			addProblem("データベースに接続できません（db_driver=%s）: %v", startup.DBDriver, err)
+		}
+		if startup.ReadDBConnStr != "" && startup.DBDriver == "postgres" {
+			if err := checkDatabase(ctx, startup.DBDriver, startup.ReadDBConnStr); err != nil {
+				addProblem("リードレプリカに接続できません: %v", err)
+			}
+		}
+	default:
+		addProblem("db_driver は postgres または sqlite である必要があります: %q", startup.DBDriver)
 	}
 
-	currentDate := time.Now().In(loc).Format("2006-01-02")
-	baseDir := "./uploads"
-	dateDir := filepath.Join(baseDir, currentDate)
-	userDir := filepath.Join(dateDir, username)
+	storages := []struct {
+		key     string
+		config  StorageConfig
+		enabled bool
+	}{
+		{"storage", startup.Storage, true},
+		{"[UploadRetention.archive_storage]", config.UploadRetention.ArchiveStorage, config.uploadArchiveEnabled()},
+	}
+	var dirs []string
+	for _, storage := range storages {
+		if !storage.enabled {
+			continue
+		}
+		switch storage.config.Backend {
+		case "", "local":
+			dirs = append(dirs, storage.config.Dir)
+		case "s3":
+			if storage.config.Endpoint == "" || storage.config.Bucket == "" {
+				addProblem("%s の backend が s3 の場合は endpoint と bucket が必要です", storage.key)
+			}
+		default:
+			addProblem("%s の backend は local または s3 である必要があります: %q", storage.key, storage.config.Backend)
+		}
+	}
 
-	if err := os.MkdirAll(userDir, os.ModePerm); err != nil {
-		logError(ctx, "ディレクトリの作成に失敗しました: %v", err)
-		http.Error(w, "ディレクトリの作成に失敗しました", http.StatusInternalServerError)
-		return
+	dirs = append(dirs, "./estimation", config.Reports.Dir)
+	if *config.NegativeSamples.Enabled {
+		dirs = append(dirs, config.NegativeSamples.Dir)
+	}
+	for _, dir := range dirs {
+		if err := checkWritableDir(dir); err != nil {
+			addProblem("ディレクトリ %s に書き込めません: %v", dir, err)
+		}
 	}
 
-	currentTime := time.Now().In(loc)
-	unixTime := currentTime.Unix()
-	wifiFileName := fmt.Sprintf("wifi_data_%d.csv", unixTime)
-	bleFileName := fmt.Sprintf("ble_data_%d.csv", unixTime)
+	if rate := config.NegativeSamples.SampleRate; rate != nil && !(*rate >= 0 && *rate <= 1) {
+		addProblem("[NegativeSamples] sample_rate は 0〜1 である必要があります: %v", *rate)
+	}
+	if err := checkDecisionConfig(config.Decision); err != nil {
+		addProblem("%v", err)
+	}
+	if config.Tracing.SampleRatio > 1 {
+		addProblem("[Tracing] sample_ratio は 0〜1 である必要があります: %v", config.Tracing.SampleRatio)
+	}
+	if config.Quota.UserBytes < 0 || config.Quota.RoomBytes < 0 {
+		addProblem("[Quota] の容量は0以上である必要があります")
+	}
+	if config.Submit.QueueSize < 0 {
+		addProblem("[Submit] queue_size は0以上である必要があります: %d", config.Submit.QueueSize)
+	}
+	for category, rule := range config.RetentionPolicy.Categories {
+		if !slices.Contains(retentionCategories, category) {
+			addProblem("[RetentionPolicy.categories] の分類は %s のいずれかである必要があります: %q", strings.Join(retentionCategories, "・"), category)
+			continue
+		}
+		if rule.Days < 0 || rule.Months < 0 {
+			addProblem("[RetentionPolicy.categories.%s] days・months は0以上である必要があります", category)
+		}
+		if rule.Archive && category != retentionSessions && category != retentionUploads {
+			addProblem("[RetentionPolicy.categories.%s] archive は sessions・uploads のみ指定できます", category)
+		}
+	}
+	if config.StorageEncryption.Enabled {
+		if config.StorageEncryption.Key == "" {
+			addProblem("[StorageEncryption] enabled が true の場合は key または key_file を指定してください")
+		} else if _, err := newBlobCipher(config.StorageEncryption); err != nil {
+			addProblem("%v", err)
+		}
+	}
+	if config.RetryQueue.MaxAge < 0 {
+		addProblem("[RetryQueue] max_age は0以上である必要があります: %s", config.RetryQueue.MaxAge)
+	}
+	for _, pattern := range append(append([]string{}, config.Log.Redaction.Fields...), config.Log.Redaction.Headers...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			addProblem("[Log.redaction] のパターンが無効です: %q", pattern)
+		}
+	}
+	if config.PublicDisplay.Mode != publicDisplayCount && config.PublicDisplay.Mode != publicDisplayPseudonym {
+		addProblem("[PublicDisplay] mode は %s または %s である必要があります: %q", publicDisplayCount, publicDisplayPseudonym, config.PublicDisplay.Mode)
+	}
+	if config.PrivateStats.MinUsers < 1 {
+		addProblem("[PrivateStats] min_users は1以上である必要があります: %d", config.PrivateStats.MinUsers)
+	}
+	if config.PrivateStats.Epsilon <= 0 || math.IsInf(config.PrivateStats.Epsilon, 0) || math.IsNaN(config.PrivateStats.Epsilon) {
+		addProblem("[PrivateStats] epsilon は正の数である必要があります: %v", config.PrivateStats.Epsilon)
+	}
+	if config.Federation.Enabled && len(config.Federation.Peers) == 0 {
+		addProblem("[Federation] enabled が true の場合は [Federation.peers.{サイト名}] を1つ以上指定してください")
+	}
+	for name, peer := range config.Federation.Peers {
+		if name == "" || strings.Contains(name, ":") {
+			addProblem("[Federation.peers] のサイト名は空でなく : を含まない必要があります: %q", name)
+		}
+		if err := validateHTTPURL(peer.URL); err != nil {
+			addProblem("[Federation.peers.%s] url が無効です（%s）: %v", name, peer.URL, err)
+		}
+		if peer.Timezone != "" {
+			if _, err := time.LoadLocation(peer.Timezone); err != nil {
+				addProblem("[Federation.peers.%s] timezone が無効です: %q", name, peer.Timezone)
+			}
+		}
+	}
+	// 同じルーム・階・建物を複数のシャードに指定すると振り分け先が定まらないため、最初に指定したシャード以外を問題にします
+	shardOwners := make(map[string]string)
+	for _, name := range config.EstimationRouting.shardNames() {
+		shard := config.EstimationRouting.Shards[name]
+		if err := validateHTTPURL(shard.URL); err != nil {
+			addProblem("[EstimationRouting.shards.%s] url が無効です（%s）: %v", name, shard.URL, err)
+		}
+		if len(shard.Rooms) == 0 && len(shard.Floors) == 0 && len(shard.Buildings) == 0 {
+			addProblem("[EstimationRouting.shards.%s] rooms・floors・buildings のいずれかを指定してください", name)
+		}
+		for _, area := range []struct {
+			key string
+			ids []int
+		}{{"rooms", shard.Rooms}, {"floors", shard.Floors}, {"buildings", shard.Buildings}} {
+			for _, id := range area.ids {
+				owner := fmt.Sprintf("%s:%d", area.key, id)
+				if other, exists := shardOwners[owner]; exists {
+					addProblem("[EstimationRouting.shards.%s] %s の %d は %s にも指定されています", name, area.key, id, other)
+					continue
+				}
+				shardOwners[owner] = name
+			}
+		}
+	}
+	if config.Upstream.Estimation.MaxConnsPerHost < 0 || config.Upstream.Inquiry.MaxConnsPerHost < 0 {
+		addProblem("[Upstream] max_conns_per_host は0以上である必要があります")
+	}
+	for pattern, limit := range config.RouteLimits {
+		if !strings.HasPrefix(pattern, "/") {
+			addProblem("[RouteLimits] のパスは / で始まる必要があります: %q", pattern)
+		}
+		if limit.MaxConcurrent < 0 || limit.MaxBodyMB < 0 || limit.MaxFileMB < 0 || limit.MaxMemoryMB < 0 || limit.Timeout < 0 {
+			addProblem("[RouteLimits.%q] の上限は0以上である必要があります", pattern)
+		}
+		if limit.MaxBodyMB > 0 && limit.MaxFileMB > limit.MaxBodyMB {
+			addProblem("[RouteLimits.%q] max_file_mb（%d）は max_body_mb（%d）以下である必要があります", pattern, limit.MaxFileMB, limit.MaxBodyMB)
+		}
+	}
+	if config.Registration.RetryInitial > config.Registration.RetryMaxWait {
+		addProblem("[Registration] retry_initial（%s）は retry_max_wait（%s）以下である必要があります", config.Registration.RetryInitial, config.Registration.RetryMaxWait)
+	}
+	if config.MDNS.Enabled && !strings.HasPrefix(config.MDNS.Service, "_") {
+		addProblem("[MDNS] service は _{名前}._tcp の形式である必要があります: %q", config.MDNS.Service)
+	}
+	if config.Registration.Scheme != "http" && config.Registration.Scheme != "https" {
+		addProblem("[Registration] scheme は http または https である必要があります: %q", config.Registration.Scheme)
+	}
+	if config.Registration.SystemURI != "" {
+		if err := validateHostName(config.Registration.Scheme, config.Registration.SystemURI); err != nil {
+			addProblem("[Registration] system_uri が無効です（%s）: %v", config.Registration.SystemURI, err)
+		}
+	}
+	if config.Registration.RemoteConfig && config.Registration.RemoteConfigURL != "" {
+		if err := validateHTTPURL(config.Registration.RemoteConfigURL); err != nil {
+			addProblem("[Registration] remote_config_url が無効です（%s）: %v", config.Registration.RemoteConfigURL, err)
+		}
+	}
+	if config.Consul.Enabled {
+		if config.Consul.Address != "" && strings.Contains(config.Consul.Address, "://") {
+			if err := validateHTTPURL(config.Consul.Address); err != nil {
+				addProblem("[Consul] address が無効です（%s）: %v", config.Consul.Address, err)
+			}
+		}
+		if config.Consul.TTL < 2*time.Second {
+			addProblem("[Consul] ttl は2秒以上である必要があります: %s", config.Consul.TTL)
+		}
+	}
+	if config.Registration.MaxAttempts < 0 {
+		addProblem("[Registration] max_attempts は0以上である必要があります: %d", config.Registration.MaxAttempts)
+	}
 
-	wifiFilePath := filepath.Join(userDir, wifiFileName)
-	bleFilePath := filepath.Join(userDir, bleFileName)
+	return problems
+}
 
-	if err := saveUploadedFile(ctx, wifiFile, wifiFilePath); err != nil {
-		logError(ctx, "WiFiデータの保存に失敗しました: %v", err)
-		http.Error(w, "WiFiデータの保存に失敗しました", http.StatusInternalServerError)
-		return
+func validateHTTPURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
 	}
-	if err := saveUploadedFile(ctx, bleFile, bleFilePath); err != nil {
-		logError(ctx, "BLEデータの保存に失敗しました: %v", err)
-		http.Error(w, "BLEデータの保存に失敗しました", http.StatusInternalServerError)
-		return
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("スキームは http または https である必要があります")
 	}
+	if u.Host == "" {
+		return fmt.Errorf("ホストが指定されていません")
+	}
+	return nil
+}
 
-	wifiFileInfo, err := os.Stat(wifiFilePath)
+// validateHostName は scheme と組み合わせて URL のホスト部分（ホスト名とポート番号）になる値かを確認します
+func validateHostName(scheme string, host string) error {
+	u, err := url.Parse(scheme + "://" + host)
 	if err != nil {
-		logError(ctx, "WiFiデータの検証に失敗しました: %v", err)
-		http.Error(w, "WiFiデータの検証に失敗しました", http.StatusInternalServerError)
-		return
+		return err
 	}
+	if u.Hostname() == "" || u.Host != host {
+		return fmt.Errorf("スキームやパスを含めずにホスト名（とポート番号）のみを指定してください")
+	}
+	return nil
+}
 
-	bleFileInfo, err := os.Stat(bleFilePath)
+// checkDatabase はデータベースに接続できるかを確認します
+func checkDatabase(ctx context.Context, driver string, connStr string) error {
+	store, err := openStore(driver, connStr)
 	if err != nil {
-		logError(ctx, "BLEデータの検証に失敗しました: %v", err)
-		http.Error(w, "BLEデータの検証に失敗しました", http.StatusInternalServerError)
-		return
+		return err
 	}
+	defer store.Close()
 
-	var emptyFiles []string
-	if wifiFileInfo.Size() == 0 {
-		emptyFiles = append(emptyFiles, "WiFiデータファイルが空です")
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	return store.PingContext(ctx)
+}
+
+// checkWritableDir はディレクトリを作成し、一時ファイルを書き込めるかを確認します
+func checkWritableDir(dir string) error {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
 	}
-	if bleFileInfo.Size() == 0 {
-		emptyFiles = append(emptyFiles, "BLEデータファイルが空です")
+	file, err := os.CreateTemp(dir, ".write-check-*")
+	if err != nil {
+		return err
 	}
+	file.Close()
+	return os.Remove(file.Name())
+}
 
-	if len(emptyFiles) > 0 {
-		errorMessage := strings.Join(emptyFiles, "; ")
-		logError(ctx, "ユーザーID %d が空のファイルをアップロードしました", userID)
-		http.Error(w, errorMessage, http.StatusBadRequest)
-		return
-	}
+const vaultRefPrefix = "vault:"
 
-	estimationConfidence, err := forwardFilesToEstimationServer(ctx, bleFilePath, wifiFilePath, estimationURL)
+// resolveSecrets は秘密情報の項目を {キー}_file に指定したファイルの内容、または vault:{パス}#{キー} 形式で参照したVaultの値に置き換え、
+// 置き換えた項目名を返します。対象は db_conn_str・secret_key など _file の項目がある設定です
+func resolveSecrets(ctx context.Context, config *Config) ([]string, error) {
+	var resolved []string
+	err := walkSecretFields(reflect.ValueOf(config).Elem(), "", func(name string, value reflect.Value, file reflect.Value) error {
+		if file.String() == "" {
+			return nil
+		}
+		data, err := os.ReadFile(file.String())
+		if err != nil {
+			return fmt.Errorf("%s_file を読み取れませんでした: %v", name, err)
+		}
+		value.SetString(strings.TrimRight(string(data), "\r\n"))
+		resolved = append(resolved, name+"(file)")
+		return nil
+	})
 	if err != nil {
-		logError(ctx, "推定サーバーへの転送に失敗しました: %v", err)
-		http.Error(w, fmt.Sprintf("推定サーバーへの転送に失敗しました: %v", err), http.StatusInternalServerError)
-		return
+		return nil, err
 	}
 
-	var roomID int
-	if estimationConfidence >= 20 && estimationConfidence <= 70 {
-		inquiryConfidence, err := forwardFilesToInquiryServer(ctx, wifiFilePath, bleFilePath, inquiryURL, estimationConfidence)
+	vault := &vaultClient{config: config.Vault, secrets: make(map[string]map[string]interface{})}
+	err = walkSecretFields(reflect.ValueOf(config).Elem(), "", func(name string, value reflect.Value, file reflect.Value) error {
+		if !strings.HasPrefix(value.String(), vaultRefPrefix) {
+			return nil
+		}
+		secret, err := vault.lookup(ctx, strings.TrimPrefix(value.String(), vaultRefPrefix))
 		if err != nil {
-			logError(ctx, "問い合わせサーバーへの転送に失敗しました: %v", err)
-			http.Error(w, fmt.Sprintf("問い合わせサーバーへの転送に失敗しました: %v", err), http.StatusInternalServerError)
-			return
+			return fmt.Errorf("%s をVaultから読み取れませんでした: %v", name, err)
 		}
+		value.SetString(secret)
+		resolved = append(resolved, name+"(vault)")
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resolved, nil
+}
 
-		if estimationConfidence >= inquiryConfidence {
-			roomID, err = determineRoomID(ctx, db, bleFilePath, wifiFilePath)
-			if err != nil {
-				logError(ctx, "ルームIDの決定に失敗しました: %v", err)
-				http.Error(w, fmt.Sprintf("ルームIDの決定に失敗しました: %v", err), http.StatusInternalServerError)
-				return
-			}
-			logInfo(ctx, "ユーザーID %d に対するルームID %d を決定しました", userID, roomID)
+// walkSecretFields は同じ構造体に {フィールド名}File がある文字列の項目ごとに fn を呼び出します
+func walkSecretFields(v reflect.Value, path string, fn func(name string, value reflect.Value, file reflect.Value) error) error {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		key := field.Tag.Get("toml")
+		if key == "" {
+			key = configKeyFromFieldName(field.Name)
+		}
+		name := key
+		if path != "" {
+			name = path + "." + key
+		}
 
-			err = updateUserPresence(ctx, db, userID, estimationConfidence, inquiryConfidence, currentTime, roomID)
-			if err != nil {
-				logError(ctx, "ユーザーID %d のプレゼンス更新に失敗しました: %v", userID, err)
+		switch field.Type.Kind() {
+		case reflect.Struct:
+			if err := walkSecretFields(v.Field(i), name, fn); err != nil {
+				return err
 			}
-		} else {
-			err = endUserSession(ctx, db, userID, currentTime)
-			if err != nil {
-				logError(ctx, "ユーザーID %d のセッション終了に失敗しました: %v", userID, err)
-			} else {
-				logInfo(ctx, "ユーザーID %d のセッションを終了しました", userID)
+		case reflect.Map:
+			if field.Type.Elem().Kind() != reflect.Struct {
+				continue
 			}
-
-			// **ネガティブサンプルとして保存する処理を追加**
-			// ネガティブサンプル保存ディレクトリの定義
-			negativeSampleDir := "./manager_fingerprint/0"
-
-			// ディレクトリが存在しない場合は作成
-			if err := os.MkdirAll(negativeSampleDir, os.ModePerm); err != nil {
-				logError(ctx, "ネガティブサンプル保存ディレクトリの作成に失敗しました: %v", err)
-				// サーバーエラーとして応答
-				http.Error(w, "ネガティブサンプル保存ディレクトリの作成に失敗しました", http.StatusInternalServerError)
-				return
+			iter := v.Field(i).MapRange()
+			for iter.Next() {
+				entry := reflect.New(field.Type.Elem()).Elem()
+				entry.Set(iter.Value())
+				if err := walkSecretFields(entry, name+"."+iter.Key().String(), fn); err != nil {
+					return err
+				}
+				v.Field(i).SetMapIndex(iter.Key(), entry)
 			}
-
-			// ファイル名の生成
-			negativeWifiFileName := fmt.Sprintf("wifi_data_negative_%d.csv", unixTime)
-			negativeBleFileName := fmt.Sprintf("ble_data_negative_%d.csv", unixTime)
-
-			negativeWifiFilePath := filepath.Join(negativeSampleDir, negativeWifiFileName)
-			negativeBleFilePath := filepath.Join(negativeSampleDir, negativeBleFileName)
-
-			// ファイルのコピー
-			if err := copyFile(ctx, wifiFilePath, negativeWifiFilePath); err != nil {
-				logError(ctx, "WiFiデータのネガティブサンプルへのコピーに失敗しました: %v", err)
-				http.Error(w, "WiFiデータのネガティブサンプルへのコピーに失敗しました", http.StatusInternalServerError)
-				return
+		case reflect.String:
+			file := v.FieldByName(field.Name + "File")
+			if !file.IsValid() || file.Kind() != reflect.String {
+				continue
 			}
-
-			if err := copyFile(ctx, bleFilePath, negativeBleFilePath); err != nil {
-				logError(ctx, "BLEデータのネガティブサンプルへのコピーに失敗しました: %v", err)
-				http.Error(w, "BLEデータのネガティブサンプルへのコピーに失敗しました", http.StatusInternalServerError)
-				return
+			if err := fn(name, v.Field(i), file); err != nil {
+				return err
 			}
-
-			logInfo(ctx, "ユーザーID %d のデータをネガティブサンプルとして保存しました", userID)
 		}
-	} else {
-		if estimationConfidence > 70 {
-			roomID, err = determineRoomID(ctx, db, bleFilePath, wifiFilePath)
-			if err != nil {
-				logError(ctx, "ルームIDの決定に失敗しました: %v", err)
-				http.Error(w, fmt.Sprintf("ルームIDの決定に失敗しました: %v", err), http.StatusInternalServerError)
-				return
-			}
-			logInfo(ctx, "ユーザーID %d に対するルームID %d を決定しました", userID, roomID)
+	}
+	return nil
+}
 
-			err = updateUserPresence(ctx, db, userID, estimationConfidence, 0, currentTime, roomID)
-			if err != nil {
-				logError(ctx, "ユーザーID %d のプレゼンス更新に失敗しました: %v", userID, err)
-			}
-		} else {
-			err = endUserSession(ctx, db, userID, currentTime)
-			if err != nil {
-				logError(ctx, "ユーザーID %d のセッション終了に失敗しました: %v", userID, err)
-			} else {
-				logInfo(ctx, "ユーザーID %d のセッションを終了しました", userID)
-			}
+// vaultClient はVaultのKVシークレットエンジンから秘密情報を読み出します。同じパスは一度だけ読み出します
+type vaultClient struct {
+	config  VaultConfig
+	secrets map[string]map[string]interface{}
+}
+
+func (c *vaultClient) lookup(ctx context.Context, ref string) (string, error) {
+	secretPath, key, ok := strings.Cut(ref, "#")
+	if !ok || secretPath == "" || key == "" {
+		return "", fmt.Errorf("Vaultの参照は vault:{パス}#{キー} の形式で指定してください: %s", ref)
+	}
+
+	data, ok := c.secrets[secretPath]
+	if !ok {
+		var err error
+		data, err = c.read(ctx, secretPath)
+		if err != nil {
+			return "", err
 		}
+		c.secrets[secretPath] = data
 	}
 
-	response := UploadResponse{Message: "シグナルデータを受信しました"}
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(response); err != nil {
-		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
-		http.Error(w, "JSON応答のエンコードに失敗しました", http.StatusInternalServerError)
-		return
+	value, ok := data[key].(string)
+	if !ok {
+		return "", fmt.Errorf("%s にキー %s がありません", secretPath, key)
 	}
+	return value, nil
 }
 
-// copyFile はソースファイルからターゲットファイルへ内容をコピーします
-func copyFile(ctx context.Context, srcPath string, dstPath string) error {
-	srcFile, err := os.Open(srcPath)
-	if err != nil {
-		logError(ctx, "ソースファイルのオープンに失敗しました: %v", err)
-		return err
+func (c *vaultClient) read(ctx context.Context, secretPath string) (map[string]interface{}, error) {
+	address := c.config.Address
+	if address == "" {
+		address = os.Getenv("VAULT_ADDR")
 	}
-	defer srcFile.Close()
-
-	dstFile, err := os.Create(dstPath)
-	if err != nil {
-		logError(ctx, "ターゲットファイルの作成に失敗しました: %v", err)
-		return err
+	token := c.config.Token
+	if token == "" {
+		token = os.Getenv("VAULT_TOKEN")
+	}
+	if address == "" || token == "" {
+		return nil, fmt.Errorf("Vaultのアドレスとトークンが設定されていません（[Vault] または VAULT_ADDR・VAULT_TOKEN を設定してください）")
+	}
+	timeout := c.config.Timeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
 	}
-	defer dstFile.Close()
 
-	_, err = io.Copy(dstFile, srcFile)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(address, "/")+"/v1/"+strings.TrimPrefix(secretPath, "/"), nil)
 	if err != nil {
-		logError(ctx, "ファイルのコピー中にエラーが発生しました: %v", err)
-		return err
+		return nil, err
 	}
+	req.Header.Set("X-Vault-Token", token)
 
-	// ファイルのパーミッションをコピー
-	srcInfo, err := srcFile.Stat()
+	resp, err := (&http.Client{Timeout: timeout}).Do(req)
 	if err != nil {
-		logError(ctx, "ソースファイルの情報取得に失敗しました: %v", err)
-		return err
+		return nil, err
 	}
-	if err := os.Chmod(dstPath, srcInfo.Mode()); err != nil {
-		logError(ctx, "ターゲットファイルのパーミッション変更に失敗しました: %v", err)
-		return err
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Vaultが %d を返しました（パス: %s）", resp.StatusCode, secretPath)
 	}
 
-	return nil
+	var body struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("Vaultの応答を解析できませんでした: %v", err)
+	}
+	// KV v2 は data.data に値を、data.metadata にバージョン情報を返します
+	if nested, ok := body.Data["data"].(map[string]interface{}); ok {
+		if _, ok := body.Data["metadata"]; ok {
+			return nested, nil
+		}
+	}
+	return body.Data, nil
 }
 
-func handleSignalsServer(w http.ResponseWriter, r *http.Request, ctx context.Context, db *sql.DB, estimationURL string, inquiryURL string) {
-	handleSignalsServerSubmit(w, r, ctx, estimationURL)
+// redactConnStr は接続文字列に含まれるパスワードを伏せ字にします
+func redactConnStr(connStr string) string {
+	if u, err := url.Parse(connStr); err == nil && u.User != nil {
+		return u.Redacted()
+	}
+	return connStrPasswordPattern.ReplaceAllString(connStr, "${1}xxxxx")
 }
 
-func handlePresenceHistory(w http.ResponseWriter, r *http.Request, ctx context.Context, db *sql.DB, loc *time.Location) {
-	dateStr := r.URL.Query().Get("date")
-	var since time.Time
-	var err error
+var connStrPasswordPattern = regexp.MustCompile(`(password=)\S+`)
 
-	if dateStr != "" {
-		since, err = time.Parse("2006-01-02", dateStr)
-		if err != nil {
-			logError(ctx, "日付パラメータが無効です: %v", err)
-			http.Error(w, "日付パラメータが無効です。形式はYYYY-MM-DDである必要があります。", http.StatusBadRequest)
-			return
-		}
-		since = time.Date(since.Year(), since.Month(), since.Day(), 0, 0, 0, 0, loc)
-	} else {
-		since = time.Now().In(loc).AddDate(0, -1, 0)
-	}
+// configEnvPrefix は設定値を上書きする環境変数の接頭辞です
+const configEnvPrefix = "ELPIS_"
 
-	sessions, err := fetchAllSessions(ctx, db, since)
-	if err != nil {
-		logError(ctx, "プレゼンス履歴の取得に失敗しました: %v", err)
-		http.Error(w, "プレゼンス履歴の取得に失敗しました", http.StatusInternalServerError)
-		return
+// applyEnvOverrides は ELPIS_{セクション}_{キー} の環境変数が設定されている項目を上書きし、適用した環境変数名を返します。
+// 例えば [Docker.storage] の bucket は ELPIS_DOCKER_STORAGE_BUCKET、[Log] の slow_query は ELPIS_LOG_SLOW_QUERY で上書きできます
+// 既定のルートの上限も上書きできるよう、ルートの上限は環境変数を適用する前に既定値を設定します
+func applyEnvOverrides(config *Config) ([]string, error) {
+	if config.RouteLimits == nil {
+		config.RouteLimits = maps.Clone(defaultRouteLimits)
 	}
+	return applyEnvOverridesTo(reflect.ValueOf(config).Elem(), strings.TrimSuffix(configEnvPrefix, "_"))
+}
 
-	dayUserMap := make(map[string]map[int][]PresenceSession)
-	for _, session := range sessions {
-		date := session.StartTime.In(loc).Format("2006-01-02")
-		if _, exists := dayUserMap[date]; !exists {
-			dayUserMap[date] = make(map[int][]PresenceSession)
+func applyEnvOverridesTo(v reflect.Value, prefix string) ([]string, error) {
+	var applied []string
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		key := field.Tag.Get("toml")
+		if key == "" {
+			key = configKeyFromFieldName(field.Name)
 		}
-		dayUserMap[date][session.UserID] = append(dayUserMap[date][session.UserID], session)
-	}
+		name := prefix + "_" + strings.ToUpper(key)
 
-	var allHistory []AllUsersPresenceDay
-	for date, usersMap := range dayUserMap {
-		var users []UserPresenceDetail
-		for userID, userSessions := range usersMap {
-			users = append(users, UserPresenceDetail{
-				UserID:   userID,
-				Sessions: userSessions,
-			})
+		if field.Type.Kind() == reflect.Struct {
+			nested, err := applyEnvOverridesTo(v.Field(i), name)
+			if err != nil {
+				return nil, err
+			}
+			applied = append(applied, nested...)
+			continue
 		}
-		allHistory = append(allHistory, AllUsersPresenceDay{
-			Date:  date,
-			Users: users,
-		})
-	}
-
-	sort.Slice(allHistory, func(i, j int) bool {
-		return allHistory[i].Date < allHistory[j].Date
-	})
 
-	response := PresenceHistoryResponse{
-		AllHistory: allHistory,
-	}
+		// [profiles.{名前}] などの名前付きの項目は ELPIS_PROFILES_{名前}_{キー} で上書きできます。名前は大文字にし、英数字以外を _ に置き換えます
+		// （/api/signals/submit のルートの上限は ELPIS_ROUTE_LIMITS_API_SIGNALS_SUBMIT_MAX_BODY_MB）。設定にない名前は小文字の名前で追加します
+		if field.Type.Kind() == reflect.Map && field.Type.Elem().Kind() == reflect.Struct {
+			keys := make(map[string]reflect.Value)
+			iter := v.Field(i).MapRange()
+			for iter.Next() {
+				keys[configEnvName(iter.Key().String())] = iter.Key()
+			}
+			for _, envKey := range configEnvMapKeys(name, field.Type.Elem()) {
+				if _, ok := keys[envKey]; !ok {
+					keys[envKey] = reflect.ValueOf(strings.ToLower(envKey)).Convert(field.Type.Key())
+				}
+			}
+			if len(keys) > 0 && v.Field(i).IsNil() {
+				v.Field(i).Set(reflect.MakeMap(field.Type))
+			}
+			envKeys := make([]string, 0, len(keys))
+			for envKey := range keys {
+				envKeys = append(envKeys, envKey)
+			}
+			sort.Strings(envKeys)
+			for _, envKey := range envKeys {
+				mapKey := keys[envKey]
+				entry := reflect.New(field.Type.Elem()).Elem()
+				if existing := v.Field(i).MapIndex(mapKey); existing.IsValid() {
+					entry.Set(existing)
+				}
+				nested, err := applyEnvOverridesTo(entry, name+"_"+envKey)
+				if err != nil {
+					return nil, err
+				}
+				v.Field(i).SetMapIndex(mapKey, entry)
+				applied = append(applied, nested...)
+			}
+			continue
+		}
 
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(response); err != nil {
-		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
-		http.Error(w, "JSON応答のエンコードに失敗しました", http.StatusInternalServerError)
+		raw, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := setConfigValue(v.Field(i), raw); err != nil {
+			return nil, fmt.Errorf("環境変数 %s の値が無効です: %v", name, err)
+		}
+		applied = append(applied, name)
 	}
+	return applied, nil
 }
 
-func fetchAllSessions(ctx context.Context, db *sql.DB, since time.Time) ([]PresenceSession, error) {
-	rows, err := db.QueryContext(ctx, `
-        SELECT session_id, user_id, room_id, start_time, end_time, last_seen
-        FROM user_presence_sessions
-        WHERE start_time >= $1
-        ORDER BY start_time
-    `, since)
-	if err != nil {
-		logError(ctx, "セッションのクエリに失敗しました: %v", err)
-		return nil, err
+// configEnvName は名前付きの項目の名前を環境変数名に使える形（英大文字・数字・_）に変換します
+func configEnvName(key string) string {
+	var b strings.Builder
+	for _, r := range strings.ToUpper(key) {
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+		} else if b.Len() > 0 && !strings.HasSuffix(b.String(), "_") {
+			b.WriteByte('_')
+		}
 	}
-	defer rows.Close()
+	return strings.TrimSuffix(b.String(), "_")
+}
 
-	var sessions []PresenceSession
-	for rows.Next() {
-		var session PresenceSession
-		var endTime sql.NullTime
-		if err := rows.Scan(&session.SessionID, &session.UserID, &session.RoomID, &session.StartTime, &endTime, &session.LastSeen); err != nil {
+// configEnvMapKeys は {prefix}_{名前}_{キー} の形で設定されている環境変数から名前の部分を返します
+func configEnvMapKeys(prefix string, t reflect.Type) []string {
+	suffixes := configEnvSuffixes(t)
+	seen := make(map[string]bool)
+	var keys []string
+	for _, env := range os.Environ() {
+		name, _, _ := strings.Cut(env, "=")
+		rest, ok := strings.CutPrefix(name, prefix+"_")
+		if !ok {
 			continue
 		}
-		if endTime.Valid {
-			session.EndTime = &endTime.Time
-		} else {
-			session.EndTime = nil
+		// 名前とキーの境目が曖昧な場合は、長いキーとして解釈します
+		key := ""
+		matched := 0
+		for _, suffix := range suffixes {
+			if len(suffix) > matched && strings.HasSuffix(rest, "_"+suffix) && len(rest) > len(suffix)+1 {
+				key = rest[:len(rest)-len(suffix)-1]
+				matched = len(suffix)
+			}
+		}
+		if key != "" && !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
 		}
-		sessions = append(sessions, session)
 	}
+	return keys
+}
 
-	if err := rows.Err(); err != nil {
-		logError(ctx, "セッションの読み取り中にエラーが発生しました: %v", err)
-		return nil, err
+// configEnvSuffixes は構造体の各項目の環境変数名のうち、名前より後ろの部分を返します
+func configEnvSuffixes(t reflect.Type) []string {
+	var suffixes []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		key := field.Tag.Get("toml")
+		if key == "" {
+			key = configKeyFromFieldName(field.Name)
+		}
+		name := strings.ToUpper(key)
+		switch field.Type.Kind() {
+		case reflect.Struct:
+			for _, nested := range configEnvSuffixes(field.Type) {
+				suffixes = append(suffixes, name+"_"+nested)
+			}
+		case reflect.Map:
+		default:
+			suffixes = append(suffixes, name)
+		}
 	}
-
-	return sessions, nil
+	return suffixes
 }
 
-func fetchUserSessions(ctx context.Context, db *sql.DB, userID int, since time.Time) ([]PresenceSession, error) {
-	rows, err := db.QueryContext(ctx, `
-        SELECT session_id, user_id, room_id, start_time, end_time, last_seen
-        FROM user_presence_sessions
-        WHERE user_id = $1 AND start_time >= $2
-        ORDER BY start_time
-    `, userID, since)
-	if err != nil {
-		logError(ctx, "ユーザーセッションのクエリに失敗しました: %v", err)
-		return nil, err
+// configKeyFromFieldName はタグのないフィールド名（NegativeSamples など）をスネークケース（negative_samples）に変換します
+func configKeyFromFieldName(name string) string {
+	var b strings.Builder
+	for i, r := range name {
+		if i > 0 && unicode.IsUpper(r) && unicode.IsLower(rune(name[i-1])) {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToLower(r))
 	}
-	defer rows.Close()
+	return b.String()
+}
 
-	var sessions []PresenceSession
-	for rows.Next() {
-		var session PresenceSession
-		var endTime sql.NullTime
-		if err := rows.Scan(&session.SessionID, &session.UserID, &session.RoomID, &session.StartTime, &endTime, &session.LastSeen); err != nil {
-			continue
+func setConfigValue(v reflect.Value, raw string) error {
+	// 未設定と区別するためのポインタの項目は値を確保してから設定します
+	if v.Kind() == reflect.Pointer {
+		value := reflect.New(v.Type().Elem())
+		if err := setConfigValue(value.Elem(), raw); err != nil {
+			return err
 		}
-		if endTime.Valid {
-			session.EndTime = &endTime.Time
-		} else {
-			session.EndTime = nil
+		v.Set(value)
+		return nil
+	}
+	if v.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
 		}
-		sessions = append(sessions, session)
+		v.SetInt(int64(d))
+		return nil
 	}
 
-	if err := rows.Err(); err != nil {
-		logError(ctx, "ユーザーセッションの読み取り中にエラーが発生しました: %v", err)
-		return nil, err
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("対応していない型です: %s", v.Type())
+		}
+		// 配列はカンマ区切りで指定します
+		var values []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				values = append(values, item)
+			}
+		}
+		v.Set(reflect.ValueOf(values).Convert(v.Type()))
+	default:
+		return fmt.Errorf("対応していない型です: %s", v.Type())
 	}
-
-	return sessions, nil
+	return nil
 }
 
-func handleUserPresenceHistory(w http.ResponseWriter, r *http.Request, ctx context.Context, db *sql.DB, userID int, loc *time.Location) {
-	dateStr := r.URL.Query().Get("date")
-	var since time.Time
-	var err error
+// registrar はプロキシにこのサーバーを登録します
+type registrar struct {
+	proxyURL  string
+	request   RegisterRequest
+	authToken string
+	client    *http.Client
+}
 
-	if dateStr != "" {
-		since, err = time.Parse("2006-01-02", dateStr)
-		if err != nil {
-			logError(ctx, "日付パラメータが無効です: %v", err)
-			http.Error(w, "日付パラメータが無効です。形式はYYYY-MM-DDである必要があります。", http.StatusBadRequest)
-			return
-		}
-		since = time.Date(since.Year(), since.Month(), since.Day(), 0, 0, 0, 0, loc)
-	} else {
-		since = time.Now().In(loc).AddDate(0, -1, 0)
-	}
+func newRegistrar(proxyURL string, request RegisterRequest, authToken string) *registrar {
+	return &registrar{proxyURL: proxyURL, request: request, authToken: authToken, client: tracedClient(10 * time.Second)}
+}
 
-	sessions, err := fetchUserSessions(ctx, db, userID, since)
-	if err != nil {
-		logError(ctx, "ユーザープレゼンス履歴の取得に失敗しました: %v", err)
-		http.Error(w, "ユーザープレゼンス履歴の取得に失敗しました", http.StatusInternalServerError)
-		return
-	}
+// register は登録リクエストを1回送信します
+func (r *registrar) register(ctx context.Context) error {
+	return r.send(ctx, http.MethodPost)
+}
 
-	historyMap := make(map[string][]PresenceSession)
-	for _, session := range sessions {
-		date := session.StartTime.In(loc).Format("2006-01-02")
-		historyMap[date] = append(historyMap[date], session)
-	}
+// deregister はプロキシから登録を削除し、このサーバーへの転送を止めます
+func (r *registrar) deregister(ctx context.Context) error {
+	return r.send(ctx, http.MethodDelete)
+}
 
-	var userHistory []UserPresenceDay
-	for date, sessions := range historyMap {
-		userHistory = append(userHistory, UserPresenceDay{
-			Date:     date,
-			Sessions: sessions,
-		})
+// heartbeat はプロキシに登録が残っていることを確認し、最終更新時刻を延長します。
+// PUT に対応していない古いプロキシには登録を送り直します
+func (r *registrar) heartbeat(ctx context.Context) error {
+	err := r.send(ctx, http.MethodPut)
+	var statusErr *upstreamStatusError
+	if errors.As(err, &statusErr) && statusErr.status == http.StatusMethodNotAllowed {
+		return r.register(ctx)
 	}
+	return err
+}
 
-	sort.Slice(userHistory, func(i, j int) bool {
-		return userHistory[i].Date < userHistory[j].Date
-	})
+// upstreamStatusError は登録先のプロキシや Consul が 200 以外を返したことを表します
+type upstreamStatusError struct {
+	method  string
+	url     string
+	status  int
+	message string
+}
 
-	response := UserPresenceResponse{
-		UserID:  userID,
-		History: userHistory,
+func (e *upstreamStatusError) Error() string {
+	if e.message != "" {
+		return fmt.Sprintf("%s %s が %d を返しました: %s", e.method, e.url, e.status, e.message)
 	}
+	return fmt.Sprintf("%s %s が %d を返しました", e.method, e.url, e.status)
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(response); err != nil {
-		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
-		http.Error(w, "JSON応答のエンコードに失敗しました", http.StatusInternalServerError)
+// registrationLost はハートビートのエラーがプロキシから登録が失われたことを示すかを返します。
+// プロキシが登録を知らない（404・410）か、再起動などで接続を拒否した場合が該当します
+func registrationLost(err error) bool {
+	var statusErr *upstreamStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.status == http.StatusNotFound || statusErr.status == http.StatusGone
 	}
+	return errors.Is(err, syscall.ECONNREFUSED)
 }
 
-func handleCurrentOccupants(w http.ResponseWriter, r *http.Request, ctx context.Context, db *sql.DB) {
-	query := `
-        SELECT 
-            rooms.room_id, 
-            rooms.room_name, 
-            users.user_id, 
-            user_presence_sessions.last_seen
-        FROM 
-            rooms
-        LEFT JOIN 
-            user_presence_sessions ON rooms.room_id = user_presence_sessions.room_id AND user_presence_sessions.end_time IS NULL
-        LEFT JOIN 
-            users ON user_presence_sessions.user_id = users.id
-        ORDER BY 
-            rooms.room_id, users.user_id
-    `
-
-	rows, err := db.QueryContext(ctx, query)
+func (r *registrar) send(ctx context.Context, method string) error {
+	body, err := json.Marshal(r.request)
 	if err != nil {
-		logError(ctx, "現在の占有者の取得に失敗しました: %v", err)
-		http.Error(w, "現在の占有者の取得に失敗しました", http.StatusInternalServerError)
-		return
+		return fmt.Errorf("登録リクエストのエンコードに失敗しました: %v", err)
 	}
-	defer rows.Close()
 
-	roomsMap := make(map[int]RoomOccupants)
+	req, err := http.NewRequestWithContext(ctx, method, r.proxyURL, bytes.NewBuffer(body))
+	if err != nil {
+		return fmt.Errorf("登録リクエストの作成に失敗しました: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if r.authToken != "" {
+		req.Header.Set("Authorization", "Bearer "+r.authToken)
+	}
+	setRequestIDHeader(ctx, req)
 
-	for rows.Next() {
-		var roomID int
-		var roomName string
-		var userID sql.NullString
-		var lastSeen sql.NullTime
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("登録エラー: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &upstreamStatusError{method: method, url: r.proxyURL, status: resp.StatusCode}
+	}
+	return nil
+}
 
-		if err := rows.Scan(&roomID, &roomName, &userID, &lastSeen); err != nil {
-			continue
+// run は登録が完了するまで再試行し、その後は heartbeat_interval ごとにプロキシに登録が残っているかを確認します。
+// プロキシの再起動などで登録が失われた場合は登録からやり直します。ctx が終了すると戻ります
+func (r *registrar) run(ctx context.Context, config RegistrationConfig) {
+	for {
+		if !r.registerWithRetry(ctx, config) || config.HeartbeatInterval <= 0 {
+			return
 		}
-
-		if _, exists := roomsMap[roomID]; !exists {
-			roomsMap[roomID] = RoomOccupants{
-				RoomID:    roomID,
-				RoomName:  roomName,
-				Occupants: []CurrentOccupant{},
-			}
+		if !r.watch(ctx, config.HeartbeatInterval) {
+			return
 		}
+		atomic.AddUint64(&registrationRestarts, 1)
+	}
+}
 
-		if userID.Valid {
-			occupant := CurrentOccupant{
-				UserID:   userID.String,
-				LastSeen: lastSeen.Time,
-			}
-			room := roomsMap[roomID]
-			room.Occupants = append(room.Occupants, occupant)
-			roomsMap[roomID] = room
+// registerWithRetry は登録が完了するか max_attempts 回失敗するまで再試行します。ctx が終了した場合は false を返します
+func (r *registrar) registerWithRetry(ctx context.Context, config RegistrationConfig) bool {
+	setRegistrationState(r.proxyURL, registrationPending)
+	for attempt := 1; ; attempt++ {
+		atomic.AddUint64(&registrationAttempts, 1)
+		err := r.register(ctx)
+		if err == nil {
+			setRegistrationState(r.proxyURL, registrationRegistered)
+			logInfo(ctx, "サーバーの登録が完了しました: %s", r.proxyURL)
+			return true
+		}
+		if ctx.Err() != nil {
+			return false
+		}
+		logError(ctx, "%v", err)
+		if config.MaxAttempts > 0 && attempt >= config.MaxAttempts {
+			setRegistrationState(r.proxyURL, registrationFailed)
+			logError(ctx, "プロキシ %s への登録を %d 回試行しましたが成功しませんでした", r.proxyURL, attempt)
+			return true
+		}
+		wait := registrationBackoff(attempt, config.RetryInitial, config.RetryMaxWait)
+		logInfo(ctx, "%s 後に %s への登録を再試行します（%d 回目の失敗）", wait.Round(time.Millisecond), r.proxyURL, attempt)
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(wait):
 		}
 	}
+}
 
-	if err := rows.Err(); err != nil {
-		logError(ctx, "現在の占有者の読み取り中にエラーが発生しました: %v", err)
-		http.Error(w, "現在の占有者の読み取り中にエラーが発生しました", http.StatusInternalServerError)
-		return
+// watch は heartbeat ごとにハートビートを送ります。登録が失われた場合は true、ctx が終了した場合は false を返します
+func (r *registrar) watch(ctx context.Context, heartbeat time.Duration) bool {
+	ticker := time.NewTicker(heartbeat)
+	defer ticker.Stop()
+
+	failures := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+		if err := r.heartbeat(ctx); err != nil {
+			if ctx.Err() != nil {
+				return false
+			}
+			atomic.AddUint64(&registrationHeartbeatFailures, 1)
+			if registrationLost(err) {
+				logger.Warn("プロキシから登録が失われたため、登録をやり直します", append(logAttrs(ctx), "proxy", r.proxyURL, "error", err)...)
+				return true
+			}
+			failures++
+			logger.Warn("プロキシへのハートビートに失敗しました", append(logAttrs(ctx), "proxy", r.proxyURL, "error", err, "consecutive_failures", failures)...)
+			continue
+		}
+		if failures > 0 {
+			logInfo(ctx, "プロキシ %s へのハートビートが %d 回の失敗の後に復旧しました", r.proxyURL, failures)
+			failures = 0
+		}
+		if state, _ := registrationStates.Load(r.proxyURL); state != registrationRegistered {
+			setRegistrationState(r.proxyURL, registrationRegistered)
+			logInfo(ctx, "サーバーの登録が完了しました: %s", r.proxyURL)
+		}
+		atomic.AddUint64(&registrationHeartbeats, 1)
+		atomic.StoreInt64(&registrationLastHeartbeat, time.Now().Unix())
 	}
+}
 
-	response := CurrentOccupantsResponse{
-		Rooms: []RoomOccupants{},
+// registrationBackoff は attempt 回目の失敗後に待つ時間を返します。initial から倍にしながら maxWait で頭打ちにし、
+// 複数のマネージャーが同時に再試行しないよう後半の半分をランダムにずらします
+func registrationBackoff(attempt int, initial time.Duration, maxWait time.Duration) time.Duration {
+	wait := initial
+	for i := 1; i < attempt && wait < maxWait; i++ {
+		wait *= 2
 	}
-	for _, room := range roomsMap {
-		response.Rooms = append(response.Rooms, room)
+	if wait > maxWait {
+		wait = maxWait
 	}
+	half := wait / 2
+	return half + time.Duration(rand.Int63n(int64(wait-half)+1))
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(response); err != nil {
-		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
-		http.Error(w, "JSON応答のエンコードに失敗しました", http.StatusInternalServerError)
-	}
+const (
+	mdnsAddress = "224.0.0.251:5353"
+	mdnsTTL     = 120
+	// mdnsClassBit はクラスの最上位ビットです。応答では cache-flush、質問では送信元への直接応答（QU）を表します
+	mdnsClassBit = 1 << 15
+)
+
+// mdnsAnnouncer は {instance}.{service}.local としてこのサーバーを告知し、問い合わせに応答します
+type mdnsAnnouncer struct {
+	conn     *net.UDPConn
+	group    *net.UDPAddr
+	service  dnsmessage.Name
+	instance dnsmessage.Name
+	host     dnsmessage.Name
+	port     uint16
+	txt      []string
+	ips      [][4]byte
 }
 
-func handleHealthCheck(w http.ResponseWriter, r *http.Request, ctx context.Context, db *sql.DB, loc *time.Location) {
-	response := HealthCheckResponse{
-		Status:    "ok",
-		Timestamp: time.Now().In(loc).Format(time.RFC3339),
+func newMDNSAnnouncer(config MDNSConfig, port int) (*mdnsAnnouncer, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("ホスト名の取得に失敗しました: %v", err)
+	}
+	hostname = strings.SplitN(hostname, ".", 2)[0]
+	if config.Instance == "" {
+		config.Instance = hostname
 	}
 
-	if err := db.PingContext(ctx); err != nil {
-		response.Status = "error"
-		response.Database = "Unavailable"
-	} else {
-		response.Database = "Available"
+	ips, err := mdnsAddrs()
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("告知できるIPv4アドレスがありません")
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	if response.Status == "ok" {
-		w.WriteHeader(http.StatusOK)
-	} else {
-		w.WriteHeader(http.StatusServiceUnavailable)
+	service, err := dnsmessage.NewName(config.Service + ".local.")
+	if err != nil {
+		return nil, fmt.Errorf("サービス名が無効です: %v", err)
 	}
-	if err := json.NewEncoder(w).Encode(response); err != nil {
-		logError(ctx, "HealthCheck JSON応答のエンコードに失敗しました: %v", err)
+	instance, err := dnsmessage.NewName(config.Instance + "." + config.Service + ".local.")
+	if err != nil {
+		return nil, fmt.Errorf("インスタンス名が無効です: %v", err)
+	}
+	host, err := dnsmessage.NewName(hostname + ".local.")
+	if err != nil {
+		return nil, fmt.Errorf("ホスト名が無効です: %v", err)
 	}
-}
 
-func cleanUpOldSessions(ctx context.Context, db *sql.DB, inactivityThreshold time.Duration, loc *time.Location) {
-	ticker := time.NewTicker(1 * time.Minute)
-	defer ticker.Stop()
+	group, err := net.ResolveUDPAddr("udp4", mdnsAddress)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		return nil, fmt.Errorf("mDNS の待ち受けに失敗しました: %v", err)
+	}
 
-	for {
-		<-ticker.C
-		cutoffTime := time.Now().In(loc).Add(-inactivityThreshold)
+	return &mdnsAnnouncer{
+		conn:     conn,
+		group:    group,
+		service:  service,
+		instance: instance,
+		host:     host,
+		port:     uint16(port),
+		txt:      []string{"path=" + config.Path},
+		ips:      ips,
+	}, nil
+}
 
-		rows, err := db.QueryContext(ctx, `
-            SELECT user_id, last_seen
-            FROM user_presence_sessions
-            WHERE end_time IS NULL AND last_seen < $1
-        `, cutoffTime)
+// mdnsAddrs は起動しているインターフェースのIPv4アドレスを返します（ループバックを除く）
+func mdnsAddrs() ([][4]byte, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("ネットワークインターフェースの取得に失敗しました: %v", err)
+	}
+	var ips [][4]byte
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
 		if err != nil {
-			logError(ctx, "古いセッションのクエリに失敗しました: %v", err)
 			continue
 		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			if ip4 := ipNet.IP.To4(); ip4 != nil {
+				ips = append(ips, [4]byte(ip4))
+			}
+		}
+	}
+	return ips, nil
+}
 
-		var userID int
-		var lastSeen time.Time
-		var usersToEnd []int
+// run は起動を告知した後、ctx が終了するまで問い合わせに応答します
+func (m *mdnsAnnouncer) run(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+		m.conn.Close()
+	}()
 
-		for rows.Next() {
-			if err := rows.Scan(&userID, &lastSeen); err != nil {
-				continue
+	// 起動直後の告知は取りこぼされることがあるため、1秒空けて2回送ります
+	go func() {
+		for i := 0; i < 2; i++ {
+			if err := m.send(mdnsTTL, m.group); err != nil {
+				logError(ctx, "mDNS の告知に失敗しました: %v", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second):
 			}
-			usersToEnd = append(usersToEnd, userID)
 		}
-		rows.Close()
+	}()
 
-		for _, uid := range usersToEnd {
-			endTime := time.Now().In(loc)
-			err := endUserSession(ctx, db, uid, endTime)
-			if err == nil {
-				logInfo(ctx, "ユーザーID %d のセッションを終了しました", uid)
-			} else {
-				logError(ctx, "ユーザーID %d のセッション終了に失敗しました: %v", uid, err)
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := m.conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() == nil {
+				logError(ctx, "mDNS の受信に失敗しました: %v", err)
 			}
+			return
+		}
+		answer, unicast := m.matches(buf[:n])
+		if !answer {
+			continue
+		}
+		// QU ビットが立っているか 5353 以外のポートから問い合わせた場合は送信元に直接応答します
+		to := m.group
+		if unicast || from.Port != m.group.Port {
+			to = from
+		}
+		if err := m.send(mdnsTTL, to); err != nil {
+			logError(ctx, "mDNS の応答に失敗しました: %v", err)
 		}
 	}
 }
 
-func loggingMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+// goodbye は TTL 0 の応答を送り、端末のキャッシュからこのサーバーを削除させます
+func (m *mdnsAnnouncer) goodbye() error {
+	return m.send(0, m.group)
+}
+
+// matches は問い合わせにこのサーバーが答えるべき質問が含まれるかと、送信元への直接応答を求めているかを返します
+func (m *mdnsAnnouncer) matches(msg []byte) (bool, bool) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(msg)
+	if err != nil || header.Response {
+		return false, false
+	}
+	questions, err := parser.AllQuestions()
+	if err != nil {
+		return false, false
+	}
+	answer, unicast := false, false
+	for _, q := range questions {
+		name := q.Name.String()
+		if strings.EqualFold(name, m.service.String()) || strings.EqualFold(name, m.instance.String()) || strings.EqualFold(name, m.host.String()) || strings.EqualFold(name, "_services._dns-sd._udp.local.") {
+			answer = true
+			unicast = unicast || q.Class&mdnsClassBit != 0
+		}
+	}
+	return answer, unicast
+}
+
+func (m *mdnsAnnouncer) send(ttl uint32, to *net.UDPAddr) error {
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{Response: true, Authoritative: true})
+	builder.EnableCompression()
+	if err := builder.StartAnswers(); err != nil {
+		return err
+	}
+	shared := dnsmessage.ResourceHeader{Name: m.service, Class: dnsmessage.ClassINET, TTL: ttl}
+	if err := builder.PTRResource(shared, dnsmessage.PTRResource{PTR: m.instance}); err != nil {
+		return err
+	}
+	unique := dnsmessage.ResourceHeader{Name: m.instance, Class: dnsmessage.ClassINET | mdnsClassBit, TTL: ttl}
+	if err := builder.SRVResource(unique, dnsmessage.SRVResource{Port: m.port, Target: m.host}); err != nil {
+		return err
+	}
+	if err := builder.TXTResource(unique, dnsmessage.TXTResource{TXT: m.txt}); err != nil {
+		return err
+	}
+	for _, ip := range m.ips {
+		header := dnsmessage.ResourceHeader{Name: m.host, Class: dnsmessage.ClassINET | mdnsClassBit, TTL: ttl}
+		if err := builder.AResource(header, dnsmessage.AResource{A: ip}); err != nil {
+			return err
+		}
+	}
+	msg, err := builder.Finish()
+	if err != nil {
+		return err
+	}
+	_, err = m.conn.WriteToUDP(msg, to)
+	return err
+}
 
-		id := atomic.AddUint64(&requestID, 1)
+// consulRegistrar は Consul エージェントにこのサーバーを TTL チェック付きのサービスとして登録します
+type consulRegistrar struct {
+	address string
+	token   string
+	service consulService
+	client  *http.Client
+}
 
-		unixTime := time.Now().Unix()
+type consulService struct {
+	ID      string            `json:"ID"`
+	Name    string            `json:"Name"`
+	Tags    []string          `json:"Tags,omitempty"`
+	Address string            `json:"Address,omitempty"`
+	Port    int               `json:"Port"`
+	Meta    map[string]string `json:"Meta,omitempty"`
+	Check   consulCheck       `json:"Check"`
+}
 
-		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+type consulCheck struct {
+	CheckID                        string `json:"CheckID"`
+	TTL                            string `json:"TTL"`
+	DeregisterCriticalServiceAfter string `json:"DeregisterCriticalServiceAfter,omitempty"`
+}
+
+func newConsulRegistrar(config ConsulConfig, port int) (*consulRegistrar, error) {
+	address := config.Address
+	if address == "" {
+		address = os.Getenv("CONSUL_HTTP_ADDR")
+	}
+	if address == "" {
+		return nil, fmt.Errorf("Consulのアドレスが設定されていません（[Consul] address または CONSUL_HTTP_ADDR を設定してください）")
+	}
+	if !strings.Contains(address, "://") {
+		address = "http://" + address
+	}
+	token := config.Token
+	if token == "" {
+		token = os.Getenv("CONSUL_HTTP_TOKEN")
+	}
+
+	id := config.ServiceID
+	if id == "" {
+		hostname, err := os.Hostname()
 		if err != nil {
-			ip = r.RemoteAddr
+			return nil, fmt.Errorf("ホスト名の取得に失敗しました: %v", err)
 		}
+		id = fmt.Sprintf("%s-%s-%d", config.ServiceName, hostname, port)
+	}
 
-		userAgent := r.Header.Get("User-Agent")
+	check := consulCheck{CheckID: "service:" + id, TTL: config.TTL.String()}
+	if config.DeregisterCriticalAfter > 0 {
+		check.DeregisterCriticalServiceAfter = config.DeregisterCriticalAfter.String()
+	}
+	return &consulRegistrar{
+		address: strings.TrimRight(address, "/"),
+		token:   token,
+		service: consulService{
+			ID:      id,
+			Name:    config.ServiceName,
+			Tags:    config.Tags,
+			Address: config.ServiceAddress,
+			Port:    port,
+			Meta:    map[string]string{"health": "/api/health"},
+			Check:   check,
+		},
+		client: tracedClient(10 * time.Second),
+	}, nil
+}
 
-		excludedPaths := map[string]bool{
-			"/api/signals/server":      true,
-			"/api/signals/submit":      true,
-			"/api/fingerprint/collect": true,
-		}
+// register はサービスを登録します。同じIDで登録し直した場合は上書きされます
+func (c *consulRegistrar) register(ctx context.Context) error {
+	body, err := json.Marshal(c.service)
+	if err != nil {
+		return fmt.Errorf("Consulへの登録リクエストのエンコードに失敗しました: %v", err)
+	}
+	return c.put(ctx, "/v1/agent/service/register", body)
+}
 
-		excludeBody := excludedPaths[r.URL.Path]
+// pass は TTL チェックを passing に更新します
+func (c *consulRegistrar) pass(ctx context.Context) error {
+	return c.put(ctx, "/v1/agent/check/pass/"+url.PathEscape(c.service.Check.CheckID), nil)
+}
 
-		var requestBody string
+// deregister はサービスをカタログから削除します
+func (c *consulRegistrar) deregister(ctx context.Context) error {
+	return c.put(ctx, "/v1/agent/service/deregister/"+url.PathEscape(c.service.ID), nil)
+}
 
-		if r.Body != nil && !excludeBody {
-			const maxBodySize = 10 * 1024 * 1024
-			body, err := io.ReadAll(io.LimitReader(r.Body, maxBodySize))
-			if err != nil {
-				logger.Error("リクエストボディの読み取りに失敗しました", "request_id", id, "error", err)
-			} else {
-				requestBody = string(body)
-				r.Body = io.NopCloser(bytes.NewBuffer(body))
+func (c *consulRegistrar) put(ctx context.Context, path string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, c.address+path, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("Consulへのリクエストの作成に失敗しました: %v", err)
+	}
+	if c.token != "" {
+		req.Header.Set("X-Consul-Token", c.token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Consulへのリクエストに失敗しました: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return &upstreamStatusError{method: http.MethodPut, url: c.address + path, status: resp.StatusCode, message: strings.TrimSpace(string(message))}
+	}
+	return nil
+}
+
+// run は登録が完了するまで再試行し、その後は TTL の半分ごとにチェックを更新します。
+// エージェントの再起動などでサービスが失われた場合（404）は登録し直します。ctx が終了すると戻ります
+func (c *consulRegistrar) run(ctx context.Context, ttl time.Duration) {
+	key := c.address + "#" + c.service.ID
+	for {
+		setRegistrationState(key, registrationPending)
+		for attempt := 1; ; attempt++ {
+			err := c.register(ctx)
+			if err == nil {
+				break
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			wait := registrationBackoff(attempt, time.Second, time.Minute)
+			logError(ctx, "Consulへの登録に失敗しました。%s 後に再試行します: %v", wait.Round(time.Millisecond), err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(wait):
 			}
 		}
+		setRegistrationState(key, registrationRegistered)
+		logInfo(ctx, "Consulにサービス %s（ID: %s）を登録しました", c.service.Name, c.service.ID)
 
-		capture := &ResponseCapture{
-			ResponseWriter: w,
-			StatusCode:     http.StatusOK,
+		if !c.watch(ctx, ttl/2) {
+			return
 		}
+		atomic.AddUint64(&registrationRestarts, 1)
+	}
+}
 
-		ctx := context.WithValue(r.Context(), requestIDKey, id)
-
-		logRequest(ctx, "IP: %s | User-Agent: %s | 時間: %d | メソッド: %s | URI: %s", ip, userAgent, unixTime, r.Method, r.RequestURI)
+// watch は interval ごとに TTL チェックを更新します。サービスが失われた場合は true、ctx が終了した場合は false を返します
+func (c *consulRegistrar) watch(ctx context.Context, interval time.Duration) bool {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 
-		if !excludeBody && requestBody != "" {
-			logRequest(ctx, "内容: %s", sanitizeString(requestBody))
+	for {
+		if err := c.pass(ctx); err != nil {
+			if ctx.Err() != nil {
+				return false
+			}
+			if registrationLost(err) {
+				logger.Warn("Consulからサービスが失われたため、登録し直します", append(logAttrs(ctx), "service_id", c.service.ID, "error", err)...)
+				return true
+			}
+			logger.Warn("ConsulのTTLチェックの更新に失敗しました", append(logAttrs(ctx), "service_id", c.service.ID, "error", err)...)
 		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+}
 
-		next.ServeHTTP(capture, r.WithContext(ctx))
+// shutdownTimeout は終了時に処理中のリクエストの完了を待つ時間です
+const shutdownTimeout = 15 * time.Second
 
-		responseBody := capture.Body.String()
-		responseLog := fmt.Sprintf("ステータスコード: %d", capture.StatusCode)
+// recordedUpload は loadgen で再送する、同じ時刻に保存されたBLE・WiFi CSVの組です
+type recordedUpload struct {
+	name        string
+	body        []byte
+	contentType string
+}
 
-		if responseBody != "" {
-			responseLog += fmt.Sprintf(" | 応答ボディ: %s", sanitizeString(responseBody))
-		}
+// recordedUploadPattern は保存済みアップロードのファイル名です（例: ble_data_1731587734.csv、wifi_data_1731587734_12.csv）
+var recordedUploadPattern = regexp.MustCompile(`^(ble|wifi)_data_(.+)\.csv$`)
 
-		logRequest(ctx, responseLog)
+// loadRecordedUploads は dir 以下（uploads/{日付}/{ユーザー名}/ など）から同じディレクトリ・同じ時刻のBLE・WiFi CSVの組を読み込み、
+// 送信用のマルチパートボディを組み立てます。片方しかないファイルは無視します
+func loadRecordedUploads(dir string) ([]recordedUpload, error) {
+	pairs := make(map[string][2]string)
+	err := filepath.WalkDir(dir, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		match := recordedUploadPattern.FindStringSubmatch(d.Name())
+		if match == nil {
+			return nil
+		}
+		key := filepath.Join(filepath.Dir(filePath), match[2])
+		pair := pairs[key]
+		if match[1] == "ble" {
+			pair[0] = filePath
+		} else {
+			pair[1] = filePath
+		}
+		pairs[key] = pair
+		return nil
 	})
-}
+	if err != nil {
+		return nil, fmt.Errorf("アップロードの読み込みに失敗しました: %v", err)
+	}
 
-func sanitizeString(s string) string {
-	const maxLength = 1000
-	if len(s) > maxLength {
-		return s[:maxLength] + "...(省略)"
+	keys := make([]string, 0, len(pairs))
+	for key := range pairs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	uploads := make([]recordedUpload, 0, len(keys))
+	for _, key := range keys {
+		pair := pairs[key]
+		if pair[0] == "" || pair[1] == "" {
+			continue
+		}
+		var body bytes.Buffer
+		writer := multipart.NewWriter(&body)
+		for i, field := range []string{"ble_data", "wifi_data"} {
+			data, err := os.ReadFile(pair[i])
+			if err != nil {
+				return nil, fmt.Errorf("アップロードの読み込みに失敗しました: %v", err)
+			}
+			part, err := writer.CreateFormFile(field, filepath.Base(pair[i]))
+			if err != nil {
+				return nil, fmt.Errorf("リクエストボディの作成に失敗しました: %v", err)
+			}
+			part.Write(data)
+		}
+		writer.Close()
+		uploads = append(uploads, recordedUpload{name: key, body: body.Bytes(), contentType: writer.FormDataContentType()})
 	}
+	return uploads, nil
+}
 
-	s = strings.ReplaceAll(s, "\n", " ")
-	s = strings.ReplaceAll(s, "\r", " ")
-	s = strings.Join(strings.Fields(s), " ")
-	return s
+// LoadgenReport は loadgen の結果です。レイテンシはミリ秒です
+type LoadgenReport struct {
+	URL         string         `json:"url"`
+	Concurrency int            `json:"concurrency"`
+	Uploads     int            `json:"uploads"`
+	Requests    int            `json:"requests"`
+	Errors      int            `json:"errors"`
+	Statuses    map[string]int `json:"statuses"`
+	Elapsed     float64        `json:"elapsed_seconds"`
+	Throughput  float64        `json:"requests_per_second"`
+	LatencyP50  float64        `json:"latency_p50_ms"`
+	LatencyP90  float64        `json:"latency_p90_ms"`
+	LatencyP99  float64        `json:"latency_p99_ms"`
+	LatencyMax  float64        `json:"latency_max_ms"`
 }
 
-func handleFingerprintCollect(w http.ResponseWriter, r *http.Request, ctx context.Context, loc *time.Location) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "許可されていないメソッドです。POSTを使用してください。", http.StatusMethodNotAllowed)
-		return
+// runLoadgen は保存済みのアップロードを concurrency 件ずつ同時に送信し、スループットとレイテンシを表示します。
+// 終了コードはエラー・5xx の応答がなければ 0 です
+func runLoadgen(args []string) int {
+	fs := flag.NewFlagSet("loadgen", flag.ExitOnError)
+	target := fs.String("url", "http://localhost:8010/api/signals/submit", "送信先のURL（/api/signals/submit または /api/signals/server）")
+	dir := fs.String("dir", "uploads", "再送するアップロードのディレクトリ（{ble,wifi}_data_{時刻}.csv の組を再帰的に探します）")
+	username := fs.String("user", "", "Basic認証のユーザー名")
+	password := fs.String("password", "", "Basic認証のパスワード")
+	concurrency := fs.Int("concurrency", 8, "同時に送信するリクエスト数")
+	requests := fs.Int("requests", 0, "送信するリクエスト数（0 の場合はアップロードを1回ずつ送信します）")
+	duration := fs.Duration("duration", 0, "指定した場合は requests の代わりにこの時間だけ送信を続けます")
+	timeout := fs.Duration("timeout", 60*time.Second, "1リクエストのタイムアウト")
+	asJSON := fs.Bool("json", false, "結果をJSONで出力します")
+	fs.Parse(args)
+
+	uploads, err := loadRecordedUploads(*dir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if len(uploads) == 0 {
+		fmt.Fprintf(os.Stderr, "%s にBLE・WiFi CSVの組が見つかりません\n", *dir)
+		return 1
+	}
+	if *concurrency < 1 {
+		*concurrency = 1
+	}
+	total := *requests
+	if total <= 0 && *duration <= 0 {
+		total = len(uploads)
 	}
 
-	if err := r.ParseMultipartForm(32 << 20); err != nil {
-		logError(ctx, "multipart/form-dataの解析に失敗しました: %v", err)
-		http.Error(w, "multipart/form-dataの解析に失敗しました", http.StatusBadRequest)
-		return
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = *concurrency
+	client := &http.Client{Transport: transport, Timeout: *timeout}
+
+	var deadline time.Time
+	if *duration > 0 {
+		deadline = time.Now().Add(*duration)
 	}
 
-	roomIDStr := r.FormValue("room_id")
-	if roomIDStr == "" {
-		logError(ctx, "room_idが指定されていません")
-		http.Error(w, "room_idを指定してください。", http.StatusBadRequest)
-		return
+	var (
+		next      int64
+		mu        sync.Mutex
+		latencies []time.Duration
+		statuses  = make(map[string]int)
+		failures  int
+		wg        sync.WaitGroup
+	)
+	started := time.Now()
+	for w := 0; w < *concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(atomic.AddInt64(&next, 1) - 1)
+				if (total > 0 && i >= total) || (!deadline.IsZero() && time.Now().After(deadline)) {
+					return
+				}
+				upload := uploads[i%len(uploads)]
+				req, err := http.NewRequest(http.MethodPost, *target, bytes.NewReader(upload.body))
+				if err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					return
+				}
+				req.Header.Set("Content-Type", upload.contentType)
+				if *username != "" {
+					req.SetBasicAuth(*username, *password)
+				}
+
+				sent := time.Now()
+				resp, err := client.Do(req)
+				if err == nil {
+					io.Copy(io.Discard, resp.Body)
+					resp.Body.Close()
+				}
+				elapsed := time.Since(sent)
+
+				mu.Lock()
+				latencies = append(latencies, elapsed)
+				if err != nil {
+					failures++
+					statuses["error"]++
+				} else {
+					statuses[strconv.Itoa(resp.StatusCode)]++
+					if resp.StatusCode >= 500 {
+						failures++
+					}
+				}
+				mu.Unlock()
+			}
+		}()
 	}
+	wg.Wait()
+	elapsed := time.Since(started)
 
-	roomID, err := strconv.Atoi(roomIDStr)
-	if err != nil {
-		logError(ctx, "無効なroom_idです: %v", err)
-		http.Error(w, "room_idは整数でなければなりません。", http.StatusBadRequest)
-		return
+	slices.Sort(latencies)
+	percentile := func(p float64) float64 {
+		if len(latencies) == 0 {
+			return 0
+		}
+		i := int(math.Ceil(p*float64(len(latencies)))) - 1
+		return float64(latencies[max(i, 0)]) / float64(time.Millisecond)
+	}
+	report := LoadgenReport{
+		URL:         *target,
+		Concurrency: *concurrency,
+		Uploads:     len(uploads),
+		Requests:    len(latencies),
+		Errors:      failures,
+		Statuses:    statuses,
+		Elapsed:     elapsed.Seconds(),
+		Throughput:  float64(len(latencies)) / elapsed.Seconds(),
+		LatencyP50:  percentile(0.50),
+		LatencyP90:  percentile(0.90),
+		LatencyP99:  percentile(0.99),
+		LatencyMax:  percentile(1),
 	}
 
-	var sampleType string
-	if roomID == 0 {
-		sampleType = "negative"
+	if *asJSON {
+		json.NewEncoder(os.Stdout).Encode(report)
 	} else {
-		sampleType = "positive"
+		counts := make([]string, 0, len(statuses))
+		for code, count := range statuses {
+			counts = append(counts, fmt.Sprintf("%s=%d", code, count))
+		}
+		sort.Strings(counts)
+		fmt.Printf("送信先        : %s（同時 %d 件、アップロード %d 組）\n", report.URL, report.Concurrency, report.Uploads)
+		fmt.Printf("リクエスト数  : %d（エラー %d）\n", report.Requests, report.Errors)
+		fmt.Printf("ステータス    : %s\n", strings.Join(counts, " "))
+		fmt.Printf("所要時間      : %.2fs\n", report.Elapsed)
+		fmt.Printf("スループット  : %.1f req/s\n", report.Throughput)
+		fmt.Printf("レイテンシ    : p50=%.1fms p90=%.1fms p99=%.1fms max=%.1fms\n", report.LatencyP50, report.LatencyP90, report.LatencyP99, report.LatencyMax)
+	}
+	if failures > 0 {
+		return 1
+	}
+	return 0
+}
+
+// commandUsage はサブコマンドの一覧です
+const commandUsage = `使い方: server [サブコマンド] [フラグ]
+
+サブコマンド:
+  serve    サーバーを起動します（省略時）
+  migrate  データベースのマイグレーションを実行して終了します
+  seed     マイグレーションを実行し、開発用の初期データを投入して終了します
+  check    設定と、データベース・ストレージ・ディレクトリへの接続を検証して終了します
+  loadgen  保存済みのアップロードを起動中のサーバーへ同時に送信し、スループットとレイテンシを表示します（server loadgen -h）
+
+フラグ:
+`
+
+func main() {
+	command := "serve"
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), commandUsage)
+		flag.PrintDefaults()
+	}
+	switch command {
+	case "serve", "migrate", "seed", "check":
+	// loadgen は設定ファイルとデータベースを使わないため、設定を読み込む前に実行します
+	case "loadgen":
+		os.Exit(runLoadgen(args))
+	default:
+		fmt.Fprintf(flag.CommandLine.Output(), "不明なサブコマンドです: %s\n\n", command)
+		flag.Usage()
+		os.Exit(2)
 	}
 
-	wifiFile, _, err := r.FormFile("wifi_data")
-	if err != nil {
-		logError(ctx, "wifi_dataファイルの取得に失敗しました: %v", err)
-		http.Error(w, "wifi_dataファイルの取得に失敗しました。", http.StatusBadRequest)
-		return
+	defaultConfigPath := "config.toml"
+	if path := os.Getenv(configEnvPrefix + "CONFIG"); path != "" {
+		defaultConfigPath = path
 	}
-	defer wifiFile.Close()
 
-	bleFile, _, err := r.FormFile("ble_data")
-	if err != nil {
-		logError(ctx, "ble_dataファイルの取得に失敗しました: %v", err)
-		http.Error(w, "ble_dataファイルの取得に失敗しました。", http.StatusBadRequest)
-		return
+	configPath := flag.String("config", defaultConfigPath, "設定ファイルのパス（環境変数 ELPIS_CONFIG でも指定できます）")
+	mode := flag.String("mode", "", "使用するプロファイル（docker・local または [profiles] で定義した名前）。省略時は設定ファイルの mode を使用します")
+	port := flag.String("port", "", "サーバーポート。省略時は設定ファイルの server_port を使用します")
+	migrateOnly := flag.Bool("migrate", false, "migrate サブコマンドと同じです（互換性のために残しています）")
+	flag.CommandLine.Parse(args)
+	if *migrateOnly {
+		command = "migrate"
 	}
-	defer bleFile.Close()
 
-	baseDir := "./estimation"
-	sanitizedRoomID := filepath.Base(roomIDStr)
-	var saveDir string
-	if sampleType == "positive" {
-		saveDir = filepath.Join(baseDir, "positive_samples", sanitizedRoomID)
-	} else {
-		saveDir = filepath.Join(baseDir, "negative_samples", sanitizedRoomID)
+	// 設定の優先順位はコマンドラインフラグ > 環境変数 > 設定ファイルです
+	var config Config
+	if _, err := toml.DecodeFile(*configPath, &config); err != nil {
+		logger = slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+			Level: slog.LevelError,
+		}))
+		logger.Error("設定ファイルの読み取りに失敗しました", "error", err)
+		os.Exit(1)
 	}
 
-	if err := os.MkdirAll(saveDir, os.ModePerm); err != nil {
-		logError(ctx, "保存ディレクトリの作成に失敗しました: %v", err)
-		http.Error(w, "保存ディレクトリの作成に失敗しました。", http.StatusInternalServerError)
-		return
+	envOverrides, err := applyEnvOverrides(&config)
+	if err != nil {
+		logger = slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+			Level: slog.LevelError,
+		}))
+		logger.Error("環境変数による設定の上書きに失敗しました", "error", err)
+		os.Exit(1)
 	}
 
-	managerFingerprintDir := filepath.Join(".", "manager_fingerprint", sanitizedRoomID)
-	if err := os.MkdirAll(managerFingerprintDir, os.ModePerm); err != nil {
-		logError(ctx, "manager_fingerprintディレクトリの作成に失敗しました: %v", err)
-		http.Error(w, "manager_fingerprintディレクトリの作成に失敗しました。", http.StatusInternalServerError)
-		return
+	secrets, err := resolveSecrets(context.Background(), &config)
+	if err != nil {
+		logger = slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+			Level: slog.LevelError,
+		}))
+		logger.Error("秘密情報の読み込みに失敗しました", "error", err)
+		os.Exit(1)
 	}
 
-	timestamp := time.Now().In(loc).Unix()
-	wifiFileName := fmt.Sprintf("wifi_data_%d.csv", timestamp)
-	bleFileName := fmt.Sprintf("ble_data_%d.csv", timestamp)
-
-	wifiFilePath := filepath.Join(saveDir, wifiFileName)
-	bleFilePath := filepath.Join(saveDir, bleFileName)
+	var flagOverrides []string
+	flag.Visit(func(f *flag.Flag) {
+		flagOverrides = append(flagOverrides, f.Name)
+	})
+	if *mode == "" {
+		*mode = config.Mode
+	}
+	if *port == "" {
+		*port = config.ServerPort
+	}
 
-	managerWifiFilePath := filepath.Join(managerFingerprintDir, wifiFileName)
-	managerBleFilePath := filepath.Join(managerFingerprintDir, bleFileName)
+	profile, _ := config.profile(*mode)
+	proxyURLs := []string(profile.ProxyURL)
+	estimationURL := profile.EstimationURL
+	inquiryURL := profile.InquiryURL
+	dbDriver := profile.DBDriver
+	dbConnStr := profile.DBConnStr
+	readDBConnStr := profile.ReadDBConnStr
+	maxOpenConns := profile.MaxOpenConns
+	maxIdleConns := profile.MaxIdleConns
+	connMaxLifetime := profile.ConnMaxLifetime
+	skipRegistration := profile.SkipRegistration
+	autoMigrate := profile.AutoMigrate
+	storageConfig := profile.Storage
 
-	if err := saveUploadedFile(ctx, wifiFile, wifiFilePath); err != nil {
-		logError(ctx, "wifi_dataの保存に失敗しました: %v", err)
-		http.Error(w, "wifi_dataの保存に失敗しました。", http.StatusInternalServerError)
-		return
+	if config.Log.Format == "" {
+		config.Log.Format = "text"
 	}
-	if err := saveUploadedFile(ctx, bleFile, bleFilePath); err != nil {
-		logError(ctx, "ble_dataの保存に失敗しました: %v", err)
-		http.Error(w, "ble_dataの保存に失敗しました。", http.StatusInternalServerError)
-		return
+	applyRuntimeDefaults(&config)
+	if config.Log.Output == "" {
+		config.Log.Output = "stdout"
 	}
-
-	// 追加: ../manager_fingerprint/{room_id} に保存
-	if err := saveUploadedFile(ctx, wifiFile, managerWifiFilePath); err != nil {
-		logError(ctx, "manager_fingerprintへのwifi_dataの保存に失敗しました: %v", err)
-		http.Error(w, "manager_fingerprintへのwifi_dataの保存に失敗しました。", http.StatusInternalServerError)
-		return
+	if config.Log.Access.Format == "" {
+		config.Log.Access.Format = "common"
 	}
-	if err := saveUploadedFile(ctx, bleFile, managerBleFilePath); err != nil {
-		logError(ctx, "manager_fingerprintへのble_dataの保存に失敗しました: %v", err)
-		http.Error(w, "manager_fingerprintへのble_dataの保存に失敗しました。", http.StatusInternalServerError)
-		return
+	if config.Log.Access.Output == "" {
+		config.Log.Access.Output = "stdout"
 	}
-
-	response := UploadResponse{Message: "フィンガープリントデータを正常に受信しました"}
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(response); err != nil {
-		logError(ctx, "JSON応答のエンコードに失敗しました: %v", err)
-		http.Error(w, "応答の作成に失敗しました。", http.StatusInternalServerError)
-		return
+	if config.Log.ResponseBody == nil {
+		responseBody := true
+		config.Log.ResponseBody = &responseBody
+	}
+	if config.Log.ResponseBodyLimit <= 0 {
+		config.Log.ResponseBodyLimit = 1000
+	}
+	if config.Log.Redaction.Enabled == nil {
+		redaction := true
+		config.Log.Redaction.Enabled = &redaction
+	}
+	if config.Log.Redaction.Fields == nil {
+		config.Log.Redaction.Fields = []string{"password", "*token*", "*secret*", "access_key", "user_id", "user_name", "username", "actor", "requester", "target_user_id"}
+	}
+	if config.Log.Redaction.Headers == nil {
+		config.Log.Redaction.Headers = []string{"Authorization", "Cookie"}
 	}
 
-	logInfo(ctx, "フィンガープリントデータを正常に受信しました。サンプルタイプ: %s, RoomID: %s", sampleType, roomIDStr)
-}
-
-func main() {
-	configPath := "config.toml"
-
-	var config Config
-	if _, err := toml.DecodeFile(configPath, &config); err != nil {
+	logOutput, err := openLogOutput(config.Log.Output, config.Log.Rotation)
+	if err == nil {
+		logger, err = newLogger(config.Log, logOutput)
+	}
+	if err != nil {
 		logger = slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
 			Level: slog.LevelError,
 		}))
-		logger.Error("設定ファイルの読み取りに失敗しました", "error", err)
+		logger.Error("ログ出力の初期化に失敗しました", "error", err)
 		os.Exit(1)
 	}
 
-	mode := flag.String("mode", config.Mode, "アプリケーションモード（dockerまたはlocal）")
-	port := flag.String("port", config.ServerPort, "サーバーポート")
-	flag.Parse()
+	// アプリケーションのログと同じ出力先の場合は同じファイルを共有します
+	accessOutput := logOutput
+	if config.Log.Access.Output != config.Log.Output {
+		accessOutput, err = openLogOutput(config.Log.Access.Output, config.Log.Access.Rotation)
+	}
+	var access *accessLogger
+	if err == nil {
+		access, err = newAccessLogger(config.Log.Access.Format, accessOutput)
+	}
+	if err != nil {
+		logger.Error("アクセスログ出力の初期化に失敗しました", "error", err)
+		os.Exit(1)
+	}
 
-	var proxyURL, estimationURL, inquiryURL, dbConnStr string
-	var skipRegistration bool
+	if dbDriver == "" {
+		dbDriver = "postgres"
+	}
 
-	if *mode == "local" {
-		proxyURL = config.Local.ProxyURL
-		estimationURL = config.Local.EstimationURL
-		inquiryURL = config.Local.InquiryURL
-		dbConnStr = config.Local.DBConnStr
-		skipRegistration = config.Local.SkipRegistration
-	} else {
-		proxyURL = config.Docker.ProxyURL
-		estimationURL = config.Docker.EstimationURL
-		inquiryURL = config.Docker.InquiryURL
-		dbConnStr = config.Docker.DBConnStr
-		skipRegistration = config.Docker.SkipRegistration
+	if storageConfig.Backend == "" {
+		storageConfig.Backend = "local"
+	}
+	if storageConfig.Dir == "" {
+		storageConfig.Dir = "."
 	}
 
-	logger = slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
-		Level: slog.LevelInfo,
-	}))
+	if config.NegativeSamples.Dir == "" {
+		config.NegativeSamples.Dir = "./manager_fingerprint/0"
+	}
+	if config.NegativeSamples.Enabled == nil {
+		negativeSamples := true
+		config.NegativeSamples.Enabled = &negativeSamples
+	}
+	if config.NegativeSamples.SampleRate == nil {
+		sampleRate := 1.0
+		config.NegativeSamples.SampleRate = &sampleRate
+	}
+	if config.Reports.Dir == "" {
+		config.Reports.Dir = "./reports"
+	}
+	if config.Session.CleanupInterval <= 0 {
+		config.Session.CleanupInterval = time.Minute
+	}
+	if config.RetentionPolicy.Interval <= 0 {
+		config.RetentionPolicy.Interval = 24 * time.Hour
+	}
+	if config.RetentionPolicy.Categories == nil {
+		config.RetentionPolicy.Categories = make(map[string]RetentionRule)
+	}
+	if _, ok := config.RetentionPolicy.Categories[retentionSessions]; !ok {
+		config.RetentionPolicy.Categories[retentionSessions] = RetentionRule{Months: config.Retention.Months, Archive: config.Retention.Archive}
+	}
+	if _, ok := config.RetentionPolicy.Categories[retentionUploads]; !ok {
+		config.RetentionPolicy.Categories[retentionUploads] = RetentionRule{Days: config.UploadRetention.Days, Archive: config.UploadRetention.Archive}
+	}
+	if config.UploadRetention.ArchiveStorage.Dir == "" {
+		config.UploadRetention.ArchiveStorage.Dir = "./archive"
+	}
+	if config.Quota.RefreshInterval <= 0 {
+		config.Quota.RefreshInterval = 5 * time.Minute
+	}
+	if config.RetryQueue.Interval <= 0 {
+		config.RetryQueue.Interval = 30 * time.Second
+	}
+	if config.RetryQueue.BatchSize <= 0 {
+		config.RetryQueue.BatchSize = 100
+	}
+	if config.PublicDisplay.Mode == "" {
+		config.PublicDisplay.Mode = publicDisplayCount
+	}
+	if config.PrivateStats.MinUsers == 0 {
+		config.PrivateStats.MinUsers = 5
+	}
+	if config.PrivateStats.Epsilon == 0 {
+		config.PrivateStats.Epsilon = 1
+	}
+	if config.Federation.Timeout <= 0 {
+		config.Federation.Timeout = 10 * time.Second
+	}
+	if config.Cluster.InstanceID == "" {
+		config.Cluster.InstanceID = defaultInstanceID()
+	}
+	if config.Cluster.IdempotencyTTL <= 0 {
+		config.Cluster.IdempotencyTTL = 24 * time.Hour
+	}
+	if config.Submit.Workers <= 0 {
+		config.Submit.Workers = 16
+	}
+	if config.Submit.RetryAfter <= 0 {
+		config.Submit.RetryAfter = 5 * time.Second
+	}
+	if config.Submit.MaxScanAge <= 0 {
+		config.Submit.MaxScanAge = 24 * time.Hour
+	}
+	if config.Submit.MaxClockSkew <= 0 {
+		config.Submit.MaxClockSkew = 5 * time.Minute
+	}
+	if config.RouteLimits == nil {
+		config.RouteLimits = maps.Clone(defaultRouteLimits)
+	}
+	for pattern, limit := range config.RouteLimits {
+		if limit.RetryAfter <= 0 {
+			limit.RetryAfter = 5 * time.Second
+			config.RouteLimits[pattern] = limit
+		}
+	}
+	for _, client := range []*HTTPClientConfig{&config.Upstream.Estimation, &config.Upstream.Inquiry} {
+		if client.Timeout <= 0 {
+			client.Timeout = 30 * time.Second
+		}
+		if client.DialTimeout <= 0 {
+			client.DialTimeout = 5 * time.Second
+		}
+		if client.KeepAlive <= 0 {
+			client.KeepAlive = 30 * time.Second
+		}
+		if client.IdleConnTimeout <= 0 {
+			client.IdleConnTimeout = 90 * time.Second
+		}
+		if client.MaxIdleConnsPerHost <= 0 {
+			client.MaxIdleConnsPerHost = config.Submit.Workers
+		}
+	}
+	if config.DeviceCache.RefreshInterval <= 0 {
+		config.DeviceCache.RefreshInterval = time.Minute
+	}
+	if config.EstimationRouting.RefreshInterval <= 0 {
+		config.EstimationRouting.RefreshInterval = time.Minute
+	}
+	if config.Consul.ServiceName == "" {
+		config.Consul.ServiceName = "elpis-manager"
+	}
+	if config.Consul.TTL <= 0 {
+		config.Consul.TTL = 30 * time.Second
+	}
+	if config.MDNS.Service == "" {
+		config.MDNS.Service = "_elpis._tcp"
+	}
+	if config.MDNS.Path == "" {
+		config.MDNS.Path = "/api"
+	}
+	if config.Registration.Scheme == "" {
+		config.Registration.Scheme = "http"
+	}
+	if config.Registration.RemoteConfigInterval <= 0 {
+		config.Registration.RemoteConfigInterval = 5 * time.Minute
+	}
+	if config.Registration.RetryInitial <= 0 {
+		config.Registration.RetryInitial = time.Second
+	}
+	if config.Registration.RetryMaxWait <= 0 {
+		config.Registration.RetryMaxWait = time.Minute
+	}
+	if config.Tracing.ServiceName == "" {
+		config.Tracing.ServiceName = "elpis-manager"
+	}
+	if config.Tracing.SampleRatio <= 0 {
+		config.Tracing.SampleRatio = 1
+	}
 
-	loc, err := time.LoadLocation("Asia/Tokyo")
+	if config.Timezone == "" {
+		config.Timezone = "Asia/Tokyo"
+	}
+	loc, err := time.LoadLocation(config.Timezone)
 	if err != nil {
-		logger.Error("Asia/Tokyoのロケーションの読み込みに失敗しました", "error", err)
+		logger.Error("タイムゾーンの読み込みに失敗しました", "timezone", config.Timezone, "error", err)
 		os.Exit(1)
 	}
 
@@ -1495,158 +17497,464 @@ func main() {
 ==========================================
 	サーバー設定
 -------------------------------------------
-Mode               : %s
+Config Source      : file=%s env=%v flags=%v（優先順位: フラグ > 環境変数 > 設定ファイル）
+Secrets            : %v
+Mode               : %s (profiles=%v)
 Server Port        : %s
-Proxy URL          : %s
+Timezone           : %s
+Proxy URL          : %v
 Estimation URL     : %s
 Inquiry URL        : %s
+Database Driver    : %s
 Database ConnStr   : %s
+Read Replica       : %s
+Database Pool      : max_open=%d max_idle=%d max_lifetime=%s
+Storage            : backend=%s dir=%s endpoint=%s bucket=%s
 Skip Registration  : %v
-System URI         : %s
+System URI         : %s://%s (auth_token=%v heartbeat=%s retry=%s..%s max_attempts=%d)
+Remote Config      : enabled=%v urls=%v interval=%s
+mDNS               : enabled=%v instance=%s service=%s path=%s
+Consul             : enabled=%v address=%s service=%s id=%s tags=%v ttl=%s deregister_after=%s
+Public Display     : enabled=%v mode=%s pseudonym_key=%v
+Private Stats      : enabled=%v min_users=%d epsilon=%g noise_key=%v
+Federation         : enabled=%v timeout=%s sites=%v
+Cluster            : instance_id=%s idempotency_ttl=%s
+Session            : merge_gap=%s inactivity_timeout=%s cleanup_interval=%s
+Negative Samples   : enabled=%v rate=%.2f max=%d dir=%s
+Retention          : months=%d archive=%v
+Upload Retention   : days=%d archive=%v
+Retention Policy   : interval=%s categories=%v
+Storage Encryption : enabled=%v allow_plaintext=%v
+Retry Queue        : enabled=%v interval=%s max_age=%s batch_size=%d
+Quota              : user_bytes=%d room_bytes=%d refresh=%s
+Submit             : workers=%d queue_size=%d retry_after=%s max_records=%d max_scan_age=%s max_clock_skew=%s
+Route Limits       : %v
+Upstream           : estimation=%+v inquiry=%+v
+Estimation Routing : shards=%v refresh=%s
+Device Cache       : enabled=%v refresh=%s
+Device Scan        : interval=%s min_rssi=%d batch=%d hours=%+v buildings=%d
+Tracing            : enabled=%v endpoint=%s service=%s ratio=%.2f
+Debug              : enabled=%v
+Decision           : inquiry_min=%d inquiry_max=%d speculative_inquiry=%v inquiry_win=%s
+CORS               : origins=%v methods=%v headers=%v credentials=%v
+Log                : format=%s level=%s output=%s slow_request=%s slow_query=%s response_body=%v(limit=%d) rotation=max_size_mb=%d interval=%s max_backups=%d max_age_days=%d compress=%v
+Access Log         : format=%s output=%s
+Log Redaction      : enabled=%v fields=%v headers=%v mask_bssid=%v
 ==========================================
-`, *mode, *port, proxyURL, estimationURL, inquiryURL, dbConnStr, skipRegistration, config.Registration.SystemURI)
+`, *configPath, envOverrides, flagOverrides, secrets, *mode, config.profileNames(), *port, config.Timezone, proxyURLs, estimationURL, inquiryURL, dbDriver, redactConnStr(dbConnStr), redactConnStr(readDBConnStr), maxOpenConns, maxIdleConns, connMaxLifetime,
+		storageConfig.Backend, storageConfig.Dir, storageConfig.Endpoint, storageConfig.Bucket, skipRegistration, config.Registration.Scheme, config.Registration.SystemURI, config.Registration.AuthToken != "", config.Registration.HeartbeatInterval, config.Registration.RetryInitial, config.Registration.RetryMaxWait, config.Registration.MaxAttempts,
+		config.Registration.RemoteConfig, remoteConfigURLs(config.Registration, proxyURLs), config.Registration.RemoteConfigInterval,
+		config.MDNS.Enabled, config.MDNS.Instance, config.MDNS.Service, config.MDNS.Path,
+		config.Consul.Enabled, config.Consul.Address, config.Consul.ServiceName, config.Consul.ServiceID, config.Consul.Tags, config.Consul.TTL, config.Consul.DeregisterCriticalAfter,
+		config.PublicDisplay.Enabled, config.PublicDisplay.Mode, config.PublicDisplay.PseudonymKey != "",
+		config.PrivateStats.Enabled, config.PrivateStats.MinUsers, config.PrivateStats.Epsilon, config.PrivateStats.NoiseKey != "",
+		config.Federation.Enabled, config.Federation.Timeout, config.Federation.siteNames(),
+		config.Cluster.InstanceID, config.Cluster.IdempotencyTTL,
+		config.Session.MergeGap, config.Session.InactivityTimeout, config.Session.CleanupInterval,
+		*config.NegativeSamples.Enabled, *config.NegativeSamples.SampleRate, config.NegativeSamples.MaxSamples, config.NegativeSamples.Dir,
+		config.Retention.Months, config.Retention.Archive,
+		config.UploadRetention.Days, config.UploadRetention.Archive,
+		config.RetentionPolicy.Interval, config.RetentionPolicy.Categories,
+		config.StorageEncryption.Enabled, config.StorageEncryption.AllowPlaintext,
+		config.RetryQueue.Enabled, config.RetryQueue.Interval, config.RetryQueue.MaxAge, config.RetryQueue.BatchSize,
+		config.Quota.UserBytes, config.Quota.RoomBytes, config.Quota.RefreshInterval,
+		config.Submit.Workers, config.Submit.QueueSize, config.Submit.RetryAfter, config.Submit.MaxRecords, config.Submit.MaxScanAge, config.Submit.MaxClockSkew,
+		config.RouteLimits,
+		config.Upstream.Estimation, config.Upstream.Inquiry,
+		config.EstimationRouting.shardNames(), config.EstimationRouting.RefreshInterval,
+		config.DeviceCache.Enabled, config.DeviceCache.RefreshInterval,
+		config.DeviceScan.ScanInterval, config.DeviceScan.MinRSSI, config.DeviceScan.UploadBatchSize, config.DeviceScan.Hours, len(config.DeviceScan.Buildings),
+		config.Tracing.Enabled, config.Tracing.Endpoint, config.Tracing.ServiceName, config.Tracing.SampleRatio,
+		config.Debug.Enabled,
+		config.Decision.InquiryMin, config.Decision.InquiryMax, config.Decision.SpeculativeInquiry, config.Decision.InquiryWin,
+		config.CORS.AllowedOrigins, config.CORS.AllowedMethods, config.CORS.AllowedHeaders, *config.CORS.AllowCredentials,
+		config.Log.Format, config.Log.Level, config.Log.Output, config.Log.SlowRequest, config.Log.SlowQuery, *config.Log.ResponseBody, config.Log.ResponseBodyLimit,
+		config.Log.Rotation.MaxSizeMB, config.Log.Rotation.Interval, config.Log.Rotation.MaxBackups, config.Log.Rotation.MaxAgeDays, config.Log.Rotation.Compress,
+		config.Log.Access.Format, config.Log.Access.Output,
+		*config.Log.Redaction.Enabled, config.Log.Redaction.Fields, config.Log.Redaction.Headers, config.Log.Redaction.MaskBSSID)
+
+	problems := validateConfig(context.Background(), config, startupConfig{
+		Mode:             *mode,
+		Port:             *port,
+		ProxyURLs:        proxyURLs,
+		EstimationURL:    estimationURL,
+		InquiryURL:       inquiryURL,
+		DBDriver:         dbDriver,
+		DBConnStr:        dbConnStr,
+		ReadDBConnStr:    readDBConnStr,
+		SkipRegistration: skipRegistration,
+		Storage:          storageConfig,
+	})
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			logError(context.Background(), "設定エラー: %s", problem)
+		}
+		logError(context.Background(), "設定に %d 件の問題があるため起動を中止します", len(problems))
+		os.Exit(1)
+	}
+
+	initialSettings, err := newRuntimeSettings(config, *mode)
+	if err != nil {
+		logError(context.Background(), "設定の読み込みに失敗しました: %v", err)
+		os.Exit(1)
+	}
+	settings.Store(initialSettings)
+	reloader := &configReloader{path: *configPath, mode: *mode}
+	go reloader.watchReloadSignal()
+
+	shutdownTracing, err := setupTracing(context.Background(), config.Tracing)
+	if err != nil {
+		logError(context.Background(), "トレースの初期化に失敗しました: %v", err)
+		os.Exit(1)
+	}
+	defer shutdownTracing(context.Background())
 
-	db, err := sql.Open("postgres", dbConnStr)
+	store, err := openStore(dbDriver, dbConnStr)
 	if err != nil {
 		logError(context.Background(), "データベースへの接続に失敗しました: %v", err)
 		os.Exit(1)
 	}
-	defer db.Close()
+	defer store.Close()
+	store.configurePool(context.Background(), maxOpenConns, maxIdleConns, connMaxLifetime)
 
-	if err := db.Ping(); err != nil {
+	if err := store.PingContext(context.Background()); err != nil {
 		logError(context.Background(), "データベースへのPingに失敗しました: %v", err)
 		os.Exit(1)
 	}
 	logInfo(context.Background(), "データベースに正常に接続しました")
 
-	if !skipRegistration {
-		go func() {
-			serverPortInt, err := strconv.Atoi(*port)
+	// 履歴・統計など読み取り専用のハンドラはリードレプリカが設定されていればそちらへ振り分け、セッションの更新はプライマリで行います
+	readStore := store
+	if readDBConnStr != "" {
+		if store.Driver() == "sqlite" {
+			logInfo(context.Background(), "SQLiteではリードレプリカを使用しないため read_db_conn_str は無視します")
+		} else {
+			readStore, err = openStore(dbDriver, readDBConnStr)
 			if err != nil {
-				logError(context.Background(), "ポート番号の変換に失敗しました: %v", err)
+				logError(context.Background(), "リードレプリカへの接続に失敗しました: %v", err)
 				os.Exit(1)
 			}
+			defer readStore.Close()
+			readStore.configurePool(context.Background(), maxOpenConns, maxIdleConns, connMaxLifetime)
 
-			registerData := RegisterRequest{
-				Scheme: "http",
-				Host:   config.Registration.SystemURI,
-				Port:   serverPortInt,
+			if err := readStore.PingContext(context.Background()); err != nil {
+				logError(context.Background(), "リードレプリカへのPingに失敗しました: %v", err)
+				os.Exit(1)
 			}
+			logInfo(context.Background(), "リードレプリカに正常に接続しました")
+		}
+	}
 
-			for {
-				registerBody, err := json.Marshal(registerData)
-				if err != nil {
-					logError(context.Background(), "登録リクエストのエンコードに失敗しました: %v", err)
-					logInfo(context.Background(), "登録を再試行しています...")
-					time.Sleep(5 * time.Second)
-					continue
-				}
+	if command == "migrate" || command == "seed" || (command == "serve" && autoMigrate) {
+		applied, err := runMigrations(context.Background(), store)
+		if err != nil {
+			logError(context.Background(), "マイグレーションに失敗しました: %v", err)
+			os.Exit(1)
+		}
+		logInfo(context.Background(), "マイグレーションが完了しました。適用件数: %d", applied)
+		if hashed, err := hashLegacyPasswords(context.Background(), store); err != nil {
+			logError(context.Background(), "%v", err)
+			os.Exit(1)
+		} else if hashed > 0 {
+			logInfo(context.Background(), "%d 人のユーザーのパスワードをハッシュに置き換えました", hashed)
+		}
+		if command == "migrate" {
+			return
+		}
+	}
 
-				resp, err := http.Post(proxyURL, "application/json", bytes.NewBuffer(registerBody))
-				if err != nil {
-					logError(context.Background(), "登録エラー: %v", err)
-					logInfo(context.Background(), "登録を再試行しています...")
-					time.Sleep(5 * time.Second)
-					continue
-				}
+	if command == "seed" {
+		seeded, err := seedDevData(context.Background(), store)
+		if err != nil {
+			logError(context.Background(), "%v", err)
+			os.Exit(1)
+		}
+		if seeded {
+			logInfo(context.Background(), "開発用の初期データを投入しました")
+		} else {
+			logInfo(context.Background(), "ユーザーが既に登録されているため初期データの投入を省略しました")
+		}
+		if hashed, err := hashLegacyPasswords(context.Background(), store); err != nil {
+			logError(context.Background(), "%v", err)
+			os.Exit(1)
+		} else if hashed > 0 {
+			logInfo(context.Background(), "%d 人のユーザーのパスワードをハッシュに置き換えました", hashed)
+		}
+		return
+	}
 
-				if resp.StatusCode != http.StatusOK {
-					logError(context.Background(), "サーバーの登録に失敗しました。ステータスコード: %d", resp.StatusCode)
-					resp.Body.Close()
-					logInfo(context.Background(), "登録を再試行しています...")
-					time.Sleep(5 * time.Second)
-					continue
-				}
+	blobs, err := openBlobStore(context.Background(), storageConfig)
+	if err != nil {
+		logError(context.Background(), "ストレージの初期化に失敗しました: %v", err)
+		os.Exit(1)
+	}
 
-				resp.Body.Close()
-				logInfo(context.Background(), "サーバーの登録が完了しました。")
-				break
-			}
-		}()
+	if command == "check" {
+		pending, err := pendingMigrations(context.Background(), store)
+		if err != nil {
+			logError(context.Background(), "%v", err)
+			os.Exit(1)
+		}
+		if len(pending) > 0 {
+			logInfo(context.Background(), "未適用のマイグレーションが %d 件あります: %s", len(pending), strings.Join(pending, ", "))
+		}
+		checkDuplicateOpenSessions(context.Background(), store)
+		logInfo(context.Background(), "設定と接続に問題はありません")
+		return
 	}
 
-	go cleanUpOldSessions(context.Background(), db, 21*time.Minute, loc)
+	var blobCipher cipher.AEAD
+	if config.StorageEncryption.Enabled {
+		blobCipher, err = newBlobCipher(config.StorageEncryption)
+		if err != nil {
+			logError(context.Background(), "%v", err)
+			os.Exit(1)
+		}
+		blobs = &encryptedBlobStore{BlobStore: blobs, aead: blobCipher, allowPlaintext: config.StorageEncryption.AllowPlaintext}
+		if config.StorageEncryption.AllowPlaintext {
+			logger.Warn("[StorageEncryption] allow_plaintext が有効なため、暗号化していないファイルも読み込みます。暗号化する前に保存したファイルがなくなったら無効にしてください")
+		}
+		logger.Warn("推定サーバーが直接読む学習用ファイル（estimation/positive_samples・negative_samples）は暗号化せずに保存します。ディレクトリの権限で保護してください")
+	}
 
-	mux := http.NewServeMux()
+	usage := newStorageUsage(blobs, config.Quota)
+	verifier := newStorageVerifier(store, blobs)
 
-	mux.HandleFunc("/api/users/", func(w http.ResponseWriter, r *http.Request) {
-		id := atomic.AddUint64(&requestID, 1)
-		ctx := context.WithValue(r.Context(), requestIDKey, id)
-		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
-		if len(parts) == 4 && parts[0] == "api" && parts[1] == "users" && parts[3] == "presence_history" && r.Method == http.MethodGet {
-			userIDStr := parts[2]
-			userID, err := strconv.Atoi(userIDStr)
-			if err != nil {
-				logError(ctx, "無効なユーザーIDです: %v", err)
-				http.Error(w, "無効なユーザーIDです", http.StatusBadRequest)
-				return
-			}
-			handleUserPresenceHistory(w, r, ctx, db, userID, loc)
-			return
+	var uploadArchive BlobStore
+	if config.uploadArchiveEnabled() {
+		uploadArchive, err = openBlobStore(context.Background(), config.UploadRetention.ArchiveStorage)
+		if err != nil {
+			logError(context.Background(), "アーカイブ用ストレージの初期化に失敗しました: %v", err)
+			os.Exit(1)
 		}
-		http.NotFound(w, r)
-	})
+		if blobCipher != nil {
+			uploadArchive = &encryptedBlobStore{BlobStore: uploadArchive, aead: blobCipher, allowPlaintext: config.StorageEncryption.AllowPlaintext}
+		}
+	}
 
-	mux.HandleFunc("/api/presence_history", func(w http.ResponseWriter, r *http.Request) {
-		id := atomic.AddUint64(&requestID, 1)
-		ctx := context.WithValue(r.Context(), requestIDKey, id)
-		if r.Method != http.MethodGet {
-			logError(ctx, "許可されていないメソッドです: %s", r.Method)
-			http.Error(w, "許可されていないメソッドです", http.StatusMethodNotAllowed)
-			return
+	var registrations []*registrar
+	registrationCtx, stopRegistration := context.WithCancel(context.Background())
+	defer stopRegistration()
+	if !skipRegistration {
+		serverPortInt, err := strconv.Atoi(*port)
+		if err != nil {
+			logError(context.Background(), "ポート番号の変換に失敗しました: %v", err)
+			os.Exit(1)
 		}
-		handlePresenceHistory(w, r, ctx, db, loc)
-	})
 
-	mux.HandleFunc("/api/current_occupants", func(w http.ResponseWriter, r *http.Request) {
-		id := atomic.AddUint64(&requestID, 1)
-		ctx := context.WithValue(r.Context(), requestIDKey, id)
-		if r.Method != http.MethodGet {
-			logError(ctx, "許可されていないメソッドです: %s", r.Method)
-			http.Error(w, "許可されていないメソッドです", http.StatusMethodNotAllowed)
-			return
+		// 冗長構成のプロキシそれぞれに登録し、1台が停止しても他のプロキシから転送されるようにします
+		for _, proxyURL := range proxyURLs {
+			registration := newRegistrar(proxyURL, RegisterRequest{
+				Scheme: config.Registration.Scheme,
+				Host:   config.Registration.SystemURI,
+				Port:   serverPortInt,
+			}, config.Registration.AuthToken)
+			registrations = append(registrations, registration)
+			go registration.run(registrationCtx, config.Registration)
 		}
-		handleCurrentOccupants(w, r, ctx, db)
-	})
 
-	mux.HandleFunc("/api/signals/submit", func(w http.ResponseWriter, r *http.Request) {
-		id := atomic.AddUint64(&requestID, 1)
-		ctx := context.WithValue(r.Context(), requestIDKey, id)
-		handleSignalsSubmit(w, r, ctx, db, estimationURL, inquiryURL, loc)
-	})
+		if config.Registration.RemoteConfig {
+			go pollRemoteConfig(registrationCtx, reloader, remoteConfigURLs(config.Registration, proxyURLs), config.Registration.AuthToken, config.Registration.RemoteConfigInterval)
+		}
+	}
 
-	mux.HandleFunc("/api/signals/server", func(w http.ResponseWriter, r *http.Request) {
-		id := atomic.AddUint64(&requestID, 1)
-		ctx := context.WithValue(r.Context(), requestIDKey, id)
-		handleSignalsServer(w, r, ctx, db, estimationURL, inquiryURL)
-	})
+	var announcer *mdnsAnnouncer
+	if config.MDNS.Enabled {
+		serverPortInt, err := strconv.Atoi(*port)
+		if err != nil {
+			logError(context.Background(), "ポート番号の変換に失敗しました: %v", err)
+			os.Exit(1)
+		}
+		announcer, err = newMDNSAnnouncer(config.MDNS, serverPortInt)
+		if err != nil {
+			logError(context.Background(), "mDNS による告知を開始できません: %v", err)
+			os.Exit(1)
+		}
+		go announcer.run(registrationCtx)
+		logInfo(context.Background(), "mDNS で %s として告知しています", announcer.instance)
+	}
 
-	mux.HandleFunc("/api/fingerprint/collect", func(w http.ResponseWriter, r *http.Request) {
-		id := atomic.AddUint64(&requestID, 1)
-		ctx := context.WithValue(r.Context(), requestIDKey, id)
-		handleFingerprintCollect(w, r, ctx, loc)
-	})
+	var consul *consulRegistrar
+	if config.Consul.Enabled {
+		serverPortInt, err := strconv.Atoi(*port)
+		if err != nil {
+			logError(context.Background(), "ポート番号の変換に失敗しました: %v", err)
+			os.Exit(1)
+		}
+		consul, err = newConsulRegistrar(config.Consul, serverPortInt)
+		if err != nil {
+			logError(context.Background(), "Consulへの登録を開始できません: %v", err)
+			os.Exit(1)
+		}
+		go consul.run(registrationCtx, config.Consul.TTL)
+	}
 
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		id := atomic.AddUint64(&requestID, 1)
-		ctx := context.WithValue(r.Context(), requestIDKey, id)
-		handleHealthCheck(w, r, ctx, db, loc)
+	checkDuplicateOpenSessions(context.Background(), store)
+	leases := newJobLeases(store, config.Cluster.InstanceID)
+	go cleanUpOldSessions(context.Background(), store, store, store, leases, config.Session.CleanupInterval, loc)
+	go cleanUpIdempotencyKeys(context.Background(), store, leases, config.Cluster.IdempotencyTTL, time.Hour)
+
+	retention := newRetentionEnforcer(store, store, store, store, blobs, uploadArchive, config.RetentionPolicy, loc)
+	go retention.schedule(context.Background(), leases)
+
+	if config.Reports.ScheduleEnabled {
+		if store.Driver() == "postgres" {
+			go generateMonthlyReports(context.Background(), readStore, store, config.Reports, loc)
+		} else {
+			logInfo(context.Background(), "データベースドライバ %s では月次レポートの自動生成を行いません", store.Driver())
+		}
+	}
+
+	submitPool := newWorkerPool(config.Submit.Workers, config.Submit.QueueSize)
+	estimationClient = newHTTPClient(config.Upstream.Estimation)
+	inquiryClient = newHTTPClient(config.Upstream.Inquiry)
+	limits := newRouteLimits(config.RouteLimits)
+
+	var devices DeviceStore = store
+	var devicesCache *deviceCache
+	if config.DeviceCache.Enabled {
+		devicesCache = newDeviceCache(store)
+		if err := devicesCache.refresh(context.Background()); err != nil {
+			logError(context.Background(), "%v（読み込めるまでデータベースに問い合わせます）", err)
+		}
+		go devicesCache.run(context.Background(), config.DeviceCache.RefreshInterval)
+		devices = devicesCache
+	}
+	estimationRoutes = newEstimationRouter(store, config.EstimationRouting)
+	if estimationRoutes != nil {
+		if err := estimationRoutes.refresh(context.Background()); err != nil {
+			logError(context.Background(), "%v（読み込めるまで rooms で指定したルームだけを振り分けます）", err)
+		}
+		go estimationRoutes.run(context.Background(), config.EstimationRouting.RefreshInterval)
+	}
+
+	signals := signalDeps{presence: store, userDevices: store, devices: devices, uploads: store, orgs: store, tenants: store, blobs: blobs, usage: usage}
+	// リトライキューを無効にした場合も、有効だった間に保存した送信は再送します
+	replay := signals
+	replay.queue = store
+	go replayQueuedSubmissions(context.Background(), replay, leases, config.RetryQueue, config.Session.MergeGap, config.NegativeSamples, loc)
+	if config.RetryQueue.Enabled {
+		signals.queue = store
+	}
+
+	apiSpec, err := openAPIDocument(openAPISpec)
+	if err != nil {
+		logError(context.Background(), "APIの仕様の読み込みに失敗しました: %v", err)
+		os.Exit(1)
+	}
+
+	if config.Debug.Enabled {
+		publishDebugVars(submitPool, limits, devicesCache)
+	}
+
+	mux := newRouteMux()
+	registerRoutes(mux, routeDeps{
+		config:        config,
+		store:         store,
+		readStore:     readStore,
+		devices:       devices,
+		devicesCache:  devicesCache,
+		signals:       signals,
+		blobs:         blobs,
+		uploadArchive: uploadArchive,
+		usage:         usage,
+		verifier:      verifier,
+		retention:     retention,
+		reloader:      reloader,
+		submitPool:    submitPool,
+		apiSpec:       apiSpec,
+		loc:           loc,
 	})
 
-	loggedMux := loggingMiddleware(mux)
+	undocumented, unrouted, err := checkOpenAPIRoutes(openAPISpec, mux.patterns)
+	if err != nil {
+		logError(context.Background(), "APIの仕様とルートの照合に失敗しました: %v", err)
+	}
+	for _, pattern := range undocumented {
+		logger.Warn("APIの仕様（openapi.json）に記載されていないルートです", "pattern", pattern)
+	}
+	for _, specPath := range unrouted {
+		logger.Warn("APIの仕様（openapi.json）に記載したパスに一致するルートがありません", "path", specPath)
+	}
+
+	responseBodyLimit := config.Log.ResponseBodyLimit
+	if !*config.Log.ResponseBody {
+		responseBodyLimit = 0
+	}
+	loggedMux := loggingMiddleware(authenticateRequests(orgMiddleware(limitRoutes(mux, limits), store, store, store, loc), store, newCredentialCache()), access, responseBodyLimit, newLogRedactor(config.Log.Redaction))
+	tracedMux := otelhttp.NewHandler(apiVersions(loggedMux), "elpis-manager", otelhttp.WithSpanNameFormatter(func(operation string, r *http.Request) string {
+		return r.Method + " " + r.URL.Path
+	}))
 
 	corsHandler := cors.New(cors.Options{
-		AllowedOrigins:   []string{"http://localhost:5173", "https://elpis.kajilab.dev", "https://elpis-a.kajilab.dev", "https://elpis-b.kajilab.dev"},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Content-Type", "Authorization"},
-		AllowCredentials: true,
+		AllowOriginFunc: func(origin string) bool {
+			return corsOriginAllowed(currentSettings().CORSOrigins, origin)
+		},
+		AllowedMethods:   config.CORS.AllowedMethods,
+		AllowedHeaders:   config.CORS.AllowedHeaders,
+		AllowCredentials: *config.CORS.AllowCredentials,
 	})
 
-	finalHandler := corsHandler.Handler(loggedMux)
+	finalHandler := corsHandler.Handler(tracedMux)
+
+	server := &http.Server{Addr: ":" + *port, Handler: finalHandler}
+	signalCtx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
 
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
 	logInfo(context.Background(), "ポート %s でサーバーを開始します。モード: %s", *port, *mode)
-	if err := http.ListenAndServe(":"+*port, finalHandler); err != nil {
+
+	select {
+	case err := <-serverErr:
 		logError(context.Background(), "サーバーの起動に失敗しました: %v", err)
 		os.Exit(1)
+	case <-signalCtx.Done():
+	}
+
+	// 先にプロキシから登録を削除して新しいリクエストが転送されないようにしてから、処理中のリクエストの完了を待ちます
+	logInfo(context.Background(), "終了シグナルを受信しました。サーバーを停止します")
+	stopRegistration()
+	if len(registrations) > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		var wg sync.WaitGroup
+		for _, registration := range registrations {
+			wg.Add(1)
+			go func(registration *registrar) {
+				defer wg.Done()
+				if err := registration.deregister(ctx); err != nil {
+					logError(ctx, "プロキシからの登録の削除に失敗しました: %v", err)
+					return
+				}
+				setRegistrationState(registration.proxyURL, registrationDeregistered)
+				logInfo(ctx, "プロキシ %s からの登録を削除しました", registration.proxyURL)
+			}(registration)
+		}
+		wg.Wait()
+		cancel()
+	}
+	if consul != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := consul.deregister(ctx); err != nil {
+			logError(ctx, "Consulからのサービスの削除に失敗しました: %v", err)
+		} else {
+			setRegistrationState(consul.address+"#"+consul.service.ID, registrationDeregistered)
+			logInfo(ctx, "Consulからサービス %s を削除しました", consul.service.ID)
+		}
+		cancel()
+	}
+	if announcer != nil {
+		if err := announcer.goodbye(); err != nil {
+			logError(context.Background(), "mDNS の告知の取り消しに失敗しました: %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		logError(ctx, "処理中のリクエストの完了を待てませんでした: %v", err)
 	}
+	logInfo(context.Background(), "サーバーを停止しました")
 }
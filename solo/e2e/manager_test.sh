@@ -20,9 +20,9 @@ SAMPLE_DIRS=(
     "./echo_estimation/positive_samples"
 )
 
-# Basic認証のユーザー名とパスワード（パスワードは不要ですが、curlの仕様上指定が必要です）
+# Basic認証のユーザー名とパスワード（マネージャーはパスワードを確認するため、初期データのパスワードを指定します）
 BASIC_AUTH_USER="hihumikan"
-BASIC_AUTH_PASS="password"  # 任意の値
+BASIC_AUTH_PASS="password2"
 
 # 環境選択のメニュー
 ENVIRONMENTS=(
@@ -0,0 +1,16 @@
+ALTER TABLE user_presence_sessions ADD COLUMN IF NOT EXISTS estimation_confidence INT;
+
+ALTER TABLE user_presence_sessions ADD COLUMN IF NOT EXISTS inquiry_confidence INT;
+
+CREATE TABLE IF NOT EXISTS
+    presence_decisions (
+        decision_id SERIAL PRIMARY KEY,
+        user_id INT REFERENCES Users (id),
+        room_id INT REFERENCES rooms (room_id),
+        estimation_confidence INT NOT NULL,
+        inquiry_confidence INT,
+        decision VARCHAR(20) NOT NULL,
+        decided_at TIMESTAMP NOT NULL
+    );
+
+CREATE INDEX IF NOT EXISTS idx_presence_decisions_user_id_decided_at ON presence_decisions (user_id, decided_at);
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS
+    admin_audit_log (
+        audit_id SERIAL PRIMARY KEY,
+        actor VARCHAR(20) NOT NULL,
+        action VARCHAR(50) NOT NULL,
+        target VARCHAR(100) NOT NULL,
+        detail TEXT,
+        created_at TIMESTAMP NOT NULL
+    );
+
+CREATE INDEX IF NOT EXISTS idx_admin_audit_log_created_at ON admin_audit_log (created_at);
@@ -0,0 +1 @@
+ALTER TABLE fingerprint_samples ADD COLUMN IF NOT EXISTS collected_by VARCHAR(20) NOT NULL DEFAULT '';
@@ -0,0 +1 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS tracking_paused_until TIMESTAMP;
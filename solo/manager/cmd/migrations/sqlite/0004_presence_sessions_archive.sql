@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS
+    user_presence_sessions_archive (
+        session_id INT PRIMARY KEY,
+        user_id INT,
+        room_id INT,
+        start_time TIMESTAMP NOT NULL,
+        end_time TIMESTAMP,
+        last_seen TIMESTAMP NOT NULL,
+        estimation_confidence INT,
+        inquiry_confidence INT,
+        archived_at TIMESTAMP NOT NULL
+    );
+
+CREATE INDEX IF NOT EXISTS idx_user_presence_sessions_archive_start_time ON user_presence_sessions_archive (start_time);
@@ -0,0 +1 @@
+ALTER TABLE fingerprint_samples ADD COLUMN collected_by VARCHAR(20) NOT NULL DEFAULT '';
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS
+    dataset_snapshots (
+        snapshot_id INTEGER PRIMARY KEY AUTOINCREMENT,
+        name VARCHAR(100) NOT NULL UNIQUE,
+        description TEXT NOT NULL DEFAULT '',
+        created_by VARCHAR(20) NOT NULL,
+        created_at TIMESTAMP NOT NULL,
+        sample_count INT NOT NULL,
+        manifest TEXT NOT NULL
+    );
@@ -0,0 +1,3 @@
+ALTER TABLE users ADD COLUMN tracking_consent BOOLEAN NOT NULL DEFAULT TRUE;
+
+ALTER TABLE users ADD COLUMN consent_updated_at TIMESTAMP;
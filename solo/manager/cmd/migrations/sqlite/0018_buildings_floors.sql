@@ -0,0 +1,22 @@
+CREATE TABLE IF NOT EXISTS
+    buildings (
+        building_id INTEGER PRIMARY KEY AUTOINCREMENT,
+        name VARCHAR(100) NOT NULL,
+        org_id INT NOT NULL DEFAULT 1
+    );
+
+CREATE TABLE IF NOT EXISTS
+    floors (
+        floor_id INTEGER PRIMARY KEY AUTOINCREMENT,
+        building_id INT NOT NULL REFERENCES buildings (building_id),
+        name VARCHAR(100) NOT NULL,
+        level INT NOT NULL DEFAULT 0
+    );
+
+ALTER TABLE rooms ADD COLUMN floor_id INT REFERENCES floors (floor_id);
+
+CREATE INDEX IF NOT EXISTS idx_buildings_org_id ON buildings (org_id);
+
+CREATE INDEX IF NOT EXISTS idx_floors_building_id ON floors (building_id);
+
+CREATE INDEX IF NOT EXISTS idx_rooms_floor_id ON rooms (floor_id);
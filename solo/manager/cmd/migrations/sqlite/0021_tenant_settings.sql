@@ -0,0 +1,8 @@
+-- 組織ごとに設定ファイルの値を上書きする設定（settings は TenantSettings のJSON）
+CREATE TABLE IF NOT EXISTS
+    tenant_settings (
+        org_id INT PRIMARY KEY,
+        settings TEXT NOT NULL,
+        updated_by VARCHAR(20) NOT NULL,
+        updated_at TIMESTAMP NOT NULL
+    );
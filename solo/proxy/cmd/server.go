@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"crypto/subtle"
 	"database/sql"
 	"encoding/csv"
 	"encoding/json"
@@ -9,8 +10,10 @@ import (
 	"io"
 	"log"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"os"
+	"regexp"
 	"strings"
 	"sync"
 	"time"
@@ -27,6 +30,18 @@ type Config struct {
 	Server struct {
 		Port int `toml:"port"`
 	} `toml:"server"`
+	Register struct {
+		AuthToken string `toml:"auth_token"`
+	} `toml:"register"`
+	Shared SharedConfig `toml:"shared"`
+}
+
+// SharedConfig は /api/config でマネージャーに配布する共有設定です。指定のない項目はマネージャーの設定ファイルの値が使われます
+type SharedConfig struct {
+	InquiryMin        *int     `toml:"inquiry_min" json:"inquiry_min,omitempty"`
+	InquiryMax        *int     `toml:"inquiry_max" json:"inquiry_max,omitempty"`
+	InactivityTimeout string   `toml:"inactivity_timeout" json:"inactivity_timeout,omitempty"`
+	CORSOrigins       []string `toml:"cors_origins" json:"cors_origins,omitempty"`
 }
 
 type RegisterRequest struct {
@@ -59,6 +74,11 @@ var (
 	client       = &http.Client{Timeout: 10 * time.Second}
 	queryCounter int
 	counterMutex = &sync.Mutex{}
+	// 外部から受け取るリクエストIDとして許可する形式
+	requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:+/=-]{1,128}$`)
+	// 空でない場合、/api/register は Authorization: Bearer ヘッダーにこの値を持つリクエストのみ受け付けます
+	registerAuthToken string
+	sharedConfig      SharedConfig
 )
 
 func init() {
@@ -72,6 +92,12 @@ func main() {
 		log.Fatalf("[FATAL] 設定ファイルの読み込みエラー: %v", err)
 	}
 
+	registerAuthToken = config.Register.AuthToken
+	sharedConfig = config.Shared
+	if registerAuthToken == "" {
+		log.Printf("[WARN] register.auth_token が設定されていません。/api/register は認証なしで受け付けます（登録の削除は登録したホストからのみ受け付けます）")
+	}
+
 	var err error
 	db, err = sql.Open("postgres", config.Database.ConnStr)
 	if err != nil {
@@ -86,6 +112,7 @@ func main() {
 
 	http.HandleFunc("/api/register", registerHandler)
 	http.HandleFunc("/api/inquiry", inquiryHandler)
+	http.HandleFunc("/api/config", configHandler)
 
 	go cleanupCache()
 
@@ -96,21 +123,78 @@ func main() {
 	}
 }
 
+// requestIDFromHeader はリクエストの X-Request-ID を返します。指定がないか形式が不正な場合はUUIDを発行します
+func requestIDFromHeader(r *http.Request) string {
+	if id := r.Header.Get("X-Request-ID"); requestIDPattern.MatchString(id) {
+		return id
+	}
+	return uuid.New().String()
+}
+
 func registerHandler(w http.ResponseWriter, r *http.Request) {
-	requestID := uuid.New().String()
+	requestID := requestIDFromHeader(r)
+	w.Header().Set("X-Request-ID", requestID)
 	log.Printf("[REQUEST_ID: %s] /api/register エンドポイントにアクセスされました。メソッド: %s", requestID, r.Method)
 
+	if !registrationAuthorized(r) {
+		log.Printf("[REQUEST_ID: %s][ERROR] 登録トークンが一致しません。送信元: %s", requestID, r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="elpis-proxy"`)
+		http.Error(w, "認証に失敗しました", http.StatusUnauthorized)
+		return
+	}
+
 	switch r.Method {
 	case http.MethodPost:
 		handleRegisterPost(w, r, requestID)
 	case http.MethodGet:
 		handleRegisterGet(w, r, requestID)
+	case http.MethodPut:
+		handleRegisterPut(w, r, requestID)
+	case http.MethodDelete:
+		handleRegisterDelete(w, r, requestID)
 	default:
 		log.Printf("[REQUEST_ID: %s] 許可されていないメソッド: %s, パス: %s", requestID, r.Method, r.URL.Path)
 		http.Error(w, "許可されていないメソッドです", http.StatusMethodNotAllowed)
 	}
 }
 
+// configHandler は登録済みのマネージャーに共有設定を返します。登録と同じトークンで認証します
+func configHandler(w http.ResponseWriter, r *http.Request) {
+	requestID := requestIDFromHeader(r)
+	w.Header().Set("X-Request-ID", requestID)
+
+	if r.Method != http.MethodGet {
+		log.Printf("[REQUEST_ID: %s] 許可されていないメソッド: %s, パス: %s", requestID, r.Method, r.URL.Path)
+		http.Error(w, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+		return
+	}
+	if !registrationAuthorized(r) {
+		log.Printf("[REQUEST_ID: %s][ERROR] 登録トークンが一致しません。送信元: %s", requestID, r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="elpis-proxy"`)
+		http.Error(w, "認証に失敗しました", http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(sharedConfig); err != nil {
+		log.Printf("[REQUEST_ID: %s][ERROR] JSONエンコードエラー: %v", requestID, err)
+		http.Error(w, "JSONエンコードエラー", http.StatusInternalServerError)
+		return
+	}
+}
+
+// registrationAuthorized はリクエストが登録トークンを持っているかを返します。トークンが未設定の場合は常に true です
+func registrationAuthorized(r *http.Request) bool {
+	if registerAuthToken == "" {
+		return true
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(registerAuthToken)) == 1
+}
+
 func handleRegisterPost(w http.ResponseWriter, r *http.Request, requestID string) {
 	log.Printf("[REQUEST_ID: %s] POST /api/register リクエストの処理を開始します。", requestID)
 
@@ -167,6 +251,123 @@ func handleRegisterPost(w http.ResponseWriter, r *http.Request, requestID string
 	log.Printf("[REQUEST_ID: %s] POST /api/register レスポンスをクライアントに送信しました。レスポンス内容: %+v", requestID, resp)
 }
 
+// handleRegisterPut はマネージャーからのハートビートを受け取り、登録の最終更新時刻を延長します。
+// 登録がない場合は 404 を返し、マネージャーに登録をやり直させます
+func handleRegisterPut(w http.ResponseWriter, r *http.Request, requestID string) {
+	var req RegisterRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Printf("[REQUEST_ID: %s][ERROR] JSONデコードエラー: %v", requestID, err)
+		http.Error(w, "リクエストの形式が正しくありません", http.StatusBadRequest)
+		return
+	}
+
+	if req.Host == "" {
+		log.Printf("[REQUEST_ID: %s][ERROR] ホストが指定されていません", requestID)
+		http.Error(w, "ホストは必須です", http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.Exec(`UPDATE organizations SET last_updated = CURRENT_TIMESTAMP WHERE api_endpoint = $1`, req.Host)
+	if err != nil {
+		log.Printf("[REQUEST_ID: %s][ERROR] データベースエラー: %v", requestID, err)
+		http.Error(w, "内部サーバーエラーが発生しました", http.StatusInternalServerError)
+		return
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		log.Printf("[REQUEST_ID: %s][ERROR] RowsAffected の取得に失敗しました: %v", requestID, err)
+		http.Error(w, "内部サーバーエラーが発生しました", http.StatusInternalServerError)
+		return
+	}
+	if rowsAffected == 0 {
+		log.Printf("[REQUEST_ID: %s] 登録されていないホストからのハートビートです。ホスト: %s", requestID, req.Host)
+		http.Error(w, "登録されていません", http.StatusNotFound)
+		return
+	}
+
+	resp := RegisterResponse{
+		Message: "Success",
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("[REQUEST_ID: %s][ERROR] JSONエンコードエラー: %v", requestID, err)
+		http.Error(w, "JSONエンコードエラー", http.StatusInternalServerError)
+		return
+	}
+}
+
+// handleRegisterDelete は停止するマネージャーの登録を削除し、以降の問い合わせの転送先から外します
+func handleRegisterDelete(w http.ResponseWriter, r *http.Request, requestID string) {
+	log.Printf("[REQUEST_ID: %s] DELETE /api/register リクエストの処理を開始します。", requestID)
+
+	var req RegisterRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Printf("[REQUEST_ID: %s][ERROR] JSONデコードエラー: %v", requestID, err)
+		http.Error(w, "リクエストの形式が正しくありません", http.StatusBadRequest)
+		return
+	}
+
+	if req.Host == "" {
+		log.Printf("[REQUEST_ID: %s][ERROR] ホストが指定されていません", requestID)
+		http.Error(w, "ホストは必須です", http.StatusBadRequest)
+		return
+	}
+
+	// トークンを設定していない場合は誰でも登録を削除できてしまうため、登録したホスト自身からの要求のみ受け付けます
+	if registerAuthToken == "" && !requestFromHost(r, req.Host) {
+		log.Printf("[REQUEST_ID: %s][ERROR] 登録したホスト以外からの削除要求です。ホスト: %s, 送信元: %s", requestID, req.Host, r.RemoteAddr)
+		http.Error(w, "登録したホスト以外から登録を削除することはできません", http.StatusForbidden)
+		return
+	}
+
+	result, err := db.Exec(`DELETE FROM organizations WHERE api_endpoint = $1`, req.Host)
+	if err != nil {
+		log.Printf("[REQUEST_ID: %s][ERROR] データベースエラー: %v", requestID, err)
+		http.Error(w, "内部サーバーエラーが発生しました", http.StatusInternalServerError)
+		return
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		log.Printf("[REQUEST_ID: %s][ERROR] RowsAffected の取得に失敗しました: %v", requestID, err)
+	} else {
+		log.Printf("[REQUEST_ID: %s] 登録を削除しました。ホスト: %s, 影響を受けた行数: %d", requestID, req.Host, rowsAffected)
+	}
+
+	resp := RegisterResponse{
+		Message: "Success",
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("[REQUEST_ID: %s][ERROR] JSONエンコードエラー: %v", requestID, err)
+		http.Error(w, "JSONエンコードエラー", http.StatusInternalServerError)
+		return
+	}
+}
+
+// requestFromHost はリクエストの送信元アドレスが host を名前解決したアドレスのいずれかと一致するかを返します
+func requestFromHost(r *http.Request, host string) bool {
+	remote, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	remoteIP := net.ParseIP(remote)
+	if remoteIP == nil {
+		return false
+	}
+	addrs, err := net.DefaultResolver.LookupHost(r.Context(), host)
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ip := net.ParseIP(addr); ip != nil && ip.Equal(remoteIP) {
+			return true
+		}
+	}
+	return false
+}
+
 func handleRegisterGet(w http.ResponseWriter, r *http.Request, requestID string) {
 	log.Printf("[REQUEST_ID: %s] GET /api/register リクエストの処理を開始します。", requestID)
 
@@ -217,7 +418,8 @@ func handleRegisterGet(w http.ResponseWriter, r *http.Request, requestID string)
 }
 
 func inquiryHandler(w http.ResponseWriter, r *http.Request) {
-	requestID := uuid.New().String()
+	requestID := requestIDFromHeader(r)
+	w.Header().Set("X-Request-ID", requestID)
 	log.Printf("[REQUEST_ID: %s] /api/inquiry エンドポイントにアクセスされました。メソッド: %s", requestID, r.Method)
 
 	if r.Method != http.MethodPost {
@@ -406,6 +608,7 @@ func querySystem(systemURI string, port int, wifiData, bleData [][]string, reque
 		return 0, fmt.Errorf("リクエストの作成に失敗しました: %v", err)
 	}
 	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("X-Request-ID", requestID)
 
 	log.Printf("[REQUEST_ID: %s] クエリ用リクエストヘッダー: %v", requestID, req.Header)
 